@@ -0,0 +1,55 @@
+package rsbackup
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// acmeManager returns the manager obtaining and renewing certificates for
+// c.ACMEHosts. Certificates and the account key are cached in the state
+// directory, so restarts don't request new ones.
+func (c *Config) acmeManager() *autocert.Manager {
+	m := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(c.ACMEHosts...),
+		Cache:      autocert.DirCache(c.StatePath("acme")),
+		Email:      c.ACMEEmail,
+	}
+	if c.ACMEDirectoryURL != "" {
+		m.Client = &acme.Client{DirectoryURL: c.ACMEDirectoryURL}
+	}
+	return m
+}
+
+// useACME sets conf up to get its certificates from m, answering
+// TLS-ALPN-01 challenges on the server's own port. With ACMEHTTPAddress
+// set, HTTP-01 challenges are answered there as well, and other plain
+// HTTP requests are redirected to HTTPS.
+func (r *RSBackupAPI) useACME(conf *tls.Config, m *autocert.Manager) {
+	conf.GetCertificate = m.GetCertificate
+	conf.NextProtos = append(conf.NextProtos, "h2", "http/1.1", acme.ALPNProto)
+	if r.Config.ACMEHTTPAddress == "" {
+		return
+	}
+	challenges := &http.Server{
+		Addr:              r.Config.ACMEHTTPAddress,
+		Handler:           m.HTTPHandler(nil),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		err := challenges.ListenAndServe()
+		if err != nil && err != http.ErrServerClosed {
+			log.Errorf("ACME HTTP-01 listener on %s failed: %s", r.Config.ACMEHTTPAddress, err)
+		}
+	}()
+	r.OnShutdown("ACME HTTP-01 listener", func(ctx context.Context) error {
+		return challenges.Shutdown(ctx)
+	})
+}
@@ -0,0 +1,60 @@
+package rsbackup
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/acme"
+)
+
+func TestACME(t *testing.T) {
+	tmpDir := createTMPDir(t, "rsbackup")
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	httpAddress := listener.Addr().String()
+	listener.Close()
+	config := &Config{BackupRoot: tmpDir, ACMEHosts: []string{"backup.example.com"}, ACMEHTTPAddress: httpAddress}
+	m := config.acmeManager()
+	if err := m.HostPolicy(context.Background(), "backup.example.com"); err != nil {
+		t.Errorf("Configured host refused: %s", err)
+	}
+	if err := m.HostPolicy(context.Background(), "other.example.com"); err == nil {
+		t.Errorf("Accepted a host that isn't configured")
+	}
+
+	api := &RSBackupAPI{Config: config}
+	conf := &tls.Config{}
+	api.useACME(conf, m)
+	defer api.Stop()
+	if conf.GetCertificate == nil || conf.NextProtos[len(conf.NextProtos)-1] != acme.ALPNProto {
+		t.Errorf("TLS config can't answer TLS-ALPN-01 challenges, protocols %v", conf.NextProtos)
+	}
+
+	// Plain HTTP requests besides challenges are sent to HTTPS.
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	var rsp *http.Response
+	for i := 0; i < 50; i++ {
+		req, _ := http.NewRequest("GET", "http://"+httpAddress+"/list_data", nil)
+		req.Host = "backup.example.com"
+		rsp, err = client.Do(req)
+		if err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsp.Body.Close()
+	if rsp.StatusCode != http.StatusFound || rsp.Header.Get("Location") != "https://backup.example.com/list_data" {
+		t.Errorf("Got status code %d and location '%s'", rsp.StatusCode, rsp.Header.Get("Location"))
+	}
+}
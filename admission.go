@@ -0,0 +1,32 @@
+package rsbackup
+
+import (
+	"net/http"
+)
+
+// ingestRetryAfter is the Retry-After, in seconds, of uploads refused for
+// lack of room. Bursts of uploads are usually short.
+const ingestRetryAfter = "10"
+
+// admitted runs the upload handler next once the ingest pool gives it a
+// turn, so no more than Tunables.IngestWorkers uploads are received and
+// encoded at once. Up to IngestQueue more wait for a turn; uploads beyond
+// that are refused with 503 and a Retry-After header.
+func (rs *RSBackupAPI) admitted(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ingest := rs.background().ingest
+		err := ingest.acquire(r.Context().Done())
+		if err == errQueueFull {
+			rs.Errorf(r, "Too many uploads in progress, refusing %s", r.URL.Path)
+			w.Header().Set("Retry-After", ingestRetryAfter)
+			http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+			return
+		}
+		if err != nil {
+			rs.Errorf(r, "Upload to %s abandoned while queued", r.URL.Path)
+			return
+		}
+		defer ingest.release()
+		next(w, r)
+	}
+}
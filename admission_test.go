@@ -0,0 +1,64 @@
+package rsbackup
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestAdmitted(t *testing.T) {
+	api := &RSBackupAPI{Config: &Config{Tunables: Tunables{IngestWorkers: 1, IngestQueue: 1}}}
+	unblock := make(chan struct{})
+	handler := api.admitted(func(w http.ResponseWriter, r *http.Request) {
+		<-unblock
+	})
+	codes := make(chan int, 2)
+	upload := func() {
+		rr := httptest.NewRecorder()
+		handler(rr, httptest.NewRequest("POST", "/submit_data", nil))
+		codes <- rr.Code
+	}
+	waitFor := func(active, waiting int) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for time.Now().Before(deadline) {
+			s := api.background().ingest.stats()
+			if s.active == active && s.waiting == waiting {
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+		t.Fatalf("Got stats %+v, expected %d active and %d waiting", api.background().ingest.stats(), active, waiting)
+	}
+
+	go upload()
+	waitFor(1, 0)
+	go upload()
+	waitFor(1, 1)
+	rr := httptest.NewRecorder()
+	handler(rr, httptest.NewRequest("POST", "/submit_data", nil))
+	if rr.Code != http.StatusServiceUnavailable || rr.Header().Get("Retry-After") != ingestRetryAfter {
+		t.Errorf("Got status code %d and Retry-After '%s' with the queue full", rr.Code, rr.Header().Get("Retry-After"))
+	}
+	close(unblock)
+	for i := 0; i < 2; i++ {
+		if code := <-codes; code != http.StatusOK {
+			t.Errorf("Got status code %d for an admitted upload", code)
+		}
+	}
+	if s := api.background().ingest.stats(); s.done != 2 || s.rejected != 1 {
+		t.Errorf("Got stats %+v", s)
+	}
+
+	// Without IngestWorkers uploads aren't bounded.
+	api = &RSBackupAPI{Config: &Config{}}
+	handler = api.admitted(func(w http.ResponseWriter, r *http.Request) {})
+	for i := 0; i < 20; i++ {
+		rr := httptest.NewRecorder()
+		handler(rr, httptest.NewRequest("POST", "/submit_data", nil))
+		if rr.Code != http.StatusOK {
+			t.Fatalf("Got status code %d without IngestWorkers", rr.Code)
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package rsbackup
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// maxAnnotationLength bounds a single note.
+const maxAnnotationLength = 4096
+
+// Annotation is a free-form note an operator attached to a file.
+type Annotation struct {
+	Note    string    `json:"note"`
+	Author  string    `json:"author"`
+	Created time.Time `json:"created"`
+}
+
+// AnnotationStore keeps the notes attached to files, oldest first, in a json
+// file. Notes are only ever added, so they double as history.
+type AnnotationStore struct {
+	mu          sync.Mutex
+	path        string
+	annotations map[string][]Annotation
+}
+
+func NewAnnotationStore(fpath string) (*AnnotationStore, error) {
+	s := &AnnotationStore{
+		path:        fpath,
+		annotations: make(map[string][]Annotation),
+	}
+	err := readJSONState(fpath, &s.annotations)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *AnnotationStore) Add(fname, note, author string) (Annotation, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	annotation := Annotation{Note: note, Author: author, Created: time.Now()}
+	s.annotations[fname] = append(s.annotations[fname], annotation)
+	err := writeJSONState(s.path, s.annotations)
+	if err != nil {
+		s.annotations[fname] = s.annotations[fname][:len(s.annotations[fname])-1]
+		return Annotation{}, err
+	}
+	return annotation, nil
+}
+
+// Move carries the notes on from over to to, after a rename.
+func (s *AnnotationStore) Move(from, to string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	annotations, ok := s.annotations[from]
+	if !ok {
+		return nil
+	}
+	delete(s.annotations, from)
+	s.annotations[to] = annotations
+	return writeJSONState(s.path, s.annotations)
+}
+
+// Forget drops the notes on fname. Notes are history, so this is only
+// done when a file is shredded.
+func (s *AnnotationStore) Forget(fname string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.annotations[fname]; !ok {
+		return nil
+	}
+	delete(s.annotations, fname)
+	return writeJSONState(s.path, s.annotations)
+}
+
+func (s *AnnotationStore) Get(fname string) []Annotation {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Annotation(nil), s.annotations[fname]...)
+}
+
+// annotationsOf returns the notes on fname, nil when annotations are
+// disabled.
+func (rs *RSBackupAPI) annotationsOf(fname string) []Annotation {
+	if rs.Annotations == nil {
+		return nil
+	}
+	return rs.Annotations.Get(fname)
+}
+
+func (rs *RSBackupAPI) annotateHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		rs.Errorf(r, "Bad method %s", r.Method)
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	fname, err := getFileNameParam(r.URL)
+	if err != nil {
+		rs.Errorf(r, "Can't annotate file: %s", err)
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	note := r.FormValue("note")
+	if note == "" || len(note) > maxAnnotationLength {
+		rs.Errorf(r, "Note must be between 1 and %d bytes, got %d", maxAnnotationLength, len(note))
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	if _, err := rs.RsFileMan.Stat(fname); err != nil {
+		rs.Errorf(r, "Can't annotate %s: file not found", fname)
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+	author := "anonymous"
+	if token, ok := requestToken(r); ok {
+		author = token.Name
+	}
+	annotation, err := rs.Annotations.Add(fname, note, author)
+	if err != nil {
+		rs.Errorf(r, "Unable to annotate %s: %s", fname, err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	log.WithFields(log.Fields{
+		"token":  author,
+		"client": rs.clientIP(r),
+		"file":   fname,
+		"note":   note,
+	}).Info("Annotated file")
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(annotation)
+	if err != nil {
+		rs.Errorf(r, "Unable to marshal json response: %s", err)
+	}
+}
@@ -0,0 +1,73 @@
+package rsbackup
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestAnnotateHandler(t *testing.T) {
+	tmpDir := createTMPDir(t, "rsbackup")
+	conf := &Config{BackupRoot: tmpDir, DataShards: 2, ParityShards: 1}
+	cloneShards(t, "tyger", tmpDir, conf)
+	annotationsPath := conf.StatePath("annotations.json")
+	annotations, err := NewAnnotationStore(annotationsPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	api := &RSBackupAPI{Config: conf, RsFileMan: &RSFileManager{Config: conf}, Annotations: annotations}
+
+	annotateTests := []struct {
+		name           string
+		method         string
+		url            string
+		note           string
+		expectedStatus int
+	}{
+		{"bad method", "GET", "/annotate/tyger", "disk replaced", 405},
+		{"file not found", "POST", "/annotate/lion", "disk replaced", 404},
+		{"empty note", "POST", "/annotate/tyger", "", 400},
+		{"note too long", "POST", "/annotate/tyger", strings.Repeat("x", maxAnnotationLength+1), 400},
+		{"first note", "POST", "/annotate/tyger", "corruption investigated", 200},
+		{"second note", "POST", "/annotate/tyger", "disk replaced", 200},
+	}
+	for _, tt := range annotateTests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.url, strings.NewReader(url.Values{"note": {tt.note}}.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			req = req.WithContext(context.WithValue(req.Context(), tokenContextKey, APIToken{Name: "operator", Admin: true}))
+			rr := httptest.NewRecorder()
+			http.HandlerFunc(api.annotateHandler).ServeHTTP(rr, req)
+			if rr.Code != tt.expectedStatus {
+				t.Errorf("Got status code %d, expected %d", rr.Code, tt.expectedStatus)
+			}
+		})
+	}
+
+	// Notes survive a restart and show up when checking the file.
+	api.Annotations, err = NewAnnotationStore(annotationsPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest("GET", "/check_data/tyger", nil)
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(api.checkDataHandler).ServeHTTP(rr, req)
+	var rsp checkDataRsp
+	err = json.NewDecoder(rr.Body).Decode(&rsp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rsp.Annotations) != 2 {
+		t.Fatalf("Got %d annotations, expected 2", len(rsp.Annotations))
+	}
+	if rsp.Annotations[0].Note != "corruption investigated" || rsp.Annotations[1].Note != "disk replaced" {
+		t.Errorf("Annotations out of order: %+v", rsp.Annotations)
+	}
+	if rsp.Annotations[0].Author != "operator" {
+		t.Errorf("Got author '%s', expected 'operator'", rsp.Annotations[0].Author)
+	}
+}
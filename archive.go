@@ -0,0 +1,269 @@
+package rsbackup
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const archiveTar = "tar"
+
+var errBadArchive = errors.New("Not a valid tar archive")
+
+// ArchiveIndex is recorded in the metadata of files submitted as
+// archives. The archive is stored as it was submitted, the index lists
+// its members and where their data is.
+type ArchiveIndex struct {
+	// Format is the only one supported so far, "tar".
+	Format  string          `json:"format"`
+	Members []ArchiveMember `json:"members"`
+}
+
+// ArchiveMember is an entry of an archive.
+type ArchiveMember struct {
+	Name string `json:"name"`
+	// Type is "file", "dir", "symlink", "hardlink", "sparse" or "other".
+	// Only members of type "file" can be extracted.
+	Type     string    `json:"type"`
+	Size     int64     `json:"size"`
+	Mode     string    `json:"mode"`
+	Mtime    time.Time `json:"mtime"`
+	Linkname string    `json:"linkname,omitempty"`
+	// Offset is where the data of the member starts in the archive.
+	Offset int64 `json:"offset"`
+}
+
+// archiveParam reads the archive field of a submission, "tar" asking for
+// the members of the file to be indexed. It returns nil without it.
+func archiveParam(r *http.Request) (*ArchiveIndex, error) {
+	switch format := r.FormValue("archive"); format {
+	case "":
+		return nil, nil
+	case archiveTar:
+		return &ArchiveIndex{Format: archiveTar}, nil
+	default:
+		return nil, fmt.Errorf("Unknown archive format '%s', only \"tar\" is supported", format)
+	}
+}
+
+// member returns the member called name.
+func (a *ArchiveIndex) member(name string) (*ArchiveMember, bool) {
+	name = strings.TrimPrefix(name, "./")
+	for i := range a.Members {
+		if strings.TrimPrefix(a.Members[i].Name, "./") == name {
+			return &a.Members[i], true
+		}
+	}
+	return nil, false
+}
+
+func memberType(hdr *tar.Header) string {
+	for key := range hdr.PAXRecords {
+		if strings.HasPrefix(key, "GNU.sparse.") {
+			return "sparse"
+		}
+	}
+	switch hdr.Typeflag {
+	case tar.TypeReg, tar.TypeRegA:
+		return "file"
+	case tar.TypeDir:
+		return "dir"
+	case tar.TypeSymlink:
+		return "symlink"
+	case tar.TypeLink:
+		return "hardlink"
+	case tar.TypeGNUSparse:
+		return "sparse"
+	}
+	return "other"
+}
+
+// tarIndexer reads src, indexing the tar archive read on the side.
+type tarIndexer struct {
+	src     io.Reader
+	pw      *io.PipeWriter
+	members []ArchiveMember
+	done    chan error
+}
+
+func newTarIndexer(src io.Reader) *tarIndexer {
+	pr, pw := io.Pipe()
+	t := &tarIndexer{src: src, pw: pw, done: make(chan error, 1)}
+	go func() {
+		err := t.index(&countingReadCloser{ReadCloser: pr})
+		// Padding after the end of the archive is read too.
+		io.Copy(ioutil.Discard, pr)
+		t.done <- err
+	}()
+	return t
+}
+
+func (t *tarIndexer) index(archive *countingReadCloser) error {
+	tr := tar.NewReader(archive)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		// The archive is read up to the data of the member.
+		t.members = append(t.members, ArchiveMember{
+			Name:     hdr.Name,
+			Type:     memberType(hdr),
+			Size:     hdr.Size,
+			Mode:     fmt.Sprintf("%04o", hdr.Mode&07777),
+			Mtime:    hdr.ModTime.UTC(),
+			Linkname: hdr.Linkname,
+			Offset:   archive.n,
+		})
+	}
+}
+
+func (t *tarIndexer) Read(p []byte) (int, error) {
+	n, err := t.src.Read(p)
+	if n > 0 {
+		// The indexer reads everything, even past errors.
+		t.pw.Write(p[:n])
+	}
+	return n, err
+}
+
+// close returns the members of the archive once src was read to the end.
+func (t *tarIndexer) close() ([]ArchiveMember, error) {
+	t.pw.Close()
+	if err := <-t.done; err != nil {
+		return nil, fmt.Errorf("%w: %s", errBadArchive, err)
+	}
+	if t.members == nil {
+		return []ArchiveMember{}, nil
+	}
+	return t.members, nil
+}
+
+// memberReader gives random access to the data of a member of an archive
+// read by src.
+type memberReader struct {
+	src    io.ReadSeeker
+	member *ArchiveMember
+	pos    int64
+}
+
+func (m *memberReader) Read(p []byte) (int, error) {
+	if m.pos >= m.member.Size {
+		return 0, io.EOF
+	}
+	if remaining := m.member.Size - m.pos; int64(len(p)) > remaining {
+		p = p[:remaining]
+	}
+	_, err := m.src.Seek(m.member.Offset+m.pos, io.SeekStart)
+	if err != nil {
+		return 0, err
+	}
+	n, err := m.src.Read(p)
+	m.pos += int64(n)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+func (m *memberReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += m.pos
+	case io.SeekEnd:
+		offset += m.member.Size
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("Negative position %d", offset)
+	}
+	m.pos = offset
+	return offset, nil
+}
+
+// memberWriter passes the data of a member on to w, out of the whole
+// archive written to it.
+type memberWriter struct {
+	w      io.Writer
+	member *ArchiveMember
+	pos    int64
+}
+
+func (m *memberWriter) Write(p []byte) (int, error) {
+	base := m.pos
+	m.pos += int64(len(p))
+	start, end := m.member.Offset, m.member.Offset+m.member.Size
+	if start < base {
+		start = base
+	}
+	if end > m.pos {
+		end = m.pos
+	}
+	if start < end {
+		if _, err := m.w.Write(p[start-base : end-base]); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// archiveMemberParam returns the member of fname named by the member
+// parameter of the request, or nil without it. It fails unless the
+// member can be extracted.
+func archiveMemberParam(r *http.Request, fname string, extras *MetadataExtras) (*ArchiveMember, error) {
+	name := r.FormValue("member")
+	if name == "" {
+		return nil, nil
+	}
+	if extras.Archive == nil {
+		return nil, fmt.Errorf("%s wasn't submitted as an archive", fname)
+	}
+	member, ok := extras.Archive.member(name)
+	if !ok {
+		return nil, fmt.Errorf("%s has no member '%s'", fname, name)
+	}
+	if member.Type != "file" {
+		return nil, fmt.Errorf("Member '%s' of %s is a %s, only files can be extracted", name, fname, member.Type)
+	}
+	return member, nil
+}
+
+type listArchiveRsp struct {
+	Name string `json:"name"`
+	*ArchiveIndex
+}
+
+// listArchiveHandler lists the members of a file submitted as an archive.
+func (rs *RSBackupAPI) listArchiveHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		rs.Errorf(r, "Bad request method %s", r.Method)
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	fname, err := getFileNameParam(r.URL)
+	if err != nil {
+		rs.Errorf(r, "Can't list archive: %s", err)
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	if rs.redirectRenamed(w, r, fname) {
+		return
+	}
+	extras, err := rs.RsFileMan.ReadExtras(rs.RsFileMan.DataPath(fname))
+	if err != nil || extras.Archive == nil {
+		rs.Errorf(r, "No archive %s", fname)
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+	err = writeResponse(w, r, &listArchiveRsp{Name: fname, ArchiveIndex: extras.Archive})
+	if err != nil {
+		rs.Errorf(r, "Unable to marshal response: %s", err)
+	}
+}
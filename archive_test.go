@@ -0,0 +1,130 @@
+package rsbackup
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestArchiveIngestion(t *testing.T) {
+	mtime := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	readme := []byte("tyger tyger burning bright\n")
+	dump := bytes.Repeat([]byte("INSERT INTO logs VALUES (1);\n"), 1000)
+	archive := new(bytes.Buffer)
+	tw := tar.NewWriter(archive)
+	for _, hdr := range []*tar.Header{
+		{Name: "etc/", Typeflag: tar.TypeDir, Mode: 0755, ModTime: mtime},
+		{Name: "etc/README", Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(readme)), ModTime: mtime},
+		{Name: "etc/link", Typeflag: tar.TypeSymlink, Linkname: "README", Mode: 0777, ModTime: mtime},
+		{Name: "var/dump.sql", Typeflag: tar.TypeReg, Mode: 0600, Size: int64(len(dump)), ModTime: mtime},
+	} {
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		switch hdr.Name {
+		case "etc/README":
+			tw.Write(readme)
+		case "var/dump.sql":
+			tw.Write(dump)
+		}
+	}
+	tw.Close()
+
+	tmpDir := createTMPDir(t, "rsbackup")
+	config := &Config{BackupRoot: tmpDir, DataShards: 2, ParityShards: 1, Compression: "zstd"}
+	fm := &RSFileManager{Config: config}
+	api := &RSBackupAPI{Config: config, RsFileMan: fm}
+	submit := func(fname string, data []byte) *httptest.ResponseRecorder {
+		body := new(bytes.Buffer)
+		mw := multipart.NewWriter(body)
+		fw, _ := mw.CreateFormFile("file", fname)
+		fw.Write(data)
+		mw.WriteField("filename", fname)
+		mw.WriteField("archive", "tar")
+		mw.Close()
+		req := httptest.NewRequest("POST", "/submit_data", body)
+		req.Header.Set("Content-Type", mw.FormDataContentType())
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(api.submitDataHandler).ServeHTTP(rr, req)
+		return rr
+	}
+	if rr := submit("backup.tar", archive.Bytes()); rr.Code != http.StatusOK {
+		t.Fatalf("Got status code %d", rr.Code)
+	}
+	if rr := submit("notes.txt", readme); rr.Code != http.StatusBadRequest {
+		t.Errorf("Got status code %d submitting a file that isn't a tar archive", rr.Code)
+	}
+	if names, _ := ioutil.ReadDir(tmpDir); len(names) != 4 {
+		t.Errorf("Got %d files, expected the archive, its metadata and parity only", len(names))
+	}
+
+	req := httptest.NewRequest("GET", "/list_archive/backup.tar", nil)
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(api.listArchiveHandler).ServeHTTP(rr, req)
+	var rsp listArchiveRsp
+	if rr.Code != http.StatusOK || json.NewDecoder(rr.Body).Decode(&rsp) != nil || rsp.ArchiveIndex == nil {
+		t.Fatalf("Got status code %d listing the archive", rr.Code)
+	}
+	var listed []string
+	for _, m := range rsp.Members {
+		listed = append(listed, m.Name+" "+m.Type+" "+m.Mode+" "+m.Linkname)
+		if !m.Mtime.Equal(mtime) {
+			t.Errorf("Got mtime %s for %s", m.Mtime, m.Name)
+		}
+	}
+	if got := strings.Join(listed, ","); rsp.Name != "backup.tar" || rsp.Format != "tar" || got != "etc/ dir 0755 ,etc/README file 0644 ,etc/link symlink 0777 README,var/dump.sql file 0600 " {
+		t.Errorf("Got archive %s listing %s", rsp.Name, got)
+	}
+	req = httptest.NewRequest("GET", "/list_archive/notes.txt", nil)
+	rr = httptest.NewRecorder()
+	http.HandlerFunc(api.listArchiveHandler).ServeHTTP(rr, req)
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("Got status code %d listing a file that isn't an archive", rr.Code)
+	}
+
+	retrieve := func(url, rangeHeader string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", url, nil)
+		if rangeHeader != "" {
+			req.Header.Set("Range", rangeHeader)
+		}
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(api.retrieveDataHandler).ServeHTTP(rr, req)
+		return rr
+	}
+	if rr := retrieve("/retrieve_data/backup.tar", ""); !bytes.Equal(rr.Body.Bytes(), archive.Bytes()) {
+		t.Errorf("Got %d bytes, expected the whole archive", rr.Body.Len())
+	}
+	if rr := retrieve("/retrieve_data/backup.tar?member=etc/README", ""); rr.Code != http.StatusOK || !bytes.Equal(rr.Body.Bytes(), readme) {
+		t.Errorf("Got status code %d and %q for a member", rr.Code, rr.Body.Bytes())
+	}
+	if rr := retrieve("/retrieve_data/backup.tar?member=./var/dump.sql", "bytes=29-56"); rr.Code != http.StatusPartialContent || !bytes.Equal(rr.Body.Bytes(), dump[29:57]) {
+		t.Errorf("Got status code %d and %q for a range of a member", rr.Code, rr.Body.Bytes())
+	}
+	for _, member := range []string{"etc/link", "etc/missing"} {
+		if rr := retrieve("/retrieve_data/backup.tar?member="+member, ""); rr.Code != http.StatusNotFound {
+			t.Errorf("Got status code %d extracting %s", rr.Code, member)
+		}
+	}
+
+	// Damaged archives are reconstructed, the member cut out of them.
+	fpath := fm.DataPath("backup.tar")
+	stored, err := ioutil.ReadFile(fpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored[10] ^= 0xff
+	if err := ioutil.WriteFile(fpath, stored, 0644); err != nil {
+		t.Fatal(err)
+	}
+	rr = retrieve("/retrieve_data/backup.tar?member=var/dump.sql&verify=true", "")
+	if rr.Header().Get("Reconstructed") != "true" || !bytes.Equal(rr.Body.Bytes(), dump) {
+		t.Errorf("Got status code %d and %d bytes for a member of a damaged archive", rr.Code, rr.Body.Len())
+	}
+}
@@ -0,0 +1,308 @@
+package rsbackup
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Results of audited operations.
+const (
+	auditOK     = "ok"
+	auditDenied = "denied"
+	auditFailed = "failed"
+)
+
+// AuditEntry is an operation recorded in the audit log.
+type AuditEntry struct {
+	Time   time.Time `json:"time"`
+	Action string    `json:"action"`
+	// Identity is the credential used, or the user name tried for
+	// refused basic auth.
+	Identity string `json:"identity,omitempty"`
+	Client   string `json:"client"`
+	Object   string `json:"object,omitempty"`
+	Status   int    `json:"status"`
+	Result   string `json:"result"`
+}
+
+// AuditLog appends entries to a file of json lines. Once the file reaches
+// maxSize it's rotated to path.1, shifting older files up to
+// path.<maxFiles>; files beyond that are deleted.
+type AuditLog struct {
+	mu       sync.Mutex
+	path     string
+	file     *os.File
+	size     int64
+	maxSize  int64
+	maxFiles int
+}
+
+// NewAuditLog opens the audit log at fpath for appending. maxSize defaults
+// to 64MiB and maxFiles to 10.
+func NewAuditLog(fpath string, maxSize Size, maxFiles int) (*AuditLog, error) {
+	if maxSize == 0 {
+		maxSize = 64 << 20
+	}
+	if maxFiles == 0 {
+		maxFiles = 10
+	}
+	a := &AuditLog{path: fpath, maxSize: int64(maxSize), maxFiles: maxFiles}
+	err := os.MkdirAll(path.Dir(fpath), 0755)
+	if err != nil {
+		return nil, err
+	}
+	return a, a.open()
+}
+
+func (a *AuditLog) open() error {
+	file, err := os.OpenFile(a.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	stat, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	a.file = file
+	a.size = stat.Size()
+	return nil
+}
+
+// rotatedPath returns the path of the i-th rotated file, 0 being the
+// current one.
+func (a *AuditLog) rotatedPath(i int) string {
+	if i == 0 {
+		return a.path
+	}
+	return fmt.Sprintf("%s.%d", a.path, i)
+}
+
+// rotate must be called with a.mu held.
+func (a *AuditLog) rotate() error {
+	err := a.file.Close()
+	if err != nil {
+		return err
+	}
+	os.Remove(a.rotatedPath(a.maxFiles))
+	for i := a.maxFiles - 1; i >= 0; i-- {
+		err = os.Rename(a.rotatedPath(i), a.rotatedPath(i+1))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return a.open()
+}
+
+// Record appends e to the log.
+func (a *AuditLog) Record(e AuditEntry) error {
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.size > 0 && a.size+int64(len(line)) > a.maxSize {
+		err = a.rotate()
+		if err != nil {
+			return fmt.Errorf("Cannot rotate audit log: %w", err)
+		}
+	}
+	n, err := a.file.Write(line)
+	a.size += int64(n)
+	return err
+}
+
+// Close closes the log, entries recorded afterwards are lost.
+func (a *AuditLog) Close(context.Context) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.file.Close()
+}
+
+// AuditFilter selects entries from the audit log. Zero fields match
+// everything.
+type AuditFilter struct {
+	Since    time.Time
+	Until    time.Time
+	Action   string
+	Identity string
+	Object   string
+	Result   string
+	// Limit keeps only the latest matching entries.
+	Limit int
+}
+
+func (f *AuditFilter) matches(e *AuditEntry) bool {
+	return (f.Since.IsZero() || !e.Time.Before(f.Since)) &&
+		(f.Until.IsZero() || e.Time.Before(f.Until)) &&
+		(f.Action == "" || f.Action == e.Action) &&
+		(f.Identity == "" || f.Identity == e.Identity) &&
+		(f.Object == "" || f.Object == e.Object) &&
+		(f.Result == "" || f.Result == e.Result)
+}
+
+// Query returns the entries matching f, oldest first, from the current
+// and the rotated files.
+func (a *AuditLog) Query(f AuditFilter) ([]AuditEntry, error) {
+	// Open every file before reading any, so a rotation in between can't
+	// make entries appear twice or not at all.
+	a.mu.Lock()
+	var files []*os.File
+	for i := a.maxFiles; i >= 0; i-- {
+		file, err := os.Open(a.rotatedPath(i))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			a.mu.Unlock()
+			for _, file := range files {
+				file.Close()
+			}
+			return nil, err
+		}
+		files = append(files, file)
+	}
+	a.mu.Unlock()
+	defer func() {
+		for _, file := range files {
+			file.Close()
+		}
+	}()
+
+	entries := []AuditEntry{}
+	for _, file := range files {
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			var e AuditEntry
+			if json.Unmarshal(scanner.Bytes(), &e) != nil || !f.matches(&e) {
+				// A line cut short by a crash is skipped.
+				continue
+			}
+			entries = append(entries, e)
+			if f.Limit > 0 && len(entries) > 2*f.Limit {
+				entries = append(entries[:0], entries[len(entries)-f.Limit:]...)
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+	if f.Limit > 0 && len(entries) > f.Limit {
+		entries = entries[len(entries)-f.Limit:]
+	}
+	return entries, nil
+}
+
+// auditResult sums up how an operation answered with status went.
+func auditResult(status int) string {
+	switch {
+	case status < 400:
+		return auditOK
+	case status == http.StatusUnauthorized || status == http.StatusForbidden || status == http.StatusTooManyRequests:
+		return auditDenied
+	default:
+		return auditFailed
+	}
+}
+
+// requestAudit returns the audit entry of the request, if it's audited.
+func requestAudit(r *http.Request) *AuditEntry {
+	entry, _ := r.Context().Value(auditContextKey).(*AuditEntry)
+	return entry
+}
+
+// auditObject names the object an audited request operates on.
+func auditObject(r *http.Request, name string) {
+	if entry := requestAudit(r); entry != nil {
+		entry.Object = name
+	}
+}
+
+// audited records requests to next as action in the audit log. With
+// objectInURL the object is taken from the URL, like /verb/{name},
+// otherwise next names it with auditObject. Requests are recorded whether
+// they're allowed or not, so audited goes outside all access checks.
+func (rs *RSBackupAPI) audited(action string, objectInURL bool, next http.HandlerFunc) http.HandlerFunc {
+	if rs.Audit == nil {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		entry := &AuditEntry{Time: time.Now().UTC(), Action: action, Client: rs.clientIP(r)}
+		if objectInURL {
+			entry.Object, _ = getURLParam(r.URL)
+		}
+		sw := &statusResponseWriter{ResponseWriter: w}
+		next(sw, r.WithContext(context.WithValue(r.Context(), auditContextKey, entry)))
+		entry.Status = sw.status
+		if entry.Status == 0 {
+			entry.Status = http.StatusOK
+		}
+		entry.Result = auditResult(entry.Status)
+		err := rs.Audit.Record(*entry)
+		if err != nil {
+			log.Errorf("Unable to record %s of '%s' in the audit log: %s", action, entry.Object, err)
+		}
+	}
+}
+
+type auditRsp struct {
+	Entries []AuditEntry `json:"entries"`
+}
+
+// auditHandler returns audit log entries, filtered by the since and until
+// times (RFC 3339) and the action, identity, object and result fields.
+// Only the latest limit entries are returned, 100 by default.
+func (rs *RSBackupAPI) auditHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		rs.Errorf(r, "Bad method %s", r.Method)
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	f := AuditFilter{
+		Action:   r.FormValue("action"),
+		Identity: r.FormValue("identity"),
+		Object:   r.FormValue("object"),
+		Result:   r.FormValue("result"),
+		Limit:    100,
+	}
+	var err error
+	for name, field := range map[string]*time.Time{"since": &f.Since, "until": &f.Until} {
+		if value := r.FormValue(name); value != "" && err == nil {
+			*field, err = time.Parse(time.RFC3339, value)
+		}
+	}
+	if value := r.FormValue("limit"); value != "" && err == nil {
+		f.Limit, err = strconv.Atoi(value)
+		if err == nil && (f.Limit < 1 || f.Limit > 10000) {
+			err = fmt.Errorf("limit must be between 1 and 10000")
+		}
+	}
+	if err != nil {
+		rs.Errorf(r, "Bad audit query: %s", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	entries, err := rs.Audit.Query(f)
+	if err != nil {
+		rs.Errorf(r, "Unable to read audit log: %s", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(auditRsp{Entries: entries})
+	if err != nil {
+		rs.Errorf(r, "Unable to marshal json response: %s", err)
+	}
+}
@@ -0,0 +1,156 @@
+package rsbackup
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestAuditLogRotation(t *testing.T) {
+	tmpDir := createTMPDir(t, "rsbackup")
+	logPath := path.Join(tmpDir, "audit.log")
+	audit, err := NewAuditLog(logPath, 1000, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 40; i++ {
+		err = audit.Record(AuditEntry{
+			Time:   start.Add(time.Duration(i) * time.Minute),
+			Action: "retrieve",
+			Object: fmt.Sprintf("file-%d", i),
+			Status: 200,
+			Result: auditOK,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, fpath := range []string{logPath, logPath + ".1", logPath + ".2"} {
+		if stat, err := os.Stat(fpath); err != nil || stat.Size() > 1000 {
+			t.Errorf("%s: %v", fpath, err)
+		}
+	}
+	if _, err := os.Stat(logPath + ".3"); !os.IsNotExist(err) {
+		t.Errorf("Kept more than 2 rotated files")
+	}
+
+	all, err := audit.Query(AuditFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) == 0 || len(all) >= 40 || all[len(all)-1].Object != "file-39" {
+		t.Fatalf("Got %d entries, the last %+v", len(all), all[len(all)-1])
+	}
+	for i := 1; i < len(all); i++ {
+		if !all[i-1].Time.Before(all[i].Time) {
+			t.Fatalf("Entries out of order at %d", i)
+		}
+	}
+	latest, _ := audit.Query(AuditFilter{Limit: 3})
+	if len(latest) != 3 || latest[0].Object != "file-37" {
+		t.Errorf("Got latest entries %+v", latest)
+	}
+	window, _ := audit.Query(AuditFilter{Since: start.Add(35 * time.Minute), Until: start.Add(37 * time.Minute)})
+	if len(window) != 2 || window[0].Object != "file-35" {
+		t.Errorf("Got entries %+v between 35 and 37 minutes", window)
+	}
+
+	// Entries survive reopening.
+	audit.Close(nil)
+	audit, err = NewAuditLog(logPath, 1000, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reopened, _ := audit.Query(AuditFilter{}); len(reopened) != len(all) {
+		t.Errorf("Got %d entries after reopening, expected %d", len(reopened), len(all))
+	}
+}
+
+func TestAudited(t *testing.T) {
+	tmpDir := createTMPDir(t, "rsbackup")
+	audit, err := NewAuditLog(path.Join(tmpDir, "audit.log"), 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	api := &RSBackupAPI{Config: &Config{}, Tokens: newTestTokenStore(t), Audit: audit}
+	retrieve := api.audited("retrieve", true, api.authenticated(ScopeRead, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("data"))
+	}))
+	submit := api.audited("submit", false, api.authenticated(ScopeWrite, func(w http.ResponseWriter, r *http.Request) {
+		auditObject(r, r.FormValue("filename"))
+		http.Error(w, "exists", http.StatusConflict)
+	}))
+	requests := []struct {
+		handler http.HandlerFunc
+		target  string
+		secret  string
+	}{
+		{retrieve, "/retrieve_data/report", testReaderSecret},
+		{retrieve, "/retrieve_data/report", "wrong-secret-0123456789"},
+		{submit, "/submit_data?filename=report", testReaderSecret},
+		{submit, "/submit_data?filename=report", testUserSecret},
+	}
+	for _, req := range requests {
+		r := httptest.NewRequest("POST", req.target, nil)
+		r.RemoteAddr = "192.0.2.7:5000"
+		r.Header.Set("Authorization", "Bearer "+req.secret)
+		req.handler(httptest.NewRecorder(), r)
+	}
+
+	expected := []AuditEntry{
+		{Action: "retrieve", Identity: "reader", Object: "report", Status: 200, Result: auditOK},
+		{Action: "retrieve", Object: "report", Status: 401, Result: auditDenied},
+		// Refused before the handler could name the file.
+		{Action: "submit", Identity: "reader", Status: 403, Result: auditDenied},
+		{Action: "submit", Identity: "user", Object: "report", Status: 409, Result: auditFailed},
+	}
+	rr := httptest.NewRecorder()
+	api.auditHandler(rr, httptest.NewRequest("GET", "/audit", nil))
+	var rsp auditRsp
+	err = json.NewDecoder(rr.Body).Decode(&rsp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rsp.Entries) != len(expected) {
+		t.Fatalf("Got %d entries, expected %d: %+v", len(rsp.Entries), len(expected), rsp.Entries)
+	}
+	for i, e := range rsp.Entries {
+		if e.Client != "192.0.2.7" || e.Time.IsZero() {
+			t.Errorf("Entry %d: got client '%s' at %s", i, e.Client, e.Time)
+		}
+		e.Client, e.Time = "", time.Time{}
+		if e != expected[i] {
+			t.Errorf("Entry %d: got %+v, expected %+v", i, e, expected[i])
+		}
+	}
+
+	queryTests := []struct {
+		query          string
+		expectedStatus int
+		expectedCount  int
+	}{
+		{"?result=denied", 200, 2},
+		{"?identity=user&action=submit", 200, 1},
+		{"?object=report&limit=1", 200, 1},
+		{"?since=2100-01-01T00:00:00Z", 200, 0},
+		{"?since=yesterday", 400, 0},
+		{"?limit=0", 400, 0},
+	}
+	for _, tt := range queryTests {
+		t.Run(tt.query, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			api.auditHandler(rr, httptest.NewRequest("GET", "/audit"+tt.query, nil))
+			var rsp auditRsp
+			json.NewDecoder(rr.Body).Decode(&rsp)
+			if rr.Code != tt.expectedStatus || len(rsp.Entries) != tt.expectedCount {
+				t.Errorf("Got status code %d and %d entries", rr.Code, len(rsp.Entries))
+			}
+		})
+	}
+}
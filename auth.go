@@ -0,0 +1,520 @@
+package rsbackup
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	errTokenExists   = errors.New("Token exists")
+	errTokenNotFound = errors.New("Token not found")
+	errTokenStatic   = errors.New("Static tokens can only be removed from the config")
+	errUnknownScope  = errors.New("Unknown scope")
+)
+
+// Scopes restrict what a token may be used for. ScopeRead covers listing,
+// checking and retrieving files, ScopeWrite submitting them, ScopeRepair
+// repairing them and ScopeAdmin everything, including managing tokens.
+const (
+	ScopeRead   = "read"
+	ScopeWrite  = "write"
+	ScopeRepair = "repair"
+	ScopeAdmin  = "admin"
+)
+
+var allScopes = []string{ScopeRead, ScopeWrite, ScopeRepair, ScopeAdmin}
+
+// dataScopes are the scopes of tokens without any, and of identity
+// provider users granted data access.
+var dataScopes = []string{ScopeRead, ScopeWrite, ScopeRepair}
+
+func validateScopes(scopes []string) error {
+	for _, scope := range scopes {
+		if !containsString(allScopes, scope) {
+			return fmt.Errorf("%w '%s'", errUnknownScope, scope)
+		}
+	}
+	return nil
+}
+
+// APIToken is a credential accepted in the Authorization header as
+// "Bearer <secret>". Only the sha256 of the secret is kept. A token
+// without Scopes has every scope except ScopeAdmin, which only Admin
+// tokens have.
+type APIToken struct {
+	Name    string    `json:"name"`
+	Hash    string    `json:"hash"`
+	Admin   bool      `json:"admin"`
+	Scopes  []string  `json:"scopes,omitempty"`
+	Created time.Time `json:"created"`
+	Static  bool      `json:"-"`
+}
+
+func (t APIToken) HasScope(scope string) bool {
+	if t.Admin || containsString(t.Scopes, ScopeAdmin) {
+		return true
+	}
+	if len(t.Scopes) == 0 {
+		return scope != ScopeAdmin
+	}
+	return containsString(t.Scopes, scope)
+}
+
+// grant adds scopes to a token mapped from the roles or groups of an
+// identity provider's user. Such tokens must only be used once granted a
+// scope, as a token without any has all data scopes.
+func (t *APIToken) grant(scopes ...string) {
+	for _, scope := range scopes {
+		t.Admin = t.Admin || scope == ScopeAdmin
+		if !containsString(t.Scopes, scope) {
+			t.Scopes = append(t.Scopes, scope)
+		}
+	}
+}
+
+func hashSecret(secret string) []byte {
+	sum := sha256.Sum256([]byte(secret))
+	return sum[:]
+}
+
+// TokenStore holds the static tokens from the config and the tokens minted
+// through the admin API, the latter persisted in a json file.
+type TokenStore struct {
+	mu     sync.Mutex
+	path   string
+	tokens map[string]*APIToken
+}
+
+// NewTokenStore loads minted tokens from fpath and adds the static ones
+// from config, which map token names to secrets, restricted to the scopes
+// in config.TokenScopes.
+func NewTokenStore(fpath string, config *Config) (*TokenStore, error) {
+	s := &TokenStore{
+		path:   fpath,
+		tokens: make(map[string]*APIToken),
+	}
+	err := readJSONState(fpath, &s.tokens)
+	if err != nil {
+		return nil, err
+	}
+	addStatic := func(tokens map[string]string, admin bool) error {
+		for name, secret := range tokens {
+			if _, ok := s.tokens[name]; ok {
+				return fmt.Errorf("Token name '%s' used more than once", name)
+			}
+			if len(secret) < 16 {
+				return fmt.Errorf("Token '%s' is too short, use at least 16 characters", name)
+			}
+			s.tokens[name] = &APIToken{
+				Name:   name,
+				Hash:   hex.EncodeToString(hashSecret(secret)),
+				Admin:  admin,
+				Scopes: config.TokenScopes[name],
+				Static: true,
+			}
+		}
+		return nil
+	}
+	err = addStatic(config.AuthTokens, false)
+	if err != nil {
+		return nil, err
+	}
+	err = addStatic(config.AdminTokens, true)
+	if err != nil {
+		return nil, err
+	}
+	for name, scopes := range config.TokenScopes {
+		token, ok := s.tokens[name]
+		if !ok || !token.Static {
+			return nil, fmt.Errorf("TokenScopes names unknown token '%s'", name)
+		}
+		if token.Admin {
+			return nil, fmt.Errorf("Admin token '%s' can't be restricted to scopes", name)
+		}
+		err = validateScopes(scopes)
+		if err != nil {
+			return nil, fmt.Errorf("Token '%s': %w", name, err)
+		}
+	}
+	return s, nil
+}
+
+func (s *TokenStore) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.tokens)
+}
+
+// Authenticate returns a copy of the token matching secret. Every token is
+// compared in constant time so timing doesn't reveal how close a guess is.
+func (s *TokenStore) Authenticate(secret string) (APIToken, bool) {
+	presented := hashSecret(secret)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var match *APIToken
+	for _, token := range s.tokens {
+		expected, err := hex.DecodeString(token.Hash)
+		if err != nil {
+			continue
+		}
+		if subtle.ConstantTimeCompare(presented, expected) == 1 {
+			match = token
+		}
+	}
+	if match == nil {
+		return APIToken{}, false
+	}
+	return *match, true
+}
+
+// Mint creates a new token called name, limited to scopes if any are
+// given, and returns its secret, which is not stored anywhere.
+func (s *TokenStore) Mint(name string, admin bool, scopes []string) (string, APIToken, error) {
+	err := validateScopes(scopes)
+	if err != nil {
+		return "", APIToken{}, err
+	}
+	secret, err := generateToken()
+	if err != nil {
+		return "", APIToken{}, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.tokens[name]; ok {
+		return "", APIToken{}, errTokenExists
+	}
+	token := &APIToken{
+		Name:    name,
+		Hash:    hex.EncodeToString(hashSecret(secret)),
+		Admin:   admin,
+		Scopes:  scopes,
+		Created: time.Now(),
+	}
+	s.tokens[name] = token
+	err = s.save()
+	if err != nil {
+		delete(s.tokens, name)
+		return "", APIToken{}, err
+	}
+	return secret, *token, nil
+}
+
+func (s *TokenStore) Revoke(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	token, ok := s.tokens[name]
+	if !ok {
+		return errTokenNotFound
+	}
+	if token.Static {
+		return errTokenStatic
+	}
+	delete(s.tokens, name)
+	err := s.save()
+	if err != nil {
+		s.tokens[name] = token
+	}
+	return err
+}
+
+func (s *TokenStore) List() []APIToken {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tokens := make([]APIToken, 0, len(s.tokens))
+	for _, token := range s.tokens {
+		tokens = append(tokens, *token)
+	}
+	sort.Slice(tokens, func(i, j int) bool { return tokens[i].Name < tokens[j].Name })
+	return tokens
+}
+
+// save must be called with s.mu held. Static tokens are not persisted.
+func (s *TokenStore) save() error {
+	minted := make(map[string]*APIToken)
+	for name, token := range s.tokens {
+		if !token.Static {
+			minted[name] = token
+		}
+	}
+	return writeJSONState(s.path, minted)
+}
+
+type contextKey int
+
+const (
+	tokenContextKey contextKey = iota
+	auditContextKey
+)
+
+// requestToken returns the token a request was authenticated with, if any.
+func requestToken(r *http.Request) (APIToken, bool) {
+	token, ok := r.Context().Value(tokenContextKey).(APIToken)
+	return token, ok
+}
+
+// statusResponseWriter remembers the status code of a response.
+type statusResponseWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusResponseWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// ReadFrom lets files reach the connection's ReadFrom, and sendfile.
+func (w *statusResponseWriter) ReadFrom(src io.Reader) (int64, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return io.Copy(w.ResponseWriter, src)
+}
+
+// Flush lets streaming handlers, like /events, flush through the wrapper.
+func (w *statusResponseWriter) Flush() {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap returns the wrapped writer for http.ResponseController.
+func (w *statusResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// PasswordAuthenticator checks user names and passwords sent with HTTP
+// Basic auth.
+type PasswordAuthenticator interface {
+	Authenticate(user, password string) (APIToken, bool)
+}
+
+// authenticate returns the token matching secret, trying API tokens before
+// JWTs.
+func (rs *RSBackupAPI) authenticate(r *http.Request, secret string) (APIToken, bool) {
+	if rs.Tokens != nil {
+		if token, ok := rs.Tokens.Authenticate(secret); ok {
+			return token, true
+		}
+	}
+	if rs.JWTs != nil && strings.Count(secret, ".") == 2 {
+		token, err := rs.JWTs.Validate(secret)
+		if err == nil {
+			return token, true
+		}
+		rs.Errorf(r, "Rejected JWT: %s", err)
+	}
+	return APIToken{}, false
+}
+
+// authenticated requires requests to carry a valid bearer token, or basic
+// auth credentials when password authenticators are set, before passing them
+// to next, and logs every authenticated request along with the token name.
+// Tokens lacking scope are refused. Without any credential source
+// authentication is disabled.
+func (rs *RSBackupAPI) authenticated(scope string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if rs.Tokens == nil && rs.JWTs == nil && len(rs.PasswordAuth) == 0 {
+			next(w, r)
+			return
+		}
+		unauthorized := func(challenge string) {
+			w.Header().Set("WWW-Authenticate", challenge)
+			if len(rs.PasswordAuth) > 0 {
+				w.Header().Add("WWW-Authenticate", `Basic realm="rsbackup"`)
+			}
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		}
+		var token APIToken
+		authHeader := r.Header.Get("Authorization")
+		if user, password, isBasic := r.BasicAuth(); isBasic && len(rs.PasswordAuth) > 0 {
+			ok := false
+			for _, auth := range rs.PasswordAuth {
+				token, ok = auth.Authenticate(user, password)
+				if ok {
+					break
+				}
+			}
+			if !ok {
+				if entry := requestAudit(r); entry != nil {
+					entry.Identity = user
+				}
+				rs.Errorf(r, "Invalid basic auth credentials of '%s' for %s %s", user, r.Method, r.URL.Path)
+				unauthorized("Bearer")
+				return
+			}
+		} else if strings.HasPrefix(authHeader, "Bearer ") {
+			var ok bool
+			token, ok = rs.authenticate(r, strings.TrimPrefix(authHeader, "Bearer "))
+			if !ok {
+				rs.Errorf(r, "Invalid bearer token for %s %s", r.Method, r.URL.Path)
+				unauthorized("Bearer error=\"invalid_token\"")
+				return
+			}
+		} else {
+			rs.Errorf(r, "Missing credentials for %s %s", r.Method, r.URL.Path)
+			unauthorized("Bearer")
+			return
+		}
+		if entry := requestAudit(r); entry != nil {
+			entry.Identity = token.Name
+		}
+		if !token.HasScope(scope) {
+			rs.Errorf(r, "Token '%s' lacks the '%s' scope for %s %s", token.Name, scope, r.Method, r.URL.Path)
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer error="insufficient_scope", scope="%s"`, scope))
+			http.Error(w, fmt.Sprintf("Missing scope '%s'", scope), http.StatusForbidden)
+			return
+		}
+
+		sw := &statusResponseWriter{ResponseWriter: w}
+		next(sw, r.WithContext(context.WithValue(r.Context(), tokenContextKey, token)))
+		log.WithFields(log.Fields{
+			"token":  token.Name,
+			"client": rs.clientIP(r),
+			"method": r.Method,
+			"path":   r.URL.Path,
+			"status": sw.status,
+		}).Info("Authenticated request")
+	}
+}
+
+type mintTokenRsp struct {
+	Name   string   `json:"name"`
+	Token  string   `json:"token"`
+	Admin  bool     `json:"admin"`
+	Scopes []string `json:"scopes,omitempty"`
+	Issued string   `json:"issued"`
+}
+
+func (rs *RSBackupAPI) mintTokenHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		rs.Errorf(r, "Bad method %s", r.Method)
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	name := r.FormValue("name")
+	auditObject(r, name)
+	if name == "" {
+		rs.Errorf(r, "Missing 'name' parameter")
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	admin := r.FormValue("admin") == "true"
+	var scopes []string
+	if s := r.FormValue("scopes"); s != "" {
+		scopes = strings.Split(s, ",")
+	}
+	secret, token, err := rs.Tokens.Mint(name, admin, scopes)
+	if err != nil {
+		rs.Errorf(r, "Unable to mint token '%s': %s", name, err)
+		switch {
+		case err == errTokenExists:
+			http.Error(w, http.StatusText(http.StatusConflict), http.StatusConflict)
+		case errors.Is(err, errUnknownScope):
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		default:
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		}
+		return
+	}
+	log.Infof("Minted token '%s' (admin: %t, scopes: %v)", name, admin, scopes)
+	rsp := &mintTokenRsp{
+		Name:   token.Name,
+		Token:  secret,
+		Admin:  token.Admin,
+		Scopes: token.Scopes,
+		Issued: token.Created.Format("2006-01-02 15:04:05"),
+	}
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(rsp)
+	if err != nil {
+		rs.Errorf(r, "Unable to marshal json response: %s", err)
+	}
+}
+
+func (rs *RSBackupAPI) revokeTokenHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		rs.Errorf(r, "Bad method %s", r.Method)
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	name, err := getURLParam(r.URL)
+	if err != nil {
+		rs.Errorf(r, "Can't revoke token: %s", err)
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	err = rs.Tokens.Revoke(name)
+	if err != nil {
+		rs.Errorf(r, "Unable to revoke token '%s': %s", name, err)
+		switch err {
+		case errTokenNotFound:
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		case errTokenStatic:
+			http.Error(w, http.StatusText(http.StatusConflict), http.StatusConflict)
+		default:
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		}
+		return
+	}
+	log.Infof("Revoked token '%s'", name)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type tokenInfo struct {
+	Name    string   `json:"name"`
+	Admin   bool     `json:"admin"`
+	Scopes  []string `json:"scopes,omitempty"`
+	Static  bool     `json:"static"`
+	Created string   `json:"created,omitempty"`
+}
+
+type listTokensRsp struct {
+	Tokens []tokenInfo `json:"tokens"`
+}
+
+func (rs *RSBackupAPI) listTokensHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		rs.Errorf(r, "Bad method %s", r.Method)
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	rsp := &listTokensRsp{Tokens: []tokenInfo{}}
+	for _, token := range rs.Tokens.List() {
+		info := tokenInfo{Name: token.Name, Admin: token.Admin, Scopes: token.Scopes, Static: token.Static}
+		if !token.Created.IsZero() {
+			info.Created = token.Created.Format("2006-01-02 15:04:05")
+		}
+		rsp.Tokens = append(rsp.Tokens, info)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(rsp)
+	if err != nil {
+		rs.Errorf(r, "Unable to marshal json response: %s", err)
+	}
+}
@@ -0,0 +1,196 @@
+package rsbackup
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strings"
+	"testing"
+)
+
+const (
+	testUserSecret   = "user-secret-0123456789"
+	testAdminSecret  = "admin-secret-0123456789"
+	testReaderSecret = "reader-secret-0123456789"
+)
+
+func newTestTokenStore(t *testing.T) *TokenStore {
+	config := &Config{
+		AuthTokens:  map[string]string{"user": testUserSecret, "reader": testReaderSecret},
+		AdminTokens: map[string]string{"admin": testAdminSecret},
+		TokenScopes: map[string][]string{"reader": {ScopeRead}},
+	}
+	tokens, err := NewTokenStore(path.Join(createTMPDir(t, "rsbackup"), "tokens.json"), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tokens
+}
+
+func TestAuthenticated(t *testing.T) {
+	authTests := []struct {
+		name           string
+		disabled       bool
+		scope          string
+		authHeader     string
+		expectedStatus int
+		expectedRsp    string
+	}{
+		{"auth disabled", true, ScopeRead, "", 200, "hello anonymous"},
+		{"missing token", false, ScopeRead, "", 401, "Unauthorized\n"},
+		{"not a bearer token", false, ScopeRead, "Basic " + testUserSecret, 401, "Unauthorized\n"},
+		{"wrong token", false, ScopeRead, "Bearer user-secret-012345678", 401, "Unauthorized\n"},
+		{"valid token", false, ScopeRead, "Bearer " + testUserSecret, 200, "hello user"},
+		{"admin token on data endpoint", false, ScopeRead, "Bearer " + testAdminSecret, 200, "hello admin"},
+		{"user token on admin endpoint", false, ScopeAdmin, "Bearer " + testUserSecret, 403, "Missing scope 'admin'\n"},
+		{"read only token reading", false, ScopeRead, "Bearer " + testReaderSecret, 200, "hello reader"},
+		{"read only token writing", false, ScopeWrite, "Bearer " + testReaderSecret, 403, "Missing scope 'write'\n"},
+		{"read only token repairing", false, ScopeRepair, "Bearer " + testReaderSecret, 403, "Missing scope 'repair'\n"},
+		{"user token repairing", false, ScopeRepair, "Bearer " + testUserSecret, 200, "hello user"},
+		{"admin token writing", false, ScopeWrite, "Bearer " + testAdminSecret, 200, "hello admin"},
+		{"admin token on admin endpoint", false, ScopeAdmin, "Bearer " + testAdminSecret, 200, "hello admin"},
+	}
+
+	for _, tt := range authTests {
+		t.Run(tt.name, func(t *testing.T) {
+			api := &RSBackupAPI{Config: &Config{}}
+			if !tt.disabled {
+				api.Tokens = newTestTokenStore(t)
+			}
+			handler := api.authenticated(tt.scope, func(w http.ResponseWriter, r *http.Request) {
+				name := "anonymous"
+				if token, ok := requestToken(r); ok {
+					name = token.Name
+				}
+				fmt.Fprintf(w, "hello %s", name)
+			})
+
+			req := httptest.NewRequest("GET", "/list_data", nil)
+			if tt.authHeader != "" {
+				req.Header.Set("Authorization", tt.authHeader)
+			}
+			rr := httptest.NewRecorder()
+			handler(rr, req)
+
+			if rr.Code != tt.expectedStatus {
+				t.Errorf("Got status code %d, expected %d", rr.Code, tt.expectedStatus)
+			}
+			if rr.Body.String() != tt.expectedRsp {
+				t.Errorf("Got rsp body '%s', expected '%s'", rr.Body.String(), tt.expectedRsp)
+			}
+		})
+	}
+}
+
+func TestTokenAdminHandlers(t *testing.T) {
+	tokensPath := path.Join(createTMPDir(t, "rsbackup"), "tokens.json")
+	config := &Config{AdminTokens: map[string]string{"admin": testAdminSecret}}
+	tokens, err := NewTokenStore(tokensPath, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	api := &RSBackupAPI{Config: config, Tokens: tokens}
+
+	req := httptest.NewRequest("POST", "/mint_token", strings.NewReader("name=backup-agent"))
+	req.Header.Set("content-type", "application/x-www-form-urlencoded")
+	rr := httptest.NewRecorder()
+	api.mintTokenHandler(rr, req)
+	if rr.Code != 200 {
+		t.Fatalf("Got status code %d minting token, expected 200", rr.Code)
+	}
+	var minted mintTokenRsp
+	err = json.NewDecoder(rr.Body).Decode(&minted)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Minted tokens survive restarts, their secrets are not stored.
+	api.Tokens, err = NewTokenStore(tokensPath, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token, ok := api.Tokens.Authenticate(minted.Token); !ok || token.Name != "backup-agent" || token.Admin {
+		t.Errorf("Minted token not accepted after reload, got %+v", token)
+	}
+	for _, token := range api.Tokens.List() {
+		if strings.Contains(token.Hash, minted.Token) {
+			t.Errorf("Token secret stored in plain text")
+		}
+	}
+
+	adminTests := []struct {
+		name           string
+		handler        http.HandlerFunc
+		method         string
+		url            string
+		body           string
+		expectedStatus int
+	}{
+		{"mint duplicate", api.mintTokenHandler, "POST", "/mint_token", "name=backup-agent", 409},
+		{"mint without name", api.mintTokenHandler, "POST", "/mint_token", "", 400},
+		{"mint with scopes", api.mintTokenHandler, "POST", "/mint_token", "name=uploader&scopes=read,write", 200},
+		{"mint with unknown scope", api.mintTokenHandler, "POST", "/mint_token", "name=deleter&scopes=delete", 400},
+		{"list", api.listTokensHandler, "GET", "/list_tokens", "", 200},
+		{"revoke static", api.revokeTokenHandler, "POST", "/revoke_token/admin", "", 409},
+		{"revoke unknown", api.revokeTokenHandler, "POST", "/revoke_token/nobody", "", 404},
+		{"revoke", api.revokeTokenHandler, "POST", "/revoke_token/backup-agent", "", 204},
+	}
+	for _, tt := range adminTests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.url, strings.NewReader(tt.body))
+			req.Header.Set("content-type", "application/x-www-form-urlencoded")
+			rr := httptest.NewRecorder()
+			tt.handler(rr, req)
+			if rr.Code != tt.expectedStatus {
+				t.Errorf("Got status code %d, expected %d", rr.Code, tt.expectedStatus)
+			}
+		})
+	}
+
+	if _, ok := api.Tokens.Authenticate(minted.Token); ok {
+		t.Errorf("Revoked token still accepted")
+	}
+	for _, token := range api.Tokens.List() {
+		if token.Name == "uploader" && (!token.HasScope(ScopeWrite) || token.HasScope(ScopeRepair)) {
+			t.Errorf("Minted token has wrong scopes %v", token.Scopes)
+		}
+	}
+}
+
+func TestNewTokenStoreValidation(t *testing.T) {
+	_, err := NewTokenStore(path.Join(createTMPDir(t, "rsbackup"), "tokens.json"), &Config{
+		AuthTokens: map[string]string{"short": "secret"},
+	})
+	if err == nil {
+		t.Errorf("Expected error for short static token")
+	}
+	_, err = NewTokenStore(path.Join(createTMPDir(t, "rsbackup"), "tokens.json"), &Config{
+		AuthTokens:  map[string]string{"dup": testUserSecret},
+		AdminTokens: map[string]string{"dup": testAdminSecret},
+	})
+	if err == nil {
+		t.Errorf("Expected error for duplicate token name")
+	}
+	_, err = NewTokenStore(path.Join(createTMPDir(t, "rsbackup"), "tokens.json"), &Config{
+		AuthTokens:  map[string]string{"user": testUserSecret},
+		TokenScopes: map[string][]string{"user": {"delete"}},
+	})
+	if err == nil {
+		t.Errorf("Expected error for unknown scope")
+	}
+	_, err = NewTokenStore(path.Join(createTMPDir(t, "rsbackup"), "tokens.json"), &Config{
+		AdminTokens: map[string]string{"admin": testAdminSecret},
+		TokenScopes: map[string][]string{"admin": {ScopeRead}},
+	})
+	if err == nil {
+		t.Errorf("Expected error for restricted admin token")
+	}
+	_, err = NewTokenStore(path.Join(createTMPDir(t, "rsbackup"), "tokens.json"), &Config{
+		TokenScopes: map[string][]string{"nobody": {ScopeRead}},
+	})
+	if err == nil {
+		t.Errorf("Expected error for scopes of unknown token")
+	}
+}
@@ -0,0 +1,569 @@
+package rsbackup
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	b2AuthorizeURL = "https://api.backblazeb2.com/b2api/v2/b2_authorize_account"
+	// b2MaxCopySize is the largest file b2_copy_file copies in one call,
+	// larger ones are copied in parts.
+	b2MaxCopySize = 5 * 1000 * 1000 * 1000
+	// b2Retries is how often a call is tried again after B2 was busy or
+	// unreachable, waiting twice as long each time.
+	b2Retries = 6
+)
+
+// b2Auth is the answer of b2_authorize_account.
+type b2Auth struct {
+	AccountID           string `json:"accountId"`
+	Token               string `json:"authorizationToken"`
+	APIURL              string `json:"apiUrl"`
+	DownloadURL         string `json:"downloadUrl"`
+	RecommendedPartSize int64  `json:"recommendedPartSize"`
+	Allowed             struct {
+		BucketID   string `json:"bucketId"`
+		BucketName string `json:"bucketName"`
+	} `json:"allowed"`
+}
+
+// b2File is a file version as B2 lists it.
+type b2File struct {
+	FileID          string `json:"fileId"`
+	FileName        string `json:"fileName"`
+	ContentLength   int64  `json:"contentLength"`
+	UploadTimestamp int64  `json:"uploadTimestamp"`
+}
+
+// B2Backend stores files in a Backblaze B2 bucket, through the native
+// API. Files larger than the part size B2 recommends are uploaded and
+// copied as large files, in parts.
+type B2Backend struct {
+	*objectBackend
+	bucket       string
+	keyID        string
+	appKey       string
+	authorizeURL string
+	client       *http.Client
+	retryDelay   time.Duration
+	// partSize overrides the part size recommended for the account.
+	partSize    int64
+	maxCopySize int64
+	bucketID    string
+
+	mu   sync.Mutex
+	auth *b2Auth
+}
+
+// NewB2Backend returns a backend for config.B2Bucket, authorizing with
+// config.B2KeyID and the application key in config.B2ApplicationKeyPath.
+func NewB2Backend(config *Config) (*B2Backend, error) {
+	appKey, err := ioutil.ReadFile(config.B2ApplicationKeyPath)
+	if err != nil {
+		return nil, err
+	}
+	b, err := newB2Backend(config, strings.TrimSpace(string(appKey)), b2AuthorizeURL)
+	if err != nil {
+		return nil, err
+	}
+	err = b.connect()
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+func newB2Backend(config *Config, appKey, authorizeURL string) (*B2Backend, error) {
+	b := &B2Backend{
+		bucket:       config.B2Bucket,
+		keyID:        config.B2KeyID,
+		appKey:       appKey,
+		authorizeURL: authorizeURL,
+		client:       &http.Client{Timeout: 10 * time.Minute},
+		retryDelay:   time.Second,
+		maxCopySize:  b2MaxCopySize,
+	}
+	var err error
+	b.objectBackend, err = newObjectBackend(config, config.B2Prefix, b)
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// connect authorizes and looks up the bucket, so bad credentials are
+// found on startup rather than on the first request.
+func (b *B2Backend) connect() error {
+	auth, err := b.authorization()
+	if err != nil {
+		return err
+	}
+	if auth.Allowed.BucketID != "" {
+		if auth.Allowed.BucketName != b.bucket {
+			return fmt.Errorf("B2 key is restricted to bucket %s", auth.Allowed.BucketName)
+		}
+		b.bucketID = auth.Allowed.BucketID
+		return nil
+	}
+	var body struct {
+		Buckets []struct {
+			BucketID string `json:"bucketId"`
+		} `json:"buckets"`
+	}
+	err = b.call("b2_list_buckets", map[string]string{"accountId": auth.AccountID, "bucketName": b.bucket}, &body)
+	if err != nil {
+		return err
+	}
+	if len(body.Buckets) == 0 {
+		return fmt.Errorf("B2 bucket %s doesn't exist", b.bucket)
+	}
+	b.bucketID = body.Buckets[0].BucketID
+	return nil
+}
+
+// authorization returns the current authorization, asking for one if
+// there is none.
+func (b *B2Backend) authorization() (*b2Auth, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.auth != nil {
+		return b.auth, nil
+	}
+	req, err := http.NewRequest("GET", b.authorizeURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.SetBasicAuth(b.keyID, b.appKey)
+	rsp, err := b.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Authorizing with B2 failed: %s", b2Error(rsp))
+	}
+	auth := &b2Auth{}
+	err = json.NewDecoder(rsp.Body).Decode(auth)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot parse B2 authorization: %s", err)
+	}
+	b.auth = auth
+	return auth, nil
+}
+
+// expire drops auth, unless it was replaced already.
+func (b *B2Backend) expire(auth *b2Auth) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.auth == auth {
+		b.auth = nil
+	}
+}
+
+// b2Error reads the error B2 answered with. Missing files give an error
+// that os.IsNotExist understands.
+func b2Error(rsp *http.Response) error {
+	_, err := b2ErrorCode(rsp)
+	return err
+}
+
+// b2ErrorCode is b2Error, also returning the code of the error.
+func b2ErrorCode(rsp *http.Response) (string, error) {
+	var body struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	}
+	json.NewDecoder(rsp.Body).Decode(&body)
+	if rsp.StatusCode == http.StatusNotFound || body.Code == "file_not_present" {
+		return body.Code, os.ErrNotExist
+	}
+	return body.Code, fmt.Errorf("B2 returned %s: %s %s", rsp.Status, body.Code, body.Message)
+}
+
+// send does the request newRequest makes, which is called again for every
+// attempt. Expired tokens are renewed right away. When B2 is busy or
+// unreachable, send waits as long as B2 asks, or else twice as long as
+// the last time, and tries again.
+func (b *B2Backend) send(newRequest func(auth *b2Auth) (*http.Request, error)) (*http.Response, error) {
+	delay := b.retryDelay
+	for attempt := 0; ; attempt++ {
+		auth, err := b.authorization()
+		if err != nil {
+			return nil, err
+		}
+		req, err := newRequest(auth)
+		if err != nil {
+			return nil, err
+		}
+		rsp, err := b.client.Do(req)
+		wait := delay
+		if err == nil {
+			switch {
+			case rsp.StatusCode == http.StatusUnauthorized:
+				var code string
+				code, err = b2ErrorCode(rsp)
+				rsp.Body.Close()
+				if code != "expired_auth_token" && code != "bad_auth_token" {
+					return nil, err
+				}
+				b.expire(auth)
+				wait = 0
+			case rsp.StatusCode == http.StatusTooManyRequests || rsp.StatusCode == http.StatusRequestTimeout || rsp.StatusCode >= 500:
+				if seconds, convErr := strconv.Atoi(rsp.Header.Get("Retry-After")); convErr == nil {
+					wait = time.Duration(seconds) * time.Second
+				}
+				err = b2Error(rsp)
+				rsp.Body.Close()
+			default:
+				return rsp, nil
+			}
+		}
+		if attempt >= b2Retries {
+			return nil, err
+		}
+		time.Sleep(wait)
+		if wait > 0 {
+			delay *= 2
+		}
+	}
+}
+
+// call posts params to the API called api and decodes the answer into
+// result, if it isn't nil.
+func (b *B2Backend) call(api string, params interface{}, result interface{}) error {
+	encoded, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+	rsp, err := b.send(func(auth *b2Auth) (*http.Request, error) {
+		req, err := http.NewRequest("POST", auth.APIURL+"/b2api/v2/"+api, bytes.NewReader(encoded))
+		if err == nil {
+			req.Header.Set("Authorization", auth.Token)
+		}
+		return req, err
+	})
+	if err != nil {
+		return err
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode != http.StatusOK {
+		return b2Error(rsp)
+	}
+	if result == nil {
+		return nil
+	}
+	return json.NewDecoder(rsp.Body).Decode(result)
+}
+
+// b2EscapeName percent-encodes a file name for URLs and headers, leaving
+// the slashes.
+func b2EscapeName(name string) string {
+	segments := strings.Split(name, "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+	return strings.Join(segments, "/")
+}
+
+func b2Time(timestamp int64) time.Time {
+	return time.Unix(0, timestamp*int64(time.Millisecond))
+}
+
+func (b *B2Backend) uploadPartSize() (int64, error) {
+	if b.partSize > 0 {
+		return b.partSize, nil
+	}
+	auth, err := b.authorization()
+	if err != nil {
+		return 0, err
+	}
+	return auth.RecommendedPartSize, nil
+}
+
+func (b *B2Backend) list(prefix string, limit int) ([]string, error) {
+	var names []string
+	start := ""
+	for {
+		params := map[string]interface{}{"bucketId": b.bucketID, "prefix": prefix, "delimiter": "/", "maxFileCount": 1000}
+		if limit > 0 {
+			params["maxFileCount"] = limit
+		}
+		if start != "" {
+			params["startFileName"] = start
+		}
+		var body struct {
+			Files        []b2File `json:"files"`
+			NextFileName string   `json:"nextFileName"`
+		}
+		err := b.call("b2_list_file_names", params, &body)
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range body.Files {
+			names = append(names, strings.TrimSuffix(strings.TrimPrefix(f.FileName, prefix), "/"))
+		}
+		start = body.NextFileName
+		if start == "" || (limit > 0 && len(names) >= limit) {
+			return names, nil
+		}
+	}
+}
+
+// lookup returns the current version of the file name.
+func (b *B2Backend) lookup(name string) (*b2File, error) {
+	var body struct {
+		Files []b2File `json:"files"`
+	}
+	err := b.call("b2_list_file_names", map[string]interface{}{"bucketId": b.bucketID, "prefix": name, "startFileName": name, "maxFileCount": 1}, &body)
+	if err != nil {
+		return nil, err
+	}
+	if len(body.Files) == 0 || body.Files[0].FileName != name {
+		return nil, os.ErrNotExist
+	}
+	return &body.Files[0], nil
+}
+
+func (b *B2Backend) stat(name string) (int64, time.Time, error) {
+	f, err := b.lookup(name)
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	return f.ContentLength, b2Time(f.UploadTimestamp), nil
+}
+
+// download returns the ID of the file version as its version.
+func (b *B2Backend) download(name string, w io.Writer) (string, time.Time, error) {
+	rsp, err := b.send(func(auth *b2Auth) (*http.Request, error) {
+		req, err := http.NewRequest("GET", auth.DownloadURL+"/file/"+url.PathEscape(b.bucket)+"/"+b2EscapeName(name), nil)
+		if err == nil {
+			req.Header.Set("Authorization", auth.Token)
+		}
+		return req, err
+	})
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode != http.StatusOK {
+		return "", time.Time{}, b2Error(rsp)
+	}
+	fileID := rsp.Header.Get("X-Bz-File-Id")
+	if fileID == "" {
+		return "", time.Time{}, fmt.Errorf("B2 returned no file ID for '%s'", name)
+	}
+	timestamp, _ := strconv.ParseInt(rsp.Header.Get("X-Bz-Upload-Timestamp"), 10, 64)
+	_, err = io.Copy(w, rsp.Body)
+	return fileID, b2Time(timestamp), err
+}
+
+// upload stores a new version of name, then deletes the one replaced. B2
+// has no conditional uploads, so the current version is only checked
+// before uploading.
+func (b *B2Backend) upload(name string, src io.ReaderAt, size int64, version string) error {
+	current, err := b.lookup(name)
+	switch {
+	case err == nil && current.FileID != version:
+		return os.ErrExist
+	case os.IsNotExist(err) && version != "":
+		return os.ErrExist
+	case err != nil && !os.IsNotExist(err):
+		return err
+	}
+	partSize, err := b.uploadPartSize()
+	if err != nil {
+		return err
+	}
+	if size > partSize {
+		err = b.uploadLarge(name, src, size, partSize)
+	} else {
+		_, err = b.sendData("b2_get_upload_url", map[string]string{"bucketId": b.bucketID}, io.NewSectionReader(src, 0, size), http.Header{
+			"X-Bz-File-Name": {b2EscapeName(name)},
+			"Content-Type":   {"b2/x-auto"},
+		})
+	}
+	if err != nil || version == "" {
+		return err
+	}
+	return b.call("b2_delete_file_version", map[string]string{"fileName": name, "fileId": version}, nil)
+}
+
+// sendData uploads data to an upload URL from the API called api, with a
+// new URL for every attempt as B2 asks. It returns the SHA1 of data.
+func (b *B2Backend) sendData(api string, params map[string]string, data *io.SectionReader, header http.Header) (string, error) {
+	hash := sha1.New()
+	_, err := io.Copy(hash, data)
+	if err != nil {
+		return "", err
+	}
+	sum := hex.EncodeToString(hash.Sum(nil))
+	rsp, err := b.send(func(*b2Auth) (*http.Request, error) {
+		var target struct {
+			UploadURL string `json:"uploadUrl"`
+			Token     string `json:"authorizationToken"`
+		}
+		err := b.call(api, params, &target)
+		if err != nil {
+			return nil, err
+		}
+		req, err := http.NewRequest("POST", target.UploadURL, io.NewSectionReader(data, 0, data.Size()))
+		if err != nil {
+			return nil, err
+		}
+		req.ContentLength = data.Size()
+		for key, values := range header {
+			req.Header[key] = values
+		}
+		req.Header.Set("Authorization", target.Token)
+		req.Header.Set("X-Bz-Content-Sha1", sum)
+		return req, nil
+	})
+	if err != nil {
+		return "", err
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode != http.StatusOK {
+		return "", b2Error(rsp)
+	}
+	return sum, nil
+}
+
+// largeFile starts a large file called name and calls addPart with the
+// number of each part until it reports the last one. The file is
+// finished with the SHA1s addPart returns, or cancelled if it fails.
+func (b *B2Backend) largeFile(name string, addPart func(fileID string, number int) (sum string, last bool, err error)) error {
+	var large struct {
+		FileID string `json:"fileId"`
+	}
+	err := b.call("b2_start_large_file", map[string]string{"bucketId": b.bucketID, "fileName": name, "contentType": "b2/x-auto"}, &large)
+	if err != nil {
+		return err
+	}
+	var sums []string
+	for number, last := 1, false; !last; number++ {
+		var sum string
+		sum, last, err = addPart(large.FileID, number)
+		if err != nil {
+			b.call("b2_cancel_large_file", map[string]string{"fileId": large.FileID}, nil)
+			return err
+		}
+		sums = append(sums, sum)
+	}
+	return b.call("b2_finish_large_file", map[string]interface{}{"fileId": large.FileID, "partSha1Array": sums}, nil)
+}
+
+func (b *B2Backend) uploadLarge(name string, src io.ReaderAt, size, partSize int64) error {
+	return b.largeFile(name, func(fileID string, number int) (string, bool, error) {
+		offset := int64(number-1) * partSize
+		n := partSize
+		if offset+n >= size {
+			n = size - offset
+		}
+		sum, err := b.sendData("b2_get_upload_part_url", map[string]string{"fileId": fileID}, io.NewSectionReader(src, offset, n), http.Header{
+			"X-Bz-Part-Number": {strconv.Itoa(number)},
+		})
+		return sum, offset+n >= size, err
+	})
+}
+
+// versions returns the IDs of all versions of the file name, hidden ones
+// included.
+func (b *B2Backend) versions(name string) ([]string, error) {
+	var ids []string
+	params := map[string]interface{}{"bucketId": b.bucketID, "prefix": name, "startFileName": name, "maxFileCount": 1000}
+	for {
+		var body struct {
+			Files        []b2File `json:"files"`
+			NextFileName string   `json:"nextFileName"`
+			NextFileID   string   `json:"nextFileId"`
+		}
+		err := b.call("b2_list_file_versions", params, &body)
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range body.Files {
+			if f.FileName == name {
+				ids = append(ids, f.FileID)
+			}
+		}
+		if body.NextFileName != name {
+			return ids, nil
+		}
+		params["startFileId"] = body.NextFileID
+	}
+}
+
+// remove deletes every version of name, so no old ones are kept around.
+func (b *B2Backend) remove(name string) error {
+	ids, err := b.versions(name)
+	if err != nil {
+		return err
+	}
+	if len(ids) == 0 {
+		return os.ErrNotExist
+	}
+	for _, id := range ids {
+		err = b.call("b2_delete_file_version", map[string]string{"fileName": name, "fileId": id}, nil)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// copy copies src to dst within the bucket, in parts for files too large
+// to copy at once, then deletes the versions of dst it replaced.
+func (b *B2Backend) copy(src, dst string) error {
+	f, err := b.lookup(src)
+	if err != nil {
+		return err
+	}
+	replaced, err := b.versions(dst)
+	if err != nil {
+		return err
+	}
+	if f.ContentLength <= b.maxCopySize {
+		err = b.call("b2_copy_file", map[string]string{"sourceFileId": f.FileID, "fileName": dst}, nil)
+	} else {
+		err = b.largeFile(dst, func(fileID string, number int) (string, bool, error) {
+			offset := int64(number-1) * b.maxCopySize
+			end := offset + b.maxCopySize
+			if end > f.ContentLength {
+				end = f.ContentLength
+			}
+			var part struct {
+				ContentSha1 string `json:"contentSha1"`
+			}
+			err := b.call("b2_copy_part", map[string]interface{}{
+				"sourceFileId": f.FileID,
+				"largeFileId":  fileID,
+				"partNumber":   number,
+				"range":        fmt.Sprintf("bytes=%d-%d", offset, end-1),
+			}, &part)
+			return part.ContentSha1, end >= f.ContentLength, err
+		})
+	}
+	if err != nil {
+		return err
+	}
+	for _, id := range replaced {
+		err = b.call("b2_delete_file_version", map[string]string{"fileName": dst, "fileId": id}, nil)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,421 @@
+package rsbackup
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type fakeB2Version struct {
+	id   string
+	name string
+	data []byte
+}
+
+type fakeB2Large struct {
+	name  string
+	parts map[int][]byte
+}
+
+// fakeB2 implements the parts of the B2 native API that B2Backend uses,
+// for a single bucket.
+type fakeB2 struct {
+	mu  sync.Mutex
+	url string
+	// versions are kept in the order they were uploaded.
+	versions []*fakeB2Version
+	large    map[string]*fakeB2Large
+	ids      int
+	tokens   int
+	// busy is the number of uploads still answered with 503.
+	busy int
+}
+
+func (f *fakeB2) newID() string {
+	f.ids++
+	return fmt.Sprintf("file-%d", f.ids)
+}
+
+func (f *fakeB2) token() string {
+	return fmt.Sprintf("token-%d", f.tokens)
+}
+
+// latest returns the current version of every file, sorted by name.
+func (f *fakeB2) latest() []*fakeB2Version {
+	current := map[string]*fakeB2Version{}
+	for _, v := range f.versions {
+		current[v.name] = v
+	}
+	var latest []*fakeB2Version
+	for _, v := range current {
+		latest = append(latest, v)
+	}
+	sort.Slice(latest, func(i, j int) bool { return latest[i].name < latest[j].name })
+	return latest
+}
+
+func (f *fakeB2) byID(id string) *fakeB2Version {
+	for _, v := range f.versions {
+		if v.id == id {
+			return v
+		}
+	}
+	return nil
+}
+
+func fakeB2Error(w http.ResponseWriter, status int, code string) {
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{"status": status, "code": code, "message": code})
+}
+
+func fakeB2Entry(v *fakeB2Version) map[string]interface{} {
+	return map[string]interface{}{"fileId": v.id, "fileName": v.name, "contentLength": len(v.data), "uploadTimestamp": time.Now().UnixNano() / int64(time.Millisecond)}
+}
+
+func (f *fakeB2) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if r.URL.Path == "/b2api/v2/b2_authorize_account" {
+		if user, pass, _ := r.BasicAuth(); user != "key-id" || pass != "app-key" {
+			fakeB2Error(w, http.StatusUnauthorized, "unauthorized")
+			return
+		}
+		f.tokens++
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"accountId":           "account",
+			"authorizationToken":  f.token(),
+			"apiUrl":              f.url,
+			"downloadUrl":         f.url,
+			"recommendedPartSize": 100 * 1000 * 1000,
+			"allowed":             map[string]string{"bucketId": "bucket-id", "bucketName": "bucket"},
+		})
+		return
+	}
+	if r.Header.Get("Authorization") != f.token() {
+		fakeB2Error(w, http.StatusUnauthorized, "expired_auth_token")
+		return
+	}
+	var params struct {
+		BucketID      string   `json:"bucketId"`
+		FileID        string   `json:"fileId"`
+		FileName      string   `json:"fileName"`
+		Prefix        string   `json:"prefix"`
+		Delimiter     string   `json:"delimiter"`
+		StartFileName string   `json:"startFileName"`
+		MaxFileCount  int      `json:"maxFileCount"`
+		SourceFileID  string   `json:"sourceFileId"`
+		LargeFileID   string   `json:"largeFileId"`
+		PartNumber    int      `json:"partNumber"`
+		Range         string   `json:"range"`
+		PartSha1Array []string `json:"partSha1Array"`
+	}
+	if strings.HasPrefix(r.URL.Path, "/b2api/v2/") {
+		json.NewDecoder(r.Body).Decode(&params)
+	}
+	switch r.URL.Path {
+	case "/b2api/v2/b2_list_file_names":
+		var files []map[string]interface{}
+		folders := map[string]bool{}
+		next := ""
+		for _, v := range f.latest() {
+			if !strings.HasPrefix(v.name, params.Prefix) || v.name < params.StartFileName {
+				continue
+			}
+			if len(files) == params.MaxFileCount {
+				next = v.name
+				break
+			}
+			if i := strings.Index(v.name[len(params.Prefix):], "/"); params.Delimiter == "/" && i >= 0 {
+				folder := v.name[:len(params.Prefix)+i+1]
+				if !folders[folder] {
+					folders[folder] = true
+					files = append(files, map[string]interface{}{"fileName": folder, "action": "folder"})
+				}
+				continue
+			}
+			files = append(files, fakeB2Entry(v))
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"files": files, "nextFileName": next})
+	case "/b2api/v2/b2_list_file_versions":
+		var files []map[string]interface{}
+		for i := len(f.versions) - 1; i >= 0; i-- {
+			if v := f.versions[i]; strings.HasPrefix(v.name, params.Prefix) && v.name >= params.StartFileName {
+				files = append(files, fakeB2Entry(v))
+			}
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"files": files})
+	case "/b2api/v2/b2_delete_file_version":
+		for i, v := range f.versions {
+			if v.id == params.FileID && v.name == params.FileName {
+				f.versions = append(f.versions[:i], f.versions[i+1:]...)
+				json.NewEncoder(w).Encode(map[string]string{"fileId": v.id})
+				return
+			}
+		}
+		fakeB2Error(w, http.StatusBadRequest, "file_not_present")
+	case "/b2api/v2/b2_get_upload_url":
+		json.NewEncoder(w).Encode(map[string]string{"uploadUrl": f.url + "/upload", "authorizationToken": f.token()})
+	case "/b2api/v2/b2_get_upload_part_url":
+		json.NewEncoder(w).Encode(map[string]string{"uploadUrl": f.url + "/upload_part/" + params.FileID, "authorizationToken": f.token()})
+	case "/b2api/v2/b2_start_large_file":
+		id := f.newID()
+		f.large[id] = &fakeB2Large{name: params.FileName, parts: map[int][]byte{}}
+		json.NewEncoder(w).Encode(map[string]string{"fileId": id, "fileName": params.FileName})
+	case "/b2api/v2/b2_finish_large_file":
+		large := f.large[params.FileID]
+		data := []byte{}
+		for i := 1; i <= len(params.PartSha1Array); i++ {
+			sum := sha1.Sum(large.parts[i])
+			if hex.EncodeToString(sum[:]) != params.PartSha1Array[i-1] {
+				fakeB2Error(w, http.StatusBadRequest, "bad_request")
+				return
+			}
+			data = append(data, large.parts[i]...)
+		}
+		delete(f.large, params.FileID)
+		f.versions = append(f.versions, &fakeB2Version{id: params.FileID, name: large.name, data: data})
+		json.NewEncoder(w).Encode(map[string]string{"fileId": params.FileID})
+	case "/b2api/v2/b2_cancel_large_file":
+		delete(f.large, params.FileID)
+		json.NewEncoder(w).Encode(map[string]string{"fileId": params.FileID})
+	case "/b2api/v2/b2_copy_file":
+		src := f.byID(params.SourceFileID)
+		if src == nil {
+			fakeB2Error(w, http.StatusBadRequest, "file_not_present")
+			return
+		}
+		v := &fakeB2Version{id: f.newID(), name: params.FileName, data: src.data}
+		f.versions = append(f.versions, v)
+		json.NewEncoder(w).Encode(fakeB2Entry(v))
+	case "/b2api/v2/b2_copy_part":
+		src := f.byID(params.SourceFileID)
+		var start, end int
+		fmt.Sscanf(params.Range, "bytes=%d-%d", &start, &end)
+		part := src.data[start : end+1]
+		f.large[params.LargeFileID].parts[params.PartNumber] = part
+		sum := sha1.Sum(part)
+		json.NewEncoder(w).Encode(map[string]string{"contentSha1": hex.EncodeToString(sum[:])})
+	default:
+		if strings.HasPrefix(r.URL.Path, "/upload") {
+			if f.busy > 0 {
+				f.busy--
+				fakeB2Error(w, http.StatusServiceUnavailable, "service_unavailable")
+				return
+			}
+			data, _ := ioutil.ReadAll(r.Body)
+			sum := sha1.Sum(data)
+			if hex.EncodeToString(sum[:]) != r.Header.Get("X-Bz-Content-Sha1") {
+				fakeB2Error(w, http.StatusBadRequest, "bad_request")
+				return
+			}
+			if strings.HasPrefix(r.URL.Path, "/upload_part/") {
+				var number int
+				fmt.Sscanf(r.Header.Get("X-Bz-Part-Number"), "%d", &number)
+				f.large[strings.TrimPrefix(r.URL.Path, "/upload_part/")].parts[number] = data
+				json.NewEncoder(w).Encode(map[string]int{"partNumber": number})
+				return
+			}
+			name, _ := url.PathUnescape(r.Header.Get("X-Bz-File-Name"))
+			v := &fakeB2Version{id: f.newID(), name: name, data: data}
+			f.versions = append(f.versions, v)
+			json.NewEncoder(w).Encode(fakeB2Entry(v))
+			return
+		}
+		if name := strings.TrimPrefix(r.URL.Path, "/file/bucket/"); name != r.URL.Path {
+			for _, v := range f.latest() {
+				if v.name == name {
+					w.Header().Set("X-Bz-File-Id", v.id)
+					w.Header().Set("X-Bz-Upload-Timestamp", "1700000000000")
+					w.Write(v.data)
+					return
+				}
+			}
+		}
+		fakeB2Error(w, http.StatusNotFound, "not_found")
+	}
+}
+
+func newTestB2Backend(t *testing.T) (*B2Backend, *fakeB2) {
+	fake := &fakeB2{large: make(map[string]*fakeB2Large)}
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+	fake.url = server.URL
+
+	conf := &Config{BackupRoot: createTMPDir(t, "rsbackup"), B2Bucket: "bucket", B2Prefix: "backups/", B2KeyID: "key-id"}
+	b, err := newB2Backend(conf, "app-key", server.URL+"/b2api/v2/b2_authorize_account")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.retryDelay = time.Millisecond
+	err = b.connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b, fake
+}
+
+func TestB2Backend(t *testing.T) {
+	b, fake := newTestB2Backend(t)
+	fpath := path.Join(b.root, "85/tyger")
+	f, err := b.CreateExclusive(fpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("tyger tyger"))
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if len(fake.versions) != 1 || fake.versions[0].name != "backups/85/tyger" {
+		t.Fatalf("File not uploaded under the prefix, got %v", fake.versions)
+	}
+	if _, err := b.CreateExclusive(fpath); !os.IsExist(err) {
+		t.Errorf("Got %v creating an existing file", err)
+	}
+
+	// Uploads don't replace files changed since they were opened, and
+	// replaced versions are deleted.
+	f, err = b.OpenWritable(fpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, _ := b.OpenWritable(fpath)
+	other.Write([]byte("Tyger"))
+	if err := other.Close(); err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("TYGER"))
+	if err := f.Close(); !os.IsExist(err) {
+		t.Errorf("Got %v replacing a changed file", err)
+	}
+	if len(fake.versions) != 1 || string(fake.versions[0].data) != "Tyger tyger" {
+		t.Errorf("Got versions %v", fake.versions)
+	}
+
+	names, err := b.List(b.root)
+	if err != nil || len(names) != 1 || names[0] != "85" {
+		t.Errorf("Got names %v (error: %v)", names, err)
+	}
+	if stat, err := b.Stat(path.Join(b.root, "85")); err != nil || !stat.IsDir() {
+		t.Errorf("Got %v stating a directory (error: %v)", stat, err)
+	}
+	err = b.Rename(fpath, path.Join(b.root, "tyger"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Stat(fpath); !os.IsNotExist(err) {
+		t.Errorf("Got %v stating a renamed file", err)
+	}
+	if stat, err := b.Stat(path.Join(b.root, "tyger")); err != nil || stat.Size() != 11 {
+		t.Errorf("Got %v after rename (error: %v)", stat, err)
+	}
+	if err := b.Remove(fpath); !os.IsNotExist(err) {
+		t.Errorf("Got %v removing a missing file", err)
+	}
+	if spooled, _ := ioutil.ReadDir(b.spoolDir); len(spooled) != 0 {
+		t.Errorf("Spooled files left behind: %v", spooled)
+	}
+}
+
+func TestB2BackendLargeFiles(t *testing.T) {
+	b, fake := newTestB2Backend(t)
+	b.partSize = 4
+	b.maxCopySize = 4
+	fpath := path.Join(b.root, "tyger")
+	f, err := b.CreateExclusive(fpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("tyger tyger"))
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	err = b.Rename(fpath, path.Join(b.root, "lion"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fake.versions) != 1 || fake.versions[0].name != "backups/lion" || string(fake.versions[0].data) != "tyger tyger" || len(fake.large) != 0 {
+		t.Errorf("Got versions %v, unfinished large files %v", fake.versions, fake.large)
+	}
+}
+
+func TestB2BackendRetries(t *testing.T) {
+	b, fake := newTestB2Backend(t)
+	// Expire the token and make B2 busy for a few uploads.
+	fake.tokens++
+	fake.busy = 2
+	f, err := b.CreateExclusive(path.Join(b.root, "tyger"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("tyger tyger"))
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if len(fake.versions) != 1 {
+		t.Errorf("Got versions %v", fake.versions)
+	}
+
+	fake.busy = b2Retries + 1
+	f, _ = b.CreateExclusive(path.Join(b.root, "lion"))
+	f.Write([]byte("lion"))
+	if err := f.Close(); err == nil {
+		t.Errorf("Upload succeeded while B2 was busy")
+	}
+}
+
+func TestHandlersWithB2Backend(t *testing.T) {
+	b, fake := newTestB2Backend(t)
+	testData, err := ioutil.ReadFile("testdata/tyger")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := &Config{BackupRoot: b.root, DataShards: 2, ParityShards: 1}
+	api := &RSBackupAPI{Config: conf, RsFileMan: &RSFileManager{Config: conf, Storage: b}}
+
+	body := new(bytes.Buffer)
+	multipartWriter := multipart.NewWriter(body)
+	form, _ := multipartWriter.CreateFormFile("file", "tyger")
+	form.Write(testData)
+	multipartWriter.WriteField("filename", "tyger")
+	multipartWriter.Close()
+	req := httptest.NewRequest("POST", "/submit_data", body)
+	req.Header.Add("content-type", multipartWriter.FormDataContentType())
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(api.submitDataHandler).ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Got status code %d submitting", rr.Code)
+	}
+	if len(fake.versions) != 4 {
+		t.Errorf("Got versions %v", fake.versions)
+	}
+
+	health, _, _, err := api.RsFileMan.CheckData("tyger")
+	if err != nil || !health {
+		t.Errorf("Got health %t (error: %v)", health, err)
+	}
+	rr = httptest.NewRecorder()
+	http.HandlerFunc(api.retrieveDataHandler).ServeHTTP(rr, httptest.NewRequest("GET", "/retrieve_data/tyger", nil))
+	if rr.Body.String() != string(testData) {
+		t.Errorf("Got retrieved contents '%s'", rr.Body.String())
+	}
+
+	rr = httptest.NewRecorder()
+	http.HandlerFunc(api.deleteHandler).ServeHTTP(rr, httptest.NewRequest("POST", "/delete/tyger", nil))
+	if rr.Code != http.StatusNoContent || len(fake.versions) != 0 {
+		t.Errorf("Got status code %d deleting, versions left: %v", rr.Code, fake.versions)
+	}
+}
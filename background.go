@@ -0,0 +1,474 @@
+package rsbackup
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"runtime"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	errQueueFull = errors.New("Queue full")
+	errStopped   = errors.New("Stopped while queued")
+)
+
+// workPool bounds how many tasks of one kind run at once and how many may
+// wait for a turn. Both limits can be changed while tasks run.
+type workPool struct {
+	mu         sync.Mutex
+	limit      int
+	queueLimit int
+	active     int
+	waiting    int
+	// wake is closed and replaced whenever a turn may have come free.
+	wake     chan struct{}
+	done     int64
+	rejected int64
+}
+
+func newWorkPool(limit, queueLimit int) *workPool {
+	return &workPool{limit: limit, queueLimit: queueLimit, wake: make(chan struct{})}
+}
+
+// acquire waits for a turn to run a task, which must be handed back with
+// release. It fails right away when the queue is full, or once stop is
+// closed.
+func (p *workPool) acquire(stop <-chan struct{}) error {
+	p.mu.Lock()
+	if p.active < p.limit {
+		p.active++
+		p.mu.Unlock()
+		return nil
+	}
+	if p.waiting >= p.queueLimit {
+		p.rejected++
+		p.mu.Unlock()
+		return errQueueFull
+	}
+	p.waiting++
+	for {
+		wake := p.wake
+		p.mu.Unlock()
+		select {
+		case <-wake:
+		case <-stop:
+			p.mu.Lock()
+			p.waiting--
+			p.mu.Unlock()
+			return errStopped
+		}
+		p.mu.Lock()
+		if p.active < p.limit {
+			p.waiting--
+			p.active++
+			p.mu.Unlock()
+			return nil
+		}
+	}
+}
+
+func (p *workPool) release() {
+	p.mu.Lock()
+	p.active--
+	p.done++
+	p.wakeAll()
+	p.mu.Unlock()
+}
+
+func (p *workPool) resize(limit, queueLimit int) {
+	p.mu.Lock()
+	p.limit = limit
+	p.queueLimit = queueLimit
+	p.wakeAll()
+	p.mu.Unlock()
+}
+
+// wakeAll must be called with p.mu held.
+func (p *workPool) wakeAll() {
+	close(p.wake)
+	p.wake = make(chan struct{})
+}
+
+type poolStats struct {
+	limit, queueLimit, active, waiting int
+	done, rejected                     int64
+}
+
+func (p *workPool) stats() poolStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return poolStats{p.limit, p.queueLimit, p.active, p.waiting, p.done, p.rejected}
+}
+
+// ioOpSize is the most bytes a single read operation is counted for.
+const ioOpSize = 1 << 20
+
+// ioThrottle paces background reads to a rate of bytes and a rate of read
+// operations, both shared by all workers. Work is paid for after it's
+// done, by sleeping until the reads fit both rates.
+type ioThrottle struct {
+	mu     sync.Mutex
+	rate   float64
+	iops   float64
+	next   time.Time
+	nextOp time.Time
+	bytes  int64
+	ops    int64
+	slept  time.Duration
+}
+
+// pay accounts for n bytes read from one file and waits until they fit
+// the rates, or until stop is closed. Opening the file counts as an
+// operation, and so does every ioOpSize bytes read.
+func (t *ioThrottle) pay(n int64, stop <-chan struct{}) {
+	ops := 1 + n/ioOpSize
+	t.mu.Lock()
+	t.bytes += n
+	t.ops += ops
+	now := time.Now()
+	var wait time.Duration
+	if t.rate > 0 {
+		if t.next.Before(now) {
+			t.next = now
+		}
+		t.next = t.next.Add(time.Duration(float64(n) / t.rate * float64(time.Second)))
+		wait = t.next.Sub(now)
+	}
+	if t.iops > 0 {
+		if t.nextOp.Before(now) {
+			t.nextOp = now
+		}
+		t.nextOp = t.nextOp.Add(time.Duration(float64(ops) / t.iops * float64(time.Second)))
+		if opWait := t.nextOp.Sub(now); opWait > wait {
+			wait = opWait
+		}
+	}
+	if wait <= 0 {
+		t.mu.Unlock()
+		return
+	}
+	t.slept += wait
+	t.mu.Unlock()
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-stop:
+	}
+}
+
+func (t *ioThrottle) setRates(rate Rate, iops int) {
+	t.mu.Lock()
+	t.rate = float64(rate)
+	t.iops = float64(iops)
+	t.mu.Unlock()
+}
+
+type throttleStats struct {
+	rate, iops float64
+	bytes, ops int64
+	slept      time.Duration
+}
+
+func (t *ioThrottle) stats() throttleStats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return throttleStats{t.rate, t.iops, t.bytes, t.ops, t.slept}
+}
+
+// Tunables are the limits on background work, see Config for what each
+// one does. They can be changed while the server runs via /background.
+type Tunables struct {
+	ScrubWorkers  int  `json:"scrub_workers"`
+	SampleWorkers int  `json:"sample_workers"`
+	SampleQueue   int  `json:"sample_queue"`
+	RepairWorkers int  `json:"repair_workers"`
+	RepairQueue   int  `json:"repair_queue"`
+	ScrubReadRate Rate `json:"scrub_read_rate"`
+	ScrubIOPS     int  `json:"scrub_iops"`
+	// RepairReadRate and RepairIOPS pace repairs like ScrubReadRate and
+	// ScrubIOPS pace scrubs.
+	RepairReadRate Rate `json:"repair_read_rate"`
+	RepairIOPS     int  `json:"repair_iops"`
+	// IngestWorkers bounds the uploads received at once, 0 for no bound.
+	IngestWorkers int `json:"ingest_workers"`
+	IngestQueue   int `json:"ingest_queue"`
+}
+
+// withDefaults fills in the limits left at 0.
+func (t Tunables) withDefaults() Tunables {
+	if t.ScrubWorkers == 0 {
+		t.ScrubWorkers = 1
+	}
+	if t.SampleWorkers == 0 {
+		t.SampleWorkers = 1
+	}
+	if t.SampleQueue == 0 {
+		t.SampleQueue = 64
+	}
+	if t.RepairWorkers == 0 {
+		t.RepairWorkers = runtime.NumCPU()
+	}
+	if t.RepairQueue == 0 {
+		t.RepairQueue = 16
+	}
+	if t.IngestQueue == 0 {
+		t.IngestQueue = 16
+	}
+	return t
+}
+
+// ingestLimit returns the uploads received at once, unbounded without
+// IngestWorkers.
+func (t Tunables) ingestLimit() int {
+	if t.IngestWorkers == 0 {
+		return int(^uint(0) >> 1)
+	}
+	return t.IngestWorkers
+}
+
+func (t Tunables) validate() error {
+	if t.ScrubWorkers < 0 || t.SampleWorkers < 0 || t.SampleQueue < 0 || t.RepairWorkers < 0 || t.RepairQueue < 0 || t.ScrubReadRate < 0 ||
+		t.ScrubIOPS < 0 || t.RepairReadRate < 0 || t.RepairIOPS < 0 || t.IngestWorkers < 0 || t.IngestQueue < 0 {
+		return fmt.Errorf("Background work limits must not be negative")
+	}
+	return nil
+}
+
+// backgroundWork holds the pools background tasks run in, sized by the
+// current tunables.
+type backgroundWork struct {
+	mu       sync.Mutex
+	tunables Tunables
+	scrub    *workPool
+	sample   *workPool
+	repair   *workPool
+	ingest   *workPool
+	throttle *ioThrottle
+	// repairThrottle paces repairs, throttle everything else.
+	repairThrottle *ioThrottle
+	jobs           *jobList
+}
+
+func newBackgroundWork(t Tunables) *backgroundWork {
+	t = t.withDefaults()
+	return &backgroundWork{
+		tunables: t,
+		// Scrubs wait for as long as it takes, they never overflow.
+		scrub:    newWorkPool(t.ScrubWorkers, int(^uint(0)>>1)),
+		sample:   newWorkPool(t.SampleWorkers, t.SampleQueue),
+		repair:   newWorkPool(t.RepairWorkers, t.RepairQueue),
+		ingest:   newWorkPool(t.ingestLimit(), t.IngestQueue),
+		throttle: &ioThrottle{rate: float64(t.ScrubReadRate), iops: float64(t.ScrubIOPS)},
+		jobs:     newJobList(),
+
+		repairThrottle: &ioThrottle{rate: float64(t.RepairReadRate), iops: float64(t.RepairIOPS)},
+	}
+}
+
+func (b *backgroundWork) current() Tunables {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.tunables
+}
+
+func (b *backgroundWork) update(t Tunables) {
+	t = t.withDefaults()
+	b.mu.Lock()
+	b.tunables = t
+	b.mu.Unlock()
+	b.scrub.resize(t.ScrubWorkers, int(^uint(0)>>1))
+	b.sample.resize(t.SampleWorkers, t.SampleQueue)
+	b.repair.resize(t.RepairWorkers, t.RepairQueue)
+	b.ingest.resize(t.ingestLimit(), t.IngestQueue)
+	b.throttle.setRates(t.ScrubReadRate, t.ScrubIOPS)
+	b.repairThrottle.setRates(t.RepairReadRate, t.RepairIOPS)
+}
+
+// background returns the pools for background work, set up from the
+// config on first use.
+func (rs *RSBackupAPI) background() *backgroundWork {
+	rs.backgroundOnce.Do(func() {
+		rs.work = newBackgroundWork(rs.Config.Tunables)
+	})
+	return rs.work
+}
+
+// backgroundHandler shows the limits on background work on GET and changes
+// the ones given as form fields on POST.
+func (rs *RSBackupAPI) backgroundHandler(w http.ResponseWriter, r *http.Request) {
+	work := rs.background()
+	switch r.Method {
+	case "GET":
+	case "POST":
+		t := work.current()
+		ints := map[string]*int{
+			"scrub_workers":  &t.ScrubWorkers,
+			"sample_workers": &t.SampleWorkers,
+			"sample_queue":   &t.SampleQueue,
+			"repair_workers": &t.RepairWorkers,
+			"repair_queue":   &t.RepairQueue,
+			"scrub_iops":     &t.ScrubIOPS,
+			"repair_iops":    &t.RepairIOPS,
+			"ingest_workers": &t.IngestWorkers,
+			"ingest_queue":   &t.IngestQueue,
+		}
+		var err error
+		for name, field := range ints {
+			if value := r.FormValue(name); value != "" && err == nil {
+				*field, err = strconv.Atoi(value)
+			}
+		}
+		rates := map[string]*Rate{
+			"scrub_read_rate":  &t.ScrubReadRate,
+			"repair_read_rate": &t.RepairReadRate,
+		}
+		for name, field := range rates {
+			if value := r.FormValue(name); value != "" && err == nil {
+				*field, err = ParseRate(value)
+			}
+		}
+		if err == nil {
+			err = t.validate()
+		}
+		if err != nil {
+			rs.Errorf(r, "Bad background limits: %s", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		work.update(t)
+		log.Infof("Background limits changed to %+v", work.current())
+	default:
+		rs.Errorf(r, "Bad method %s", r.Method)
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(work.current())
+	if err != nil {
+		rs.Errorf(r, "Unable to marshal json response: %s", err)
+	}
+}
+
+// metricsHandler reports the limits and utilization of background work in
+// the Prometheus text format.
+func (rs *RSBackupAPI) metricsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		rs.Errorf(r, "Bad method %s", r.Method)
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	work := rs.background()
+	pools := []struct {
+		name  string
+		stats poolStats
+	}{
+		{"scrub", work.scrub.stats()},
+		{"sample", work.sample.stats()},
+		{"repair", work.repair.stats()},
+	}
+	if work.current().IngestWorkers > 0 {
+		pools = append(pools, struct {
+			name  string
+			stats poolStats
+		}{"ingest", work.ingest.stats()})
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	metric := func(name, help, kind string, values func(emit func(labels string, value interface{}))) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+		values(func(labels string, value interface{}) {
+			fmt.Fprintf(w, "%s%s %v\n", name, labels, value)
+		})
+	}
+	perPool := func(value func(s poolStats) interface{}) func(emit func(string, interface{})) {
+		return func(emit func(string, interface{})) {
+			for _, p := range pools {
+				emit(fmt.Sprintf(`{work="%s"}`, p.name), value(p.stats))
+			}
+		}
+	}
+	metric("rsbackup_workers", "Tasks of a kind allowed to run at once.", "gauge",
+		perPool(func(s poolStats) interface{} { return s.limit }))
+	metric("rsbackup_workers_busy", "Tasks of a kind running.", "gauge",
+		perPool(func(s poolStats) interface{} { return s.active }))
+	metric("rsbackup_queue_limit", "Tasks of a kind allowed to wait for a worker.", "gauge",
+		func(emit func(string, interface{})) {
+			for _, p := range pools[1:] {
+				emit(fmt.Sprintf(`{work="%s"}`, p.name), p.stats.queueLimit)
+			}
+		})
+	metric("rsbackup_queued", "Tasks of a kind waiting for a worker.", "gauge",
+		perPool(func(s poolStats) interface{} { return s.waiting }))
+	metric("rsbackup_tasks_total", "Tasks of a kind finished.", "counter",
+		perPool(func(s poolStats) interface{} { return s.done }))
+	metric("rsbackup_tasks_rejected_total", "Tasks of a kind dropped because the queue was full.", "counter",
+		perPool(func(s poolStats) interface{} { return s.rejected }))
+
+	for _, throttled := range []struct {
+		name  string
+		stats throttleStats
+	}{
+		{"scrub", work.throttle.stats()},
+		{"repair", work.repairThrottle.stats()},
+	} {
+		name, s := throttled.name, throttled.stats
+		metric("rsbackup_"+name+"_read_rate_bytes", "Cap on bytes read per second by "+name+"s, 0 for none.", "gauge",
+			func(emit func(string, interface{})) { emit("", int64(s.rate)) })
+		metric("rsbackup_"+name+"_iops", "Cap on read operations per second by "+name+"s, 0 for none.", "gauge",
+			func(emit func(string, interface{})) { emit("", int64(s.iops)) })
+		metric("rsbackup_"+name+"_read_bytes_total", "Bytes read by "+name+"s.", "counter",
+			func(emit func(string, interface{})) { emit("", s.bytes) })
+		metric("rsbackup_"+name+"_read_operations_total", "Read operations counted for "+name+"s.", "counter",
+			func(emit func(string, interface{})) { emit("", s.ops) })
+		metric("rsbackup_"+name+"_throttled_seconds_total", "Time "+name+"s waited for the read caps.", "counter",
+			func(emit func(string, interface{})) { emit("", s.slept.Seconds()) })
+	}
+
+	if rs.RsFileMan != nil && rs.RsFileMan.Cache != nil {
+		tiers, misses := rs.RsFileMan.Cache.stats()
+		perTier := func(value func(s cacheStats) int64) func(emit func(string, interface{})) {
+			return func(emit func(string, interface{})) {
+				for _, s := range tiers {
+					emit(fmt.Sprintf(`{tier="%s"}`, s.tier), value(s))
+				}
+			}
+		}
+		metric("rsbackup_cache_bytes", "Bytes of retrieved files cached.", "gauge",
+			perTier(func(s cacheStats) int64 { return s.bytes }))
+		metric("rsbackup_cache_limit_bytes", "Cap on bytes of retrieved files cached.", "gauge",
+			perTier(func(s cacheStats) int64 { return s.limit }))
+		metric("rsbackup_cache_hits_total", "Retrievals served from the cache.", "counter",
+			perTier(func(s cacheStats) int64 { return s.hits }))
+		metric("rsbackup_cache_misses_total", "Retrievals of files that weren't cached.", "counter",
+			func(emit func(string, interface{})) { emit("", misses) })
+	}
+	if rs.Mirror != nil {
+		metric("rsbackup_mirror_queue_limit", "Files allowed to wait for mirroring.", "gauge",
+			func(emit func(string, interface{})) { emit("", cap(rs.Mirror.queue)) })
+		metric("rsbackup_mirror_queued", "Files waiting for mirroring.", "gauge",
+			func(emit func(string, interface{})) { emit("", len(rs.Mirror.queue)) })
+	}
+	if rs.Usage != nil {
+		metric("rsbackup_storage_bytes", "Bytes stored under the backup root.", "gauge",
+			func(emit func(string, interface{})) { emit("", rs.Usage.Bytes()) })
+		metric("rsbackup_storage_limit_bytes", "Cap on bytes stored under the backup root, 0 for none.", "gauge",
+			func(emit func(string, interface{})) { emit("", rs.Usage.Limit()) })
+	}
+	if rs.Consistency != nil {
+		metric("rsbackup_consistency_anomalies", "Anomalies of a kind found by the scan on startup.", "gauge",
+			func(emit func(string, interface{})) {
+				for _, kind := range anomalyKinds {
+					emit(fmt.Sprintf(`{kind="%s"}`, kind), rs.Consistency.Counts[kind])
+				}
+			})
+	}
+	metric("rsbackup_requests_in_flight", "Requests being served.", "gauge",
+		func(emit func(string, interface{})) { emit("", atomic.LoadInt64(&rs.inFlight)) })
+}
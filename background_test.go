@@ -0,0 +1,153 @@
+package rsbackup
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWorkPool(t *testing.T) {
+	pool := newWorkPool(1, 1)
+	if err := pool.acquire(nil); err != nil {
+		t.Fatal(err)
+	}
+	acquired := make(chan error)
+	go func() { acquired <- pool.acquire(nil) }()
+	for pool.stats().waiting != 1 {
+		time.Sleep(time.Millisecond)
+	}
+	if err := pool.acquire(nil); err != errQueueFull {
+		t.Errorf("Got %v with the queue full, expected %v", err, errQueueFull)
+	}
+	stop := make(chan struct{})
+	close(stop)
+	pool.resize(1, 2)
+	if err := pool.acquire(stop); err != errStopped {
+		t.Errorf("Got %v after stopping, expected %v", err, errStopped)
+	}
+
+	// Growing the pool lets the queued task run.
+	pool.resize(2, 2)
+	select {
+	case err := <-acquired:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Queued task didn't start after resize")
+	}
+	pool.release()
+	pool.release()
+	stats := pool.stats()
+	if stats.active != 0 || stats.waiting != 0 || stats.done != 2 || stats.rejected != 1 {
+		t.Errorf("Unexpected stats %+v", stats)
+	}
+}
+
+func TestBackgroundHandler(t *testing.T) {
+	api := &RSBackupAPI{Config: &Config{Tunables: Tunables{ScrubWorkers: 2}}}
+	post := func(form url.Values) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/background", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(api.backgroundHandler).ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := post(url.Values{"repair_workers": {"3"}, "scrub_read_rate": {"10MB/s"}, "repair_iops": {"20"}})
+	if rr.Code != 200 {
+		t.Fatalf("Got status code %d, expected 200: %s", rr.Code, rr.Body)
+	}
+	var tunables Tunables
+	err := json.NewDecoder(rr.Body).Decode(&tunables)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tunables.ScrubWorkers != 2 || tunables.RepairWorkers != 3 || tunables.ScrubReadRate != 10e6 || tunables.SampleQueue != 64 || tunables.RepairIOPS != 20 {
+		t.Errorf("Unexpected tunables %+v", tunables)
+	}
+	if limit := api.background().repair.stats().limit; limit != 3 {
+		t.Errorf("Repair pool has %d workers, expected 3", limit)
+	}
+	for _, form := range []url.Values{{"scrub_workers": {"-1"}}, {"repair_queue": {"many"}}, {"scrub_read_rate": {"fast"}}, {"repair_iops": {"-5"}}} {
+		if rr := post(form); rr.Code != 400 {
+			t.Errorf("Got status code %d for %v, expected 400", rr.Code, form)
+		}
+	}
+
+	req := httptest.NewRequest("GET", "/metrics", nil)
+	rr = httptest.NewRecorder()
+	http.HandlerFunc(api.metricsHandler).ServeHTTP(rr, req)
+	for _, line := range []string{
+		`rsbackup_workers{work="repair"} 3`,
+		`rsbackup_workers_busy{work="scrub"} 0`,
+		`rsbackup_queue_limit{work="sample"} 64`,
+		"rsbackup_scrub_read_rate_bytes 10000000",
+		"rsbackup_repair_iops 20",
+		"# TYPE rsbackup_tasks_total counter",
+	} {
+		if !strings.Contains(rr.Body.String(), line+"\n") {
+			t.Errorf("Metrics lack '%s':\n%s", line, rr.Body)
+		}
+	}
+}
+
+func TestIOThrottle(t *testing.T) {
+	throttle := &ioThrottle{}
+	throttle.setRates(0, 100)
+	start := time.Now()
+	// Nine files of a byte and one just over ioOpSize, eleven operations.
+	for i := 0; i < 9; i++ {
+		throttle.pay(1, nil)
+	}
+	throttle.pay(ioOpSize+1, nil)
+	if took := time.Since(start); took < 100*time.Millisecond {
+		t.Errorf("Eleven operations took %s at 100 per second", took)
+	}
+	if s := throttle.stats(); s.ops != 11 || s.bytes != 9+ioOpSize+1 {
+		t.Errorf("Got stats %+v", s)
+	}
+
+	// The byte rate is the tighter cap here.
+	throttle.setRates(1000, 1000)
+	start = time.Now()
+	throttle.pay(100, nil)
+	throttle.pay(100, nil)
+	if took := time.Since(start); took < 150*time.Millisecond {
+		t.Errorf("200 bytes took %s at 1000 bytes per second", took)
+	}
+}
+
+func TestRepairQueueFull(t *testing.T) {
+	tmpDir := createTMPDir(t, "rsbackup")
+	conf := &Config{BackupRoot: tmpDir, DataShards: 2, ParityShards: 1, Tunables: Tunables{RepairWorkers: 1, RepairQueue: 1}}
+	cloneShards(t, "tyger_bad", tmpDir, conf)
+	api := &RSBackupAPI{Config: conf, RsFileMan: &RSFileManager{Config: conf}}
+	repairs := api.background().repair
+	repairs.acquire(nil)
+	queued := make(chan error)
+	go func() { queued <- repairs.acquire(nil) }()
+	for repairs.stats().waiting != 1 {
+		time.Sleep(time.Millisecond)
+	}
+
+	req := httptest.NewRequest("GET", "/repair_data/tyger_bad", nil)
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(api.repairDataHandler).ServeHTTP(rr, req)
+	if rr.Code != http.StatusServiceUnavailable || rr.Header().Get("Retry-After") == "" {
+		t.Errorf("Got status code %d and Retry-After '%s', expected 503", rr.Code, rr.Header().Get("Retry-After"))
+	}
+
+	repairs.release()
+	<-queued
+	repairs.release()
+	rr = httptest.NewRecorder()
+	http.HandlerFunc(api.repairDataHandler).ServeHTTP(rr, req)
+	if rr.Code != 200 {
+		t.Errorf("Got status code %d once the queue drained, expected 200", rr.Code)
+	}
+}
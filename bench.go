@@ -0,0 +1,170 @@
+package rsbackup
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// BenchShards are the shard counts a benchmark run tries.
+type BenchShards struct {
+	DataShards   int
+	ParityShards int
+}
+
+// ParseBenchShards parses shard counts written like "10+3".
+func ParseBenchShards(s string) (BenchShards, error) {
+	var b BenchShards
+	parts := strings.Split(s, "+")
+	var err error
+	if len(parts) == 2 {
+		b.DataShards, err = strconv.Atoi(parts[0])
+		if err == nil {
+			b.ParityShards, err = strconv.Atoi(parts[1])
+		}
+	}
+	if len(parts) != 2 || err != nil || b.DataShards < 1 || b.ParityShards < 1 || b.DataShards+b.ParityShards > 256 {
+		return b, fmt.Errorf("Invalid shard counts '%s', expected e.g. 10+3", s)
+	}
+	return b, nil
+}
+
+func (b BenchShards) String() string {
+	return fmt.Sprintf("%d+%d", b.DataShards, b.ParityShards)
+}
+
+// BenchResult is how long a file of Size bytes took to encode, to check
+// and to repair with some shard counts and encode workers.
+type BenchResult struct {
+	BenchShards
+	Workers int
+	Size    int64
+	Encode  time.Duration
+	Verify  time.Duration
+	Repair  time.Duration
+}
+
+// Rate returns the throughput in bytes per second of an operation that
+// took d.
+func (b BenchResult) Rate(d time.Duration) float64 {
+	if d <= 0 {
+		return 0
+	}
+	return float64(b.Size) / d.Seconds()
+}
+
+// Benchmark stores a file of size random bytes in a scratch directory in
+// BackupRoot, so on its disk, and encodes, checks and repairs it with
+// every pair of the shard counts and encode workers, with the codec and
+// shard hash of config. The repair rebuilds the first data shard. The
+// scratch directory is removed when done. Unless the file is larger than
+// the memory, it's read from the page cache, which leaves the disk out
+// of the checks.
+func Benchmark(config *Config, size int64, shards []BenchShards, workers []int) ([]BenchResult, error) {
+	dir, err := ioutil.TempDir(config.BackupRoot, stagingPrefix+"bench")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	scratch := *config
+	scratch.BackupRoot, scratch.ShardSize, scratch.ShardBands, scratch.ReplicationThreshold = dir, 0, nil, 0
+	fm := &RSFileManager{Config: &scratch}
+	fname := "bench"
+	fpath := fm.DataPath(fname)
+	if err := writeRandomFile(fm.storage(), fpath, size); err != nil {
+		return nil, err
+	}
+	var results []BenchResult
+	for _, s := range shards {
+		for _, w := range workers {
+			scratch.DataShards, scratch.ParityShards, scratch.EncodeWorkers = s.DataShards, s.ParityShards, w
+			result, err := benchFile(fm, fname, size)
+			if err != nil {
+				return nil, fmt.Errorf("Benchmark of %s shards with %d workers: %w", s, w, err)
+			}
+			result.BenchShards, result.Workers = s, w
+			results = append(results, result)
+		}
+	}
+	return results, nil
+}
+
+func writeRandomFile(storage StorageBackend, fpath string, size int64) error {
+	f, err := storage.CreateExclusive(fpath)
+	if err != nil {
+		return err
+	}
+	_, err = io.CopyN(f, rand.New(rand.NewSource(time.Now().UnixNano())), size)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// benchFile times encoding, checking and repairing fname, and removes its
+// parity and metadata again.
+func benchFile(fm *RSFileManager, fname string, size int64) (BenchResult, error) {
+	result := BenchResult{Size: size}
+	config := fm.Config
+	fpath := fm.DataPath(fname)
+	defer func() {
+		for _, suffix := range objectSuffixes(fm.storage(), fpath) {
+			if suffix != "" {
+				fm.storage().Remove(fpath + suffix)
+			}
+		}
+	}()
+
+	start := time.Now()
+	md, segments, err := writeParity(fm.storage(), fpath, config.DataShards, config.ParityShards, config)
+	if err != nil {
+		return result, err
+	}
+	result.Encode = time.Since(start)
+	extras := MetadataExtras{Codec: config.codecName(), Hash: config.shardHashName(), Segments: segments}
+	if err := fm.WriteMetadata(fname, md, extras); err != nil {
+		return result, err
+	}
+
+	start = time.Now()
+	health, _, _, err := fm.CheckData(fname)
+	if err != nil {
+		return result, err
+	}
+	result.Verify = time.Since(start)
+	if !health {
+		return result, fmt.Errorf("File found damaged right after encoding")
+	}
+
+	// Flipping the first byte damages the first data shard.
+	f, err := fm.storage().OpenWritable(fpath)
+	if err != nil {
+		return result, err
+	}
+	b := make([]byte, 1)
+	_, err = f.ReadAt(b, 0)
+	if err == nil {
+		b[0] ^= 0xff
+		_, err = f.Write(b)
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return result, err
+	}
+	start = time.Now()
+	if err := fm.RepairData(fname); err != nil {
+		return result, err
+	}
+	result.Repair = time.Since(start)
+	if health, _, _, err := fm.CheckData(fname); err != nil || !health {
+		return result, fmt.Errorf("File still damaged after repair (error: %v)", err)
+	}
+	return result, nil
+}
@@ -0,0 +1,40 @@
+package rsbackup
+
+import (
+	"io/ioutil"
+	"testing"
+)
+
+func TestBenchmark(t *testing.T) {
+	config := &Config{BackupRoot: createTMPDir(t, "rsbackup"), DataShards: 3, ParityShards: 2}
+	shards := []BenchShards{{DataShards: 2, ParityShards: 1}, {DataShards: 4, ParityShards: 2}}
+	results, err := Benchmark(config, 1<<20, shards, []int{1, 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 4 {
+		t.Fatalf("Got %d results, expected 4", len(results))
+	}
+	for _, r := range results {
+		if r.Size != 1<<20 || r.Encode <= 0 || r.Verify <= 0 || r.Repair <= 0 || r.Rate(r.Encode) <= 0 {
+			t.Errorf("Got result %+v", r)
+		}
+	}
+	if results[3].DataShards != 4 || results[3].Workers != 2 {
+		t.Errorf("Got result %+v last, expected 4+2 with 2 workers", results[3])
+	}
+	if entries, _ := ioutil.ReadDir(config.BackupRoot); len(entries) != 0 {
+		t.Errorf("Got %d entries left in the backup root", len(entries))
+	}
+
+	for _, s := range []string{"10+3", "1+1"} {
+		if _, err := ParseBenchShards(s); err != nil {
+			t.Errorf("Got error %v parsing '%s'", err, s)
+		}
+	}
+	for _, s := range []string{"10", "0+3", "200+100", "a+b", "1+2+3"} {
+		if _, err := ParseBenchShards(s); err == nil {
+			t.Errorf("Expected an error parsing '%s'", s)
+		}
+	}
+}
@@ -0,0 +1,391 @@
+package rsbackup
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/sirmackk/rsutils"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// bundleMembers returns the paths of all files making up fname: the data
+// file, its metadata and parity shards.
+func (r *RSFileManager) bundleMembers(fname string) ([]string, error) {
+	fpath := r.DataPath(fname)
+	md, err := r.readStoredMetadata(fpath)
+	if err != nil {
+		return nil, err
+	}
+	if md.Dedup != nil {
+		return nil, errDedupBundle
+	}
+	if md.Packed != nil {
+		return nil, errPackedBundle
+	}
+	members := []string{fpath, fpath + ".md"}
+	for i := 0; i < md.ParityShards; i++ {
+		members = append(members, fmt.Sprintf("%s.parity.%d", fpath, i+1))
+	}
+	return members, nil
+}
+
+// WriteBundle writes a tar archive containing the data file, metadata and
+// parity shards of fname to w, so the backup can be verified and repaired
+// anywhere. Members are named like in a flat BackupRoot.
+func (r *RSFileManager) WriteBundle(w io.Writer, fname string) error {
+	members, err := r.bundleMembers(fname)
+	if err != nil {
+		return err
+	}
+	tw := tar.NewWriter(w)
+	for _, member := range members {
+		err = addTarMember(tw, r.storage(), member)
+		if err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+func addTarMember(tw *tar.Writer, storage StorageBackend, fpath string) error {
+	f, err := storage.Open(fpath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	hdr, err := tar.FileInfoHeader(stat, "")
+	if err != nil {
+		return err
+	}
+	hdr.Name = path.Base(fpath)
+	err = tw.WriteHeader(hdr)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, f)
+	return err
+}
+
+func (rs *RSBackupAPI) exportBundleHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		rs.Errorf(r, "Bad method %s", r.Method)
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	fname, err := getFileNameParam(r.URL)
+	if err != nil {
+		rs.Errorf(r, "Can't export bundle: %s", err)
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	_, err = rs.RsFileMan.Stat(fname)
+	if err != nil || isReservedName(fname) {
+		rs.Errorf(r, "Can't export %s: file not found", fname)
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+	// Check all members are there before starting the response, once the
+	// archive is streaming errors can't be reported anymore.
+	members, err := rs.RsFileMan.bundleMembers(fname)
+	if err == errDedupBundle || err == errPackedBundle {
+		rs.Errorf(r, "Can't export %s: %s", fname, err)
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	if err != nil {
+		rs.Errorf(r, "Can't export %s: %s", fname, err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	for _, member := range members {
+		if _, err := rs.RsFileMan.storage().Stat(member); err != nil {
+			rs.Errorf(r, "Can't export %s: %s", fname, err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+	}
+	log.Debugf("Exporting bundle of %s", fname)
+	w.Header().Set("Content-Type", "application/x-tar")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": fname + ".bundle.tar"}))
+	err = rs.RsFileMan.WriteBundle(w, fname)
+	if err != nil {
+		rs.Errorf(r, "Export of %s aborted: %s", fname, err)
+	}
+}
+
+var (
+	errBundleInvalid = errors.New("Invalid bundle")
+	errShardsInvalid = errors.New("Incomplete shards or metadata")
+	errShardsCorrupt = errors.New("Shards don't match their metadata")
+	errFileExists    = errors.New("File exists")
+)
+
+// extractBundle unpacks the members of a bundle into dir and returns the
+// name of the file it contains.
+func extractBundle(src io.Reader, dir string) (string, error) {
+	tr := tar.NewReader(src)
+	var members []string
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", fmt.Errorf("%w: %s", errBundleInvalid, err)
+		}
+		if hdr.Typeflag != tar.TypeReg || validateFileName(hdr.Name) != nil {
+			return "", fmt.Errorf("%w: unexpected member '%s'", errBundleInvalid, hdr.Name)
+		}
+		f, err := os.OpenFile(path.Join(dir, hdr.Name), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err != nil {
+			return "", fmt.Errorf("%w: %s", errBundleInvalid, err)
+		}
+		_, err = io.Copy(f, tr)
+		f.Close()
+		if err != nil {
+			return "", err
+		}
+		members = append(members, hdr.Name)
+	}
+
+	var fname string
+	for _, member := range members {
+		if strings.HasSuffix(member, ".md") {
+			if fname != "" {
+				return "", fmt.Errorf("%w: more than one metadata file", errBundleInvalid)
+			}
+			fname = strings.TrimSuffix(member, ".md")
+		}
+	}
+	if fname == "" {
+		return "", fmt.Errorf("%w: no metadata file", errBundleInvalid)
+	}
+	for _, member := range members {
+		if member != fname && !strings.HasPrefix(member, fname+".") {
+			return "", fmt.Errorf("%w: member '%s' doesn't belong to '%s'", errBundleInvalid, member, fname)
+		}
+	}
+	return fname, validateFileName(fname)
+}
+
+// ImportBundle unpacks a bundle written by WriteBundle into the backup
+// root, as stored by the namespace storedBy. The data and parity shards
+// must match the hashes in the bundled metadata, otherwise nothing is
+// imported.
+func (r *RSFileManager) ImportBundle(src io.Reader, storedBy string) (string, *rsutils.Metadata, error) {
+	stagingDir, err := r.stagingDir("import")
+	if err != nil {
+		return "", nil, err
+	}
+	defer os.RemoveAll(stagingDir)
+
+	fname, err := extractBundle(src, stagingDir)
+	if err != nil {
+		return "", nil, err
+	}
+	md, err := r.commitStaged(stagingDir, fname, fname, storedBy)
+	if errors.Is(err, errShardsInvalid) {
+		err = fmt.Errorf("%w: %s", errBundleInvalid, err)
+	}
+	return fname, md, err
+}
+
+// stagingDir creates a temporary directory in the staging directory for
+// assembling a file before it is moved into the backup root.
+func (r *RSFileManager) stagingDir(prefix string) (string, error) {
+	dir := r.Config.StagingPath()
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return "", err
+	}
+	return ioutil.TempDir(dir, prefix+"-")
+}
+
+// commitStaged verifies the data, metadata and parity assembled under
+// stagedName in a flat dir and moves them into the backup root as fname,
+// stored now by the namespace storedBy. The data file is created first,
+// so the file can't replace one stored under the same name meanwhile.
+func (r *RSFileManager) commitStaged(dir, stagedName, fname, storedBy string) (*rsutils.Metadata, error) {
+	staged := &RSFileManager{Config: &Config{BackupRoot: dir, RestoreWorkers: r.Config.RestoreWorkers}}
+	members, err := staged.bundleMembers(stagedName)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", errShardsInvalid, err)
+	}
+	shards, err := staged.openShards(stagedName)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", errShardsInvalid, err)
+	}
+	md := shards.md
+	err = checkStagedSizes(members, md, shards.chunkSize)
+	if err == nil && len(shards.damaged(restoreWorkers(r.Config))) > 0 {
+		err = errShardsCorrupt
+	}
+	shards.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	err = restampStaged(path.Join(dir, stagedName), storedBy)
+	if err == nil {
+		err = r.identifyStaged(path.Join(dir, stagedName))
+	}
+	if err != nil {
+		return nil, err
+	}
+	dstPath := r.DataPath(fname)
+	entry, err := r.Journal.begin(opStore, fname, "")
+	if err != nil {
+		return nil, err
+	}
+	defer r.Journal.end(entry)
+	claim, err := r.storage().CreateExclusive(dstPath)
+	if os.IsExist(err) {
+		return nil, errFileExists
+	}
+	if err != nil {
+		return nil, err
+	}
+	claim.Close()
+	// members starts with the data file and its metadata. The parity goes
+	// first, so the file is never listed without it, and the metadata
+	// last, so an interrupted commit is undone by RecoverOperations.
+	var moved []string
+	for _, member := range append(members[2:], members[0], members[1]) {
+		dst := dstPath + strings.TrimPrefix(path.Base(member), stagedName)
+		err = storeLocal(r.storage(), member, dst)
+		if err != nil {
+			for _, dst := range moved {
+				r.storage().Remove(dst)
+			}
+			if !errors.Is(err, os.ErrExist) {
+				// Otherwise stored by someone else while it was replaced.
+				r.storage().Remove(dstPath)
+			}
+			return nil, err
+		}
+		moved = append(moved, dst)
+	}
+	r.repairMetadata(dstPath)
+	r.reindex(fname)
+	return md, nil
+}
+
+// restampStaged replaces what the metadata of the file staged at fpath says
+// about who stored it and when, and drops the retention it asks for: those
+// are the server's to decide, not the client's who sent them.
+func restampStaged(fpath, storedBy string) error {
+	staged := &RSFileManager{Config: &Config{BackupRoot: path.Dir(fpath)}}
+	md, err := staged.readMetadataFile(fpath + ".md")
+	if err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	md.StoredAt, md.StoredBy = &now, storedBy
+	md.Immutable, md.RetainUntil = false, nil
+	err = sealMetadata(md)
+	if err != nil {
+		return err
+	}
+	return writeJSONState(fpath+".md", md)
+}
+
+// checkStagedSizes makes sure the staged data file holds exactly md.Size
+// bytes and every parity shard chunkSize bytes, hashes alone don't catch
+// trailing garbage.
+func checkStagedSizes(members []string, md *rsutils.Metadata, chunkSize int64) error {
+	if md.ParityShards < 1 {
+		return fmt.Errorf("%w: no parity shards", errShardsInvalid)
+	}
+	for i, member := range members {
+		if i == 1 {
+			// The metadata file.
+			continue
+		}
+		stat, err := os.Stat(member)
+		if err != nil {
+			return fmt.Errorf("%w: %s", errShardsInvalid, err)
+		}
+		expected := chunkSize
+		if i == 0 {
+			expected = md.Size
+		}
+		if stat.Size() != expected {
+			return fmt.Errorf("%w: '%s' has %d bytes, expected %d", errShardsCorrupt, path.Base(member), stat.Size(), expected)
+		}
+	}
+	return nil
+}
+
+type importBundleRsp struct {
+	Name string `json:"name"`
+	submitDataRsp
+}
+
+func (rs *RSBackupAPI) importBundleHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		rs.Errorf(r, "Bad method %s", r.Method)
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	if maxSize := int64(rs.Config.MaxUploadSize); maxSize > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, maxSize)
+	}
+	if !rs.checkQuota(w, r, r.ContentLength) || !rs.checkDiskSpace(w, r, r.ContentLength) {
+		return
+	}
+	fname, md, err := rs.RsFileMan.ImportBundle(r.Body, requestNamespace(r))
+	auditObject(r, fname)
+	if err != nil {
+		rs.Errorf(r, "Unable to import bundle '%s': %s", fname, err)
+		switch {
+		case errors.Is(err, errBundleInvalid):
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		case errors.Is(err, errShardsCorrupt):
+			http.Error(w, http.StatusText(http.StatusUnprocessableEntity), http.StatusUnprocessableEntity)
+		case errors.Is(err, errFileExists):
+			http.Error(w, http.StatusText(http.StatusConflict), http.StatusConflict)
+		case isNoSpace(err):
+			rs.insufficientSpace(w, r, r.ContentLength)
+		default:
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		}
+		return
+	}
+	if !rs.chargeQuota(w, r, fname) {
+		return
+	}
+	log.Infof("Imported bundle of %s", fname)
+	rs.recordHealth(fname, true)
+	rs.recordEvent(fname, eventStored, "bundle")
+	rs.mirror(fname)
+	rsp := &importBundleRsp{
+		Name: fname,
+		submitDataRsp: submitDataRsp{
+			ID:           rs.RsFileMan.objectID(fname),
+			Size:         md.Size,
+			Hashes:       md.Hashes,
+			DataShards:   md.DataShards,
+			ParityShards: md.ParityShards,
+		},
+	}
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(rsp)
+	if err != nil {
+		rs.Errorf(r, "Unable to marshal json response: %s", err)
+	}
+}
@@ -0,0 +1,196 @@
+package rsbackup
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExportBundleHandler(t *testing.T) {
+	exportTests := []struct {
+		name            string
+		method          string
+		url             string
+		expectedStatus  int
+		expectedMembers []string
+	}{
+		{"bad method", "POST", "/export_bundle/tyger", 405, nil},
+		{"bad url param", "GET", "/export_bundle/", 400, nil},
+		{"file not found", "GET", "/export_bundle/lion", 404, nil},
+		{"success", "GET", "/export_bundle/tyger", 200, []string{"tyger", "tyger.md", "tyger.parity.1"}},
+	}
+
+	for _, tt := range exportTests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := &Config{
+				BackupRoot: "testdata/",
+			}
+			api := &RSBackupAPI{
+				Config: config,
+				RsFileMan: &RSFileManager{
+					Config: config,
+				},
+			}
+
+			req := httptest.NewRequest(tt.method, tt.url, nil)
+			rr := httptest.NewRecorder()
+			http.HandlerFunc(api.exportBundleHandler).ServeHTTP(rr, req)
+
+			if rr.Code != tt.expectedStatus {
+				t.Fatalf("Got status code %d, expected %d", rr.Code, tt.expectedStatus)
+			}
+			if tt.expectedMembers == nil {
+				return
+			}
+			var members []string
+			tr := tar.NewReader(bytes.NewReader(rr.Body.Bytes()))
+			for {
+				hdr, err := tr.Next()
+				if err != nil {
+					break
+				}
+				members = append(members, hdr.Name)
+				content, err := ioutil.ReadAll(tr)
+				if err != nil {
+					t.Fatal(err)
+				}
+				expected, err := ioutil.ReadFile("testdata/" + hdr.Name)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(content, expected) {
+					t.Errorf("Content of bundle member %s differs", hdr.Name)
+				}
+			}
+			if !reflect.DeepEqual(members, tt.expectedMembers) {
+				t.Errorf("Got bundle members %v, expected %v", members, tt.expectedMembers)
+			}
+			if ct := rr.Header().Get("content-type"); !strings.HasPrefix(ct, "application/x-tar") {
+				t.Errorf("Got content-type '%s', expected 'application/x-tar'", ct)
+			}
+		})
+	}
+}
+
+func TestImportBundleHandler(t *testing.T) {
+	bundle := func(fname string) []byte {
+		var buf bytes.Buffer
+		rsMan := &RSFileManager{Config: &Config{BackupRoot: "testdata/"}}
+		err := rsMan.WriteBundle(&buf, fname)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+	foreignBundle := func() []byte {
+		var buf bytes.Buffer
+		tw := tar.NewWriter(&buf)
+		for _, name := range []string{"tyger", "tyger.md", "lion"} {
+			tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Typeflag: tar.TypeReg})
+		}
+		tw.Close()
+		return buf.Bytes()
+	}
+
+	importTests := []struct {
+		name           string
+		method         string
+		body           []byte
+		filesThatExist []string
+		expectedStatus int
+		expectedRsp    string
+	}{
+		{"bad method", "GET", bundle("tyger"), nil, 405, "Method Not Allowed"},
+		{"not a tar", "POST", []byte("tyger"), nil, 400, "Bad Request"},
+		{"foreign member", "POST", foreignBundle(), nil, 400, "Bad Request"},
+		{"corrupt bundle", "POST", bundle("tyger_bad"), nil, 422, "Unprocessable Entity"},
+		{"file exists", "POST", bundle("tyger"), []string{"tyger"}, 409, "Conflict"},
+		{"success", "POST", bundle("tyger"), nil, 200, `{"name":"tyger","id":"<id>","size":808,"hashes":["aa8b8979f1486fe03d54d1bdd4a32018386285a2ad0dc9a2820f0da3d6293e72","64163fa75b3eadb78f376dd7ab84e48595e9748dadbfb50e2126bef20481baa1","e32a8903342ab6dc68d46462df727f6812f6fbb728c4a1240b625331b811c147"],"data_shards":2,"parity_shards":1}`},
+	}
+
+	for _, tt := range importTests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpDir := createTMPDir(t, "rsbackup")
+			config := &Config{BackupRoot: tmpDir}
+			rsMan := &RSFileManager{Config: config, Layout: HashPrefixLayout{Levels: 1}}
+			api := &RSBackupAPI{Config: config, RsFileMan: rsMan}
+			for _, name := range tt.filesThatExist {
+				err := os.MkdirAll(path.Dir(rsMan.DataPath(name)), 0755)
+				if err != nil {
+					t.Fatal(err)
+				}
+				err = ioutil.WriteFile(rsMan.DataPath(name), nil, 0644)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			req := httptest.NewRequest(tt.method, "/import_bundle", bytes.NewReader(tt.body))
+			rr := httptest.NewRecorder()
+			http.HandlerFunc(api.importBundleHandler).ServeHTTP(rr, req)
+
+			if rr.Code != tt.expectedStatus {
+				t.Errorf("Got status code %d, expected %d", rr.Code, tt.expectedStatus)
+			}
+			// The bundle has no ID, so it gets a random one.
+			rspBody := objectIDField.ReplaceAllString(strings.TrimSuffix(rr.Body.String(), "\n"), `"id":"<id>"`)
+			if rspBody != tt.expectedRsp {
+				t.Errorf("Got rsp body '%s', expected '%s'", rspBody, tt.expectedRsp)
+			}
+			if tt.expectedStatus != 200 {
+				return
+			}
+			health, _, _, err := rsMan.CheckData("tyger")
+			if err != nil || !health {
+				t.Errorf("Imported file is not healthy (health: %t, err: %v)", health, err)
+			}
+			names, err := rsMan.ListData()
+			if err != nil || !reflect.DeepEqual(names, []string{"tyger"}) {
+				t.Errorf("Got files %v (err: %v) after import, expected [tyger]", names, err)
+			}
+		})
+	}
+}
+
+func TestImportBundleRestampsOwnership(t *testing.T) {
+	srcDir := createTMPDir(t, "rsbackup-src")
+	for _, suffix := range []string{"", ".parity.1"} {
+		data, err := ioutil.ReadFile("testdata/tyger" + suffix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ioutil.WriteFile(path.Join(srcDir, "tyger"+suffix), data, 0644)
+	}
+	md, _ := ioutil.ReadFile("testdata/tyger.md")
+	forged := strings.TrimSuffix(strings.TrimSpace(string(md)), "}") +
+		`,"StoredBy":"admin","StoredAt":"2001-01-01T00:00:00Z","Immutable":true,"RetainUntil":"2999-01-01T00:00:00Z"}`
+	ioutil.WriteFile(path.Join(srcDir, "tyger.md"), []byte(forged), 0644)
+	var bundle bytes.Buffer
+	if err := (&RSFileManager{Config: &Config{BackupRoot: srcDir}}).WriteBundle(&bundle, "tyger"); err != nil {
+		t.Fatal(err)
+	}
+
+	rsMan := &RSFileManager{Config: &Config{BackupRoot: createTMPDir(t, "rsbackup")}}
+	before := time.Now()
+	if _, _, err := rsMan.ImportBundle(&bundle, "laptop"); err != nil {
+		t.Fatal(err)
+	}
+	extras, err := rsMan.ReadExtras(rsMan.DataPath("tyger"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if extras.StoredBy != "laptop" || extras.StoredAt == nil || extras.StoredAt.Before(before.Add(-time.Second)) || extras.Immutable || extras.RetainUntil != nil {
+		t.Errorf("Got extras %+v, expected the bundled ownership and retention to be replaced", extras)
+	}
+	if err := rsMan.Delete("tyger", false, false); err != nil {
+		t.Errorf("Imported file can't be deleted: %s", err)
+	}
+}
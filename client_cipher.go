@@ -0,0 +1,71 @@
+package rsbackup
+
+import (
+	"fmt"
+	"net/http"
+	"unicode"
+)
+
+// ClientCipher describes how a client encrypted a file before submitting
+// it. The server stores it untouched with the metadata and hands it back
+// on retrieval, so restore tooling knows how to decrypt the file.
+type ClientCipher struct {
+	Algorithm string `json:"algorithm"`
+	KeyID     string `json:"key_id,omitempty"`
+	Nonce     string `json:"nonce,omitempty"`
+}
+
+// Retrievals of client encrypted files carry the cipher in these headers.
+const (
+	cipherAlgorithmHeader = "Cipher-Algorithm"
+	cipherKeyIDHeader     = "Cipher-Key-Id"
+	cipherNonceHeader     = "Cipher-Nonce"
+)
+
+func (c *ClientCipher) setHeaders(h http.Header) {
+	h.Set(cipherAlgorithmHeader, c.Algorithm)
+	if c.KeyID != "" {
+		h.Set(cipherKeyIDHeader, c.KeyID)
+	}
+	if c.Nonce != "" {
+		h.Set(cipherNonceHeader, c.Nonce)
+	}
+}
+
+// clientCipherParams reads the cipher of a submission declared client
+// encrypted with client_encrypted=true. The cipher_algorithm field is
+// required, cipher_key_id and cipher_nonce are optional. Values must fit
+// in a header, see checkHeaderValue.
+func clientCipherParams(r *http.Request) (*ClientCipher, error) {
+	if r.FormValue("client_encrypted") != "true" {
+		return nil, nil
+	}
+	c := &ClientCipher{
+		Algorithm: r.FormValue("cipher_algorithm"),
+		KeyID:     r.FormValue("cipher_key_id"),
+		Nonce:     r.FormValue("cipher_nonce"),
+	}
+	if c.Algorithm == "" {
+		return nil, fmt.Errorf("Missing 'cipher_algorithm' parameter for client encrypted data")
+	}
+	for name, value := range map[string]string{"cipher_algorithm": c.Algorithm, "cipher_key_id": c.KeyID, "cipher_nonce": c.Nonce} {
+		if err := checkHeaderValue(name, value); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// checkHeaderValue makes sure the value of the form field name can be
+// sent back in a header: at most 256 printable ASCII characters.
+func checkHeaderValue(name, value string) error {
+	if len(value) > 256 {
+		return fmt.Errorf("'%s' is longer than 256 characters", name)
+	}
+	for _, ch := range value {
+		if ch > unicode.MaxASCII || !unicode.IsPrint(ch) {
+			return fmt.Errorf("'%s' contains forbidden character %q", name, ch)
+		}
+	}
+	return nil
+}
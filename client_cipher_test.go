@@ -0,0 +1,83 @@
+package rsbackup
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientEncryptedSubmission(t *testing.T) {
+	tmpDir := createTMPDir(t, "rsbackup")
+	conf := &Config{BackupRoot: tmpDir, DataShards: 2, ParityShards: 1}
+	api := &RSBackupAPI{Config: conf, RsFileMan: &RSFileManager{Config: conf}}
+	submit := func(fname string, fields map[string]string) *httptest.ResponseRecorder {
+		body := new(bytes.Buffer)
+		mw := multipart.NewWriter(body)
+		fw, err := mw.CreateFormFile("file", fname)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fw.Write([]byte("opaque ciphertext"))
+		mw.WriteField("filename", fname)
+		for name, value := range fields {
+			mw.WriteField(name, value)
+		}
+		mw.Close()
+		req := httptest.NewRequest("POST", "/submit_data", body)
+		req.Header.Set("Content-Type", mw.FormDataContentType())
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(api.submitDataHandler).ServeHTTP(rr, req)
+		return rr
+	}
+
+	submitTests := []struct {
+		name           string
+		fields         map[string]string
+		expectedStatus int
+	}{
+		{"missing algorithm", map[string]string{"client_encrypted": "true", "cipher_key_id": "laptop"}, 400},
+		{"bad nonce", map[string]string{"client_encrypted": "true", "cipher_algorithm": "AES-256-GCM", "cipher_nonce": "a\nb"}, 400},
+		{"encrypted", map[string]string{"client_encrypted": "true", "cipher_algorithm": "AES-256-GCM", "cipher_key_id": "laptop", "cipher_nonce": "q83vEjRWeJA="}, 200},
+		{"plain", map[string]string{"cipher_algorithm": "ignored"}, 200},
+	}
+	for _, tt := range submitTests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := submit(tt.name, tt.fields)
+			if rr.Code != tt.expectedStatus {
+				t.Errorf("Got status code %d, expected %d", rr.Code, tt.expectedStatus)
+			}
+		})
+	}
+
+	req := httptest.NewRequest("GET", "/retrieve_data/encrypted", nil)
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(api.retrieveDataHandler).ServeHTTP(rr, req)
+	if rr.Header().Get(cipherAlgorithmHeader) != "AES-256-GCM" || rr.Header().Get(cipherKeyIDHeader) != "laptop" || rr.Header().Get(cipherNonceHeader) != "q83vEjRWeJA=" {
+		t.Errorf("Retrieval lacks the cipher, got headers %v", rr.Header())
+	}
+	if rr.Body.String() != "opaque ciphertext" {
+		t.Errorf("Got '%s'", rr.Body)
+	}
+
+	req = httptest.NewRequest("GET", "/check_data/encrypted", nil)
+	rr = httptest.NewRecorder()
+	http.HandlerFunc(api.checkDataHandler).ServeHTTP(rr, req)
+	var rsp checkDataRsp
+	err := json.NewDecoder(rr.Body).Decode(&rsp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rsp.ClientCipher == nil || rsp.ClientCipher.Algorithm != "AES-256-GCM" {
+		t.Errorf("Check lacks the cipher, got %+v", rsp.ClientCipher)
+	}
+
+	req = httptest.NewRequest("GET", "/retrieve_data/plain", nil)
+	rr = httptest.NewRecorder()
+	http.HandlerFunc(api.retrieveDataHandler).ServeHTTP(rr, req)
+	if rr.Header().Get(cipherAlgorithmHeader) != "" {
+		t.Errorf("Plain file retrieved with cipher '%s'", rr.Header().Get(cipherAlgorithmHeader))
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/sirmackk/rsbackup"
+	log "github.com/sirupsen/logrus"
+)
+
+// runBench runs the bench subcommand with args, the arguments after it,
+// and returns the exit code.
+func runBench(config *rsbackup.Config, args []string) int {
+	flags := flag.NewFlagSet("bench", flag.ContinueOnError)
+	size := rsbackup.Size(256 << 20)
+	flags.Var(&size, "size", "Size of the file encoded, checked and repaired, eg. 1GiB")
+	shardsList := flags.String("shards", fmt.Sprintf("%d+%d", config.DataShards, config.ParityShards), "Comma separated shard counts to try, eg. 4+2,10+3")
+	workersList := flags.String("workers", strconv.Itoa(config.EncodeWorkers), "Comma separated encode workers to try, 0 for one per CPU")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	var shards []rsbackup.BenchShards
+	for _, s := range strings.Split(*shardsList, ",") {
+		parsed, err := rsbackup.ParseBenchShards(strings.TrimSpace(s))
+		if err != nil {
+			log.Error(err)
+			return 2
+		}
+		shards = append(shards, parsed)
+	}
+	var workers []int
+	for _, s := range strings.Split(*workersList, ",") {
+		w, err := strconv.Atoi(strings.TrimSpace(s))
+		if err != nil || w < 0 {
+			log.Errorf("Invalid encode workers '%s'", s)
+			return 2
+		}
+		workers = append(workers, w)
+	}
+	if size <= 0 {
+		log.Error("-size must be positive")
+		return 2
+	}
+
+	log.Infof("Benchmarking with a %s file in %s", size, config.BackupRoot)
+	results, err := rsbackup.Benchmark(config, int64(size), shards, workers)
+	if err != nil {
+		log.Errorf("Benchmark failed: %s", err)
+		return 1
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "shards\tworkers\tencode MB/s\tverify MB/s\trepair MB/s\t")
+	for _, r := range results {
+		w := r.Workers
+		if w == 0 {
+			w = runtime.GOMAXPROCS(0)
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%.1f\t%.1f\t%.1f\t\n", r.BenchShards, w, r.Rate(r.Encode)/1e6, r.Rate(r.Verify)/1e6, r.Rate(r.Repair)/1e6)
+	}
+	tw.Flush()
+	return 0
+}
@@ -1,10 +1,15 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
+	"net"
 	"os"
 	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 
@@ -23,47 +28,528 @@ func setupLogging(debug, ts bool) {
 	})
 }
 
+// loadConfigFile applies the config file at fpath to config. Flags given
+// on the command line take precedence over the file.
+func loadConfigFile(fpath string, config *rsbackup.Config) error {
+	explicit := make(map[string]string)
+	flag.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = f.Value.String()
+	})
+	err := rsbackup.LoadConfigFile(fpath, config)
+	if err != nil {
+		return err
+	}
+	for name, value := range explicit {
+		err = flag.Set(name, value)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func main() {
+	config := &rsbackup.Config{
+		UploadMemoryBuffer: 256 << 20,
+		StagingMaxAge:      24 * time.Hour,
+	}
+	var configPath = flag.String("config", "", "Path to json config file, flags override its values")
 	var ip = flag.String("ip", "127.0.0.1", "Iface address to bind to")
 	var port = flag.Int("port", 44987, "Port to bind to")
-	var dataShards = flag.Int("data-shards", 10, "Number of data shards")
-	var parityShards = flag.Int("parity-shards", 3, "Number of parity shards")
-	var backupRoot = flag.String("backup-root", ".", "Directory to store data & parity")
-	var httpCertPath = flag.String("cert-path", "", "Path to TLS certificate for HTTP server")
-	var httpKeyPath = flag.String("key-path", "", "Path to TLS certificate key")
+	flag.IntVar(&config.DataShards, "data-shards", 10, "Number of data shards")
+	flag.IntVar(&config.ParityShards, "parity-shards", 3, "Number of parity shards")
+	flag.Var(&config.ShardSize, "shard-size", "Size of data shards, eg. 64MiB, to derive shard counts per file instead, 0 for fixed counts")
+	flag.Var(&config.ReplicationThreshold, "replication-threshold", "Replicate files smaller than this, eg. 64KiB, instead of splitting them into shards, 0 to disable")
+	flag.IntVar(&config.Replicas, "replicas", 0, "Number of replicas of replicated files, 0 for as many as -parity-shards")
+	flag.Var(&config.SegmentSize, "segment-size", "Hash files larger than this, eg. 1GiB, in segments checked and repaired on their own, 0 to hash them whole")
+	flag.Var(&config.BlockSize, "block-size", "Hash shards in blocks of this size, eg. 4MiB, to locate damage, 0 to hash them whole")
+	flag.BoolVar(&config.DeferParity, "defer-parity", false, "Answer submits once the data is stored and generate the parity in a background job")
+	var autoShards = flag.Bool("auto-shards", false, "Pick shard counts by file size: 1+2 up to 1MiB, 10+3 up to 1GiB, 20+4 beyond")
+	flag.StringVar(&config.BackupRoot, "backup-root", ".", "Directory to store data & parity")
+	var layoutName = flag.String("layout", "flat", "Directory layout of backup-root: flat, hash1, hash2...")
+	var migrateFrom = flag.String("migrate-layout-from", "", "Move files stored in this layout to -layout and exit")
+	var initRepo = flag.Bool("init", false, "Initialize backup-root as a repository if it isn't one yet")
+	var forceRepo = flag.Bool("force", false, "Use backup-root even if it isn't an initialized repository")
+	flag.BoolVar(&config.MetadataIndex, "metadata-index", false, "Keep the metadata of stored files in an index for listings")
+	flag.BoolVar(&config.ConsistencyScan, "consistency-scan", false, "Scan the backup root for anomalies on start")
+	var rebuildIndex = flag.Bool("rebuild-index", false, "Rebuild the metadata index from the metadata files on start")
+	flag.StringVar(&config.HttpCertPath, "cert-path", "", "Path to TLS certificate for HTTP server, or vault:path#field")
+	flag.StringVar(&config.HttpKeyPath, "key-path", "", "Path to TLS certificate key, or vault:path#field")
+	var acmeHost = flag.String("acme", "", "Obtain and renew the TLS certificate for this hostname via ACME (Let's Encrypt), instead of -cert-path and -key-path")
+	flag.StringVar(&config.ACMEEmail, "acme-email", "", "Contact address given to the ACME CA for expiry notices")
+	flag.StringVar(&config.ACMEHTTPAddress, "acme-http-address", "", "Address to answer ACME HTTP-01 challenges on, eg. :80, TLS-ALPN-01 is used otherwise")
+	flag.StringVar(&config.TLSMinVersion, "tls-min-version", "1.2", "Oldest TLS version accepted, 1.2 or 1.3")
+	flag.DurationVar(&config.HSTSMaxAge, "hsts-max-age", 0, "max-age of the Strict-Transport-Security header, eg. 8760h, 0 omits it")
+	flag.StringVar(&config.HtpasswdPath, "htpasswd", "", "Path to htpasswd file with bcrypt hashed users for basic auth")
+	flag.BoolVar(&config.Immutable, "immutable", false, "Refuse to delete or rename stored files")
+	flag.DurationVar(&config.ImmutableRetention, "immutable-retention", 0, "How long immutable files stay locked after they are stored, 0 for ever")
+	flag.DurationVar(&config.TrashRetention, "trash-retention", 7*24*time.Hour, "How long deleted files can be restored from the trash, 0 deletes them right away")
+	flag.BoolVar(&config.ConfirmDeletes, "confirm-deletes", false, "Only delete files when the delete is repeated with the confirmation token it returned")
+	var runAsUser = flag.String("user", "", "User, name or uid, to switch to once the port is bound")
+	var runAsGroup = flag.String("group", "", "Group, name or gid, to switch to with -user, defaults to the user's primary group")
+	var chroot = flag.Bool("chroot", false, "Chroot into backup-root once the port is bound, every file read must be inside it")
+	flag.BoolVar(&config.AuthDisabled, "insecure-no-auth", false, "Disable API token authentication")
+	flag.Float64Var(&config.RateLimitRequests, "rate-limit", 0, "Requests per second allowed per client, 0 for no limit")
+	flag.IntVar(&config.RateLimitBurst, "rate-limit-burst", 0, "Requests a client may make at once, defaults to a second's worth")
+	flag.Var(&config.RateLimitBandwidth, "rate-limit-bandwidth", "Bandwidth allowed per client, eg. 50MB/s, 0 for no limit")
+	flag.DurationVar(&config.ShutdownTimeout, "shutdown-timeout", 30*time.Second, "Time in-flight requests get to finish on shutdown")
 	var debug = flag.Bool("debug", false, "Enable debug logging")
 	var tsLogging = flag.Bool("timestamp-logging", false, "Enable log timestamps")
+	flag.Var(&config.MaxUploadSize, "max-upload-size", "Max size of a submitted file, eg. 50GiB, 0 for no limit")
+	flag.Var(&config.UploadMemoryBuffer, "upload-memory-buffer", "Amount of an upload sent before its filename buffered in memory, eg. 256MiB")
+	flag.Var(&config.ReadBufferSize, "read-buffer-size", "Size of the reads of files served other than as stored, eg. 1MiB, 0 for 32KiB")
+	flag.Var(&config.WriteBufferSize, "write-buffer-size", "Size of the writes of uploads to storage, eg. 1MiB, 0 for 32KiB")
+	flag.Var(&config.CacheMemory, "cache-memory", "Bytes of retrieved files cached in memory, eg. 1GiB, 0 for none")
+	flag.StringVar(&config.CacheDir, "cache-dir", "", "Local directory retrieved files are cached in, with -cache-dir-size")
+	flag.Var(&config.CacheDirSize, "cache-dir-size", "Bytes of retrieved files cached in -cache-dir, eg. 100GiB")
+	flag.Var(&config.CacheMaxObject, "cache-max-object", "Largest file cached, eg. 256MiB, 0 for 64MiB")
+	flag.DurationVar(&config.CacheVerifiedFor, "cache-verified-for", 0, "How long a verified retrieval is trusted, 0 for 10m, negative for never")
+	flag.DurationVar(&config.IdempotencyTTL, "idempotency-ttl", 24*time.Hour, "How long to remember Idempotency-Key results")
+	flag.IntVar(&config.IdempotencyMaxKeys, "idempotency-max-keys", 10000, "Max number of remembered Idempotency-Key results")
+	flag.DurationVar(&config.ShareDefaultTTL, "share-ttl", 24*time.Hour, "Default lifetime of share links")
+	flag.IntVar(&config.RestoreWorkers, "restore-workers", 0, "Parallel decoders when serving degraded data, 0 for one per CPU")
+	flag.IntVar(&config.EncodeWorkers, "encode-workers", 0, "Parallel encoders when computing parity, 0 for one per CPU")
+	flag.StringVar(&config.ErasureCoding, "erasure-coding", "simd", "Reed-Solomon code to use, simd or generic")
+	flag.StringVar(&config.ShardHash, "shard-hash", "sha256", "Algorithm to hash the shards of new files with: sha256, sha512 or blake3")
+	flag.StringVar(&config.Codec, "codec", rsbackup.CodecReedSolomon, "Codec to encode new files with: "+strings.Join(rsbackup.Codecs(), ", "))
+	flag.Float64Var(&config.ReadSampleRate, "read-sample-rate", 0, "Fraction of stripes checked against parity on every download, eg. 0.01")
+	flag.IntVar(&config.ScrubWorkers, "scrub-workers", 1, "Files checked at once by scrubs")
+	flag.Var(&config.ScrubReadRate, "scrub-read-rate", "Cap on disk reads by scrubs, eg. 100MB/s, 0 for no limit")
+	flag.IntVar(&config.ScrubIOPS, "scrub-iops", 0, "Cap on read operations per second by scrubs, 0 for no limit")
+	flag.IntVar(&config.RepairWorkers, "repair-workers", 0, "Repairs run at once, 0 for one per CPU")
+	flag.Var(&config.RepairReadRate, "repair-read-rate", "Cap on disk reads by repairs, eg. 50MB/s, 0 for no limit")
+	flag.IntVar(&config.RepairIOPS, "repair-iops", 0, "Cap on read operations per second by repairs, 0 for no limit")
+	flag.IntVar(&config.IngestWorkers, "ingest-workers", 0, "Uploads received at once, 0 for no limit")
+	flag.IntVar(&config.IngestQueue, "ingest-queue", 16, "Uploads allowed to wait for -ingest-workers before they're refused")
+	flag.DurationVar(&config.ScrubInterval, "scrub-interval", 0, "Time between background checks of all files, 0 disables scrubbing")
+	flag.Float64Var(&config.ScrubSampleRate, "scrub-sample-rate", 0, "Fraction of the blocks of each file checked by scrubs, eg. 0.05, 0 to check them all")
+	flag.IntVar(&config.DeepScrubEvery, "deep-scrub-every", 10, "Check all of every file every this many scrubs when -scrub-sample-rate is set")
+	flag.BoolVar(&config.FetchEnabled, "fetch-enabled", false, "Serve submit_url, which downloads files from urls clients give")
+	flag.DurationVar(&config.FetchTimeout, "fetch-timeout", time.Hour, "Timeout for downloads requested via submit_url")
+	flag.Var(&config.FetchMaxSize, "fetch-max-size", "Max size downloaded via submit_url, eg. 10GiB, 0 for no limit")
 	flag.Parse()
 
-	if *httpCertPath == "" || *httpKeyPath == "" {
-		log.Error("both -cert-path and -key-path arguments are required!")
+	setupLogging(*debug, *tsLogging)
+
+	addressFlagSet := false
+	flag.Visit(func(f *flag.Flag) {
+		addressFlagSet = addressFlagSet || f.Name == "ip" || f.Name == "port"
+	})
+	if *configPath != "" {
+		err := loadConfigFile(*configPath, config)
+		if err != nil {
+			log.Errorf("Unable to load config: %s", err)
+			os.Exit(1)
+		}
+	}
+	if config.Address == "" || addressFlagSet {
+		config.Address = fmt.Sprintf("%s:%d", *ip, *port)
+	}
+	if *acmeHost != "" {
+		config.ACMEHosts = []string{*acmeHost}
+	}
+	if *autoShards && len(config.ShardBands) == 0 {
+		config.ShardBands = rsbackup.DefaultShardBands
+	}
+	err := config.Validate()
+	if err != nil {
+		log.Errorf("Invalid config: %s", err)
 		os.Exit(1)
 	}
+	log.Infof("Encoding new files with %s, Reed-Solomon coding with %s", config.Codec, config.DescribeErasureCoding())
+	if flag.Arg(0) == "bench" {
+		os.Exit(runBench(config, flag.Args()[1:]))
+	}
 
-	setupLogging(*debug, *tsLogging)
+	layout, err := rsbackup.ParseLayout(*layoutName)
+	if err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
 
-	config := &rsbackup.Config{
-		BackupRoot:   *backupRoot,
-		DataShards:   *dataShards,
-		ParityShards: *parityShards,
-		HttpCertPath: *httpCertPath,
-		HttpKeyPath:  *httpKeyPath,
-		Address:      fmt.Sprintf("%s:%d", *ip, *port),
+	if *migrateFrom == "" && len(config.ACMEHosts) == 0 && (config.HttpCertPath == "" || config.HttpKeyPath == "") {
+		log.Error("both -cert-path and -key-path arguments are required, unless -acme is used!")
+		os.Exit(1)
+	}
+
+	// Until migrated, files are stored in the layout they're migrated from.
+	storedLayout := layout
+	if *migrateFrom != "" {
+		storedLayout, err = rsbackup.ParseLayout(*migrateFrom)
+		if err != nil {
+			log.Error(err)
+			os.Exit(1)
+		}
+	}
+	_, err = rsbackup.OpenRepository(config, storedLayout, *initRepo, *forceRepo)
+	if err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
+
+	// The port is bound first, so privileged ports work after dropping
+	// privileges.
+	var listener net.Listener
+	if *runAsGroup != "" && *runAsUser == "" {
+		log.Error("-group requires -user")
+		os.Exit(1)
+	}
+	if *runAsUser != "" || *chroot {
+		listener, err = net.Listen("tcp", config.Address)
+		if err != nil {
+			log.Errorf("Unable to listen on %s: %s", config.Address, err)
+			os.Exit(1)
+		}
+		err = dropPrivileges(config, *runAsUser, *runAsGroup, *chroot)
+		if err != nil {
+			log.Errorf("Unable to drop privileges: %s", err)
+			os.Exit(1)
+		}
+		log.Infof("Running as uid %d, gid %d (chrooted: %t)", os.Getuid(), os.Getgid(), *chroot)
 	}
+
+	secrets, err := rsbackup.NewSecretReader(config)
+	if err != nil {
+		log.Errorf("Unable to set up Vault: %s", err)
+		os.Exit(1)
+	}
+	keys, err := rsbackup.NewKeyRing(config, secrets)
+	if err != nil {
+		log.Errorf("Unable to load encryption keys: %s", err)
+		os.Exit(1)
+	}
+
 	rsMan := &rsbackup.RSFileManager{
 		Config: config,
+		Layout: layout,
+		Keys:   keys,
+	}
+	rsMan.Chunks, err = rsbackup.NewChunkStore(config.StatePath("chunks.json"))
+	if err != nil {
+		log.Errorf("Unable to load chunk references: %s", err)
+		os.Exit(1)
+	}
+	rsMan.Packs, err = rsbackup.NewPackStore(config.StatePath("packs.json"))
+	if err != nil {
+		log.Errorf("Unable to load packed file counts: %s", err)
+		os.Exit(1)
+	}
+	local, err := rsbackup.NewOSBackend(config)
+	if err != nil {
+		log.Errorf("Unable to set up local storage: %s", err)
+		os.Exit(1)
+	}
+	rsMan.Storage = local
+	if config.GCSBucket != "" {
+		gcs, err := rsbackup.NewGCSBackend(config)
+		if err != nil {
+			log.Errorf("Unable to set up GCS storage: %s", err)
+			os.Exit(1)
+		}
+		rsMan.Storage = gcs
+		log.Infof("Storing files in GCS bucket %s", config.GCSBucket)
+	}
+	if config.B2Bucket != "" {
+		b2, err := rsbackup.NewB2Backend(config)
+		if err != nil {
+			log.Errorf("Unable to set up B2 storage: %s", err)
+			os.Exit(1)
+		}
+		rsMan.Storage = b2
+		log.Infof("Storing files in B2 bucket %s", config.B2Bucket)
+	}
+	if len(config.ShardRoots) > 0 {
+		disks, err := rsbackup.NewMultiDiskBackend(config.BackupRoot, config.ShardRoots, local)
+		if err != nil {
+			log.Errorf("Unable to set up shard roots: %s", err)
+			os.Exit(1)
+		}
+		rsMan.Storage = disks
+		if len(config.ShardRoots) <= config.ParityShards {
+			log.Warnf("Only %d shard roots for %d parity shards, some disks hold several shards of a file", len(config.ShardRoots), config.ParityShards)
+		}
+		log.Infof("Spreading files over %s", strings.Join(config.ShardRoots, ", "))
+	}
+	var placement *rsbackup.PlacementBackend
+	if len(config.Placement) > 0 {
+		placement, err = rsbackup.NewPlacementBackend(config)
+		if err != nil {
+			log.Errorf("Unable to set up placement: %s", err)
+			os.Exit(1)
+		}
+		rsMan.Storage = placement
+		log.Infof("Placing files by %d rules over %d storage targets", len(config.Placement), len(config.StorageTargets))
+	}
+	if config.SFTPStorageURL != "" {
+		remote, err := rsbackup.NewSFTPBackend(config)
+		if err != nil {
+			log.Errorf("Unable to set up SFTP storage: %s", err)
+			os.Exit(1)
+		}
+		rsMan.Storage = remote
+		log.Infof("Storing files at %s", config.SFTPStorageURL)
+	}
+	var tiering *rsbackup.TieredBackend
+	if config.ColdTarget != "" {
+		tiering, err = rsbackup.NewTieredBackend(config, rsMan.Storage)
+		if err != nil {
+			log.Errorf("Unable to set up tiering: %s", err)
+			os.Exit(1)
+		}
+		rsMan.Storage = tiering
+		log.Infof("Moving files untouched for %s to storage target %s", config.ColdAfter, config.ColdTarget)
+	}
+	if err := rsMan.RemoveStaged(); err != nil {
+		log.Errorf("Unable to remove files left staged: %s", err)
+		os.Exit(1)
+	}
+	var usage *rsbackup.StorageUsage
+	if config.MaxStorageSize > 0 {
+		usage, err = rsbackup.NewStorageUsage(config.StatePath("usage.json"), rsMan.Storage, config)
+		if err != nil {
+			log.Errorf("Unable to count storage usage: %s", err)
+			os.Exit(1)
+		}
+		rsMan.Storage = usage.Track(rsMan.Storage)
+		log.Infof("Storing up to %s, %d bytes stored", config.MaxStorageSize, usage.Bytes())
+	}
+	rsMan.Journal, err = rsbackup.OpenOperationJournal(config.StatePath("journal"))
+	if err != nil {
+		log.Errorf("Unable to open operation journal: %s", err)
+		os.Exit(1)
+	}
+	rsMan.Cache, err = rsbackup.NewReadCache(config)
+	if err != nil {
+		log.Errorf("Unable to set up the read cache: %s", err)
+		os.Exit(1)
+	}
+	// The index is rebuilt after a crash, so it sees what was recovered.
+	recovered, err := rsMan.RecoverOperations()
+	if err != nil {
+		log.Errorf("Unable to recover interrupted operations: %s", err)
+		os.Exit(1)
+	}
+	if recovered > 0 {
+		log.Infof("Recovered %d interrupted operations", recovered)
+	}
+	if config.MetadataIndex {
+		rsMan.Index, err = rsbackup.OpenMetadataIndex(config.StatePath("index.db"))
+		if err != nil {
+			log.Errorf("Unable to open metadata index: %s", err)
+			os.Exit(1)
+		}
+		if rsMan.Index.NeedsRebuild() || *rebuildIndex {
+			log.Infof("Rebuilding metadata index")
+			indexed, err := rsMan.RebuildIndex()
+			if err != nil {
+				log.Errorf("Unable to rebuild metadata index: %s", err)
+				os.Exit(1)
+			}
+			log.Infof("Indexed %d files", indexed)
+		}
+	}
+	// Multipart forms spill to the temporary directory.
+	if err := os.MkdirAll(config.StagingPath(), 0755); err != nil {
+		log.Errorf("Unable to create staging directory: %s", err)
+		os.Exit(1)
+	}
+	os.Setenv("TMPDIR", config.StagingPath())
+
+	if *migrateFrom != "" {
+		log.Infof("Migrating %s from layout %s to %s", config.BackupRoot, storedLayout, layout)
+		moved, err := rsMan.MigrateLayout(storedLayout)
+		log.Infof("Migrated %d files", moved)
+		if err == nil {
+			err = rsbackup.RecordRepositoryLayout(config, layout)
+		}
+		if err != nil {
+			log.Errorf("Migration failed: %s", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	shares, err := rsbackup.NewShareStore(config.StatePath("shares.json"))
+	if err != nil {
+		log.Errorf("Unable to load share links: %s", err)
+		os.Exit(1)
+	}
+
+	presigned, err := rsbackup.NewPresignStore(config.StatePath("presigned.json"))
+	if err != nil {
+		log.Errorf("Unable to load presigned uploads: %s", err)
+		os.Exit(1)
+	}
+
+	health, err := rsbackup.NewHealthCache(config.StatePath("health.json"))
+	if err != nil {
+		log.Errorf("Unable to load cached health: %s", err)
+		os.Exit(1)
+	}
+
+	annotations, err := rsbackup.NewAnnotationStore(config.StatePath("annotations.json"))
+	if err != nil {
+		log.Errorf("Unable to load annotations: %s", err)
+		os.Exit(1)
+	}
+
+	renames, err := rsbackup.NewRenameHistory(config.StatePath("renames.json"))
+	if err != nil {
+		log.Errorf("Unable to load rename history: %s", err)
+		os.Exit(1)
+	}
+
+	audit, err := rsbackup.NewAuditLog(config.StatePath("audit.log"), config.AuditMaxSize, config.AuditMaxFiles)
+	if err != nil {
+		log.Errorf("Unable to open audit log: %s", err)
+		os.Exit(1)
 	}
 
 	apiServer := &rsbackup.RSBackupAPI{
-		Config:    config,
-		RsFileMan: rsMan,
+		Config:      config,
+		RsFileMan:   rsMan,
+		Shares:      shares,
+		Presigned:   presigned,
+		Health:      health,
+		Annotations: annotations,
+		Renames:     renames,
+		Secrets:     secrets,
+		Audit:       audit,
+		Events:      rsbackup.NewEventFeed(),
+		Placement:   placement,
+		Tiering:     tiering,
+		Listener:    listener,
+	}
+	apiServer.OnShutdown("audit log", audit.Close)
+	if usage != nil {
+		apiServer.Usage = usage
+		apiServer.OnShutdown("storage usage", usage.Close)
+	}
+	if rsMan.Index != nil {
+		apiServer.OnShutdown("metadata index", func(context.Context) error {
+			return rsMan.Index.Close()
+		})
+	}
+	if config.ConsistencyScan {
+		log.Infof("Scanning %s for anomalies", config.BackupRoot)
+		apiServer.Consistency, err = rsMan.ScanConsistency()
+		if err != nil {
+			log.Errorf("Unable to scan the backup root: %s", err)
+			os.Exit(1)
+		}
+		log.Infof("Found %d anomalies in %s", len(apiServer.Consistency.Anomalies), apiServer.Consistency.Took)
+	}
+	if len(config.Quotas) > 0 || config.DefaultQuota > 0 {
+		apiServer.Quotas, err = rsbackup.NewQuotaStore(config.StatePath("quotas.json"), config)
+		if err != nil {
+			log.Errorf("Unable to load quota usage: %s", err)
+			os.Exit(1)
+		}
+	}
+	// Files queued while DeferParity was on get their parity either way.
+	apiServer.ParityQueue, err = rsbackup.NewParityQueue(config.StatePath("parity_queue.json"))
+	if err != nil {
+		log.Errorf("Unable to load the parity queue: %s", err)
+		os.Exit(1)
+	}
+	apiServer.StartDeferredParity()
+	if config.TrashRetention > 0 {
+		apiServer.Trash, err = rsbackup.NewTrash(config.StatePath("trash.json"), config)
+		if err != nil {
+			log.Errorf("Unable to load the trash: %s", err)
+			os.Exit(1)
+		}
+		apiServer.StartTrashPurger()
+	}
+	if config.SFTPURL != "" {
+		mirror, err := rsbackup.NewSFTPMirror(config, rsMan)
+		if err != nil {
+			log.Errorf("Unable to set up SFTP mirror: %s", err)
+			os.Exit(1)
+		}
+		apiServer.Mirror = mirror
+		apiServer.OnShutdown("SFTP mirror", mirror.Stop)
+	}
+	if config.AuthDisabled {
+		log.Warn("Authentication is disabled, anyone who can reach the server can use it")
+	} else {
+		tokens, err := rsbackup.NewTokenStore(config.StatePath("tokens.json"), config)
+		if err != nil {
+			log.Errorf("Unable to load API tokens: %s", err)
+			os.Exit(1)
+		}
+		apiServer.Tokens = tokens
+		if config.OIDCIssuer != "" {
+			apiServer.JWTs, err = rsbackup.NewJWTValidator(config)
+			if err != nil {
+				log.Errorf("Unable to set up OIDC authentication: %s", err)
+				os.Exit(1)
+			}
+		}
+		if config.HtpasswdPath != "" {
+			htpasswd, err := rsbackup.LoadHtpasswd(config.HtpasswdPath, config.HtpasswdAdmins)
+			if err != nil {
+				log.Errorf("Unable to load htpasswd file: %s", err)
+				os.Exit(1)
+			}
+			apiServer.PasswordAuth = append(apiServer.PasswordAuth, htpasswd)
+			reload := make(chan os.Signal, 1)
+			signal.Notify(reload, syscall.SIGHUP)
+			go func() {
+				for range reload {
+					err := htpasswd.Reload()
+					if err != nil {
+						log.Errorf("Unable to reload htpasswd file, keeping previous users: %s", err)
+					}
+				}
+			}()
+		}
+		if config.LDAPURL != "" {
+			apiServer.PasswordAuth = append(apiServer.PasswordAuth, rsbackup.NewLDAPAuthenticator(config))
+		}
+		if tokens.Len() == 0 && apiServer.JWTs == nil && len(apiServer.PasswordAuth) == 0 {
+			log.Error("No credentials configured, set AdminTokens, OIDCIssuer, HtpasswdPath or LDAPURL in the -config file or use -insecure-no-auth")
+			os.Exit(1)
+		}
+	}
+
+	if config.ScrubInterval > 0 {
+		apiServer.StartScrubber(config.ScrubInterval)
+	}
+	if config.CompactionInterval > 0 {
+		apiServer.StartCompactor(config.CompactionInterval)
+	}
+	if tiering != nil {
+		apiServer.StartTiering()
+	}
+	if len(config.Lifecycle) > 0 && config.LifecycleInterval > 0 {
+		apiServer.StartLifecycle(config.LifecycleInterval)
+	}
+	if config.StagingMaxAge > 0 {
+		apiServer.StartJanitor()
 	}
 
+	reloadCert := make(chan os.Signal, 1)
+	signal.Notify(reloadCert, syscall.SIGHUP)
+	go func() {
+		for range reloadCert {
+			err := apiServer.ReloadCertificate()
+			if err != nil {
+				log.Errorf("Unable to reload TLS certificate, keeping the current one: %s", err)
+			}
+		}
+	}()
+
 	terminate := make(chan os.Signal, 1)
-	signal.Notify(terminate, os.Interrupt)
+	signal.Notify(terminate, os.Interrupt, syscall.SIGTERM)
 	go func() {
 		sig := <-terminate
 		log.Infof("Received signal %s, terminating...", sig)
+		go func() {
+			<-terminate
+			log.Warn("Received second signal, exiting immediately")
+			os.Exit(1)
+		}()
 		err := apiServer.Stop()
 		if err != nil {
 			log.Errorf("Error while shutting down server: %s", err)
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"crypto/x509"
+	"fmt"
+	"os"
+	"syscall"
+
+	"github.com/sirmackk/rsbackup"
+)
+
+// dropPrivileges chroots into the backup root if asked to, and switches
+// to userName and groupName if given. Users and groups are looked up and
+// the system's CA certificates loaded beforehand, as neither can be found
+// inside the chroot.
+func dropPrivileges(config *rsbackup.Config, userName, groupName string, chroot bool) error {
+	uid, gid := -1, -1
+	if userName != "" {
+		owner, err := rsbackup.LookupOwner(userName, groupName)
+		if err != nil {
+			return err
+		}
+		uid, gid = owner.UID, owner.GID
+	}
+	if chroot {
+		if _, err := x509.SystemCertPool(); err != nil {
+			return fmt.Errorf("Unable to load CA certificates: %w", err)
+		}
+		root := config.BackupRoot
+		err := config.Chroot()
+		if err != nil {
+			return err
+		}
+		err = syscall.Chroot(root)
+		if err != nil {
+			return fmt.Errorf("Unable to chroot into %s: %w", root, err)
+		}
+		err = os.Chdir("/")
+		if err != nil {
+			return err
+		}
+	}
+	if uid < 0 {
+		return nil
+	}
+	// Supplementary groups go first, setgid and setuid can't be undone.
+	err := syscall.Setgroups([]int{gid})
+	if err == nil {
+		err = syscall.Setgid(gid)
+	}
+	if err == nil {
+		err = syscall.Setuid(uid)
+	}
+	if err != nil {
+		return fmt.Errorf("Unable to switch to uid %d and gid %d: %w", uid, gid, err)
+	}
+	return nil
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/sirmackk/rsbackup"
+)
+
+func dropPrivileges(config *rsbackup.Config, userName, groupName string, chroot bool) error {
+	return fmt.Errorf("-user, -group and -chroot are only supported on Linux")
+}
@@ -0,0 +1,83 @@
+package rsbackup
+
+import (
+	"fmt"
+	"sort"
+)
+
+// CodecReedSolomon names the Reed-Solomon codec, the default. Files whose
+// metadata names no codec were stored with it.
+const CodecReedSolomon = "reed-solomon"
+
+// Codec computes the parity shards of files and rebuilds their lost
+// shards. Shards are passed data shards first, then parity shards, all
+// of the same length.
+type Codec interface {
+	// Encode fills the parity shards from the data shards.
+	Encode(shards [][]byte) error
+	// Verify reports whether the parity shards match the data shards.
+	Verify(shards [][]byte) (bool, error)
+	// Reconstruct rebuilds the shards that are nil or empty.
+	Reconstruct(shards [][]byte) error
+	// ReconstructData only rebuilds the data shards that are nil or empty.
+	ReconstructData(shards [][]byte) error
+}
+
+// incrementalCodec is a Codec that can add one data shard at a time to
+// the parity, as files encoded while they're received need.
+type incrementalCodec interface {
+	Codec
+	EncodeIdx(dataShard []byte, idx int, parity [][]byte) error
+}
+
+// CodecFactory creates the codec of files with dataShards and
+// parityShards.
+type CodecFactory func(config *Config, dataShards, parityShards int) (Codec, error)
+
+var codecs = map[string]CodecFactory{
+	CodecReedSolomon: func(config *Config, dataShards, parityShards int) (Codec, error) {
+		return config.erasureCoder(dataShards, parityShards)
+	},
+}
+
+// RegisterCodec makes a codec available as Config.Codec under name, it
+// must be called before the config is validated, e.g. from init. Files
+// record the name of their codec, so it must not change once files were
+// stored with it.
+func RegisterCodec(name string, factory CodecFactory) {
+	if _, ok := codecs[name]; ok || name == "" {
+		panic(fmt.Sprintf("Codec '%s' is already registered", name))
+	}
+	codecs[name] = factory
+}
+
+// Codecs returns the names of the registered codecs.
+func Codecs() []string {
+	names := make([]string, 0, len(codecs))
+	for name := range codecs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// codecName returns the name of the codec new files are stored with.
+func (c *Config) codecName() string {
+	if c.Codec == "" {
+		return CodecReedSolomon
+	}
+	return c.Codec
+}
+
+// newCodec returns the codec named name, as recorded in the metadata of a
+// file, for its dataShards and parityShards.
+func (c *Config) newCodec(name string, dataShards, parityShards int) (Codec, error) {
+	if name == "" {
+		name = CodecReedSolomon
+	}
+	factory, ok := codecs[name]
+	if !ok {
+		return nil, fmt.Errorf("Unknown codec '%s'", name)
+	}
+	return factory(c, dataShards, parityShards)
+}
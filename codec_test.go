@@ -0,0 +1,147 @@
+package rsbackup
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+// xorCodec makes every parity shard the XOR of the data shards, so it
+// can rebuild one lost data shard.
+type xorCodec struct{ dataShards int }
+
+func (c xorCodec) parity(shards [][]byte) []byte {
+	p := make([]byte, len(shards[0]))
+	for _, shard := range shards[:c.dataShards] {
+		for i, b := range shard {
+			p[i] ^= b
+		}
+	}
+	return p
+}
+
+func (c xorCodec) Encode(shards [][]byte) error {
+	for _, shard := range shards[c.dataShards:] {
+		copy(shard, c.parity(shards))
+	}
+	return nil
+}
+
+func (c xorCodec) Verify(shards [][]byte) (bool, error) {
+	for _, shard := range shards[c.dataShards:] {
+		if !bytes.Equal(shard, c.parity(shards)) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func (c xorCodec) Reconstruct(shards [][]byte) error {
+	if err := c.ReconstructData(shards); err != nil {
+		return err
+	}
+	for i := c.dataShards; i < len(shards); i++ {
+		shards[i] = c.parity(shards)
+	}
+	return nil
+}
+
+func (c xorCodec) ReconstructData(shards [][]byte) error {
+	lost, size := -1, 0
+	for i, shard := range shards {
+		if len(shard) > 0 {
+			size = len(shard)
+		} else if i < c.dataShards && lost >= 0 {
+			return errors.New("Too many lost data shards")
+		} else if i < c.dataShards {
+			lost = i
+		}
+	}
+	if lost < 0 {
+		return nil
+	}
+	// The lost shard is the parity of the others and any parity shard.
+	shards[lost] = make([]byte, size)
+	for _, parity := range shards[c.dataShards:] {
+		if len(parity) > 0 {
+			rebuilt := c.parity(shards)
+			for j, b := range parity {
+				rebuilt[j] ^= b
+			}
+			shards[lost] = rebuilt
+			return nil
+		}
+	}
+	return errors.New("No parity left")
+}
+
+func init() {
+	RegisterCodec("xor-test", func(config *Config, dataShards, parityShards int) (Codec, error) {
+		return xorCodec{dataShards}, nil
+	})
+}
+
+func TestCodec(t *testing.T) {
+	config := &Config{BackupRoot: createTMPDir(t, "rsbackup"), DataShards: 3, ParityShards: 2}
+	fm := &RSFileManager{Config: config}
+	api := &RSBackupAPI{Config: config, RsFileMan: fm}
+	contents := map[string][]byte{
+		"tyger": bytes.Repeat([]byte("tyger tyger burning bright "), 400),
+		"lamb":  bytes.Repeat([]byte("little lamb who made thee "), 400),
+	}
+	for _, fname := range []string{"tyger", "lamb"} {
+		if fname == "lamb" {
+			config.Codec = "xor-test"
+		}
+		fpath := fm.DataPath(fname)
+		if err := ioutil.WriteFile(fpath, contents[fname], 0644); err != nil {
+			t.Fatal(err)
+		}
+		var extras MetadataExtras
+		md, err := api.generateParity(fm.storage(), fpath, &extras)
+		if err == nil {
+			err = fm.WriteMetadata(fname, md, extras)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for fname, codec := range map[string]string{"tyger": CodecReedSolomon, "lamb": "xor-test"} {
+		if extras, err := fm.ReadExtras(fm.DataPath(fname)); err != nil || extras.Codec != codec {
+			t.Errorf("Got codec '%s' (error: %v) for %s, expected '%s'", extras.Codec, err, fname, codec)
+		}
+	}
+
+	// Both are repaired with their own codec, whichever new files get.
+	for _, fname := range []string{"tyger", "lamb"} {
+		fpath := fm.DataPath(fname)
+		damaged := append([]byte{}, contents[fname]...)
+		damaged[100] ^= 0xff
+		if err := ioutil.WriteFile(fpath, damaged, 0644); err != nil {
+			t.Fatal(err)
+		}
+		os.Remove(fpath + ".parity.1")
+		if health, _, _, err := fm.CheckData(fname); err != nil || health {
+			t.Errorf("Got health %t (error: %v) of damaged %s", health, err, fname)
+		}
+		if err := fm.RepairData(fname); err != nil {
+			t.Fatalf("Repairing %s: %s", fname, err)
+		}
+		if health, _, _, err := fm.CheckData(fname); err != nil || !health {
+			t.Errorf("Got health %t (error: %v) of repaired %s", health, err, fname)
+		}
+		if data, err := ioutil.ReadFile(fpath); err != nil || !bytes.Equal(data, contents[fname]) {
+			t.Errorf("Got different contents of repaired %s (error: %v)", fname, err)
+		}
+		if sampled, ok, err := fm.SampleStripes(fname, 1); err != nil || !ok || sampled == 0 {
+			t.Errorf("Got %d stripes sampled, consistent: %t (error: %v) of %s", sampled, ok, err, fname)
+		}
+	}
+
+	config.Codec = "lrc"
+	if err := config.Validate(); err == nil {
+		t.Errorf("An unknown codec passed validation")
+	}
+}
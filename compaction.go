@@ -0,0 +1,336 @@
+package rsbackup
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const defaultCompactionThreshold = 0.5
+
+// packMember is a packed file found in a container, fpath being its data
+// file in BackupRoot or in the trash.
+type packMember struct {
+	fpath string
+	info  PackInfo
+}
+
+// storedReferences finds what every file, including those in the trash,
+// uses of the containers and chunks shared between files: the packed
+// files in each container and the set of chunks used.
+func (rs *RSBackupAPI) storedReferences() (map[string][]packMember, map[string]bool, error) {
+	fm := rs.RsFileMan
+	names, err := fm.ListData()
+	if err != nil {
+		return nil, nil, err
+	}
+	var paths []string
+	for _, name := range names {
+		paths = append(paths, fm.DataPath(name))
+	}
+	if rs.Trash != nil {
+		for _, entry := range rs.Trash.List() {
+			paths = append(paths, rs.Trash.dataPath(entry.ID))
+		}
+	}
+	members := make(map[string][]packMember)
+	chunks := make(map[string]bool)
+	for _, fpath := range paths {
+		if packed := fm.packedInfo(fpath); packed != nil {
+			members[packed.Container] = append(members[packed.Container], packMember{fpath: fpath, info: *packed})
+		}
+		manifest, err := fm.readManifest(fpath)
+		if os.IsNotExist(err) {
+			// Removed since the listing.
+			continue
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("Cannot read chunks of '%s': %s", fpath, err)
+		}
+		if manifest != nil {
+			for _, chunk := range manifest.Chunks {
+				chunks[chunk.Hash] = true
+			}
+		}
+	}
+	return members, chunks, nil
+}
+
+// compact reclaims the space of deleted files from shared storage. Sealed
+// containers with less than Config.CompactionThreshold of their bytes
+// still in use are rewritten with only the packed files left, containers
+// and chunks no file uses are removed. Reads and writes are paced to the
+// scrub read rate. Closing stop ends it early.
+func (rs *RSBackupAPI) compact(job *jobProgress, stop <-chan struct{}) error {
+	fm := rs.RsFileMan
+	members, used, err := rs.storedReferences()
+	if err != nil {
+		return err
+	}
+	var containers, chunks []string
+	if fm.Packs != nil {
+		containers, err = fm.packFiles().ListData()
+		if err != nil {
+			return err
+		}
+	}
+	if fm.Chunks != nil {
+		chunks, err = fm.chunkFiles().ListData()
+		if err != nil {
+			return err
+		}
+	}
+	job.setTotal(len(containers) + len(chunks))
+	for _, container := range containers {
+		select {
+		case <-stop:
+			return nil
+		default:
+		}
+		err := rs.compactContainer(container, members[container], stop)
+		if err != nil {
+			log.Warnf("Compaction couldn't process container %s, continuing: %s", container, err)
+		}
+		job.done(container, err)
+	}
+	for _, hash := range chunks {
+		select {
+		case <-stop:
+			return nil
+		default:
+		}
+		if !used[hash] {
+			fm.Chunks.removeUnused(fm.chunkFiles(), hash)
+		}
+		job.done(hash, nil)
+	}
+	return nil
+}
+
+// compactContainer removes container if no file uses it anymore, or
+// rewrites it when too little of it is used by members.
+func (rs *RSBackupAPI) compactContainer(container string, members []packMember, stop <-chan struct{}) error {
+	fm := rs.RsFileMan
+	files := fm.packFiles()
+	if len(members) == 0 {
+		fm.Packs.removeUnused(files, container)
+		return nil
+	}
+	stat, err := files.Stat(container)
+	if err != nil {
+		return err
+	}
+	var live int64
+	for _, m := range members {
+		live += m.info.Size
+	}
+	if float64(live) >= rs.Config.compactionThreshold()*float64(stat.Size()) || fm.Packs.isOpen(container) {
+		return nil
+	}
+	log.Infof("Compacting container %s, %d of %d bytes used by %d files", container, live, stat.Size(), len(members))
+	sort.Slice(members, func(i, j int) bool { return members[i].info.Offset < members[j].info.Offset })
+	id, err := generateToken()
+	if err != nil {
+		return err
+	}
+	compacted := id[:16]
+	moved, err := copyMembers(files, container, compacted, members)
+	if err == nil {
+		err = protectContainer(files, compacted)
+	}
+	rs.background().throttle.pay(2*live, stop)
+	if err != nil {
+		// Nothing uses the copy yet.
+		removeStoredObject(files.storage(), files.DataPath(compacted), false)
+		return err
+	}
+	return rs.switchContainer(container, compacted, moved)
+}
+
+// copyMembers writes the contents of members from container to a new
+// container, checking them against their hash, and returns where they
+// were written.
+func copyMembers(files *RSFileManager, container, compacted string, members []packMember) ([]packMember, error) {
+	src, err := files.storage().Open(files.DataPath(container))
+	if err != nil {
+		return nil, err
+	}
+	defer src.Close()
+	dst, err := files.storage().CreateExclusive(files.DataPath(compacted))
+	if err != nil {
+		return nil, err
+	}
+	var moved []packMember
+	var offset int64
+	for _, m := range members {
+		hash := sha256.New()
+		_, err = io.Copy(io.MultiWriter(dst, hash), io.NewSectionReader(src, m.info.Offset, m.info.Size))
+		if err != nil {
+			break
+		}
+		if hex.EncodeToString(hash.Sum(nil)) != m.info.Hash {
+			err = fmt.Errorf("Contents of '%s' are damaged, repair them first", m.fpath)
+			break
+		}
+		info := m.info
+		info.Container, info.Offset = compacted, offset
+		moved = append(moved, packMember{fpath: m.fpath, info: info})
+		offset += info.Size
+	}
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	return moved, err
+}
+
+// switchContainer points the members moved from container to their
+// copies in compacted and removes container once nothing uses it. Files
+// renamed, trashed or deleted since they were found are left alone, they
+// keep container around until the next compaction.
+func (rs *RSBackupAPI) switchContainer(container, compacted string, moved []packMember) error {
+	fm := rs.RsFileMan
+	if rs.Trash != nil {
+		rs.Trash.mu.Lock()
+		defer rs.Trash.mu.Unlock()
+	}
+	renameMu.Lock()
+	defer renameMu.Unlock()
+	s := fm.Packs
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switched := 0
+	var err error
+	for _, m := range moved {
+		var md *storedMetadata
+		md, err = fm.readStoredMetadata(m.fpath)
+		if os.IsNotExist(err) {
+			err = nil
+			continue
+		}
+		if err != nil {
+			break
+		}
+		if md.Packed == nil || md.Packed.Container != container || md.Packed.Hash != m.info.Hash {
+			continue
+		}
+		info := m.info
+		md.Packed = &info
+		err = fm.replaceMetadata(m.fpath, md)
+		if err != nil {
+			break
+		}
+		switched++
+	}
+	live := s.state.Live[container] - switched
+	if live > 0 {
+		s.state.Live[container] = live
+	} else {
+		delete(s.state.Live, container)
+	}
+	if switched > 0 {
+		s.state.Live[compacted] = switched
+	}
+	if stateErr := writeJSONState(s.path, s.state); err == nil {
+		err = stateErr
+	}
+	if err != nil {
+		return err
+	}
+	files := fm.packFiles()
+	if switched == 0 {
+		removeStoredObject(files.storage(), files.DataPath(compacted), false)
+	}
+	if live <= 0 && switched == len(moved) {
+		removeStoredObject(files.storage(), files.DataPath(container), false)
+	}
+	return nil
+}
+
+func (s *PackStore) isOpen(container string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.state.Open == container
+}
+
+// removeUnused removes container if no file is counted in it and files
+// aren't appended to it.
+func (s *PackStore) removeUnused(files *RSFileManager, container string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.state.Live[container] > 0 || s.state.Open == container {
+		if s.state.Open != container {
+			log.Warnf("Container %s counts %d files, but none was found", container, s.state.Live[container])
+		}
+		return
+	}
+	log.Infof("Removing unused container %s", container)
+	removeStoredObject(files.storage(), files.DataPath(container), false)
+}
+
+// removeUnused removes the chunk hash if no file counts a reference to
+// it, as left behind by a store cut short.
+func (s *ChunkStore) removeUnused(files *RSFileManager, hash string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.refs[hash] > 0 {
+		return
+	}
+	log.Infof("Removing unused chunk %s", hash)
+	removeStoredObject(files.storage(), files.DataPath(hash), false)
+}
+
+// compactHandler starts a compaction job.
+func (rs *RSBackupAPI) compactHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		rs.Errorf(r, "Bad method %s", r.Method)
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	job, err := rs.background().jobs.start("compact", rs.compact)
+	if err == errJobRunning {
+		rs.Errorf(r, "Compaction already running")
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	rs.writeJobStarted(w, r, job)
+}
+
+// StartCompactor starts a compaction job every interval until the server
+// is stopped, unless one is running already.
+func (rs *RSBackupAPI) StartCompactor(interval time.Duration) {
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+			_, err := rs.background().jobs.start("compact", rs.compact)
+			if err != nil {
+				log.Warnf("Skipping compaction: %s", err)
+			}
+		}
+	}()
+	rs.OnShutdown("compactor", func(ctx context.Context) error {
+		close(stop)
+		select {
+		case <-done:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	})
+}
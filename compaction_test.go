@@ -0,0 +1,88 @@
+package rsbackup
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestCompaction(t *testing.T) {
+	api := newTestPackAPI(t)
+	fm := api.RsFileMan
+	api.Config.TrashRetention = time.Hour
+	var err error
+	api.Trash, err = NewTrash(api.Config.StatePath("trash.json"), api.Config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fm.Chunks, err = NewChunkStore(api.Config.StatePath("chunks.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	contents := make(map[string][]byte)
+	for i := 0; i < 9; i++ {
+		fname := fmt.Sprintf("small%d", i)
+		contents[fname] = bytes.Repeat([]byte{byte('a' + i)}, 1000+i)
+		submitData(t, api, fname, contents[fname])
+	}
+	first := fm.packedInfo(fm.DataPath("small0")).Container
+	second := fm.packedInfo(fm.DataPath("small4")).Container
+	for _, fname := range []string{"small0", "small1", "small2"} {
+		if err := fm.Delete(fname, false, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	entry, err := api.Trash.Put(fm, "small4", "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Left behind by a store cut short.
+	if err := writeChunk(fm.chunkFiles(), "unused", []byte("unused")); err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(api.compactHandler).ServeHTTP(rr, httptest.NewRequest("POST", "/compact", nil))
+	var job Job
+	if rr.Code != http.StatusAccepted || json.NewDecoder(rr.Body).Decode(&job) != nil {
+		t.Fatalf("Got status code %d starting compaction", rr.Code)
+	}
+	job = waitForJob(t, api, job.ID)
+	if job.State != jobDone || len(job.Failed) != 0 || job.Total != 4 {
+		t.Fatalf("Got job %+v", job)
+	}
+
+	if _, err := os.Stat(fm.packFiles().DataPath(first)); !os.IsNotExist(err) {
+		t.Errorf("Got %v stating a compacted container", err)
+	}
+	compacted := fm.packedInfo(fm.DataPath("small3"))
+	if compacted.Container == first || compacted.Offset != 0 || fm.Packs.Files(compacted.Container) != 1 || fm.Packs.Files(first) != 0 {
+		t.Errorf("Got %+v after compaction", compacted)
+	}
+	if info := fm.packedInfo(fm.DataPath("small5")); info.Container != second || fm.Packs.Files(second) != 4 {
+		t.Errorf("Container in use was compacted, got %+v", info)
+	}
+	if _, err := fm.chunkFiles().Stat("unused"); !os.IsNotExist(err) {
+		t.Errorf("Got %v stating an unused chunk", err)
+	}
+
+	if err := api.Trash.Restore(fm, entry.ID, "small4"); err != nil {
+		t.Fatal(err)
+	}
+	for _, fname := range []string{"small3", "small4", "small8"} {
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(api.retrieveDataHandler).ServeHTTP(rr, httptest.NewRequest("GET", "/retrieve_data/"+fname, nil))
+		if !bytes.Equal(rr.Body.Bytes(), contents[fname]) {
+			t.Errorf("Got status code %d and %d bytes retrieving %s", rr.Code, rr.Body.Len(), fname)
+		}
+		health, _, _, err := fm.CheckData(fname)
+		if err != nil || !health {
+			t.Errorf("Got health %t for %s (error: %v)", health, fname, err)
+		}
+	}
+}
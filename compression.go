@@ -0,0 +1,252 @@
+package rsbackup
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const compressionZstd = "zstd"
+
+var errDecompressionAborted = errors.New("Decompression aborted")
+
+// CompressionInfo is recorded in the metadata of compressed files. The data
+// file holds the compressed contents, encrypted after compressing when
+// encryption is on, so parity covers what is actually stored.
+type CompressionInfo struct {
+	// Algorithm is the only one supported so far, "zstd".
+	Algorithm string
+	// Size is the size of the contents as submitted.
+	Size int64
+}
+
+// compressingReader reads the zstd compressed contents of src. Its
+// CompressionInfo is complete once it is closed.
+type compressingReader struct {
+	*io.PipeReader
+	info *CompressionInfo
+	done chan struct{}
+}
+
+func newCompressingReader(src io.Reader) *compressingReader {
+	pr, pw := io.Pipe()
+	c := &compressingReader{PipeReader: pr, info: &CompressionInfo{Algorithm: compressionZstd}, done: make(chan struct{})}
+	go func() {
+		defer close(c.done)
+		enc, err := zstd.NewWriter(pw)
+		if err == nil {
+			c.info.Size, err = io.Copy(enc, src)
+			if closeErr := enc.Close(); err == nil {
+				err = closeErr
+			}
+		}
+		pw.CloseWithError(err)
+	}()
+	return c
+}
+
+// Close stops compressing and waits until src is no longer read.
+func (c *compressingReader) Close() error {
+	c.PipeReader.Close()
+	<-c.done
+	return nil
+}
+
+// decompressingReader gives random access to the contents of a compressed
+// file. Seeking back starts decompressing from the beginning again and
+// seeking ahead decompresses up to there, so reading a range costs as much
+// as reading everything before it.
+type decompressingReader struct {
+	src  io.ReadSeeker
+	file io.Closer
+	size int64
+	pos  int64
+	dec  *zstd.Decoder
+	// at is the position of dec in the contents.
+	at int64
+}
+
+func (d *decompressingReader) Read(p []byte) (int, error) {
+	if d.pos >= d.size {
+		return 0, io.EOF
+	}
+	if d.dec == nil || d.at > d.pos {
+		_, err := d.src.Seek(0, io.SeekStart)
+		if err != nil {
+			return 0, err
+		}
+		if d.dec == nil {
+			d.dec, err = zstd.NewReader(d.src)
+		} else {
+			err = d.dec.Reset(d.src)
+		}
+		if err != nil {
+			return 0, err
+		}
+		d.at = 0
+	}
+	if d.at < d.pos {
+		n, err := io.CopyN(io.Discard, d.dec, d.pos-d.at)
+		d.at += n
+		if err != nil {
+			return 0, err
+		}
+	}
+	n, err := d.dec.Read(p)
+	d.at += int64(n)
+	d.pos += int64(n)
+	return n, err
+}
+
+func (d *decompressingReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += d.pos
+	case io.SeekEnd:
+		offset += d.size
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("Negative position %d", offset)
+	}
+	d.pos = offset
+	return offset, nil
+}
+
+func (d *decompressingReader) Close() error {
+	if d.dec != nil {
+		d.dec.Close()
+	}
+	return d.file.Close()
+}
+
+// decompressingWriter decompresses the size bytes of compressed contents
+// written to it and passes them on to w.
+type decompressingWriter struct {
+	pw        *io.PipeWriter
+	remaining int64
+	done      chan error
+}
+
+func newDecompressingWriter(w io.Writer, size int64) *decompressingWriter {
+	pr, pw := io.Pipe()
+	d := &decompressingWriter{pw: pw, remaining: size, done: make(chan error, 1)}
+	go func() {
+		dec, err := zstd.NewReader(pr)
+		if err == nil {
+			_, err = io.Copy(w, dec)
+			dec.Close()
+		}
+		pr.CloseWithError(err)
+		d.done <- err
+	}()
+	return d
+}
+
+func (d *decompressingWriter) Write(p []byte) (int, error) {
+	if int64(len(p)) > d.remaining {
+		return 0, fmt.Errorf("Compressed contents longer than expected")
+	}
+	n, err := d.pw.Write(p)
+	d.remaining -= int64(n)
+	if err == nil && d.remaining == 0 {
+		d.pw.Close()
+		err = <-d.done
+	}
+	return n, err
+}
+
+// Close gives up on contents that weren't written completely.
+func (d *decompressingWriter) Close() error {
+	if d.remaining == 0 {
+		return nil
+	}
+	d.pw.CloseWithError(errDecompressionAborted)
+	d.remaining = 0
+	<-d.done
+	return nil
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+// openContents opens fname for reading the contents as they were
+// submitted, decrypting, decompressing, reassembling them from chunks and
+// filling in holes as needed. It also returns their size.
+func (r *RSFileManager) openContents(fname string) (io.ReadSeeker, io.Closer, int64, error) {
+	content, file, size, err := r.openPlaintext(fname)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	extras, err := r.ReadExtras(r.DataPath(fname))
+	if err != nil {
+		// Files stored without metadata, e.g. mid submission, are served
+		// as they are like openPlaintext does.
+		return content, file, size, nil
+	}
+	if extras.Compression != nil {
+		d := &decompressingReader{src: content, file: file, size: extras.Compression.Size}
+		content, file, size = d, d, d.size
+	}
+	if extras.Dedup != nil {
+		manifest, err := decodeManifest(content)
+		file.Close()
+		if err != nil {
+			return nil, nil, 0, err
+		}
+		c := newChunkedReader(r.chunkFiles(), manifest)
+		content, file, size = c, c, c.size
+	}
+	if extras.Sparse != nil {
+		content, size = newSparseReader(content, extras.Sparse), extras.Sparse.Size
+	}
+	return content, file, size, nil
+}
+
+// contentsWriter is like plaintextWriter, but also decompresses,
+// reassembles chunks and fills in holes. The returned writer must be
+// closed.
+func (r *RSFileManager) contentsWriter(w io.Writer, fname string, storedSize int64) (io.WriteCloser, int64, error) {
+	extras, err := r.ReadExtras(r.DataPath(fname))
+	if err != nil {
+		return nil, 0, err
+	}
+	plainSize := storedSize
+	if extras.Encryption != nil {
+		plainSize = extras.Encryption.Size
+	}
+	size := plainSize
+	if extras.Compression != nil {
+		size = extras.Compression.Size
+	}
+	if extras.Sparse != nil {
+		w = &sparseWriter{w: w, info: extras.Sparse}
+	}
+	if extras.Dedup != nil {
+		w = &manifestWriter{files: r.chunkFiles(), w: w, remaining: size}
+		size = extras.Dedup.Size
+	}
+	var closer io.Closer = nopWriteCloser{}
+	if extras.Compression != nil {
+		decompressing := newDecompressingWriter(w, plainSize)
+		w, closer = decompressing, decompressing
+	}
+	dst, _, err := r.plaintextWriter(w, fname, storedSize)
+	if err != nil {
+		closer.Close()
+		return nil, 0, err
+	}
+	if extras.Sparse != nil {
+		size = extras.Sparse.Size
+	}
+	return struct {
+		io.Writer
+		io.Closer
+	}{dst, closer}, size, nil
+}
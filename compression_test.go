@@ -0,0 +1,102 @@
+package rsbackup
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestCompressedStorage(t *testing.T) {
+	for _, encrypted := range []bool{false, true} {
+		tmpDir := createTMPDir(t, "rsbackup")
+		config := &Config{BackupRoot: tmpDir, DataShards: 2, ParityShards: 1, Compression: "zstd"}
+		fm := &RSFileManager{Config: config}
+		if encrypted {
+			keyPath := path.Join(tmpDir, "master.key")
+			err := ioutil.WriteFile(keyPath, []byte(strings.Repeat("ab", 32)), 0600)
+			if err != nil {
+				t.Fatal(err)
+			}
+			config.EncryptionKeys = map[string]string{"2026": keyPath}
+			config.EncryptionKeyID = "2026"
+			fm.Keys, err = NewKeyRing(config, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		api := &RSBackupAPI{Config: config, RsFileMan: fm}
+		data := []byte(strings.Repeat("INSERT INTO logs VALUES ('tyger tyger burning bright');\n", 4000))
+
+		body := new(bytes.Buffer)
+		mw := multipart.NewWriter(body)
+		fw, _ := mw.CreateFormFile("file", "dump.sql")
+		fw.Write(data)
+		mw.WriteField("filename", "dump.sql")
+		mw.Close()
+		req := httptest.NewRequest("POST", "/submit_data", body)
+		req.Header.Set("Content-Type", mw.FormDataContentType())
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(api.submitDataHandler).ServeHTTP(rr, req)
+		var rsp submitDataRsp
+		if rr.Code != 200 || json.NewDecoder(rr.Body).Decode(&rsp) != nil || rsp.Size != int64(len(data)) {
+			t.Fatalf("Got status code %d and size %d", rr.Code, rsp.Size)
+		}
+
+		fpath := fm.DataPath("dump.sql")
+		extras, err := fm.ReadExtras(fpath)
+		if err != nil || extras.Compression == nil || extras.Compression.Algorithm != "zstd" || extras.Compression.Size != int64(len(data)) {
+			t.Fatalf("Got compression info %+v, %v", extras.Compression, err)
+		}
+		if (extras.Encryption != nil) != encrypted {
+			t.Errorf("Got encryption info %+v", extras.Encryption)
+		}
+
+		retrieve := func(url, rangeHeader string) *httptest.ResponseRecorder {
+			req := httptest.NewRequest("GET", url, nil)
+			if rangeHeader != "" {
+				req.Header.Set("Range", rangeHeader)
+			}
+			rr := httptest.NewRecorder()
+			http.HandlerFunc(api.retrieveDataHandler).ServeHTTP(rr, req)
+			return rr
+		}
+		if rr := retrieve("/retrieve_data/dump.sql", ""); rr.Code != 200 || !bytes.Equal(rr.Body.Bytes(), data) {
+			t.Errorf("Got status code %d and %d bytes, expected the %d bytes submitted", rr.Code, rr.Body.Len(), len(data))
+		}
+		if rr := retrieve("/retrieve_data/dump.sql", "bytes=150000-150099"); rr.Code != 206 || !bytes.Equal(rr.Body.Bytes(), data[150000:150100]) {
+			t.Errorf("Got status code %d for a range, %q", rr.Code, rr.Body.Bytes())
+		}
+		if rr := retrieve("/retrieve_data/dump.sql", "bytes=10-19"); rr.Code != 206 || !bytes.Equal(rr.Body.Bytes(), data[10:20]) {
+			t.Errorf("Got status code %d for a range before the last one, %q", rr.Code, rr.Body.Bytes())
+		}
+
+		// Parity covers the compressed file, reconstruction decompresses.
+		stored, err := ioutil.ReadFile(fpath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stored[10] ^= 0xff
+		err = ioutil.WriteFile(fpath, stored, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr = retrieve("/retrieve_data/dump.sql?verify=true", "")
+		if rr.Header().Get("Reconstructed") != "true" || rr.Header().Get("Content-Length") != strconv.Itoa(len(data)) || !bytes.Equal(rr.Body.Bytes(), data) {
+			t.Errorf("Got status code %d and %d bytes for a damaged file", rr.Code, rr.Body.Len())
+		}
+		err = fm.RepairData("dump.sql")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rr := retrieve("/retrieve_data/dump.sql", ""); !bytes.Equal(rr.Body.Bytes(), data) {
+			t.Errorf("Repaired file doesn't decompress to the submitted data")
+		}
+	}
+}
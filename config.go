@@ -0,0 +1,894 @@
+package rsbackup
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// stateDirName is the directory under BackupRoot holding server state,
+// like share links. It is never listed or served as backup data.
+const stateDirName = ".rsbackup"
+
+type Config struct {
+	BackupRoot   string
+	DataShards   int
+	ParityShards int
+	// ShardSize, when set, splits each file into data shards of at most
+	// that size instead of DataShards, with parity shards in proportion.
+	// Files record their own shard counts.
+	ShardSize Size
+	// ShardBands, when set, pick the shard counts of each file by its
+	// size, from the first band it fits in. Files larger than every band
+	// get DataShards and ParityShards.
+	ShardBands []ShardBand
+	// ReplicationThreshold replicates files of the default storage class
+	// smaller than it instead of splitting them into shards, with Replicas
+	// copies, as many as ParityShards by default. 0 disables it, clients
+	// can still ask for replicas per file.
+	ReplicationThreshold Size
+	Replicas             int
+	// SegmentSize, when set, hashes files larger than it in segments of
+	// about that size, so checks find damage down to a segment and
+	// repairs only rebuild the damaged segments. A repair holds one
+	// segment and its parity in memory.
+	SegmentSize Size
+	// BlockSize, when set, hashes each shard in blocks of at most that
+	// size too, so checks tell where a shard is damaged and repairs only
+	// rebuild the damaged blocks, like segments.
+	BlockSize Size
+	// DeferParity answers submits as soon as the data file is stored and
+	// read back against its hash, and generates the parity in a
+	// background job. Files have no redundancy until the job gets to
+	// them, queued in parity_queue.json in the state directory.
+	DeferParity bool
+	// Fsync decides how stored files are flushed to disk before they are
+	// renamed into place from their staging name: "file" (the default)
+	// syncs each file, "full" also syncs the directory it's renamed in so
+	// the rename survives a power loss, and "off" leaves both to the OS.
+	Fsync string
+	// FileMode and DirMode are the permissions of stored files and the
+	// directories holding them on local disks, "0644" and "0755" if unset.
+	FileMode Mode
+	DirMode  Mode
+	// FileOwner and FileGroup hand stored files on local disks to a user
+	// and group, by name or id, which takes running as root.
+	FileOwner    string
+	FileGroup    string
+	Address      string
+	HttpCertPath string
+	HttpKeyPath  string
+	// TLSMinVersion is the oldest TLS version accepted, "1.2" (the
+	// default) or "1.3". TLSCipherSuites restricts the TLS 1.2 cipher
+	// suites to these, by their Go names like
+	// "TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384"; TLS 1.3 suites can't be
+	// chosen. TLSCurves orders the key exchange curves, from X25519, P256,
+	// P384 and P521.
+	TLSMinVersion   string
+	TLSCipherSuites []string
+	TLSCurves       []string
+	// ACMEHosts, when set, are the hostnames certificates are obtained and
+	// renewed for from an ACME CA, instead of read from HttpCertPath and
+	// HttpKeyPath. The CA is Let's Encrypt unless ACMEDirectoryURL names
+	// another one, and ACMEEmail is given to it for expiry notices.
+	// Challenges are answered via TLS-ALPN-01 on Address, which the CA
+	// reaches on port 443, and via HTTP-01 on ACMEHTTPAddress, like ":80",
+	// if set.
+	ACMEHosts        []string
+	ACMEEmail        string
+	ACMEDirectoryURL string
+	ACMEHTTPAddress  string
+	// HSTSMaxAge is how long browsers are told to only use HTTPS for the
+	// server via Strict-Transport-Security, 0 omits the header. With
+	// HSTSIncludeSubdomains the same goes for every subdomain.
+	HSTSMaxAge            time.Duration
+	HSTSIncludeSubdomains bool
+
+	// AuthTokens maps names to secrets of static API tokens, AdminTokens
+	// does the same for tokens that can also manage other tokens.
+	AuthTokens  map[string]string
+	AdminTokens map[string]string
+	// TokenScopes restricts AuthTokens, by name, to a subset of the "read",
+	// "write" and "repair" scopes.
+	TokenScopes map[string][]string
+	// AuthDisabled turns off authentication entirely.
+	AuthDisabled bool
+	// OIDCIssuer enables authentication with JWTs issued by this OpenID
+	// Connect provider. Keys are fetched from OIDCJWKSURL, or discovered
+	// from the issuer when it is empty. Tokens must be issued for
+	// OIDCAudience, which is required: an issuer signs tokens for every
+	// client it serves.
+	OIDCIssuer   string
+	OIDCJWKSURL  string
+	OIDCAudience string
+	// OIDCRoleClaim is the claim holding a JWT's roles, nested claims are
+	// written like "realm_access.roles". OIDCAdminRoles grant admin access,
+	// OIDCUserRoles the read, write and repair scopes, and OIDCRoleScopes
+	// maps roles to the scopes they grant. JWTs without a mapped role get
+	// no access.
+	OIDCRoleClaim  string
+	OIDCAdminRoles []string
+	OIDCUserRoles  []string
+	OIDCRoleScopes map[string][]string
+	// HtpasswdPath enables HTTP Basic auth for the users in this htpasswd
+	// file, which is reloaded on SIGHUP. Users in HtpasswdAdmins get admin
+	// access.
+	HtpasswdPath   string
+	HtpasswdAdmins []string
+	// LDAPURL enables HTTP Basic auth against an LDAP or Active Directory
+	// server, like "ldaps://ldap.example.com". Users are found below
+	// LDAPBaseDN with LDAPUserFilter, "(uid=%s)" by default, using the
+	// LDAPBindDN service account if set. Membership in LDAPAdminGroups
+	// grants admin access, in LDAPUserGroups the read, write and repair
+	// scopes, and LDAPGroupScopes maps groups to the scopes they grant.
+	// Groups are given as DNs or common names, and users in none get no
+	// access.
+	LDAPURL          string
+	LDAPStartTLS     bool
+	LDAPBaseDN       string
+	LDAPUserFilter   string
+	LDAPBindDN       string
+	LDAPBindPassword string
+	LDAPAdminGroups  []string
+	LDAPUserGroups   []string
+	LDAPGroupScopes  map[string][]string
+	// TrustedAgents names the tokens allowed to submit shards and parity
+	// they computed themselves. With authentication disabled, any client
+	// may do so as long as the list isn't empty.
+	TrustedAgents []string
+
+	// TrustedProxies lists the networks of reverse proxies whose
+	// X-Forwarded-For header tells the client address.
+	TrustedProxies []string
+	// AllowedNetworks, if set, are the only networks served, and
+	// DeniedNetworks are never served. Both are CIDRs, like "10.0.0.0/8".
+	// The Admin variants apply to the admin endpoints instead.
+	AllowedNetworks      []string
+	DeniedNetworks       []string
+	AdminAllowedNetworks []string
+	AdminDeniedNetworks  []string
+
+	// RateLimitRequests is the number of requests per second each client,
+	// a credential or else an address, may make to the data endpoints,
+	// with bursts of up to RateLimitBurst. RateLimitBandwidth caps the
+	// bytes per second a client uploads and downloads together. 0
+	// disables each limit.
+	RateLimitRequests  float64
+	RateLimitBurst     int
+	RateLimitBandwidth Rate
+
+	// AuditMaxSize is the size at which the audit log is rotated, 64MiB
+	// by default. AuditMaxFiles rotated files are kept, 10 by default.
+	AuditMaxSize  Size
+	AuditMaxFiles int
+
+	// Immutable makes every stored file immutable: it can't be deleted or
+	// renamed, and as ever, not overwritten. Without it only files
+	// submitted with immutable=true are. Immutable files are unlocked
+	// ImmutableRetention after they were stored, 0 keeps them locked.
+	Immutable          bool
+	ImmutableRetention time.Duration
+	// TrashRetention is how long deleted files are kept in the trash, where
+	// they can be restored from, before they're purged. 0 deletes them
+	// right away.
+	TrashRetention time.Duration
+	// ConfirmDeletes makes deletes take two requests: the first answers
+	// with a token, and the file is only deleted when the request is
+	// repeated with it as confirm within a minute.
+	ConfirmDeletes bool
+	// ShredDeletes overwrites every deleted file before it's unlinked, as
+	// if each delete asked for shred.
+	ShredDeletes bool
+
+	// ShutdownTimeout is how long in-flight requests may take to finish
+	// when the server is stopped before they are aborted.
+	ShutdownTimeout time.Duration
+
+	// MaxUploadSize is the largest request body accepted by submit_data,
+	// 0 means no limit.
+	MaxUploadSize Size
+	// UploadMemoryBuffer is how much of an upload is buffered in memory
+	// before spilling to a temporary file. Only uploads whose file comes
+	// before their filename are buffered, others are streamed to storage.
+	UploadMemoryBuffer Size
+	// StagingDir holds uploads while they're received: the temporary
+	// files they spill to, and shards and bundles until they're checked.
+	// It's "staging" in the state directory if unset, and needn't be on
+	// the disk of BackupRoot.
+	StagingDir string
+	// StagingMaxAge is how long what crashed or aborted uploads left
+	// behind is kept before it's removed, 0 keeps it.
+	StagingMaxAge time.Duration
+	// CacheMemory is how many bytes of recently retrieved files are kept
+	// in memory, and CacheDirSize how many are kept in CacheDir, best a
+	// local SSD in front of remote storage. Files larger than
+	// CacheMaxObject, 64MiB by default, aren't cached. Files that
+	// retrievals with verify=true found intact aren't checked again for
+	// CacheVerifiedFor, 10 minutes by default, negative to always check.
+	CacheMemory      Size
+	CacheDir         string
+	CacheDirSize     Size
+	CacheMaxObject   Size
+	CacheVerifiedFor time.Duration
+
+	// IdempotencyTTL is how long the result of a request carrying an
+	// Idempotency-Key header is kept for replay.
+	IdempotencyTTL time.Duration
+	// IdempotencyMaxKeys bounds the number of cached idempotent results.
+	IdempotencyMaxKeys int
+
+	// ShareDefaultTTL is the lifetime of share links created without a ttl.
+	ShareDefaultTTL time.Duration
+
+	// ScrubInterval is the time between background checks of every stored
+	// file, 0 disables them.
+	ScrubInterval time.Duration
+	// ScrubSampleRate, when set, has scrubs check only that fraction,
+	// between 0 and 1, of the blocks of each file, picked anew every
+	// time, or of its stripes for files not hashed in blocks. Every
+	// DeepScrubEvery-th scrub since the start, the 10th by default, still
+	// checks all of every file.
+	ScrubSampleRate float64
+	DeepScrubEvery  int
+
+	// ReadSampleRate is the fraction of stripes, between 0 and 1, checked
+	// against their parity whenever a file is retrieved without verify.
+	ReadSampleRate float64
+
+	// Tunables limit the background work: ScrubWorkers files are checked
+	// at once by a scrub (1 by default), reading at most ScrubReadRate
+	// bytes and ScrubIOPS operations per second (no limit by default);
+	// jobs like compaction and tiering are paced to the same caps.
+	// SampleWorkers read samples run at once (1 by default) with up to
+	// SampleQueue more waiting (64 by default), further samples are
+	// skipped. RepairWorkers repairs run at once (one per CPU by default)
+	// with up to RepairQueue more waiting (16 by default), further repair
+	// requests get a 503, paced to RepairReadRate and RepairIOPS.
+	// IngestWorkers uploads are received at once (no limit by default)
+	// with up to IngestQueue more waiting (16 by default), further
+	// uploads get a 503 too. All of them can be changed while the server
+	// runs through /background.
+	Tunables
+
+	// RestoreWorkers is the number of stripes decoded in parallel when
+	// serving degraded data, 0 means one per CPU.
+	RestoreWorkers int
+	// EncodeWorkers is the number of stripes encoded in parallel when
+	// computing the parity of a stored file, 0 means one per CPU the Go
+	// runtime uses.
+	EncodeWorkers int
+	// ErasureCoding picks the Reed-Solomon code: "simd", the default, uses
+	// the vector instructions of the CPU, "generic" plain Go code. Both
+	// compute the same shards.
+	ErasureCoding string
+	// Codec names the codec new files are encoded with, "reed-solomon"
+	// by default, see RegisterCodec. Stored files keep theirs.
+	Codec string
+	// ShardHash is the algorithm the shards of new files are hashed with:
+	// "sha256", the default, "sha512" or "blake3", the fastest to scrub.
+	// Stored files keep theirs.
+	ShardHash string
+
+	// EncryptionKeys maps key IDs to files, or Vault secrets, holding a 32
+	// byte master key, hex encoded. With EncryptionKeyID set, new files are encrypted with
+	// a data key of their own wrapped by that master key. Files record the
+	// ID of their key, so retired keys must stay listed for as long as
+	// files use them.
+	EncryptionKeys  map[string]string
+	EncryptionKeyID string
+
+	// Compression, when "zstd", compresses new files before they are
+	// encrypted and split into shards. Files record whether they are
+	// compressed, so it can be turned off again at any time.
+	Compression string
+	// Dedup splits new files into chunks of about DedupChunkSize bytes, 1
+	// MiB by default, cut where their contents say so. Each chunk is only
+	// stored once, with its own parity, however many files contain it.
+	Dedup          bool
+	DedupChunkSize Size
+	// MetadataIndex keeps the metadata of files in index.db in the state
+	// directory, so listings don't read every metadata file.
+	MetadataIndex bool
+	// ConsistencyScan looks for data files without metadata, metadata
+	// without data, missing parity shards and leftovers of uploads on
+	// startup, and reports them at /consistency.
+	ConsistencyScan bool
+	// Sparse leaves runs of zeros, in blocks of 64KiB, out of new files
+	// and records where they were instead, so holes of sparse files take
+	// neither disk space nor parity.
+	Sparse bool
+	// PackThreshold packs new files whose stored contents are no larger
+	// into shared containers of up to PackSize bytes, 8MiB by default,
+	// instead of giving each its own parity. 0 disables packing.
+	PackThreshold Size
+	PackSize      Size
+	// SinglePassBuffer caps the memory taken by the parity of a file
+	// computed while it's received, 64MiB by default. The parity of larger
+	// files, and of those stored other than as received, is computed by
+	// reading them again once they're saved.
+	SinglePassBuffer Size
+	// ReadBufferSize is the size of the reads made of stored files served
+	// other than as they are, such as encrypted or compressed ones, and
+	// WriteBufferSize that of the writes of uploads to storage, both 32KiB
+	// by default. Files stored as they are are sent with sendfile.
+	ReadBufferSize  Size
+	WriteBufferSize Size
+	// CompactionInterval is the time between background compactions,
+	// which rewrite containers once less than CompactionThreshold of
+	// their bytes, 0.5 by default, belong to files still stored, and
+	// remove the containers and chunks no file uses. 0 disables them.
+	CompactionInterval  time.Duration
+	CompactionThreshold float64
+
+	// VaultAddr, like "https://vault:8200", lets EncryptionKeys,
+	// HttpCertPath and HttpKeyPath refer to secrets in Vault as
+	// "vault:path#field", eg. "vault:secret/data/rsbackup#master_key".
+	// The Vault token is read from VaultTokenPath, or else the VAULT_TOKEN
+	// environment variable. Secrets, from Vault or files, are fetched again
+	// every SecretRefresh, 0 disables refreshing.
+	VaultAddr      string
+	VaultTokenPath string
+	SecretRefresh  time.Duration
+
+	// Quotas limits the bytes, data and parity, that each namespace may
+	// store. A file's namespace is the name of the credential that stored
+	// it. DefaultQuota applies to namespaces not listed, 0 means no limit.
+	Quotas       map[string]Size
+	DefaultQuota Size
+	// MaxStorageSize caps the bytes, data and parity of every namespace
+	// and whatever else is kept in storage, stored under BackupRoot.
+	// Submissions past it are refused like those that don't fit on disk.
+	// 0 means no cap.
+	MaxStorageSize Size
+
+	// FetchEnabled serves submit_url, which has the server download files
+	// from urls clients give. Loopback, private and link-local addresses
+	// are never fetched from, unless they're in FetchAllowedNetworks,
+	// CIDRs like "10.1.2.0/24".
+	FetchEnabled         bool
+	FetchAllowedNetworks []string
+	// FetchTimeout bounds downloads done for submit_url requests.
+	FetchTimeout time.Duration
+	// FetchMaxSize is the largest file submit_url will download, 0 means
+	// no limit.
+	FetchMaxSize Size
+
+	// SFTPURL, like "sftp://user@host/backups", names a remote directory
+	// every stored file is copied to. SFTPKeyPath is the SSH private key
+	// to log in with and the host key must be listed in
+	// SFTPKnownHostsPath. Copies share SFTPConnections connections, 2 by
+	// default, and are attempted SFTPRetries more times on failure, 3 by
+	// default.
+	SFTPURL            string
+	SFTPKeyPath        string
+	SFTPKnownHostsPath string
+	SFTPConnections    int
+	SFTPRetries        int
+	// SFTPQueue is the number of files waiting to be mirrored before
+	// storing more files blocks, 1024 by default.
+	SFTPQueue int
+	// SFTPStorageURL stores files in a remote directory, named like
+	// SFTPURL, instead of under BackupRoot, which still holds the server
+	// state. It logs in with the same key and known hosts.
+	SFTPStorageURL string
+
+	// GCSBucket stores files in a Google Cloud Storage bucket, object
+	// names starting with GCSPrefix, instead of under BackupRoot, which
+	// still holds the server state. GCSCredentialsPath is a service
+	// account key file, without it the service account of the VM is used.
+	GCSBucket          string
+	GCSPrefix          string
+	GCSCredentialsPath string
+
+	// B2Bucket stores files in a Backblaze B2 bucket instead, object names
+	// starting with B2Prefix. B2KeyID is the ID of an application key,
+	// the key itself is read from B2ApplicationKeyPath.
+	B2Bucket             string
+	B2Prefix             string
+	B2KeyID              string
+	B2ApplicationKeyPath string
+
+	// ShardRoots spreads the files over these directories, each on its own
+	// disk, instead of keeping them under BackupRoot, which still holds the
+	// server state. The data and parity shards of a file are placed on
+	// different disks, metadata is copied to all of them.
+	ShardRoots []string
+
+	// StorageTargets names places files can be stored besides BackupRoot,
+	// Placement rules pick which of them hold the data, parity and
+	// metadata of a file, the first matching rule wins. Files no rule
+	// matches stay under BackupRoot.
+	StorageTargets map[string]StorageTarget
+	Placement      []PlacementRule
+	// ColdTarget names the storage target the data and parity of files
+	// are moved to once they weren't retrieved for ColdAfter. Retrieving
+	// a file moves it back.
+	ColdTarget string
+	ColdAfter  time.Duration
+	// StorageClasses lets clients pick, by name, other shard counts than
+	// DataShards and ParityShards for the files they submit. Placement
+	// rules with the name as Class place those files.
+	StorageClasses map[string]StorageClass
+
+	// Lifecycle rules expire, thin out and move to the cold tier the files
+	// they match, every LifecycleInterval. With LifecycleDryRun that is
+	// only logged.
+	Lifecycle         []LifecycleRule
+	LifecycleInterval time.Duration
+	LifecycleDryRun   bool
+}
+
+// StatePath returns the path of the server state file called name.
+func (c *Config) StatePath(name string) string {
+	return path.Join(c.BackupRoot, stateDirName, name)
+}
+
+// StagingPath returns the directory uploads are received in.
+func (c *Config) StagingPath() string {
+	if c.StagingDir != "" {
+		return c.StagingDir
+	}
+	return c.StatePath("staging")
+}
+
+// Chroot rewrites BackupRoot, and every file the server reads, to the
+// paths they have once the process is chrooted into BackupRoot. Files
+// outside BackupRoot would be out of reach, so they are an error. Vault
+// secrets are left alone.
+func (c *Config) Chroot() error {
+	root, err := filepath.Abs(c.BackupRoot)
+	if err != nil {
+		return err
+	}
+	rebase := func(fpath *string) {
+		if *fpath == "" || strings.HasPrefix(*fpath, vaultPrefix) || err != nil {
+			return
+		}
+		abs, absErr := filepath.Abs(*fpath)
+		rel, relErr := filepath.Rel(root, abs)
+		if absErr != nil || relErr != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+			err = fmt.Errorf("'%s' is outside of BackupRoot, it can't be read after chrooting", *fpath)
+			return
+		}
+		*fpath = path.Join("/", rel)
+	}
+	for _, fpath := range []*string{&c.HttpCertPath, &c.HttpKeyPath, &c.HtpasswdPath, &c.VaultTokenPath, &c.SFTPKeyPath, &c.SFTPKnownHostsPath, &c.GCSCredentialsPath, &c.B2ApplicationKeyPath, &c.StagingDir, &c.CacheDir} {
+		rebase(fpath)
+	}
+	for i := range c.ShardRoots {
+		rebase(&c.ShardRoots[i])
+	}
+	targets := make(map[string]StorageTarget, len(c.StorageTargets))
+	for name, target := range c.StorageTargets {
+		rebase(&target.Dir)
+		roots := make([]string, len(target.ShardRoots))
+		for i := range roots {
+			roots[i] = target.ShardRoots[i]
+			rebase(&roots[i])
+		}
+		target.ShardRoots = roots
+		targets[name] = target
+	}
+	keys := make(map[string]string, len(c.EncryptionKeys))
+	for id, ref := range c.EncryptionKeys {
+		rebase(&ref)
+		keys[id] = ref
+	}
+	if err != nil {
+		return err
+	}
+	c.EncryptionKeys = keys
+	if c.StorageTargets != nil {
+		c.StorageTargets = targets
+	}
+	c.BackupRoot = "/"
+	return nil
+}
+
+func (c *Config) validatePlacement() error {
+	for name, target := range c.StorageTargets {
+		if name == "" {
+			return fmt.Errorf("StorageTargets need a name")
+		}
+		kinds := 0
+		for _, setting := range []string{target.Dir, target.SFTPURL, target.GCSBucket, target.B2Bucket} {
+			if setting != "" {
+				kinds++
+			}
+		}
+		if len(target.ShardRoots) > 0 {
+			kinds++
+		}
+		if kinds != 1 {
+			return fmt.Errorf("Storage target '%s' needs exactly one of Dir, ShardRoots, SFTPURL, GCSBucket and B2Bucket", name)
+		}
+		if target.B2Bucket != "" && (c.B2KeyID == "" || c.B2ApplicationKeyPath == "") {
+			return fmt.Errorf("Storage target '%s' needs B2KeyID and B2ApplicationKeyPath", name)
+		}
+	}
+	for name, class := range c.StorageClasses {
+		if name == "" {
+			return fmt.Errorf("StorageClasses need a name")
+		}
+		if class.DataShards < 1 || class.ParityShards < 1 || class.DataShards+class.ParityShards > 256 {
+			return fmt.Errorf("Storage class '%s' needs at least one data and parity shard, and at most 256 shards", name)
+		}
+	}
+	for _, rule := range c.Placement {
+		if _, err := path.Match(rule.Files, ""); err != nil {
+			return fmt.Errorf("Bad placement pattern '%s': %s", rule.Files, err)
+		}
+		if _, ok := c.StorageClasses[rule.Class]; rule.Class != "" && !ok {
+			return fmt.Errorf("Placement uses unknown storage class '%s'", rule.Class)
+		}
+		for _, target := range append([]string{rule.Data, rule.Metadata}, rule.Parity...) {
+			if _, ok := c.StorageTargets[target]; target != "" && !ok {
+				return fmt.Errorf("Placement uses unknown storage target '%s'", target)
+			}
+		}
+	}
+	return nil
+}
+
+func (c *Config) validateLifecycle() error {
+	if c.LifecycleInterval < 0 {
+		return fmt.Errorf("LifecycleInterval must not be negative")
+	}
+	for i, rule := range c.Lifecycle {
+		if rule.ExpireAfter < 0 || rule.ColdAfter < 0 || rule.KeepLatest < 0 {
+			return fmt.Errorf("Lifecycle rule %d has negative values", i)
+		}
+		if rule.ExpireAfter == 0 && rule.ColdAfter == 0 && rule.KeepLatest == 0 {
+			return fmt.Errorf("Lifecycle rule %d needs one of ExpireAfter, ColdAfter and KeepLatest", i)
+		}
+		if rule.ColdAfter > 0 && c.ColdTarget == "" {
+			return fmt.Errorf("Lifecycle rule %d needs ColdTarget for ColdAfter", i)
+		}
+	}
+	return nil
+}
+
+func (c *Config) dedupChunkSize() int {
+	if c.DedupChunkSize > 0 {
+		return int(c.DedupChunkSize)
+	}
+	return defaultDedupChunkSize
+}
+
+func (c *Config) singlePassBuffer() int64 {
+	if c.SinglePassBuffer > 0 {
+		return int64(c.SinglePassBuffer)
+	}
+	return defaultSinglePassBuffer
+}
+
+func (c *Config) readBufferSize() int {
+	if c.ReadBufferSize > 0 {
+		return int(c.ReadBufferSize)
+	}
+	return defaultIOBufferSize
+}
+
+func (c *Config) writeBufferSize() int {
+	if c.WriteBufferSize > 0 {
+		return int(c.WriteBufferSize)
+	}
+	return defaultIOBufferSize
+}
+
+func (c *Config) packSize() Size {
+	if c.PackSize > 0 {
+		return c.PackSize
+	}
+	return defaultPackSize
+}
+
+func (c *Config) compactionThreshold() float64 {
+	if c.CompactionThreshold > 0 {
+		return c.CompactionThreshold
+	}
+	return defaultCompactionThreshold
+}
+
+func isReservedName(name string) bool {
+	return name == stateDirName || name == chunkDirName || name == packDirName || isStagingName(name)
+}
+
+// redactedSecret replaces secrets in configs that are printed.
+const redactedSecret = "<redacted>"
+
+// plainConfig formats like Config, without the redaction.
+type plainConfig Config
+
+// redacted returns a copy of c with the secrets of tokens and the LDAP bind
+// password replaced.
+func (c Config) redacted() plainConfig {
+	for _, tokens := range []*map[string]string{&c.AuthTokens, &c.AdminTokens} {
+		if *tokens == nil {
+			continue
+		}
+		masked := make(map[string]string, len(*tokens))
+		for name := range *tokens {
+			masked[name] = redactedSecret
+		}
+		*tokens = masked
+	}
+	if c.LDAPBindPassword != "" {
+		c.LDAPBindPassword = redactedSecret
+	}
+	return plainConfig(c)
+}
+
+// String formats c with its secrets redacted, so it can be logged.
+func (c Config) String() string {
+	return fmt.Sprintf("%+v", c.redacted())
+}
+
+// GoString is String for %#v.
+func (c Config) GoString() string {
+	return strings.Replace(fmt.Sprintf("%#v", c.redacted()), "plainConfig", "Config", 1)
+}
+
+// Validate checks the config for values the server cannot work with.
+func (c *Config) Validate() error {
+	if c.BackupRoot == "" {
+		return fmt.Errorf("BackupRoot must be set")
+	}
+	if c.DataShards < 1 || c.ParityShards < 1 {
+		return fmt.Errorf("Need at least 1 data and 1 parity shard, got %d and %d", c.DataShards, c.ParityShards)
+	}
+	if c.ShardSize < 0 || (c.ShardSize > 0 && c.ShardSize < 4<<10) {
+		return fmt.Errorf("ShardSize must be at least 4KiB")
+	}
+	if len(c.ShardBands) > 0 && c.ShardSize > 0 {
+		return fmt.Errorf("ShardBands and ShardSize can't be used together")
+	}
+	if c.SegmentSize < 0 || (c.SegmentSize > 0 && c.SegmentSize < 1<<20) {
+		return fmt.Errorf("SegmentSize must be at least 1MiB")
+	}
+	if c.BlockSize < 0 || (c.BlockSize > 0 && c.BlockSize < 64<<10) {
+		return fmt.Errorf("BlockSize must be at least 64KiB")
+	}
+	if c.ReplicationThreshold < 0 || c.Replicas < 0 || c.Replicas > 255 {
+		return fmt.Errorf("ReplicationThreshold can't be negative, and Replicas must be at most 255")
+	}
+	for i, band := range c.ShardBands {
+		if band.DataShards < 1 || band.ParityShards < 1 || band.DataShards+band.ParityShards > 256 {
+			return fmt.Errorf("Shard band %d needs at least one data and parity shard, and at most 256 shards", i)
+		}
+		if band.UpTo < 0 || (i > 0 && (c.ShardBands[i-1].UpTo == 0 || band.UpTo != 0 && band.UpTo <= c.ShardBands[i-1].UpTo)) {
+			return fmt.Errorf("Shard bands must be in ascending order of UpTo, with an unbounded band last")
+		}
+	}
+	if c.DataShards+c.ParityShards > 256 {
+		return fmt.Errorf("At most 256 shards are supported, got %d", c.DataShards+c.ParityShards)
+	}
+	for _, networks := range [][]string{c.TrustedProxies, c.AllowedNetworks, c.DeniedNetworks, c.AdminAllowedNetworks, c.AdminDeniedNetworks, c.FetchAllowedNetworks} {
+		_, err := parseNetworks(networks)
+		if err != nil {
+			return err
+		}
+	}
+	if c.OIDCIssuer != "" && c.OIDCAudience == "" {
+		return fmt.Errorf("OIDCIssuer needs OIDCAudience, the client id tokens must be issued for")
+	}
+	if c.OIDCIssuer != "" && (c.OIDCRoleClaim == "" || len(c.OIDCAdminRoles)+len(c.OIDCUserRoles)+len(c.OIDCRoleScopes) == 0) {
+		return fmt.Errorf("OIDCIssuer grants no access without OIDCRoleClaim and OIDCAdminRoles, OIDCUserRoles or OIDCRoleScopes")
+	}
+	for role, scopes := range c.OIDCRoleScopes {
+		if err := validateScopes(scopes); err != nil {
+			return fmt.Errorf("OIDCRoleScopes '%s': %w", role, err)
+		}
+	}
+	if c.LDAPURL != "" && len(c.LDAPAdminGroups)+len(c.LDAPUserGroups)+len(c.LDAPGroupScopes) == 0 {
+		return fmt.Errorf("LDAPURL grants no access without LDAPAdminGroups, LDAPUserGroups or LDAPGroupScopes")
+	}
+	for group, scopes := range c.LDAPGroupScopes {
+		if err := validateScopes(scopes); err != nil {
+			return fmt.Errorf("LDAPGroupScopes '%s': %w", group, err)
+		}
+	}
+	if _, ok := c.EncryptionKeys[c.EncryptionKeyID]; c.EncryptionKeyID != "" && !ok {
+		return fmt.Errorf("EncryptionKeyID '%s' is not listed in EncryptionKeys", c.EncryptionKeyID)
+	}
+	refs := []string{c.HttpCertPath, c.HttpKeyPath}
+	for _, ref := range c.EncryptionKeys {
+		refs = append(refs, ref)
+	}
+	for _, ref := range refs {
+		if !isVaultRef(ref) {
+			continue
+		}
+		if c.VaultAddr == "" {
+			return fmt.Errorf("'%s' needs VaultAddr to be set", ref)
+		}
+		if _, _, err := parseVaultRef(ref); err != nil {
+			return err
+		}
+	}
+	if len(c.ACMEHosts) > 0 && (c.HttpCertPath != "" || c.HttpKeyPath != "") {
+		return fmt.Errorf("Certificates come either from ACMEHosts or from HttpCertPath and HttpKeyPath, not both")
+	}
+	for _, host := range c.ACMEHosts {
+		if host == "" || strings.ContainsAny(host, ":/ ") {
+			return fmt.Errorf("ACMEHosts must be plain hostnames, got '%s'", host)
+		}
+	}
+	if _, err := c.tlsConfig(); err != nil {
+		return err
+	}
+	if c.HSTSMaxAge < 0 {
+		return fmt.Errorf("HSTSMaxAge must not be negative")
+	}
+	if c.SecretRefresh < 0 {
+		return fmt.Errorf("SecretRefresh must not be negative")
+	}
+	if c.RateLimitRequests < 0 || c.RateLimitBurst < 0 || c.RateLimitBandwidth < 0 {
+		return fmt.Errorf("Rate limits must not be negative")
+	}
+	if c.ReadSampleRate < 0 || c.ReadSampleRate > 1 {
+		return fmt.Errorf("ReadSampleRate must be between 0 and 1")
+	}
+	if err := c.Tunables.validate(); err != nil {
+		return err
+	}
+	switch c.Fsync {
+	case "", fsyncOff, fsyncFile, fsyncFull:
+	default:
+		return fmt.Errorf("Unknown Fsync '%s', must be \"off\", \"file\" or \"full\"", c.Fsync)
+	}
+	if c.FileMode != 0 && c.FileMode&0600 != 0600 {
+		return fmt.Errorf("FileMode %s must let the server read and write its files", c.FileMode)
+	}
+	if c.DirMode != 0 && c.DirMode&0700 != 0700 {
+		return fmt.Errorf("DirMode %s must let the server use its directories", c.DirMode)
+	}
+	if c.ScrubInterval < 0 {
+		return fmt.Errorf("ScrubInterval must not be negative")
+	}
+	if c.ScrubSampleRate < 0 || c.ScrubSampleRate > 1 || c.DeepScrubEvery < 0 {
+		return fmt.Errorf("ScrubSampleRate must be between 0 and 1, and DeepScrubEvery must not be negative")
+	}
+	if c.RestoreWorkers < 0 || c.EncodeWorkers < 0 {
+		return fmt.Errorf("RestoreWorkers and EncodeWorkers must not be negative")
+	}
+	if c.ErasureCoding != "" && c.ErasureCoding != erasureSIMD && c.ErasureCoding != erasureGeneric {
+		return fmt.Errorf("Unknown ErasureCoding '%s', must be \"simd\" or \"generic\"", c.ErasureCoding)
+	}
+	if _, ok := shardHashes[c.ShardHash]; c.ShardHash != "" && !ok {
+		return fmt.Errorf("Unknown ShardHash '%s', must be \"sha256\", \"sha512\" or \"blake3\"", c.ShardHash)
+	}
+	if _, ok := codecs[c.Codec]; c.Codec != "" && !ok {
+		return fmt.Errorf("Unknown Codec '%s', must be one of %s", c.Codec, strings.Join(Codecs(), ", "))
+	}
+	if c.SFTPConnections < 0 || c.SFTPRetries < 0 || c.SFTPQueue < 0 {
+		return fmt.Errorf("SFTPConnections, SFTPRetries and SFTPQueue must not be negative")
+	}
+	backends := 0
+	for _, setting := range []string{c.GCSBucket, c.B2Bucket, c.SFTPStorageURL} {
+		if setting != "" {
+			backends++
+		}
+	}
+	if len(c.ShardRoots) > 0 {
+		backends++
+	}
+	if len(c.Placement) > 0 {
+		backends++
+	}
+	if backends > 1 {
+		return fmt.Errorf("Only one of GCSBucket, B2Bucket, SFTPStorageURL, ShardRoots and Placement can be set")
+	}
+	if len(c.ShardRoots) == 1 {
+		return fmt.Errorf("ShardRoots needs at least two directories")
+	}
+	if c.B2Bucket != "" && (c.B2KeyID == "" || c.B2ApplicationKeyPath == "") {
+		return fmt.Errorf("B2Bucket needs B2KeyID and B2ApplicationKeyPath")
+	}
+	if err := c.validatePlacement(); err != nil {
+		return err
+	}
+	if c.Compression != "" && c.Compression != compressionZstd {
+		return fmt.Errorf("Unknown Compression '%s', only \"zstd\" is supported", c.Compression)
+	}
+	if c.Dedup && c.EncryptionKeyID != "" {
+		return fmt.Errorf("Dedup can't be used with EncryptionKeyID, chunks are shared by files with different data keys")
+	}
+	if c.DedupChunkSize < 0 || (c.DedupChunkSize > 0 && c.DedupChunkSize < 4<<10) {
+		return fmt.Errorf("DedupChunkSize must be at least 4KiB")
+	}
+	if c.PackThreshold < 0 || c.PackSize < 0 {
+		return fmt.Errorf("PackThreshold and PackSize can't be negative")
+	}
+	if c.PackThreshold > c.packSize() {
+		return fmt.Errorf("PackThreshold can't be above PackSize")
+	}
+	if _, ok := c.StorageTargets[c.ColdTarget]; c.ColdTarget != "" && !ok {
+		return fmt.Errorf("ColdTarget is an unknown storage target '%s'", c.ColdTarget)
+	}
+	if c.ColdAfter < 0 {
+		return fmt.Errorf("ColdAfter must not be negative")
+	}
+	if c.ColdTarget != "" && c.ColdAfter == 0 {
+		return fmt.Errorf("ColdTarget needs ColdAfter")
+	}
+	if err := c.validateLifecycle(); err != nil {
+		return err
+	}
+	if c.StagingMaxAge < 0 {
+		return fmt.Errorf("StagingMaxAge must not be negative")
+	}
+	if c.CompactionInterval < 0 {
+		return fmt.Errorf("CompactionInterval must not be negative")
+	}
+	if c.CompactionThreshold < 0 || c.CompactionThreshold > 1 {
+		return fmt.Errorf("CompactionThreshold must be between 0 and 1")
+	}
+	if c.ImmutableRetention < 0 || c.TrashRetention < 0 {
+		return fmt.Errorf("ImmutableRetention and TrashRetention must not be negative")
+	}
+	if c.AuditMaxFiles < 0 {
+		return fmt.Errorf("AuditMaxFiles must not be negative")
+	}
+	if c.MaxUploadSize < 0 || c.UploadMemoryBuffer < 0 || c.FetchMaxSize < 0 || c.DefaultQuota < 0 || c.MaxStorageSize < 0 || c.AuditMaxSize < 0 || c.ReadBufferSize < 0 || c.WriteBufferSize < 0 {
+		return fmt.Errorf("Sizes must not be negative")
+	}
+	if c.CacheMemory < 0 || c.CacheDirSize < 0 || c.CacheMaxObject < 0 {
+		return fmt.Errorf("Cache sizes must not be negative")
+	}
+	if (c.CacheDir == "") != (c.CacheDirSize == 0) {
+		return fmt.Errorf("CacheDir and CacheDirSize must be set together")
+	}
+	for namespace, quota := range c.Quotas {
+		if quota < 0 {
+			return fmt.Errorf("Quota of '%s' must not be negative", namespace)
+		}
+	}
+	return nil
+}
+
+// LoadConfigFile reads a json config file into c. Keys are Config field
+// names and only the fields present in the file are changed. Sizes and
+// rates can be given as human readable strings, like "50GiB" or "20MB/s",
+// and durations as strings understood by time.ParseDuration, like "24h".
+func LoadConfigFile(fpath string, c *Config) error {
+	f, err := os.Open(fpath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var fields map[string]json.RawMessage
+	err = json.NewDecoder(f).Decode(&fields)
+	if err != nil {
+		return fmt.Errorf("Cannot parse config file '%s': %s", fpath, err)
+	}
+	cv := reflect.ValueOf(c).Elem()
+	durationType := reflect.TypeOf(time.Duration(0))
+	for name, raw := range fields {
+		field := cv.FieldByName(name)
+		if !field.IsValid() || !field.CanSet() {
+			return fmt.Errorf("Unknown config key '%s' in '%s'", name, fpath)
+		}
+		if field.Type() == durationType {
+			var str string
+			if json.Unmarshal(raw, &str) == nil {
+				d, err := time.ParseDuration(str)
+				if err != nil {
+					return fmt.Errorf("Bad value for '%s': %s", name, err)
+				}
+				field.SetInt(int64(d))
+				continue
+			}
+		}
+		err = json.Unmarshal(raw, field.Addr().Interface())
+		if err != nil {
+			return fmt.Errorf("Bad value for '%s': %s", name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,164 @@
+package rsbackup
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadConfigFile(t *testing.T) {
+	configTests := []struct {
+		name        string
+		content     string
+		expectedErr bool
+	}{
+		{"valid", `{"DataShards":4,"MaxUploadSize":"50GiB","FetchTimeout":"90s","IdempotencyTTL":60000000000}`, false},
+		{"unknown key", `{"Shards":4}`, true},
+		{"unexported field", `{"server":4}`, true},
+		{"bad size", `{"MaxUploadSize":"huge"}`, true},
+		{"bad duration", `{"FetchTimeout":"soon"}`, true},
+		{"not json", `DataShards=4`, true},
+	}
+
+	for _, tt := range configTests {
+		t.Run(tt.name, func(t *testing.T) {
+			configPath := path.Join(createTMPDir(t, "rsbackup"), "config.json")
+			err := ioutil.WriteFile(configPath, []byte(tt.content), 0600)
+			if err != nil {
+				t.Fatal(err)
+			}
+			config := &Config{BackupRoot: "/backups", DataShards: 10, ParityShards: 3}
+			err = LoadConfigFile(configPath, config)
+			if (err != nil) != tt.expectedErr {
+				t.Fatalf("Got error '%v', expected error: %t", err, tt.expectedErr)
+			}
+			if err != nil {
+				return
+			}
+			expected := Config{
+				BackupRoot:     "/backups",
+				DataShards:     4,
+				ParityShards:   3,
+				MaxUploadSize:  50 << 30,
+				FetchTimeout:   90 * time.Second,
+				IdempotencyTTL: time.Minute,
+			}
+			if !reflect.DeepEqual(*config, expected) {
+				t.Errorf("Got config %+v, expected %+v", *config, expected)
+			}
+		})
+	}
+}
+
+func TestValidateConfig(t *testing.T) {
+	validateTests := []struct {
+		name        string
+		config      Config
+		expectedErr bool
+	}{
+		{"valid", Config{BackupRoot: ".", DataShards: 10, ParityShards: 3}, false},
+		{"no backup root", Config{DataShards: 10, ParityShards: 3}, true},
+		{"no parity", Config{BackupRoot: ".", DataShards: 10}, true},
+		{"too many shards", Config{BackupRoot: ".", DataShards: 250, ParityShards: 10}, true},
+		{"unknown encryption key", Config{BackupRoot: ".", DataShards: 10, ParityShards: 3, EncryptionKeyID: "2026"}, true},
+		{"negative size", Config{BackupRoot: ".", DataShards: 10, ParityShards: 3, MaxUploadSize: -1}, true},
+		{"negative storage cap", Config{BackupRoot: ".", DataShards: 10, ParityShards: 3, MaxStorageSize: -1}, true},
+		{"oidc", Config{BackupRoot: ".", DataShards: 10, ParityShards: 3, OIDCIssuer: "https://id.example.com", OIDCAudience: "rsbackup", OIDCRoleClaim: "roles", OIDCRoleScopes: map[string][]string{"backup-reader": {"read"}}}, false},
+		{"oidc without audience", Config{BackupRoot: ".", DataShards: 10, ParityShards: 3, OIDCIssuer: "https://id.example.com", OIDCRoleClaim: "roles", OIDCUserRoles: []string{"backup-user"}}, true},
+		{"oidc without roles", Config{BackupRoot: ".", DataShards: 10, ParityShards: 3, OIDCIssuer: "https://id.example.com", OIDCAudience: "rsbackup", OIDCRoleClaim: "roles"}, true},
+		{"ldap", Config{BackupRoot: ".", DataShards: 10, ParityShards: 3, LDAPURL: "ldaps://ldap.example.com", LDAPGroupScopes: map[string][]string{"backup-readers": {"read"}}}, false},
+		{"ldap without groups", Config{BackupRoot: ".", DataShards: 10, ParityShards: 3, LDAPURL: "ldaps://ldap.example.com"}, true},
+		{"oidc unknown scope", Config{BackupRoot: ".", DataShards: 10, ParityShards: 3, OIDCIssuer: "https://id.example.com", OIDCAudience: "rsbackup", OIDCRoleClaim: "roles", OIDCRoleScopes: map[string][]string{"backup-reader": {"browse"}}}, true},
+		{"acme", Config{BackupRoot: ".", DataShards: 10, ParityShards: 3, ACMEHosts: []string{"backup.example.com"}}, false},
+		{"acme and cert", Config{BackupRoot: ".", DataShards: 10, ParityShards: 3, ACMEHosts: []string{"backup.example.com"}, HttpCertPath: "cert.pem"}, true},
+		{"acme url", Config{BackupRoot: ".", DataShards: 10, ParityShards: 3, ACMEHosts: []string{"https://backup.example.com"}}, true},
+		{"b2 without key", Config{BackupRoot: ".", DataShards: 10, ParityShards: 3, B2Bucket: "backups"}, true},
+		{"b2 and gcs", Config{BackupRoot: ".", DataShards: 10, ParityShards: 3, B2Bucket: "backups", B2KeyID: "key", B2ApplicationKeyPath: "b2.key", GCSBucket: "backups"}, true},
+		{"zstd compression", Config{BackupRoot: ".", DataShards: 10, ParityShards: 3, Compression: "zstd"}, false},
+		{"unknown compression", Config{BackupRoot: ".", DataShards: 10, ParityShards: 3, Compression: "lz4"}, true},
+		{"dedup", Config{BackupRoot: ".", DataShards: 10, ParityShards: 3, Dedup: true, DedupChunkSize: 64 << 10}, false},
+		{"dedup chunks too small", Config{BackupRoot: ".", DataShards: 10, ParityShards: 3, Dedup: true, DedupChunkSize: 512}, true},
+		{"dedup with encryption", Config{BackupRoot: ".", DataShards: 10, ParityShards: 3, Dedup: true, EncryptionKeyID: "2026", EncryptionKeys: map[string]string{"2026": "key"}}, true},
+		{"packing", Config{BackupRoot: ".", DataShards: 10, ParityShards: 3, PackThreshold: 64 << 10}, false},
+		{"pack threshold above pack size", Config{BackupRoot: ".", DataShards: 10, ParityShards: 3, PackThreshold: 2 << 20, PackSize: 1 << 20}, true},
+		{"compaction threshold above 1", Config{BackupRoot: ".", DataShards: 10, ParityShards: 3, CompactionThreshold: 1.5}, true},
+		{"placement", Config{BackupRoot: ".", DataShards: 10, ParityShards: 3, StorageTargets: map[string]StorageTarget{"disk2": {Dir: "/mnt/disk2"}}, Placement: []PlacementRule{{Files: "*.tar", Parity: []string{"disk2"}}}}, false},
+		{"cold target", Config{BackupRoot: ".", DataShards: 10, ParityShards: 3, StorageTargets: map[string]StorageTarget{"archive": {GCSBucket: "archive"}}, ColdTarget: "archive", ColdAfter: 30 * 24 * time.Hour}, false},
+		{"cold target unknown", Config{BackupRoot: ".", DataShards: 10, ParityShards: 3, ColdTarget: "archive", ColdAfter: time.Hour}, true},
+		{"cold target without cold after", Config{BackupRoot: ".", DataShards: 10, ParityShards: 3, StorageTargets: map[string]StorageTarget{"archive": {GCSBucket: "archive"}}, ColdTarget: "archive"}, true},
+		{"lifecycle", Config{BackupRoot: ".", DataShards: 10, ParityShards: 3, Lifecycle: []LifecycleRule{{Prefix: "db-", ExpireAfter: time.Hour, KeepLatest: 7}}, LifecycleInterval: time.Hour}, false},
+		{"lifecycle rule without action", Config{BackupRoot: ".", DataShards: 10, ParityShards: 3, Lifecycle: []LifecycleRule{{Prefix: "db-"}}}, true},
+		{"lifecycle cold without target", Config{BackupRoot: ".", DataShards: 10, ParityShards: 3, Lifecycle: []LifecycleRule{{ColdAfter: time.Hour}}}, true},
+		{"storage class", Config{BackupRoot: ".", DataShards: 10, ParityShards: 3, StorageClasses: map[string]StorageClass{"archive": {DataShards: 4, ParityShards: 4}}, Placement: []PlacementRule{{Class: "archive"}}}, false},
+		{"storage class without parity", Config{BackupRoot: ".", DataShards: 10, ParityShards: 3, StorageClasses: map[string]StorageClass{"archive": {DataShards: 4}}}, true},
+		{"placement unknown storage class", Config{BackupRoot: ".", DataShards: 10, ParityShards: 3, Placement: []PlacementRule{{Class: "archive"}}}, true},
+		{"fsync full", Config{BackupRoot: ".", DataShards: 10, ParityShards: 3, Fsync: "full"}, false},
+		{"fsync unknown", Config{BackupRoot: ".", DataShards: 10, ParityShards: 3, Fsync: "always"}, true},
+		{"file mode", Config{BackupRoot: ".", DataShards: 10, ParityShards: 3, FileMode: 0640, DirMode: 0750}, false},
+		{"file mode unreadable", Config{BackupRoot: ".", DataShards: 10, ParityShards: 3, FileMode: 0200}, true},
+		{"dir mode unsearchable", Config{BackupRoot: ".", DataShards: 10, ParityShards: 3, DirMode: 0600}, true},
+		{"negative staging max age", Config{BackupRoot: ".", DataShards: 10, ParityShards: 3, StagingMaxAge: -time.Hour}, true},
+		{"placement unknown target", Config{BackupRoot: ".", DataShards: 10, ParityShards: 3, Placement: []PlacementRule{{Data: "disk2"}}}, true},
+		{"placement bad pattern", Config{BackupRoot: ".", DataShards: 10, ParityShards: 3, Placement: []PlacementRule{{Files: "["}}}, true},
+		{"storage target of two kinds", Config{BackupRoot: ".", DataShards: 10, ParityShards: 3, StorageTargets: map[string]StorageTarget{"disk2": {Dir: "/mnt/disk2", GCSBucket: "backups"}}, Placement: []PlacementRule{{Data: "disk2"}}}, true},
+	}
+
+	for _, tt := range validateTests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.config.Validate()
+			if (err != nil) != tt.expectedErr {
+				t.Errorf("Got error '%v', expected error: %t", err, tt.expectedErr)
+			}
+		})
+	}
+}
+
+func TestConfigChroot(t *testing.T) {
+	c := &Config{
+		BackupRoot:     "/srv/backup",
+		HttpCertPath:   "/srv/backup/tls/cert.pem",
+		HttpKeyPath:    "vault:secret/data/rsbackup#key",
+		EncryptionKeys: map[string]string{"2026": "/srv/backup/keys/../keys/2026"},
+	}
+	err := c.Chroot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.BackupRoot != "/" || c.HttpCertPath != "/tls/cert.pem" || c.HttpKeyPath != "vault:secret/data/rsbackup#key" || c.EncryptionKeys["2026"] != "/keys/2026" {
+		t.Errorf("Got %+v after chroot", c)
+	}
+
+	for _, outside := range []string{"/srv/backup-keys/2026", "/srv/backup/../htpasswd", "/etc/htpasswd"} {
+		c := &Config{BackupRoot: "/srv/backup", HtpasswdPath: outside}
+		if err := c.Chroot(); err == nil {
+			t.Errorf("Chrooted with %s outside the backup root", outside)
+		}
+	}
+}
+
+func TestConfigRedactsSecrets(t *testing.T) {
+	config := &Config{
+		BackupRoot:       "/srv/backups",
+		AuthTokens:       map[string]string{"laptop": "laptop-secret-0123456789"},
+		AdminTokens:      map[string]string{"ops": "ops-secret-0123456789"},
+		LDAPBindPassword: "bind-secret-0123456789",
+	}
+	for _, format := range []string{"%v", "%+v", "%#v"} {
+		printed := fmt.Sprintf(format, config)
+		for _, secret := range []string{"laptop-secret-0123456789", "ops-secret-0123456789", "bind-secret-0123456789"} {
+			if strings.Contains(printed, secret) {
+				t.Errorf("%s leaks %s: %s", format, secret, printed)
+			}
+		}
+		if !strings.Contains(printed, "laptop") || !strings.Contains(printed, "/srv/backups") {
+			t.Errorf("%s left out what isn't secret: %s", format, printed)
+		}
+	}
+	if config.AuthTokens["laptop"] != "laptop-secret-0123456789" {
+		t.Errorf("Printing the config changed its tokens")
+	}
+}
@@ -0,0 +1,186 @@
+package rsbackup
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Kinds of anomalies found by ScanConsistency.
+const (
+	anomalyDataWithoutMetadata = "data_without_metadata"
+	anomalyMetadataWithoutData = "metadata_without_data"
+	anomalyParityWithoutData   = "parity_without_data"
+	anomalyMissingParity       = "missing_parity"
+	anomalyStagingLeftover     = "staging_leftover"
+)
+
+var anomalyKinds = []string{
+	anomalyDataWithoutMetadata,
+	anomalyMetadataWithoutData,
+	anomalyParityWithoutData,
+	anomalyMissingParity,
+	anomalyStagingLeftover,
+}
+
+// Anomaly is something in the backup root that a complete store, rename
+// or delete doesn't leave behind, with what can be done about it.
+type Anomaly struct {
+	Kind string `json:"kind"`
+	Path string `json:"path"`
+	// Name is the file it concerns, if any.
+	Name string `json:"name,omitempty"`
+	Fix  string `json:"fix"`
+}
+
+// ConsistencyReport is what a scan of the backup root found.
+type ConsistencyReport struct {
+	ScannedAt time.Time      `json:"scanned_at"`
+	Took      string         `json:"took"`
+	Counts    map[string]int `json:"counts"`
+	Anomalies []Anomaly      `json:"anomalies"`
+}
+
+func (c *ConsistencyReport) add(a Anomaly) {
+	log.Warnf("Consistency scan: %s '%s', %s", a.Kind, a.Path, a.Fix)
+	c.Counts[a.Kind]++
+	c.Anomalies = append(c.Anomalies, a)
+}
+
+// ScanConsistency looks through the backup root and the staging directory
+// for data files without metadata, metadata and parity shards without a
+// data file, missing parity shards and leftovers of uploads. It only
+// reads; chunks and containers are left to compaction.
+func (r *RSFileManager) ScanConsistency() (*ConsistencyReport, error) {
+	started := time.Now()
+	report := &ConsistencyReport{ScannedAt: started.UTC(), Counts: make(map[string]int), Anomalies: []Anomaly{}}
+	for _, kind := range anomalyKinds {
+		report.Counts[kind] = 0
+	}
+	err := r.scanDir(report, r.Config.BackupRoot, r.layout().Depth())
+	if err != nil {
+		return nil, err
+	}
+	err = scanStagingDir(report, r.Config.StagingPath())
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	report.Took = time.Since(started).Round(time.Millisecond).String()
+	return report, nil
+}
+
+// scanDir adds the anomalies up to depth directory levels below dir to
+// report.
+func (r *RSFileManager) scanDir(report *ConsistencyReport, dir string, depth int) error {
+	storage := r.storage()
+	names, err := storage.List(dir)
+	if err != nil {
+		return err
+	}
+	sort.Strings(names)
+	// The names of the objects in dir, whether their data file is there
+	// and their parity shards.
+	var bases []string
+	seen := make(map[string]bool)
+	data := make(map[string]bool)
+	parity := make(map[string][]string)
+	for _, name := range names {
+		fpath := path.Join(dir, name)
+		switch {
+		case isStagingName(name):
+			report.add(Anomaly{Kind: anomalyStagingLeftover, Path: fpath,
+				Fix: "left by an interrupted store, the janitor removes it once older than StagingMaxAge"})
+			continue
+		case isReservedName(name):
+			continue
+		case depth > 0:
+			if err := r.scanDir(report, fpath, depth-1); err != nil {
+				log.Errorf("Unable to scan directory '%s', skipping: %s", fpath, err)
+			}
+			continue
+		}
+		base, shard := shardOf(name)
+		if !seen[base] {
+			seen[base] = true
+			bases = append(bases, base)
+		}
+		switch {
+		case shard == 0:
+			data[base] = true
+		case shard > 0:
+			parity[base] = append(parity[base], name)
+		}
+	}
+	for _, base := range bases {
+		r.scanObject(report, dir, base, data[base], parity[base])
+	}
+	return nil
+}
+
+// scanObject adds the anomalies of the object named base in dir to report.
+// The metadata mirror is read, but not restored from.
+func (r *RSFileManager) scanObject(report *ConsistencyReport, dir, base string, hasData bool, parity []string) {
+	fpath := path.Join(dir, base)
+	md, err := r.readMetadataFile(fpath + ".md")
+	if err != nil {
+		md, err = r.readMetadataFile(fpath + metadataMirrorSuffix)
+	}
+	if hasData {
+		if err != nil {
+			report.add(Anomaly{Kind: anomalyDataWithoutMetadata, Path: fpath, Name: base,
+				Fix: fmt.Sprintf("rebuild its metadata with POST /rebuild_metadata/%s, or resubmit it", base)})
+			return
+		}
+		if md.Packed == nil && md.Metadata != nil && len(parity) < md.ParityShards {
+			report.add(Anomaly{Kind: anomalyMissingParity, Path: fpath, Name: base,
+				Fix: fmt.Sprintf("%d of %d parity shards are missing, rebuild them with GET /repair_data/%s",
+					md.ParityShards-len(parity), md.ParityShards, base)})
+		}
+		return
+	}
+	switch {
+	case err == nil && md.Packed != nil:
+		// Its contents are in a container.
+	case err == nil && md.Metadata != nil:
+		fix := "too few parity shards are left to rebuild it, delete what's left or resubmit it"
+		if len(parity) >= md.DataShards {
+			fix = fmt.Sprintf("rebuild it from its parity shards with GET /repair_data/%s", base)
+		}
+		report.add(Anomaly{Kind: anomalyMetadataWithoutData, Path: fpath + ".md", Name: base, Fix: fix})
+	case len(parity) > 0:
+		report.add(Anomaly{Kind: anomalyParityWithoutData, Path: path.Join(dir, parity[0]), Name: base,
+			Fix: "nothing can be rebuilt from it, the janitor removes it once older than StagingMaxAge"})
+	}
+}
+
+// scanStagingDir adds what uploads left in the local staging directory dir
+// to report.
+func scanStagingDir(report *ConsistencyReport, dir string) error {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if hasStagingEntryPrefix(entry.Name()) {
+			report.add(Anomaly{Kind: anomalyStagingLeftover, Path: path.Join(dir, entry.Name()),
+				Fix: "left by an interrupted upload, the janitor removes it once older than StagingMaxAge"})
+		}
+	}
+	return nil
+}
+
+// consistencyHandler serves the report of the scan run on startup.
+func (rs *RSBackupAPI) consistencyHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		rs.Errorf(r, "Bad method %s", r.Method)
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	writeResponse(w, r, rs.Consistency)
+}
@@ -0,0 +1,94 @@
+package rsbackup
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestScanConsistency(t *testing.T) {
+	config := &Config{BackupRoot: createTMPDir(t, "rsbackup"), DataShards: 1, ParityShards: 2}
+	fm := &RSFileManager{Config: config}
+	api := &RSBackupAPI{Config: config, RsFileMan: fm}
+	store := func(fname string) {
+		t.Helper()
+		fpath := fm.DataPath(fname)
+		if err := ioutil.WriteFile(fpath, []byte("little "+fname), 0644); err != nil {
+			t.Fatal(err)
+		}
+		md, err := api.generateParity(fm.storage(), fpath, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := fm.WriteMetadata(fname, md, MetadataExtras{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, fname := range []string{"tyger", "lamb", "fly", "rose", "worm"} {
+		store(fname)
+	}
+	removeMetadata(fm.storage(), fm.DataPath("lamb"))
+	os.Remove(fm.DataPath("fly"))
+	os.Remove(fm.DataPath("rose") + ".parity.2")
+	os.Remove(fm.DataPath("worm"))
+	removeMetadata(fm.storage(), fm.DataPath("worm"))
+	os.Mkdir(fm.DataPath(stagingPrefix+"bird"), 0755)
+	os.MkdirAll(config.StagingPath(), 0755)
+	ioutil.WriteFile(config.StagingPath()+"/multipart-1234", []byte("spilt"), 0644)
+
+	report, err := fm.ScanConsistency()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{
+		anomalyDataWithoutMetadata: "lamb",
+		anomalyMetadataWithoutData: "fly",
+		anomalyMissingParity:       "rose",
+		anomalyParityWithoutData:   "worm",
+	}
+	for _, a := range report.Anomalies {
+		if name, ok := expected[a.Kind]; ok && a.Name != name {
+			t.Errorf("Got %s for %s, expected it for %s", a.Kind, a.Name, name)
+		}
+		if a.Fix == "" {
+			t.Errorf("Got no fix for %+v", a)
+		}
+	}
+	for kind := range expected {
+		if report.Counts[kind] != 1 {
+			t.Errorf("Got %d %s, expected 1", report.Counts[kind], kind)
+		}
+	}
+	if report.Counts[anomalyStagingLeftover] != 2 || len(report.Anomalies) != 6 {
+		t.Errorf("Got anomalies %+v", report.Anomalies)
+	}
+	for _, a := range report.Anomalies {
+		// With all its parity shards, the lost data can be rebuilt.
+		if a.Kind == anomalyMetadataWithoutData && !strings.Contains(a.Fix, "/repair_data/fly") {
+			t.Errorf("Got fix '%s' for lost data", a.Fix)
+		}
+	}
+
+	api.Consistency = report
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(api.consistencyHandler).ServeHTTP(rr, httptest.NewRequest("GET", "/consistency", nil))
+	var served ConsistencyReport
+	json.NewDecoder(rr.Body).Decode(&served)
+	if rr.Code != http.StatusOK || len(served.Anomalies) != 6 || served.Counts[anomalyMissingParity] != 1 {
+		t.Errorf("Got status code %d and report %+v", rr.Code, served)
+	}
+	rr = httptest.NewRecorder()
+	http.HandlerFunc(api.consistencyHandler).ServeHTTP(rr, httptest.NewRequest("POST", "/consistency", nil))
+	if rr.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Got status code %d for POST", rr.Code)
+	}
+	rr = httptest.NewRecorder()
+	http.HandlerFunc(api.metricsHandler).ServeHTTP(rr, httptest.NewRequest("GET", "/metrics", nil))
+	if !strings.Contains(rr.Body.String(), `rsbackup_consistency_anomalies{kind="staging_leftover"} 2`) {
+		t.Errorf("Got metrics %s", rr.Body.String())
+	}
+}
@@ -0,0 +1,466 @@
+package rsbackup
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/bits"
+	"os"
+	"path"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/sirmackk/rsutils"
+	log "github.com/sirupsen/logrus"
+)
+
+// chunkDirName is the directory under BackupRoot holding the chunks of
+// deduplicated files.
+const chunkDirName = ".chunks"
+
+const defaultDedupChunkSize = 1 << 20
+
+var errDedupBundle = errors.New("Deduplicated files can't be bundled")
+
+// gearTable drives the rolling hash picking chunk boundaries. It comes from
+// a fixed xorshift sequence, as changing it would move every boundary and
+// stop new chunks matching stored ones.
+var gearTable = func() [256]uint64 {
+	var table [256]uint64
+	x := uint64(0x9e3779b97f4a7c15)
+	for i := range table {
+		x ^= x << 13
+		x ^= x >> 7
+		x ^= x << 17
+		table[i] = x
+	}
+	return table
+}()
+
+// DedupInfo is recorded in the metadata of deduplicated files. Their data
+// file holds a chunkManifest listing the chunks of the contents, which are
+// stored under chunkDirName with parity of their own.
+type DedupInfo struct {
+	// Size is the size of the contents.
+	Size   int64
+	Chunks int
+	// Stored is the bytes taken by the chunks that were new when the file
+	// was stored, parity and metadata included.
+	Stored int64
+}
+
+type manifestChunk struct {
+	Hash string `json:"hash"`
+	Size int64  `json:"size"`
+}
+
+type chunkManifest struct {
+	Chunks []manifestChunk `json:"chunks"`
+}
+
+func (m *chunkManifest) size() int64 {
+	var size int64
+	for _, chunk := range m.Chunks {
+		size += chunk.Size
+	}
+	return size
+}
+
+// chunker splits a stream with content-defined chunking. A chunk ends where
+// the rolling hash of the bytes before has its top bits clear, so data
+// inserted into a file only changes the chunks around it.
+type chunker struct {
+	src      *bufio.Reader
+	min, max int
+	mask     uint64
+	buf      []byte
+}
+
+func newChunker(src io.Reader, average int) *chunker {
+	maskBits := uint(bits.Len(uint(average)) - 1)
+	return &chunker{
+		src:  bufio.NewReaderSize(src, 64<<10),
+		min:  average / 4,
+		max:  average * 4,
+		mask: (1<<maskBits - 1) << (64 - maskBits),
+		buf:  make([]byte, 0, average*4),
+	}
+}
+
+// next returns the next chunk, valid until the following call, or io.EOF
+// at the end of the stream.
+func (c *chunker) next() ([]byte, error) {
+	c.buf = c.buf[:0]
+	var hash uint64
+	for len(c.buf) < c.max {
+		b, err := c.src.ReadByte()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		c.buf = append(c.buf, b)
+		hash = hash<<1 + gearTable[b]
+		if len(c.buf) >= c.min && hash&c.mask == 0 {
+			break
+		}
+	}
+	if len(c.buf) == 0 {
+		return nil, io.EOF
+	}
+	return c.buf, nil
+}
+
+// ChunkStore counts the references from deduplicated files to each chunk,
+// a chunk is removed along with the last file using it. The counts are
+// persisted in a json file. A crash may leave chunks nothing uses behind,
+// but never removes chunks that are used.
+type ChunkStore struct {
+	mu   sync.Mutex
+	path string
+	refs map[string]int
+}
+
+func NewChunkStore(fpath string) (*ChunkStore, error) {
+	s := &ChunkStore{path: fpath, refs: make(map[string]int)}
+	err := readJSONState(fpath, &s.refs)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// References returns the number of files using the chunk hash.
+func (s *ChunkStore) References(hash string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.refs[hash]
+}
+
+// store splits src into chunks of about average bytes, stores those files
+// doesn't have yet and takes a reference to each. It returns the manifest
+// of src and the bytes taken by the new chunks.
+func (s *ChunkStore) store(files *RSFileManager, src io.Reader, average int) (*chunkManifest, int64, error) {
+	manifest := &chunkManifest{}
+	var stored int64
+	c := newChunker(src, average)
+	for {
+		chunk, err := c.next()
+		if err == io.EOF {
+			break
+		}
+		if err == nil {
+			sum := sha256.Sum256(chunk)
+			hash := hex.EncodeToString(sum[:])
+			var n int64
+			n, err = s.add(files, hash, chunk)
+			if err == nil {
+				manifest.Chunks = append(manifest.Chunks, manifestChunk{Hash: hash, Size: int64(len(chunk))})
+				stored += n
+				continue
+			}
+		}
+		s.release(files, manifest, false)
+		return nil, 0, err
+	}
+	s.mu.Lock()
+	err := writeJSONState(s.path, s.refs)
+	s.mu.Unlock()
+	if err != nil {
+		s.release(files, manifest, false)
+		return nil, 0, err
+	}
+	return manifest, stored, nil
+}
+
+// add takes a reference to the chunk hash, storing data in files if the
+// chunk is new, and returns the bytes that took. New chunks are written
+// one at a time, so concurrent uploads don't store a chunk twice.
+func (s *ChunkStore) add(files *RSFileManager, hash string, data []byte) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.refs[hash] > 0 {
+		s.refs[hash]++
+		return 0, nil
+	}
+	storage := files.storage()
+	fpath := files.DataPath(hash)
+	// Metadata is written last, without it the chunk is left over from a
+	// write cut short. Complete chunks nothing used are taken up again.
+	if _, err := storage.Stat(fpath + ".md"); err != nil {
+		removeStoredObject(storage, fpath, false)
+		err = writeChunk(files, hash, data)
+		if err != nil {
+			return 0, err
+		}
+	}
+	s.refs[hash] = 1
+	return storedSize(storage, fpath), nil
+}
+
+func writeChunk(files *RSFileManager, hash string, data []byte) error {
+	var extras MetadataExtras
+	fpath, encoded, err := files.saveFile(bytes.NewReader(data), int64(len(data)), hash, &extras)
+	if err != nil {
+		return err
+	}
+	var md *rsutils.Metadata
+	if encoded != nil {
+		md, err = encoded.store(files.storage(), fpath, files.Config.Fsync)
+	} else {
+		md, _, err = writeParity(files.storage(), fpath, files.Config.DataShards, files.Config.ParityShards, files.Config)
+	}
+	if err == nil {
+		now := time.Now().UTC()
+		extras.StoredAt, extras.Codec, extras.Hash = &now, files.Config.codecName(), files.Config.shardHashName()
+		err = files.WriteMetadata(hash, md, extras)
+	}
+	if err != nil {
+		removeStoredObject(files.storage(), fpath, false)
+	}
+	return err
+}
+
+// removeStoredObject removes the data, parity and metadata files at
+// fpath, shredding them first with shred.
+func removeStoredObject(storage StorageBackend, fpath string, shred bool) {
+	suffixes := objectSuffixes(storage, fpath)
+	for i := len(suffixes) - 1; i >= 0; i-- {
+		if shred {
+			shredFile(storage, fpath+suffixes[i])
+		}
+		err := storage.Remove(fpath + suffixes[i])
+		if err != nil && !os.IsNotExist(err) {
+			log.Errorf("Unable to remove file '%s': %s", fpath+suffixes[i], err)
+		}
+	}
+}
+
+// release drops the references of manifest, removing the chunks nothing
+// uses anymore.
+func (s *ChunkStore) release(files *RSFileManager, manifest *chunkManifest, shred bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var unused []string
+	for _, chunk := range manifest.Chunks {
+		refs := s.refs[chunk.Hash]
+		if refs <= 0 {
+			// Stored before the counts were, it may be used elsewhere.
+			continue
+		}
+		if refs == 1 {
+			delete(s.refs, chunk.Hash)
+			unused = append(unused, chunk.Hash)
+			continue
+		}
+		s.refs[chunk.Hash] = refs - 1
+	}
+	err := writeJSONState(s.path, s.refs)
+	if err != nil {
+		return err
+	}
+	for _, hash := range unused {
+		removeStoredObject(files.storage(), files.DataPath(hash), shred)
+	}
+	return nil
+}
+
+// chunkFiles returns a file manager for the chunks of deduplicated files.
+// Chunks are stored like files of their own, named after their sha256.
+func (r *RSFileManager) chunkFiles() *RSFileManager {
+	config := *r.Config
+	config.BackupRoot = path.Join(r.Config.BackupRoot, chunkDirName)
+	config.Dedup = false
+	// Holes are left out of the files before they're cut into chunks.
+	config.Sparse = false
+	return &RSFileManager{Config: &config, Layout: HashPrefixLayout{Levels: 1}, Storage: r.Storage}
+}
+
+// readManifest returns the manifest of the deduplicated file at fpath, or
+// nil if it isn't deduplicated. Manifests are never compressed or
+// encrypted.
+func (r *RSFileManager) readManifest(fpath string) (*chunkManifest, error) {
+	extras, err := r.ReadExtras(fpath)
+	if err != nil || extras.Dedup == nil {
+		return nil, err
+	}
+	file, err := r.storage().Open(fpath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return decodeManifest(file)
+}
+
+func decodeManifest(src io.Reader) (*chunkManifest, error) {
+	var manifest chunkManifest
+	err := json.NewDecoder(src).Decode(&manifest)
+	if err != nil {
+		return nil, fmt.Errorf("Bad chunk manifest: %s", err)
+	}
+	return &manifest, nil
+}
+
+// releaseChunks drops the references of a deduplicated file whose files
+// were removed, manifest being what readManifest returned before.
+func (r *RSFileManager) releaseChunks(manifest *chunkManifest, shred bool) {
+	if manifest == nil {
+		return
+	}
+	if r.Chunks == nil {
+		log.Warnf("Chunk references aren't counted, %d chunks stay stored", len(manifest.Chunks))
+		return
+	}
+	err := r.Chunks.release(r.chunkFiles(), manifest, shred)
+	if err != nil {
+		log.Errorf("Unable to release chunks: %s", err)
+	}
+}
+
+// checkChunks reports whether every chunk of the deduplicated file at
+// fpath is healthy, true for files that aren't deduplicated. With repair
+// damaged chunks are repaired.
+func (r *RSFileManager) checkChunks(fpath string, repair bool) (bool, error) {
+	manifest, err := r.readManifest(fpath)
+	if err != nil || manifest == nil {
+		return err == nil, err
+	}
+	files := r.chunkFiles()
+	checked := make(map[string]bool)
+	health := true
+	for _, chunk := range manifest.Chunks {
+		if checked[chunk.Hash] {
+			continue
+		}
+		checked[chunk.Hash] = true
+		healthy, _, _, err := files.CheckData(chunk.Hash)
+		if err != nil {
+			return false, fmt.Errorf("Chunk %s: %s", chunk.Hash, err)
+		}
+		if healthy {
+			continue
+		}
+		if !repair {
+			health = false
+			continue
+		}
+		log.Infof("Repairing chunk %s of '%s'", chunk.Hash, fpath)
+		err = files.RepairData(chunk.Hash)
+		if err != nil {
+			return false, fmt.Errorf("Chunk %s: %s", chunk.Hash, err)
+		}
+	}
+	return health, nil
+}
+
+// chunkedReader gives random access to the contents of a deduplicated
+// file, reading them from its chunks.
+type chunkedReader struct {
+	files   *RSFileManager
+	chunks  []manifestChunk
+	offsets []int64
+	size    int64
+	pos     int64
+	// current is the index of the open chunk, -1 if none is.
+	current int
+	content io.ReadSeeker
+	closer  io.Closer
+}
+
+func newChunkedReader(files *RSFileManager, manifest *chunkManifest) *chunkedReader {
+	c := &chunkedReader{files: files, chunks: manifest.Chunks, current: -1}
+	for _, chunk := range manifest.Chunks {
+		c.offsets = append(c.offsets, c.size)
+		c.size += chunk.Size
+	}
+	return c
+}
+
+func (c *chunkedReader) Read(p []byte) (int, error) {
+	if c.pos >= c.size {
+		return 0, io.EOF
+	}
+	i := sort.Search(len(c.offsets), func(i int) bool { return c.offsets[i] > c.pos }) - 1
+	if i != c.current {
+		c.Close()
+		content, closer, _, err := c.files.openContents(c.chunks[i].Hash)
+		if err != nil {
+			return 0, fmt.Errorf("Chunk %s: %w", c.chunks[i].Hash, err)
+		}
+		c.current, c.content, c.closer = i, content, closer
+	}
+	_, err := c.content.Seek(c.pos-c.offsets[i], io.SeekStart)
+	if err != nil {
+		return 0, err
+	}
+	if left := c.offsets[i] + c.chunks[i].Size - c.pos; int64(len(p)) > left {
+		p = p[:left]
+	}
+	n, err := c.content.Read(p)
+	c.pos += int64(n)
+	if err == io.EOF {
+		if n == 0 {
+			return 0, fmt.Errorf("Chunk %s is shorter than its manifest says", c.chunks[i].Hash)
+		}
+		err = nil
+	}
+	return n, err
+}
+
+func (c *chunkedReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += c.pos
+	case io.SeekEnd:
+		offset += c.size
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("Negative position %d", offset)
+	}
+	c.pos = offset
+	return offset, nil
+}
+
+func (c *chunkedReader) Close() error {
+	if c.closer == nil {
+		return nil
+	}
+	err := c.closer.Close()
+	c.current, c.content, c.closer = -1, nil, nil
+	return err
+}
+
+// manifestWriter collects the size bytes of a manifest written to it and
+// then writes the contents of its chunks to w.
+type manifestWriter struct {
+	files     *RSFileManager
+	w         io.Writer
+	buf       bytes.Buffer
+	remaining int64
+}
+
+func (m *manifestWriter) Write(p []byte) (int, error) {
+	if int64(len(p)) > m.remaining {
+		return 0, fmt.Errorf("Chunk manifest longer than expected")
+	}
+	m.buf.Write(p)
+	m.remaining -= int64(len(p))
+	if m.remaining > 0 {
+		return len(p), nil
+	}
+	manifest, err := decodeManifest(&m.buf)
+	if err != nil {
+		return len(p), err
+	}
+	chunks := newChunkedReader(m.files, manifest)
+	defer chunks.Close()
+	_, err = io.Copy(m.w, chunks)
+	return len(p), err
+}
@@ -0,0 +1,177 @@
+package rsbackup
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"testing"
+)
+
+func chunkHashes(t *testing.T, data []byte, average int) map[string]bool {
+	hashes := make(map[string]bool)
+	c := newChunker(bytes.NewReader(data), average)
+	total := 0
+	for {
+		chunk, err := c.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(chunk) > 4*average {
+			t.Errorf("Got a chunk of %d bytes", len(chunk))
+		}
+		total += len(chunk)
+		hashes[string(chunk)] = true
+	}
+	if total != len(data) {
+		t.Errorf("Chunks hold %d bytes, expected %d", total, len(data))
+	}
+	return hashes
+}
+
+func TestChunker(t *testing.T) {
+	data := make([]byte, 1<<20)
+	rand.New(rand.NewSource(1)).Read(data)
+	edited := append(append(append([]byte{}, data[:500000]...), []byte("inserted")...), data[500000:]...)
+
+	before := chunkHashes(t, data, 16<<10)
+	after := chunkHashes(t, edited, 16<<10)
+	changed := 0
+	for chunk := range after {
+		if !before[chunk] {
+			changed++
+		}
+	}
+	if len(before) < 16 || changed > 2 {
+		t.Errorf("Inserting 8 bytes changed %d of %d chunks", changed, len(before))
+	}
+}
+
+func TestDedupStorage(t *testing.T) {
+	for _, compression := range []string{"", "zstd"} {
+		tmpDir := createTMPDir(t, "rsbackup")
+		config := &Config{BackupRoot: tmpDir, DataShards: 2, ParityShards: 1, Dedup: true, DedupChunkSize: 4 << 10, Compression: compression}
+		chunks, err := NewChunkStore(config.StatePath("chunks.json"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		fm := &RSFileManager{Config: config, Chunks: chunks}
+		api := &RSBackupAPI{Config: config, RsFileMan: fm}
+
+		monday := make([]byte, 200<<10)
+		rand.New(rand.NewSource(2)).Read(monday)
+		tuesday := append(append(append([]byte{}, monday[:100000]...), []byte("tuesday")...), monday[100000:]...)
+		submitData(t, api, "monday", monday)
+		submitData(t, api, "tuesday", tuesday)
+
+		mondayExtras, _ := fm.ReadExtras(fm.DataPath("monday"))
+		tuesdayExtras, _ := fm.ReadExtras(fm.DataPath("tuesday"))
+		if mondayExtras.Dedup == nil || tuesdayExtras.Dedup == nil || mondayExtras.Dedup.Size != int64(len(monday)) {
+			t.Fatalf("Got dedup info %+v and %+v", mondayExtras.Dedup, tuesdayExtras.Dedup)
+		}
+		if tuesdayExtras.Dedup.Stored*5 > mondayExtras.Dedup.Stored {
+			t.Errorf("Storing a similar file took %d bytes, the first %d", tuesdayExtras.Dedup.Stored, mondayExtras.Dedup.Stored)
+		}
+		if names, err := fm.ListData(); err != nil || len(names) != 2 {
+			t.Errorf("Got names %v (error: %v)", names, err)
+		}
+
+		retrieve := func(url, rangeHeader string) *httptest.ResponseRecorder {
+			req := httptest.NewRequest("GET", url, nil)
+			if rangeHeader != "" {
+				req.Header.Set("Range", rangeHeader)
+			}
+			rr := httptest.NewRecorder()
+			http.HandlerFunc(api.retrieveDataHandler).ServeHTTP(rr, req)
+			return rr
+		}
+		if rr := retrieve("/retrieve_data/tuesday", ""); rr.Code != 200 || !bytes.Equal(rr.Body.Bytes(), tuesday) {
+			t.Errorf("Got status code %d and %d bytes, expected the %d bytes submitted", rr.Code, rr.Body.Len(), len(tuesday))
+		}
+		if rr := retrieve("/retrieve_data/tuesday", "bytes=99990-100019"); rr.Code != 206 || !bytes.Equal(rr.Body.Bytes(), tuesday[99990:100020]) {
+			t.Errorf("Got status code %d for a range, %q", rr.Code, rr.Body.Bytes())
+		}
+
+		// Damaged chunks make every file using them unhealthy, repairing
+		// one of the files repairs the chunk.
+		manifest, err := fm.readManifest(fm.DataPath("monday"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		chunkPath := fm.chunkFiles().DataPath(manifest.Chunks[0].Hash)
+		stored, err := ioutil.ReadFile(chunkPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stored[0] ^= 0xff
+		ioutil.WriteFile(chunkPath, stored, 0644)
+		for _, fname := range []string{"monday", "tuesday"} {
+			health, _, _, err := fm.CheckData(fname)
+			if err != nil || health {
+				t.Errorf("Got health %t for %s with a damaged chunk (error: %v)", health, fname, err)
+			}
+		}
+		rr := retrieve("/retrieve_data/monday?verify=true", "")
+		if rr.Header().Get("Reconstructed") != "" || rr.Code != 200 {
+			t.Errorf("Got status code %d verifying a file with a healthy manifest", rr.Code)
+		}
+		err = fm.RepairData("monday")
+		if err != nil {
+			t.Fatal(err)
+		}
+		health, _, _, err := fm.CheckData("tuesday")
+		if err != nil || !health {
+			t.Errorf("Got health %t after repairing the chunk (error: %v)", health, err)
+		}
+
+		// Reconstructing a damaged manifest still serves the contents.
+		manifestPath := fm.DataPath("tuesday")
+		stored, _ = ioutil.ReadFile(manifestPath)
+		stored[5] ^= 0xff
+		ioutil.WriteFile(manifestPath, stored, 0644)
+		rr = retrieve("/retrieve_data/tuesday?verify=true", "")
+		if rr.Header().Get("Reconstructed") != "true" || !bytes.Equal(rr.Body.Bytes(), tuesday) {
+			t.Errorf("Got status code %d and %d bytes for a damaged manifest", rr.Code, rr.Body.Len())
+		}
+		fm.RepairData("tuesday")
+
+		// Chunks stay until the last file using them is deleted.
+		if err := fm.Delete("monday", false, false); err != nil {
+			t.Fatal(err)
+		}
+		if rr := retrieve("/retrieve_data/tuesday", ""); !bytes.Equal(rr.Body.Bytes(), tuesday) {
+			t.Errorf("Lost contents of tuesday deleting monday")
+		}
+		if err := fm.Delete("tuesday", false, false); err != nil {
+			t.Fatal(err)
+		}
+		if left, _ := fm.chunkFiles().ListData(); len(left) != 0 {
+			t.Errorf("%d chunks left after deleting every file", len(left))
+		}
+		if refs := chunks.References(manifest.Chunks[0].Hash); refs != 0 {
+			t.Errorf("Got %d references to a removed chunk", refs)
+		}
+	}
+}
+
+func TestDedupBundle(t *testing.T) {
+	tmpDir := createTMPDir(t, "rsbackup")
+	config := &Config{BackupRoot: tmpDir, DataShards: 2, ParityShards: 1, Dedup: true}
+	chunks, err := NewChunkStore(path.Join(tmpDir, "chunks.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	api := &RSBackupAPI{Config: config, RsFileMan: &RSFileManager{Config: config, Chunks: chunks}}
+	submitTestData(t, api, "tyger")
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(api.exportBundleHandler).ServeHTTP(rr, httptest.NewRequest("GET", "/export_bundle/tyger", nil))
+	if rr.Code != http.StatusUnprocessableEntity {
+		t.Errorf("Got status code %d exporting a deduplicated file", rr.Code)
+	}
+}
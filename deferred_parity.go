@@ -0,0 +1,231 @@
+package rsbackup
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/sirmackk/rsutils"
+	log "github.com/sirupsen/logrus"
+)
+
+// parityJobKind is the kind of the jobs generating deferred parity.
+const parityJobKind = "parity"
+
+// pendingParity is a file stored with Config.DeferParity, by name and by
+// ID in case it's renamed before the job gets to it.
+type pendingParity struct {
+	Name string `json:"name"`
+	ID   string `json:"id"`
+}
+
+// ParityQueue persists the files whose parity is yet to be generated in a
+// json file, so a restart picks up where the last job left off. Files
+// leave the queue once their parity and metadata are stored.
+type ParityQueue struct {
+	mu      sync.Mutex
+	path    string
+	pending []pendingParity
+	// job is the ID of the job working through the queue, empty while
+	// none is.
+	job string
+}
+
+func NewParityQueue(fpath string) (*ParityQueue, error) {
+	q := &ParityQueue{path: fpath}
+	err := readJSONState(fpath, &q.pending)
+	if err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+// Len returns how many files wait for their parity.
+func (q *ParityQueue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.pending)
+}
+
+func (q *ParityQueue) add(fname, id string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.pending = append(q.pending, pendingParity{Name: fname, ID: id})
+	err := writeJSONState(q.path, q.pending)
+	if err != nil {
+		q.pending = q.pending[:len(q.pending)-1]
+	}
+	return err
+}
+
+func (q *ParityQueue) remove(item pendingParity) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for i, pending := range q.pending {
+		if pending == item {
+			q.pending = append(q.pending[:i:i], q.pending[i+1:]...)
+			return writeJSONState(q.path, q.pending)
+		}
+	}
+	return nil
+}
+
+// next returns the first file the job hasn't tried yet and how many
+// untried files there are. Once there are none, or stop is closed, the
+// job is done with the queue, in the same step so a file added right
+// after starts a new job.
+func (q *ParityQueue) next(tried map[pendingParity]bool, stop <-chan struct{}) (pendingParity, int, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var untried []pendingParity
+	for _, pending := range q.pending {
+		if !tried[pending] {
+			untried = append(untried, pending)
+		}
+	}
+	select {
+	case <-stop:
+		untried = nil
+	default:
+	}
+	if len(untried) == 0 {
+		q.job = ""
+		return pendingParity{}, 0, false
+	}
+	return untried[0], len(untried), true
+}
+
+// defersParity reports whether the parity of a file with extras is left
+// to the parity job.
+func (rs *RSBackupAPI) defersParity(extras MetadataExtras) bool {
+	return rs.Config.DeferParity && rs.ParityQueue != nil && extras.Packed == nil
+}
+
+// hashStored reads back the data file at fpath and returns the metadata
+// of a file without parity, whose single data shard is the data file. An
+// empty file has nothing worth deferring and gets none.
+func (r *RSFileManager) hashStored(fpath string) (*rsutils.Metadata, error) {
+	f, err := r.storage().Open(fpath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	n, err := io.Copy(h, f)
+	if err != nil || n == 0 {
+		return nil, err
+	}
+	return &rsutils.Metadata{Size: n, Hashes: []string{fmt.Sprintf("%x", h.Sum(nil))}, DataShards: 1}, nil
+}
+
+// drainParityQueue starts a job generating the parity of the queued
+// files, unless one is running already, and returns its ID.
+func (rs *RSBackupAPI) drainParityQueue() (string, error) {
+	q := rs.ParityQueue
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.job != "" || len(q.pending) == 0 {
+		return q.job, nil
+	}
+	jobs := rs.background().jobs
+	job, err := jobs.start(parityJobKind, rs.generateQueuedParity)
+	if err == errJobRunning {
+		// The last job let go of the queue but isn't marked finished yet.
+		jobs.waitKind(parityJobKind)
+		job, err = jobs.start(parityJobKind, rs.generateQueuedParity)
+	}
+	if err != nil {
+		return "", err
+	}
+	q.job = job.ID
+	return job.ID, nil
+}
+
+// generateQueuedParity generates the parity of the queued files, trying
+// each once. Files it fails on stay queued for the next job.
+func (rs *RSBackupAPI) generateQueuedParity(job *jobProgress, stop <-chan struct{}) error {
+	q := rs.ParityQueue
+	tried := make(map[pendingParity]bool)
+	for {
+		item, untried, ok := q.next(tried, stop)
+		if !ok {
+			return nil
+		}
+		job.setTotal(len(tried) + untried)
+		tried[item] = true
+		fname, err := rs.completeParity(item)
+		if err == nil {
+			err = q.remove(item)
+		}
+		if err != nil {
+			log.Errorf("Unable to generate the parity of %s, it stays queued: %s", item.Name, err)
+		} else if fname != "" {
+			rs.mirror(fname)
+		}
+		job.done(item.Name, err)
+	}
+}
+
+// completeParity generates the parity of a queued file, after checking
+// that the data file still matches the hash it was stored with, and
+// returns the name the file has now, empty if it was deleted meanwhile.
+// renameMu is held throughout, so the file stays where it is.
+func (rs *RSBackupAPI) completeParity(item pendingParity) (string, error) {
+	renameMu.Lock()
+	defer renameMu.Unlock()
+	fm := rs.RsFileMan
+	fname := item.Name
+	md, err := fm.readStoredMetadata(fm.DataPath(fname))
+	if (err == nil && md.ID != item.ID) || os.IsNotExist(err) {
+		fname, err = fm.NameOfID(item.ID)
+		if os.IsNotExist(err) {
+			return "", nil
+		}
+		if err == nil {
+			md, err = fm.readStoredMetadata(fm.DataPath(fname))
+		}
+	}
+	if err != nil {
+		return "", err
+	}
+	if !md.ParityPending {
+		return fname, nil
+	}
+	fpath := fm.DataPath(fname)
+	stored, err := fm.hashStored(fpath)
+	if err != nil {
+		return "", err
+	}
+	if stored == nil || stored.Size != md.Size || stored.Hashes[0] != md.Hashes[0] {
+		return "", fmt.Errorf("Data of '%s' doesn't match its hash, no parity generated", fname)
+	}
+	storage := fm.storage()
+	for _, suffix := range objectSuffixes(storage, fpath) {
+		if strings.HasPrefix(suffix, ".parity.") {
+			// Left over from an interrupted job.
+			storage.Remove(fpath + suffix)
+		}
+	}
+	md.Metadata, err = rs.generateParity(storage, fpath, &md.MetadataExtras)
+	if err != nil {
+		return "", err
+	}
+	md.ParityPending = false
+	return fname, fm.replaceMetadata(fpath, md)
+}
+
+// StartDeferredParity starts a job for the files left queued by the last
+// run, if any.
+func (rs *RSBackupAPI) StartDeferredParity() {
+	if rs.ParityQueue.Len() == 0 {
+		return
+	}
+	log.Infof("Generating the parity of %d files queued before the restart", rs.ParityQueue.Len())
+	_, err := rs.drainParityQueue()
+	if err != nil {
+		log.Errorf("Unable to start generating deferred parity: %s", err)
+	}
+}
@@ -0,0 +1,101 @@
+package rsbackup
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestDeferredParity(t *testing.T) {
+	conf := &Config{BackupRoot: createTMPDir(t, "rsbackup"), DataShards: 3, ParityShards: 2, DeferParity: true}
+	fm := &RSFileManager{Config: conf}
+	api := &RSBackupAPI{Config: conf, RsFileMan: fm}
+	queue, err := NewParityQueue(conf.StatePath("parity_queue.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	api.ParityQueue = queue
+	submit := func(fname, content string) submitDataRsp {
+		body := new(bytes.Buffer)
+		mw := multipart.NewWriter(body)
+		mw.WriteField("filename", fname)
+		fw, _ := mw.CreateFormFile("file", fname)
+		fw.Write([]byte(content))
+		mw.Close()
+		req := httptest.NewRequest("POST", "/submit_data", body)
+		req.Header.Set("Content-Type", mw.FormDataContentType())
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(api.submitDataHandler).ServeHTTP(rr, req)
+		var rsp submitDataRsp
+		if rr.Code != http.StatusOK || json.NewDecoder(rr.Body).Decode(&rsp) != nil {
+			t.Fatalf("Got status code %d submitting %s", rr.Code, fname)
+		}
+		return rsp
+	}
+
+	content := strings.Repeat("tyger tyger burning bright ", 100)
+	rsp := submit("tyger", content)
+	if rsp.ParityJob == "" || rsp.DataShards != 1 || rsp.ParityShards != 0 || rsp.Size != int64(len(content)) {
+		t.Fatalf("Got response %+v", rsp)
+	}
+	if job := waitForJob(t, api, rsp.ParityJob); job.State != jobDone || job.Done != 1 || len(job.Failed) != 0 {
+		t.Fatalf("Got job %+v", job)
+	}
+	md, err := fm.readStoredMetadata(fm.DataPath("tyger"))
+	if err != nil || md.ParityPending || md.DataShards != 3 || md.ParityShards != 2 || md.ID != rsp.ID {
+		t.Fatalf("Got metadata %+v (error: %v) once the parity is generated", md, err)
+	}
+	os.Remove(fm.DataPath("tyger") + ".parity.2")
+	if err := fm.RepairData("tyger"); err != nil {
+		t.Fatal(err)
+	}
+	if health, _, _, err := fm.CheckData("tyger"); err != nil || !health {
+		t.Errorf("Got health %t (error: %v) after repair", health, err)
+	}
+	if queue.Len() != 0 {
+		t.Errorf("Got %d files queued once done", queue.Len())
+	}
+
+	// The job waits for the file while it's damaged.
+	renameMu.Lock()
+	rsp = submit("lamb", content)
+	if err := ioutil.WriteFile(fm.DataPath("lamb"), []byte(strings.ToUpper(content)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	renameMu.Unlock()
+	if job := waitForJob(t, api, rsp.ParityJob); job.State != jobDone || len(job.Failed) != 1 {
+		t.Fatalf("Got job %+v for a damaged file", job)
+	}
+	if extras, err := fm.ReadExtras(fm.DataPath("lamb")); err != nil || !extras.ParityPending {
+		t.Errorf("Got extras %+v (error: %v) for a damaged file", extras, err)
+	}
+
+	// What's left in the queue is taken up after a restart, files deleted
+	// meanwhile are dropped.
+	if err := queue.add("gone", "0123"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(fm.DataPath("lamb"), []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	api.ParityQueue, err = NewParityQueue(conf.StatePath("parity_queue.json"))
+	if err != nil || api.ParityQueue.Len() != 2 {
+		t.Fatalf("Got %v queued files (error: %v) after a restart", api.ParityQueue, err)
+	}
+	job, err := api.drainParityQueue()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job := waitForJob(t, api, job); job.State != jobDone || job.Done != 2 || len(job.Failed) != 0 {
+		t.Fatalf("Got job %+v after a restart", job)
+	}
+	if health, _, _, err := fm.CheckData("lamb"); err != nil || !health || api.ParityQueue.Len() != 0 {
+		t.Errorf("Got health %t (error: %v) and %d files queued after a restart", health, err, api.ParityQueue.Len())
+	}
+}
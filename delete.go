@@ -0,0 +1,192 @@
+package rsbackup
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Delete removes the data, parity and metadata files of fname. The data
+// file goes first, so a delete cut short leaves no listed file behind.
+// With shred every file is overwritten with random bytes before it's
+// unlinked. override ignores the retention lock of fname.
+func (r *RSFileManager) Delete(fname string, shred, override bool) error {
+	renameMu.Lock()
+	defer renameMu.Unlock()
+	fpath := r.DataPath(fname)
+	_, err := r.storage().Stat(fpath)
+	if err != nil {
+		return err
+	}
+	err = r.checkMutable(fpath, override)
+	if err != nil {
+		return err
+	}
+	shared, err := r.readShared(fpath)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	entry, err := r.Journal.begin(opDelete, fname, "")
+	if err != nil {
+		return err
+	}
+	defer r.Journal.end(entry)
+	suffixes := objectSuffixes(r.storage(), fpath)
+	// objectSuffixes lists the data file last.
+	for i := len(suffixes) - 1; i >= 0; i-- {
+		if shred {
+			err = shredFile(r.storage(), fpath+suffixes[i])
+			if err != nil && !os.IsNotExist(err) {
+				return fmt.Errorf("Cannot shred '%s': %w", fname, err)
+			}
+		}
+		err = r.storage().Remove(fpath + suffixes[i])
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("Cannot delete '%s': %w", fname, err)
+		}
+	}
+	r.releaseShared(shared, shred)
+	r.unindex(fname)
+	return nil
+}
+
+// shredFile overwrites the contents of fpath with random bytes and syncs
+// them to disk. Filesystems that don't write in place, like copy-on-write
+// ones, may keep the old contents elsewhere regardless.
+func shredFile(storage StorageBackend, fpath string) error {
+	file, err := storage.OpenWritable(fpath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	stat, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	_, err = io.CopyN(file, rand.Reader, stat.Size())
+	if err != nil {
+		return err
+	}
+	err = file.Sync()
+	if err != nil {
+		return err
+	}
+	return file.Truncate(0)
+}
+
+// deleteHandler deletes a file along with its health record and quota
+// usage. With the trash enabled the file is moved there and its entry
+// returned. With shred=true, or ShredDeletes set, the files are instead
+// overwritten and unlinked right away, and the notes on the file and the
+// names it was renamed from are forgotten as well.
+func (rs *RSBackupAPI) deleteHandler(w http.ResponseWriter, r *http.Request) {
+	rs.deleteFile(w, r, false)
+}
+
+// forceDeleteHandler deletes a file like deleteHandler, even when its
+// retention lock hasn't expired yet. It's only for admins.
+func (rs *RSBackupAPI) forceDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	rs.deleteFile(w, r, true)
+}
+
+// deleteFile deletes the file named in the url of r. With ConfirmDeletes
+// set, it first only answers with a confirmation token, and deletes the
+// file once the same client repeats the request with confirm=<token>.
+func (rs *RSBackupAPI) deleteFile(w http.ResponseWriter, r *http.Request, override bool) {
+	if r.Method != "POST" {
+		rs.Errorf(r, "Bad method %s", r.Method)
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	fname, err := getFileNameParam(r.URL)
+	if err != nil {
+		rs.Errorf(r, "Can't delete file: %s", err)
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	shred := rs.Config.ShredDeletes || r.FormValue("shred") == "true"
+	by := requestNamespace(r)
+	if rs.Config.ConfirmDeletes {
+		token := r.FormValue("confirm")
+		if token == "" {
+			rs.requestDeleteConfirmation(w, r, pendingDelete{name: fname, by: by, shred: shred, override: override})
+			return
+		}
+		d, err := rs.deleteConfirmations().confirm(token, fname, by, override)
+		if err != nil {
+			rs.Errorf(r, "Can't delete %s: %s", fname, err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		// Deleted as requested, not as confirmed.
+		shred = d.shred
+	}
+	// Shredded files must not linger in the trash.
+	var trashed *TrashEntry
+	if rs.Trash != nil && !shred {
+		var entry TrashEntry
+		entry, err = rs.Trash.Put(rs.RsFileMan, fname, by, override)
+		trashed = &entry
+	} else {
+		err = rs.RsFileMan.Delete(fname, shred, override)
+	}
+	if err != nil {
+		rs.Errorf(r, "Unable to delete %s: %s", fname, err)
+		switch {
+		case os.IsNotExist(err):
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		case isLocked(err):
+			http.Error(w, err.Error(), http.StatusConflict)
+		default:
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		}
+		return
+	}
+	log.Infof("Deleted %s (by '%s', shredded: %t, trashed: %t, overriding retention: %t)", fname, by, shred, trashed != nil, override)
+	rs.forgetDeleted(fname, shred)
+	if trashed == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(trashed)
+	if err != nil {
+		rs.Errorf(r, "Unable to marshal json response: %s", err)
+	}
+}
+
+// forgetDeleted drops the health record, retrieval time and quota usage of
+// the deleted fname. Shredded files lose their annotations and rename
+// history too.
+func (rs *RSBackupAPI) forgetDeleted(fname string, shred bool) {
+	if rs.Health != nil {
+		if err := rs.Health.Forget(fname); err != nil {
+			log.Errorf("Unable to forget health of %s: %s", fname, err)
+		}
+	}
+	if rs.Tiering != nil {
+		if err := rs.Tiering.Forget(fname); err != nil {
+			log.Errorf("Unable to forget retrieval time of %s: %s", fname, err)
+		}
+	}
+	if rs.Quotas != nil {
+		if err := rs.Quotas.Release(fname); err != nil {
+			log.Errorf("Unable to release quota usage of %s: %s", fname, err)
+		}
+	}
+	if shred && rs.Annotations != nil {
+		if err := rs.Annotations.Forget(fname); err != nil {
+			log.Errorf("Unable to forget annotations of %s: %s", fname, err)
+		}
+	}
+	if shred && rs.Renames != nil {
+		if err := rs.Renames.Forget(fname); err != nil {
+			log.Errorf("Unable to forget renames of %s: %s", fname, err)
+		}
+	}
+}
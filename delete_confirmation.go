@@ -0,0 +1,101 @@
+package rsbackup
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// deleteConfirmationTTL is how long a delete may be confirmed after it was
+// requested.
+const deleteConfirmationTTL = time.Minute
+
+var errBadConfirmation = errors.New("Unknown or expired confirmation token")
+
+// pendingDelete is a delete waiting to be confirmed.
+type pendingDelete struct {
+	name     string
+	by       string
+	shred    bool
+	override bool
+	expires  time.Time
+}
+
+// deleteConfirmations holds the pending deletes by confirmation token.
+type deleteConfirmations struct {
+	mu      sync.Mutex
+	pending map[string]pendingDelete
+}
+
+// request returns a token confirming d.
+func (c *deleteConfirmations) request(d pendingDelete) (string, error) {
+	token, err := generateToken()
+	if err != nil {
+		return "", err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	for t, pending := range c.pending {
+		if now.After(pending.expires) {
+			delete(c.pending, t)
+		}
+	}
+	c.pending[token] = d
+	return token, nil
+}
+
+// confirm uses up token, which must have been issued for a delete of name
+// by the same client, and returns that delete.
+func (c *deleteConfirmations) confirm(token, name, by string, override bool) (pendingDelete, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	d, ok := c.pending[token]
+	if !ok || d.name != name || d.by != by || d.override != override {
+		return pendingDelete{}, errBadConfirmation
+	}
+	delete(c.pending, token)
+	if time.Now().After(d.expires) {
+		return pendingDelete{}, errBadConfirmation
+	}
+	return d, nil
+}
+
+// deleteConfirmations returns the deletes waiting to be confirmed.
+func (rs *RSBackupAPI) deleteConfirmations() *deleteConfirmations {
+	rs.confirmationsOnce.Do(func() {
+		rs.confirmations = &deleteConfirmations{pending: make(map[string]pendingDelete)}
+	})
+	return rs.confirmations
+}
+
+type deleteConfirmationRsp struct {
+	Name         string    `json:"name"`
+	ConfirmToken string    `json:"confirm_token"`
+	Expires      time.Time `json:"expires"`
+}
+
+// requestDeleteConfirmation answers a delete of fname that needs to be
+// confirmed with the token to repeat it with.
+func (rs *RSBackupAPI) requestDeleteConfirmation(w http.ResponseWriter, r *http.Request, d pendingDelete) {
+	if _, err := rs.RsFileMan.Stat(d.name); err != nil {
+		rs.Errorf(r, "Unable to delete %s: %s", d.name, err)
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+	d.expires = time.Now().Add(deleteConfirmationTTL).UTC()
+	token, err := rs.deleteConfirmations().request(d)
+	if err != nil {
+		rs.Errorf(r, "Unable to create confirmation token: %s", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	err = json.NewEncoder(w).Encode(deleteConfirmationRsp{Name: d.name, ConfirmToken: token, Expires: d.expires})
+	if err != nil {
+		rs.Errorf(r, "Unable to marshal json response: %s", err)
+	}
+}
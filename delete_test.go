@@ -0,0 +1,165 @@
+package rsbackup
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestShredFile(t *testing.T) {
+	tmpDir := createTMPDir(t, "rsbackup")
+	fpath := path.Join(tmpDir, "secret")
+	secret := bytes.Repeat([]byte("secret"), 10000)
+	err := os.WriteFile(fpath, secret, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Keep the file open, like a concurrent reader would, to see what the
+	// disk holds after shredding.
+	file, err := os.Open(fpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	err = shredFile(OSBackend{}, fpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stat, _ := file.Stat(); stat.Size() != 0 {
+		t.Errorf("Shredded file still has %d bytes", stat.Size())
+	}
+}
+
+func TestDeleteHandler(t *testing.T) {
+	tmpDir := createTMPDir(t, "rsbackup")
+	conf := &Config{BackupRoot: tmpDir, DataShards: 2, ParityShards: 1}
+	cloneShards(t, "tyger", tmpDir, conf)
+	cloneShards(t, "tyger_bad", tmpDir, conf)
+	health, err := NewHealthCache(conf.StatePath("health.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	annotations, err := NewAnnotationStore(conf.StatePath("annotations.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	renames, err := NewRenameHistory(conf.StatePath("renames.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, fname := range []string{"tyger", "tyger_bad"} {
+		health.Record(fname, true)
+		annotations.Add(fname, "from the poem", "operator")
+	}
+	renames.Record("the tiger", "tiger", "operator")
+	renames.Record("tiger", "tyger", "operator")
+	renames.Record("lion", "tyger_bad", "operator")
+	api := &RSBackupAPI{
+		Config:      conf,
+		RsFileMan:   &RSFileManager{Config: conf},
+		Health:      health,
+		Annotations: annotations,
+		Renames:     renames,
+	}
+
+	deleteTests := []struct {
+		name           string
+		method         string
+		url            string
+		expectedStatus int
+	}{
+		{"bad method", "GET", "/delete/tyger", 405},
+		{"file not found", "POST", "/delete/lion", 404},
+		{"delete", "POST", "/delete/tyger_bad", 204},
+		{"shred", "POST", "/delete/tyger?shred=true", 204},
+		{"already deleted", "POST", "/delete/tyger", 404},
+	}
+	for _, tt := range deleteTests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			http.HandlerFunc(api.deleteHandler).ServeHTTP(rr, httptest.NewRequest(tt.method, tt.url, nil))
+			if rr.Code != tt.expectedStatus {
+				t.Errorf("Got status code %d, expected %d", rr.Code, tt.expectedStatus)
+			}
+		})
+	}
+
+	for _, fname := range []string{"tyger", "tyger_bad"} {
+		for _, suffix := range []string{"", ".md", ".parity.1"} {
+			if _, err := os.Stat(path.Join(tmpDir, fname+suffix)); !os.IsNotExist(err) {
+				t.Errorf("%s%s left behind: %v", fname, suffix, err)
+			}
+		}
+		if _, ok := health.Get(fname); ok {
+			t.Errorf("Health of %s kept", fname)
+		}
+	}
+	// Notes and old names are only scrubbed when shredding.
+	if len(annotations.Get("tyger_bad")) != 1 {
+		t.Errorf("Notes on a deleted file were dropped")
+	}
+	if _, ok := renames.Resolve("lion"); !ok {
+		t.Errorf("Old name of a deleted file was dropped")
+	}
+	if len(annotations.Get("tyger")) != 0 {
+		t.Errorf("Notes on a shredded file were kept")
+	}
+	for _, name := range []string{"tiger", "the tiger"} {
+		if _, ok := renames.Resolve(name); ok {
+			t.Errorf("Old name %s of a shredded file was kept", name)
+		}
+	}
+}
+
+func TestDeleteConfirmation(t *testing.T) {
+	tmpDir := createTMPDir(t, "rsbackup")
+	conf := &Config{BackupRoot: tmpDir, DataShards: 2, ParityShards: 1, ConfirmDeletes: true}
+	cloneShards(t, "tyger", tmpDir, conf)
+	api := &RSBackupAPI{Config: conf, RsFileMan: &RSFileManager{Config: conf}}
+	del := func(target string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(api.deleteHandler).ServeHTTP(rr, httptest.NewRequest("POST", target, nil))
+		return rr
+	}
+
+	if rr := del("/delete/lion"); rr.Code != http.StatusNotFound {
+		t.Errorf("Got status code %d for a missing file, expected 404", rr.Code)
+	}
+	rr := del("/delete/tyger?shred=true")
+	if rr.Code != http.StatusAccepted {
+		t.Fatalf("Got status code %d, expected 202", rr.Code)
+	}
+	var rsp deleteConfirmationRsp
+	err := json.NewDecoder(rr.Body).Decode(&rsp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path.Join(tmpDir, "tyger")); err != nil {
+		t.Fatalf("Deleted before confirmation: %s", err)
+	}
+
+	confirmTests := []struct {
+		name           string
+		target         string
+		expectedStatus int
+	}{
+		{"wrong token", "/delete/tyger?confirm=0123", 400},
+		{"other file", "/delete/tyger_bad?confirm=" + rsp.ConfirmToken, 400},
+		{"confirmed", "/delete/tyger?confirm=" + rsp.ConfirmToken, 204},
+		{"token used up", "/delete/tyger?confirm=" + rsp.ConfirmToken, 400},
+	}
+	for _, tt := range confirmTests {
+		t.Run(tt.name, func(t *testing.T) {
+			if rr := del(tt.target); rr.Code != tt.expectedStatus {
+				t.Errorf("Got status code %d, expected %d", rr.Code, tt.expectedStatus)
+			}
+		})
+	}
+	if _, err := os.Stat(path.Join(tmpDir, "tyger")); !os.IsNotExist(err) {
+		t.Errorf("Confirmed delete left the file: %v", err)
+	}
+}
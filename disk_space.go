@@ -0,0 +1,93 @@
+package rsbackup
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"syscall"
+)
+
+var (
+	errFreeSpaceUnknown  = errors.New("Free space is unknown")
+	errInsufficientSpace = errors.New("Insufficient disk space")
+)
+
+// spaceReporter is a StorageBackend that knows how much can still be
+// written to it.
+type spaceReporter interface {
+	FreeSpace(dir string) (int64, error)
+}
+
+func (OSBackend) FreeSpace(dir string) (int64, error) {
+	return freeSpace(dir)
+}
+
+// freeSpace returns the bytes that can still be stored, or
+// errFreeSpaceUnknown if the storage can't tell.
+func (r *RSFileManager) freeSpace() (int64, error) {
+	reporter, ok := r.storage().(spaceReporter)
+	if !ok {
+		return 0, errFreeSpaceUnknown
+	}
+	return reporter.FreeSpace(r.Config.BackupRoot)
+}
+
+// isNoSpace reports whether err comes from storage running out of space.
+func isNoSpace(err error) bool {
+	return errors.Is(err, syscall.ENOSPC)
+}
+
+type diskSpaceRsp struct {
+	Error     string `json:"error"`
+	Requested int64  `json:"requested,omitempty"`
+	Available *int64 `json:"available,omitempty"`
+}
+
+// insufficientSpace rejects a request storage has no room for, requested
+// being the bytes it would have taken if known. Unlike quotaExceeded, no
+// namespace is reported: the whole server is out of space.
+func (rs *RSBackupAPI) insufficientSpace(w http.ResponseWriter, r *http.Request, requested int64) {
+	rsp := &diskSpaceRsp{Error: errInsufficientSpace.Error()}
+	if requested > 0 {
+		rsp.Requested = requested
+	}
+	if available, err := rs.RsFileMan.freeSpace(); err == nil {
+		rsp.Available = &available
+	}
+	rs.Errorf(r, "Not enough disk space to store %d bytes", requested)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusInsufficientStorage)
+	err := json.NewEncoder(w).Encode(rsp)
+	if err != nil {
+		rs.Errorf(r, "Unable to marshal json response: %s", err)
+	}
+}
+
+// checkDiskSpace rejects a request up front when storage has no room for
+// the bytes it declares, or none at all if it doesn't. Storage that can't
+// tell its free space lets every request through. It reports whether to go
+// on.
+func (rs *RSBackupAPI) checkDiskSpace(w http.ResponseWriter, r *http.Request, bytes int64) bool {
+	available, err := rs.RsFileMan.freeSpace()
+	if err != nil || bytes <= available && available > 0 {
+		return true
+	}
+	rs.insufficientSpace(w, r, bytes)
+	return false
+}
+
+// discardSaved removes the files stored for the data file at fpath when
+// it couldn't be protected, and releases the chunks or container space
+// extras say it took. Its metadata may not be written yet.
+func (r *RSFileManager) discardSaved(fpath string, extras MetadataExtras) {
+	var manifest *chunkManifest
+	if extras.Dedup != nil {
+		if f, err := r.storage().Open(fpath); err == nil {
+			manifest, _ = decodeManifest(f)
+			f.Close()
+		}
+	}
+	removeStoredObject(r.storage(), fpath, false)
+	r.releaseChunks(manifest, false)
+	r.releasePacked(extras.Packed, false)
+}
@@ -0,0 +1,17 @@
+//go:build linux
+// +build linux
+
+package rsbackup
+
+import "syscall"
+
+// freeSpace returns the bytes unprivileged processes can still write to
+// the filesystem holding dir.
+func freeSpace(dir string) (int64, error) {
+	var fs syscall.Statfs_t
+	err := syscall.Statfs(dir, &fs)
+	if err != nil {
+		return 0, err
+	}
+	return int64(fs.Bavail) * int64(fs.Bsize), nil
+}
@@ -0,0 +1,8 @@
+//go:build !linux
+// +build !linux
+
+package rsbackup
+
+func freeSpace(dir string) (int64, error) {
+	return 0, errFreeSpaceUnknown
+}
@@ -0,0 +1,92 @@
+package rsbackup
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+// fullBackend is a disk with free bytes left, where writes to files whose
+// names contain failing run out of space.
+type fullBackend struct {
+	OSBackend
+	free    int64
+	failing string
+}
+
+func (b fullBackend) FreeSpace(dir string) (int64, error) {
+	return b.free, nil
+}
+
+func (b fullBackend) CreateExclusive(fpath string) (StorageFile, error) {
+	f, err := b.OSBackend.CreateExclusive(fpath)
+	if err != nil || b.failing == "" || !strings.Contains(fpath, b.failing) {
+		return f, err
+	}
+	return fullFile{f}, nil
+}
+
+type fullFile struct {
+	StorageFile
+}
+
+func (f fullFile) Write(p []byte) (int, error) {
+	return 0, &os.PathError{Op: "write", Path: "full", Err: syscall.ENOSPC}
+}
+
+func TestDiskSpace(t *testing.T) {
+	tmpDir := createTMPDir(t, "rsbackup")
+	conf := &Config{BackupRoot: tmpDir, DataShards: 2, ParityShards: 1}
+	storage := &fullBackend{free: 1000}
+	api := &RSBackupAPI{Config: conf, RsFileMan: &RSFileManager{Config: conf, Storage: storage}}
+	submit := func(fname string, size int) *httptest.ResponseRecorder {
+		body := new(bytes.Buffer)
+		mw := multipart.NewWriter(body)
+		fw, err := mw.CreateFormFile("file", fname)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fw.Write(bytes.Repeat([]byte("a"), size))
+		mw.WriteField("filename", fname)
+		mw.Close()
+		req := httptest.NewRequest("POST", "/submit_data", body)
+		req.Header.Set("Content-Type", mw.FormDataContentType())
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(api.submitDataHandler).ServeHTTP(rr, req)
+		return rr
+	}
+	assertFull := func(rr *httptest.ResponseRecorder, available int64) {
+		var rsp diskSpaceRsp
+		if rr.Code != http.StatusInsufficientStorage || json.NewDecoder(rr.Body).Decode(&rsp) != nil {
+			t.Fatalf("Got status code %d", rr.Code)
+		}
+		if rsp.Error != errInsufficientSpace.Error() || rsp.Available == nil || *rsp.Available != available {
+			t.Errorf("Got response %+v", rsp)
+		}
+		if names, err := ioutil.ReadDir(tmpDir); err != nil || len(names) != 0 {
+			t.Errorf("Got %d files left behind (error: %v)", len(names), err)
+		}
+	}
+
+	// Data and parity of 1000 bytes don't fit.
+	assertFull(submit("big", 1000), 1000)
+	if rr := submit("small", 100); rr.Code != http.StatusOK {
+		t.Fatalf("Got status code %d submitting a file that fits", rr.Code)
+	}
+	if err := api.RsFileMan.Delete("small", false, false); err != nil {
+		t.Fatal(err)
+	}
+
+	storage.free = 1 << 30
+	storage.failing = ".parity."
+	assertFull(submit("parity", 100), 1<<30)
+	storage.failing = "data"
+	assertFull(submit("data", 100), 1<<30)
+}
@@ -0,0 +1,141 @@
+package rsbackup
+
+import (
+	"fmt"
+	"hash"
+	"io"
+	"runtime"
+	"sync"
+
+	"github.com/sirmackk/rsutils"
+)
+
+// encodeStripeSize is how much of each data shard is encoded at a time.
+var encodeStripeSize int64 = 256 << 10
+
+func encodeWorkers(config *Config) int {
+	if config.EncodeWorkers > 0 {
+		return config.EncodeWorkers
+	}
+	return runtime.GOMAXPROCS(0)
+}
+
+// encodeStripe is the same stretch of every shard, the unit of work when
+// computing parity. Stripes are hashed and written out in order.
+type encodeStripe struct {
+	off    int64
+	shards [][]byte
+	err    error
+	done   chan struct{}
+}
+
+// encodeStripes computes the parity of the size bytes of data, split into
+// dataShards, and writes it to parityWriters. Stripes are encoded by
+// Config.EncodeWorkers in parallel, while earlier ones are hashed and
+// written. Files Config.SegmentSize splits are hashed by segment too.
+func encodeStripes(data StorageFile, size int64, dataShards, parityShards int, config *Config, parityWriters []io.Writer) (*rsutils.Metadata, *SegmentInfo, error) {
+	enc, err := config.newCodec(config.codecName(), dataShards, parityShards)
+	if err != nil {
+		return nil, nil, err
+	}
+	workers := encodeWorkers(config)
+	md := &rsutils.Metadata{Size: size, DataShards: dataShards, ParityShards: parityShards}
+	s := &shardSet{md: md, chunkSize: (size + int64(dataShards) - 1) / int64(dataShards), data: data}
+
+	encode := func(stripe *encodeStripe) error {
+		stripeLen := s.chunkSize - stripe.off
+		if stripeLen > encodeStripeSize {
+			stripeLen = encodeStripeSize
+		}
+		stripe.shards = make([][]byte, dataShards+parityShards)
+		for i := range stripe.shards {
+			stripe.shards[i] = make([]byte, stripeLen)
+			if i < dataShards {
+				if err := s.readShardAt(i, stripe.shards[i], stripe.off); err != nil {
+					return err
+				}
+			}
+		}
+		if dataShards == 1 {
+			// The parity of a single data shard is copies of it.
+			for _, shard := range stripe.shards[1:] {
+				copy(shard, stripe.shards[0])
+			}
+			return nil
+		}
+		return enc.Encode(stripe.shards)
+	}
+
+	quit := make(chan struct{})
+	jobs := make(chan *encodeStripe)
+	// order holds stripes in file order, its capacity bounds how many are
+	// held in memory.
+	order := make(chan *encodeStripe, workers)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for stripe := range jobs {
+				stripe.err = encode(stripe)
+				close(stripe.done)
+			}
+		}()
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer close(order)
+		defer close(jobs)
+		for off := int64(0); off < s.chunkSize; off += encodeStripeSize {
+			stripe := &encodeStripe{off: off, done: make(chan struct{})}
+			select {
+			case order <- stripe:
+			case <-quit:
+				return
+			}
+			select {
+			case jobs <- stripe:
+			case <-quit:
+				return
+			}
+		}
+	}()
+
+	hashers := make([]hash.Hash, dataShards+parityShards)
+	for i := range hashers {
+		hashers[i] = newShardHash(config.shardHashName())
+	}
+	var segments *segmentHasher
+	if stripe := config.segmentStripe(size, dataShards); stripe > 0 {
+		segments = newSegmentHasher(stripe, dataShards+parityShards, config.shardHashName())
+	}
+	for stripe := range order {
+		<-stripe.done
+		err = stripe.err
+		for i := 0; err == nil && i < len(stripe.shards); i++ {
+			hashers[i].Write(stripe.shards[i])
+			if i >= dataShards {
+				_, err = parityWriters[i-dataShards].Write(stripe.shards[i])
+			}
+		}
+		if err != nil {
+			break
+		}
+		if segments != nil {
+			segments.write(stripe.shards)
+		}
+	}
+	close(quit)
+	wg.Wait()
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, h := range hashers {
+		md.Hashes = append(md.Hashes, fmt.Sprintf("%x", h.Sum(nil)))
+	}
+	if segments != nil {
+		return md, segments.segments(), nil
+	}
+	return md, nil, nil
+}
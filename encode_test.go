@@ -0,0 +1,75 @@
+package rsbackup
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/sirmackk/rsutils"
+)
+
+func TestWriteParityStripes(t *testing.T) {
+	defer func(size int64) { encodeStripeSize = size }(encodeStripeSize)
+	encodeStripeSize = 16
+	var tests = []struct {
+		size         int64
+		dataShards   int
+		parityShards int
+		workers      int
+	}{
+		{1, 2, 1, 1},
+		{16, 1, 1, 4},
+		{100, 3, 2, 1},
+		{100, 3, 2, 4},
+		{1000, 10, 4, 3},
+		{4097, 4, 2, 8},
+	}
+	dir := createTMPDir(t, "rsbackup")
+	for _, tt := range tests {
+		data := make([]byte, tt.size)
+		rand.Read(data)
+		fpath := dir + "/tyger"
+		if err := ioutil.WriteFile(fpath, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		md, _, err := writeParity(OSBackend{}, fpath, tt.dataShards, tt.parityShards, &Config{Fsync: fsyncOff, EncodeWorkers: tt.workers})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		f, err := os.Open(fpath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		chunks := rsutils.SplitIntoPaddedChunks(f, tt.size, tt.dataShards)
+		sources := make([]io.Reader, len(chunks))
+		for i := range chunks {
+			sources[i] = chunks[i]
+		}
+		parity := make([]bytes.Buffer, tt.parityShards)
+		writers := make([]io.Writer, tt.parityShards)
+		for i := range writers {
+			writers[i] = &parity[i]
+		}
+		expected, err := rsutils.NewShardCreator(sources, tt.size, tt.dataShards, tt.parityShards).Encode(writers)
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(md, expected) {
+			t.Errorf("Got metadata %+v for %+v, expected %+v", md, tt, expected)
+		}
+		for i := range parity {
+			got, _ := ioutil.ReadFile(fmt.Sprintf("%s.parity.%d", fpath, i+1))
+			if !bytes.Equal(got, parity[i].Bytes()) {
+				t.Errorf("Got different parity shard %d for %+v", i+1, tt)
+			}
+		}
+		removeStoredObject(OSBackend{}, fpath, false)
+	}
+}
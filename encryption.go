@@ -0,0 +1,485 @@
+package rsbackup
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirmackk/rsutils"
+)
+
+// Encrypted files are split into segments of encSegmentSize bytes, each
+// sealed on its own so that ranges can be decrypted without reading the
+// whole file.
+const encSegmentSize = 64 << 10
+
+var errUnknownKey = errors.New("Unknown encryption key")
+
+// EncryptionInfo is recorded in the metadata of encrypted files. The data
+// file holds the ciphertext and parity is computed over it, so checks and
+// repairs work on encrypted files without any keys.
+type EncryptionInfo struct {
+	// KeyID names the master key that wraps the data key.
+	KeyID string
+	// WrappedKey is the data key of the file sealed by the master key.
+	WrappedKey []byte
+	// Size is the size of the plaintext.
+	Size int64
+}
+
+// MetadataExtras are recorded in metadata files next to the shard
+// metadata.
+type MetadataExtras struct {
+	// ID identifies the file for good, whatever it's renamed to. Files
+	// stored before IDs were given out have none.
+	ID           string           `json:",omitempty"`
+	Encryption   *EncryptionInfo  `json:",omitempty"`
+	Sparse       *SparseInfo      `json:",omitempty"`
+	Compression  *CompressionInfo `json:",omitempty"`
+	Dedup        *DedupInfo       `json:",omitempty"`
+	Packed       *PackInfo        `json:",omitempty"`
+	ClientCipher *ClientCipher    `json:",omitempty"`
+	// Attributes are the POSIX attributes the file had on the client.
+	Attributes *FileAttributes `json:",omitempty"`
+	// Archive indexes the members of files submitted as archives.
+	Archive *ArchiveIndex `json:",omitempty"`
+	// StoredAt is when the file was submitted, StoredBy the namespace of
+	// the credential that submitted it.
+	StoredAt *time.Time `json:",omitempty"`
+	StoredBy string     `json:",omitempty"`
+	// Immutable files can't be deleted or renamed, see
+	// RSFileManager.checkMutable.
+	Immutable bool `json:",omitempty"`
+	// RetainUntil locks the file the same way until then, unless an
+	// admin overrides it.
+	RetainUntil *time.Time `json:",omitempty"`
+	// StorageClass is the Config.StorageClasses entry the file was
+	// submitted with, empty for the default.
+	StorageClass string `json:",omitempty"`
+	// Replicas is the number of copies a replicated file has, stored as
+	// the parity shards of a single data shard. 0 for shards.
+	Replicas int `json:",omitempty"`
+	// Codec names the codec that computed the parity, see RegisterCodec.
+	// Files stored before codecs were recorded used Reed-Solomon.
+	Codec string `json:",omitempty"`
+	// Hash names the algorithm of the shard hashes, see Config.ShardHash.
+	// Files stored before it was recorded used sha256.
+	Hash string `json:",omitempty"`
+	// Segments are set for files hashed by segment, see
+	// Config.SegmentSize.
+	Segments *SegmentInfo `json:",omitempty"`
+	// ParityPending is set while the parity of a file stored with
+	// Config.DeferParity is yet to be generated. Until then the data file
+	// is its only shard.
+	ParityPending bool `json:",omitempty"`
+	// Labels are the key/value pairs the file was submitted with, to
+	// select files by in listings.
+	Labels map[string]string `json:",omitempty"`
+	// UserMetadata holds opaque key/value pairs clients store with the
+	// file, returned with it.
+	UserMetadata map[string]string `json:",omitempty"`
+	// Tier is "cold" once the data and parity were moved to the cold
+	// storage target, see TieredBackend.
+	Tier string `json:",omitempty"`
+}
+
+// storedMetadata is the layout of metadata files.
+type storedMetadata struct {
+	*rsutils.Metadata
+	MetadataExtras
+	// Checksum is set by sealMetadata.
+	Checksum string `json:",omitempty"`
+}
+
+// KeyRing holds the master keys files may be encrypted with. New files are
+// encrypted with the active key, unless there is none.
+type KeyRing struct {
+	mu      sync.RWMutex
+	active  string
+	keys    map[string]cipher.AEAD
+	refs    map[string]string
+	secrets *SecretReader
+}
+
+// NewKeyRing loads the master keys listed in config.EncryptionKeys through
+// secrets. It returns nil when no keys are configured.
+func NewKeyRing(config *Config, secrets *SecretReader) (*KeyRing, error) {
+	if len(config.EncryptionKeys) == 0 {
+		return nil, nil
+	}
+	k := &KeyRing{active: config.EncryptionKeyID, refs: config.EncryptionKeys, secrets: secrets}
+	return k, k.Reload()
+}
+
+// Reload reads all master keys again. The keys in use are only replaced
+// once every key was read.
+func (k *KeyRing) Reload() error {
+	keys := make(map[string]cipher.AEAD)
+	for id, ref := range k.refs {
+		encoded, err := k.secrets.Read(ref)
+		if err != nil {
+			return err
+		}
+		key, err := hex.DecodeString(strings.TrimSpace(string(encoded)))
+		if err != nil || len(key) != 32 {
+			return fmt.Errorf("Key file of '%s' must hold 32 hex encoded bytes", id)
+		}
+		keys[id], err = newGCM(key)
+		if err != nil {
+			return err
+		}
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if _, ok := keys[k.active]; k.active != "" && !ok {
+		return fmt.Errorf("%w '%s'", errUnknownKey, k.active)
+	}
+	k.keys = keys
+	return nil
+}
+
+// Activate makes the key id the one new files are encrypted with. It
+// lasts until a restart, EncryptionKeyID must be changed to match.
+func (k *KeyRing) Activate(id string) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if _, ok := k.keys[id]; !ok {
+		return fmt.Errorf("%w '%s'", errUnknownKey, id)
+	}
+	k.active = id
+	return nil
+}
+
+// Active returns the id of the key new files are encrypted with.
+func (k *KeyRing) Active() string {
+	if k == nil {
+		return ""
+	}
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.active
+}
+
+func (k *KeyRing) key(id string) cipher.AEAD {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.keys[id]
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Encrypting reports whether new files are stored encrypted.
+func (k *KeyRing) Encrypting() bool {
+	return k.Active() != ""
+}
+
+// newDataKey returns a fresh data key and the info to record for it.
+func (k *KeyRing) newDataKey() ([]byte, *EncryptionInfo, error) {
+	dataKey := make([]byte, 32)
+	_, err := rand.Read(dataKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	info, err := k.wrap(dataKey)
+	return dataKey, info, err
+}
+
+// wrap seals dataKey with the active key.
+func (k *KeyRing) wrap(dataKey []byte) (*EncryptionInfo, error) {
+	k.mu.RLock()
+	id, master := k.active, k.keys[k.active]
+	k.mu.RUnlock()
+	nonce := make([]byte, master.NonceSize())
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+	wrapped := master.Seal(nonce, nonce, dataKey, []byte(id))
+	return &EncryptionInfo{KeyID: id, WrappedKey: wrapped}, nil
+}
+
+// unwrap opens the data key described by info.
+func (k *KeyRing) unwrap(info *EncryptionInfo) ([]byte, error) {
+	var master cipher.AEAD
+	if k != nil {
+		master = k.key(info.KeyID)
+	}
+	if master == nil {
+		return nil, fmt.Errorf("%w '%s'", errUnknownKey, info.KeyID)
+	}
+	nonceSize := master.NonceSize()
+	if len(info.WrappedKey) < nonceSize {
+		return nil, fmt.Errorf("Wrapped key too short")
+	}
+	dataKey, err := master.Open(nil, info.WrappedKey[:nonceSize], info.WrappedKey[nonceSize:], []byte(info.KeyID))
+	if err != nil {
+		return nil, fmt.Errorf("Cannot unwrap data key: %s", err)
+	}
+	return dataKey, nil
+}
+
+// rewrap returns info with the data key wrapped by the active key.
+func (k *KeyRing) rewrap(info *EncryptionInfo) (*EncryptionInfo, error) {
+	dataKey, err := k.unwrap(info)
+	if err != nil {
+		return nil, err
+	}
+	rewrapped, err := k.wrap(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	rewrapped.Size = info.Size
+	return rewrapped, nil
+}
+
+// dataCipher unwraps the data key described by info.
+func (k *KeyRing) dataCipher(info *EncryptionInfo) (*segmentCipher, error) {
+	dataKey, err := k.unwrap(info)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	return &segmentCipher{aead: aead, size: info.Size}, nil
+}
+
+// segmentCipher seals and opens the segments of a file of size bytes.
+// Segment nonces are their index, with the last byte set for the final
+// segment so that truncated files don't decrypt.
+type segmentCipher struct {
+	aead cipher.AEAD
+	size int64
+}
+
+func (c *segmentCipher) segments() int64 {
+	if c.size == 0 {
+		return 1
+	}
+	return (c.size + encSegmentSize - 1) / encSegmentSize
+}
+
+func (c *segmentCipher) nonce(i int64, final bool) []byte {
+	nonce := make([]byte, c.aead.NonceSize())
+	binary.BigEndian.PutUint64(nonce, uint64(i))
+	if final {
+		nonce[len(nonce)-1] = 1
+	}
+	return nonce
+}
+
+// sealedLen returns the size of segment i once sealed.
+func (c *segmentCipher) sealedLen(i int64) int64 {
+	n := c.size - i*encSegmentSize
+	if n > encSegmentSize {
+		n = encSegmentSize
+	}
+	return n + int64(c.aead.Overhead())
+}
+
+func (c *segmentCipher) open(i int64, sealed []byte) ([]byte, error) {
+	plain, err := c.aead.Open(nil, c.nonce(i, i == c.segments()-1), sealed, nil)
+	if err != nil {
+		return nil, fmt.Errorf("Segment %d fails authentication", i)
+	}
+	return plain, nil
+}
+
+// encryptTo writes src to dst sealed with aead, returning the size of the
+// plaintext.
+func encryptTo(dst io.Writer, src io.Reader, aead cipher.AEAD) (int64, error) {
+	c := &segmentCipher{aead: aead}
+	cur := make([]byte, encSegmentSize)
+	next := make([]byte, encSegmentSize)
+	n, err := io.ReadFull(src, cur)
+	var size int64
+	for i := int64(0); ; i++ {
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return size, err
+		}
+		final := err != nil
+		var m int
+		if !final {
+			// Only reading ahead tells whether this is the last segment.
+			m, err = io.ReadFull(src, next)
+			final = m == 0 && err == io.EOF
+		}
+		_, werr := dst.Write(aead.Seal(nil, c.nonce(i, final), cur[:n], nil))
+		if werr != nil {
+			return size, werr
+		}
+		size += int64(n)
+		if final {
+			return size, nil
+		}
+		cur, next, n = next, cur, m
+	}
+}
+
+// decryptingReader gives random access to the plaintext of a file sealed
+// by encryptTo, so it can be served with range requests.
+type decryptingReader struct {
+	src    io.ReaderAt
+	c      *segmentCipher
+	pos    int64
+	cached int64
+	plain  []byte
+}
+
+func newDecryptingReader(src io.ReaderAt, c *segmentCipher) *decryptingReader {
+	return &decryptingReader{src: src, c: c, cached: -1}
+}
+
+func (d *decryptingReader) Read(p []byte) (int, error) {
+	if d.pos >= d.c.size {
+		return 0, io.EOF
+	}
+	i := d.pos / encSegmentSize
+	if i != d.cached {
+		sealedSize := int64(encSegmentSize + d.c.aead.Overhead())
+		sealed := make([]byte, d.c.sealedLen(i))
+		_, err := d.src.ReadAt(sealed, i*sealedSize)
+		if err != nil && err != io.EOF {
+			return 0, err
+		}
+		d.plain, err = d.c.open(i, sealed)
+		if err != nil {
+			return 0, err
+		}
+		d.cached = i
+	}
+	n := copy(p, d.plain[d.pos-i*encSegmentSize:])
+	d.pos += int64(n)
+	return n, nil
+}
+
+func (d *decryptingReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += d.pos
+	case io.SeekEnd:
+		offset += d.c.size
+	default:
+		return 0, fmt.Errorf("Invalid whence %d", whence)
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("Negative position %d", offset)
+	}
+	d.pos = offset
+	return offset, nil
+}
+
+// decryptingWriter decrypts ciphertext written to it in order and passes
+// the plaintext on to w.
+type decryptingWriter struct {
+	w      io.Writer
+	c      *segmentCipher
+	i      int64
+	sealed []byte
+}
+
+func (d *decryptingWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		if d.i >= d.c.segments() {
+			return written, fmt.Errorf("Ciphertext longer than expected")
+		}
+		want := int(d.c.sealedLen(d.i)) - len(d.sealed)
+		if want > len(p) {
+			want = len(p)
+		}
+		d.sealed = append(d.sealed, p[:want]...)
+		p = p[want:]
+		written += want
+		if int64(len(d.sealed)) < d.c.sealedLen(d.i) {
+			continue
+		}
+		plain, err := d.c.open(d.i, d.sealed)
+		if err != nil {
+			return written, err
+		}
+		_, err = d.w.Write(plain)
+		if err != nil {
+			return written, err
+		}
+		d.sealed = d.sealed[:0]
+		d.i++
+	}
+	return written, nil
+}
+
+// ReadExtras returns what the metadata of the file at fpath records
+// besides the shards.
+func (r *RSFileManager) ReadExtras(fpath string) (MetadataExtras, error) {
+	md, err := r.readStoredMetadata(fpath)
+	if err != nil {
+		return MetadataExtras{}, err
+	}
+	return md.MetadataExtras, nil
+}
+
+// ReadEncryption returns the encryption details recorded in the metadata
+// of the file at fpath, or nil if it isn't encrypted.
+func (r *RSFileManager) ReadEncryption(fpath string) (*EncryptionInfo, error) {
+	extras, err := r.ReadExtras(fpath)
+	return extras.Encryption, err
+}
+
+// openPlaintext opens the stored contents of fname for reading,
+// decrypting them if the file is encrypted. It also returns the size of
+// the contents.
+func (r *RSFileManager) openPlaintext(fname string) (io.ReadSeeker, io.Closer, int64, error) {
+	fpath := r.DataPath(fname)
+	content, file, err := r.openStored(fpath)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	info, err := r.ReadEncryption(fpath)
+	if err != nil && !os.IsNotExist(err) {
+		file.Close()
+		return nil, nil, 0, err
+	}
+	if info == nil {
+		return content, file, content.Size(), nil
+	}
+	c, err := r.Keys.dataCipher(info)
+	if err != nil {
+		file.Close()
+		return nil, nil, 0, err
+	}
+	return newDecryptingReader(content, c), file, info.Size, nil
+}
+
+// plaintextWriter returns a writer that turns the stored contents of fname
+// written to it into plaintext on w, and the size of the plaintext.
+func (r *RSFileManager) plaintextWriter(w io.Writer, fname string, storedSize int64) (io.Writer, int64, error) {
+	info, err := r.ReadEncryption(r.DataPath(fname))
+	if err != nil {
+		return nil, 0, err
+	}
+	if info == nil {
+		return w, storedSize, nil
+	}
+	c, err := r.Keys.dataCipher(info)
+	if err != nil {
+		return nil, 0, err
+	}
+	return &decryptingWriter{w: w, c: c}, info.Size, nil
+}
@@ -0,0 +1,178 @@
+package rsbackup
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestEncryptionRoundTrip(t *testing.T) {
+	aead, err := newGCM(bytes.Repeat([]byte{7}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, size := range []int{0, 1, encSegmentSize, encSegmentSize + 1, 3*encSegmentSize - 5} {
+		plain := make([]byte, size)
+		rand.Read(plain)
+		sealed := new(bytes.Buffer)
+		n, err := encryptTo(sealed, bytes.NewReader(plain), aead)
+		if err != nil || n != int64(size) {
+			t.Fatalf("Encrypting %d bytes: got %d, %v", size, n, err)
+		}
+		c := &segmentCipher{aead: aead, size: int64(size)}
+
+		reader := newDecryptingReader(bytes.NewReader(sealed.Bytes()), c)
+		off := int64(size / 3)
+		reader.Seek(off, io.SeekStart)
+		got, err := ioutil.ReadAll(reader)
+		if err != nil || !bytes.Equal(got, plain[off:]) {
+			t.Errorf("Reading %d bytes from %d: got %d bytes, %v", size, off, len(got), err)
+		}
+
+		written := new(bytes.Buffer)
+		writer := &decryptingWriter{w: written, c: c}
+		for rest := sealed.Bytes(); len(rest) > 0; {
+			chunk := 1000
+			if chunk > len(rest) {
+				chunk = len(rest)
+			}
+			_, err = writer.Write(rest[:chunk])
+			if err != nil {
+				t.Fatalf("Writing %d bytes: %s", size, err)
+			}
+			rest = rest[chunk:]
+		}
+		if !bytes.Equal(written.Bytes(), plain) {
+			t.Errorf("Decrypting writer got %d bytes, expected %d", written.Len(), size)
+		}
+
+		// Dropping the final segment must not go unnoticed.
+		if size > encSegmentSize {
+			truncated := &segmentCipher{aead: aead, size: encSegmentSize}
+			_, err = ioutil.ReadAll(newDecryptingReader(bytes.NewReader(sealed.Bytes()), truncated))
+			if err == nil {
+				t.Errorf("Truncated %d bytes decrypted", size)
+			}
+		}
+	}
+}
+
+func TestEncryptedStorage(t *testing.T) {
+	tmpDir := createTMPDir(t, "rsbackup")
+	keyPath := path.Join(tmpDir, "master.key")
+	err := ioutil.WriteFile(keyPath, []byte(strings.Repeat("ab", 32)+"\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &Config{
+		BackupRoot:      tmpDir,
+		DataShards:      2,
+		ParityShards:    1,
+		EncryptionKeys:  map[string]string{"2026": keyPath},
+		EncryptionKeyID: "2026",
+	}
+	keys, err := NewKeyRing(config, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	api := &RSBackupAPI{Config: config, RsFileMan: &RSFileManager{Config: config, Keys: keys}}
+	data := make([]byte, 3*encSegmentSize/2)
+	rand.Read(data)
+
+	body := new(bytes.Buffer)
+	mw := multipart.NewWriter(body)
+	fw, err := mw.CreateFormFile("file", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fw.Write(data)
+	mw.WriteField("filename", "secret")
+	mw.Close()
+	req := httptest.NewRequest("POST", "/submit_data", body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(api.submitDataHandler).ServeHTTP(rr, req)
+	if rr.Code != 200 {
+		t.Fatalf("Got status code %d, expected 200: %s", rr.Code, rr.Body)
+	}
+
+	stored, err := ioutil.ReadFile(path.Join(tmpDir, "secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(stored, data[:64]) {
+		t.Errorf("Data file holds plaintext")
+	}
+	info, err := api.RsFileMan.ReadEncryption(path.Join(tmpDir, "secret"))
+	if err != nil || info == nil || info.KeyID != "2026" || info.Size != int64(len(data)) {
+		t.Fatalf("Got encryption info %+v, %v", info, err)
+	}
+
+	retrieve := func(url, rangeHeader string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", url, nil)
+		if rangeHeader != "" {
+			req.Header.Set("Range", rangeHeader)
+		}
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(api.retrieveDataHandler).ServeHTTP(rr, req)
+		return rr
+	}
+	if rr := retrieve("/retrieve_data/secret", ""); rr.Code != 200 || !bytes.Equal(rr.Body.Bytes(), data) {
+		t.Errorf("Got status code %d and %d bytes, expected the %d bytes submitted", rr.Code, rr.Body.Len(), len(data))
+	}
+	if rr := retrieve("/retrieve_data/secret", "bytes=65530-65545"); rr.Code != 206 || !bytes.Equal(rr.Body.Bytes(), data[65530:65546]) {
+		t.Errorf("Range across segments: got status code %d, %q", rr.Code, rr.Body.Bytes())
+	}
+
+	// Checks and repairs work on the ciphertext, reconstruction decrypts.
+	stored[10] ^= 0xff
+	err = ioutil.WriteFile(path.Join(tmpDir, "secret"), stored, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr = retrieve("/retrieve_data/secret?verify=true", "")
+	if rr.Code != 200 || rr.Header().Get("Reconstructed") != "true" || !bytes.Equal(rr.Body.Bytes(), data) {
+		t.Errorf("Got status code %d and %d bytes for a damaged file", rr.Code, rr.Body.Len())
+	}
+	err = api.RsFileMan.RepairData("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rr := retrieve("/retrieve_data/secret", ""); !bytes.Equal(rr.Body.Bytes(), data) {
+		t.Errorf("Repaired file doesn't decrypt to the submitted data")
+	}
+
+	// Without the key the file can be checked but not read.
+	api.RsFileMan.Keys = nil
+	if rr := retrieve("/retrieve_data/secret", ""); rr.Code != 500 {
+		t.Errorf("Got status code %d without the key, expected 500", rr.Code)
+	}
+	healthy, _, _, err := api.RsFileMan.CheckData("secret")
+	if err != nil || !healthy {
+		t.Errorf("Check without the key failed: %t, %v", healthy, err)
+	}
+}
+
+func TestNewKeyRing(t *testing.T) {
+	tmpDir := createTMPDir(t, "rsbackup")
+	shortKey := path.Join(tmpDir, "short.key")
+	ioutil.WriteFile(shortKey, []byte("abcd"), 0600)
+	if _, err := NewKeyRing(&Config{EncryptionKeys: map[string]string{"short": shortKey}}, nil); err == nil {
+		t.Errorf("Accepted a short key")
+	}
+	if _, err := NewKeyRing(&Config{EncryptionKeys: map[string]string{"missing": path.Join(tmpDir, "missing.key")}}, nil); !os.IsNotExist(err) {
+		t.Errorf("Got %v for a missing key file", err)
+	}
+	keys, err := NewKeyRing(&Config{}, nil)
+	if keys != nil || err != nil || keys.Encrypting() {
+		t.Errorf("Got %v, %v without keys", keys, err)
+	}
+}
@@ -0,0 +1,55 @@
+package rsbackup
+
+import (
+	"strings"
+
+	"github.com/klauspost/cpuid/v2"
+	"github.com/klauspost/reedsolomon"
+)
+
+// Values of Config.ErasureCoding.
+const (
+	erasureSIMD    = "simd"
+	erasureGeneric = "generic"
+)
+
+// erasureCoder returns the Reed-Solomon coder Config.ErasureCoding picks
+// for dataShards and parityShards. Both compute the same shards, the SIMD
+// one with whichever vector instructions the CPU has.
+func (c *Config) erasureCoder(dataShards, parityShards int) (reedsolomon.Encoder, error) {
+	if c.ErasureCoding != erasureGeneric {
+		return reedsolomon.New(dataShards, parityShards)
+	}
+	return reedsolomon.New(dataShards, parityShards,
+		reedsolomon.WithSSE2(false), reedsolomon.WithSSSE3(false), reedsolomon.WithAVX2(false),
+		reedsolomon.WithAVX512(false), reedsolomon.WithGFNI(false), reedsolomon.WithAVXGFNI(false),
+		reedsolomon.WithNEON(false), reedsolomon.WithSVE(false))
+}
+
+// DescribeErasureCoding says how the Reed-Solomon coder Config.ErasureCoding
+// picks runs on this CPU.
+func (c *Config) DescribeErasureCoding() string {
+	if c.ErasureCoding == erasureGeneric {
+		return "generic code"
+	}
+	var features []string
+	for _, f := range []struct {
+		name string
+		id   cpuid.FeatureID
+	}{
+		{"avx512", cpuid.AVX512F},
+		{"gfni", cpuid.GFNI},
+		{"avx2", cpuid.AVX2},
+		{"ssse3", cpuid.SSSE3},
+		{"neon", cpuid.ASIMD},
+		{"sve", cpuid.SVE},
+	} {
+		if cpuid.CPU.Supports(f.id) {
+			features = append(features, f.name)
+		}
+	}
+	if len(features) == 0 {
+		return "generic code, the CPU has no SIMD instructions it uses"
+	}
+	return "SIMD (" + strings.Join(features, ", ") + ")"
+}
@@ -0,0 +1,41 @@
+package rsbackup
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+func TestErasureCoders(t *testing.T) {
+	data := make([]byte, 10000)
+	rand.Read(data)
+	var parity [][]byte
+	for _, coding := range []string{"", erasureSIMD, erasureGeneric} {
+		config := &Config{ErasureCoding: coding}
+		enc, err := config.erasureCoder(4, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		shards, err := enc.Split(append([]byte(nil), data...))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := enc.Encode(shards); err != nil {
+			t.Fatal(err)
+		}
+		if parity == nil {
+			parity = shards[4:]
+		}
+		for i := range parity {
+			if !bytes.Equal(shards[4+i], parity[i]) {
+				t.Errorf("Got different parity shard %d from the %q coder", i, coding)
+			}
+		}
+		if config.DescribeErasureCoding() == "" {
+			t.Errorf("Got no description of the %q coder", coding)
+		}
+	}
+	if err := (&Config{BackupRoot: "/tmp", DataShards: 1, ParityShards: 1, ErasureCoding: "avx"}).Validate(); err == nil {
+		t.Errorf("Expected an unknown ErasureCoding to be refused")
+	}
+}
@@ -0,0 +1,148 @@
+package rsbackup
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// eventBuffer is how many events a subscriber may fall behind by before
+// it misses some.
+const eventBuffer = 64
+
+// eventKeepalive is how often an idle stream gets a comment, so proxies
+// don't time it out.
+var eventKeepalive = 30 * time.Second
+
+// StorageEvent is something that happened to a stored file, as recorded in
+// its history.
+type StorageEvent struct {
+	ID     uint64    `json:"id"`
+	Time   time.Time `json:"time"`
+	Event  string    `json:"event"`
+	Name   string    `json:"name"`
+	Detail string    `json:"detail,omitempty"`
+}
+
+// EventFeed hands storage events to the clients streaming them. Nothing is
+// kept for clients that aren't connected.
+type EventFeed struct {
+	mu          sync.Mutex
+	lastID      uint64
+	subscribers map[chan StorageEvent]struct{}
+	closed      bool
+}
+
+func NewEventFeed() *EventFeed {
+	return &EventFeed{subscribers: make(map[chan StorageEvent]struct{})}
+}
+
+// Publish numbers event and sends it to every subscriber. A subscriber
+// too far behind misses it rather than holding up the caller.
+func (f *EventFeed) Publish(event StorageEvent) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.lastID++
+	event.ID = f.lastID
+	for ch := range f.subscribers {
+		select {
+		case ch <- event:
+		default:
+			log.Warnf("Event subscriber fell behind, dropped event %d", event.ID)
+		}
+	}
+}
+
+// Subscribe returns a channel of the events published from now on and a
+// function to stop them. The channel is closed when the feed is.
+func (f *EventFeed) Subscribe() (<-chan StorageEvent, func()) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	ch := make(chan StorageEvent, eventBuffer)
+	if f.closed {
+		close(ch)
+		return ch, func() {}
+	}
+	f.subscribers[ch] = struct{}{}
+	return ch, func() {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		if _, ok := f.subscribers[ch]; ok {
+			delete(f.subscribers, ch)
+			close(ch)
+		}
+	}
+}
+
+// Close ends every subscription, so streams don't hold up a shutdown.
+func (f *EventFeed) Close() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.closed = true
+	for ch := range f.subscribers {
+		delete(f.subscribers, ch)
+		close(ch)
+	}
+}
+
+// eventsHandler streams storage events as server-sent events, those named
+// in the comma separated event parameter or all of them.
+func (rs *RSBackupAPI) eventsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		rs.Errorf(r, "Bad method %s", r.Method)
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		rs.Errorf(r, "Unable to stream events, the response can't be flushed")
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	var wanted map[string]bool
+	if param := r.FormValue("event"); param != "" {
+		wanted = make(map[string]bool)
+		for _, event := range strings.Split(param, ",") {
+			wanted[strings.TrimSpace(event)] = true
+		}
+	}
+	events, stop := rs.Events.Subscribe()
+	defer stop()
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	keepalive := time.NewTicker(eventKeepalive)
+	defer keepalive.Stop()
+	for {
+		var err error
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepalive.C:
+			_, err = fmt.Fprint(w, ": keepalive\n\n")
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+			if wanted != nil && !wanted[event.Event] {
+				continue
+			}
+			var data []byte
+			data, err = json.Marshal(event)
+			if err == nil {
+				_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.ID, event.Event, data)
+			}
+		}
+		if err != nil {
+			rs.Errorf(r, "Unable to stream events: %s", err)
+			return
+		}
+		flusher.Flush()
+	}
+}
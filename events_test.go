@@ -0,0 +1,126 @@
+package rsbackup
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEventsStream(t *testing.T) {
+	config := &Config{BackupRoot: createTMPDir(t, "rsbackup")}
+	api := &RSBackupAPI{Config: config, RsFileMan: &RSFileManager{Config: config}, Events: NewEventFeed()}
+	server := httptest.NewServer(http.HandlerFunc(api.eventsHandler))
+	defer server.Close()
+	rsp, err := http.Get(server.URL + "/events?event=corruption_found,repaired")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode != http.StatusOK || rsp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("Got status code %d and content type %s", rsp.StatusCode, rsp.Header.Get("Content-Type"))
+	}
+	// The handler subscribes before answering, so nothing published from
+	// here on is missed.
+	api.recordEvent("tyger", eventChecked, "scrub")
+	api.recordEvent("tyger", eventCorruptionFound, "scrub")
+	api.recordEvent("tyger", eventRepaired, "")
+
+	type message struct {
+		id, event string
+		data      StorageEvent
+	}
+	lines := bufio.NewScanner(rsp.Body)
+	next := func() message {
+		var msg message
+		for lines.Scan() {
+			line := lines.Text()
+			switch {
+			case line == "":
+				return msg
+			case strings.HasPrefix(line, "id: "):
+				msg.id = strings.TrimPrefix(line, "id: ")
+			case strings.HasPrefix(line, "event: "):
+				msg.event = strings.TrimPrefix(line, "event: ")
+			case strings.HasPrefix(line, "data: "):
+				if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &msg.data); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+		t.Fatalf("Stream ended: %v", lines.Err())
+		return msg
+	}
+	if msg := next(); msg.id != "2" || msg.event != eventCorruptionFound || msg.data.Name != "tyger" || msg.data.Detail != "scrub" || msg.data.Time.IsZero() {
+		t.Errorf("Got message %+v", msg)
+	}
+	if msg := next(); msg.id != "3" || msg.event != eventRepaired {
+		t.Errorf("Got message %+v", msg)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		for lines.Scan() {
+		}
+		close(done)
+	}()
+	api.Events.Close()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the stream to end when the feed is closed")
+	}
+}
+
+// The middleware wraps the response writer, which must still flush.
+func TestEventsStreamThroughMiddleware(t *testing.T) {
+	config := &Config{BackupRoot: createTMPDir(t, "rsbackup"), RateLimitRequests: 10, RateLimitBurst: 10, RateLimitBandwidth: 1 << 20}
+	audit, err := NewAuditLog(path.Join(config.BackupRoot, "audit.log"), 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	api := &RSBackupAPI{Config: config, RsFileMan: &RSFileManager{Config: config}, Events: NewEventFeed(), Tokens: newTestTokenStore(t), Audit: audit}
+	handler := api.audited("events", false, api.authenticated(ScopeRead, api.rateLimited(newRateLimiter(config), api.eventsHandler)))
+	server := httptest.NewServer(handler)
+	defer server.Close()
+	req, _ := http.NewRequest("GET", server.URL+"/events", nil)
+	req.Header.Set("Authorization", "Bearer "+testReaderSecret)
+	rsp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode != http.StatusOK {
+		t.Fatalf("Got status code %d", rsp.StatusCode)
+	}
+	api.recordEvent("tyger", eventRepaired, "")
+	lines := bufio.NewScanner(rsp.Body)
+	for lines.Scan() {
+		if lines.Text() == "event: "+eventRepaired {
+			api.Events.Close()
+			return
+		}
+	}
+	t.Fatalf("Stream ended before the event: %v", lines.Err())
+}
+
+func TestEventFeedSlowSubscriber(t *testing.T) {
+	feed := NewEventFeed()
+	events, stop := feed.Subscribe()
+	for i := 0; i < eventBuffer+10; i++ {
+		feed.Publish(StorageEvent{Event: eventRetrieved, Name: "lamb"})
+	}
+	if len(events) != eventBuffer {
+		t.Errorf("Got %d events buffered", len(events))
+	}
+	stop()
+	stop()
+	feed.Close()
+	if _, ok := <-events; !ok {
+		t.Errorf("Expected the buffered events to be readable after stopping")
+	}
+}
@@ -0,0 +1,144 @@
+package rsbackup
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Limits on the extended attributes of a file, those of Linux.
+const (
+	maxXattrName  = 255
+	maxXattrBytes = 64 << 10
+)
+
+// FileAttributes are the POSIX attributes a file had on the client that
+// submitted it. The server stores them untouched with the metadata and
+// hands them back on retrieval, so restores can put them back.
+type FileAttributes struct {
+	// Mode holds the permission bits, setuid, setgid and sticky included,
+	// in octal.
+	Mode  string     `json:"mode,omitempty"`
+	Mtime *time.Time `json:"mtime,omitempty"`
+	UID   *int       `json:"uid,omitempty"`
+	GID   *int       `json:"gid,omitempty"`
+	Owner string     `json:"owner,omitempty"`
+	Group string     `json:"group,omitempty"`
+	// Xattrs maps the names of extended attributes to their values.
+	Xattrs map[string][]byte `json:"xattrs,omitempty"`
+}
+
+// Retrievals of files submitted with attributes carry them in these
+// headers. There's a File-Xattr header for every extended attribute, its
+// value being the name, '=' and the base64 encoded value.
+const (
+	fileModeHeader  = "File-Mode"
+	fileMtimeHeader = "File-Mtime"
+	fileUIDHeader   = "File-Uid"
+	fileGIDHeader   = "File-Gid"
+	fileOwnerHeader = "File-Owner"
+	fileGroupHeader = "File-Group"
+	fileXattrHeader = "File-Xattr"
+)
+
+func (a *FileAttributes) setHeaders(h http.Header) {
+	if a.Mode != "" {
+		h.Set(fileModeHeader, a.Mode)
+	}
+	if a.Mtime != nil {
+		h.Set(fileMtimeHeader, a.Mtime.Format(time.RFC3339Nano))
+	}
+	if a.UID != nil {
+		h.Set(fileUIDHeader, strconv.Itoa(*a.UID))
+	}
+	if a.GID != nil {
+		h.Set(fileGIDHeader, strconv.Itoa(*a.GID))
+	}
+	if a.Owner != "" {
+		h.Set(fileOwnerHeader, a.Owner)
+	}
+	if a.Group != "" {
+		h.Set(fileGroupHeader, a.Group)
+	}
+	names := make([]string, 0, len(a.Xattrs))
+	for name := range a.Xattrs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		h.Add(fileXattrHeader, name+"="+base64.StdEncoding.EncodeToString(a.Xattrs[name]))
+	}
+}
+
+// fileAttributesParams reads the attributes of a submission from the
+// fields attr_mode (octal), attr_mtime (RFC 3339), attr_uid, attr_gid,
+// attr_owner and attr_group, and an xattr field per extended attribute
+// written like its File-Xattr header. It returns nil if there are none.
+func fileAttributesParams(r *http.Request) (*FileAttributes, error) {
+	a := &FileAttributes{
+		Owner: r.FormValue("attr_owner"),
+		Group: r.FormValue("attr_group"),
+	}
+	set := a.Owner != "" || a.Group != ""
+	if value := r.FormValue("attr_mode"); value != "" {
+		mode, err := strconv.ParseUint(value, 8, 32)
+		if err != nil || mode&^07777 != 0 {
+			return nil, fmt.Errorf("Bad attr_mode '%s', must be octal permissions like 0644", value)
+		}
+		a.Mode, set = fmt.Sprintf("%04o", mode), true
+	}
+	if value := r.FormValue("attr_mtime"); value != "" {
+		mtime, err := time.Parse(time.RFC3339Nano, value)
+		if err != nil {
+			return nil, fmt.Errorf("Bad attr_mtime: %w", err)
+		}
+		a.Mtime, set = &mtime, true
+	}
+	for name, id := range map[string]**int{"attr_uid": &a.UID, "attr_gid": &a.GID} {
+		value := r.FormValue(name)
+		if value == "" {
+			continue
+		}
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("Bad %s '%s'", name, value)
+		}
+		*id, set = &n, true
+	}
+	for name, value := range map[string]string{"attr_owner": a.Owner, "attr_group": a.Group} {
+		if err := checkHeaderValue(name, value); err != nil {
+			return nil, err
+		}
+	}
+	total := 0
+	for _, field := range r.Form["xattr"] {
+		i := strings.IndexByte(field, '=')
+		if i <= 0 {
+			return nil, fmt.Errorf("Bad xattr '%s', must be written name=base64 value", field)
+		}
+		name := field[:i]
+		value, err := base64.StdEncoding.DecodeString(field[i+1:])
+		if err != nil {
+			return nil, fmt.Errorf("Bad value of xattr '%s': %s", name, err)
+		}
+		if len(name) > maxXattrName || checkHeaderValue("xattr", name) != nil {
+			return nil, fmt.Errorf("Bad xattr name %q", name)
+		}
+		total += len(name) + len(value)
+		if total > maxXattrBytes {
+			return nil, fmt.Errorf("Extended attributes take more than %d bytes", maxXattrBytes)
+		}
+		if a.Xattrs == nil {
+			a.Xattrs = make(map[string][]byte)
+		}
+		a.Xattrs[name], set = value, true
+	}
+	if !set {
+		return nil, nil
+	}
+	return a, nil
+}
@@ -0,0 +1,106 @@
+package rsbackup
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestFileAttributes(t *testing.T) {
+	tmpDir := createTMPDir(t, "rsbackup")
+	conf := &Config{BackupRoot: tmpDir, DataShards: 2, ParityShards: 1}
+	api := &RSBackupAPI{Config: conf, RsFileMan: &RSFileManager{Config: conf}}
+	submit := func(fname string, fields map[string][]string) *httptest.ResponseRecorder {
+		body := new(bytes.Buffer)
+		mw := multipart.NewWriter(body)
+		fw, err := mw.CreateFormFile("file", fname)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fw.Write([]byte("contents"))
+		mw.WriteField("filename", fname)
+		for name, values := range fields {
+			for _, value := range values {
+				mw.WriteField(name, value)
+			}
+		}
+		mw.Close()
+		req := httptest.NewRequest("POST", "/submit_data", body)
+		req.Header.Set("Content-Type", mw.FormDataContentType())
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(api.submitDataHandler).ServeHTTP(rr, req)
+		return rr
+	}
+
+	submitTests := []struct {
+		name           string
+		fields         map[string][]string
+		expectedStatus int
+	}{
+		{"bad mode", map[string][]string{"attr_mode": {"rwxr-xr-x"}}, 400},
+		{"mode with file type", map[string][]string{"attr_mode": {"0100644"}}, 400},
+		{"bad mtime", map[string][]string{"attr_mtime": {"yesterday"}}, 400},
+		{"negative uid", map[string][]string{"attr_uid": {"-1"}}, 400},
+		{"bad xattr", map[string][]string{"xattr": {"user.comment"}}, 400},
+		{"bad xattr value", map[string][]string{"xattr": {"user.comment=not base64"}}, 400},
+		{"owner with newline", map[string][]string{"attr_owner": {"root\nX-Injected: 1"}}, 400},
+		{"attributes", map[string][]string{
+			"attr_mode":  {"4755"},
+			"attr_mtime": {"2021-03-04T05:06:07.5Z"},
+			"attr_uid":   {"1000"},
+			"attr_gid":   {"100"},
+			"attr_owner": {"alice"},
+			"attr_group": {"users"},
+			"xattr":      {"user.comment=aGVsbG8=", "security.selinux=c3lzdGVtX3U6b2JqZWN0X3I6dXNlcl9ob21lX3Q6czAA"},
+		}, 200},
+		{"plain", nil, 200},
+	}
+	for _, tt := range submitTests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := submit(tt.name, tt.fields)
+			if rr.Code != tt.expectedStatus {
+				t.Errorf("Got status code %d, expected %d", rr.Code, tt.expectedStatus)
+			}
+		})
+	}
+
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(api.retrieveDataHandler).ServeHTTP(rr, httptest.NewRequest("GET", "/retrieve_data/attributes", nil))
+	expected := map[string]string{
+		fileModeHeader:  "4755",
+		fileMtimeHeader: "2021-03-04T05:06:07.5Z",
+		fileUIDHeader:   "1000",
+		fileGIDHeader:   "100",
+		fileOwnerHeader: "alice",
+		fileGroupHeader: "users",
+	}
+	for header, value := range expected {
+		if got := rr.Header().Get(header); got != value {
+			t.Errorf("Got %s '%s', expected '%s'", header, got, value)
+		}
+	}
+	if xattrs := rr.Header()[fileXattrHeader]; len(xattrs) != 2 || xattrs[1] != "user.comment=aGVsbG8=" {
+		t.Errorf("Got xattr headers %v", xattrs)
+	}
+
+	rr = httptest.NewRecorder()
+	http.HandlerFunc(api.checkDataHandler).ServeHTTP(rr, httptest.NewRequest("GET", "/check_data/attributes", nil))
+	var rsp checkDataRsp
+	if err := json.NewDecoder(rr.Body).Decode(&rsp); err != nil || rsp.Attributes == nil {
+		t.Fatalf("Got no attributes checking data (error: %v)", err)
+	}
+	mtime := time.Date(2021, 3, 4, 5, 6, 7, 5e8, time.UTC)
+	if rsp.Attributes.Mtime == nil || !rsp.Attributes.Mtime.Equal(mtime) || string(rsp.Attributes.Xattrs["user.comment"]) != "hello" {
+		t.Errorf("Got attributes %+v", rsp.Attributes)
+	}
+
+	rr = httptest.NewRecorder()
+	http.HandlerFunc(api.retrieveDataHandler).ServeHTTP(rr, httptest.NewRequest("GET", "/retrieve_data/plain", nil))
+	if rr.Header().Get(fileModeHeader) != "" || len(rr.Header()[fileXattrHeader]) != 0 {
+		t.Errorf("Got attribute headers for a file submitted without: %v", rr.Header())
+	}
+}
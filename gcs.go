@@ -0,0 +1,362 @@
+package rsbackup
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	gcsEndpoint = "https://storage.googleapis.com"
+	gcsScope    = "https://www.googleapis.com/auth/devstorage.read_write"
+	// gcsMetadataTokenURL hands out tokens for the service account of the
+	// VM, it's an IP so no name lookup is needed.
+	gcsMetadataTokenURL = "http://169.254.169.254/computeMetadata/v1/instance/service-accounts/default/token"
+)
+
+// gcsServiceAccount holds the fields of a service account key file needed
+// to get access tokens.
+type gcsServiceAccount struct {
+	ClientEmail string `json:"client_email"`
+	PrivateKey  string `json:"private_key"`
+	TokenURI    string `json:"token_uri"`
+}
+
+// GCSBackend stores files as objects in a Google Cloud Storage bucket.
+type GCSBackend struct {
+	*objectBackend
+	bucket   string
+	endpoint string
+	client   *http.Client
+	account  *gcsServiceAccount
+	key      *rsa.PrivateKey
+
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+}
+
+// NewGCSBackend returns a backend for config.GCSBucket. It authenticates
+// with the service account key in config.GCSCredentialsPath, or else as
+// the VM it runs on.
+func NewGCSBackend(config *Config) (*GCSBackend, error) {
+	g := &GCSBackend{
+		bucket:   config.GCSBucket,
+		endpoint: gcsEndpoint,
+		client:   &http.Client{Timeout: 10 * time.Minute},
+	}
+	if config.GCSCredentialsPath != "" {
+		encoded, err := ioutil.ReadFile(config.GCSCredentialsPath)
+		if err != nil {
+			return nil, err
+		}
+		g.account = &gcsServiceAccount{}
+		err = json.Unmarshal(encoded, g.account)
+		if err != nil {
+			return nil, fmt.Errorf("Cannot parse GCS credentials: %s", err)
+		}
+		block, _ := pem.Decode([]byte(g.account.PrivateKey))
+		if block == nil {
+			return nil, fmt.Errorf("GCS credentials hold no private key")
+		}
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("Cannot parse GCS private key: %s", err)
+		}
+		var ok bool
+		g.key, ok = key.(*rsa.PrivateKey)
+		if !ok {
+			return nil, fmt.Errorf("GCS private key isn't an RSA key")
+		}
+	}
+	var err error
+	g.objectBackend, err = newObjectBackend(config, config.GCSPrefix, g)
+	if err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+// assertion returns a JWT signed by the service account key, to exchange
+// for an access token.
+func (g *GCSBackend) assertion(now time.Time) (string, error) {
+	claims, err := json.Marshal(map[string]interface{}{
+		"iss":   g.account.ClientEmail,
+		"scope": gcsScope,
+		"aud":   g.account.TokenURI,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+	signed := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"RS256","typ":"JWT"}`)) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	sum := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, g.key, crypto.SHA256, sum[:])
+	if err != nil {
+		return "", err
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+// accessToken returns a token for the API, fetching a new one a minute
+// before the current one expires.
+func (g *GCSBackend) accessToken() (string, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	now := time.Now()
+	if g.token != "" && now.Before(g.expires) {
+		return g.token, nil
+	}
+	var req *http.Request
+	var err error
+	if g.account != nil {
+		var assertion string
+		assertion, err = g.assertion(now)
+		if err != nil {
+			return "", err
+		}
+		form := url.Values{"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"}, "assertion": {assertion}}
+		req, err = http.NewRequest("POST", g.account.TokenURI, strings.NewReader(form.Encode()))
+		if err == nil {
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+	} else {
+		req, err = http.NewRequest("GET", gcsMetadataTokenURL, nil)
+		if err == nil {
+			req.Header.Set("Metadata-Flavor", "Google")
+		}
+	}
+	if err != nil {
+		return "", err
+	}
+	rsp, err := g.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("Fetching a GCS access token returned %s", rsp.Status)
+	}
+	var body struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+	err = json.NewDecoder(rsp.Body).Decode(&body)
+	if err != nil {
+		return "", fmt.Errorf("Cannot parse GCS access token: %s", err)
+	}
+	g.token = body.AccessToken
+	g.expires = now.Add(time.Duration(body.ExpiresIn)*time.Second - time.Minute)
+	return g.token, nil
+}
+
+func (g *GCSBackend) do(req *http.Request) (*http.Response, error) {
+	token, err := g.accessToken()
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	return g.client.Do(req)
+}
+
+func (g *GCSBackend) objectURL(name string) string {
+	return g.endpoint + "/storage/v1/b/" + url.PathEscape(g.bucket) + "/o/" + url.PathEscape(name)
+}
+
+// gcsError turns an unexpected response into an error that os.IsNotExist
+// and os.IsExist understand.
+func gcsError(rsp *http.Response) error {
+	switch rsp.StatusCode {
+	case http.StatusNotFound:
+		return os.ErrNotExist
+	case http.StatusPreconditionFailed:
+		return os.ErrExist
+	}
+	return fmt.Errorf("GCS returned %s", rsp.Status)
+}
+
+type gcsObject struct {
+	Size    int64     `json:"size,string"`
+	Updated time.Time `json:"updated"`
+}
+
+func (g *GCSBackend) list(prefix string, limit int) ([]string, error) {
+	var names []string
+	pageToken := ""
+	for {
+		query := url.Values{"prefix": {prefix}, "delimiter": {"/"}, "fields": {"items(name),prefixes,nextPageToken"}}
+		if pageToken != "" {
+			query.Set("pageToken", pageToken)
+		}
+		if limit > 0 {
+			query.Set("maxResults", strconv.Itoa(limit))
+		}
+		req, err := http.NewRequest("GET", g.endpoint+"/storage/v1/b/"+url.PathEscape(g.bucket)+"/o?"+query.Encode(), nil)
+		if err != nil {
+			return nil, err
+		}
+		rsp, err := g.do(req)
+		if err != nil {
+			return nil, err
+		}
+		var body struct {
+			Items         []struct{ Name string } `json:"items"`
+			Prefixes      []string                `json:"prefixes"`
+			NextPageToken string                  `json:"nextPageToken"`
+		}
+		if rsp.StatusCode == http.StatusOK {
+			err = json.NewDecoder(rsp.Body).Decode(&body)
+		} else {
+			err = gcsError(rsp)
+		}
+		rsp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range body.Items {
+			names = append(names, strings.TrimPrefix(item.Name, prefix))
+		}
+		for _, p := range body.Prefixes {
+			names = append(names, strings.TrimSuffix(strings.TrimPrefix(p, prefix), "/"))
+		}
+		pageToken = body.NextPageToken
+		if pageToken == "" || (limit > 0 && len(names) >= limit) {
+			return names, nil
+		}
+	}
+}
+
+func (g *GCSBackend) stat(name string) (int64, time.Time, error) {
+	req, err := http.NewRequest("GET", g.objectURL(name), nil)
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	rsp, err := g.do(req)
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode != http.StatusOK {
+		return 0, time.Time{}, gcsError(rsp)
+	}
+	var obj gcsObject
+	err = json.NewDecoder(rsp.Body).Decode(&obj)
+	return obj.Size, obj.Updated, err
+}
+
+func (g *GCSBackend) remove(name string) error {
+	req, err := http.NewRequest("DELETE", g.objectURL(name), nil)
+	if err != nil {
+		return err
+	}
+	rsp, err := g.do(req)
+	if err != nil {
+		return err
+	}
+	rsp.Body.Close()
+	if rsp.StatusCode != http.StatusNoContent && rsp.StatusCode != http.StatusOK {
+		return gcsError(rsp)
+	}
+	return nil
+}
+
+// copy rewrites src to dst, in as many calls as the API needs for large
+// objects.
+func (g *GCSBackend) copy(src, dst string) error {
+	rewriteURL := g.objectURL(src) + "/rewriteTo/b/" + url.PathEscape(g.bucket) + "/o/" + url.PathEscape(dst)
+	rewriteToken := ""
+	for {
+		target := rewriteURL
+		if rewriteToken != "" {
+			target += "?rewriteToken=" + url.QueryEscape(rewriteToken)
+		}
+		req, err := http.NewRequest("POST", target, nil)
+		if err != nil {
+			return err
+		}
+		rsp, err := g.do(req)
+		if err != nil {
+			return err
+		}
+		var body struct {
+			Done         bool   `json:"done"`
+			RewriteToken string `json:"rewriteToken"`
+		}
+		if rsp.StatusCode == http.StatusOK {
+			err = json.NewDecoder(rsp.Body).Decode(&body)
+		} else {
+			err = gcsError(rsp)
+		}
+		rsp.Body.Close()
+		if err != nil {
+			return err
+		}
+		if body.Done {
+			return nil
+		}
+		rewriteToken = body.RewriteToken
+	}
+}
+
+// download returns the generation of the object as its version.
+func (g *GCSBackend) download(name string, w io.Writer) (string, time.Time, error) {
+	req, err := http.NewRequest("GET", g.objectURL(name)+"?alt=media", nil)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	rsp, err := g.do(req)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode != http.StatusOK {
+		return "", time.Time{}, gcsError(rsp)
+	}
+	generation := rsp.Header.Get("X-Goog-Generation")
+	if _, err := strconv.ParseInt(generation, 10, 64); err != nil {
+		return "", time.Time{}, fmt.Errorf("GCS returned no generation for '%s'", name)
+	}
+	modTime, _ := http.ParseTime(rsp.Header.Get("Last-Modified"))
+	_, err = io.Copy(w, rsp.Body)
+	return generation, modTime, err
+}
+
+// upload only replaces the generation given, where generation 0 matches
+// no object.
+func (g *GCSBackend) upload(name string, src io.ReaderAt, size int64, version string) error {
+	if version == "" {
+		version = "0"
+	}
+	query := url.Values{"uploadType": {"media"}, "name": {name}, "ifGenerationMatch": {version}}
+	req, err := http.NewRequest("POST", g.endpoint+"/upload/storage/v1/b/"+url.PathEscape(g.bucket)+"/o?"+query.Encode(), io.NewSectionReader(src, 0, size))
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	req.Header.Set("Content-Type", "application/octet-stream")
+	rsp, err := g.do(req)
+	if err != nil {
+		return err
+	}
+	rsp.Body.Close()
+	if rsp.StatusCode != http.StatusOK {
+		return gcsError(rsp)
+	}
+	return nil
+}
@@ -0,0 +1,279 @@
+package rsbackup
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type fakeGCSObject struct {
+	data       []byte
+	generation int64
+}
+
+// fakeGCS implements the parts of the GCS JSON API that GCSBackend uses,
+// for a single bucket.
+type fakeGCS struct {
+	mu         sync.Mutex
+	key        *rsa.PublicKey
+	objects    map[string]*fakeGCSObject
+	generation int64
+}
+
+func (f *fakeGCS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if r.URL.Path == "/token" {
+		parts := strings.Split(r.FormValue("assertion"), ".")
+		sig, _ := base64.RawURLEncoding.DecodeString(parts[len(parts)-1])
+		sum := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+		if len(parts) != 3 || rsa.VerifyPKCS1v15(f.key, crypto.SHA256, sum[:], sig) != nil {
+			http.Error(w, "bad assertion", http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"access_token": "fake-token", "expires_in": 3600})
+		return
+	}
+	if r.Header.Get("Authorization") != "Bearer fake-token" {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	segments := strings.Split(r.URL.EscapedPath(), "/")
+	unescape := func(s string) string {
+		u, _ := url.PathUnescape(s)
+		return u
+	}
+	switch {
+	case r.URL.Path == "/upload/storage/v1/b/bucket/o":
+		name := r.URL.Query().Get("name")
+		expected, _ := strconv.ParseInt(r.URL.Query().Get("ifGenerationMatch"), 10, 64)
+		var current int64
+		if obj, ok := f.objects[name]; ok {
+			current = obj.generation
+		}
+		if current != expected {
+			http.Error(w, "precondition failed", http.StatusPreconditionFailed)
+			return
+		}
+		data, _ := ioutil.ReadAll(r.Body)
+		f.generation++
+		f.objects[name] = &fakeGCSObject{data: data, generation: f.generation}
+		json.NewEncoder(w).Encode(map[string]string{"name": name})
+	case r.URL.Path == "/storage/v1/b/bucket/o":
+		prefix := r.URL.Query().Get("prefix")
+		var items []map[string]string
+		prefixes := map[string]bool{}
+		for name := range f.objects {
+			if !strings.HasPrefix(name, prefix) {
+				continue
+			}
+			if i := strings.Index(name[len(prefix):], "/"); i >= 0 {
+				prefixes[name[:len(prefix)+i+1]] = true
+			} else {
+				items = append(items, map[string]string{"name": name})
+			}
+		}
+		var prefixList []string
+		for p := range prefixes {
+			prefixList = append(prefixList, p)
+		}
+		sort.Strings(prefixList)
+		json.NewEncoder(w).Encode(map[string]interface{}{"items": items, "prefixes": prefixList})
+	case len(segments) == 12 && segments[7] == "rewriteTo":
+		obj, ok := f.objects[unescape(segments[6])]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		f.generation++
+		f.objects[unescape(segments[11])] = &fakeGCSObject{data: obj.data, generation: f.generation}
+		json.NewEncoder(w).Encode(map[string]bool{"done": true})
+	case len(segments) == 7 && segments[4] == "bucket":
+		name := unescape(segments[6])
+		obj, ok := f.objects[name]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		switch {
+		case r.Method == "DELETE":
+			delete(f.objects, name)
+			w.WriteHeader(http.StatusNoContent)
+		case r.URL.Query().Get("alt") == "media":
+			w.Header().Set("X-Goog-Generation", strconv.FormatInt(obj.generation, 10))
+			w.Write(obj.data)
+		default:
+			json.NewEncoder(w).Encode(map[string]string{"name": name, "size": strconv.Itoa(len(obj.data)), "updated": time.Now().Format(time.RFC3339)})
+		}
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func newTestGCSBackend(t *testing.T) (*GCSBackend, *fakeGCS) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake := &fakeGCS{key: &key.PublicKey, objects: make(map[string]*fakeGCSObject)}
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+
+	tmpDir := createTMPDir(t, "rsbackup")
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	credentials, _ := json.Marshal(gcsServiceAccount{
+		ClientEmail: "rsbackup@project.iam.gserviceaccount.com",
+		PrivateKey:  string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+		TokenURI:    server.URL + "/token",
+	})
+	credentialsPath := path.Join(tmpDir, "credentials.json")
+	err = ioutil.WriteFile(credentialsPath, credentials, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := &Config{BackupRoot: tmpDir, GCSBucket: "bucket", GCSPrefix: "backups/", GCSCredentialsPath: credentialsPath}
+	g, err := NewGCSBackend(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g.endpoint = server.URL
+	return g, fake
+}
+
+func TestGCSBackend(t *testing.T) {
+	g, fake := newTestGCSBackend(t)
+	fpath := path.Join(g.root, "85/tyger")
+	f, err := g.CreateExclusive(fpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("tyger tyger"))
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := fake.objects["backups/85/tyger"]; !ok {
+		t.Fatalf("Object not uploaded under the prefix, got %v", fake.objects)
+	}
+	if _, err := g.CreateExclusive(fpath); !os.IsExist(err) {
+		t.Errorf("Got %v creating an existing file", err)
+	}
+
+	// Uploads don't replace objects changed since they were opened.
+	f, err = g.OpenWritable(fpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, _ := g.OpenWritable(fpath)
+	other.Write([]byte("Tyger"))
+	if err := other.Close(); err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("TYGER"))
+	if err := f.Close(); !os.IsExist(err) {
+		t.Errorf("Got %v replacing a changed object", err)
+	}
+	f, _ = g.Open(fpath)
+	contents, _ := ioutil.ReadAll(f)
+	f.Close()
+	if string(contents) != "Tyger tyger" {
+		t.Errorf("Got contents '%s'", contents)
+	}
+
+	names, err := g.List(g.root)
+	if err != nil || len(names) != 1 || names[0] != "85" {
+		t.Errorf("Got names %v (error: %v)", names, err)
+	}
+	if stat, err := g.Stat(path.Join(g.root, "85")); err != nil || !stat.IsDir() {
+		t.Errorf("Got %v stating a directory (error: %v)", stat, err)
+	}
+	err = g.Rename(fpath, path.Join(g.root, "tyger"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := g.Stat(fpath); !os.IsNotExist(err) {
+		t.Errorf("Got %v stating a renamed file", err)
+	}
+	if stat, err := g.Stat(path.Join(g.root, "tyger")); err != nil || stat.Size() != 11 {
+		t.Errorf("Got %v after rename (error: %v)", stat, err)
+	}
+	if err := g.Remove(fpath); !os.IsNotExist(err) {
+		t.Errorf("Got %v removing a missing file", err)
+	}
+	if _, err := g.objectName("/elsewhere"); err == nil {
+		t.Errorf("Mapped a path outside the backup root")
+	}
+	if spooled, _ := ioutil.ReadDir(g.spoolDir); len(spooled) != 0 {
+		t.Errorf("Spooled files left behind: %v", spooled)
+	}
+}
+
+func TestHandlersWithGCSBackend(t *testing.T) {
+	g, fake := newTestGCSBackend(t)
+	testData, err := ioutil.ReadFile("testdata/tyger")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := &Config{BackupRoot: g.root, DataShards: 2, ParityShards: 1}
+	api := &RSBackupAPI{Config: conf, RsFileMan: &RSFileManager{Config: conf, Storage: g}}
+
+	body := new(bytes.Buffer)
+	multipartWriter := multipart.NewWriter(body)
+	form, _ := multipartWriter.CreateFormFile("file", "tyger")
+	form.Write(testData)
+	multipartWriter.WriteField("filename", "tyger")
+	multipartWriter.Close()
+	req := httptest.NewRequest("POST", "/submit_data", body)
+	req.Header.Add("content-type", multipartWriter.FormDataContentType())
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(api.submitDataHandler).ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Got status code %d submitting", rr.Code)
+	}
+	if len(fake.objects) != 4 {
+		t.Errorf("Got objects %v", fake.objects)
+	}
+
+	// Corrupt the data, then repair it.
+	fake.objects["backups/tyger"].data[0] ^= 0xff
+	health, _, _, err := api.RsFileMan.CheckData("tyger")
+	if err != nil || health {
+		t.Fatalf("Got health %t for corrupted data (error: %v)", health, err)
+	}
+	err = api.RsFileMan.RepairData("tyger")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr = httptest.NewRecorder()
+	http.HandlerFunc(api.retrieveDataHandler).ServeHTTP(rr, httptest.NewRequest("GET", "/retrieve_data/tyger", nil))
+	if rr.Body.String() != string(testData) {
+		t.Errorf("Got retrieved contents '%s'", rr.Body.String())
+	}
+
+	rr = httptest.NewRecorder()
+	http.HandlerFunc(api.deleteHandler).ServeHTTP(rr, httptest.NewRequest("POST", "/delete/tyger", nil))
+	if rr.Code != http.StatusNoContent || len(fake.objects) != 0 {
+		t.Errorf("Got status code %d deleting, objects left: %v", rr.Code, fake.objects)
+	}
+}
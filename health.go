@@ -0,0 +1,112 @@
+package rsbackup
+
+import (
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// HealthRecord is the outcome of the last integrity check of a file. Error
+// is set when the file couldn't be checked at all.
+type HealthRecord struct {
+	Health    bool      `json:"health"`
+	Error     string    `json:"error,omitempty"`
+	CheckedAt time.Time `json:"checked_at"`
+}
+
+// HealthCache remembers the results of integrity checks so listings can
+// report health without hashing anything. Records are persisted in a json
+// file.
+type HealthCache struct {
+	mu      sync.Mutex
+	path    string
+	records map[string]HealthRecord
+}
+
+func NewHealthCache(fpath string) (*HealthCache, error) {
+	c := &HealthCache{
+		path:    fpath,
+		records: make(map[string]HealthRecord),
+	}
+	err := readJSONState(fpath, &c.records)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *HealthCache) Record(fname string, health bool) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.records[fname] = HealthRecord{Health: health, CheckedAt: time.Now()}
+	return writeJSONState(c.path, c.records)
+}
+
+// RecordError stores that checking fname failed with err.
+func (c *HealthCache) RecordError(fname string, checkErr error) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.records[fname] = HealthRecord{Error: checkErr.Error(), CheckedAt: time.Now()}
+	return writeJSONState(c.path, c.records)
+}
+
+// Move carries the record of from over to to, after a rename.
+func (c *HealthCache) Move(from, to string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	record, ok := c.records[from]
+	delete(c.records, from)
+	delete(c.records, to)
+	if ok {
+		c.records[to] = record
+	}
+	return writeJSONState(c.path, c.records)
+}
+
+// Forget drops the record of fname, after it was deleted.
+func (c *HealthCache) Forget(fname string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.records[fname]; !ok {
+		return nil
+	}
+	delete(c.records, fname)
+	return writeJSONState(c.path, c.records)
+}
+
+func (c *HealthCache) Get(fname string) (HealthRecord, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	record, ok := c.records[fname]
+	return record, ok
+}
+
+// recordHealth stores the result of a check of fname in the health cache
+// and the metadata index, those that are enabled.
+func (rs *RSBackupAPI) recordHealth(fname string, health bool) {
+	if index := rs.RsFileMan.Index; index != nil {
+		if err := index.SetHealth(fname, health, time.Now().UTC()); err != nil {
+			log.Errorf("Unable to index health of %s: %s", fname, err)
+		}
+	}
+	if rs.Health == nil {
+		return
+	}
+	err := rs.Health.Record(fname, health)
+	if err != nil {
+		log.Errorf("Unable to record health of %s: %s", fname, err)
+	}
+}
+
+// recordCheckError stores that checking fname failed, if health caching is
+// enabled.
+func (rs *RSBackupAPI) recordCheckError(fname string, checkErr error) {
+	if rs.Health == nil {
+		return
+	}
+	err := rs.Health.RecordError(fname, checkErr)
+	if err != nil {
+		log.Errorf("Unable to record health of %s: %s", fname, err)
+	}
+}
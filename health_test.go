@@ -0,0 +1,72 @@
+package rsbackup
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestListDataExtended(t *testing.T) {
+	tmpDir := createTMPDir(t, "rsbackup")
+	conf := &Config{BackupRoot: tmpDir, DataShards: 2, ParityShards: 1}
+	cloneShards(t, "tyger", tmpDir, conf)
+	cloneShards(t, "tyger_bad", tmpDir, conf)
+	cloneShards(t, "tyger_broken", tmpDir, conf)
+	healthPath := conf.StatePath("health.json")
+	health, err := NewHealthCache(healthPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	api := &RSBackupAPI{Config: conf, RsFileMan: &RSFileManager{Config: conf}, Health: health}
+
+	for _, fname := range []string{"tyger", "tyger_bad"} {
+		req := httptest.NewRequest("GET", "/check_data/"+fname, nil)
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(api.checkDataHandler).ServeHTTP(rr, req)
+		if rr.Code != 200 {
+			t.Fatalf("Got status code %d checking %s", rr.Code, fname)
+		}
+	}
+
+	// Results must survive a restart.
+	api.Health, err = NewHealthCache(healthPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest("GET", "/list_data?extended=true", nil)
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(api.listDataHandler).ServeHTTP(rr, req)
+	if rr.Code != 200 {
+		t.Fatalf("Got status code %d, expected 200", rr.Code)
+	}
+	var rsp listDataRsp
+	err = json.NewDecoder(rr.Body).Decode(&rsp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectedHealth := map[string]string{
+		"tyger":        "true",
+		"tyger_bad":    "false",
+		"tyger_broken": "null",
+	}
+	if len(rsp.Objects) != len(expectedHealth) {
+		t.Fatalf("Got %d objects, expected %d", len(rsp.Objects), len(expectedHealth))
+	}
+	for _, obj := range rsp.Objects {
+		got := "null"
+		if obj.CachedHealth != nil {
+			got = "false"
+			if *obj.CachedHealth {
+				got = "true"
+			}
+		}
+		if got != expectedHealth[obj.Name] {
+			t.Errorf("Got cached health %s for %s, expected %s", got, obj.Name, expectedHealth[obj.Name])
+		}
+		if (obj.CachedCheckTime == "") != (got == "null") {
+			t.Errorf("Unexpected cached check time '%s' for %s", obj.CachedCheckTime, obj.Name)
+		}
+	}
+}
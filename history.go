@@ -0,0 +1,142 @@
+package rsbackup
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	bolt "go.etcd.io/bbolt"
+)
+
+var indexHistoryBucket = []byte("history")
+
+// maxHistoryEvents is how many events are kept per file, the oldest are
+// dropped first.
+const maxHistoryEvents = 100
+
+// Events recorded in the history of a file.
+const (
+	eventStored          = "stored"
+	eventChecked         = "checked"
+	eventCorruptionFound = "corruption_found"
+	eventRepaired        = "repaired"
+	eventRetrieved       = "retrieved"
+)
+
+// HistoryEvent is something that happened to a file. Detail says how, such
+// as the scrub for a check.
+type HistoryEvent struct {
+	Time   time.Time `json:"time"`
+	Event  string    `json:"event"`
+	Detail string    `json:"detail,omitempty"`
+}
+
+// checkEvent returns the event a check of a file with health records.
+func checkEvent(health bool) string {
+	if health {
+		return eventChecked
+	}
+	return eventCorruptionFound
+}
+
+func getHistory(tx *bolt.Tx, fname string) []HistoryEvent {
+	history := tx.Bucket(indexHistoryBucket)
+	if history == nil {
+		return nil
+	}
+	var events []HistoryEvent
+	if v := history.Get([]byte(fname)); v == nil || json.Unmarshal(v, &events) != nil {
+		return nil
+	}
+	return events
+}
+
+func putHistory(tx *bolt.Tx, fname string, events []HistoryEvent) error {
+	history, err := tx.CreateBucketIfNotExists(indexHistoryBucket)
+	if err != nil {
+		return err
+	}
+	v, err := json.Marshal(events)
+	if err != nil {
+		return err
+	}
+	return history.Put([]byte(fname), v)
+}
+
+// AddEvent appends event to the history of fname.
+func (x *MetadataIndex) AddEvent(fname string, event HistoryEvent) error {
+	return x.db.Update(func(tx *bolt.Tx) error {
+		events := append(getHistory(tx, fname), event)
+		if len(events) > maxHistoryEvents {
+			events = events[len(events)-maxHistoryEvents:]
+		}
+		return putHistory(tx, fname, events)
+	})
+}
+
+// History returns the events of fname, oldest first.
+func (x *MetadataIndex) History(fname string) ([]HistoryEvent, error) {
+	var events []HistoryEvent
+	err := x.db.View(func(tx *bolt.Tx) error {
+		events = getHistory(tx, fname)
+		return nil
+	})
+	return events, err
+}
+
+// recordEvent publishes an event of fname to the event feed and adds it to
+// the history of fname, those that are enabled. The event happened
+// already, so failing to record it is only logged.
+func (rs *RSBackupAPI) recordEvent(fname, event, detail string) {
+	now := time.Now().UTC()
+	if rs.Events != nil {
+		rs.Events.Publish(StorageEvent{Time: now, Event: event, Name: fname, Detail: detail})
+	}
+	index := rs.RsFileMan.Index
+	if index == nil {
+		return
+	}
+	err := index.AddEvent(fname, HistoryEvent{Time: now, Event: event, Detail: detail})
+	if err != nil {
+		log.Errorf("Unable to record %s event of %s: %s", event, fname, err)
+	}
+}
+
+type historyRsp struct {
+	Name   string         `json:"name"`
+	Events []HistoryEvent `json:"events"`
+}
+
+// historyHandler returns the history of a file, oldest event first.
+func (rs *RSBackupAPI) historyHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		rs.Errorf(r, "Bad method %s", r.Method)
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	fname, err := getFileNameParam(r.URL)
+	if err != nil {
+		rs.Errorf(r, "Can't read history: %s", err)
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	events, err := rs.RsFileMan.Index.History(fname)
+	if err != nil {
+		rs.Errorf(r, "Unable to read history of %s: %s", fname, err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	if _, ok := rs.RsFileMan.Index.Get(fname); !ok && len(events) == 0 {
+		rs.Errorf(r, "File %s not found", fname)
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+	if events == nil {
+		events = []HistoryEvent{}
+	}
+	err = writeResponse(w, r, historyRsp{Name: fname, Events: events})
+	if err != nil {
+		rs.Errorf(r, "Unable to marshal response: %s", err)
+	}
+}
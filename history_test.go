@@ -0,0 +1,90 @@
+package rsbackup
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"testing"
+)
+
+func TestHistory(t *testing.T) {
+	index, err := OpenMetadataIndex(path.Join(createTMPDir(t, "rsbackup-state"), "index.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	config := &Config{BackupRoot: createTMPDir(t, "rsbackup"), DataShards: 2, ParityShards: 1}
+	api := &RSBackupAPI{Config: config, RsFileMan: &RSFileManager{Config: config, Index: index}}
+	body := new(bytes.Buffer)
+	mw := multipart.NewWriter(body)
+	fw, _ := mw.CreateFormFile("file", "tyger")
+	fw.Write([]byte("burning bright"))
+	mw.WriteField("filename", "tyger")
+	mw.Close()
+	req := httptest.NewRequest("POST", "/submit_data", body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(api.submitDataHandler).ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Got status code %d submitting", rr.Code)
+	}
+	call := func(h http.HandlerFunc, method, url string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, httptest.NewRequest(method, url, nil))
+		if rr.Code != http.StatusOK {
+			t.Fatalf("Got status code %d from %s", rr.Code, url)
+		}
+		return rr
+	}
+	call(api.checkDataHandler, "GET", "/check_data/tyger")
+	call(api.retrieveDataHandler, "GET", "/retrieve_data/tyger")
+	if err := ioutil.WriteFile(api.RsFileMan.DataPath("tyger")+".parity.1", []byte("fearful symmetry"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	call(api.checkDataHandler, "GET", "/check_data/tyger")
+	call(api.repairDataHandler, "GET", "/repair_data/tyger")
+	if err := api.RsFileMan.Rename("tyger", "lamb"); err != nil {
+		t.Fatal(err)
+	}
+
+	history := func(fname string) (int, historyRsp) {
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(api.historyHandler).ServeHTTP(rr, httptest.NewRequest("GET", "/history/"+fname, nil))
+		var rsp historyRsp
+		json.NewDecoder(rr.Body).Decode(&rsp)
+		return rr.Code, rsp
+	}
+	code, rsp := history("lamb")
+	expected := []string{eventStored, eventChecked, eventRetrieved, eventCorruptionFound, eventRepaired}
+	if code != http.StatusOK || len(rsp.Events) != len(expected) {
+		t.Fatalf("Got status code %d and history %+v", code, rsp)
+	}
+	for i, event := range rsp.Events {
+		if event.Event != expected[i] || event.Time.IsZero() {
+			t.Errorf("Got event %d %+v, expected %s", i, event, expected[i])
+		}
+	}
+	if rsp.Events[1].Detail != "check" {
+		t.Errorf("Got detail '%s' of a check", rsp.Events[1].Detail)
+	}
+	if code, _ := history("tyger"); code != http.StatusNotFound {
+		t.Errorf("Got status code %d for the old name", code)
+	}
+
+	for i := 0; i < maxHistoryEvents; i++ {
+		api.recordEvent("lamb", eventRetrieved, "")
+	}
+	if _, rsp := history("lamb"); len(rsp.Events) != maxHistoryEvents || rsp.Events[0].Event != eventRetrieved {
+		t.Errorf("Got %d events, the oldest %+v", len(rsp.Events), rsp.Events[0])
+	}
+	if err := api.RsFileMan.Delete("lamb", false, false); err != nil {
+		t.Fatal(err)
+	}
+	if code, _ := history("lamb"); code != http.StatusNotFound {
+		t.Errorf("Got status code %d for a deleted file", code)
+	}
+}
@@ -0,0 +1,103 @@
+package rsbackup
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// dummyBcryptHash is compared against for unknown users, so looking up a
+// user takes as long whether it exists or not.
+var (
+	dummyBcryptHash     []byte
+	dummyBcryptHashOnce sync.Once
+)
+
+// Htpasswd holds the users of an htpasswd file for HTTP Basic auth. Only
+// bcrypt hashes, as written by `htpasswd -B`, are supported.
+type Htpasswd struct {
+	path   string
+	admins []string
+
+	mu    sync.RWMutex
+	users map[string][]byte
+}
+
+// LoadHtpasswd reads the htpasswd file at fpath. Users named in admins get
+// admin access.
+func LoadHtpasswd(fpath string, admins []string) (*Htpasswd, error) {
+	h := &Htpasswd{path: fpath, admins: admins}
+	err := h.Reload()
+	if err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// Reload replaces the users with the current contents of the file. On
+// error the previously loaded users are kept.
+func (h *Htpasswd) Reload() error {
+	f, err := os.Open(h.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	users := make(map[string][]byte)
+	scanner := bufio.NewScanner(f)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return fmt.Errorf("Malformed line %d in '%s'", lineNo, h.path)
+		}
+		if _, err := bcrypt.Cost([]byte(parts[1])); err != nil {
+			log.Warnf("Skipping user '%s' in '%s', only bcrypt hashes are supported", parts[0], h.path)
+			continue
+		}
+		users[parts[0]] = []byte(parts[1])
+	}
+	err = scanner.Err()
+	if err != nil {
+		return err
+	}
+	h.mu.Lock()
+	h.users = users
+	h.mu.Unlock()
+	log.Infof("Loaded %d users from %s", len(users), h.path)
+	return nil
+}
+
+func (h *Htpasswd) Len() int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return len(h.users)
+}
+
+// Authenticate checks user's password and returns the token representing
+// the user.
+func (h *Htpasswd) Authenticate(user, password string) (APIToken, bool) {
+	h.mu.RLock()
+	hash, ok := h.users[user]
+	h.mu.RUnlock()
+	if !ok {
+		dummyBcryptHashOnce.Do(func() {
+			dummyBcryptHash, _ = bcrypt.GenerateFromPassword([]byte("rsbackup"), bcrypt.DefaultCost)
+		})
+		hash = dummyBcryptHash
+	}
+	valid := bcrypt.CompareHashAndPassword(hash, []byte(password)) == nil
+	if !ok || !valid {
+		return APIToken{}, false
+	}
+	return APIToken{Name: "basic:" + user, Admin: containsString(h.admins, user)}, true
+}
@@ -0,0 +1,112 @@
+package rsbackup
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func writeHtpasswd(t *testing.T, fpath string, users map[string]string) {
+	content := "# rsbackup users\n"
+	for user, password := range users {
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+		if err != nil {
+			t.Fatal(err)
+		}
+		content += fmt.Sprintf("%s:%s\n", user, hash)
+	}
+	// Entries with other hash types are skipped.
+	content += "legacy:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=\n"
+	err := ioutil.WriteFile(fpath, []byte(content), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHtpasswdAuthenticated(t *testing.T) {
+	htpasswdPath := path.Join(createTMPDir(t, "rsbackup"), "htpasswd")
+	writeHtpasswd(t, htpasswdPath, map[string]string{"alice": "wonderland", "root": "hunter2"})
+	htpasswd, err := LoadHtpasswd(htpasswdPath, []string{"root"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if htpasswd.Len() != 2 {
+		t.Errorf("Got %d users, expected 2", htpasswd.Len())
+	}
+	api := &RSBackupAPI{Config: &Config{}, Tokens: newTestTokenStore(t), PasswordAuth: []PasswordAuthenticator{htpasswd}}
+
+	basicTests := []struct {
+		name           string
+		scope          string
+		user           string
+		password       string
+		expectedStatus int
+		expectedRsp    string
+	}{
+		{"valid user", ScopeRead, "alice", "wonderland", 200, "hello basic:alice"},
+		{"wrong password", ScopeRead, "alice", "looking-glass", 401, "Unauthorized\n"},
+		{"unknown user", ScopeRead, "bob", "wonderland", 401, "Unauthorized\n"},
+		{"unsupported hash", ScopeRead, "legacy", "password", 401, "Unauthorized\n"},
+		{"user on admin endpoint", ScopeAdmin, "alice", "wonderland", 403, "Missing scope 'admin'\n"},
+		{"admin on admin endpoint", ScopeAdmin, "root", "hunter2", 200, "hello basic:root"},
+	}
+	for _, tt := range basicTests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := api.authenticated(tt.scope, func(w http.ResponseWriter, r *http.Request) {
+				token, _ := requestToken(r)
+				fmt.Fprintf(w, "hello %s", token.Name)
+			})
+			req := httptest.NewRequest("GET", "/list_data", nil)
+			req.SetBasicAuth(tt.user, tt.password)
+			rr := httptest.NewRecorder()
+			handler(rr, req)
+			if rr.Code != tt.expectedStatus {
+				t.Errorf("Got status code %d, expected %d", rr.Code, tt.expectedStatus)
+			}
+			if rr.Body.String() != tt.expectedRsp {
+				t.Errorf("Got rsp body '%s', expected '%s'", rr.Body.String(), tt.expectedRsp)
+			}
+			if rr.Code == 401 && len(rr.Header().Values("WWW-Authenticate")) != 2 {
+				t.Errorf("Expected bearer and basic challenges, got %v", rr.Header().Values("WWW-Authenticate"))
+			}
+		})
+	}
+}
+
+func TestHtpasswdReload(t *testing.T) {
+	htpasswdPath := path.Join(createTMPDir(t, "rsbackup"), "htpasswd")
+	writeHtpasswd(t, htpasswdPath, map[string]string{"alice": "wonderland"})
+	htpasswd, err := LoadHtpasswd(htpasswdPath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writeHtpasswd(t, htpasswdPath, map[string]string{"bob": "builder"})
+	err = htpasswd.Reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := htpasswd.Authenticate("alice", "wonderland"); ok {
+		t.Errorf("Removed user still accepted after reload")
+	}
+	if _, ok := htpasswd.Authenticate("bob", "builder"); !ok {
+		t.Errorf("Added user not accepted after reload")
+	}
+
+	// A broken file keeps the previous users.
+	err = ioutil.WriteFile(htpasswdPath, []byte("no separator\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if htpasswd.Reload() == nil {
+		t.Errorf("Expected error reloading malformed file")
+	}
+	if _, ok := htpasswd.Authenticate("bob", "builder"); !ok {
+		t.Errorf("User lost after failed reload")
+	}
+}
@@ -1,68 +1,164 @@
 package rsbackup
 
 import (
-	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"path"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
 	log "github.com/sirupsen/logrus"
 )
 
-type Config struct {
-	BackupRoot   string
-	DataShards   int
-	ParityShards int
-	Address      string
-	HttpCertPath string
-	HttpKeyPath  string
-}
-
-func getClientIP(r *http.Request) string {
-	if addr := r.Header.Get("x-forwarded-for"); addr != "" {
-		return addr
-	} else if addr := r.RemoteAddr; addr != "" {
-		return addr
-	} else {
-		return "Unknown"
-	}
-}
-
 // getURLParam returns the parameter in a URL.
 // It is specifically limited to returning only the 3rd level part, ie.
-// /some/thing will return "thing."
-func getURLParam(urlPath string) (string, error) {
-	urlParams := strings.Split(urlPath, "/")
+// /some/thing will return "thing." The path is split before the parameter
+// is percent-decoded, so an escaped '/' stays part of the parameter.
+func getURLParam(u *url.URL) (string, error) {
+	urlParams := strings.Split(u.EscapedPath(), "/")
 	if len(urlParams) != 3 || urlParams[2] == "" {
-		return "", fmt.Errorf("Cannot extract url param from '%s'", urlPath)
+		return "", fmt.Errorf("Cannot extract url param from '%s'", u.EscapedPath())
+	}
+	return url.PathUnescape(urlParams[2])
+}
+
+// getFileNameParam returns the file name in a URL like /verb/{name}, where
+// name is encoded as a single path segment, see url.PathEscape.
+func getFileNameParam(u *url.URL) (string, error) {
+	fname, err := getURLParam(u)
+	if err != nil {
+		return "", err
 	}
-	return urlParams[2], nil
+	return fname, validateFileName(fname)
 }
 
 type RSBackupAPI struct {
 	Config    *Config
 	RsFileMan *RSFileManager
-	server    *http.Server
+	// Shares is optional, share link routes are only served when set.
+	Shares *ShareStore
+	// Tokens enables authentication when set.
+	Tokens *TokenStore
+	// JWTs enables authentication with OIDC issued JWTs when set.
+	JWTs *JWTValidator
+	// PasswordAuth enables HTTP Basic auth, credentials are checked against
+	// each authenticator in turn.
+	PasswordAuth []PasswordAuthenticator
+	// Health caches check results for extended listings when set.
+	Health *HealthCache
+	// Annotations enables operator notes on files when set.
+	Annotations *AnnotationStore
+	// Mirror copies every stored file offsite when set.
+	Mirror *SFTPMirror
+	// Quotas limits the storage used per namespace when set.
+	Quotas *QuotaStore
+	// Usage counts the bytes stored, for Config.MaxStorageSize, when set.
+	Usage *StorageUsage
+	// Placement is told which namespace stores each file when set, for
+	// placement rules limited to a namespace.
+	Placement *PlacementBackend
+	// Tiering moves files untouched for a while to cold storage when set,
+	// and back on retrieval.
+	Tiering *TieredBackend
+	// Renames enables renaming files, requests for old names are
+	// redirected to the new ones.
+	Renames *RenameHistory
+	// Presigned enables presigned upload URLs when set.
+	Presigned *PresignStore
+	// ParityQueue holds the files stored with Config.DeferParity until
+	// their parity is generated, parity is never deferred without it.
+	ParityQueue *ParityQueue
+	// Trash keeps deleted files for a while when set.
+	Trash *Trash
+	// Audit records sensitive operations when set.
+	Audit *AuditLog
+	// Events streams storage events at /events when set.
+	Events *EventFeed
+	// Consistency is what the scan on startup found, served at
+	// /consistency when set.
+	Consistency *ConsistencyReport
+	// Secrets reads the TLS certificate and key, from Vault when set.
+	Secrets *SecretReader
+	// Listener is served on instead of listening on Config.Address, when
+	// set, so the port can be bound before privileges are dropped.
+	Listener net.Listener
+	server   *http.Server
+	certs    *certStore
+
+	trustedProxies []*net.IPNet
+
+	backgroundOnce sync.Once
+	work           *backgroundWork
+
+	confirmationsOnce sync.Once
+	confirmations     *deleteConfirmations
+
+	inFlight      int64
+	shutdownHooks []shutdownHook
 }
 
 func (rs *RSBackupAPI) Errorf(r *http.Request, formatString string, args ...interface{}) {
-	fmtString := fmt.Sprintf("[%s] %s", getClientIP(r), formatString)
+	fmtString := fmt.Sprintf("[%s] %s", rs.clientIP(r), formatString)
 	log.Errorf(fmtString, args...)
 }
 
 func (r *RSBackupAPI) Start() chan struct{} {
 	r.server = &http.Server{
-		Addr: r.Config.Address,
+		Addr:    r.Config.Address,
+		Handler: r.trackInFlight(r.securityHeaders(http.DefaultServeMux)),
 	}
 	running := make(chan struct{})
+	var err error
+	r.server.TLSConfig, err = r.Config.tlsConfig()
+	if err != nil {
+		log.Errorf("Bad TLS settings: %s", err)
+		close(running)
+		return running
+	}
+	if len(r.Config.ACMEHosts) > 0 {
+		r.useACME(r.server.TLSConfig, r.Config.acmeManager())
+	} else {
+		r.certs, err = newCertStore(r.Secrets, r.Config.HttpCertPath, r.Config.HttpKeyPath)
+		if err != nil {
+			log.Errorf("Unable to load TLS certificate: %s", err)
+			close(running)
+			return running
+		}
+		r.server.TLSConfig.GetCertificate = r.certs.GetCertificate
+		if r.certs.fileStamp() != "" {
+			r.watchCertificate(certWatchInterval)
+		}
+	}
+	if r.Config.SecretRefresh > 0 {
+		r.startSecretRefresh(r.Config.SecretRefresh)
+	}
+	r.OnShutdown("jobs", r.background().jobs.cancelAll)
+	if r.Events != nil {
+		r.server.RegisterOnShutdown(r.Events.Close)
+	}
 
 	go func() {
 		r.registerRoutes()
-		err := r.server.ListenAndServeTLS(r.Config.HttpCertPath, r.Config.HttpKeyPath)
+		var err error
+		if r.Listener != nil {
+			err = r.server.ServeTLS(r.Listener, "", "")
+		} else {
+			err = r.server.ListenAndServeTLS("", "")
+		}
+		if err == http.ErrServerClosed {
+			// Stop is in charge from here on.
+			return
+		}
 		if err != nil {
 			log.Errorf("TLS Server couldn't start: %s", err)
 			close(running)
@@ -72,30 +168,159 @@ func (r *RSBackupAPI) Start() chan struct{} {
 	return running
 }
 
-func (r *RSBackupAPI) Stop() error {
-	log.Infof("Shutting down server...")
-	if r.server != nil {
-		err := r.server.Shutdown(context.Background())
-		if err != nil {
-			return fmt.Errorf("Error while shutting down server: %s", err)
-		}
-		r.server = nil
-		log.Info("Server shutdown successfully")
-	}
-	return nil
-}
-
 func (r *RSBackupAPI) registerRoutes() {
 	log.Debug("Registering routes")
-	http.HandleFunc("/list_data", r.listDataHandler)
-	http.HandleFunc("/check_data/", r.checkDataHandler)
-	http.HandleFunc("/submit_data", r.submitDataHandler)
-	http.HandleFunc("/retrieve_data/", r.retrieveDataHandler)
-	http.HandleFunc("/repair_data/", r.repairDataHandler)
+	idempotency := newIdempotencyCache(r.Config.IdempotencyMaxKeys, r.Config.IdempotencyTTL)
+	r.trustedProxies = mustParseNetworks(r.Config.TrustedProxies)
+	dataFilter := ipFilter{
+		allow: mustParseNetworks(r.Config.AllowedNetworks),
+		deny:  mustParseNetworks(r.Config.DeniedNetworks),
+	}
+	adminFilter := ipFilter{
+		allow: mustParseNetworks(r.Config.AdminAllowedNetworks),
+		deny:  mustParseNetworks(r.Config.AdminDeniedNetworks),
+	}
+	limiter := newRateLimiter(r.Config)
+	scoped := func(scope string, h http.HandlerFunc) http.HandlerFunc {
+		return r.filtered(dataFilter, r.authenticated(scope, r.rateLimited(limiter, h)))
+	}
+	mutating := func(scope string, h http.HandlerFunc) http.HandlerFunc {
+		return r.filtered(dataFilter, r.authenticated(scope, r.rateLimited(limiter, r.idempotent(idempotency, h))))
+	}
+	// Uploads are admitted before idempotent, which would replay refusals.
+	ingesting := func(h http.HandlerFunc) http.HandlerFunc {
+		return r.filtered(dataFilter, r.authenticated(ScopeWrite, r.rateLimited(limiter, r.admitted(r.idempotent(idempotency, h)))))
+	}
+	admin := func(h http.HandlerFunc) http.HandlerFunc {
+		return r.filtered(adminFilter, r.authenticated(ScopeAdmin, h))
+	}
+	adminMutating := func(h http.HandlerFunc) http.HandlerFunc {
+		return r.filtered(adminFilter, r.authenticated(ScopeAdmin, r.idempotent(idempotency, h)))
+	}
+	http.HandleFunc("/list_data", scoped(ScopeRead, r.listDataHandler))
+	http.HandleFunc("/check_data/", scoped(ScopeRead, r.checkDataHandler))
+	http.HandleFunc("/list_archive/", scoped(ScopeRead, r.listArchiveHandler))
+	if r.Events != nil {
+		http.HandleFunc("/events", scoped(ScopeRead, r.eventsHandler))
+	}
+	if r.RsFileMan.Index != nil {
+		http.HandleFunc("/search", scoped(ScopeRead, r.searchHandler))
+		http.HandleFunc("/history/", scoped(ScopeRead, r.historyHandler))
+	}
+	http.HandleFunc("/submit_data", r.audited("submit", false, ingesting(r.submitDataHandler)))
+	if r.Config.FetchEnabled {
+		http.HandleFunc("/submit_url", r.audited("submit_url", false, ingesting(r.submitURLHandler)))
+	}
+	http.HandleFunc("/retrieve_data/", r.audited("retrieve", true, scoped(ScopeRead, r.retrieveDataHandler)))
+	http.HandleFunc("/repair_data/", r.audited("repair", true, mutating(ScopeRepair, r.repairDataHandler)))
+	http.HandleFunc("/check_object/", scoped(ScopeRead, r.byID(r.checkDataHandler)))
+	http.HandleFunc("/retrieve_object/", r.audited("retrieve", true, scoped(ScopeRead, r.byID(r.retrieveDataHandler))))
+	http.HandleFunc("/repair_object/", r.audited("repair", true, mutating(ScopeRepair, r.byID(r.repairDataHandler))))
+	http.HandleFunc("/rebuild_metadata/", r.audited("rebuild_metadata", true, mutating(ScopeRepair, r.rebuildMetadataHandler)))
+	http.HandleFunc("/export_bundle/", r.audited("export_bundle", true, scoped(ScopeRead, r.exportBundleHandler)))
+	http.HandleFunc("/import_bundle", r.audited("import_bundle", false, ingesting(r.importBundleHandler)))
+	http.HandleFunc("/delete/", r.audited("delete", true, mutating(ScopeWrite, r.deleteHandler)))
+	http.HandleFunc("/force_delete/", r.audited("force_delete", true, adminMutating(r.forceDeleteHandler)))
+	if r.Presigned != nil {
+		http.HandleFunc("/presign_upload", r.audited("presign_upload", false, adminMutating(r.presignUploadHandler)))
+		// Like share tokens, upload tokens are kept out of the audit log.
+		http.HandleFunc("/upload/", r.audited("submit_presigned", false, r.filtered(dataFilter, r.rateLimited(limiter, r.admitted(r.presignedUploadHandler)))))
+	}
+	if r.Trash != nil {
+		http.HandleFunc("/trash", scoped(ScopeRead, r.trashHandler))
+		http.HandleFunc("/restore/", r.audited("restore", false, mutating(ScopeWrite, r.restoreHandler)))
+	}
+	if len(r.Config.TrustedAgents) > 0 {
+		http.HandleFunc("/submit_shards", r.audited("submit_shards", false, ingesting(r.submitShardsHandler)))
+	}
+	if r.Shares != nil {
+		// A share link hands out read access, so it takes read access to
+		// create one.
+		http.HandleFunc("/share/", r.audited("share", true, mutating(ScopeRead, r.shareHandler)))
+		// The share token in the url is the credential, so it's kept out
+		// of the audit log.
+		http.HandleFunc("/shared/", r.audited("retrieve_shared", false, r.filtered(dataFilter, r.rateLimited(limiter, r.sharedHandler))))
+	}
+	if r.Renames != nil {
+		http.HandleFunc("/rename/", r.audited("rename", true, mutating(ScopeWrite, r.renameHandler)))
+	}
+	if r.Quotas != nil {
+		http.HandleFunc("/quota", scoped(ScopeRead, r.quotaHandler))
+	}
+	if r.Annotations != nil {
+		http.HandleFunc("/annotate/", r.audited("annotate", true, adminMutating(r.annotateHandler)))
+	}
+	if r.Audit != nil {
+		http.HandleFunc("/audit", admin(r.auditHandler))
+	}
+	http.HandleFunc("/background", admin(r.backgroundHandler))
+	http.HandleFunc("/metrics", admin(r.metricsHandler))
+	http.HandleFunc("/inventory", admin(r.inventoryHandler))
+	if r.Consistency != nil {
+		http.HandleFunc("/consistency", admin(r.consistencyHandler))
+	}
+	http.HandleFunc("/jobs", admin(r.jobsHandler))
+	http.HandleFunc("/jobs/", admin(r.jobsHandler))
+	http.HandleFunc("/reencode_data/", r.audited("reencode", true, adminMutating(r.reencodeDataHandler)))
+	http.HandleFunc("/reencode", r.audited("reencode", false, adminMutating(r.reencodeHandler)))
+	if r.RsFileMan.Packs != nil || r.RsFileMan.Chunks != nil {
+		http.HandleFunc("/compact", r.audited("compact", false, adminMutating(r.compactHandler)))
+	}
+	if len(r.Config.Lifecycle) > 0 {
+		http.HandleFunc("/lifecycle", r.audited("lifecycle", false, adminMutating(r.lifecycleHandler)))
+	}
+	if r.RsFileMan.Keys != nil {
+		http.HandleFunc("/rotate_key", r.audited("rotate_key", false, adminMutating(r.rotateKeyHandler)))
+	}
+	if r.Tokens != nil {
+		http.HandleFunc("/list_tokens", admin(r.listTokensHandler))
+		http.HandleFunc("/mint_token", r.audited("mint_token", false, adminMutating(r.mintTokenHandler)))
+		http.HandleFunc("/revoke_token/", r.audited("revoke_token", true, adminMutating(r.revokeTokenHandler)))
+	}
 }
 
 type listDataRsp struct {
-	Files []string `json:"files"`
+	Files   []string     `json:"files"`
+	Objects []objectInfo `json:"objects,omitempty"`
+}
+
+// objectInfo describes a file in an extended listing. The health fields come
+// from the last check and are null for files that were never checked.
+type objectInfo struct {
+	Name            string       `json:"name"`
+	ID              string       `json:"id,omitempty"`
+	CachedHealth    *bool        `json:"cached_health"`
+	CachedCheckTime string       `json:"cached_check_time,omitempty"`
+	CachedError     string       `json:"cached_error,omitempty"`
+	Annotations     []Annotation `json:"annotations,omitempty"`
+	// Size and StoredAt are only known with the metadata index.
+	Size     *int64            `json:"size,omitempty"`
+	StoredAt *time.Time        `json:"stored_at,omitempty"`
+	Labels   map[string]string `json:"labels,omitempty"`
+}
+
+// objectInfo returns what an extended listing tells about a file.
+func (rs *RSBackupAPI) objectInfo(name string) objectInfo {
+	info := objectInfo{Name: name, ID: rs.RsFileMan.objectID(name), Annotations: rs.annotationsOf(name), Labels: rs.labelsOf(name)}
+	if rs.RsFileMan.Index != nil {
+		if entry, ok := rs.RsFileMan.Index.Get(name); ok {
+			info.Size, info.StoredAt = &entry.Size, entry.StoredAt
+			if entry.Health != nil && rs.Health == nil {
+				info.CachedHealth = entry.Health
+				info.CachedCheckTime = entry.CheckedAt.Format("2006-01-02 15:04:05")
+			}
+		}
+	}
+	if rs.Health == nil {
+		return info
+	}
+	if record, ok := rs.Health.Get(name); ok {
+		health := record.Health
+		info.CachedHealth = &health
+		info.CachedCheckTime = record.CheckedAt.Format("2006-01-02 15:04:05")
+		info.CachedError = record.Error
+	}
+	return info
 }
 
 func (rs *RSBackupAPI) listDataHandler(w http.ResponseWriter, r *http.Request) {
@@ -105,26 +330,91 @@ func (rs *RSBackupAPI) listDataHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	log.Debugf("Listing files in %s", rs.Config.BackupRoot)
+	var selector map[string]string
+	if value := r.FormValue("labels"); value != "" {
+		var err error
+		selector, err = parseLabels(value)
+		if err != nil {
+			rs.Errorf(r, "%s", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	sortBy, descending, err := rs.listSortParams(r)
+	if err != nil {
+		rs.Errorf(r, "%s", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	switch format := r.FormValue("format"); format {
+	case "", "json":
+	case "ndjson":
+		if sortBy != "name" || descending {
+			rs.Errorf(r, "Sorted listing can't be streamed")
+			http.Error(w, "sort and order can't be used with format=ndjson", http.StatusBadRequest)
+			return
+		}
+		rs.streamList(w, r, selector)
+		return
+	default:
+		rs.Errorf(r, "Bad listing format '%s'", format)
+		http.Error(w, "format must be json or ndjson", http.StatusBadRequest)
+		return
+	}
 	names, err := rs.RsFileMan.ListData()
 	if err != nil {
 		rs.Errorf(r, "Error while listing files from %s: %s", rs.Config.BackupRoot, err)
 		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		return
 	}
-	w.Header().Set("Content-Type", "application/json")
-	err = json.NewEncoder(w).Encode(&listDataRsp{Files: names})
+	if selector != nil {
+		selected := []string{}
+		for _, name := range names {
+			if matchLabels(rs.labelsOf(name), selector) {
+				selected = append(selected, name)
+			}
+		}
+		names = selected
+	}
+	rs.sortNames(names, sortBy, descending)
+	rsp := &listDataRsp{Files: names}
+	if r.FormValue("extended") == "true" {
+		rsp.Objects = make([]objectInfo, len(names))
+		for i, name := range names {
+			rsp.Objects[i] = rs.objectInfo(name)
+		}
+	}
+	err = writeResponse(w, r, rsp)
 	if err != nil {
-		rs.Errorf(r, "Error while marshalling json: %s", err)
+		rs.Errorf(r, "Error while marshalling response: %s", err)
 		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		return
 	}
 }
 
 type checkDataRsp struct {
-	Name   string   `json:"name"`
-	Lmod   string   `json:"lmod"`
-	Health bool     `json:"health"`
-	Hashes []string `json:"hashes"`
+	Name        string       `json:"name"`
+	ID          string       `json:"id,omitempty"`
+	Lmod        string       `json:"lmod"`
+	Health      bool         `json:"health"`
+	Hashes      []string     `json:"hashes"`
+	Annotations []Annotation `json:"annotations,omitempty"`
+	// ClientCipher is set for client encrypted files.
+	ClientCipher *ClientCipher   `json:"client_cipher,omitempty"`
+	Attributes   *FileAttributes `json:"attributes,omitempty"`
+	// Sparse is set for files stored without their holes. Restores may
+	// fetch only its extents, with range requests.
+	Sparse       *SparseInfo       `json:"sparse,omitempty"`
+	RetainUntil  *time.Time        `json:"retain_until,omitempty"`
+	StorageClass string            `json:"storage_class,omitempty"`
+	Replicas     int               `json:"replicas,omitempty"`
+	Labels       map[string]string `json:"labels,omitempty"`
+	UserMetadata map[string]string `json:"user_metadata,omitempty"`
+	// HashAlgorithm is what Hashes were computed with, sha256 if unset.
+	HashAlgorithm string `json:"hash_algorithm,omitempty"`
+	// DamagedBlocks locates the damage of unhealthy files hashed in
+	// blocks.
+	DamagedBlocks []DamagedBlock `json:"damaged_blocks,omitempty"`
 }
 
 func (rs *RSBackupAPI) checkDataHandler(w http.ResponseWriter, r *http.Request) {
@@ -133,12 +423,15 @@ func (rs *RSBackupAPI) checkDataHandler(w http.ResponseWriter, r *http.Request)
 		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
 		return
 	}
-	fname, err := getURLParam(r.URL.Path)
+	fname, err := getFileNameParam(r.URL)
 	if err != nil {
 		rs.Errorf(r, "Can't check data: %s", err)
 		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
 		return
 	}
+	if rs.redirectRenamed(w, r, fname) {
+		return
+	}
 	log.Debugf("Checking health of %s", fname)
 	health, lmod, hashes, err := rs.RsFileMan.CheckData(fname)
 	if err != nil {
@@ -151,24 +444,62 @@ func (rs *RSBackupAPI) checkDataHandler(w http.ResponseWriter, r *http.Request)
 		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		return
 	}
+	rs.recordHealth(fname, health)
+	rs.recordEvent(fname, checkEvent(health), "check")
 	rsp := &checkDataRsp{
-		Name:   fname,
-		Lmod:   lmod,
-		Health: health,
-		Hashes: hashes,
+		Name:        fname,
+		Lmod:        lmod,
+		Health:      health,
+		Hashes:      hashes,
+		Annotations: rs.annotationsOf(fname),
 	}
-	w.Header().Set("Content-Type", "application/json")
-	err = json.NewEncoder(w).Encode(rsp)
+	if extras, err := rs.RsFileMan.ReadExtras(rs.RsFileMan.DataPath(fname)); err == nil {
+		rsp.ID = extras.ID
+		rsp.ClientCipher = extras.ClientCipher
+		rsp.Attributes = extras.Attributes
+		rsp.Sparse = extras.Sparse
+		rsp.RetainUntil = extras.RetainUntil
+		rsp.StorageClass = extras.StorageClass
+		rsp.Replicas = extras.Replicas
+		rsp.HashAlgorithm = responseHash(extras.Hash)
+		rsp.Labels = extras.Labels
+		rsp.UserMetadata = extras.UserMetadata
+	}
+	if !health {
+		rsp.DamagedBlocks, err = rs.RsFileMan.DamagedBlocks(fname)
+		if err != nil {
+			rs.Errorf(r, "Unable to locate damage of %s: %s", fname, err)
+		}
+	}
+	err = writeResponse(w, r, rsp)
 	if err != nil {
-		rs.Errorf(r, "Unable to marshal json response: %s", err)
+		rs.Errorf(r, "Unable to marshal response: %s", err)
 	}
 }
 
 type submitDataRsp struct {
+	// ID identifies the file for good, see MetadataExtras.ID.
+	ID           string   `json:"id,omitempty"`
 	Size         int64    `json:"size"`
 	Hashes       []string `json:"hashes"`
 	DataShards   int      `json:"data_shards"`
 	ParityShards int      `json:"parity_shards"`
+	// ClientCipher is set for client encrypted files.
+	ClientCipher *ClientCipher   `json:"client_cipher,omitempty"`
+	Attributes   *FileAttributes `json:"attributes,omitempty"`
+	// Sparse is set for files stored without their holes. Restores may
+	// fetch only its extents, with range requests.
+	Sparse       *SparseInfo       `json:"sparse,omitempty"`
+	RetainUntil  *time.Time        `json:"retain_until,omitempty"`
+	StorageClass string            `json:"storage_class,omitempty"`
+	Replicas     int               `json:"replicas,omitempty"`
+	Labels       map[string]string `json:"labels,omitempty"`
+	UserMetadata map[string]string `json:"user_metadata,omitempty"`
+	// HashAlgorithm is what Hashes were computed with, sha256 if unset.
+	HashAlgorithm string `json:"hash_algorithm,omitempty"`
+	// ParityJob is the job generating the parity of a file stored with
+	// Config.DeferParity, the file has no redundancy until it's done.
+	ParityJob string `json:"parity_job,omitempty"`
 }
 
 func (rs *RSBackupAPI) submitDataHandler(w http.ResponseWriter, r *http.Request) {
@@ -178,58 +509,240 @@ func (rs *RSBackupAPI) submitDataHandler(w http.ResponseWriter, r *http.Request)
 		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
 		return
 	}
-	err := r.ParseMultipartForm(256 << 20)
-	if err != nil {
-		rs.Errorf(r, "Error while reading multipart form: %s", err)
-		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+	rs.receiveUpload(w, r, rs.Config.MaxUploadSize, "")
+}
+
+// receiveUpload stores the file uploaded in the "file" field of a multipart
+// form as fname, or the name in the "filename" field if fname is empty.
+// Request bodies over limit are refused, 0 allows any size.
+func (rs *RSBackupAPI) receiveUpload(w http.ResponseWriter, r *http.Request, limit Size, fname string) {
+	if maxSize := int64(limit); maxSize > 0 {
+		if r.ContentLength > maxSize {
+			rs.Errorf(r, "Upload of %d bytes exceeds limit of %s", r.ContentLength, limit)
+			http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, maxSize)
+	}
+	stored := rs.storedEstimate(r.ContentLength)
+	if !rs.checkQuota(w, r, stored) || !rs.checkDiskSpace(w, r, stored) {
 		return
 	}
-	inputData, _, err := r.FormFile("file")
+	inputData, err := rs.readUpload(r, fname == "")
 	if err != nil {
-		rs.Errorf(r, "Bad form field: %s", err)
-		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		rs.badUpload(w, r, err)
 		return
 	}
 	defer inputData.Close()
-	desiredFileName := r.FormValue("filename")
+	desiredFileName := fname
 	if desiredFileName == "" {
-		rs.Errorf(r, "Missing 'filename' parameter'", "")
+		desiredFileName = r.FormValue("filename")
+	}
+	auditObject(r, desiredFileName)
+	err = validateFileName(desiredFileName)
+	if err != nil {
+		rs.Errorf(r, "%s", err)
 		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
 		return
 	}
-	if strings.ContainsAny(desiredFileName, "/") {
-		rs.Errorf(r, "Request contains forbidden character '/' in filename '%s',", desiredFileName)
-		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+	class, err := rs.storageClassParam(r)
+	if err != nil {
+		rs.Errorf(r, "%s", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	replicas, err := replicasParam(r, class)
+	if err != nil {
+		rs.Errorf(r, "%s", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !rs.placeFile(w, r, desiredFileName) {
+		return
+	}
+	extras := MetadataExtras{Immutable: r.FormValue("immutable") == "true", StorageClass: class, Replicas: replicas}
+	extras.ClientCipher, err = clientCipherParams(r)
+	if err == nil {
+		extras.Attributes, err = fileAttributesParams(r)
+	}
+	if err == nil {
+		extras.RetainUntil, err = retainUntilParam(r)
+	}
+	if err == nil {
+		extras.Archive, err = archiveParam(r)
+	}
+	if err == nil {
+		extras.Labels, err = labelsParam(r)
+	}
+	if err == nil {
+		extras.UserMetadata, err = userMetadataParams(r)
+	}
+	if err != nil {
+		rs.Errorf(r, "%s", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 	log.Debugf("Submitted file %s", desiredFileName)
-	dataFilePath, err := rs.RsFileMan.SaveFile(inputData, desiredFileName)
+	entry, err := rs.RsFileMan.Journal.begin(opStore, desiredFileName, "")
+	if err != nil {
+		rs.Errorf(r, "Unable to journal submit of %s: %s", desiredFileName, err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	defer rs.RsFileMan.Journal.end(entry)
+	dataFilePath, encoded, err := rs.RsFileMan.saveFile(inputData, inputData.size, desiredFileName, &extras)
+	if err != nil && inputData.err != nil {
+		rs.badUpload(w, r, inputData.err)
+		return
+	}
+	if isNoSpace(err) {
+		rs.insufficientSpace(w, r, stored)
+		return
+	}
+	if errors.Is(err, errBadArchive) {
+		rs.Errorf(r, "Unable to index %s: %s", desiredFileName, err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 	if err != nil {
 		// TODO: bubble up 'file exists' error to client somehow
 		rs.Errorf(r, "Unable to save file %s: %s", desiredFileName, err)
 		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		return
 	}
-	md, err := rs.GenerateParityFiles(dataFilePath)
+	if err := inputData.finish(); err != nil {
+		rs.RsFileMan.discardSaved(dataFilePath, extras)
+		rs.badUpload(w, r, err)
+		return
+	}
+	rs.protectData(w, r, desiredFileName, dataFilePath, extras, encoded)
+}
+
+// storedEstimate returns the bytes an upload of size bytes takes once
+// stored: parity adds ParityShards/DataShards on top of it.
+func (rs *RSBackupAPI) storedEstimate(size int64) int64 {
+	shards := int64(rs.Config.DataShards + rs.Config.ParityShards)
+	return size * shards / int64(rs.Config.DataShards)
+}
+
+// badUpload answers a submit whose form couldn't be read because of err.
+func (rs *RSBackupAPI) badUpload(w http.ResponseWriter, r *http.Request, err error) {
+	rs.Errorf(r, "Error while reading multipart form: %s", err)
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+		return
+	}
+	http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+}
+
+// validateFileName checks that a client supplied name can be stored. Any
+// valid UTF-8 string without '/' or control characters is accepted, except
+// for "." and "..".
+func validateFileName(fname string) error {
+	if fname == "" {
+		return fmt.Errorf("Missing 'filename' parameter")
+	}
+	if !utf8.ValidString(fname) {
+		return fmt.Errorf("Filename %q is not valid UTF-8", fname)
+	}
+	for _, c := range fname {
+		if c == '/' || unicode.IsControl(c) {
+			return fmt.Errorf("Request contains forbidden character %q in filename %q", c, fname)
+		}
+	}
+	if fname == "." || fname == ".." {
+		return fmt.Errorf("Request uses forbidden filename '%s'", fname)
+	}
+	if isReservedName(fname) {
+		return fmt.Errorf("Request uses reserved filename '%s'", fname)
+	}
+	return nil
+}
+
+// protectData generates parity and metadata for a freshly saved data file,
+// or packs it into a container when it's small, and responds with the
+// resulting metadata. The parity is taken from encoded when it was
+// computed while saving. If that fails the data file is removed again.
+func (rs *RSBackupAPI) protectData(w http.ResponseWriter, r *http.Request, fname, dataFilePath string, extras MetadataExtras, encoded *parityEncoder) {
+	md, err := rs.RsFileMan.packFile(dataFilePath, &extras)
+	if err == nil && md == nil && encoded == nil && rs.defersParity(extras) {
+		md, err = rs.RsFileMan.hashStored(dataFilePath)
+		extras.ParityPending = md != nil
+	}
+	if err == nil && md == nil && encoded != nil {
+		md, err = encoded.store(rs.RsFileMan.storage(), dataFilePath, rs.Config.Fsync)
+		extras.Codec, extras.Hash = rs.Config.codecName(), rs.Config.shardHashName()
+	} else if err == nil && md == nil {
+		md, err = rs.generateParity(rs.RsFileMan.storage(), dataFilePath, &extras)
+	}
+	if err != nil {
+		rs.RsFileMan.discardSaved(dataFilePath, extras)
+	}
+	if isNoSpace(err) {
+		rs.insufficientSpace(w, r, 0)
+		return
+	}
 	if err != nil {
 		// TODO: bubble up 'file exists' error to client somehow
-		rs.Errorf(r, "Unable to generate parity files for %s: %s", desiredFileName, err)
+		rs.Errorf(r, "Unable to generate parity files for %s: %s", fname, err)
 		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		return
 	}
-	err = rs.RsFileMan.WriteMetadata(desiredFileName, md)
+	now := time.Now().UTC()
+	extras.StoredAt = &now
+	extras.StoredBy = requestNamespace(r)
+	extras.ID, err = newObjectID()
+	if err == nil && extras.ParityPending {
+		// Queued first, a file the job doesn't find is dropped.
+		err = rs.ParityQueue.add(fname, extras.ID)
+	}
+	if err == nil {
+		err = rs.RsFileMan.WriteMetadata(fname, md, extras)
+	}
+	if err != nil {
+		rs.RsFileMan.discardSaved(dataFilePath, extras)
+	}
+	if isNoSpace(err) {
+		rs.insufficientSpace(w, r, 0)
+		return
+	}
 	if err != nil {
 		rs.Errorf(r, "%s", err)
 		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		return
 	}
+	if !rs.chargeQuota(w, r, fname) {
+		return
+	}
+	rs.recordEvent(fname, eventStored, "")
+	rs.mirror(fname)
+	var parityJob string
+	if extras.ParityPending {
+		parityJob, err = rs.drainParityQueue()
+		if err != nil {
+			log.Errorf("Unable to start generating the parity of %s, it stays queued: %s", fname, err)
+		}
+	}
 
 	rsp := &submitDataRsp{
+		ID:           extras.ID,
 		Size:         md.Size,
 		Hashes:       md.Hashes,
 		DataShards:   md.DataShards,
 		ParityShards: md.ParityShards,
+		ClientCipher: extras.ClientCipher,
+		Attributes:   extras.Attributes,
+		Sparse:       extras.Sparse,
+		RetainUntil:  extras.RetainUntil,
+		StorageClass: extras.StorageClass,
+		Replicas:     extras.Replicas,
+		Labels:       extras.Labels,
+		UserMetadata: extras.UserMetadata,
 	}
+	rsp.Size = contentSize(md, extras)
+	rsp.HashAlgorithm = responseHash(extras.Hash)
+	rsp.ParityJob = parityJob
 
 	w.Header().Set("content-type", "application/json")
 	err = json.NewEncoder(w).Encode(rsp)
@@ -244,27 +757,130 @@ func (rs *RSBackupAPI) retrieveDataHandler(w http.ResponseWriter, r *http.Reques
 		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
 		return
 	}
-	fname, err := getURLParam(r.URL.Path)
+	fname, err := getFileNameParam(r.URL)
 	if err != nil {
 		rs.Errorf(r, "Can't retrieve file: %s", err)
 		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
 		return
 	}
-	fpath := path.Join(rs.Config.BackupRoot, fname)
+	if rs.redirectRenamed(w, r, fname) {
+		return
+	}
+	rs.serveData(w, r, fname)
+}
+
+// serveData streams the data file fname to the client. With verify=true
+// the shards are checked first and damaged data is reconstructed on the fly.
+func (rs *RSBackupAPI) serveData(w http.ResponseWriter, r *http.Request, fname string) {
+	fpath := rs.RsFileMan.DataPath(fname)
 	log.Debugf("Retrieving file %s", fpath)
-	file, err := os.Open(fpath)
+	if isReservedName(fname) {
+		rs.Errorf(r, "Retrieval of reserved name %s refused", fname)
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+	rs.recall(fname)
+	content, file, _, err := rs.RsFileMan.openContents(fname)
 	if err != nil {
 		if os.IsNotExist(err) {
 			rs.Errorf(r, "Retrieval failed, %s does not exist", fpath)
 			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
 			return
 		}
-		rs.Errorf(r, "Retrieval of %s failed: %s", err)
+		rs.Errorf(r, "Retrieval of %s failed: %s", fpath, err)
 		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		return
 	}
 	defer file.Close()
-	http.ServeContent(w, r, fname, time.Time{}, file)
+	var member *ArchiveMember
+	asIs := false
+	if extras, err := rs.RsFileMan.ReadExtras(fpath); err == nil {
+		asIs = extras.storedAsIs()
+		member, err = archiveMemberParam(r, fname, &extras)
+		if err != nil {
+			rs.Errorf(r, "%s", err)
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if extras.ClientCipher != nil {
+			extras.ClientCipher.setHeaders(w.Header())
+		}
+		// The attributes are those of the archive.
+		if extras.Attributes != nil && member == nil {
+			extras.Attributes.setHeaders(w.Header())
+		}
+		setUserMetadataHeaders(w.Header(), extras.UserMetadata)
+	}
+	served := fname
+	if member != nil {
+		content, served = &memberReader{src: content, member: member}, path.Base(member.Name)
+	}
+	if r.FormValue("verify") == "true" {
+		damaged, checked, err := rs.RsFileMan.checkShards(fname)
+		if err != nil {
+			rs.Errorf(r, "Verification of %s failed: %s", fname, err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		if checked {
+			rs.recordHealth(fname, len(damaged) == 0)
+			rs.recordEvent(fname, checkEvent(len(damaged) == 0), "verify")
+		}
+		if len(damaged) > 0 {
+			rs.recordEvent(fname, eventRetrieved, "reconstructed")
+			rs.serveReconstructed(w, r, fname, damaged, member)
+			return
+		}
+	} else if rs.Config.ReadSampleRate > 0 {
+		rs.queueSample(fname)
+	}
+	rs.recordEvent(fname, eventRetrieved, "")
+	if f, ok := file.(*os.File); ok && asIs && member == nil {
+		// ServeContent hands the file to the connection, which sends it
+		// with sendfile where it can.
+		content = f
+	} else {
+		content = newBufferedReadSeeker(content, rs.Config.readBufferSize())
+	}
+	http.ServeContent(w, r, served, time.Time{}, content)
+}
+
+// serveReconstructed streams fname rebuilt from its healthy shards, without
+// touching the damaged copy on disk, or only member of it if not nil.
+func (rs *RSBackupAPI) serveReconstructed(w http.ResponseWriter, r *http.Request, fname string, damaged []int, member *ArchiveMember) {
+	md, err := rs.RsFileMan.ReadMetadata(rs.RsFileMan.DataPath(fname))
+	if err != nil {
+		rs.Errorf(r, "Cannot read metadata of %s: %s", fname, err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	if len(damaged) > md.ParityShards {
+		rs.Errorf(r, "Cannot serve %s: %d shards damaged, only have %d parity shards", fname, len(damaged), md.ParityShards)
+		http.Error(w, http.StatusText(http.StatusUnprocessableEntity), http.StatusUnprocessableEntity)
+		return
+	}
+	var out io.Writer = w
+	if member != nil {
+		out = &memberWriter{w: w, member: member}
+	}
+	dst, size, err := rs.RsFileMan.contentsWriter(out, fname, md.Size)
+	if err != nil {
+		rs.Errorf(r, "Cannot decrypt %s: %s", fname, err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	defer dst.Close()
+	if member != nil {
+		size = member.Size
+	}
+	log.Warnf("Serving %s reconstructed from parity, damaged shards: %v", fname, damaged)
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+	w.Header().Set("Reconstructed", "true")
+	err = rs.RsFileMan.WriteReconstructed(dst, fname, damaged)
+	if err != nil {
+		rs.Errorf(r, "Reconstruction of %s aborted: %s", fname, err)
+	}
 }
 
 type repairDataRsp struct {
@@ -278,7 +894,7 @@ func (rs *RSBackupAPI) repairDataHandler(w http.ResponseWriter, r *http.Request)
 		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
 		return
 	}
-	fname, err := getURLParam(r.URL.Path)
+	fname, err := getFileNameParam(r.URL)
 	if err != nil {
 		rs.Errorf(r, "Can't retrieve file: %s", err)
 		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
@@ -288,9 +904,25 @@ func (rs *RSBackupAPI) repairDataHandler(w http.ResponseWriter, r *http.Request)
 		Name:   fname,
 		Status: "GOOD",
 	}
+	work := rs.background()
+	repairs := work.repair
+	err = repairs.acquire(r.Context().Done())
+	if err == errQueueFull {
+		rs.Errorf(r, "Too many repairs queued, refusing %s", fname)
+		w.Header().Set("Retry-After", "60")
+		http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		return
+	}
+	if err != nil {
+		rs.Errorf(r, "Repair of %s abandoned while queued", fname)
+		return
+	}
+	defer repairs.release()
 	w.Header().Set("Content-Type", "application/json")
 	log.Debugf("Repairing file %s", fname)
 	err = rs.RsFileMan.RepairData(fname)
+	// The turn is held while paced, so queued repairs wait too.
+	work.repairThrottle.pay(storedSize(rs.RsFileMan.storage(), rs.RsFileMan.DataPath(fname)), r.Context().Done())
 	if err != nil {
 		if os.IsNotExist(err) {
 			rs.Errorf(r, "File %s not found", fname)
@@ -310,6 +942,8 @@ func (rs *RSBackupAPI) repairDataHandler(w http.ResponseWriter, r *http.Request)
 		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		return
 	}
+	rs.recordHealth(fname, true)
+	rs.recordEvent(fname, eventRepaired, "")
 	err = json.NewEncoder(w).Encode(rsp)
 	if err != nil {
 		rs.Errorf(r, "Cannot mashal json rsp: %s", err)
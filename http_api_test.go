@@ -11,6 +11,7 @@ import (
 
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"strings"
 	"testing"
 )
@@ -37,9 +38,24 @@ func fillDirWithEmptyFiles(t *testing.T, dir string, names ...string) []string {
 	return names
 }
 
+// newMemoryAPI returns an API for config that keeps files in memory.
+func newMemoryAPI(config *Config) (*RSBackupAPI, *MemoryBackend) {
+	storage := &MemoryBackend{}
+	api := &RSBackupAPI{
+		Config: config,
+		RsFileMan: &RSFileManager{
+			Config:  config,
+			Storage: storage,
+		},
+	}
+	return api, storage
+}
+
 func TestListDataHandler(t *testing.T) {
-	tmpDir := createTMPDir(t, "rsbackup")
-	fillDirWithEmptyFiles(t, tmpDir, "file1", "file2", "file1.parity.1", "file1.parity.2")
+	storage := &MemoryBackend{}
+	for _, name := range []string{"file1", "file2", "file1.parity.1", "file1.parity.2"} {
+		storage.WriteFile(path.Join("/backups", name), nil)
+	}
 
 	listDataTests := []struct {
 		name           string
@@ -49,8 +65,8 @@ func TestListDataHandler(t *testing.T) {
 		expectedRsp    string
 		expectedHeader string
 	}{
-		{"good request", "GET", tmpDir, 200, `{"files":["file1","file2"]}`, "application/json"},
-		{"bad method", "POST", tmpDir, 405, "Method Not Allowed", "text/plain; charset=utf-8"},
+		{"good request", "GET", "/backups", 200, `{"files":["file1","file2"]}`, "application/json"},
+		{"bad method", "POST", "/backups", 405, "Method Not Allowed", "text/plain; charset=utf-8"},
 		{"bad backupRoot dir", "GET", "/dir/doesnt/exist", 500, "Internal Server Error", "text/plain; charset=utf-8"},
 	}
 
@@ -62,7 +78,8 @@ func TestListDataHandler(t *testing.T) {
 			api := &RSBackupAPI{
 				Config: config,
 				RsFileMan: &RSFileManager{
-					Config: config,
+					Config:  config,
+					Storage: storage,
 				},
 			}
 
@@ -164,26 +181,20 @@ func TestSubmitDataHandler(t *testing.T) {
 		{"illegal fname form field", "POST", "tyger", []string{}, "file", "derp", "ty/ger", 400, "Bad Request"},
 		{"file exists", "POST", "tyger", []string{"tyger"}, "file", "filename", "tyger", 500, "Internal Server Error"},
 		{"parity file exists", "POST", "tyger", []string{"tyger.parity.1"}, "file", "filename", "tyger", 500, "Internal Server Error"},
-		{"successful upload", "POST", "tyger", []string{}, "file", "filename", "tyger", 200, `{"size":808,"hashes":["aa8b8979f1486fe03d54d1bdd4a32018386285a2ad0dc9a2820f0da3d6293e72","64163fa75b3eadb78f376dd7ab84e48595e9748dadbfb50e2126bef20481baa1","e32a8903342ab6dc68d46462df727f6812f6fbb728c4a1240b625331b811c147"],"data_shards":2,"parity_shards":1}`},
+		{"successful upload", "POST", "tyger", []string{}, "file", "filename", "tyger", 200, `{"id":"<id>","size":808,"hashes":["aa8b8979f1486fe03d54d1bdd4a32018386285a2ad0dc9a2820f0da3d6293e72","64163fa75b3eadb78f376dd7ab84e48595e9748dadbfb50e2126bef20481baa1","e32a8903342ab6dc68d46462df727f6812f6fbb728c4a1240b625331b811c147"],"data_shards":2,"parity_shards":1}`},
 	}
 	// successful upload
 	for _, tt := range submitDataTests {
 		t.Run(tt.name, func(t *testing.T) {
-			tmpDir := createTMPDir(t, "rsbackup")
-			config := &Config{
-				BackupRoot:   tmpDir,
+			api, storage := newMemoryAPI(&Config{
+				BackupRoot:   "/backups",
 				DataShards:   2,
 				ParityShards: 1,
-			}
-			api := &RSBackupAPI{
-				Config: config,
-				RsFileMan: &RSFileManager{
-					Config: config,
-				},
+			})
+			for _, name := range tt.filesThatExist {
+				storage.WriteFile(path.Join("/backups", name), nil)
 			}
 
-			fillDirWithEmptyFiles(t, tmpDir, tt.filesThatExist...)
-
 			body := new(bytes.Buffer)
 			multipartWriter := multipart.NewWriter(body)
 			form, err := multipartWriter.CreateFormFile(tt.formFileField, tt.fileToSubmit)
@@ -223,7 +234,9 @@ func TestSubmitDataHandler(t *testing.T) {
 			if err != nil {
 				t.Fatal(err)
 			}
-			if rspBodyTrimmed := strings.TrimSuffix(string(rspBody), "\n"); rspBodyTrimmed != tt.expectedRsp {
+			// IDs are random.
+			rspBodyTrimmed := objectIDField.ReplaceAllString(strings.TrimSuffix(string(rspBody), "\n"), `"id":"<id>"`)
+			if rspBodyTrimmed != tt.expectedRsp {
 				t.Errorf("Got rsp body '%s', expected '%s'", rspBodyTrimmed, tt.expectedRsp)
 			}
 
@@ -328,32 +341,27 @@ func TestRepairData(t *testing.T) {
 		name           string
 		method         string
 		url            string
-		shardName      string
 		expectedStatus int
 		expectedRsp    string
 	}{
-		{"bad method", "POST", "/repair_data/tyger", "tyger", 405, "Method Not Allowed"},
-		{"bad url param", "GET", "/repair_data/", "tyger", 400, "Bad Request"},
-		{"file not found", "GET", "/repair_data/lion", "tyger", 404, "Not Found"},
-		{"too few parity shards", "GET", "/repair_data/tyger_broken", "tyger_broken", 200, `{"name":"tyger_broken","status":"Cannot repair data: 2 shards corrupt, only have 1 parity shards"}`},
-		{"Data repair", "GET", "/repair_data/tyger_bad", "tyger_bad", 200, `{"name":"tyger_bad","status":"GOOD"}`},
+		{"bad method", "POST", "/repair_data/tyger", 405, "Method Not Allowed"},
+		{"bad url param", "GET", "/repair_data/", 400, "Bad Request"},
+		{"file not found", "GET", "/repair_data/lion", 404, "Not Found"},
+		{"too few parity shards", "GET", "/repair_data/tyger_broken", 200, `{"name":"tyger_broken","status":"Cannot repair data: 2 shards corrupt, only have 1 parity shards"}`},
+		{"Data repair", "GET", "/repair_data/tyger_bad", 200, `{"name":"tyger_bad","status":"GOOD"}`},
 	}
 
 	for _, tt := range repairDataTests {
 		t.Run(tt.name, func(t *testing.T) {
-			tmpDir := createTMPDir(t, "rsbackup")
-			config := &Config{
-				BackupRoot:   tmpDir,
+			api, storage := newMemoryAPI(&Config{
+				BackupRoot:   "/backups",
 				DataShards:   2,
 				ParityShards: 1,
+			})
+			err := storage.Load("testdata", "/backups")
+			if err != nil {
+				t.Fatal(err)
 			}
-			api := &RSBackupAPI{
-				Config: config,
-				RsFileMan: &RSFileManager{
-					Config: config,
-				},
-			}
-			cloneShards(t, tt.shardName, tmpDir, config)
 
 			req := httptest.NewRequest(tt.method, tt.url, nil)
 			rr := httptest.NewRecorder()
@@ -374,3 +382,65 @@ func TestRepairData(t *testing.T) {
 		})
 	}
 }
+
+func TestFileNameRoundTrip(t *testing.T) {
+	testData, err := ioutil.ReadFile("testdata/tyger")
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{"with space", "a+b", "100%", "%2F", "naïve ☃", "tyger?x=1#y", "..."}
+
+	for _, name := range names {
+		t.Run(name, func(t *testing.T) {
+			tmpDir := createTMPDir(t, "rsbackup")
+			config := &Config{BackupRoot: tmpDir, DataShards: 2, ParityShards: 1}
+			api := &RSBackupAPI{Config: config, RsFileMan: &RSFileManager{Config: config}}
+
+			body := new(bytes.Buffer)
+			multipartWriter := multipart.NewWriter(body)
+			form, err := multipartWriter.CreateFormFile("file", "tyger")
+			if err != nil {
+				t.Fatal(err)
+			}
+			form.Write(testData)
+			multipartWriter.WriteField("filename", name)
+			multipartWriter.Close()
+			req := httptest.NewRequest("POST", "/submit_data", body)
+			req.Header.Set("Content-Type", multipartWriter.FormDataContentType())
+			rr := httptest.NewRecorder()
+			http.HandlerFunc(api.submitDataHandler).ServeHTTP(rr, req)
+			if rr.Code != 200 {
+				t.Fatalf("Got status code %d submitting '%s'", rr.Code, name)
+			}
+
+			for verb, handler := range map[string]http.HandlerFunc{
+				"check_data":    api.checkDataHandler,
+				"retrieve_data": api.retrieveDataHandler,
+				"repair_data":   api.repairDataHandler,
+			} {
+				req := httptest.NewRequest("GET", "/"+verb+"/"+url.PathEscape(name), nil)
+				rr := httptest.NewRecorder()
+				handler.ServeHTTP(rr, req)
+				if rr.Code != 200 {
+					t.Errorf("Got status code %d for %s of '%s'", rr.Code, verb, name)
+				}
+				if verb == "retrieve_data" && !bytes.Equal(rr.Body.Bytes(), testData) {
+					t.Errorf("Retrieved data of '%s' doesn't match", name)
+				}
+			}
+		})
+	}
+}
+
+func TestFileNameParamRejectsIllegalNames(t *testing.T) {
+	for _, escaped := range []string{"..", ".", "a%2Fb", "..%2F..%2Fetc", "a%00b", "%FF", "%2E%2E"} {
+		u, err := url.Parse("/check_data/" + escaped)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fname, err := getFileNameParam(u)
+		if err == nil {
+			t.Errorf("Expected error for '%s', got name '%s'", escaped, fname)
+		}
+	}
+}
@@ -0,0 +1,203 @@
+package rsbackup
+
+import (
+	"bytes"
+	"container/list"
+	"net/http"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const idempotencyKeyHeader = "Idempotency-Key"
+
+// idempotentResult is a completed (or in-flight) response to a request
+// carrying an Idempotency-Key header.
+type idempotentResult struct {
+	key     string
+	method  string
+	path    string
+	created time.Time
+	done    chan struct{}
+
+	status int
+	header http.Header
+	body   []byte
+}
+
+// idempotencyCache is a bounded, TTL'd cache of results keyed by the
+// client supplied Idempotency-Key. Once full, the oldest entry is evicted.
+type idempotencyCache struct {
+	mu         sync.Mutex
+	ttl        time.Duration
+	maxEntries int
+	entries    map[string]*list.Element
+	order      *list.List
+}
+
+func newIdempotencyCache(maxEntries int, ttl time.Duration) *idempotencyCache {
+	return &idempotencyCache{
+		ttl:        ttl,
+		maxEntries: maxEntries,
+		entries:    make(map[string]*list.Element),
+		order:      list.New(),
+	}
+}
+
+// reserve returns the existing result for key, or registers a new in-flight
+// result and returns it with created set to true. The caller that created
+// the result must call complete or release on it.
+func (c *idempotencyCache) reserve(key, method, path string) (*idempotentResult, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	c.expire(now)
+	if elem, ok := c.entries[key]; ok {
+		return elem.Value.(*idempotentResult), false
+	}
+	res := &idempotentResult{
+		key:     key,
+		method:  method,
+		path:    path,
+		created: now,
+		done:    make(chan struct{}),
+	}
+	c.entries[key] = c.order.PushBack(res)
+	for c.maxEntries > 0 && c.order.Len() > c.maxEntries {
+		c.remove(c.order.Front())
+	}
+	return res, true
+}
+
+func (c *idempotencyCache) complete(res *idempotentResult, status int, header http.Header, body []byte) {
+	res.status = status
+	res.header = header
+	res.body = body
+	close(res.done)
+}
+
+// release drops an in-flight result without caching it, so that the next
+// request with the same key is processed again.
+func (c *idempotencyCache) release(res *idempotentResult) {
+	c.mu.Lock()
+	if elem, ok := c.entries[res.key]; ok && elem.Value.(*idempotentResult) == res {
+		c.remove(elem)
+	}
+	c.mu.Unlock()
+	close(res.done)
+}
+
+// expire must be called with c.mu held.
+func (c *idempotencyCache) expire(now time.Time) {
+	for elem := c.order.Front(); elem != nil; elem = c.order.Front() {
+		if now.Sub(elem.Value.(*idempotentResult).created) < c.ttl {
+			return
+		}
+		c.remove(elem)
+	}
+}
+
+// remove must be called with c.mu held.
+func (c *idempotencyCache) remove(elem *list.Element) {
+	delete(c.entries, elem.Value.(*idempotentResult).key)
+	c.order.Remove(elem)
+}
+
+// recordingResponseWriter passes writes through to the client while keeping
+// a copy of the status and body.
+type recordingResponseWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (w *recordingResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *recordingResponseWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *recordingResponseWriter) Flush() {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *recordingResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// idempotent wraps a mutating handler so that requests retried with the same
+// Idempotency-Key header get the original response replayed instead of
+// performing the operation a second time. Server errors aren't replayed,
+// requests that failed with one run again. Requests without the header are
+// passed through untouched.
+func (rs *RSBackupAPI) idempotent(cache *idempotencyCache, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(idempotencyKeyHeader)
+		if key == "" {
+			next(w, r)
+			return
+		}
+		// Keys are only unique per client, never replay one client's
+		// response to another.
+		cacheKey := key
+		if token, ok := requestToken(r); ok {
+			cacheKey = token.Name + "\x00" + key
+		}
+		res, created := cache.reserve(cacheKey, r.Method, r.URL.Path)
+		if !created {
+			<-res.done
+			if res.method != r.Method || res.path != r.URL.Path {
+				rs.Errorf(r, "Idempotency key '%s' reused for %s %s, originally %s %s", key, r.Method, r.URL.Path, res.method, res.path)
+				http.Error(w, http.StatusText(http.StatusUnprocessableEntity), http.StatusUnprocessableEntity)
+				return
+			}
+			if res.status == 0 {
+				// The original request was abandoned before completing, retry it.
+				rs.idempotent(cache, next)(w, r)
+				return
+			}
+			log.Debugf("Replaying response for idempotency key '%s'", key)
+			for k, v := range res.header {
+				w.Header()[k] = v
+			}
+			w.Header().Set("Idempotent-Replayed", "true")
+			w.WriteHeader(res.status)
+			w.Write(res.body)
+			return
+		}
+
+		rec := &recordingResponseWriter{ResponseWriter: w}
+		completed := false
+		defer func() {
+			if !completed {
+				cache.release(res)
+			}
+		}()
+		next(rec, r)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		if rec.status >= 500 {
+			// Server errors are usually transient, like a full disk or
+			// queue, so a retry with the same key runs the request again.
+			return
+		}
+		cache.complete(res, rec.status, w.Header().Clone(), rec.body.Bytes())
+		completed = true
+	}
+}
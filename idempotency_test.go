@@ -0,0 +1,110 @@
+package rsbackup
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestIdempotentHandler(t *testing.T) {
+	idempotentTests := []struct {
+		name           string
+		firstURL       string
+		firstKey       string
+		secondURL      string
+		secondKey      string
+		firstStatus    int
+		expectedStatus int
+		expectedRsp    string
+		expectedCalls  int
+	}{
+		{"no key", "/submit_data", "", "/submit_data", "", 200, 200, "call 2", 2},
+		{"different keys", "/submit_data", "abc", "/submit_data", "def", 200, 200, "call 2", 2},
+		{"replayed", "/submit_data", "abc", "/submit_data", "abc", 200, 200, "call 1", 1},
+		{"client error replayed", "/submit_data", "abc", "/submit_data", "abc", 400, 400, "call 1", 1},
+		{"server error retried", "/submit_data", "abc", "/submit_data", "abc", 503, 200, "call 2", 2},
+		{"key reused for other path", "/repair_data/a", "abc", "/repair_data/b", "abc", 200, 422, "Unprocessable Entity\n", 1},
+	}
+
+	for _, tt := range idempotentTests {
+		t.Run(tt.name, func(t *testing.T) {
+			api := &RSBackupAPI{Config: &Config{}}
+			calls := 0
+			handler := api.idempotent(newIdempotencyCache(10, time.Minute), func(w http.ResponseWriter, r *http.Request) {
+				calls++
+				if calls == 1 {
+					w.WriteHeader(tt.firstStatus)
+				}
+				fmt.Fprintf(w, "call %d", calls)
+			})
+
+			req := httptest.NewRequest("POST", tt.firstURL, nil)
+			req.Header.Set(idempotencyKeyHeader, tt.firstKey)
+			handler(httptest.NewRecorder(), req)
+
+			req = httptest.NewRequest("POST", tt.secondURL, nil)
+			req.Header.Set(idempotencyKeyHeader, tt.secondKey)
+			rr := httptest.NewRecorder()
+			handler(rr, req)
+			rsp := rr.Result()
+
+			if rsp.StatusCode != tt.expectedStatus {
+				t.Errorf("Got status code %d, expected %d", rsp.StatusCode, tt.expectedStatus)
+			}
+			body, err := ioutil.ReadAll(rsp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(body) != tt.expectedRsp {
+				t.Errorf("Got rsp body '%s', expected '%s'", body, tt.expectedRsp)
+			}
+			if calls != tt.expectedCalls {
+				t.Errorf("Handler called %d times, expected %d", calls, tt.expectedCalls)
+			}
+		})
+	}
+}
+
+func TestIdempotentMintToken(t *testing.T) {
+	api := &RSBackupAPI{Config: &Config{}, Tokens: newTestTokenStore(t)}
+	handler := api.authenticated(ScopeAdmin, api.idempotent(newIdempotencyCache(10, time.Minute), api.mintTokenHandler))
+	mint := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/mint_token?name=ci", nil)
+		req.Header.Set("Authorization", "Bearer "+testAdminSecret)
+		req.Header.Set(idempotencyKeyHeader, "mint")
+		rr := httptest.NewRecorder()
+		handler(rr, req)
+		return rr
+	}
+	before := api.Tokens.Len()
+	first := mint()
+	second := mint()
+	if first.Code != 200 || second.Code != 200 || second.Body.String() != first.Body.String() || second.Header().Get("Idempotent-Replayed") != "true" {
+		t.Errorf("Got %d '%s' retrying, originally %d '%s'", second.Code, second.Body, first.Code, first.Body)
+	}
+	if minted := api.Tokens.Len() - before; minted != 1 {
+		t.Errorf("Minted %d tokens", minted)
+	}
+}
+
+func TestIdempotencyCacheBounds(t *testing.T) {
+	cache := newIdempotencyCache(2, time.Minute)
+	for _, key := range []string{"a", "b", "c"} {
+		res, _ := cache.reserve(key, "POST", "/submit_data")
+		cache.complete(res, 200, http.Header{}, nil)
+	}
+	if _, created := cache.reserve("a", "POST", "/submit_data"); !created {
+		t.Errorf("Expected oldest key to be evicted")
+	}
+
+	cache = newIdempotencyCache(10, time.Millisecond)
+	res, _ := cache.reserve("a", "POST", "/submit_data")
+	cache.complete(res, 200, http.Header{}, nil)
+	time.Sleep(5 * time.Millisecond)
+	if _, created := cache.reserve("a", "POST", "/submit_data"); !created {
+		t.Errorf("Expected key to expire")
+	}
+}
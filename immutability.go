@@ -0,0 +1,101 @@
+package rsbackup
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+)
+
+var (
+	errImmutable = errors.New("File is immutable")
+	errRetained  = errors.New("File is under retention")
+)
+
+// storedAt returns when the file at fpath, with extras in its metadata,
+// was stored.
+func (r *RSFileManager) storedAt(fpath string, extras MetadataExtras) (time.Time, error) {
+	if extras.StoredAt != nil {
+		return *extras.StoredAt, nil
+	}
+	// Files stored before StoredAt was recorded, or imported from them,
+	// fall back to when the data file was written.
+	stat, err := r.storage().Stat(fpath)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return stat.ModTime(), nil
+}
+
+// immutableUntil returns until when the file at fpath, with extras in its
+// metadata, is immutable, the zero time if it isn't, or forever when
+// there's no end. Files are immutable when the server is or when they were
+// stored as such, and stay so for ImmutableRetention after they were
+// stored.
+func (r *RSFileManager) immutableUntil(fpath string, extras MetadataExtras) (until time.Time, forever bool, err error) {
+	if !r.Config.Immutable && !extras.Immutable {
+		return time.Time{}, false, nil
+	}
+	if r.Config.ImmutableRetention == 0 {
+		return time.Time{}, true, nil
+	}
+	storedAt, err := r.storedAt(fpath, extras)
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	until = storedAt.Add(r.Config.ImmutableRetention)
+	if !time.Now().Before(until) {
+		return time.Time{}, false, nil
+	}
+	return until, false, nil
+}
+
+// checkMutable returns an error wrapping errImmutable or errRetained if
+// the file at fpath may not be deleted or renamed yet. With override the
+// retention lock set by the client is ignored, immutability never is. It
+// must be called with renameMu held, so the answer holds until the change
+// is made.
+func (r *RSFileManager) checkMutable(fpath string, override bool) error {
+	extras, err := r.ReadExtras(fpath)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	until, forever, err := r.immutableUntil(fpath, extras)
+	switch {
+	case err != nil:
+		return err
+	case forever:
+		return errImmutable
+	case !until.IsZero():
+		return fmt.Errorf("%w until %s", errImmutable, until.UTC().Format(time.RFC3339))
+	}
+	if !override && extras.RetainUntil != nil && time.Now().Before(*extras.RetainUntil) {
+		return fmt.Errorf("%w until %s", errRetained, extras.RetainUntil.UTC().Format(time.RFC3339))
+	}
+	return nil
+}
+
+// isLocked tells whether err was returned for a file that's immutable or
+// under retention.
+func isLocked(err error) bool {
+	return errors.Is(err, errImmutable) || errors.Is(err, errRetained)
+}
+
+// retainUntilParam parses the retain_until form field of a submit, an
+// RFC 3339 time in the future, or returns nil if it's missing.
+func retainUntilParam(r *http.Request) (*time.Time, error) {
+	value := r.FormValue("retain_until")
+	if value == "" {
+		return nil, nil
+	}
+	until, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return nil, fmt.Errorf("Bad retain_until: %w", err)
+	}
+	if !until.After(time.Now()) {
+		return nil, fmt.Errorf("retain_until %s is in the past", value)
+	}
+	until = until.UTC()
+	return &until, nil
+}
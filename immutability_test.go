@@ -0,0 +1,114 @@
+package rsbackup
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+)
+
+// setExtras records extras in the metadata of fname.
+func setExtras(t *testing.T, fm *RSFileManager, fname string, extras MetadataExtras) {
+	fpath := fm.DataPath(fname)
+	md, err := fm.readStoredMetadata(fpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	md.MetadataExtras = extras
+	err = fm.replaceMetadata(fpath, md)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCheckMutable(t *testing.T) {
+	tmpDir := createTMPDir(t, "rsbackup")
+	conf := &Config{BackupRoot: tmpDir, DataShards: 2, ParityShards: 1}
+	fm := &RSFileManager{Config: conf}
+	cloneShards(t, "tyger", tmpDir, conf)
+	fpath := fm.DataPath("tyger")
+	hourAgo := time.Now().Add(-time.Hour)
+	inHour := time.Now().Add(time.Hour)
+
+	mutableTests := []struct {
+		name      string
+		immutable bool
+		retention time.Duration
+		extras    MetadataExtras
+		override  bool
+		expected  error
+	}{
+		{"mutable", false, 0, MetadataExtras{}, false, nil},
+		{"immutable server", true, 0, MetadataExtras{}, false, errImmutable},
+		{"immutable file", false, 0, MetadataExtras{Immutable: true}, false, errImmutable},
+		{"retained", true, 2 * time.Hour, MetadataExtras{StoredAt: &hourAgo}, false, errImmutable},
+		{"retention over", false, 30 * time.Minute, MetadataExtras{Immutable: true, StoredAt: &hourAgo}, false, nil},
+		// Without StoredAt the data file's age counts, which is new.
+		{"retained by mtime", true, 30 * time.Minute, MetadataExtras{}, false, errImmutable},
+		{"retention lock", false, 0, MetadataExtras{RetainUntil: &inHour}, false, errRetained},
+		{"retention lock expired", false, 0, MetadataExtras{RetainUntil: &hourAgo}, false, nil},
+		{"retention lock overridden", false, 0, MetadataExtras{RetainUntil: &inHour}, true, nil},
+		{"immutability not overridden", true, 0, MetadataExtras{RetainUntil: &inHour}, true, errImmutable},
+	}
+	for _, tt := range mutableTests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf.Immutable = tt.immutable
+			conf.ImmutableRetention = tt.retention
+			setExtras(t, fm, "tyger", tt.extras)
+			err := fm.checkMutable(fpath, tt.override)
+			if !errors.Is(err, tt.expected) || (tt.expected == nil && err != nil) {
+				t.Errorf("Got error %v, expected %v", err, tt.expected)
+			}
+		})
+	}
+}
+
+func TestRetainUntilParam(t *testing.T) {
+	future := time.Now().Add(time.Hour).Truncate(time.Second)
+	paramTests := []struct {
+		value    string
+		expected *time.Time
+		fails    bool
+	}{
+		{"", nil, false},
+		{future.Format(time.RFC3339), &future, false},
+		{"2000-01-01T00:00:00Z", nil, true},
+		{"tomorrow", nil, true},
+	}
+	for _, tt := range paramTests {
+		r := httptest.NewRequest("POST", "/submit_data?retain_until="+url.QueryEscape(tt.value), nil)
+		until, err := retainUntilParam(r)
+		if (err != nil) != tt.fails || (until == nil) != (tt.expected == nil) || (until != nil && !until.Equal(*tt.expected)) {
+			t.Errorf("%q: got %v, %v", tt.value, until, err)
+		}
+	}
+}
+
+func TestImmutableFiles(t *testing.T) {
+	tmpDir := createTMPDir(t, "rsbackup")
+	conf := &Config{BackupRoot: tmpDir, DataShards: 2, ParityShards: 1, Immutable: true}
+	fm := &RSFileManager{Config: conf}
+	cloneShards(t, "tyger", tmpDir, conf)
+	api := &RSBackupAPI{Config: conf, RsFileMan: fm}
+
+	if err := fm.Rename("tyger", "tiger"); !errors.Is(err, errImmutable) {
+		t.Errorf("Renamed immutable file, got error %v", err)
+	}
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(api.deleteHandler).ServeHTTP(rr, httptest.NewRequest("POST", "/delete/tyger?shred=true", nil))
+	if rr.Code != http.StatusConflict {
+		t.Errorf("Got status code %d, expected 409", rr.Code)
+	}
+	// Forcing only overrides retention locks.
+	rr = httptest.NewRecorder()
+	http.HandlerFunc(api.forceDeleteHandler).ServeHTTP(rr, httptest.NewRequest("POST", "/force_delete/tyger", nil))
+	if rr.Code != http.StatusConflict {
+		t.Errorf("Got status code %d, expected 409", rr.Code)
+	}
+	if _, err := os.Stat(fm.DataPath("tyger")); err != nil {
+		t.Errorf("Immutable file is gone: %s", err)
+	}
+}
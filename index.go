@@ -0,0 +1,373 @@
+package rsbackup
+
+import (
+	"encoding/json"
+	"path"
+	"time"
+
+	"github.com/sirmackk/rsutils"
+	log "github.com/sirupsen/logrus"
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	indexObjectsBucket = []byte("objects")
+	indexStateBucket   = []byte("state")
+	indexCleanKey      = []byte("clean")
+)
+
+// IndexEntry is what the metadata index knows about a file.
+type IndexEntry struct {
+	Name string `json:"name"`
+	ID   string `json:"id,omitempty"`
+	// Size is the size of the contents as submitted, StoredSize that of
+	// the data file.
+	Size         int64             `json:"size"`
+	StoredSize   int64             `json:"stored_size"`
+	Hashes       []string          `json:"hashes"`
+	DataShards   int               `json:"data_shards"`
+	ParityShards int               `json:"parity_shards"`
+	StoredAt     *time.Time        `json:"stored_at,omitempty"`
+	Modified     time.Time         `json:"modified"`
+	Labels       map[string]string `json:"labels,omitempty"`
+	// Health is the result of the last check, at CheckedAt, and nil if
+	// the file wasn't checked since it was indexed.
+	Health    *bool      `json:"health,omitempty"`
+	CheckedAt *time.Time `json:"checked_at,omitempty"`
+}
+
+// MetadataIndex keeps the metadata of every file in a bbolt database, so
+// listings don't walk the backup root and read each metadata file. It is
+// kept in sync by the file manager, and rebuilt from the metadata files
+// when it's new or the server wasn't shut down cleanly.
+type MetadataIndex struct {
+	db *bolt.DB
+	// rebuild is set while the index can't be trusted.
+	rebuild bool
+}
+
+func OpenMetadataIndex(fpath string) (*MetadataIndex, error) {
+	db, err := bolt.Open(fpath, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	index := &MetadataIndex{db: db}
+	err = db.Update(func(tx *bolt.Tx) error {
+		state, err := tx.CreateBucketIfNotExists(indexStateBucket)
+		if err != nil {
+			return err
+		}
+		index.rebuild = state.Get(indexCleanKey) == nil
+		return state.Delete(indexCleanKey)
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return index, nil
+}
+
+// NeedsRebuild reports whether the index is new or wasn't closed cleanly.
+func (x *MetadataIndex) NeedsRebuild() bool {
+	return x.rebuild
+}
+
+// Close marks the index as in sync with the metadata files and closes it.
+func (x *MetadataIndex) Close() error {
+	err := x.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(indexStateBucket).Put(indexCleanKey, []byte{1})
+	})
+	if closeErr := x.db.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Names returns the names of the files indexed, sorted.
+func (x *MetadataIndex) Names() ([]string, error) {
+	names := []string{}
+	err := x.db.View(func(tx *bolt.Tx) error {
+		objects := tx.Bucket(indexObjectsBucket)
+		if objects == nil {
+			return nil
+		}
+		return objects.ForEach(func(k, v []byte) error {
+			names = append(names, string(k))
+			return nil
+		})
+	})
+	return names, err
+}
+
+// walkPage is how many names WalkNames reads per transaction, so a slow
+// caller doesn't keep one open.
+const walkPage = 1000
+
+// WalkNames calls fn with the name of each file indexed, sorted, stopping
+// at the first error fn returns.
+func (x *MetadataIndex) WalkNames(fn func(string) error) error {
+	after := ""
+	for {
+		var page []string
+		err := x.db.View(func(tx *bolt.Tx) error {
+			objects := tx.Bucket(indexObjectsBucket)
+			if objects == nil {
+				return nil
+			}
+			c := objects.Cursor()
+			k, _ := c.First()
+			if after != "" {
+				k, _ = c.Seek([]byte(after))
+				if string(k) == after {
+					k, _ = c.Next()
+				}
+			}
+			for ; k != nil && len(page) < walkPage; k, _ = c.Next() {
+				page = append(page, string(k))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, name := range page {
+			if err := fn(name); err != nil {
+				return err
+			}
+		}
+		if len(page) < walkPage {
+			return nil
+		}
+		after = page[len(page)-1]
+	}
+}
+
+// Get returns the entry of fname.
+func (x *MetadataIndex) Get(fname string) (IndexEntry, bool) {
+	var entry IndexEntry
+	found := false
+	x.db.View(func(tx *bolt.Tx) error {
+		objects := tx.Bucket(indexObjectsBucket)
+		if objects == nil {
+			return nil
+		}
+		if v := objects.Get([]byte(fname)); v != nil {
+			found = json.Unmarshal(v, &entry) == nil
+		}
+		return nil
+	})
+	return entry, found
+}
+
+func putEntry(tx *bolt.Tx, entry IndexEntry) error {
+	objects, err := tx.CreateBucketIfNotExists(indexObjectsBucket)
+	if err != nil {
+		return err
+	}
+	var replaced *IndexEntry
+	if v := objects.Get([]byte(entry.Name)); v != nil {
+		replaced = &IndexEntry{}
+		if json.Unmarshal(v, replaced) != nil {
+			replaced = nil
+		}
+	}
+	if err := putID(tx, entry, replaced); err != nil {
+		return err
+	}
+	encoded, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	return objects.Put([]byte(entry.Name), encoded)
+}
+
+// Put adds or replaces the entry of a file.
+func (x *MetadataIndex) Put(entry IndexEntry) error {
+	return x.db.Update(func(tx *bolt.Tx) error {
+		return putEntry(tx, entry)
+	})
+}
+
+// Remove drops fname and its history from the index.
+func (x *MetadataIndex) Remove(fname string) error {
+	return x.db.Update(func(tx *bolt.Tx) error {
+		if history := tx.Bucket(indexHistoryBucket); history != nil {
+			if err := history.Delete([]byte(fname)); err != nil {
+				return err
+			}
+		}
+		objects := tx.Bucket(indexObjectsBucket)
+		if objects == nil {
+			return nil
+		}
+		var entry IndexEntry
+		if v := objects.Get([]byte(fname)); v != nil && json.Unmarshal(v, &entry) == nil && entry.ID != "" {
+			if err := tx.Bucket(indexIDsBucket).Delete([]byte(entry.ID)); err != nil {
+				return err
+			}
+		}
+		return objects.Delete([]byte(fname))
+	})
+}
+
+// Move indexes the entry and history of from as to.
+func (x *MetadataIndex) Move(from, to string) error {
+	return x.db.Update(func(tx *bolt.Tx) error {
+		if events := getHistory(tx, from); events != nil {
+			if err := tx.Bucket(indexHistoryBucket).Delete([]byte(from)); err != nil {
+				return err
+			}
+			if err := putHistory(tx, to, events); err != nil {
+				return err
+			}
+		}
+		objects := tx.Bucket(indexObjectsBucket)
+		if objects == nil {
+			return nil
+		}
+		var entry IndexEntry
+		if v := objects.Get([]byte(from)); v == nil || json.Unmarshal(v, &entry) != nil {
+			return nil
+		}
+		entry.Name = to
+		if err := objects.Delete([]byte(from)); err != nil {
+			return err
+		}
+		return putEntry(tx, entry)
+	})
+}
+
+// SetHealth records the result of checking fname, if it's indexed.
+func (x *MetadataIndex) SetHealth(fname string, health bool, at time.Time) error {
+	return x.db.Update(func(tx *bolt.Tx) error {
+		objects := tx.Bucket(indexObjectsBucket)
+		if objects == nil {
+			return nil
+		}
+		var entry IndexEntry
+		if v := objects.Get([]byte(fname)); v == nil || json.Unmarshal(v, &entry) != nil {
+			return nil
+		}
+		entry.Health, entry.CheckedAt = &health, &at
+		return putEntry(tx, entry)
+	})
+}
+
+// contentSize returns the size of the contents of a file as submitted,
+// its data file holding md.Size bytes.
+func contentSize(md *rsutils.Metadata, extras MetadataExtras) int64 {
+	size := md.Size
+	if extras.Encryption != nil {
+		size = extras.Encryption.Size
+	}
+	if extras.Compression != nil {
+		size = extras.Compression.Size
+	}
+	if extras.Dedup != nil {
+		size = extras.Dedup.Size
+	}
+	if extras.Sparse != nil {
+		size = extras.Sparse.Size
+	}
+	return size
+}
+
+// indexEntry returns the entry of the file at fpath, with metadata md.
+func (r *RSFileManager) indexEntry(fpath string, md *storedMetadata) (IndexEntry, error) {
+	stat, err := r.storage().Stat(fpath)
+	if err != nil {
+		return IndexEntry{}, err
+	}
+	return IndexEntry{
+		Name:         path.Base(fpath),
+		ID:           md.ID,
+		Size:         contentSize(md.Metadata, md.MetadataExtras),
+		StoredSize:   md.Size,
+		Hashes:       md.Hashes,
+		DataShards:   md.DataShards,
+		ParityShards: md.ParityShards,
+		StoredAt:     md.StoredAt,
+		Labels:       md.Labels,
+		Modified:     stat.ModTime().UTC(),
+	}, nil
+}
+
+// reindex updates the index entry of fname from its metadata file. The
+// file was changed already, so failing to index it is only logged; the
+// next rebuild catches up.
+func (r *RSFileManager) reindex(fname string) {
+	if r.Index == nil {
+		return
+	}
+	fpath := r.DataPath(fname)
+	md, err := r.readStoredMetadata(fpath)
+	if err == nil && md.Metadata == nil {
+		return
+	}
+	var entry IndexEntry
+	if err == nil {
+		entry, err = r.indexEntry(fpath, md)
+	}
+	if err == nil {
+		err = r.Index.Put(entry)
+	}
+	if err != nil {
+		log.Errorf("Unable to index %s: %s", fname, err)
+	}
+}
+
+// unindex drops fname from the index, like reindex.
+func (r *RSFileManager) unindex(fname string) {
+	if r.Index == nil {
+		return
+	}
+	if err := r.Index.Remove(fname); err != nil {
+		log.Errorf("Unable to drop %s from the index: %s", fname, err)
+	}
+}
+
+// RebuildIndex replaces the index with the metadata files found in the
+// backup root. Files without metadata, mid submission, are left out.
+func (r *RSFileManager) RebuildIndex() (int, error) {
+	names, err := r.listDir(r.Config.BackupRoot, r.layout().Depth())
+	if err != nil {
+		return 0, err
+	}
+	var entries []IndexEntry
+	for _, name := range names {
+		fpath := r.DataPath(name)
+		md, err := r.readStoredMetadata(fpath)
+		if err != nil || md.Metadata == nil {
+			continue
+		}
+		entry, err := r.indexEntry(fpath, md)
+		if err != nil {
+			continue
+		}
+		// Checks of files unchanged since still hold.
+		if old, ok := r.Index.Get(name); ok && old.Modified.Equal(entry.Modified) {
+			entry.Health, entry.CheckedAt = old.Health, old.CheckedAt
+		}
+		entries = append(entries, entry)
+	}
+	err = r.Index.db.Update(func(tx *bolt.Tx) error {
+		for _, bucket := range [][]byte{indexObjectsBucket, indexIDsBucket} {
+			if tx.Bucket(bucket) != nil {
+				if err := tx.DeleteBucket(bucket); err != nil {
+					return err
+				}
+			}
+		}
+		for _, entry := range entries {
+			if err := putEntry(tx, entry); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	r.Index.rebuild = false
+	return len(entries), nil
+}
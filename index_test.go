@@ -0,0 +1,109 @@
+package rsbackup
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+)
+
+func TestMetadataIndex(t *testing.T) {
+	tmpDir := createTMPDir(t, "rsbackup")
+	stateDir := createTMPDir(t, "rsbackup-state")
+	indexPath := path.Join(stateDir, "index.db")
+	config := &Config{BackupRoot: tmpDir, DataShards: 2, ParityShards: 1, Compression: "zstd"}
+	index, err := OpenMetadataIndex(indexPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !index.NeedsRebuild() {
+		t.Errorf("Expected a new index to need a rebuild")
+	}
+	fm := &RSFileManager{Config: config, Index: index}
+	api := &RSBackupAPI{Config: config, RsFileMan: fm}
+	submit := func(fname string, size int) {
+		t.Helper()
+		body := new(bytes.Buffer)
+		mw := multipart.NewWriter(body)
+		fw, _ := mw.CreateFormFile("file", fname)
+		fw.Write(bytes.Repeat([]byte("a"), size))
+		mw.WriteField("filename", fname)
+		mw.Close()
+		req := httptest.NewRequest("POST", "/submit_data", body)
+		req.Header.Set("Content-Type", mw.FormDataContentType())
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(api.submitDataHandler).ServeHTTP(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("Got status code %d submitting %s", rr.Code, fname)
+		}
+	}
+	assertListed := func(expected ...string) {
+		t.Helper()
+		names, err := fm.ListData()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(names, expected) {
+			t.Errorf("Got %v listed, expected %v", names, expected)
+		}
+	}
+
+	submit("first", 1000)
+	submit("second", 10)
+	submit("third", 10)
+	assertListed("first", "second", "third")
+	stat, err := os.Stat(fm.DataPath("first"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry, ok := index.Get("first")
+	if !ok || entry.Size != 1000 || entry.StoredSize != stat.Size() || entry.StoredAt == nil || len(entry.Hashes) != 3 {
+		t.Errorf("Got entry %+v for a compressed file of %d bytes", entry, stat.Size())
+	}
+	if err := fm.Delete("second", false, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := fm.Rename("third", "fourth"); err != nil {
+		t.Fatal(err)
+	}
+	assertListed("first", "fourth")
+	api.recordHealth("first", true)
+	if entry, _ := index.Get("first"); entry.Health == nil || !*entry.Health || entry.CheckedAt == nil {
+		t.Errorf("Got entry %+v, expected the check recorded", entry)
+	}
+
+	// A rebuild finds the files that weren't indexed, and keeps the
+	// checks of those unchanged.
+	if err := index.Remove("first"); err != nil {
+		t.Fatal(err)
+	}
+	index.Put(IndexEntry{Name: "gone"})
+	if n, err := fm.RebuildIndex(); err != nil || n != 2 {
+		t.Errorf("Got %d files indexed, error %v", n, err)
+	}
+	assertListed("first", "fourth")
+	api.recordHealth("fourth", false)
+	if _, err := fm.RebuildIndex(); err != nil {
+		t.Fatal(err)
+	}
+	if entry, _ := index.Get("fourth"); entry.Health == nil || *entry.Health {
+		t.Errorf("Got entry %+v after a rebuild, expected the check kept", entry)
+	}
+
+	// The index is only trusted after it was closed.
+	if err := index.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if index, err = OpenMetadataIndex(indexPath); err != nil || index.NeedsRebuild() {
+		t.Fatalf("Got error %v reopening the index, or it needs a rebuild", err)
+	}
+	index.db.Close()
+	if index, err = OpenMetadataIndex(indexPath); err != nil || !index.NeedsRebuild() {
+		t.Fatalf("Got error %v reopening the index, or it doesn't need a rebuild", err)
+	}
+	index.db.Close()
+}
@@ -0,0 +1,140 @@
+package rsbackup
+
+import (
+	"fmt"
+	"hash"
+	"io"
+
+	"github.com/sirmackk/rsutils"
+)
+
+// defaultSinglePassBuffer is the parity kept in memory for a file encoded
+// as it's received, unless Config.SinglePassBuffer says otherwise.
+const defaultSinglePassBuffer = 64 << 20
+
+// parityEncoder computes the parity shards and hashes of a data file of a
+// known size from its contents as they are written, so storing the file
+// doesn't take reading it again. Each byte adds to the parity of its
+// offset within its data shard, so the parity is only complete, and kept
+// in memory until then, once the whole file went through.
+type parityEncoder struct {
+	enc       incrementalCodec
+	md        *rsutils.Metadata
+	chunkSize int64
+	written   int64
+	hashes    []hash.Hash
+	hashName  string
+	parity    [][]byte
+}
+
+// newParityEncoder returns an encoder for a data file of size bytes, or
+// nil if its parity would take more than Config.SinglePassBuffer, it's
+// hashed by segment or the codec can't encode a shard at a time.
+func newParityEncoder(config *Config, size int64, dataShards, parityShards int) (*parityEncoder, error) {
+	chunkSize := (size + int64(dataShards) - 1) / int64(dataShards)
+	if size <= 0 || chunkSize*int64(parityShards) > config.singlePassBuffer() || config.segmentStripe(size, dataShards) > 0 {
+		return nil, nil
+	}
+	codec, err := config.newCodec(config.codecName(), dataShards, parityShards)
+	if err != nil {
+		return nil, err
+	}
+	enc, ok := codec.(incrementalCodec)
+	if !ok {
+		return nil, nil
+	}
+	e := &parityEncoder{
+		enc:       enc,
+		md:        &rsutils.Metadata{Size: size, DataShards: dataShards, ParityShards: parityShards},
+		chunkSize: chunkSize,
+		hashName:  config.shardHashName(),
+		hashes:    make([]hash.Hash, dataShards),
+		parity:    make([][]byte, parityShards),
+	}
+	for i := range e.hashes {
+		e.hashes[i] = newShardHash(config.shardHashName())
+	}
+	for i := range e.parity {
+		e.parity[i] = make([]byte, chunkSize)
+	}
+	return e, nil
+}
+
+// Write adds p, the next bytes of the data file, to the parity. Bytes past
+// the size the encoder was made for are only counted.
+func (e *parityEncoder) Write(p []byte) (int, error) {
+	total := len(p)
+	for len(p) > 0 && e.written < e.md.Size {
+		shard, off := int(e.written/e.chunkSize), e.written%e.chunkSize
+		n := e.chunkSize - off
+		if n > int64(len(p)) {
+			n = int64(len(p))
+		}
+		e.hashes[shard].Write(p[:n])
+		parity := make([][]byte, len(e.parity))
+		for i := range parity {
+			parity[i] = e.parity[i][off : off+n]
+		}
+		if err := e.enc.EncodeIdx(p[:n], shard, parity); err != nil {
+			return 0, err
+		}
+		e.written += n
+		p = p[n:]
+	}
+	e.written += int64(len(p))
+	return total, nil
+}
+
+// metadata returns the metadata of the data file, or nil if it wasn't the
+// size the encoder was made for.
+func (e *parityEncoder) metadata() *rsutils.Metadata {
+	if e.written != e.md.Size {
+		return nil
+	}
+	if e.md.Hashes != nil {
+		return e.md
+	}
+	// The data shards that end early are padded with zeros, which add
+	// nothing to the parity.
+	zeros := make([]byte, 32<<10)
+	for i, h := range e.hashes {
+		padding := e.chunkSize - (e.md.Size - int64(i)*e.chunkSize)
+		if padding > e.chunkSize {
+			padding = e.chunkSize
+		}
+		for padding > 0 {
+			n := int64(len(zeros))
+			if n > padding {
+				n = padding
+			}
+			h.Write(zeros[:n])
+			padding -= n
+		}
+		e.md.Hashes = append(e.md.Hashes, fmt.Sprintf("%x", h.Sum(nil)))
+	}
+	for _, parity := range e.parity {
+		e.md.Hashes = append(e.md.Hashes, shardSum(e.hashName, parity))
+	}
+	return e.md
+}
+
+// store writes the parity shards of the data file at dataFilePath in
+// storage, and returns its metadata.
+func (e *parityEncoder) store(storage StorageBackend, dataFilePath, fsync string) (*rsutils.Metadata, error) {
+	md := e.metadata()
+	if md == nil {
+		return nil, fmt.Errorf("Encoded %d bytes of %s, expected %d", e.written, dataFilePath, e.md.Size)
+	}
+	err := writeParityFiles(storage, dataFilePath, len(e.parity), fsync, func(parityWriters []io.Writer) error {
+		for i, parity := range e.parity {
+			if _, err := parityWriters[i].Write(parity); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return md, nil
+}
@@ -0,0 +1,77 @@
+package rsbackup
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+func TestParityEncoder(t *testing.T) {
+	var tests = []struct {
+		size         int64
+		dataShards   int
+		parityShards int
+	}{
+		{1, 2, 1},
+		{7, 3, 2},
+		{9, 3, 2},
+		{100, 10, 3},
+		{100000, 4, 2},
+		{5, 10, 4},
+	}
+	dir := createTMPDir(t, "rsbackup")
+	for _, tt := range tests {
+		data := make([]byte, tt.size)
+		rand.Read(data)
+		fpath := dir + "/two-pass"
+		if err := ioutil.WriteFile(fpath, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		expected, _, err := writeParity(OSBackend{}, fpath, tt.dataShards, tt.parityShards, &Config{Fsync: fsyncOff})
+		if err != nil {
+			t.Fatal(err)
+		}
+		enc, err := newParityEncoder(&Config{}, tt.size, tt.dataShards, tt.parityShards)
+		if err != nil || enc == nil {
+			t.Fatalf("Got encoder %v (error: %v)", enc, err)
+		}
+		// Written in pieces that don't line up with the shards.
+		io.CopyBuffer(enc, bytes.NewReader(data), make([]byte, 3))
+		md, err := enc.store(OSBackend{}, dir+"/single-pass", fsyncOff)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(md, expected) {
+			t.Errorf("Got metadata %+v for %d bytes, expected %+v", md, tt.size, expected)
+		}
+		for i := 1; i <= tt.parityShards; i++ {
+			got, _ := ioutil.ReadFile(fmt.Sprintf("%s/single-pass.parity.%d", dir, i))
+			want, _ := ioutil.ReadFile(fmt.Sprintf("%s.parity.%d", fpath, i))
+			if !bytes.Equal(got, want) {
+				t.Errorf("Got different parity shard %d for %d bytes", i, tt.size)
+			}
+		}
+		removeStoredObject(OSBackend{}, fpath, false)
+		removeStoredObject(OSBackend{}, dir+"/single-pass", false)
+	}
+}
+
+func TestParityEncoderSize(t *testing.T) {
+	if enc, _ := newParityEncoder(&Config{SinglePassBuffer: 499}, 1000, 2, 1); enc != nil {
+		t.Errorf("Got an encoder for parity over the limit")
+	}
+	if enc, _ := newParityEncoder(&Config{}, -1, 2, 1); enc != nil {
+		t.Errorf("Got an encoder for an unknown size")
+	}
+	for _, written := range []string{"burning", "burning bright"} {
+		enc, _ := newParityEncoder(&Config{}, int64(len("burning br")), 2, 1)
+		enc.Write([]byte(written))
+		if md := enc.metadata(); md != nil {
+			t.Errorf("Got metadata %+v after writing %q", md, written)
+		}
+	}
+}
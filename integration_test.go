@@ -0,0 +1,244 @@
+//go:build integration
+// +build integration
+
+package rsbackup
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/json"
+	"io/ioutil"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+const integrationToken = "integration-secret-0123456789"
+
+func freeAddress(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+type integrationClient struct {
+	t      *testing.T
+	client *http.Client
+	base   string
+}
+
+func (c *integrationClient) do(req *http.Request, expectedStatus int) []byte {
+	req.Header.Set("Authorization", "Bearer "+integrationToken)
+	rsp, err := c.client.Do(req)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	defer rsp.Body.Close()
+	body, err := ioutil.ReadAll(rsp.Body)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	if rsp.StatusCode != expectedStatus {
+		c.t.Fatalf("%s %s: got status code %d, expected %d: %s", req.Method, req.URL, rsp.StatusCode, expectedStatus, body)
+	}
+	return body
+}
+
+func (c *integrationClient) get(urlPath string, expectedStatus int) []byte {
+	req, err := http.NewRequest("GET", c.base+urlPath, nil)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return c.do(req, expectedStatus)
+}
+
+func (c *integrationClient) submit(fname string, data []byte) {
+	body := new(bytes.Buffer)
+	mw := multipart.NewWriter(body)
+	fw, err := mw.CreateFormFile("file", fname)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	fw.Write(data)
+	mw.WriteField("filename", fname)
+	mw.Close()
+	req, err := http.NewRequest("POST", c.base+"/submit_data", body)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	c.do(req, 200)
+}
+
+func (c *integrationClient) checkHealth(fname string) bool {
+	var rsp checkDataRsp
+	err := json.Unmarshal(c.get("/check_data/"+fname, 200), &rsp)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return rsp.Health
+}
+
+// TestIntegration runs the full server over TLS. The routes are registered
+// on http.DefaultServeMux, so there can only be one server per test binary.
+func TestIntegration(t *testing.T) {
+	tmpDir := createTMPDir(t, "rsbackup")
+	certPath, keyPath, pool := writeSelfSignedCert(t, tmpDir)
+	backupRoot := path.Join(tmpDir, "backups")
+	config := &Config{
+		BackupRoot:         backupRoot,
+		DataShards:         4,
+		ParityShards:       2,
+		Address:            freeAddress(t),
+		HttpCertPath:       certPath,
+		HttpKeyPath:        keyPath,
+		AdminTokens:        map[string]string{"integration": integrationToken},
+		ShutdownTimeout:    5 * time.Second,
+		UploadMemoryBuffer: 1 << 20,
+		IdempotencyTTL:     time.Hour,
+	}
+	_, err := OpenRepository(config, FlatLayout{}, true, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokens, err := NewTokenStore(config.StatePath("tokens.json"), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	health, err := NewHealthCache(config.StatePath("health.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	api := &RSBackupAPI{
+		Config:    config,
+		RsFileMan: &RSFileManager{Config: config},
+		Tokens:    tokens,
+		Health:    health,
+	}
+	running := api.Start()
+	defer func() {
+		if api.server != nil {
+			api.Stop()
+		}
+	}()
+
+	c := &integrationClient{
+		t:      t,
+		client: &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}},
+		base:   "https://" + config.Address,
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		select {
+		case <-running:
+			t.Fatal("Server failed to start")
+		default:
+		}
+		conn, err := tls.Dial("tcp", config.Address, &tls.Config{RootCAs: pool})
+		if err == nil {
+			conn.Close()
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Server not reachable: %s", err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	// Not a multiple of the shard count, so the last shard is padded.
+	original := make([]byte, 3<<20+12345)
+	_, err = rand.Read(original)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fname := "integration data.bin"
+	escaped := "integration%20data.bin"
+	c.submit(fname, original)
+	if !c.checkHealth(escaped) {
+		t.Fatal("Freshly submitted file is not healthy")
+	}
+
+	// Corrupt two data shards, as many as there is parity.
+	dataPath := path.Join(backupRoot, fname)
+	f, err := os.OpenFile(dataPath, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chunkSize := (int64(len(original)) + 3) / 4
+	for _, off := range []int64{10, 2*chunkSize + 4242} {
+		_, err = f.WriteAt([]byte("corrupted"), off)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	f.Close()
+
+	if c.checkHealth(escaped) {
+		t.Fatal("Corrupted file reported healthy")
+	}
+	var listing listDataRsp
+	err = json.Unmarshal(c.get("/list_data?extended=true", 200), &listing)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(listing.Objects) != 1 || listing.Objects[0].CachedHealth == nil || *listing.Objects[0].CachedHealth {
+		t.Errorf("Extended listing doesn't report cached damage: %+v", listing.Objects)
+	}
+
+	restored := c.get("/retrieve_data/"+escaped+"?verify=true", 200)
+	if !bytes.Equal(restored, original) {
+		t.Error("Data reconstructed on the fly doesn't match the original")
+	}
+
+	var repair repairDataRsp
+	err = json.Unmarshal(c.get("/repair_data/"+escaped, 200), &repair)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if repair.Status != "GOOD" {
+		t.Fatalf("Repair failed: %s", repair.Status)
+	}
+	if !c.checkHealth(escaped) {
+		t.Fatal("Repaired file is not healthy")
+	}
+	restored = c.get("/retrieve_data/"+escaped, 200)
+	if !bytes.Equal(restored, original) {
+		t.Error("Repaired data doesn't match the original")
+	}
+
+	// A retried mint is replayed instead of minting another token.
+	mint := func() []byte {
+		req, err := http.NewRequest("POST", c.base+"/mint_token?name=ci", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set(idempotencyKeyHeader, "mint-ci")
+		return c.do(req, 200)
+	}
+	if first, second := mint(), mint(); !bytes.Equal(first, second) {
+		t.Errorf("Retried mint returned '%s', originally '%s'", second, first)
+	}
+
+	// Without credentials nothing is served.
+	rsp, err := c.client.Get(c.base + "/list_data")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsp.Body.Close()
+	if rsp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Got status code %d without credentials, expected 401", rsp.StatusCode)
+	}
+
+	err = api.Stop()
+	if err != nil {
+		t.Errorf("Error stopping server: %s", err)
+	}
+}
@@ -0,0 +1,127 @@
+package rsbackup
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// inventoryItem is what the inventory reports about a file: its index
+// entry, read from the metadata when there's no index, and the last check
+// from the health cache if that's enabled.
+type inventoryItem struct {
+	IndexEntry
+	// CheckError is set when the last check couldn't read the file, Error
+	// when its metadata can't be read now.
+	CheckError string `json:"check_error,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+var inventoryColumns = []string{"name", "size", "stored_size", "data_shards", "parity_shards", "hashes", "stored_at", "modified", "health", "checked_at", "check_error", "error", "id"}
+
+func (item *inventoryItem) csvRecord() []string {
+	formatTime := func(t *time.Time) string {
+		if t == nil || t.IsZero() {
+			return ""
+		}
+		return t.UTC().Format(time.RFC3339)
+	}
+	health := ""
+	if item.Health != nil {
+		health = strconv.FormatBool(*item.Health)
+	}
+	return []string{
+		item.Name,
+		strconv.FormatInt(item.Size, 10),
+		strconv.FormatInt(item.StoredSize, 10),
+		strconv.Itoa(item.DataShards),
+		strconv.Itoa(item.ParityShards),
+		strings.Join(item.Hashes, " "),
+		formatTime(item.StoredAt),
+		formatTime(&item.Modified),
+		health,
+		formatTime(item.CheckedAt),
+		item.CheckError,
+		item.Error,
+		item.ID,
+	}
+}
+
+func (rs *RSBackupAPI) inventoryItem(name string) inventoryItem {
+	item := inventoryItem{IndexEntry: IndexEntry{Name: name}}
+	if index := rs.RsFileMan.Index; index != nil {
+		if entry, ok := index.Get(name); ok {
+			item.IndexEntry = entry
+		} else {
+			item.Error = "Not indexed"
+		}
+	} else {
+		fpath := rs.RsFileMan.DataPath(name)
+		md, err := rs.RsFileMan.readStoredMetadata(fpath)
+		if err == nil && md.Metadata == nil {
+			err = fmt.Errorf("Metadata not found")
+		}
+		if err == nil {
+			item.IndexEntry, err = rs.RsFileMan.indexEntry(fpath, md)
+		}
+		if err != nil {
+			item.Error = err.Error()
+		}
+	}
+	if rs.Health != nil {
+		if record, ok := rs.Health.Get(name); ok {
+			checkedAt := record.CheckedAt
+			item.Health, item.CheckedAt, item.CheckError = &record.Health, &checkedAt, record.Error
+			if record.Error != "" {
+				item.Health = nil
+			}
+		}
+	}
+	return item
+}
+
+// inventoryHandler streams a report of every stored file as it's found, as
+// json lines or, with format=csv, as csv with a header.
+func (rs *RSBackupAPI) inventoryHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		rs.Errorf(r, "Bad method %s", r.Method)
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	format := r.FormValue("format")
+	if format != "" && format != "jsonl" && format != "ndjson" && format != "csv" {
+		rs.Errorf(r, "Bad inventory format '%s'", format)
+		http.Error(w, "format must be jsonl, ndjson or csv", http.StatusBadRequest)
+		return
+	}
+	// Once the report is streaming, errors can only be logged.
+	var err error
+	if format == "csv" {
+		w.Header().Set("Content-Type", "text/csv")
+		cw := csv.NewWriter(w)
+		err = cw.Write(inventoryColumns)
+		if err == nil {
+			err = rs.RsFileMan.WalkData(func(name string) error {
+				item := rs.inventoryItem(name)
+				return cw.Write(item.csvRecord())
+			})
+		}
+		cw.Flush()
+		if err == nil {
+			err = cw.Error()
+		}
+	} else {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		enc := json.NewEncoder(w)
+		err = rs.RsFileMan.WalkData(func(name string) error {
+			return enc.Encode(rs.inventoryItem(name))
+		})
+	}
+	if err != nil {
+		rs.Errorf(r, "Unable to write inventory: %s", err)
+	}
+}
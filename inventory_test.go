@@ -0,0 +1,88 @@
+package rsbackup
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+)
+
+func TestInventory(t *testing.T) {
+	tmpDir := createTMPDir(t, "rsbackup")
+	config := &Config{BackupRoot: tmpDir, DataShards: 2, ParityShards: 1}
+	health, err := NewHealthCache(path.Join(createTMPDir(t, "rsbackup-state"), "health.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	api := &RSBackupAPI{Config: config, RsFileMan: &RSFileManager{Config: config}, Health: health}
+	for _, fname := range []string{"tyger", "lamb", "fly"} {
+		body := new(bytes.Buffer)
+		mw := multipart.NewWriter(body)
+		fw, _ := mw.CreateFormFile("file", fname)
+		fw.Write([]byte("little " + fname))
+		mw.WriteField("filename", fname)
+		mw.Close()
+		req := httptest.NewRequest("POST", "/submit_data", body)
+		req.Header.Set("Content-Type", mw.FormDataContentType())
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(api.submitDataHandler).ServeHTTP(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("Got status code %d submitting %s", rr.Code, fname)
+		}
+	}
+	api.recordHealth("tyger", true)
+	health.RecordError("lamb", fmt.Errorf("disk on fire"))
+	os.Remove(api.RsFileMan.DataPath("fly") + ".md")
+	os.Remove(api.RsFileMan.DataPath("fly") + metadataMirrorSuffix)
+	inventory := func(query string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(api.inventoryHandler).ServeHTTP(rr, httptest.NewRequest("GET", "/inventory"+query, nil))
+		return rr
+	}
+
+	rr := inventory("")
+	dec := json.NewDecoder(rr.Body)
+	items := make(map[string]inventoryItem)
+	for dec.More() {
+		var item inventoryItem
+		if err := dec.Decode(&item); err != nil {
+			t.Fatal(err)
+		}
+		items[item.Name] = item
+	}
+	if rr.Code != http.StatusOK || len(items) != 3 {
+		t.Fatalf("Got status code %d and %d items", rr.Code, len(items))
+	}
+	if item := items["tyger"]; item.Size != 12 || item.DataShards != 2 || item.ParityShards != 1 || len(item.Hashes) != 3 || item.StoredAt == nil || item.Health == nil || !*item.Health || item.CheckedAt == nil {
+		t.Errorf("Got item %+v", item)
+	}
+	if item := items["lamb"]; item.Health != nil || item.CheckError != "disk on fire" || item.Error != "" {
+		t.Errorf("Got item %+v for a file that couldn't be checked", item)
+	}
+	if item := items["fly"]; item.Error == "" || item.Hashes != nil {
+		t.Errorf("Got item %+v for a file without metadata", item)
+	}
+
+	rr = inventory("?format=csv")
+	records, err := csv.NewReader(rr.Body).ReadAll()
+	if err != nil || rr.Code != http.StatusOK || len(records) != 4 {
+		t.Fatalf("Got status code %d and %d records (error: %v)", rr.Code, len(records), err)
+	}
+	if !reflect.DeepEqual(records[0], inventoryColumns) {
+		t.Errorf("Got header %v", records[0])
+	}
+	tyger := records[3]
+	if tyger[0] != "tyger" || tyger[1] != "12" || tyger[3] != "2" || tyger[8] != "true" || tyger[9] == "" || len(tyger[5]) != 3*64+2 {
+		t.Errorf("Got record %v", tyger)
+	}
+	if rr := inventory("?format=xml"); rr.Code != http.StatusBadRequest {
+		t.Errorf("Got status code %d for an unknown format", rr.Code)
+	}
+}
@@ -0,0 +1,120 @@
+package rsbackup
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// parseNetworks parses CIDRs like "10.0.0.0/8". Single addresses are taken
+// to be networks of their own.
+func parseNetworks(specs []string) ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0, len(specs))
+	for _, spec := range specs {
+		if !strings.Contains(spec, "/") {
+			ip := net.ParseIP(spec)
+			if ip == nil {
+				return nil, fmt.Errorf("Invalid address '%s'", spec)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 8 * net.IPv4len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(spec)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid network '%s'", spec)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// mustParseNetworks is parseNetworks for lists already checked by
+// Config.Validate.
+func mustParseNetworks(specs []string) []*net.IPNet {
+	networks, err := parseNetworks(specs)
+	if err != nil {
+		log.Errorf("Ignoring networks %v: %s", specs, err)
+	}
+	return networks
+}
+
+func containsIP(networks []*net.IPNet, ip net.IP) bool {
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ipFilter decides by source address which requests get served. Denied
+// networks win over allowed ones and, if any networks are allowed, nothing
+// else is.
+type ipFilter struct {
+	allow []*net.IPNet
+	deny  []*net.IPNet
+}
+
+func (f ipFilter) permits(ip net.IP) bool {
+	if ip == nil {
+		return len(f.allow) == 0 && len(f.deny) == 0
+	}
+	if containsIP(f.deny, ip) {
+		return false
+	}
+	return len(f.allow) == 0 || containsIP(f.allow, ip)
+}
+
+// clientAddr returns the address a request comes from. X-Forwarded-For is
+// only believed when the request comes from a trusted proxy, and then the
+// client is the last address in it that isn't a trusted proxy itself.
+func (rs *RSBackupAPI) clientAddr(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !containsIP(rs.trustedProxies, ip) {
+		return ip
+	}
+	forwarded := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		hop := net.ParseIP(strings.TrimSpace(forwarded[i]))
+		if hop == nil {
+			break
+		}
+		ip = hop
+		if !containsIP(rs.trustedProxies, hop) {
+			break
+		}
+	}
+	return ip
+}
+
+func (rs *RSBackupAPI) clientIP(r *http.Request) string {
+	if ip := rs.clientAddr(r); ip != nil {
+		return ip.String()
+	}
+	return "Unknown"
+}
+
+// filtered refuses requests from addresses filter doesn't permit before
+// they reach next.
+func (rs *RSBackupAPI) filtered(filter ipFilter, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !filter.permits(rs.clientAddr(r)) {
+			rs.Errorf(r, "Address not allowed to %s %s", r.Method, r.URL.Path)
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+		next(w, r)
+	}
+}
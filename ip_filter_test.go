@@ -0,0 +1,77 @@
+package rsbackup
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientAddr(t *testing.T) {
+	api := &RSBackupAPI{Config: &Config{}, trustedProxies: mustParseNetworks([]string{"10.0.0.0/8", "192.168.1.1"})}
+	addrTests := []struct {
+		name         string
+		remoteAddr   string
+		forwardedFor []string
+		expectedIP   string
+	}{
+		{"direct", "203.0.113.7:4242", nil, "203.0.113.7"},
+		{"forged header", "203.0.113.7:4242", []string{"10.1.1.1"}, "203.0.113.7"},
+		{"trusted proxy", "10.0.0.1:4242", []string{"198.51.100.3"}, "198.51.100.3"},
+		{"chain of proxies", "10.0.0.1:4242", []string{"6.6.6.6, 198.51.100.3", "192.168.1.1"}, "198.51.100.3"},
+		{"proxy without header", "10.0.0.1:4242", nil, "10.0.0.1"},
+		{"garbage in header", "10.0.0.1:4242", []string{"nonsense"}, "10.0.0.1"},
+	}
+	for _, tt := range addrTests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/list_data", nil)
+			req.RemoteAddr = tt.remoteAddr
+			for _, value := range tt.forwardedFor {
+				req.Header.Add("X-Forwarded-For", value)
+			}
+			if ip := api.clientIP(req); ip != tt.expectedIP {
+				t.Errorf("Got client address %s, expected %s", ip, tt.expectedIP)
+			}
+		})
+	}
+}
+
+func TestFiltered(t *testing.T) {
+	api := &RSBackupAPI{Config: &Config{}}
+	filter := ipFilter{
+		allow: mustParseNetworks([]string{"10.0.0.0/8", "2001:db8::/32"}),
+		deny:  mustParseNetworks([]string{"10.6.6.6"}),
+	}
+	handler := api.filtered(filter, func(w http.ResponseWriter, r *http.Request) {})
+	filterTests := []struct {
+		remoteAddr     string
+		expectedStatus int
+	}{
+		{"10.1.2.3:4242", 200},
+		{"10.6.6.6:4242", 403},
+		{"203.0.113.7:4242", 403},
+		{"[2001:db8::1]:4242", 200},
+		{"[2001:db9::1]:4242", 403},
+	}
+	for _, tt := range filterTests {
+		req := httptest.NewRequest("GET", "/list_data", nil)
+		req.RemoteAddr = tt.remoteAddr
+		rr := httptest.NewRecorder()
+		handler(rr, req)
+		if rr.Code != tt.expectedStatus {
+			t.Errorf("Got status code %d for %s, expected %d", rr.Code, tt.remoteAddr, tt.expectedStatus)
+		}
+	}
+}
+
+func TestParseNetworks(t *testing.T) {
+	for _, spec := range []string{"10.0.0.0/8", "192.168.1.1", "::1", "2001:db8::/32"} {
+		if _, err := parseNetworks([]string{spec}); err != nil {
+			t.Errorf("Rejected '%s': %s", spec, err)
+		}
+	}
+	for _, spec := range []string{"10.0.0.0/33", "localhost", ""} {
+		if _, err := parseNetworks([]string{spec}); err == nil {
+			t.Errorf("Accepted '%s'", spec)
+		}
+	}
+}
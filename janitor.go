@@ -0,0 +1,202 @@
+package rsbackup
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// janitorInterval is how often leftovers of uploads are looked for.
+const janitorInterval = time.Hour
+
+// stagingEntryPrefixes start the names of what uploads leave in the
+// staging directory: temporary files of multipart forms and the
+// directories of stagingDir.
+var stagingEntryPrefixes = []string{"multipart-", "shards-", "import-"}
+
+// cleanLeftovers removes what crashed or aborted uploads left behind,
+// untouched since before: entries of the staging directory, files staged
+// in storage, and parity shards and metadata whose data file is gone,
+// which would keep a file of that name from being stored again. Closing
+// stop ends it early.
+func (rs *RSBackupAPI) cleanLeftovers(job *jobProgress, stop <-chan struct{}, before time.Time) error {
+	err := cleanStagingDir(rs.Config.StagingPath(), before, job)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	fm := rs.RsFileMan
+	for _, files := range []*RSFileManager{fm, fm.chunkFiles(), fm.packFiles()} {
+		err = files.sweep(files.Config.BackupRoot, files.layout().Depth(), before, job, stop)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// cleanStagingDir removes the entries uploads left in the local staging
+// directory dir that weren't changed since before. Anything else in it is
+// left alone, it may be shared.
+func cleanStagingDir(dir string, before time.Time, job *jobProgress) error {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if !hasStagingEntryPrefix(entry.Name()) {
+			continue
+		}
+		fpath := path.Join(dir, entry.Name())
+		modified, err := lastModified(OSBackend{}, fpath)
+		if err != nil || modified.After(before) {
+			continue
+		}
+		log.Warnf("Removing '%s', left by an upload at %s", fpath, modified.Format(time.RFC3339))
+		err = os.RemoveAll(fpath)
+		job.done(fpath, err)
+	}
+	return nil
+}
+
+func hasStagingEntryPrefix(name string) bool {
+	for _, prefix := range stagingEntryPrefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// sweep removes stale staged files and orphaned parity shards and
+// metadata up to depth directory levels below dir.
+func (r *RSFileManager) sweep(dir string, depth int, before time.Time, job *jobProgress, stop <-chan struct{}) error {
+	storage := r.storage()
+	names, err := storage.List(dir)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		select {
+		case <-stop:
+			return nil
+		default:
+		}
+		fpath := path.Join(dir, name)
+		switch {
+		case isStagingName(name):
+			var modified time.Time
+			modified, err = lastModified(storage, fpath)
+			if err == nil && modified.Before(before) {
+				log.Warnf("Removing '%s', staged at %s", fpath, modified.Format(time.RFC3339))
+				err = removeTree(storage, fpath)
+				job.done(fpath, err)
+			}
+		case isReservedName(name):
+		case depth > 0:
+			err = r.sweep(fpath, depth-1, before, job, stop)
+		default:
+			err = r.removeOrphan(fpath, before, job)
+		}
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeOrphan removes fpath if it's a parity shard or metadata whose data
+// file is gone, unchanged since before.
+func (r *RSFileManager) removeOrphan(fpath string, before time.Time, job *jobProgress) error {
+	base, shard := shardOf(fpath)
+	if shard == 0 {
+		return nil
+	}
+	// Renames and deletes remove the files of a data file one by one.
+	renameMu.Lock()
+	defer renameMu.Unlock()
+	storage := r.storage()
+	if _, err := storage.Stat(base); !os.IsNotExist(err) {
+		return err
+	}
+	// A data file that is only named like one has metadata of its own.
+	if _, err := storage.Stat(fpath + ".md"); !os.IsNotExist(err) {
+		return err
+	}
+	stat, err := storage.Stat(fpath)
+	if err != nil || stat.ModTime().After(before) {
+		return err
+	}
+	log.Warnf("Removing '%s', its data file is gone", fpath)
+	err = storage.Remove(fpath)
+	job.done(fpath, err)
+	return err
+}
+
+// lastModified returns when fpath, or anything below it if it's a
+// directory, was last changed.
+func lastModified(storage StorageBackend, fpath string) (time.Time, error) {
+	stat, err := storage.Stat(fpath)
+	if err != nil {
+		return time.Time{}, err
+	}
+	modified := stat.ModTime()
+	if !stat.IsDir() {
+		return modified, nil
+	}
+	names, err := storage.List(fpath)
+	if err != nil {
+		return time.Time{}, err
+	}
+	for _, name := range names {
+		t, err := lastModified(storage, path.Join(fpath, name))
+		if err != nil {
+			return time.Time{}, err
+		}
+		if t.After(modified) {
+			modified = t
+		}
+	}
+	return modified, nil
+}
+
+func (rs *RSBackupAPI) janitor(job *jobProgress, stop <-chan struct{}) error {
+	return rs.cleanLeftovers(job, stop, time.Now().Add(-rs.Config.StagingMaxAge))
+}
+
+// StartJanitor removes what uploads left behind longer than
+// Config.StagingMaxAge ago, every janitorInterval until the server is
+// stopped.
+func (rs *RSBackupAPI) StartJanitor() {
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(janitorInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+			_, err := rs.background().jobs.start("janitor", rs.janitor)
+			if err != nil {
+				log.Warnf("Skipping janitor: %s", err)
+			}
+		}
+	}()
+	rs.OnShutdown("janitor", func(ctx context.Context) error {
+		close(stop)
+		select {
+		case <-done:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	})
+}
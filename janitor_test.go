@@ -0,0 +1,76 @@
+package rsbackup
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestJanitor(t *testing.T) {
+	tmpDir := createTMPDir(t, "rsbackup")
+	stagingDir := createTMPDir(t, "rsbackup-staging")
+	conf := &Config{BackupRoot: tmpDir, DataShards: 2, ParityShards: 1, StagingDir: stagingDir, StagingMaxAge: time.Hour}
+	fm := &RSFileManager{Config: conf}
+	api := &RSBackupAPI{Config: conf, RsFileMan: fm}
+	submitData(t, api, "kept", []byte("kept"))
+
+	old := time.Now().Add(-2 * time.Hour)
+	write := func(fpath string, modified time.Time) {
+		if err := os.MkdirAll(path.Dir(fpath), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(fpath, []byte("left over"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		// Its directory too, in case write created it.
+		for _, p := range []string{fpath, path.Dir(fpath)} {
+			if p == tmpDir || p == stagingDir {
+				continue
+			}
+			if err := os.Chtimes(p, modified, modified); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	write(path.Join(tmpDir, "gone.parity.1"), old)
+	write(path.Join(tmpDir, "gone.md"), old)
+	write(path.Join(tmpDir, "fresh.parity.1"), time.Now())
+	write(path.Join(tmpDir, stagingPrefix+"0123456789abcdef", "crashed"), old)
+	write(path.Join(stagingDir, "shards-123", "staged"), old)
+	write(path.Join(stagingDir, "multipart-456"), time.Now())
+	write(path.Join(stagingDir, "unrelated"), old)
+	// A data file only named like a shard.
+	submitData(t, api, "notes.md", []byte("notes"))
+	for _, fpath := range []string{path.Join(tmpDir, "notes.md"), path.Join(tmpDir, "notes.md.md")} {
+		if err := os.Chtimes(fpath, old, old); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	job, err := api.background().jobs.start("janitor", api.janitor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job = waitForJob(t, api, job.ID); job.State != jobDone || len(job.Failed) != 0 {
+		t.Fatalf("Got job %+v", job)
+	}
+	for _, fpath := range []string{"gone.parity.1", "gone.md", stagingPrefix + "0123456789abcdef"} {
+		if _, err := os.Stat(path.Join(tmpDir, fpath)); !os.IsNotExist(err) {
+			t.Errorf("Got %v stating leftover %s", err, fpath)
+		}
+	}
+	if _, err := os.Stat(path.Join(stagingDir, "shards-123")); !os.IsNotExist(err) {
+		t.Errorf("Got %v stating a stale staging directory", err)
+	}
+	for _, fpath := range []string{path.Join(tmpDir, "fresh.parity.1"), path.Join(tmpDir, "notes.md"), path.Join(stagingDir, "multipart-456"), path.Join(stagingDir, "unrelated")} {
+		if _, err := os.Stat(fpath); err != nil {
+			t.Errorf("%s was removed: %s", fpath, err)
+		}
+	}
+	if health, _, _, err := fm.CheckData("kept"); err != nil || !health {
+		t.Errorf("Got health %t for a stored file (error: %v)", health, err)
+	}
+	submitData(t, api, "gone", []byte("stored again"))
+}
@@ -0,0 +1,301 @@
+package rsbackup
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	errJobNotFound = errors.New("Job not found")
+	errJobRunning  = errors.New("A job of this kind is already running")
+)
+
+// Job states.
+const (
+	jobRunning   = "running"
+	jobDone      = "done"
+	jobFailed    = "failed"
+	jobCancelled = "cancelled"
+)
+
+// maxFinishedJobs bounds how many finished jobs are remembered.
+const maxFinishedJobs = 100
+
+// Job is a long running operation started by an admin. Jobs are kept in
+// memory only, a restart forgets them and ends the running ones.
+type Job struct {
+	ID    string `json:"id"`
+	Kind  string `json:"kind"`
+	State string `json:"state"`
+	// Total is how many files the job goes through, Done how many of them
+	// it got through, including the ones it couldn't process.
+	Total int `json:"total"`
+	Done  int `json:"done"`
+	// Failed maps the files the job couldn't process to the reason.
+	Failed   map[string]string `json:"failed,omitempty"`
+	Error    string            `json:"error,omitempty"`
+	Started  time.Time         `json:"started"`
+	Finished *time.Time        `json:"finished,omitempty"`
+
+	seq      int
+	stop     chan struct{}
+	finished chan struct{}
+}
+
+// jobList runs jobs and keeps track of their progress.
+type jobList struct {
+	mu     sync.Mutex
+	nextID int
+	jobs   map[string]*Job
+}
+
+func newJobList() *jobList {
+	return &jobList{jobs: make(map[string]*Job)}
+}
+
+// start runs fn as a job of kind, unless one of that kind is running.
+// fn reports progress through the job it's given and must return soon
+// after stop is closed.
+func (l *jobList) start(kind string, fn func(job *jobProgress, stop <-chan struct{}) error) (Job, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, job := range l.jobs {
+		if job.Kind == kind && job.State == jobRunning {
+			return Job{}, errJobRunning
+		}
+	}
+	l.nextID++
+	job := &Job{
+		ID:       strconv.Itoa(l.nextID),
+		Kind:     kind,
+		State:    jobRunning,
+		Failed:   make(map[string]string),
+		Started:  time.Now(),
+		seq:      l.nextID,
+		stop:     make(chan struct{}),
+		finished: make(chan struct{}),
+	}
+	l.jobs[job.ID] = job
+	l.prune()
+	go func() {
+		defer close(job.finished)
+		err := fn(&jobProgress{list: l, job: job}, job.stop)
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		now := time.Now()
+		job.Finished = &now
+		select {
+		case <-job.stop:
+			job.State = jobCancelled
+		default:
+			job.State = jobDone
+		}
+		if err != nil {
+			job.State = jobFailed
+			job.Error = err.Error()
+		}
+		log.Infof("Job %s (%s) %s after %d of %d files, %d failed", job.ID, job.Kind, job.State, job.Done, job.Total, len(job.Failed))
+	}()
+	return job.snapshot(), nil
+}
+
+// prune forgets the oldest finished jobs beyond maxFinishedJobs. It must
+// be called with l.mu held.
+func (l *jobList) prune() {
+	var finished []*Job
+	for _, job := range l.jobs {
+		if job.State != jobRunning {
+			finished = append(finished, job)
+		}
+	}
+	if len(finished) <= maxFinishedJobs {
+		return
+	}
+	sort.Slice(finished, func(i, j int) bool { return finished[i].seq < finished[j].seq })
+	for _, job := range finished[:len(finished)-maxFinishedJobs] {
+		delete(l.jobs, job.ID)
+	}
+}
+
+// snapshot copies job, so it can be handed out while the job runs. It
+// must be called with the list's mu held.
+func (j *Job) snapshot() Job {
+	c := *j
+	c.Failed = make(map[string]string, len(j.Failed))
+	for name, reason := range j.Failed {
+		c.Failed[name] = reason
+	}
+	return c
+}
+
+func (l *jobList) get(id string) (Job, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	job, ok := l.jobs[id]
+	if !ok {
+		return Job{}, errJobNotFound
+	}
+	return job.snapshot(), nil
+}
+
+// list returns all jobs, oldest first.
+func (l *jobList) list() []Job {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	jobs := make([]Job, 0, len(l.jobs))
+	for _, job := range l.jobs {
+		jobs = append(jobs, job.snapshot())
+	}
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].seq < jobs[j].seq })
+	return jobs
+}
+
+// cancel asks the job id to stop. It returns once the job acknowledged,
+// or ctx is done.
+func (l *jobList) cancel(ctx context.Context, id string) error {
+	l.mu.Lock()
+	job, ok := l.jobs[id]
+	if ok && job.State == jobRunning {
+		select {
+		case <-job.stop:
+		default:
+			close(job.stop)
+		}
+	}
+	l.mu.Unlock()
+	if !ok {
+		return errJobNotFound
+	}
+	select {
+	case <-job.finished:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// waitKind waits for the running jobs of kind to be marked finished.
+func (l *jobList) waitKind(kind string) {
+	l.mu.Lock()
+	var finished []chan struct{}
+	for _, job := range l.jobs {
+		if job.Kind == kind && job.State == jobRunning {
+			finished = append(finished, job.finished)
+		}
+	}
+	l.mu.Unlock()
+	for _, ch := range finished {
+		<-ch
+	}
+}
+
+// cancelAll stops every running job, for shutdown.
+func (l *jobList) cancelAll(ctx context.Context) error {
+	l.mu.Lock()
+	var ids []string
+	for id, job := range l.jobs {
+		if job.State == jobRunning {
+			ids = append(ids, id)
+		}
+	}
+	l.mu.Unlock()
+	for _, id := range ids {
+		err := l.cancel(ctx, id)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// jobProgress is the job's side of a Job.
+type jobProgress struct {
+	list *jobList
+	job  *Job
+}
+
+func (p *jobProgress) setTotal(total int) {
+	p.list.mu.Lock()
+	p.job.Total = total
+	p.list.mu.Unlock()
+}
+
+// done counts one file as processed, failed if err isn't nil.
+func (p *jobProgress) done(name string, err error) {
+	p.list.mu.Lock()
+	p.job.Done++
+	if err != nil {
+		p.job.Failed[name] = err.Error()
+	}
+	p.list.mu.Unlock()
+}
+
+// jobsHandler lists all jobs on GET /jobs and shows one on GET
+// /jobs/{id}. POST /jobs/{id} cancels the job and shows how far it got.
+func (rs *RSBackupAPI) jobsHandler(w http.ResponseWriter, r *http.Request) {
+	jobs := rs.background().jobs
+	var rsp interface{}
+	if r.URL.Path == "/jobs" || r.URL.Path == "/jobs/" {
+		if r.Method != "GET" {
+			rs.Errorf(r, "Bad method %s", r.Method)
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		rsp = jobs.list()
+	} else {
+		id, err := getURLParam(r.URL)
+		if err != nil {
+			rs.Errorf(r, "Bad job request: %s", err)
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+		switch r.Method {
+		case "GET":
+		case "POST":
+			err = jobs.cancel(r.Context(), id)
+		default:
+			rs.Errorf(r, "Bad method %s", r.Method)
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		var job Job
+		if err == nil {
+			job, err = jobs.get(id)
+		}
+		if err == errJobNotFound {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			rs.Errorf(r, "Unable to cancel job %s: %s", id, err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		rsp = job
+	}
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(rsp)
+	if err != nil {
+		rs.Errorf(r, "Unable to marshal json response: %s", err)
+	}
+}
+
+// writeJobStarted answers a request that started job.
+func (rs *RSBackupAPI) writeJobStarted(w http.ResponseWriter, r *http.Request, job Job) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", fmt.Sprintf("/jobs/%s", job.ID))
+	w.WriteHeader(http.StatusAccepted)
+	err := json.NewEncoder(w).Encode(job)
+	if err != nil {
+		rs.Errorf(r, "Unable to marshal json response: %s", err)
+	}
+}
@@ -0,0 +1,63 @@
+package rsbackup
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestJobs(t *testing.T) {
+	api := &RSBackupAPI{Config: &Config{}}
+	jobs := api.background().jobs
+	started := make(chan struct{})
+	blocking := func(job *jobProgress, stop <-chan struct{}) error {
+		job.setTotal(3)
+		job.done("a", nil)
+		job.done("b", errors.New("unreadable"))
+		close(started)
+		<-stop
+		return nil
+	}
+	job, err := jobs.start("test", blocking)
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-started
+	if _, err := jobs.start("test", blocking); err != errJobRunning {
+		t.Errorf("Started a second job of a running kind: %v", err)
+	}
+
+	serve := func(method, target string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, nil)
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(api.jobsHandler).ServeHTTP(rr, req)
+		return rr
+	}
+	rr := serve("GET", "/jobs/"+job.ID)
+	var shown Job
+	json.NewDecoder(rr.Body).Decode(&shown)
+	if shown.State != jobRunning || shown.Total != 3 || shown.Done != 2 || shown.Failed["b"] != "unreadable" {
+		t.Errorf("Got job %+v", shown)
+	}
+	rr = serve("POST", "/jobs/"+job.ID)
+	json.NewDecoder(rr.Body).Decode(&shown)
+	if rr.Code != 200 || shown.State != jobCancelled || shown.Finished == nil {
+		t.Errorf("Got status code %d and job %+v after cancelling", rr.Code, shown)
+	}
+	if rr := serve("GET", "/jobs/42"); rr.Code != 404 {
+		t.Errorf("Got status code %d for a missing job", rr.Code)
+	}
+
+	failing, _ := jobs.start("test", func(*jobProgress, <-chan struct{}) error {
+		return errors.New("no listing")
+	})
+	jobs.cancelAll(context.Background())
+	var listed []Job
+	json.NewDecoder(serve("GET", "/jobs").Body).Decode(&listed)
+	if len(listed) != 2 || listed[1].ID != failing.ID || listed[1].State != jobFailed || listed[1].Error != "no listing" {
+		t.Errorf("Got jobs %+v", listed)
+	}
+}
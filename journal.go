@@ -0,0 +1,203 @@
+package rsbackup
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Operations recorded in the journal.
+const (
+	opStore  = "store"
+	opRename = "rename"
+	opDelete = "delete"
+	// opReencode replaces the parity and metadata of a file with those
+	// waiting in the reencode state directory under To.
+	opReencode = "reencode"
+	// opReencrypt replaces the data, parity and metadata of a file with
+	// those waiting in the rotation state directory under To.
+	opReencrypt = "reencrypt"
+)
+
+// journalEntry is an operation in progress, path the file it's kept in.
+type journalEntry struct {
+	Op        string    `json:"op"`
+	Name      string    `json:"name"`
+	To        string    `json:"to,omitempty"`
+	StartedAt time.Time `json:"started_at"`
+	path      string
+}
+
+// OperationJournal records the operations that take several steps, like
+// saving a file, writing its parity and then its metadata, while they're
+// in progress: a file per operation in dir, removed once it's over. What
+// is left after a crash is finished or undone by RecoverOperations.
+type OperationJournal struct {
+	dir string
+}
+
+func OpenOperationJournal(dir string) (*OperationJournal, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	return &OperationJournal{dir: dir}, nil
+}
+
+// begin records that op on name, renaming it to to for opRename, is about
+// to start. A nil journal records nothing.
+func (j *OperationJournal) begin(op, name, to string) (*journalEntry, error) {
+	if j == nil {
+		return nil, nil
+	}
+	id, err := generateToken()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC()
+	entry := &journalEntry{Op: op, Name: name, To: to, StartedAt: now}
+	entry.path = path.Join(j.dir, now.Format("20060102T150405.000000000")+"-"+id[:8]+".json")
+	err = writeJSONState(entry.path, entry)
+	if err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+// end records that the operation of entry is over, whether it succeeded
+// or not.
+func (j *OperationJournal) end(entry *journalEntry) {
+	if j == nil || entry == nil {
+		return
+	}
+	if err := os.Remove(entry.path); err != nil {
+		log.Errorf("Unable to close journal entry '%s': %s", entry.path, err)
+	}
+}
+
+// pending returns the entries of the operations a crash cut short, oldest
+// first.
+func (j *OperationJournal) pending() ([]*journalEntry, error) {
+	infos, err := ioutil.ReadDir(j.dir)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(infos, func(a, b int) bool { return infos[a].Name() < infos[b].Name() })
+	var entries []*journalEntry
+	for _, info := range infos {
+		if !strings.HasSuffix(info.Name(), ".json") {
+			continue
+		}
+		entry := &journalEntry{path: path.Join(j.dir, info.Name())}
+		data, err := ioutil.ReadFile(entry.path)
+		if err == nil {
+			err = json.Unmarshal(data, entry)
+		}
+		if err != nil {
+			// Cut short while it was written, before the operation began.
+			log.Warnf("Dropping unreadable journal entry '%s': %s", entry.path, err)
+			os.Remove(entry.path)
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// RecoverOperations finishes or undoes the operations left in the journal
+// by a crash, and returns how many there were. It must run before files
+// are served. A store without metadata is undone, unless its data file
+// predates it; a rename whose data file didn't move yet is undone; a
+// delete that removed the data file is finished, and so are re-encodes
+// and re-encryptions.
+// Chunks and packed files those referenced are left to compaction.
+func (r *RSFileManager) RecoverOperations() (int, error) {
+	if r.Journal == nil {
+		return 0, nil
+	}
+	entries, err := r.Journal.pending()
+	if err != nil {
+		return 0, err
+	}
+	for _, entry := range entries {
+		switch entry.Op {
+		case opStore:
+			r.recoverStore(entry)
+		case opRename:
+			err = r.recoverRename(entry)
+		case opDelete:
+			r.recoverDelete(entry)
+		case opReencode:
+			log.Warnf("Finishing the re-encode of '%s', it was cut short", entry.Name)
+			err = r.finishReencode(entry.Name, r.Config.StatePath(path.Join(reencodeDirName, entry.To)))
+		case opReencrypt:
+			log.Warnf("Finishing the re-encryption of '%s', it was cut short", entry.Name)
+			err = r.finishReencrypt(entry.Name, r.Config.StatePath(path.Join(rotationDirName, entry.To)))
+		default:
+			log.Warnf("Unknown operation '%s' in journal entry '%s'", entry.Op, entry.path)
+		}
+		if err != nil {
+			return 0, err
+		}
+		r.Journal.end(entry)
+	}
+	// Re-encodes and re-encryptions that didn't get to their journal entry
+	// left only these.
+	for _, dir := range []string{reencodeDirName, rotationDirName} {
+		if err := os.RemoveAll(r.Config.StatePath(dir)); err != nil {
+			return 0, err
+		}
+	}
+	return len(entries), nil
+}
+
+func (r *RSFileManager) recoverStore(entry *journalEntry) {
+	fpath := r.DataPath(entry.Name)
+	stat, err := r.storage().Stat(fpath)
+	// Some filesystems keep times to the second.
+	if err != nil || stat.ModTime().Before(entry.StartedAt.Truncate(time.Second)) {
+		return
+	}
+	if md, err := r.readStoredMetadata(fpath); err == nil && md.Metadata != nil {
+		return
+	}
+	log.Warnf("Removing '%s', its submit was cut short before its metadata was written", entry.Name)
+	removeStoredObject(r.storage(), fpath, false)
+}
+
+func (r *RSFileManager) recoverRename(entry *journalEntry) error {
+	srcPath, dstPath := r.DataPath(entry.Name), r.DataPath(entry.To)
+	if _, err := r.storage().Stat(srcPath); err != nil {
+		// The data file moves last, the rename was complete.
+		return nil
+	}
+	for _, suffix := range objectSuffixes(r.storage(), dstPath) {
+		if suffix == "" {
+			continue
+		}
+		if _, err := r.storage().Stat(dstPath + suffix); err != nil {
+			continue
+		}
+		log.Warnf("Moving '%s' back to '%s', the rename was cut short", dstPath+suffix, srcPath+suffix)
+		if err := r.storage().Rename(dstPath+suffix, srcPath+suffix); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *RSFileManager) recoverDelete(entry *journalEntry) {
+	fpath := r.DataPath(entry.Name)
+	if _, err := r.storage().Stat(fpath); !os.IsNotExist(err) {
+		// The data file goes first, the delete didn't begin.
+		return
+	}
+	log.Warnf("Removing what is left of '%s', its delete was cut short", entry.Name)
+	removeStoredObject(r.storage(), fpath, false)
+}
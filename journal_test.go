@@ -0,0 +1,97 @@
+package rsbackup
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestRecoverOperations(t *testing.T) {
+	config := &Config{BackupRoot: createTMPDir(t, "rsbackup"), DataShards: 2, ParityShards: 1}
+	journal, err := OpenOperationJournal(path.Join(createTMPDir(t, "rsbackup-state"), "journal"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fm := &RSFileManager{Config: config, Journal: journal}
+	api := &RSBackupAPI{Config: config, RsFileMan: fm}
+	store := func(fname string, withMetadata bool) {
+		t.Helper()
+		fpath := fm.DataPath(fname)
+		if err := ioutil.WriteFile(fpath, []byte("little "+fname), 0644); err != nil {
+			t.Fatal(err)
+		}
+		md, err := api.generateParity(fm.storage(), fpath, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if withMetadata {
+			if err := fm.WriteMetadata(fname, md, MetadataExtras{}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	exists := func(fpath string) bool {
+		_, err := os.Stat(fpath)
+		return err == nil
+	}
+
+	// Operations that complete leave nothing behind.
+	store("tyger", true)
+	if err := fm.Rename("tyger", "lamb"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fm.Delete("lamb", false, false); err != nil {
+		t.Fatal(err)
+	}
+	if entries, _ := journal.pending(); len(entries) != 0 {
+		t.Fatalf("Got %d journal entries after complete operations", len(entries))
+	}
+
+	// A submit cut short before the metadata is undone, one cut short
+	// after it kept, and so is a file stored before the submit began.
+	journal.begin(opStore, "fly", "")
+	store("fly", false)
+	journal.begin(opStore, "lamb", "")
+	store("lamb", true)
+	store("tyger", false)
+	old := time.Now().Add(-time.Hour)
+	os.Chtimes(fm.DataPath("tyger"), old, old)
+	journal.begin(opStore, "tyger", "")
+
+	// A rename cut short before the data file moved is undone.
+	store("bird", true)
+	journal.begin(opRename, "bird", "worm")
+	for _, suffix := range []string{".md", metadataMirrorSuffix, ".parity.1"} {
+		if err := os.Rename(fm.DataPath("bird")+suffix, fm.DataPath("worm")+suffix); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A delete cut short after the data file went is finished.
+	store("rose", true)
+	journal.begin(opDelete, "rose", "")
+	os.Remove(fm.DataPath("rose"))
+
+	recovered, err := fm.RecoverOperations()
+	if err != nil || recovered != 5 {
+		t.Fatalf("Recovered %d operations (error: %v)", recovered, err)
+	}
+	if entries, _ := journal.pending(); len(entries) != 0 {
+		t.Errorf("Got %d journal entries after recovery", len(entries))
+	}
+	for _, fpath := range []string{fm.DataPath("fly"), fm.DataPath("fly") + ".parity.1", fm.DataPath("worm") + ".md", fm.DataPath("rose") + ".md", fm.DataPath("rose") + ".parity.1"} {
+		if exists(fpath) {
+			t.Errorf("Expected '%s' removed", fpath)
+		}
+	}
+	if !exists(fm.DataPath("tyger")) {
+		t.Errorf("Expected the file stored before the submit kept")
+	}
+	for _, fname := range []string{"lamb", "bird"} {
+		if health, _, _, err := fm.CheckData(fname); err != nil || !health {
+			t.Errorf("Got health %t (error: %v) of %s", health, err, fname)
+		}
+	}
+}
@@ -0,0 +1,278 @@
+package rsbackup
+
+import (
+	"crypto/cipher"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// rotationDirName is the state directory re-encrypted files are built in
+// before they replace the originals.
+const rotationDirName = "rotation"
+
+// replaceMetadata swaps the metadata file of the file at fpath, and its
+// mirror, for md.
+func (r *RSFileManager) replaceMetadata(fpath string, md *storedMetadata) error {
+	err := r.storeMetadata(fpath+".md", md)
+	if err == nil {
+		err = r.storeMetadata(fpath+metadataMirrorSuffix, md)
+	}
+	if err == nil && fpath == r.DataPath(path.Base(fpath)) {
+		r.reindex(path.Base(fpath))
+	}
+	return err
+}
+
+// RewrapFile wraps the data key of fname with the active key, leaving the
+// data file untouched. It reports whether the key needed rewrapping.
+func (r *RSFileManager) RewrapFile(fname string) (bool, error) {
+	fpath := r.DataPath(fname)
+	md, err := r.readStoredMetadata(fpath)
+	if err != nil {
+		return false, err
+	}
+	if md.Encryption == nil || md.Encryption.KeyID == r.Keys.Active() {
+		return false, nil
+	}
+	md.Encryption, err = r.Keys.rewrap(md.Encryption)
+	if err != nil {
+		return false, err
+	}
+	return true, r.replaceMetadata(fpath, md)
+}
+
+// reencryptFile encrypts fname again under a fresh data key wrapped by the
+// active key and recomputes its parity, with the shard counts it has. The
+// new data, parity and metadata are built in the state directory and then
+// moved over the old ones under a journal entry, so a crash half way is
+// finished by RecoverOperations. It returns the number of bytes stored, 0
+// if fname isn't encrypted.
+func (rs *RSBackupAPI) reencryptFile(fname string) (int64, error) {
+	fm := rs.RsFileMan
+	fpath := fm.DataPath(fname)
+	md, err := fm.readStoredMetadata(fpath)
+	if err != nil {
+		return 0, err
+	}
+	if md.Encryption == nil {
+		return 0, nil
+	}
+	src, closer, _, err := fm.openPlaintext(fname)
+	if err != nil {
+		return 0, err
+	}
+	defer closer.Close()
+
+	token, err := generateToken()
+	if err != nil {
+		return 0, err
+	}
+	dir := rs.Config.StatePath(path.Join(rotationDirName, token[:16]))
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		return 0, err
+	}
+	defer os.RemoveAll(dir)
+	tmpPath := path.Join(dir, "data")
+	// Created like stored files, as they may simply be renamed into place.
+	local := fm.local()
+	dst, err := local.CreateExclusive(tmpPath)
+	if err != nil {
+		return 0, err
+	}
+	dataKey, enc, err := fm.Keys.newDataKey()
+	if err == nil {
+		var aead cipher.AEAD
+		aead, err = newGCM(dataKey)
+		if err == nil {
+			enc.Size, err = encryptTo(dst, src, aead)
+		}
+	}
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return 0, err
+	}
+	if md.Packed == nil && !md.ParityPending && md.Metadata != nil {
+		var segments *SegmentInfo
+		md.Metadata, segments, err = writeParity(local, tmpPath, md.DataShards, md.ParityShards, rs.Config)
+		md.Codec, md.Hash, md.Segments = rs.Config.codecName(), rs.Config.shardHashName(), segments
+	} else {
+		// Packed files come out with parity of their own.
+		md.Metadata, err = rs.generateParity(local, tmpPath, &md.MetadataExtras)
+	}
+	if err != nil {
+		return 0, err
+	}
+	md.Encryption = enc
+	md.Packed = nil
+	md.ParityPending = false
+	// Cold files come out hot.
+	md.Tier = ""
+	err = sealMetadata(md)
+	if err != nil {
+		return 0, err
+	}
+	for _, suffix := range []string{".md", metadataMirrorSuffix} {
+		mdFile, err := local.CreateExclusive(tmpPath + suffix)
+		if err != nil {
+			return 0, err
+		}
+		err = json.NewEncoder(mdFile).Encode(md)
+		if closeErr := mdFile.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	renameMu.Lock()
+	defer renameMu.Unlock()
+	if _, err := fm.storage().Stat(fpath); err != nil {
+		// Renamed away since it was read.
+		return 0, err
+	}
+	packed := fm.packedInfo(fpath)
+	entry, err := fm.Journal.begin(opReencrypt, fname, token[:16])
+	if err != nil {
+		return 0, err
+	}
+	err = fm.finishReencrypt(fname, dir)
+	if err != nil {
+		// The entry stays, so the next start finishes the replacement.
+		return 0, fmt.Errorf("Cannot replace '%s': %w", fname, err)
+	}
+	fm.Journal.end(entry)
+	fm.releasePacked(packed, false)
+	return storedSize(fm.storage(), fpath), nil
+}
+
+// finishReencrypt moves the parity files of the re-encrypted file waiting
+// in dir into place, then its data file and its metadata last, and removes
+// the parity files the file has no more. It picks up where it left off
+// when it was cut short.
+func (r *RSFileManager) finishReencrypt(fname, dir string) error {
+	fpath := r.DataPath(fname)
+	tmpPath := path.Join(dir, "data")
+	if _, err := os.Stat(tmpPath + ".md"); err == nil {
+		var md storedMetadata
+		err := readJSONState(tmpPath+".md", &md)
+		if err != nil {
+			return err
+		}
+		var suffixes []string
+		for i := 1; i <= md.ParityShards; i++ {
+			suffixes = append(suffixes, fmt.Sprintf(".parity.%d", i))
+		}
+		for _, suffix := range append(suffixes, "", metadataMirrorSuffix, ".md") {
+			if _, err := os.Stat(tmpPath + suffix); os.IsNotExist(err) {
+				// Moved before the cut.
+				continue
+			}
+			if err := storeLocal(r.storage(), tmpPath+suffix, fpath+suffix); err != nil {
+				return err
+			}
+		}
+		r.reindex(fname)
+	}
+	md, err := r.readStoredMetadata(fpath)
+	if os.IsNotExist(err) {
+		// Deleted since.
+		return os.RemoveAll(dir)
+	}
+	if err != nil {
+		return err
+	}
+	for i := md.ParityShards + 1; ; i++ {
+		err := r.storage().Remove(fmt.Sprintf("%s.parity.%d", fpath, i))
+		if os.IsNotExist(err) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return os.RemoveAll(dir)
+}
+
+// rotateKeys brings every encrypted file under the active key, rewrapping
+// data keys or, with reencrypt, encrypting the data again. Re-encryption
+// is paced to the scrub read rate.
+func (rs *RSBackupAPI) rotateKeys(job *jobProgress, stop <-chan struct{}, reencrypt bool) error {
+	names, err := rs.RsFileMan.ListData()
+	if err != nil {
+		return err
+	}
+	job.setTotal(len(names))
+	work := rs.background()
+	for _, name := range names {
+		select {
+		case <-stop:
+			return nil
+		default:
+		}
+		var changed bool
+		if reencrypt {
+			var n int64
+			n, err = rs.reencryptFile(name)
+			changed = n > 0
+			work.throttle.pay(n, stop)
+		} else {
+			changed, err = rs.RsFileMan.RewrapFile(name)
+		}
+		if os.IsNotExist(err) {
+			// Removed since the listing.
+			err = nil
+		}
+		if err != nil {
+			log.Warnf("Key rotation couldn't process %s, continuing: %s", name, err)
+		}
+		if changed {
+			rs.mirror(name)
+		}
+		job.done(name, err)
+	}
+	return nil
+}
+
+// rotateKeyHandler makes the key named by the key_id form field the active
+// key and starts a job bringing existing files under it. With
+// reencrypt=true files get new data keys and are encrypted again,
+// otherwise only their data keys are wrapped again.
+func (rs *RSBackupAPI) rotateKeyHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		rs.Errorf(r, "Bad method %s", r.Method)
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	keys := rs.RsFileMan.Keys
+	keyID := r.FormValue("key_id")
+	auditObject(r, keyID)
+	if keyID == "" || keys.key(keyID) == nil {
+		rs.Errorf(r, "Cannot rotate to unknown key '%s'", keyID)
+		http.Error(w, fmt.Sprintf("%s '%s'", errUnknownKey, keyID), http.StatusBadRequest)
+		return
+	}
+	reencrypt := r.FormValue("reencrypt") == "true"
+	job, err := rs.background().jobs.start("rotate_key", func(job *jobProgress, stop <-chan struct{}) error {
+		err := keys.Activate(keyID)
+		if err != nil {
+			return err
+		}
+		log.Infof("Encrypting new files with key '%s', rotating existing files (reencrypt: %t)", keyID, reencrypt)
+		return rs.rotateKeys(job, stop, reencrypt)
+	})
+	if err == errJobRunning {
+		rs.Errorf(r, "Key rotation already running")
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	rs.writeJobStarted(w, r, job)
+}
@@ -0,0 +1,155 @@
+package rsbackup
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+// waitForJob polls the job id until it finishes.
+func waitForJob(t *testing.T, api *RSBackupAPI, id string) Job {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		job, err := api.background().jobs.get(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if job.State != jobRunning {
+			return job
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("Job %s still running", id)
+	return Job{}
+}
+
+func TestKeyRotation(t *testing.T) {
+	tmpDir := createTMPDir(t, "rsbackup")
+	keyDir := createTMPDir(t, "rsbackup-keys")
+	keyRefs := make(map[string]string)
+	for id, hexKey := range map[string]string{"2026": strings.Repeat("ab", 32), "2027": strings.Repeat("cd", 32)} {
+		keyRefs[id] = path.Join(keyDir, id+".key")
+		ioutil.WriteFile(keyRefs[id], []byte(hexKey), 0600)
+	}
+	config := &Config{
+		BackupRoot:      tmpDir,
+		DataShards:      2,
+		ParityShards:    1,
+		EncryptionKeys:  keyRefs,
+		EncryptionKeyID: "2026",
+	}
+	keys, err := NewKeyRing(config, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	api := &RSBackupAPI{Config: config, RsFileMan: &RSFileManager{Config: config, Keys: keys}}
+	contents := map[string][]byte{}
+	for _, fname := range []string{"first", "second"} {
+		contents[fname] = make([]byte, encSegmentSize+100)
+		rand.Read(contents[fname])
+		body := new(bytes.Buffer)
+		mw := multipart.NewWriter(body)
+		fw, _ := mw.CreateFormFile("file", fname)
+		fw.Write(contents[fname])
+		mw.WriteField("filename", fname)
+		mw.Close()
+		req := httptest.NewRequest("POST", "/submit_data", body)
+		req.Header.Set("Content-Type", mw.FormDataContentType())
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(api.submitDataHandler).ServeHTTP(rr, req)
+		if rr.Code != 200 {
+			t.Fatalf("Got status code %d submitting %s", rr.Code, fname)
+		}
+	}
+
+	rotate := func(form url.Values) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/rotate_key", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(api.rotateKeyHandler).ServeHTTP(rr, req)
+		return rr
+	}
+	// check rotates with form and verifies every file decrypts and is
+	// wrapped by keyID afterwards.
+	check := func(form url.Values, keyID string) {
+		rr := rotate(form)
+		if rr.Code != http.StatusAccepted {
+			t.Fatalf("Got status code %d, expected 202: %s", rr.Code, rr.Body)
+		}
+		var started Job
+		json.NewDecoder(rr.Body).Decode(&started)
+		job := waitForJob(t, api, started.ID)
+		if job.State != jobDone || job.Total != 2 || job.Done != 2 || len(job.Failed) != 0 {
+			t.Errorf("Got job %+v", job)
+		}
+		for fname, data := range contents {
+			info, err := api.RsFileMan.ReadEncryption(api.RsFileMan.DataPath(fname))
+			if err != nil || info.KeyID != keyID {
+				t.Errorf("%s: got encryption info %+v, %v", fname, info, err)
+			}
+			req := httptest.NewRequest("GET", "/retrieve_data/"+fname, nil)
+			rr := httptest.NewRecorder()
+			http.HandlerFunc(api.retrieveDataHandler).ServeHTTP(rr, req)
+			if !bytes.Equal(rr.Body.Bytes(), data) {
+				t.Errorf("%s doesn't decrypt to the submitted data after rotation", fname)
+			}
+			healthy, _, _, err := api.RsFileMan.CheckData(fname)
+			if err != nil || !healthy {
+				t.Errorf("%s unhealthy after rotation: %v", fname, err)
+			}
+		}
+	}
+
+	before, _ := ioutil.ReadFile(api.RsFileMan.DataPath("first"))
+	check(url.Values{"key_id": {"2027"}}, "2027")
+	if keys.Active() != "2027" {
+		t.Errorf("Active key is '%s' after rotation", keys.Active())
+	}
+	after, _ := ioutil.ReadFile(api.RsFileMan.DataPath("first"))
+	if !bytes.Equal(before, after) {
+		t.Errorf("Rewrapping changed the data file")
+	}
+
+	// Files keep their own shard counts, more parity shards than the config
+	// gives or fewer.
+	if _, _, err := api.ReencodeFile("first", reencodeTarget{DataShards: 4, ParityShards: 3}); err != nil {
+		t.Fatal(err)
+	}
+	config.ParityShards = 2
+	check(url.Values{"key_id": {"2026"}, "reencrypt": {"true"}}, "2026")
+	for fname, parityShards := range map[string]int{"first": 3, "second": 1} {
+		fpath := api.RsFileMan.DataPath(fname)
+		md, err := api.RsFileMan.readStoredMetadata(fpath)
+		if err != nil || md.ParityShards != parityShards {
+			t.Errorf("%s: got metadata %+v (error: %v), expected %d parity shards", fname, md, err, parityShards)
+		}
+		if _, err := os.Stat(fmt.Sprintf("%s.parity.%d", fpath, parityShards)); err != nil {
+			t.Errorf("%s: %s", fname, err)
+		}
+		if _, err := os.Stat(fmt.Sprintf("%s.parity.%d", fpath, parityShards+1)); !os.IsNotExist(err) {
+			t.Errorf("%s: parity file %d left over (error: %v)", fname, parityShards+1, err)
+		}
+	}
+	after, _ = ioutil.ReadFile(api.RsFileMan.DataPath("first"))
+	if bytes.Equal(before, after) {
+		t.Errorf("Re-encryption kept the data file")
+	}
+	if names, _ := api.RsFileMan.ListData(); len(names) != 2 {
+		t.Errorf("Got files %v after re-encryption", names)
+	}
+
+	if rr := rotate(url.Values{"key_id": {"2028"}}); rr.Code != http.StatusBadRequest {
+		t.Errorf("Got status code %d rotating to an unknown key", rr.Code)
+	}
+}
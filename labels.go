@@ -0,0 +1,68 @@
+package rsbackup
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// maxLabels bounds the labels of a single file.
+const maxLabels = 32
+
+// labelPattern is what keys and values of labels look like.
+var labelPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._/-]{0,62}$`)
+
+// parseLabels parses key=value pairs separated by commas, like
+// host=web01,type=db. Both submits and selectors are written this way.
+func parseLabels(s string) (map[string]string, error) {
+	labels := make(map[string]string)
+	for _, pair := range strings.Split(s, ",") {
+		kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+		if len(kv) != 2 || !labelPattern.MatchString(kv[0]) || !labelPattern.MatchString(kv[1]) {
+			return nil, fmt.Errorf("Bad label '%s', expected key=value", pair)
+		}
+		if _, ok := labels[kv[0]]; ok {
+			return nil, fmt.Errorf("Label %s is given twice", kv[0])
+		}
+		labels[kv[0]] = kv[1]
+	}
+	if len(labels) > maxLabels {
+		return nil, fmt.Errorf("%d labels given, at most %d are allowed", len(labels), maxLabels)
+	}
+	return labels, nil
+}
+
+// labelsParam reads the labels field of a submit, or returns nil if it's
+// missing.
+func labelsParam(r *http.Request) (map[string]string, error) {
+	value := r.FormValue("labels")
+	if value == "" {
+		return nil, nil
+	}
+	return parseLabels(value)
+}
+
+// matchLabels reports whether labels has every label of selector.
+func matchLabels(labels, selector map[string]string) bool {
+	for key, value := range selector {
+		if labels[key] != value {
+			return false
+		}
+	}
+	return true
+}
+
+// labelsOf returns the labels fname was submitted with, from the metadata
+// index if there is one.
+func (rs *RSBackupAPI) labelsOf(fname string) map[string]string {
+	if rs.RsFileMan.Index != nil {
+		entry, _ := rs.RsFileMan.Index.Get(fname)
+		return entry.Labels
+	}
+	extras, err := rs.RsFileMan.ReadExtras(rs.RsFileMan.DataPath(fname))
+	if err != nil {
+		return nil
+	}
+	return extras.Labels
+}
@@ -0,0 +1,110 @@
+package rsbackup
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"reflect"
+	"testing"
+)
+
+func TestParseLabels(t *testing.T) {
+	var tests = []struct {
+		name     string
+		value    string
+		expected map[string]string
+	}{
+		{"one", "host=web01", map[string]string{"host": "web01"}},
+		{"several", "host=web01, type=db,env=prod", map[string]string{"host": "web01", "type": "db", "env": "prod"}},
+		{"paths", "dir=var/lib/mysql", map[string]string{"dir": "var/lib/mysql"}},
+		{"no value", "host", nil},
+		{"empty value", "host=", nil},
+		{"twice", "host=web01,host=web02", nil},
+		{"bad key", "-host=web01", nil},
+		{"bad value", "host=web 01", nil},
+		{"trailing comma", "host=web01,", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			labels, err := parseLabels(tt.value)
+			if (err == nil) != (tt.expected != nil) || !reflect.DeepEqual(labels, tt.expected) {
+				t.Errorf("Got %v and error %v, expected %v", labels, err, tt.expected)
+			}
+		})
+	}
+}
+
+func TestLabelSelectors(t *testing.T) {
+	for _, indexed := range []bool{false, true} {
+		tmpDir := createTMPDir(t, "rsbackup")
+		config := &Config{BackupRoot: tmpDir, DataShards: 2, ParityShards: 1}
+		fm := &RSFileManager{Config: config}
+		if indexed {
+			index, err := OpenMetadataIndex(path.Join(createTMPDir(t, "rsbackup-state"), "index.db"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer index.Close()
+			fm.Index = index
+		}
+		api := &RSBackupAPI{Config: config, RsFileMan: fm}
+		submit := func(fname, labels string) *httptest.ResponseRecorder {
+			body := new(bytes.Buffer)
+			mw := multipart.NewWriter(body)
+			fw, _ := mw.CreateFormFile("file", fname)
+			fw.Write([]byte("bright bright"))
+			mw.WriteField("filename", fname)
+			mw.WriteField("labels", labels)
+			mw.Close()
+			req := httptest.NewRequest("POST", "/submit_data", body)
+			req.Header.Set("Content-Type", mw.FormDataContentType())
+			rr := httptest.NewRecorder()
+			http.HandlerFunc(api.submitDataHandler).ServeHTTP(rr, req)
+			return rr
+		}
+		list := func(query string) (int, listDataRsp) {
+			req := httptest.NewRequest("GET", "/list_data?"+query, nil)
+			rr := httptest.NewRecorder()
+			http.HandlerFunc(api.listDataHandler).ServeHTTP(rr, req)
+			var rsp listDataRsp
+			json.NewDecoder(rr.Body).Decode(&rsp)
+			return rr.Code, rsp
+		}
+
+		for fname, labels := range map[string]string{
+			"web01-db":    "host=web01,type=db",
+			"web01-files": "host=web01,type=files",
+			"web02-db":    "host=web02,type=db",
+			"unlabelled":  "",
+		} {
+			if rr := submit(fname, labels); rr.Code != http.StatusOK {
+				t.Fatalf("Got status code %d submitting %s", rr.Code, fname)
+			}
+		}
+		if rr := submit("bad", "host"); rr.Code != http.StatusBadRequest {
+			t.Errorf("Got status code %d submitting bad labels", rr.Code)
+		}
+
+		for selector, expected := range map[string][]string{
+			"host=web01":         {"web01-db", "web01-files"},
+			"type=db":            {"web01-db", "web02-db"},
+			"host=web01,type=db": {"web01-db"},
+			"host=web03":         {},
+		} {
+			code, rsp := list("labels=" + selector)
+			if code != http.StatusOK || !reflect.DeepEqual(rsp.Files, expected) {
+				t.Errorf("Got status code %d and %v selecting %s, indexed %t", code, rsp.Files, selector, indexed)
+			}
+		}
+		if code, _ := list("labels=host"); code != http.StatusBadRequest {
+			t.Errorf("Got status code %d for a bad selector", code)
+		}
+		_, rsp := list("labels=type=files&extended=true")
+		if len(rsp.Objects) != 1 || !reflect.DeepEqual(rsp.Objects[0].Labels, map[string]string{"host": "web01", "type": "files"}) {
+			t.Errorf("Got objects %+v, indexed %t", rsp.Objects, indexed)
+		}
+	}
+}
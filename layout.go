@@ -0,0 +1,128 @@
+package rsbackup
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Layout maps file names to where their data file lives, relative to
+// BackupRoot. Parity and metadata files always sit next to the data file.
+type Layout interface {
+	// Path returns the location of the data file for fname.
+	Path(fname string) string
+	// Depth is the number of directory levels between BackupRoot and the
+	// data files.
+	Depth() int
+	String() string
+}
+
+// FlatLayout stores every file directly in BackupRoot.
+type FlatLayout struct{}
+
+func (FlatLayout) Path(fname string) string {
+	return fname
+}
+
+func (FlatLayout) Depth() int {
+	return 0
+}
+
+func (FlatLayout) String() string {
+	return "flat"
+}
+
+// HashPrefixLayout fans files out into Levels levels of directories, each
+// named after the next two hex characters of the sha256 of the file name,
+// eg. "tyger" is stored at "85/e7/tyger" with two levels.
+type HashPrefixLayout struct {
+	Levels int
+}
+
+func (l HashPrefixLayout) Path(fname string) string {
+	sum := sha256.Sum256([]byte(fname))
+	digest := hex.EncodeToString(sum[:])
+	parts := make([]string, 0, l.Levels+1)
+	for i := 0; i < l.Levels; i++ {
+		parts = append(parts, digest[i*2:i*2+2])
+	}
+	return path.Join(append(parts, fname)...)
+}
+
+func (l HashPrefixLayout) Depth() int {
+	return l.Levels
+}
+
+func (l HashPrefixLayout) String() string {
+	return fmt.Sprintf("hash%d", l.Levels)
+}
+
+// ParseLayout returns the layout called name, as returned by its String
+// method, ie. "flat", "hash1", "hash2" etc.
+func ParseLayout(name string) (Layout, error) {
+	if name == "flat" {
+		return FlatLayout{}, nil
+	}
+	var levels int
+	_, err := fmt.Sscanf(name, "hash%d", &levels)
+	if err != nil || levels < 1 || levels > 16 || name != fmt.Sprintf("hash%d", levels) {
+		return nil, fmt.Errorf("Unknown layout '%s'", name)
+	}
+	return HashPrefixLayout{Levels: levels}, nil
+}
+
+// MigrateLayout moves every file stored according to the from layout to
+// where the file manager's own layout expects it, together with its parity
+// and metadata files. It returns the number of files moved.
+func (r *RSFileManager) MigrateLayout(from Layout) (int, error) {
+	src := &RSFileManager{Config: r.Config, Layout: from, Storage: r.Storage}
+	names, err := src.ListData()
+	if err != nil {
+		return 0, err
+	}
+	moved := 0
+	for _, name := range names {
+		srcPath := src.DataPath(name)
+		dstPath := r.DataPath(name)
+		if srcPath == dstPath {
+			continue
+		}
+		_, err := r.storage().Stat(dstPath)
+		if err == nil {
+			return moved, fmt.Errorf("Cannot migrate '%s', '%s' already exists", name, dstPath)
+		}
+		// The data file goes last, so an interrupted migration never lists
+		// a file whose parity is left behind.
+		for _, suffix := range objectSuffixes(r.storage(), srcPath) {
+			err = r.storage().Rename(srcPath+suffix, dstPath+suffix)
+			if err != nil && !(suffix == ".md" && os.IsNotExist(err)) {
+				return moved, fmt.Errorf("Cannot migrate '%s': %s", name, err)
+			}
+		}
+		log.Debugf("Migrated %s to %s", srcPath, dstPath)
+		moved++
+	}
+	return moved, nil
+}
+
+// objectSuffixes returns the suffixes of the files stored for the data file
+// at fpath: the metadata and its mirror, the parity shards found in
+// storage and "" for the data file itself, which always comes last.
+func objectSuffixes(storage StorageBackend, fpath string) []string {
+	suffixes := []string{".md"}
+	if _, err := storage.Stat(fpath + metadataMirrorSuffix); err == nil {
+		suffixes = append(suffixes, metadataMirrorSuffix)
+	}
+	for i := 1; ; i++ {
+		suffix := fmt.Sprintf(".parity.%d", i)
+		if _, err := storage.Stat(fpath + suffix); err != nil {
+			break
+		}
+		suffixes = append(suffixes, suffix)
+	}
+	return append(suffixes, "")
+}
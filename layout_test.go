@@ -0,0 +1,77 @@
+package rsbackup
+
+import (
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestParseLayout(t *testing.T) {
+	layoutTests := []struct {
+		name         string
+		expectedPath string
+		expectedErr  bool
+	}{
+		{"flat", "tyger", false},
+		{"hash1", "85/tyger", false},
+		{"hash2", "85/e7/tyger", false},
+		{"hash0", "", true},
+		{"hash2x", "", true},
+		{"nested", "", true},
+	}
+
+	for _, tt := range layoutTests {
+		t.Run(tt.name, func(t *testing.T) {
+			layout, err := ParseLayout(tt.name)
+			if (err != nil) != tt.expectedErr {
+				t.Fatalf("Got error '%v', expected error: %t", err, tt.expectedErr)
+			}
+			if err != nil {
+				return
+			}
+			if p := layout.Path("tyger"); p != tt.expectedPath {
+				t.Errorf("Got path '%s', expected '%s'", p, tt.expectedPath)
+			}
+			if layout.String() != tt.name {
+				t.Errorf("Got name '%s', expected '%s'", layout.String(), tt.name)
+			}
+		})
+	}
+}
+
+func TestMigrateLayout(t *testing.T) {
+	tmpDir := createTMPDir(t, "rsbackup")
+	config := &Config{
+		BackupRoot:   tmpDir,
+		DataShards:   2,
+		ParityShards: 1,
+	}
+	cloneShards(t, "tyger", tmpDir, config)
+	cloneShards(t, "tyger_bad", tmpDir, config)
+
+	rsMan := &RSFileManager{Config: config, Layout: HashPrefixLayout{Levels: 2}}
+	moved, err := rsMan.MigrateLayout(FlatLayout{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if moved != 2 {
+		t.Errorf("Migrated %d files, expected 2", moved)
+	}
+
+	names, err := rsMan.ListData()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"tyger", "tyger_bad"}; !reflect.DeepEqual(names, expected) {
+		t.Errorf("Got files %v after migration, expected %v", names, expected)
+	}
+	for _, suffix := range []string{"", ".md", ".parity.1"} {
+		if _, err := os.Stat(rsMan.DataPath("tyger") + suffix); err != nil {
+			t.Errorf("Missing migrated file: %s", err)
+		}
+	}
+	health, _, _, err := rsMan.CheckData("tyger")
+	if err != nil || !health {
+		t.Errorf("Migrated file is not healthy (health: %t, err: %v)", health, err)
+	}
+}
@@ -0,0 +1,185 @@
+package rsbackup
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+	log "github.com/sirupsen/logrus"
+)
+
+// ldapCacheTTL is how long a successful LDAP login is remembered, so that
+// not every request costs a round trip to the directory.
+const ldapCacheTTL = time.Minute
+
+// ldapConn is the part of *ldap.Conn used for authentication.
+type ldapConn interface {
+	Bind(username, password string) error
+	Search(req *ldap.SearchRequest) (*ldap.SearchResult, error)
+	Close() error
+}
+
+type ldapCacheEntry struct {
+	token   APIToken
+	expires time.Time
+}
+
+// LDAPAuthenticator checks basic auth credentials by binding to an LDAP or
+// Active Directory server as the user, and maps the user's groups to
+// scopes.
+type LDAPAuthenticator struct {
+	baseDN       string
+	userFilter   string
+	bindDN       string
+	bindPassword string
+	adminGroups  []string
+	userGroups   []string
+	groupScopes  map[string][]string
+	dial         func() (ldapConn, error)
+
+	mu    sync.Mutex
+	cache map[[32]byte]ldapCacheEntry
+}
+
+func NewLDAPAuthenticator(config *Config) *LDAPAuthenticator {
+	userFilter := config.LDAPUserFilter
+	if userFilter == "" {
+		userFilter = "(uid=%s)"
+	}
+	return &LDAPAuthenticator{
+		baseDN:       config.LDAPBaseDN,
+		userFilter:   userFilter,
+		bindDN:       config.LDAPBindDN,
+		bindPassword: config.LDAPBindPassword,
+		adminGroups:  config.LDAPAdminGroups,
+		userGroups:   config.LDAPUserGroups,
+		groupScopes:  config.LDAPGroupScopes,
+		dial: func() (ldapConn, error) {
+			conn, err := ldap.DialURL(config.LDAPURL)
+			if err != nil {
+				return nil, err
+			}
+			if config.LDAPStartTLS {
+				u, err := url.Parse(config.LDAPURL)
+				if err != nil {
+					conn.Close()
+					return nil, err
+				}
+				err = conn.StartTLS(&tls.Config{ServerName: u.Hostname()})
+				if err != nil {
+					conn.Close()
+					return nil, err
+				}
+			}
+			return conn, nil
+		},
+		cache: make(map[[32]byte]ldapCacheEntry),
+	}
+}
+
+// Authenticate looks up user with the configured filter, binds as the
+// user with password and returns a token with the roles granted by the
+// user's memberOf groups.
+func (a *LDAPAuthenticator) Authenticate(user, password string) (APIToken, bool) {
+	// An empty password would be an unauthenticated bind, which servers
+	// accept for any DN.
+	if user == "" || password == "" {
+		return APIToken{}, false
+	}
+	key := sha256.Sum256([]byte(user + "\x00" + password))
+	a.mu.Lock()
+	entry, ok := a.cache[key]
+	a.mu.Unlock()
+	if ok && time.Now().Before(entry.expires) {
+		return entry.token, true
+	}
+
+	token, err := a.login(user, password)
+	if err != nil {
+		log.Warnf("LDAP login of '%s' failed: %s", user, err)
+		return APIToken{}, false
+	}
+	a.mu.Lock()
+	now := time.Now()
+	for k, e := range a.cache {
+		if now.After(e.expires) {
+			delete(a.cache, k)
+		}
+	}
+	a.cache[key] = ldapCacheEntry{token: token, expires: now.Add(ldapCacheTTL)}
+	a.mu.Unlock()
+	return token, true
+}
+
+func (a *LDAPAuthenticator) login(user, password string) (APIToken, error) {
+	conn, err := a.dial()
+	if err != nil {
+		return APIToken{}, err
+	}
+	defer conn.Close()
+	if a.bindDN != "" {
+		err = conn.Bind(a.bindDN, a.bindPassword)
+		if err != nil {
+			return APIToken{}, fmt.Errorf("Service account bind failed: %s", err)
+		}
+	}
+	result, err := conn.Search(ldap.NewSearchRequest(
+		a.baseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, 0, false,
+		fmt.Sprintf(a.userFilter, ldap.EscapeFilter(user)),
+		[]string{"dn", "memberOf"}, nil,
+	))
+	if err != nil {
+		return APIToken{}, err
+	}
+	if len(result.Entries) != 1 {
+		return APIToken{}, fmt.Errorf("Found %d matching entries", len(result.Entries))
+	}
+	userEntry := result.Entries[0]
+	err = conn.Bind(userEntry.DN, password)
+	if err != nil {
+		return APIToken{}, err
+	}
+
+	groups := userEntry.GetAttributeValues("memberOf")
+	token := APIToken{Name: "ldap:" + user}
+	if inLDAPGroups(groups, a.adminGroups) {
+		token.grant(ScopeAdmin)
+	}
+	if inLDAPGroups(groups, a.userGroups) {
+		token.grant(dataScopes...)
+	}
+	for group, scopes := range a.groupScopes {
+		if inLDAPGroups(groups, []string{group}) {
+			token.grant(scopes...)
+		}
+	}
+	if len(token.Scopes) == 0 {
+		return APIToken{}, fmt.Errorf("Not a member of any group granting access")
+	}
+	return token, nil
+}
+
+// inLDAPGroups reports whether any of the group DNs is in wanted, which
+// may hold full DNs or just common names.
+func inLDAPGroups(groups, wanted []string) bool {
+	for _, group := range groups {
+		dn, err := ldap.ParseDN(group)
+		for _, w := range wanted {
+			if strings.EqualFold(group, w) {
+				return true
+			}
+			if err == nil && len(dn.RDNs) > 0 && len(dn.RDNs[0].Attributes) == 1 {
+				attr := dn.RDNs[0].Attributes[0]
+				if strings.EqualFold(attr.Type, "cn") && strings.EqualFold(attr.Value, w) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
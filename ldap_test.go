@@ -0,0 +1,116 @@
+package rsbackup
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+// fakeLDAP is a directory of users with passwords and groups.
+type fakeLDAP struct {
+	passwords map[string]string
+	groups    map[string][]string
+	dials     int
+}
+
+func (d *fakeLDAP) dial() (ldapConn, error) {
+	d.dials++
+	return &fakeLDAPConn{dir: d}, nil
+}
+
+type fakeLDAPConn struct {
+	dir *fakeLDAP
+}
+
+func (c *fakeLDAPConn) Bind(username, password string) error {
+	if expected, ok := c.dir.passwords[username]; ok && expected == password {
+		return nil
+	}
+	return ldap.NewError(ldap.LDAPResultInvalidCredentials, fmt.Errorf("Invalid credentials"))
+}
+
+func (c *fakeLDAPConn) Search(req *ldap.SearchRequest) (*ldap.SearchResult, error) {
+	result := &ldap.SearchResult{}
+	for dn, groups := range c.dir.groups {
+		if req.Filter == fmt.Sprintf("(uid=%s)", dn[len("uid="):len(dn)-len(",dc=example,dc=com")]) {
+			entry := ldap.NewEntry(dn, map[string][]string{"memberOf": groups})
+			result.Entries = append(result.Entries, entry)
+		}
+	}
+	return result, nil
+}
+
+func (c *fakeLDAPConn) Close() error {
+	return nil
+}
+
+func TestLDAPAuthenticator(t *testing.T) {
+	dir := &fakeLDAP{
+		passwords: map[string]string{
+			"cn=service,dc=example,dc=com": "service-password",
+			"uid=alice,dc=example,dc=com":  "alice-password",
+			"uid=bob,dc=example,dc=com":    "bob-password",
+			"uid=eve,dc=example,dc=com":    "eve-password",
+			"uid=carol,dc=example,dc=com":  "carol-password",
+		},
+		groups: map[string][]string{
+			"uid=alice,dc=example,dc=com": {"cn=backup-users,ou=groups,dc=example,dc=com"},
+			"uid=bob,dc=example,dc=com":   {"cn=Backup-Admins,ou=groups,dc=example,dc=com"},
+			"uid=eve,dc=example,dc=com":   {"cn=marketing,ou=groups,dc=example,dc=com"},
+			"uid=carol,dc=example,dc=com": {"cn=backup-readers,ou=groups,dc=example,dc=com", "cn=backup-repairers,ou=groups,dc=example,dc=com"},
+		},
+	}
+	auth := NewLDAPAuthenticator(&Config{
+		LDAPBaseDN:       "dc=example,dc=com",
+		LDAPBindDN:       "cn=service,dc=example,dc=com",
+		LDAPBindPassword: "service-password",
+		LDAPAdminGroups:  []string{"backup-admins"},
+		LDAPUserGroups:   []string{"cn=backup-users,ou=groups,dc=example,dc=com"},
+		LDAPGroupScopes:  map[string][]string{"backup-readers": {ScopeRead}, "backup-repairers": {ScopeRepair}},
+	})
+	auth.dial = dir.dial
+
+	ldapTests := []struct {
+		name           string
+		user           string
+		password       string
+		expectedValid  bool
+		expectedScopes []string
+	}{
+		{"user", "alice", "alice-password", true, dataScopes},
+		{"admin by cn", "bob", "bob-password", true, allScopes},
+		{"scopes of groups", "carol", "carol-password", true, []string{ScopeRead, ScopeRepair}},
+		{"wrong password", "alice", "bob-password", false, nil},
+		{"empty password", "alice", "", false, nil},
+		{"unknown user", "mallory", "alice-password", false, nil},
+		{"filter injection", "*", "alice-password", false, nil},
+		{"no matching group", "eve", "eve-password", false, nil},
+	}
+	for _, tt := range ldapTests {
+		t.Run(tt.name, func(t *testing.T) {
+			token, ok := auth.Authenticate(tt.user, tt.password)
+			if ok != tt.expectedValid {
+				t.Fatalf("Got valid %t, expected %t", ok, tt.expectedValid)
+			}
+			if !ok {
+				return
+			}
+			if token.Name != "ldap:"+tt.user {
+				t.Errorf("Got token %+v", token)
+			}
+			for _, scope := range allScopes {
+				if token.HasScope(scope) != containsString(tt.expectedScopes, scope) {
+					t.Errorf("Got token %+v, expected scopes %v", token, tt.expectedScopes)
+				}
+			}
+		})
+	}
+
+	// Successful logins are cached.
+	dials := dir.dials
+	auth.Authenticate("alice", "alice-password")
+	if dir.dials != dials {
+		t.Errorf("Cached login went to the directory")
+	}
+}
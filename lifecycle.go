@@ -0,0 +1,275 @@
+package rsbackup
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	lifecycleExpire = "expire"
+	lifecycleThin   = "thin"
+	lifecycleCold   = "freeze"
+)
+
+// LifecycleRule decides what happens to the files it matches as they age.
+// The first rule matching a file applies to it.
+type LifecycleRule struct {
+	// Namespace limits the rule to files stored by that credential through
+	// the API. Imported files don't record who stored them, only rules
+	// without a Namespace apply to them.
+	Namespace string
+	// Prefix limits the rule to files whose names start with it.
+	Prefix string
+	// ExpireAfter deletes files once stored for that long.
+	ExpireAfter time.Duration
+	// ColdAfter moves files to the cold tier once untouched for that long,
+	// instead of Config.ColdAfter.
+	ColdAfter time.Duration
+	// KeepLatest thins out older versions: the files matching the rule
+	// are taken as versions of one another, and all but the KeepLatest
+	// stored last are deleted.
+	KeepLatest int
+}
+
+func (rule LifecycleRule) matches(fname string, extras MetadataExtras) bool {
+	if rule.Namespace != "" && rule.Namespace != extras.StoredBy {
+		return false
+	}
+	return strings.HasPrefix(fname, rule.Prefix)
+}
+
+// LifecycleAction is something the lifecycle rules do to a file: expire,
+// thin or freeze, moving it to the cold tier. Rule is the index of the rule in Config.Lifecycle.
+type LifecycleAction struct {
+	Name   string `json:"name"`
+	Action string `json:"action"`
+	Rule   int    `json:"rule"`
+}
+
+// lifecycleFile is a file matched by a lifecycle rule.
+type lifecycleFile struct {
+	name     string
+	extras   MetadataExtras
+	storedAt time.Time
+}
+
+// planLifecycle returns what the lifecycle rules do to the stored files at
+// now. Files that are immutable or under retention are left alone.
+func (rs *RSBackupAPI) planLifecycle(now time.Time) ([]LifecycleAction, error) {
+	fm := rs.RsFileMan
+	names, err := fm.ListData()
+	if err != nil {
+		return nil, err
+	}
+	rules := rs.Config.Lifecycle
+	matched := make([][]lifecycleFile, len(rules))
+	for _, name := range names {
+		fpath := fm.DataPath(name)
+		extras, err := fm.ReadExtras(fpath)
+		if os.IsNotExist(err) {
+			// Removed since the listing.
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		for i, rule := range rules {
+			if !rule.matches(name, extras) {
+				continue
+			}
+			storedAt, err := fm.storedAt(fpath, extras)
+			if err != nil {
+				return nil, err
+			}
+			matched[i] = append(matched[i], lifecycleFile{name: name, extras: extras, storedAt: storedAt})
+			break
+		}
+	}
+	actions := []LifecycleAction{}
+	for i, rule := range rules {
+		files := matched[i]
+		// Newest first, so the versions kept come first.
+		sort.Slice(files, func(a, b int) bool {
+			if !files[a].storedAt.Equal(files[b].storedAt) {
+				return files[a].storedAt.After(files[b].storedAt)
+			}
+			return files[a].name < files[b].name
+		})
+		for n, f := range files {
+			action := ""
+			switch {
+			case rule.ExpireAfter > 0 && now.Sub(f.storedAt) >= rule.ExpireAfter:
+				action = lifecycleExpire
+			case rule.KeepLatest > 0 && n >= rule.KeepLatest:
+				action = lifecycleThin
+			case rule.ColdAfter > 0 && rs.Tiering != nil && f.extras.Tier != tierCold && f.extras.Packed == nil && f.extras.Dedup == nil:
+				touched, err := rs.lastTouched(f.name, f.extras)
+				if err != nil {
+					return nil, err
+				}
+				if now.Sub(touched) >= rule.ColdAfter {
+					action = lifecycleCold
+				}
+			}
+			if action == "" {
+				continue
+			}
+			// Only a hint without renameMu, the delete checks again.
+			if action != lifecycleCold && fm.checkMutable(fm.DataPath(f.name), false) != nil {
+				continue
+			}
+			actions = append(actions, LifecycleAction{Name: f.name, Action: action, Rule: i})
+		}
+	}
+	return actions, nil
+}
+
+// applyLifecycle carries out what the lifecycle rules do to the stored
+// files at now. Expired and thinned files go to the trash when it's
+// enabled. Moves to the cold tier are paced to the scrub read rate.
+// Closing stop ends it early.
+func (rs *RSBackupAPI) applyLifecycle(job *jobProgress, stop <-chan struct{}, now time.Time) error {
+	actions, err := rs.planLifecycle(now)
+	if err != nil {
+		return err
+	}
+	job.setTotal(len(actions))
+	for _, action := range actions {
+		select {
+		case <-stop:
+			return nil
+		default:
+		}
+		var err error
+		switch action.Action {
+		case lifecycleCold:
+			var moved int64
+			moved, err = rs.freezeFile(action.Name, now, rs.Config.Lifecycle[action.Rule].ColdAfter)
+			rs.background().throttle.pay(moved, stop)
+		default:
+			err = rs.expireFile(action.Name, action.Action)
+		}
+		if err != nil {
+			log.Warnf("Lifecycle couldn't %s %s, continuing: %s", action.Action, action.Name, err)
+		}
+		job.done(action.Name, err)
+	}
+	return nil
+}
+
+// expireFile deletes fname for a lifecycle rule, or moves it to the trash
+// if enabled. Files locked since they were planned for are skipped.
+func (rs *RSBackupAPI) expireFile(fname, action string) error {
+	var err error
+	if rs.Trash != nil {
+		_, err = rs.Trash.Put(rs.RsFileMan, fname, "lifecycle", false)
+	} else {
+		err = rs.RsFileMan.Delete(fname, false, false)
+	}
+	if os.IsNotExist(err) || isLocked(err) {
+		log.Infof("Lifecycle skipped %s: %s", fname, err)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	log.Infof("Deleted %s (lifecycle %s, trashed: %t)", fname, action, rs.Trash != nil)
+	rs.forgetDeleted(fname, false)
+	return nil
+}
+
+type lifecycleRsp struct {
+	Actions []LifecycleAction `json:"actions"`
+}
+
+// lifecycleHandler reports what the lifecycle rules would do now on GET,
+// and starts a job doing it on POST.
+func (rs *RSBackupAPI) lifecycleHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		actions, err := rs.planLifecycle(time.Now())
+		if err != nil {
+			rs.Errorf(r, "Unable to plan lifecycle: %s", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(w).Encode(&lifecycleRsp{Actions: actions})
+		if err != nil {
+			rs.Errorf(r, "Unable to marshal json response: %s", err)
+		}
+	case "POST":
+		job, err := rs.background().jobs.start("lifecycle", rs.lifecycle)
+		if err == errJobRunning {
+			rs.Errorf(r, "Lifecycle already running")
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		rs.writeJobStarted(w, r, job)
+	default:
+		rs.Errorf(r, "Bad method %s", r.Method)
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+func (rs *RSBackupAPI) lifecycle(job *jobProgress, stop <-chan struct{}) error {
+	return rs.applyLifecycle(job, stop, time.Now())
+}
+
+// logLifecycle logs what the lifecycle rules would do now, for
+// Config.LifecycleDryRun.
+func (rs *RSBackupAPI) logLifecycle() {
+	actions, err := rs.planLifecycle(time.Now())
+	if err != nil {
+		log.Warnf("Unable to plan lifecycle: %s", err)
+		return
+	}
+	for _, action := range actions {
+		log.Infof("Lifecycle would %s %s (rule %d)", action.Action, action.Name, action.Rule)
+	}
+	log.Infof("Lifecycle dry run: %d actions", len(actions))
+}
+
+// StartLifecycle applies the lifecycle rules every interval until the
+// server is stopped, or only logs what they would do with
+// Config.LifecycleDryRun.
+func (rs *RSBackupAPI) StartLifecycle(interval time.Duration) {
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+			if rs.Config.LifecycleDryRun {
+				rs.logLifecycle()
+				continue
+			}
+			_, err := rs.background().jobs.start("lifecycle", rs.lifecycle)
+			if err != nil {
+				log.Warnf("Skipping lifecycle: %s", err)
+			}
+		}
+	}()
+	rs.OnShutdown("lifecycle", func(ctx context.Context) error {
+		close(stop)
+		select {
+		case <-done:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	})
+}
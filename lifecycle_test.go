@@ -0,0 +1,53 @@
+package rsbackup
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestLifecycle(t *testing.T) {
+	tmpDir := createTMPDir(t, "rsbackup")
+	config := &Config{BackupRoot: tmpDir, DataShards: 2, ParityShards: 1, Lifecycle: []LifecycleRule{
+		{Prefix: "db-", KeepLatest: 2},
+		{Namespace: "anonymous", Prefix: "tmp-", ExpireAfter: 24 * time.Hour},
+		{Namespace: "laptop", ExpireAfter: time.Hour},
+	}}
+	api := &RSBackupAPI{Config: config, RsFileMan: &RSFileManager{Config: config}}
+	for _, fname := range []string{"db-1", "db-2", "db-3", "db-4", "tmp-a", "notes"} {
+		submitData(t, api, fname, []byte(fname))
+	}
+
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(api.lifecycleHandler).ServeHTTP(rr, httptest.NewRequest("GET", "/lifecycle", nil))
+	var rsp lifecycleRsp
+	if rr.Code != http.StatusOK || json.NewDecoder(rr.Body).Decode(&rsp) != nil {
+		t.Fatalf("Got status code %d for the dry run", rr.Code)
+	}
+	expected := []LifecycleAction{{Name: "db-2", Action: lifecycleThin}, {Name: "db-1", Action: lifecycleThin}}
+	if !reflect.DeepEqual(rsp.Actions, expected) {
+		t.Errorf("Got actions %+v, expected %+v", rsp.Actions, expected)
+	}
+	if _, err := api.RsFileMan.Stat("db-1"); err != nil {
+		t.Errorf("Dry run removed a file: %s", err)
+	}
+
+	job, err := api.background().jobs.start("lifecycle", func(job *jobProgress, stop <-chan struct{}) error {
+		return api.applyLifecycle(job, stop, time.Now().Add(25*time.Hour))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job = waitForJob(t, api, job.ID); job.State != jobDone || len(job.Failed) != 0 || job.Total != 3 {
+		t.Fatalf("Got job %+v", job)
+	}
+	for fname, kept := range map[string]bool{"db-1": false, "db-2": false, "db-3": true, "db-4": true, "tmp-a": false, "notes": true} {
+		if _, err := api.RsFileMan.Stat(fname); os.IsNotExist(err) == kept {
+			t.Errorf("Got %v stating %s, expected it kept: %t", err, fname, kept)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package rsbackup
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+)
+
+// listSortKeys are what listings can be sorted by, besides names. They're
+// read from the index, times as nanoseconds.
+var listSortKeys = map[string]func(IndexEntry) int64{
+	"size":     func(e IndexEntry) int64 { return e.Size },
+	"modified": func(e IndexEntry) int64 { return e.Modified.UnixNano() },
+	// Unchecked files sort as checked longest ago.
+	"checked": func(e IndexEntry) int64 {
+		if e.CheckedAt == nil {
+			return math.MinInt64
+		}
+		return e.CheckedAt.UnixNano()
+	},
+}
+
+// listSortParams reads the sort field of a listing, name, size, modified
+// or checked, and its order, asc or desc.
+func (rs *RSBackupAPI) listSortParams(r *http.Request) (string, bool, error) {
+	by := r.FormValue("sort")
+	if by == "" {
+		by = "name"
+	}
+	if _, ok := listSortKeys[by]; !ok && by != "name" {
+		return "", false, fmt.Errorf("Bad sort '%s', must be name, size, modified or checked", by)
+	}
+	if by != "name" && rs.RsFileMan.Index == nil {
+		return "", false, fmt.Errorf("Sorting by %s needs the metadata index", by)
+	}
+	switch order := r.FormValue("order"); order {
+	case "", "asc":
+		return by, false, nil
+	case "desc":
+		return by, true, nil
+	default:
+		return "", false, fmt.Errorf("Bad order '%s', must be asc or desc", order)
+	}
+}
+
+// sortNames sorts names, sorted by name already, by the index entries of
+// the files. Files that sort the same stay sorted by name.
+func (rs *RSBackupAPI) sortNames(names []string, by string, descending bool) {
+	key, ok := listSortKeys[by]
+	if !ok {
+		if descending {
+			sort.Sort(sort.Reverse(sort.StringSlice(names)))
+		}
+		return
+	}
+	keys := make(map[string]int64, len(names))
+	for _, name := range names {
+		entry, _ := rs.RsFileMan.Index.Get(name)
+		keys[name] = key(entry)
+	}
+	sort.SliceStable(names, func(i, j int) bool {
+		if descending {
+			return keys[names[i]] > keys[names[j]]
+		}
+		return keys[names[i]] < keys[names[j]]
+	})
+}
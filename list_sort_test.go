@@ -0,0 +1,71 @@
+package rsbackup
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestListSorting(t *testing.T) {
+	config := &Config{BackupRoot: createTMPDir(t, "rsbackup")}
+	api := &RSBackupAPI{Config: config, RsFileMan: &RSFileManager{Config: config}}
+	list := func(query string) (int, []string) {
+		req := httptest.NewRequest("GET", "/list_data?"+query, nil)
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(api.listDataHandler).ServeHTTP(rr, req)
+		var rsp listDataRsp
+		json.NewDecoder(rr.Body).Decode(&rsp)
+		return rr.Code, rsp.Files
+	}
+	if code, _ := list("sort=size"); code != http.StatusBadRequest {
+		t.Errorf("Got status code %d sorting by size without the index", code)
+	}
+
+	index, err := OpenMetadataIndex(path.Join(createTMPDir(t, "rsbackup-state"), "index.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	api.RsFileMan.Index = index
+	day := func(d int) time.Time {
+		return time.Date(2026, 3, d, 0, 0, 0, 0, time.UTC)
+	}
+	checked := day(5)
+	for _, entry := range []IndexEntry{
+		{Name: "a", Size: 30, Modified: day(2)},
+		{Name: "b", Size: 10, Modified: day(3), CheckedAt: &checked},
+		{Name: "c", Size: 20, Modified: day(1)},
+		{Name: "d", Size: 10, Modified: day(4)},
+	} {
+		if err := index.Put(entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var tests = []struct {
+		query    string
+		expected []string
+	}{
+		{"", []string{"a", "b", "c", "d"}},
+		{"order=desc", []string{"d", "c", "b", "a"}},
+		{"sort=size", []string{"b", "d", "c", "a"}},
+		{"sort=size&order=desc", []string{"a", "c", "b", "d"}},
+		{"sort=modified", []string{"c", "a", "b", "d"}},
+		{"sort=modified&order=desc", []string{"d", "b", "a", "c"}},
+		{"sort=checked&order=desc", []string{"b", "a", "c", "d"}},
+	}
+	for _, tt := range tests {
+		code, names := list(tt.query)
+		if code != http.StatusOK || !reflect.DeepEqual(names, tt.expected) {
+			t.Errorf("Got status code %d and %v listing with %q", code, names, tt.query)
+		}
+	}
+	for _, query := range []string{"sort=color", "order=up"} {
+		if code, _ := list(query); code != http.StatusBadRequest {
+			t.Errorf("Got status code %d listing with %q", code, query)
+		}
+	}
+}
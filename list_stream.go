@@ -0,0 +1,33 @@
+package rsbackup
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// listLine is a line of a streamed listing that isn't extended.
+type listLine struct {
+	Name string `json:"name"`
+}
+
+// streamList writes the listing as json lines, one per file as it's found,
+// instead of the whole listDataRsp at once. Files are those matching
+// selector, if any, and lines are objectInfo with extended=true.
+func (rs *RSBackupAPI) streamList(w http.ResponseWriter, r *http.Request, selector map[string]string) {
+	extended := r.FormValue("extended") == "true"
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	enc := json.NewEncoder(w)
+	err := rs.RsFileMan.WalkData(func(name string) error {
+		if selector != nil && !matchLabels(rs.labelsOf(name), selector) {
+			return nil
+		}
+		if extended {
+			return enc.Encode(rs.objectInfo(name))
+		}
+		return enc.Encode(listLine{Name: name})
+	})
+	// Once the listing is streaming, errors can only be logged.
+	if err != nil {
+		rs.Errorf(r, "Unable to stream listing of %s: %s", rs.Config.BackupRoot, err)
+	}
+}
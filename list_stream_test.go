@@ -0,0 +1,128 @@
+package rsbackup
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"reflect"
+	"sort"
+	"testing"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestStreamList(t *testing.T) {
+	for _, indexed := range []bool{false, true} {
+		t.Run(fmt.Sprintf("indexed=%t", indexed), func(t *testing.T) {
+			config := &Config{BackupRoot: createTMPDir(t, "rsbackup"), DataShards: 2, ParityShards: 1}
+			fm := &RSFileManager{Config: config, Layout: HashPrefixLayout{Levels: 1}}
+			if indexed {
+				index, err := OpenMetadataIndex(path.Join(createTMPDir(t, "rsbackup-state"), "index.db"))
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer index.Close()
+				fm.Index = index
+			}
+			api := &RSBackupAPI{Config: config, RsFileMan: fm}
+			for fname, labels := range map[string]string{"tyger": "poem=tyger", "lamb": "poem=lamb", "fly": "poem=fly"} {
+				body := new(bytes.Buffer)
+				mw := multipart.NewWriter(body)
+				fw, _ := mw.CreateFormFile("file", fname)
+				fw.Write([]byte("little " + fname))
+				mw.WriteField("filename", fname)
+				mw.WriteField("labels", labels)
+				mw.Close()
+				req := httptest.NewRequest("POST", "/submit_data", body)
+				req.Header.Set("Content-Type", mw.FormDataContentType())
+				rr := httptest.NewRecorder()
+				http.HandlerFunc(api.submitDataHandler).ServeHTTP(rr, req)
+				if rr.Code != http.StatusOK {
+					t.Fatalf("Got status code %d submitting %s", rr.Code, fname)
+				}
+			}
+			list := func(query string) (int, []objectInfo) {
+				rr := httptest.NewRecorder()
+				http.HandlerFunc(api.listDataHandler).ServeHTTP(rr, httptest.NewRequest("GET", "/list_data?"+query, nil))
+				var lines []objectInfo
+				dec := json.NewDecoder(rr.Body)
+				for rr.Code == http.StatusOK && dec.More() {
+					var line objectInfo
+					if err := dec.Decode(&line); err != nil {
+						t.Fatal(err)
+					}
+					lines = append(lines, line)
+				}
+				return rr.Code, lines
+			}
+
+			code, lines := list("format=ndjson")
+			var names []string
+			for _, line := range lines {
+				names = append(names, line.Name)
+			}
+			// Only the index yields names sorted across directories.
+			if !indexed {
+				sort.Strings(names)
+			}
+			if code != http.StatusOK || !reflect.DeepEqual(names, []string{"fly", "lamb", "tyger"}) {
+				t.Errorf("Got status code %d and names %v", code, names)
+			}
+			code, lines = list("format=ndjson&extended=true&labels=poem=lamb")
+			if code != http.StatusOK || len(lines) != 1 || lines[0].Name != "lamb" || lines[0].Labels["poem"] != "lamb" {
+				t.Errorf("Got status code %d and lines %+v", code, lines)
+			}
+			for _, query := range []string{"format=xml", "format=ndjson&order=desc"} {
+				if code, _ := list(query); code != http.StatusBadRequest {
+					t.Errorf("Got status code %d for %s", code, query)
+				}
+			}
+		})
+	}
+}
+
+func TestIndexWalkNames(t *testing.T) {
+	index, err := OpenMetadataIndex(path.Join(createTMPDir(t, "rsbackup-state"), "index.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	var expected []string
+	err = index.db.Update(func(tx *bolt.Tx) error {
+		for i := 0; i < walkPage*2+5; i++ {
+			name := fmt.Sprintf("file-%05d", i)
+			expected = append(expected, name)
+			if err := putEntry(tx, IndexEntry{Name: name}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	err = index.WalkNames(func(name string) error {
+		names = append(names, name)
+		return nil
+	})
+	if err != nil || !reflect.DeepEqual(names, expected) {
+		t.Errorf("Got %d names (error: %v), expected %d", len(names), err, len(expected))
+	}
+	stop := fmt.Errorf("enough")
+	n := 0
+	err = index.WalkNames(func(string) error {
+		n++
+		if n == 3 {
+			return stop
+		}
+		return nil
+	})
+	if err != stop || n != 3 {
+		t.Errorf("Got error %v after %d names", err, n)
+	}
+}
@@ -0,0 +1,139 @@
+package rsbackup
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// metadataMirrorSuffix names the copy of the metadata of a file kept next
+// to it. A file's metadata is restored from the copy when it's lost or
+// damaged, and the other way round.
+const metadataMirrorSuffix = ".md.mirror"
+
+var errMetadataCorrupt = errors.New("Metadata is corrupt")
+
+// metadataChecksum returns the sha256 of md encoded without its checksum.
+func metadataChecksum(md *storedMetadata) (string, error) {
+	unsealed := *md
+	unsealed.Checksum = ""
+	encoded, err := json.Marshal(unsealed)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(encoded)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// sealMetadata sets the checksum of md, which must be done last before
+// it's written.
+func sealMetadata(md *storedMetadata) error {
+	var err error
+	md.Checksum, err = metadataChecksum(md)
+	return err
+}
+
+// decodeMetadata reads a metadata file from src, checking it against its
+// checksum. Metadata written before checksums were kept is taken as is.
+func decodeMetadata(src io.Reader) (*storedMetadata, error) {
+	var md storedMetadata
+	err := json.NewDecoder(src).Decode(&md)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", errMetadataCorrupt, err)
+	}
+	if md.Checksum == "" {
+		return &md, nil
+	}
+	if sum, err := metadataChecksum(&md); err != nil || sum != md.Checksum {
+		return nil, fmt.Errorf("%w: checksum mismatch", errMetadataCorrupt)
+	}
+	return &md, nil
+}
+
+func (r *RSFileManager) readMetadataFile(mdPath string) (*storedMetadata, error) {
+	mdFile, err := r.storage().Open(mdPath)
+	if err != nil {
+		return nil, err
+	}
+	defer mdFile.Close()
+	return decodeMetadata(mdFile)
+}
+
+// readStoredMetadata reads the whole metadata file of the file at fpath.
+// If it's missing or corrupt but the mirror is intact, it is restored
+// from the mirror.
+func (r *RSFileManager) readStoredMetadata(fpath string) (*storedMetadata, error) {
+	md, err := r.readMetadataFile(fpath + ".md")
+	if err == nil {
+		return md, nil
+	}
+	mirrored, mirrorErr := r.readMetadataFile(fpath + metadataMirrorSuffix)
+	if mirrorErr != nil {
+		return nil, err
+	}
+	log.Warnf("Restoring metadata of '%s' from its mirror: %s", fpath, err)
+	if err := r.storeMetadata(fpath+".md", mirrored); err != nil {
+		log.Errorf("Unable to restore metadata of '%s': %s", fpath, err)
+	}
+	return mirrored, nil
+}
+
+// storeMetadata seals md and replaces the metadata file at mdPath with it.
+// It's written to the state directory first, so the data directory never
+// holds a partial metadata file.
+func (r *RSFileManager) storeMetadata(mdPath string, md *storedMetadata) error {
+	err := sealMetadata(md)
+	if err != nil {
+		return err
+	}
+	id, err := generateToken()
+	if err != nil {
+		return err
+	}
+	// Compaction replaces metadata while keys are rotated.
+	tmpPath := r.Config.StatePath(path.Join(rotationDirName, "metadata-"+id[:16]))
+	err = writeJSONState(tmpPath, md)
+	if err != nil {
+		return err
+	}
+	return storeLocal(r.storage(), tmpPath, mdPath)
+}
+
+// repairMetadata makes sure both copies of the metadata of the file at
+// fpath are intact, writing the mirror again if it isn't. Files stored
+// before metadata was mirrored get their mirror this way.
+func (r *RSFileManager) repairMetadata(fpath string) {
+	md, err := r.readStoredMetadata(fpath)
+	if err != nil {
+		return
+	}
+	_, err = r.readMetadataFile(fpath + metadataMirrorSuffix)
+	if err == nil {
+		return
+	}
+	if !os.IsNotExist(err) {
+		log.Warnf("Writing the metadata mirror of '%s' again: %s", fpath, err)
+	}
+	if err := r.storeMetadata(fpath+metadataMirrorSuffix, md); err != nil {
+		log.Errorf("Unable to mirror metadata of '%s': %s", fpath, err)
+	}
+}
+
+// removeMetadata removes the metadata of the file at fpath, the mirror
+// first so the metadata isn't restored from it.
+func removeMetadata(storage StorageBackend, fpath string) error {
+	for _, suffix := range []string{metadataMirrorSuffix, ".md"} {
+		err := storage.Remove(fpath + suffix)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
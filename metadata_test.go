@@ -0,0 +1,98 @@
+package rsbackup
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/sirmackk/rsutils"
+)
+
+func TestMetadataIntegrity(t *testing.T) {
+	tmpDir := createTMPDir(t, "rsbackup")
+	config := &Config{BackupRoot: tmpDir, DataShards: 2, ParityShards: 1}
+	fm := &RSFileManager{Config: config}
+	api := &RSBackupAPI{Config: config, RsFileMan: fm}
+	fpath := fm.DataPath("tyger")
+	if err := ioutil.WriteFile(fpath, []byte("what immortal hand or eye"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	md, err := api.generateParity(fm.storage(), fpath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fm.WriteMetadata("tyger", md, MetadataExtras{Immutable: true}); err != nil {
+		t.Fatal(err)
+	}
+	original, err := ioutil.ReadFile(fpath + ".md")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mirrored, _ := ioutil.ReadFile(fpath + metadataMirrorSuffix); !bytes.Equal(mirrored, original) {
+		t.Fatalf("Got mirror %q of metadata %q", mirrored, original)
+	}
+	assertHealthy := func() {
+		t.Helper()
+		health, _, _, err := fm.CheckData("tyger")
+		if err != nil || !health {
+			t.Fatalf("Got health %t (error: %v)", health, err)
+		}
+		for _, suffix := range []string{".md", metadataMirrorSuffix} {
+			if stored, _ := ioutil.ReadFile(fpath + suffix); !bytes.Equal(stored, original) {
+				t.Errorf("Got %s %q, expected it restored", suffix, stored)
+			}
+		}
+	}
+
+	// Valid json that doesn't match its checksum is caught.
+	tampered := bytes.Replace(original, []byte(`"Immutable":true`), []byte(`"Immutable":false`), 1)
+	if bytes.Equal(tampered, original) {
+		t.Fatalf("Metadata %q has no Immutable field", original)
+	}
+	if _, err := decodeMetadata(bytes.NewReader(tampered)); err == nil {
+		t.Errorf("Expected an error decoding tampered metadata")
+	}
+	for name, damage := range map[string]func(string) error{
+		"missing":   os.Remove,
+		"truncated": func(p string) error { return ioutil.WriteFile(p, original[:20], 0644) },
+		"tampered":  func(p string) error { return ioutil.WriteFile(p, tampered, 0644) },
+	} {
+		for _, suffix := range []string{".md", metadataMirrorSuffix} {
+			if err := damage(fpath + suffix); err != nil {
+				t.Fatal(err)
+			}
+			t.Logf("Checking with %s %s", name, suffix)
+			assertHealthy()
+		}
+	}
+	if err := fm.checkMutable(fpath, false); err == nil {
+		t.Errorf("Expected the file to stay immutable")
+	}
+
+	// Metadata written before checksums is read as is, and gets a
+	// mirror once checked.
+	os.Remove(fpath + metadataMirrorSuffix)
+	legacy, _ := json.Marshal(storedMetadata{Metadata: &rsutils.Metadata{Size: md.Size, Hashes: md.Hashes, DataShards: md.DataShards, ParityShards: md.ParityShards}})
+	if err := ioutil.WriteFile(fpath+".md", legacy, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if health, _, _, err := fm.CheckData("tyger"); err != nil || !health {
+		t.Fatalf("Got health %t (error: %v) with legacy metadata", health, err)
+	}
+	if mirrored, err := fm.readMetadataFile(fpath + metadataMirrorSuffix); err != nil || mirrored.Checksum == "" {
+		t.Errorf("Got mirror %+v (error: %v) of legacy metadata", mirrored, err)
+	}
+
+	// The mirror moves along with the file.
+	if err := fm.Rename("tyger", "lamb"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(fm.DataPath("lamb") + metadataMirrorSuffix); err != nil {
+		t.Errorf("Expected the mirror renamed: %s", err)
+	}
+	if names, _ := fm.ListData(); len(names) != 1 || names[0] != "lamb" {
+		t.Errorf("Got names %v", names)
+	}
+}
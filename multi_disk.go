@@ -0,0 +1,350 @@
+package rsbackup
+
+import (
+	"fmt"
+	"hash/fnv"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+// MultiDiskBackend spreads files over directories on separate disks. The
+// data file and the parity shards of a file each go to their own disk,
+// as long as there are enough disks, so losing one disk loses at most
+// one shard of every file. Metadata is needed to rebuild any shard, so it
+// is copied to every disk.
+type MultiDiskBackend struct {
+	root  string
+	disks []string
+	// local creates the files on each disk.
+	local OSBackend
+}
+
+// NewMultiDiskBackend returns a backend storing the files below root on
+// disks, which must be existing directories. Files are created through
+// local.
+func NewMultiDiskBackend(root string, disks []string, local OSBackend) (*MultiDiskBackend, error) {
+	for _, disk := range disks {
+		stat, err := os.Stat(disk)
+		if err != nil {
+			return nil, err
+		}
+		if !stat.IsDir() {
+			return nil, fmt.Errorf("'%s' is not a directory", disk)
+		}
+	}
+	return &MultiDiskBackend{root: path.Clean(root), disks: disks, local: local}, nil
+}
+
+func isMetadataPath(fpath string) bool {
+	return strings.HasSuffix(fpath, ".md") || strings.HasSuffix(fpath, metadataMirrorSuffix)
+}
+
+// order returns the indexes of all disks, starting with the one fpath is
+// placed on. The data file of a file goes to a disk picked by its name,
+// and parity shard i to the i-th disk after that one.
+func (m *MultiDiskBackend) order(fpath string) []int {
+	base, shard := shardOf(fpath)
+	if shard < 0 {
+		shard = 0
+	}
+	h := fnv.New32a()
+	h.Write([]byte(path.Base(base)))
+	first := int(h.Sum32()%uint32(len(m.disks))) + shard
+	disks := make([]int, len(m.disks))
+	for i := range disks {
+		disks[i] = (first + i) % len(m.disks)
+	}
+	return disks
+}
+
+// onDisk returns the path of fpath on the disk with index disk.
+func (m *MultiDiskBackend) onDisk(disk int, fpath string) (string, error) {
+	rel, err := relativePath(m.root, fpath)
+	if err != nil {
+		return "", err
+	}
+	return path.Join(m.disks[disk], rel), nil
+}
+
+// locate returns the indexes of the disks holding fpath. Files are looked
+// for on every disk, in case they were placed while there was a different
+// number of disks.
+func (m *MultiDiskBackend) locate(fpath string) ([]int, error) {
+	var found []int
+	for _, disk := range m.order(fpath) {
+		diskPath, err := m.onDisk(disk, fpath)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := os.Lstat(diskPath); err == nil {
+			found = append(found, disk)
+		}
+	}
+	if len(found) == 0 {
+		return nil, &os.PathError{Op: "open", Path: fpath, Err: os.ErrNotExist}
+	}
+	return found, nil
+}
+
+// open opens fpath on the disks holding it, on all of them for metadata.
+func (m *MultiDiskBackend) open(fpath string, flags int) (StorageFile, error) {
+	disks, err := m.locate(fpath)
+	if err != nil {
+		return nil, err
+	}
+	if !isMetadataPath(fpath) || flags == os.O_RDONLY {
+		disks = disks[:1]
+	}
+	mirror := &mirrorFile{}
+	for _, disk := range disks {
+		diskPath, _ := m.onDisk(disk, fpath)
+		f, err := os.OpenFile(diskPath, flags, 0)
+		if err != nil {
+			mirror.Close()
+			return nil, err
+		}
+		mirror.files = append(mirror.files, f)
+	}
+	if len(mirror.files) == 1 {
+		return mirror.files[0], nil
+	}
+	return mirror, nil
+}
+
+func (m *MultiDiskBackend) Open(fpath string) (StorageFile, error) {
+	return m.open(fpath, os.O_RDONLY)
+}
+
+// OpenWritable opens every copy of metadata, writes go to all of them.
+func (m *MultiDiskBackend) OpenWritable(fpath string) (StorageFile, error) {
+	return m.open(fpath, os.O_RDWR)
+}
+
+// CreateExclusive creates fpath on the disk it's placed on, or on every
+// disk for metadata. It fails if any disk has fpath already.
+func (m *MultiDiskBackend) CreateExclusive(fpath string) (StorageFile, error) {
+	if _, err := m.locate(fpath); err == nil {
+		return nil, &os.PathError{Op: "open", Path: fpath, Err: os.ErrExist}
+	}
+	disks := m.order(fpath)
+	if !isMetadataPath(fpath) {
+		disks = disks[:1]
+	}
+	mirror := &mirrorFile{}
+	for _, disk := range disks {
+		diskPath, err := m.onDisk(disk, fpath)
+		if err == nil {
+			var f StorageFile
+			f, err = m.local.CreateExclusive(diskPath)
+			if err == nil {
+				mirror.files = append(mirror.files, f.(*os.File))
+				continue
+			}
+		}
+		mirror.Close()
+		for _, created := range mirror.files {
+			os.Remove(created.Name())
+		}
+		return nil, err
+	}
+	if len(mirror.files) == 1 {
+		return mirror.files[0], nil
+	}
+	return mirror, nil
+}
+
+// List merges the entries of dir on all disks.
+func (m *MultiDiskBackend) List(dir string) ([]string, error) {
+	seen := make(map[string]bool)
+	var names []string
+	found := false
+	for disk := range m.disks {
+		diskPath, err := m.onDisk(disk, dir)
+		if err != nil {
+			return nil, err
+		}
+		diskNames, err := OSBackend{}.List(diskPath)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		found = true
+		for _, name := range diskNames {
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+	if !found {
+		return nil, &os.PathError{Op: "open", Path: dir, Err: os.ErrNotExist}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (m *MultiDiskBackend) Stat(fpath string) (os.FileInfo, error) {
+	disks, err := m.locate(fpath)
+	if err != nil {
+		return nil, &os.PathError{Op: "stat", Path: fpath, Err: os.ErrNotExist}
+	}
+	diskPath, _ := m.onDisk(disks[0], fpath)
+	return os.Stat(diskPath)
+}
+
+// Remove removes fpath from every disk holding it.
+func (m *MultiDiskBackend) Remove(fpath string) error {
+	disks, err := m.locate(fpath)
+	if err != nil {
+		return &os.PathError{Op: "remove", Path: fpath, Err: os.ErrNotExist}
+	}
+	for _, disk := range disks {
+		diskPath, _ := m.onDisk(disk, fpath)
+		err = os.Remove(diskPath)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Rename moves from to the disk to is placed on, copying it over when
+// that's another disk. Copies of metadata are renamed on their own disks.
+func (m *MultiDiskBackend) Rename(from, to string) error {
+	disks, err := m.locate(from)
+	if err != nil {
+		return &os.LinkError{Op: "rename", Old: from, New: to, Err: os.ErrNotExist}
+	}
+	if _, err := m.onDisk(0, to); err != nil {
+		return err
+	}
+	if isMetadataPath(from) && isMetadataPath(to) {
+		for _, disk := range disks {
+			src, _ := m.onDisk(disk, from)
+			dst, _ := m.onDisk(disk, to)
+			err = m.local.Rename(src, dst)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	src, _ := m.onDisk(disks[0], from)
+	target := m.order(to)[0]
+	dst, _ := m.onDisk(target, to)
+	if target == disks[0] {
+		return m.local.Rename(src, dst)
+	}
+	return m.moveFile(src, dst)
+}
+
+// moveFile moves src to dst on another disk. dst only appears once it's
+// complete.
+func (m *MultiDiskBackend) moveFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	tmpPath := dst + ".moving"
+	out, err := m.local.CreateExclusive(tmpPath)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if err == nil {
+		err = out.Sync()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, dst)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return os.Remove(src)
+}
+
+// mirrorFile writes to several copies of a file at once, and reads from
+// the first one.
+type mirrorFile struct {
+	files []*os.File
+}
+
+func (f *mirrorFile) Read(p []byte) (int, error) {
+	n, err := f.files[0].Read(p)
+	if n > 0 {
+		// Keep the offsets of the other copies in step.
+		for _, file := range f.files[1:] {
+			if _, err := file.Seek(int64(n), io.SeekCurrent); err != nil {
+				return n, err
+			}
+		}
+	}
+	return n, err
+}
+
+func (f *mirrorFile) ReadAt(p []byte, off int64) (int, error) {
+	return f.files[0].ReadAt(p, off)
+}
+
+func (f *mirrorFile) Write(p []byte) (int, error) {
+	for _, file := range f.files {
+		if n, err := file.Write(p); err != nil {
+			return n, err
+		}
+	}
+	return len(p), nil
+}
+
+func (f *mirrorFile) Seek(offset int64, whence int) (int64, error) {
+	var pos int64
+	for _, file := range f.files {
+		var err error
+		pos, err = file.Seek(offset, whence)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return pos, nil
+}
+
+func (f *mirrorFile) Stat() (os.FileInfo, error) {
+	return f.files[0].Stat()
+}
+
+func (f *mirrorFile) Truncate(size int64) error {
+	for _, file := range f.files {
+		if err := file.Truncate(size); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *mirrorFile) Sync() error {
+	for _, file := range f.files {
+		if err := file.Sync(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *mirrorFile) Close() error {
+	var firstErr error
+	for _, file := range f.files {
+		if err := file.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
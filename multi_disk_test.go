@@ -0,0 +1,134 @@
+package rsbackup
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+)
+
+func newTestMultiDiskAPI(t *testing.T, disks int) (*RSBackupAPI, []string) {
+	tmpDir := createTMPDir(t, "rsbackup")
+	var roots []string
+	for i := 0; i < disks; i++ {
+		root := path.Join(tmpDir, fmt.Sprintf("disk%d", i))
+		if err := os.Mkdir(root, 0755); err != nil {
+			t.Fatal(err)
+		}
+		roots = append(roots, root)
+	}
+	conf := &Config{BackupRoot: path.Join(tmpDir, "state"), DataShards: 2, ParityShards: disks - 1, ShardRoots: roots}
+	storage, err := NewMultiDiskBackend(conf.BackupRoot, roots, OSBackend{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &RSBackupAPI{Config: conf, RsFileMan: &RSFileManager{Config: conf, Storage: storage}}, roots
+}
+
+func submitTestData(t *testing.T, api *RSBackupAPI, fname string) []byte {
+	testData, err := ioutil.ReadFile("testdata/tyger")
+	if err != nil {
+		t.Fatal(err)
+	}
+	submitData(t, api, fname, testData)
+	return testData
+}
+
+func submitData(t *testing.T, api *RSBackupAPI, fname string, testData []byte) {
+	body := new(bytes.Buffer)
+	multipartWriter := multipart.NewWriter(body)
+	form, _ := multipartWriter.CreateFormFile("file", fname)
+	form.Write(testData)
+	multipartWriter.WriteField("filename", fname)
+	multipartWriter.Close()
+	req := httptest.NewRequest("POST", "/submit_data", body)
+	req.Header.Add("content-type", multipartWriter.FormDataContentType())
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(api.submitDataHandler).ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Got status code %d submitting", rr.Code)
+	}
+}
+
+func TestMultiDiskBackend(t *testing.T) {
+	api, disks := newTestMultiDiskAPI(t, 3)
+	submitTestData(t, api, "tyger")
+
+	holders := map[string]int{}
+	for _, disk := range disks {
+		if _, err := os.Stat(path.Join(disk, "tyger.md")); err != nil {
+			t.Errorf("No metadata on %s: %s", disk, err)
+		}
+		for _, suffix := range []string{"", ".parity.1", ".parity.2"} {
+			if _, err := os.Stat(path.Join(disk, "tyger"+suffix)); err == nil {
+				holders[disk]++
+			}
+		}
+	}
+	if len(holders) != 3 {
+		t.Errorf("Shards aren't spread over all disks: %v", holders)
+	}
+
+	storage := api.RsFileMan.Storage
+	names, err := storage.List(api.Config.BackupRoot)
+	if err != nil || len(names) != 5 {
+		t.Errorf("Got names %v (error: %v)", names, err)
+	}
+	if _, err := storage.CreateExclusive(path.Join(api.Config.BackupRoot, "tyger.md")); !os.IsExist(err) {
+		t.Errorf("Got %v creating existing metadata", err)
+	}
+	for _, suffix := range []string{"", ".md", ".parity.1", ".parity.2"} {
+		err := storage.Rename(path.Join(api.Config.BackupRoot, "tyger"+suffix), path.Join(api.Config.BackupRoot, "lion"+suffix))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	health, _, _, err := api.RsFileMan.CheckData("lion")
+	if err != nil || !health {
+		t.Errorf("Got health %t after renaming (error: %v)", health, err)
+	}
+	if _, err := storage.Stat(path.Join(api.Config.BackupRoot, "tyger")); !os.IsNotExist(err) {
+		t.Errorf("Got %v stating a renamed file", err)
+	}
+	err = storage.Remove(path.Join(api.Config.BackupRoot, "lion.md"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, disk := range disks {
+		if _, err := os.Stat(path.Join(disk, "lion.md")); !os.IsNotExist(err) {
+			t.Errorf("Metadata left on %s", disk)
+		}
+	}
+}
+
+func TestMultiDiskBackendLostDisk(t *testing.T) {
+	for i := 0; i < 3; i++ {
+		api, disks := newTestMultiDiskAPI(t, 3)
+		testData := submitTestData(t, api, "tyger")
+		os.RemoveAll(disks[i])
+		os.Mkdir(disks[i], 0755)
+
+		health, _, _, err := api.RsFileMan.CheckData("tyger")
+		if err != nil || health {
+			t.Errorf("Got health %t after losing %s (error: %v)", health, disks[i], err)
+		}
+		err = api.RsFileMan.RepairData("tyger")
+		if err != nil {
+			t.Fatalf("Repair after losing %s failed: %s", disks[i], err)
+		}
+		health, _, _, err = api.RsFileMan.CheckData("tyger")
+		if err != nil || !health {
+			t.Errorf("Got health %t after repair (error: %v)", health, err)
+		}
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(api.retrieveDataHandler).ServeHTTP(rr, httptest.NewRequest("GET", "/retrieve_data/tyger", nil))
+		if rr.Body.String() != string(testData) {
+			t.Errorf("Got retrieved contents '%s' after losing %s", rr.Body.String(), disks[i])
+		}
+	}
+}
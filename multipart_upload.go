@@ -0,0 +1,170 @@
+package rsbackup
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+)
+
+// maxFormFields caps the bytes of the fields of a submit, like
+// ParseMultipartForm does.
+const maxFormFields = 10 << 20
+
+var errNoFilePart = errors.New("Missing 'file' part")
+
+// fileUpload is the file part of a multipart submit.
+type fileUpload struct {
+	src io.Reader
+	// size is -1 while the part is streamed.
+	size int64
+	// form is left to read after the part when it's streamed.
+	form *multipart.Reader
+	// err is the first error reading the request body.
+	err     error
+	cleanup func()
+}
+
+func (u *fileUpload) Read(p []byte) (int, error) {
+	n, err := u.src.Read(p)
+	if err != nil && err != io.EOF && u.err == nil {
+		u.err = err
+	}
+	return n, err
+}
+
+func (u *fileUpload) Close() {
+	if u.cleanup != nil {
+		u.cleanup()
+	}
+}
+
+// finish reads what follows a streamed file part, which must not be a
+// field: it came too late to be taken into account.
+func (u *fileUpload) finish() error {
+	if u.form == nil {
+		return nil
+	}
+	for {
+		part, err := u.form.NextPart()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if part.FileName() == "" {
+			return fmt.Errorf("Field '%s' follows the file, fields must come first", part.FormName())
+		}
+	}
+}
+
+// readUpload reads the fields of the multipart submit r up to its "file"
+// part, setting them on r as ParseMultipartForm would, and returns the
+// part to be streamed into storage. A file part that comes before the
+// filename field, when needFilename, is buffered instead, up to
+// Config.UploadMemoryBuffer in memory and the rest in the staging
+// directory, so the fields after it can be read.
+func (rs *RSBackupAPI) readUpload(r *http.Request, needFilename bool) (*fileUpload, error) {
+	form, err := r.MultipartReader()
+	if err != nil {
+		return nil, err
+	}
+	values := make(url.Values)
+	setForm := func() {
+		r.MultipartForm = &multipart.Form{Value: values, File: make(map[string][]*multipart.FileHeader)}
+		r.PostForm = values
+		r.Form = make(url.Values)
+		for k, v := range values {
+			r.Form[k] = append(r.Form[k], v...)
+		}
+		for k, v := range r.URL.Query() {
+			r.Form[k] = append(r.Form[k], v...)
+		}
+	}
+	var upload *fileUpload
+	left := int64(maxFormFields)
+	for {
+		part, err := form.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			if upload != nil {
+				upload.Close()
+			}
+			return nil, err
+		}
+		if part.FormName() == "file" && upload == nil {
+			if !needFilename || values.Get("filename") != "" {
+				setForm()
+				return &fileUpload{src: part, size: -1, form: form}, nil
+			}
+			upload, err = rs.bufferUpload(part)
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if part.FileName() != "" {
+			continue
+		}
+		var value bytes.Buffer
+		n, err := io.CopyN(&value, part, left+1)
+		if err != nil && err != io.EOF {
+			if upload != nil {
+				upload.Close()
+			}
+			return nil, err
+		}
+		left -= n
+		if left < 0 {
+			if upload != nil {
+				upload.Close()
+			}
+			return nil, fmt.Errorf("Form fields exceed %d bytes", maxFormFields)
+		}
+		values.Add(part.FormName(), value.String())
+	}
+	if upload == nil {
+		return nil, errNoFilePart
+	}
+	setForm()
+	return upload, nil
+}
+
+// bufferUpload reads the file part into memory, spilling to the staging
+// directory past Config.UploadMemoryBuffer.
+func (rs *RSBackupAPI) bufferUpload(part *multipart.Part) (*fileUpload, error) {
+	var buf bytes.Buffer
+	n, err := io.CopyN(&buf, part, int64(rs.Config.UploadMemoryBuffer)+1)
+	if err == io.EOF {
+		return &fileUpload{src: bytes.NewReader(buf.Bytes()), size: n}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	// The server points the temporary directory at the staging directory.
+	spill, err := ioutil.TempFile("", "multipart-")
+	if err != nil {
+		return nil, err
+	}
+	cleanup := func() {
+		spill.Close()
+		os.Remove(spill.Name())
+	}
+	size, err := io.Copy(spill, io.MultiReader(&buf, part))
+	if err == nil {
+		_, err = spill.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		cleanup()
+		return nil, err
+	}
+	return &fileUpload{src: spill, size: size, cleanup: cleanup}, nil
+}
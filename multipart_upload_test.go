@@ -0,0 +1,72 @@
+package rsbackup
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func TestStreamedUpload(t *testing.T) {
+	config := &Config{BackupRoot: createTMPDir(t, "rsbackup"), DataShards: 2, ParityShards: 1, UploadMemoryBuffer: 4, MaxUploadSize: 1024}
+	fm := &RSFileManager{Config: config}
+	api := &RSBackupAPI{Config: config, RsFileMan: fm}
+	type part struct{ name, value string }
+	submit := func(parts ...part) *httptest.ResponseRecorder {
+		body := new(bytes.Buffer)
+		mw := multipart.NewWriter(body)
+		for _, p := range parts {
+			if p.name == "file" {
+				fw, _ := mw.CreateFormFile("file", "upload")
+				fw.Write([]byte(p.value))
+			} else {
+				mw.WriteField(p.name, p.value)
+			}
+		}
+		mw.Close()
+		req := httptest.NewRequest("POST", "/submit_data", body)
+		req.Header.Set("Content-Type", mw.FormDataContentType())
+		// Sent chunked, the size isn't known up front.
+		req.ContentLength = -1
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(api.submitDataHandler).ServeHTTP(rr, req)
+		return rr
+	}
+	stored := func(fname string) bool {
+		_, err := os.Stat(fm.DataPath(fname))
+		return err == nil
+	}
+
+	var tests = []struct {
+		desc     string
+		fname    string
+		parts    []part
+		expected int
+	}{
+		{"fields first", "tyger", []part{{"filename", "tyger"}, {"labels", "env=prod"}, {"file", "burning bright"}}, http.StatusOK},
+		{"file first", "lamb", []part{{"file", "little lamb"}, {"filename", "lamb"}}, http.StatusOK},
+		{"field after streamed file", "fly", []part{{"filename", "fly"}, {"file", "little fly"}, {"immutable", "true"}}, http.StatusBadRequest},
+		{"no file", "rose", []part{{"filename", "rose"}}, http.StatusBadRequest},
+		{"too large", "worm", []part{{"filename", "worm"}, {"file", string(make([]byte, 2048))}}, http.StatusRequestEntityTooLarge},
+		{"too large buffered", "bird", []part{{"file", string(make([]byte, 2048))}, {"filename", "bird"}}, http.StatusRequestEntityTooLarge},
+	}
+	for _, tt := range tests {
+		rr := submit(tt.parts...)
+		if rr.Code != tt.expected {
+			t.Errorf("%s: got status code %d, expected %d", tt.desc, rr.Code, tt.expected)
+		}
+		if stored(tt.fname) != (tt.expected == http.StatusOK) {
+			t.Errorf("%s: got %s stored: %t", tt.desc, tt.fname, stored(tt.fname))
+		}
+	}
+	for _, fname := range []string{"tyger", "lamb"} {
+		if health, _, _, err := fm.CheckData(fname); err != nil || !health {
+			t.Errorf("Got health %t (error: %v) of %s", health, err, fname)
+		}
+	}
+	if extras, err := fm.ReadExtras(fm.DataPath("tyger")); err != nil || extras.Labels["env"] != "prod" {
+		t.Errorf("Got labels %v (error: %v) of a streamed file", extras.Labels, err)
+	}
+}
@@ -0,0 +1,62 @@
+package rsbackup
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+const (
+	contentTypeJSON    = "application/json"
+	contentTypeMsgpack = "application/x-msgpack"
+)
+
+// responseType returns the content type to answer r with: msgpack if its
+// Accept header prefers it, json otherwise. Types listed with the same
+// quality go in the order they're listed.
+func responseType(r *http.Request) string {
+	best, bestQuality := contentTypeJSON, 0.0
+	for _, accepted := range strings.Split(r.Header.Get("Accept"), ",") {
+		params := strings.Split(accepted, ";")
+		quality := 1.0
+		for _, param := range params[1:] {
+			kv := strings.SplitN(strings.TrimSpace(param), "=", 2)
+			if len(kv) != 2 || kv[0] != "q" {
+				continue
+			}
+			if q, err := strconv.ParseFloat(kv[1], 64); err == nil {
+				quality = q
+			}
+		}
+		var ctype string
+		switch strings.ToLower(strings.TrimSpace(params[0])) {
+		case contentTypeMsgpack, "application/msgpack", "application/vnd.msgpack":
+			ctype = contentTypeMsgpack
+		case contentTypeJSON, "application/*", "*/*":
+			ctype = contentTypeJSON
+		default:
+			continue
+		}
+		if quality > bestQuality {
+			best, bestQuality = ctype, quality
+		}
+	}
+	return best
+}
+
+// writeResponse encodes rsp as r accepts it, see responseType. Fields are
+// named after their json tags either way.
+func writeResponse(w http.ResponseWriter, r *http.Request, rsp interface{}) error {
+	ctype := responseType(r)
+	w.Header().Set("Content-Type", ctype)
+	w.Header().Add("Vary", "Accept")
+	if ctype == contentTypeMsgpack {
+		enc := msgpack.NewEncoder(w)
+		enc.SetCustomStructTag("json")
+		return enc.Encode(rsp)
+	}
+	return json.NewEncoder(w).Encode(rsp)
+}
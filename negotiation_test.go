@@ -0,0 +1,88 @@
+package rsbackup
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+func TestResponseType(t *testing.T) {
+	var tests = []struct {
+		accept   string
+		expected string
+	}{
+		{"", contentTypeJSON},
+		{"application/json", contentTypeJSON},
+		{"application/x-msgpack", contentTypeMsgpack},
+		{"application/msgpack", contentTypeMsgpack},
+		{"text/html, */*", contentTypeJSON},
+		{"application/x-msgpack, application/json", contentTypeMsgpack},
+		{"application/json, application/x-msgpack", contentTypeJSON},
+		{"application/json;q=0.5, application/x-msgpack", contentTypeMsgpack},
+		{"application/x-msgpack;q=0", contentTypeJSON},
+		{"APPLICATION/X-MSGPACK ; q=0.9", contentTypeMsgpack},
+		{"text/plain", contentTypeJSON},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "/list_data", nil)
+		req.Header.Set("Accept", tt.accept)
+		if ctype := responseType(req); ctype != tt.expected {
+			t.Errorf("Got %s for Accept '%s', expected %s", ctype, tt.accept, tt.expected)
+		}
+	}
+}
+
+func TestMsgpackResponses(t *testing.T) {
+	config := &Config{BackupRoot: "testdata"}
+	api := &RSBackupAPI{Config: config, RsFileMan: &RSFileManager{Config: config}}
+	get := func(h http.HandlerFunc, url, accept string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", url, nil)
+		req.Header.Set("Accept", accept)
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("Got status code %d from %s", rr.Code, url)
+		}
+		return rr
+	}
+	decode := func(rr *httptest.ResponseRecorder, v interface{}) {
+		t.Helper()
+		if ctype := rr.Header().Get("Content-Type"); ctype != contentTypeMsgpack {
+			t.Fatalf("Got content type %s", ctype)
+		}
+		dec := msgpack.NewDecoder(rr.Body)
+		dec.SetCustomStructTag("json")
+		if err := dec.Decode(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var listed, expected listDataRsp
+	decode(get(api.listDataHandler, "/list_data?extended=true", contentTypeMsgpack), &listed)
+	json.NewDecoder(get(api.listDataHandler, "/list_data?extended=true", "").Body).Decode(&expected)
+	if len(listed.Files) == 0 || !reflect.DeepEqual(listed, expected) {
+		t.Errorf("Got listing %+v, expected %+v", listed, expected)
+	}
+
+	var checked checkDataRsp
+	rr := get(api.checkDataHandler, "/check_data/tyger", contentTypeMsgpack)
+	if rr.Header().Get("Vary") != "Accept" {
+		t.Errorf("Got Vary header '%s'", rr.Header().Get("Vary"))
+	}
+	decode(rr, &checked)
+	if checked.Name != "tyger" || !checked.Health || len(checked.Hashes) != 3 {
+		t.Errorf("Got check %+v", checked)
+	}
+	// Field names are those of the json responses.
+	var raw map[string]interface{}
+	if err := msgpack.Unmarshal(get(api.checkDataHandler, "/check_data/tyger", contentTypeMsgpack).Body.Bytes(), &raw); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := raw["hashes"]; !ok {
+		t.Errorf("Got fields %v", raw)
+	}
+}
@@ -0,0 +1,167 @@
+package rsbackup
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+
+	log "github.com/sirupsen/logrus"
+	bolt "go.etcd.io/bbolt"
+)
+
+var indexIDsBucket = []byte("ids")
+
+var objectIDPattern = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+
+// errStopWalk ends a WalkData early without an error.
+var errStopWalk = errors.New("Walk stopped")
+
+// newObjectID returns a random (version 4) UUID.
+func newObjectID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
+
+// putID maps the ID of entry to its name, dropping the ID of the entry it
+// replaces.
+func putID(tx *bolt.Tx, entry IndexEntry, replaced *IndexEntry) error {
+	ids, err := tx.CreateBucketIfNotExists(indexIDsBucket)
+	if err != nil {
+		return err
+	}
+	if replaced != nil && replaced.ID != "" && replaced.ID != entry.ID {
+		if err := ids.Delete([]byte(replaced.ID)); err != nil {
+			return err
+		}
+	}
+	if entry.ID == "" {
+		return nil
+	}
+	return ids.Put([]byte(entry.ID), []byte(entry.Name))
+}
+
+// NameOf returns the name of the file with id, if it's indexed.
+func (x *MetadataIndex) NameOf(id string) (string, bool) {
+	var name string
+	x.db.View(func(tx *bolt.Tx) error {
+		ids := tx.Bucket(indexIDsBucket)
+		if ids == nil {
+			return nil
+		}
+		name = string(ids.Get([]byte(id)))
+		return nil
+	})
+	if name == "" {
+		return "", false
+	}
+	// Entries are the reference, a stale mapping doesn't count.
+	if entry, ok := x.Get(name); !ok || entry.ID != id {
+		return "", false
+	}
+	return name, true
+}
+
+// NameOfID returns the name of the file with id. Without the index, every
+// metadata file may be read to find it.
+func (r *RSFileManager) NameOfID(id string) (string, error) {
+	if r.Index != nil {
+		if name, ok := r.Index.NameOf(id); ok {
+			return name, nil
+		}
+		return "", os.ErrNotExist
+	}
+	found := ""
+	err := r.WalkData(func(name string) error {
+		if extras, err := r.ReadExtras(r.DataPath(name)); err == nil && extras.ID == id {
+			found = name
+			return errStopWalk
+		}
+		return nil
+	})
+	if err != nil && err != errStopWalk {
+		return "", err
+	}
+	if found == "" {
+		return "", os.ErrNotExist
+	}
+	return found, nil
+}
+
+// objectID returns the ID of fname, empty for files stored before files
+// had one.
+func (r *RSFileManager) objectID(fname string) string {
+	if r.Index != nil {
+		entry, _ := r.Index.Get(fname)
+		return entry.ID
+	}
+	extras, err := r.ReadExtras(r.DataPath(fname))
+	if err != nil {
+		return ""
+	}
+	return extras.ID
+}
+
+// identifyStaged gives the file staged at fpath an ID, unless it has one
+// no other file has, as a bundle exported from another server does.
+func (r *RSFileManager) identifyStaged(fpath string) error {
+	staged := &RSFileManager{Config: &Config{BackupRoot: path.Dir(fpath)}}
+	md, err := staged.readMetadataFile(fpath + ".md")
+	if err != nil {
+		return err
+	}
+	if md.ID != "" && objectIDPattern.MatchString(md.ID) {
+		if _, err := r.NameOfID(md.ID); os.IsNotExist(err) {
+			return nil
+		}
+		log.Infof("ID %s of staged %s is taken, giving it a new one", md.ID, fpath)
+	}
+	md.ID, err = newObjectID()
+	if err == nil {
+		err = sealMetadata(md)
+	}
+	if err != nil {
+		return err
+	}
+	return writeJSONState(fpath+".md", md)
+}
+
+// byID serves h for the file whose ID is the last segment of the URL, as
+// if its name was.
+func (rs *RSBackupAPI) byID(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := getURLParam(r.URL)
+		if err == nil && !objectIDPattern.MatchString(id) {
+			err = fmt.Errorf("Bad object ID '%s'", id)
+		}
+		if err != nil {
+			rs.Errorf(r, "%s", err)
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+		fname, err := rs.RsFileMan.NameOfID(id)
+		if os.IsNotExist(err) {
+			rs.Errorf(r, "Object %s not found", id)
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			rs.Errorf(r, "Unable to look up object %s: %s", id, err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		byName := r.Clone(r.Context())
+		byName.URL.Path = path.Dir(r.URL.Path) + "/" + fname
+		byName.URL.RawPath = path.Dir(r.URL.EscapedPath()) + "/" + url.PathEscape(fname)
+		h(w, byName)
+	}
+}
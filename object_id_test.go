@@ -0,0 +1,178 @@
+package rsbackup
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"regexp"
+	"testing"
+)
+
+// objectIDField matches the random IDs in responses.
+var objectIDField = regexp.MustCompile(`"id":"[0-9a-f-]{36}"`)
+
+func TestNewObjectID(t *testing.T) {
+	seen := make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		id, err := newObjectID()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !objectIDPattern.MatchString(id) || seen[id] {
+			t.Fatalf("Got ID %s", id)
+		}
+		seen[id] = true
+	}
+}
+
+func TestObjectIDs(t *testing.T) {
+	for _, indexed := range []bool{false, true} {
+		t.Run(fmt.Sprintf("indexed=%t", indexed), func(t *testing.T) {
+			config := &Config{BackupRoot: createTMPDir(t, "rsbackup"), DataShards: 2, ParityShards: 1}
+			fm := &RSFileManager{Config: config}
+			if indexed {
+				index, err := OpenMetadataIndex(path.Join(createTMPDir(t, "rsbackup-state"), "index.db"))
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer index.Close()
+				fm.Index = index
+			}
+			api := &RSBackupAPI{Config: config, RsFileMan: fm}
+			body := new(bytes.Buffer)
+			mw := multipart.NewWriter(body)
+			fw, _ := mw.CreateFormFile("file", "tyger")
+			fw.Write([]byte("burning bright"))
+			mw.WriteField("filename", "tyger")
+			mw.Close()
+			req := httptest.NewRequest("POST", "/submit_data", body)
+			req.Header.Set("Content-Type", mw.FormDataContentType())
+			rr := httptest.NewRecorder()
+			http.HandlerFunc(api.submitDataHandler).ServeHTTP(rr, req)
+			var submitted submitDataRsp
+			json.NewDecoder(rr.Body).Decode(&submitted)
+			if rr.Code != http.StatusOK || !objectIDPattern.MatchString(submitted.ID) {
+				t.Fatalf("Got status code %d and ID '%s'", rr.Code, submitted.ID)
+			}
+			id := submitted.ID
+
+			// The ID stays with the file when it's renamed.
+			if err := fm.Rename("tyger", "lamb"); err != nil {
+				t.Fatal(err)
+			}
+			byID := func(h http.HandlerFunc, url string) *httptest.ResponseRecorder {
+				rr := httptest.NewRecorder()
+				api.byID(h).ServeHTTP(rr, httptest.NewRequest("GET", url, nil))
+				return rr
+			}
+			rr = byID(api.checkDataHandler, "/check_object/"+id)
+			var checked checkDataRsp
+			json.NewDecoder(rr.Body).Decode(&checked)
+			if rr.Code != http.StatusOK || checked.Name != "lamb" || checked.ID != id || !checked.Health {
+				t.Errorf("Got status code %d and check %+v", rr.Code, checked)
+			}
+			rr = byID(api.retrieveDataHandler, "/retrieve_object/"+id)
+			if rr.Code != http.StatusOK || rr.Body.String() != "burning bright" {
+				t.Errorf("Got status code %d and contents %q", rr.Code, rr.Body.String())
+			}
+			if err := ioutil.WriteFile(fm.DataPath("lamb")+".parity.1", []byte("fearful"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if rr := byID(api.repairDataHandler, "/repair_object/"+id); rr.Code != http.StatusOK {
+				t.Errorf("Got status code %d repairing", rr.Code)
+			}
+			if health, _, _, err := fm.CheckData("lamb"); err != nil || !health {
+				t.Errorf("Got health %t (error: %v) after repair", health, err)
+			}
+			if info := api.objectInfo("lamb"); info.ID != id {
+				t.Errorf("Got listed ID '%s'", info.ID)
+			}
+
+			other, _ := newObjectID()
+			var tests = []struct {
+				url      string
+				expected int
+			}{
+				{"/check_object/" + other, http.StatusNotFound},
+				{"/check_object/lamb", http.StatusBadRequest},
+				{"/check_object/", http.StatusBadRequest},
+			}
+			for _, tt := range tests {
+				if rr := byID(api.checkDataHandler, tt.url); rr.Code != tt.expected {
+					t.Errorf("Got status code %d for %s, expected %d", rr.Code, tt.url, tt.expected)
+				}
+			}
+			if err := fm.Delete("lamb", false, false); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := fm.NameOfID(id); !os.IsNotExist(err) {
+				t.Errorf("Got error %v looking up a deleted file", err)
+			}
+		})
+	}
+}
+
+func TestImportedObjectIDs(t *testing.T) {
+	index, err := OpenMetadataIndex(path.Join(createTMPDir(t, "rsbackup-state"), "index.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	config := &Config{BackupRoot: createTMPDir(t, "rsbackup"), DataShards: 2, ParityShards: 1}
+	fm := &RSFileManager{Config: config, Index: index}
+	api := &RSBackupAPI{Config: config, RsFileMan: fm}
+	fpath := fm.DataPath("tyger")
+	if err := ioutil.WriteFile(fpath, []byte("what immortal hand or eye"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	md, err := api.generateParity(fm.storage(), fpath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, _ := newObjectID()
+	if err := fm.WriteMetadata("tyger", md, MetadataExtras{ID: id}); err != nil {
+		t.Fatal(err)
+	}
+	var bundle bytes.Buffer
+	if err := fm.WriteBundle(&bundle, "tyger"); err != nil {
+		t.Fatal(err)
+	}
+	importAs := func(fname string) string {
+		t.Helper()
+		imported, _, err := fm.ImportBundle(bytes.NewReader(bundle.Bytes()), "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := fm.Rename(imported, fname); err != nil {
+			t.Fatal(err)
+		}
+		return fm.objectID(fname)
+	}
+
+	// A bundle keeps its ID on a server without it, the ID of a file
+	// imported twice is taken the second time.
+	if err := fm.Delete("tyger", false, false); err != nil {
+		t.Fatal(err)
+	}
+	if got := importAs("lamb"); got != id {
+		t.Errorf("Got ID %s, expected the bundle's %s", got, id)
+	}
+	if got := importAs("fly"); got == id || !objectIDPattern.MatchString(got) {
+		t.Errorf("Got ID %s importing the bundle again", got)
+	}
+
+	// Metadata rebuilt from the shards keeps the ID the index has.
+	removeMetadata(fm.storage(), fm.DataPath("lamb"))
+	if _, _, err := fm.RebuildMetadata("lamb"); err != nil {
+		t.Fatal(err)
+	}
+	if extras, err := fm.ReadExtras(fm.DataPath("lamb")); err != nil || extras.ID != id {
+		t.Errorf("Got ID %s (error: %v) after rebuilding metadata", extras.ID, err)
+	}
+}
@@ -0,0 +1,252 @@
+package rsbackup
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// objectStore is an object storage service, like GCS or B2, that an
+// objectBackend keeps files in. Errors for missing or existing objects
+// must satisfy os.IsNotExist and os.IsExist.
+type objectStore interface {
+	// stat returns the size of the object name and when it was stored.
+	stat(name string) (int64, time.Time, error)
+	// download copies the object name to w. It returns the version
+	// downloaded and when it was stored.
+	download(name string, w io.Writer) (string, time.Time, error)
+	// upload stores size bytes of src as the object name, provided its
+	// current version is still version, or for "" that there is none.
+	upload(name string, src io.ReaderAt, size int64, version string) error
+	// list returns up to limit, 0 for all, names of the objects and
+	// prefixes directly below prefix, with prefix stripped.
+	list(prefix string, limit int) ([]string, error)
+	remove(name string) error
+	copy(src, dst string) error
+}
+
+// objectBackend stores files as objects named after their path below
+// BackupRoot, under a prefix. Files opened are downloaded to a spool
+// directory in the server state, and written ones uploaded when they are
+// closed.
+type objectBackend struct {
+	root     string
+	prefix   string
+	spoolDir string
+	store    objectStore
+}
+
+func newObjectBackend(config *Config, prefix string, store objectStore) (*objectBackend, error) {
+	b := &objectBackend{
+		root:     path.Clean(config.BackupRoot),
+		prefix:   strings.Trim(prefix, "/"),
+		spoolDir: config.StatePath("spool"),
+		store:    store,
+	}
+	// Spooled files left by a crash were never uploaded.
+	err := os.RemoveAll(b.spoolDir)
+	if err == nil {
+		err = os.MkdirAll(b.spoolDir, 0755)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// objectName returns the name of the object stored for fpath.
+func (b *objectBackend) objectName(fpath string) (string, error) {
+	rel, err := relativePath(b.root, fpath)
+	if err != nil {
+		return "", err
+	}
+	return path.Join(b.prefix, rel), nil
+}
+
+func (b *objectBackend) List(dir string) ([]string, error) {
+	name, err := b.objectName(dir)
+	if err != nil {
+		return nil, err
+	}
+	prefix := ""
+	if name != "" {
+		prefix = name + "/"
+	}
+	names, err := b.store.list(prefix, 0)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: dir, Err: err}
+	}
+	// Directories only exist while they hold objects, except the root.
+	if len(names) == 0 && name != b.prefix {
+		return nil, &os.PathError{Op: "open", Path: dir, Err: os.ErrNotExist}
+	}
+	return names, nil
+}
+
+func (b *objectBackend) Stat(fpath string) (os.FileInfo, error) {
+	name, err := b.objectName(fpath)
+	if err != nil {
+		return nil, err
+	}
+	size, modTime, err := b.store.stat(name)
+	if err == nil {
+		return storedFileInfo{name: path.Base(fpath), size: size, modTime: modTime}, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, &os.PathError{Op: "stat", Path: fpath, Err: err}
+	}
+	if names, err := b.store.list(name+"/", 1); err == nil && len(names) > 0 {
+		return storedFileInfo{name: path.Base(fpath), dir: true}, nil
+	}
+	return nil, &os.PathError{Op: "stat", Path: fpath, Err: os.ErrNotExist}
+}
+
+func (b *objectBackend) Remove(fpath string) error {
+	name, err := b.objectName(fpath)
+	if err != nil {
+		return err
+	}
+	err = b.store.remove(name)
+	if err != nil {
+		return &os.PathError{Op: "remove", Path: fpath, Err: err}
+	}
+	return nil
+}
+
+// Rename copies from to to within the store, then removes from.
+func (b *objectBackend) Rename(from, to string) error {
+	src, err := b.objectName(from)
+	if err != nil {
+		return err
+	}
+	dst, err := b.objectName(to)
+	if err != nil {
+		return err
+	}
+	err = b.store.copy(src, dst)
+	if err == nil {
+		err = b.store.remove(src)
+	}
+	if err != nil {
+		return &os.LinkError{Op: "rename", Old: from, New: to, Err: err}
+	}
+	return nil
+}
+
+func (b *objectBackend) Open(fpath string) (StorageFile, error) {
+	return b.spool(fpath, false)
+}
+
+func (b *objectBackend) OpenWritable(fpath string) (StorageFile, error) {
+	return b.spool(fpath, true)
+}
+
+// CreateExclusive checks fpath doesn't exist yet. The upload on close
+// only succeeds if that is still the case.
+func (b *objectBackend) CreateExclusive(fpath string) (StorageFile, error) {
+	name, err := b.objectName(fpath)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := b.Stat(fpath); err == nil {
+		return nil, &os.PathError{Op: "open", Path: fpath, Err: os.ErrExist}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	spool, err := ioutil.TempFile(b.spoolDir, "object")
+	if err != nil {
+		return nil, err
+	}
+	return &objectFile{File: spool, backend: b, fpath: fpath, name: name, modTime: time.Now(), writable: true, dirty: true}, nil
+}
+
+// spool downloads the object of fpath into a temporary file.
+func (b *objectBackend) spool(fpath string, writable bool) (StorageFile, error) {
+	name, err := b.objectName(fpath)
+	if err != nil {
+		return nil, err
+	}
+	spool, err := ioutil.TempFile(b.spoolDir, "object")
+	if err != nil {
+		return nil, err
+	}
+	f := &objectFile{File: spool, backend: b, fpath: fpath, name: name, writable: writable}
+	f.version, f.modTime, err = b.store.download(name, spool)
+	if err == nil {
+		_, err = spool.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		f.discard()
+		return nil, &os.PathError{Op: "open", Path: fpath, Err: err}
+	}
+	return f, nil
+}
+
+// objectFile is an objectBackend file spooled to local disk.
+type objectFile struct {
+	*os.File
+	backend *objectBackend
+	fpath   string
+	name    string
+	// version is the one downloaded, uploads only replace it. "" means
+	// the object must not exist.
+	version  string
+	modTime  time.Time
+	writable bool
+	dirty    bool
+	closed   bool
+}
+
+func (f *objectFile) Write(p []byte) (int, error) {
+	if !f.writable {
+		return 0, &os.PathError{Op: "write", Path: f.fpath, Err: os.ErrPermission}
+	}
+	f.dirty = true
+	return f.File.Write(p)
+}
+
+func (f *objectFile) Truncate(size int64) error {
+	if !f.writable {
+		return &os.PathError{Op: "truncate", Path: f.fpath, Err: os.ErrPermission}
+	}
+	f.dirty = true
+	return f.File.Truncate(size)
+}
+
+func (f *objectFile) Stat() (os.FileInfo, error) {
+	stat, err := f.File.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return storedFileInfo{name: path.Base(f.fpath), size: stat.Size(), modTime: f.modTime}, nil
+}
+
+func (f *objectFile) discard() {
+	f.File.Close()
+	os.Remove(f.File.Name())
+}
+
+// Close uploads the file if it was written to, unless the object was
+// changed since it was opened.
+func (f *objectFile) Close() error {
+	if f.closed {
+		return nil
+	}
+	f.closed = true
+	defer f.discard()
+	if !f.dirty {
+		return nil
+	}
+	stat, err := f.File.Stat()
+	if err != nil {
+		return err
+	}
+	err = f.backend.store.upload(f.name, f.File, stat.Size(), f.version)
+	if err != nil {
+		return &os.PathError{Op: "upload", Path: f.fpath, Err: err}
+	}
+	return nil
+}
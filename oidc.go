@@ -0,0 +1,368 @@
+package rsbackup
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// jwksMaxAge is how long fetched signing keys are used before they are
+	// fetched again.
+	jwksMaxAge = time.Hour
+	// jwksMinRefresh limits refetches triggered by tokens signed with an
+	// unknown key.
+	jwksMinRefresh = time.Minute
+	// jwtLeeway is the clock skew tolerated when checking exp and nbf.
+	jwtLeeway = time.Minute
+)
+
+var errInvalidJWT = errors.New("Invalid JWT")
+
+// JWTValidator authenticates requests with JWTs issued by an OpenID Connect
+// provider, mapping roles found in a claim to scopes.
+type JWTValidator struct {
+	issuer     string
+	audience   string
+	roleClaim  string
+	adminRoles []string
+	userRoles  []string
+	roleScopes map[string][]string
+	jwksURL    string
+	client     *http.Client
+
+	mu      sync.Mutex
+	keys    map[string]crypto.PublicKey
+	fetched time.Time
+}
+
+// NewJWTValidator sets up validation of tokens issued by config.OIDCIssuer.
+// Without an explicit OIDCJWKSURL the key set is discovered through the
+// issuer's openid-configuration document.
+func NewJWTValidator(config *Config) (*JWTValidator, error) {
+	if config.OIDCAudience == "" {
+		return nil, fmt.Errorf("OIDC authentication needs OIDCAudience")
+	}
+	v := &JWTValidator{
+		issuer:     config.OIDCIssuer,
+		audience:   config.OIDCAudience,
+		roleClaim:  config.OIDCRoleClaim,
+		adminRoles: config.OIDCAdminRoles,
+		userRoles:  config.OIDCUserRoles,
+		roleScopes: config.OIDCRoleScopes,
+		jwksURL:    config.OIDCJWKSURL,
+		client:     &http.Client{Timeout: 30 * time.Second},
+	}
+	if v.jwksURL == "" {
+		var discovery struct {
+			JWKSURI string `json:"jwks_uri"`
+		}
+		err := v.getJSON(strings.TrimSuffix(v.issuer, "/")+"/.well-known/openid-configuration", &discovery)
+		if err != nil {
+			return nil, fmt.Errorf("OIDC discovery for '%s' failed: %s", v.issuer, err)
+		}
+		if discovery.JWKSURI == "" {
+			return nil, fmt.Errorf("OIDC discovery for '%s' returned no jwks_uri", v.issuer)
+		}
+		v.jwksURL = discovery.JWKSURI
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	err := v.fetchKeys()
+	if err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+func (v *JWTValidator) getJSON(url string, dst interface{}) error {
+	rsp, err := v.client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s returned %s", url, rsp.Status)
+	}
+	return json.NewDecoder(rsp.Body).Decode(dst)
+}
+
+type jsonWebKey struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (k *jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	decode := func(s string) (*big.Int, error) {
+		b, err := base64.RawURLEncoding.DecodeString(s)
+		if err != nil {
+			return nil, err
+		}
+		return new(big.Int).SetBytes(b), nil
+	}
+	switch k.Kty {
+	case "RSA":
+		n, err := decode(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decode(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		curves := map[string]elliptic.Curve{
+			"P-256": elliptic.P256(),
+			"P-384": elliptic.P384(),
+			"P-521": elliptic.P521(),
+		}
+		curve, ok := curves[k.Crv]
+		if !ok {
+			return nil, fmt.Errorf("Unsupported curve '%s'", k.Crv)
+		}
+		x, err := decode(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decode(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	default:
+		return nil, fmt.Errorf("Unsupported key type '%s'", k.Kty)
+	}
+}
+
+// fetchKeys must be called with v.mu held.
+func (v *JWTValidator) fetchKeys() error {
+	var jwks struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	v.fetched = time.Now()
+	err := v.getJSON(v.jwksURL, &jwks)
+	if err != nil {
+		return fmt.Errorf("Cannot fetch JWKS: %s", err)
+	}
+	keys := make(map[string]crypto.PublicKey)
+	for _, k := range jwks.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			log.Warnf("Skipping JWKS key '%s': %s", k.Kid, err)
+			continue
+		}
+		keys[k.Kid] = key
+	}
+	v.keys = keys
+	log.Debugf("Fetched %d signing keys from %s", len(keys), v.jwksURL)
+	return nil
+}
+
+func (v *JWTValidator) key(kid string) (crypto.PublicKey, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	age := time.Since(v.fetched)
+	key, ok := v.keys[kid]
+	if age > jwksMaxAge || (!ok && age > jwksMinRefresh) {
+		err := v.fetchKeys()
+		if err != nil {
+			if ok {
+				// Keep using the known key while the provider is unreachable.
+				log.Warn(err)
+				return key, nil
+			}
+			return nil, err
+		}
+		key, ok = v.keys[kid]
+	}
+	if !ok {
+		return nil, fmt.Errorf("%w: unknown key id '%s'", errInvalidJWT, kid)
+	}
+	return key, nil
+}
+
+// verifySignature checks sig over signed made by key with the JWS
+// algorithm alg.
+func verifySignature(alg string, key crypto.PublicKey, signed, sig []byte) error {
+	hashes := map[string]crypto.Hash{"256": crypto.SHA256, "384": crypto.SHA384, "512": crypto.SHA512}
+	if len(alg) != 5 || hashes[alg[2:]] == 0 {
+		return fmt.Errorf("%w: unsupported algorithm '%s'", errInvalidJWT, alg)
+	}
+	hash := hashes[alg[2:]]
+	h := hash.New()
+	h.Write(signed)
+	digest := h.Sum(nil)
+	switch pub := key.(type) {
+	case *rsa.PublicKey:
+		if alg[:2] != "RS" {
+			break
+		}
+		if rsa.VerifyPKCS1v15(pub, hash, digest, sig) != nil {
+			return fmt.Errorf("%w: bad signature", errInvalidJWT)
+		}
+		return nil
+	case *ecdsa.PublicKey:
+		if alg[:2] != "ES" {
+			break
+		}
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		if len(sig) != 2*size {
+			return fmt.Errorf("%w: bad signature", errInvalidJWT)
+		}
+		r := new(big.Int).SetBytes(sig[:size])
+		s := new(big.Int).SetBytes(sig[size:])
+		if !ecdsa.Verify(pub, digest, r, s) {
+			return fmt.Errorf("%w: bad signature", errInvalidJWT)
+		}
+		return nil
+	}
+	return fmt.Errorf("%w: algorithm '%s' doesn't match key", errInvalidJWT, alg)
+}
+
+// Validate checks the signature and claims of a JWT and returns the token
+// it maps to, named after the subject.
+func (v *JWTValidator) Validate(raw string) (APIToken, error) {
+	parts := strings.Split(raw, ".")
+	if len(parts) != 3 {
+		return APIToken{}, fmt.Errorf("%w: not a JWS compact serialization", errInvalidJWT)
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	err := decodeJWTPart(parts[0], &header)
+	if err != nil {
+		return APIToken{}, err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return APIToken{}, fmt.Errorf("%w: %s", errInvalidJWT, err)
+	}
+	key, err := v.key(header.Kid)
+	if err != nil {
+		return APIToken{}, err
+	}
+	err = verifySignature(header.Alg, key, []byte(parts[0]+"."+parts[1]), sig)
+	if err != nil {
+		return APIToken{}, err
+	}
+
+	var claims map[string]interface{}
+	err = decodeJWTPart(parts[1], &claims)
+	if err != nil {
+		return APIToken{}, err
+	}
+	if iss, _ := claims["iss"].(string); iss != v.issuer {
+		return APIToken{}, fmt.Errorf("%w: issuer '%s' not accepted", errInvalidJWT, iss)
+	}
+	// Providers like Keycloak name the client in azp rather than aud.
+	azp, _ := claims["azp"].(string)
+	if !containsString(claimStrings(claims["aud"]), v.audience) && azp != v.audience {
+		return APIToken{}, fmt.Errorf("%w: not issued for '%s'", errInvalidJWT, v.audience)
+	}
+	now := time.Now()
+	exp, ok := claims["exp"].(float64)
+	if !ok || now.After(time.Unix(int64(exp), 0).Add(jwtLeeway)) {
+		return APIToken{}, fmt.Errorf("%w: expired", errInvalidJWT)
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(jwtLeeway).Before(time.Unix(int64(nbf), 0)) {
+		return APIToken{}, fmt.Errorf("%w: not valid yet", errInvalidJWT)
+	}
+	sub, _ := claims["sub"].(string)
+	if sub == "" {
+		return APIToken{}, fmt.Errorf("%w: missing subject", errInvalidJWT)
+	}
+
+	token := APIToken{Name: "oidc:" + sub}
+	for _, role := range claimStrings(lookupClaim(claims, v.roleClaim)) {
+		if containsString(v.adminRoles, role) {
+			token.grant(ScopeAdmin)
+		}
+		if containsString(v.userRoles, role) {
+			token.grant(dataScopes...)
+		}
+		token.grant(v.roleScopes[role]...)
+	}
+	if len(token.Scopes) == 0 {
+		return APIToken{}, fmt.Errorf("%w: '%s' has no role granting access", errInvalidJWT, sub)
+	}
+	return token, nil
+}
+
+func decodeJWTPart(part string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return fmt.Errorf("%w: %s", errInvalidJWT, err)
+	}
+	err = json.Unmarshal(b, v)
+	if err != nil {
+		return fmt.Errorf("%w: %s", errInvalidJWT, err)
+	}
+	return nil
+}
+
+// lookupClaim returns the claim at a dotted path like "realm_access.roles".
+func lookupClaim(claims map[string]interface{}, name string) interface{} {
+	if name == "" {
+		return nil
+	}
+	var value interface{} = claims
+	for _, key := range strings.Split(name, ".") {
+		obj, ok := value.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		value = obj[key]
+	}
+	return value
+}
+
+// claimStrings returns a claim that is either a string or a list of them.
+func claimStrings(claim interface{}) []string {
+	switch c := claim.(type) {
+	case string:
+		return []string{c}
+	case []interface{}:
+		var values []string
+		for _, v := range c {
+			if s, ok := v.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	}
+	return nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,210 @@
+package rsbackup
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type testJWKS struct {
+	keys map[string]crypto.Signer
+}
+
+func (j *testJWKS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	b64 := base64.RawURLEncoding.EncodeToString
+	switch r.URL.Path {
+	case "/.well-known/openid-configuration":
+		json.NewEncoder(w).Encode(map[string]string{"jwks_uri": "http://" + r.Host + "/jwks"})
+	case "/jwks":
+		var keys []jsonWebKey
+		for kid, key := range j.keys {
+			switch pub := key.Public().(type) {
+			case *rsa.PublicKey:
+				keys = append(keys, jsonWebKey{Kid: kid, Kty: "RSA", N: b64(pub.N.Bytes()), E: b64(big.NewInt(int64(pub.E)).Bytes())})
+			case *ecdsa.PublicKey:
+				keys = append(keys, jsonWebKey{Kid: kid, Kty: "EC", Crv: "P-256", X: b64(pub.X.Bytes()), Y: b64(pub.Y.Bytes())})
+			}
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": keys})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func signJWT(t *testing.T, key crypto.Signer, kid string, claims map[string]interface{}) string {
+	alg := "RS256"
+	if _, ok := key.(*ecdsa.PrivateKey); ok {
+		alg = "ES256"
+	}
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+	var sig []byte
+	var err error
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		sig, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest[:])
+	case *ecdsa.PrivateKey:
+		var r, s *big.Int
+		r, s, err = ecdsa.Sign(rand.Reader, k, digest[:])
+		sig = make([]byte, 64)
+		r.FillBytes(sig[:32])
+		s.FillBytes(sig[32:])
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func TestJWTValidator(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwks := &testJWKS{keys: map[string]crypto.Signer{"rsa": rsaKey, "ec": ecKey}}
+	provider := httptest.NewServer(jwks)
+	defer provider.Close()
+
+	validator, err := NewJWTValidator(&Config{
+		OIDCIssuer:     provider.URL,
+		OIDCAudience:   "rsbackup",
+		OIDCRoleClaim:  "realm_access.roles",
+		OIDCAdminRoles: []string{"backup-admin"},
+		OIDCUserRoles:  []string{"backup-user"},
+		OIDCRoleScopes: map[string][]string{"backup-reader": {ScopeRead}, "backup-repairer": {ScopeRead, ScopeRepair}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	claims := func(changes map[string]interface{}) map[string]interface{} {
+		c := map[string]interface{}{
+			"iss":          provider.URL,
+			"aud":          []string{"rsbackup", "other"},
+			"sub":          "alice",
+			"exp":          time.Now().Add(time.Hour).Unix(),
+			"realm_access": map[string]interface{}{"roles": []string{"backup-user"}},
+		}
+		for k, v := range changes {
+			c[k] = v
+		}
+		return c
+	}
+	roles := func(roles ...string) map[string]interface{} {
+		return claims(map[string]interface{}{"realm_access": map[string]interface{}{"roles": roles}})
+	}
+	jwtTests := []struct {
+		name           string
+		key            crypto.Signer
+		kid            string
+		claims         map[string]interface{}
+		expectedValid  bool
+		expectedAdmin  bool
+		expectedScopes []string
+	}{
+		{"user", rsaKey, "rsa", claims(nil), true, false, dataScopes},
+		{"ecdsa", ecKey, "ec", claims(nil), true, false, dataScopes},
+		{"admin", rsaKey, "rsa", roles("backup-admin"), true, true, []string{ScopeAdmin}},
+		{"reader", rsaKey, "rsa", roles("backup-reader"), true, false, []string{ScopeRead}},
+		{"reader and repairer", rsaKey, "rsa", roles("backup-reader", "backup-repairer", "viewer"), true, false, []string{ScopeRead, ScopeRepair}},
+		{"no role", rsaKey, "rsa", roles("viewer"), false, false, nil},
+		{"no roles claim", rsaKey, "rsa", claims(map[string]interface{}{"realm_access": nil}), false, false, nil},
+		{"expired", rsaKey, "rsa", claims(map[string]interface{}{"exp": time.Now().Add(-time.Hour).Unix()}), false, false, nil},
+		{"not valid yet", rsaKey, "rsa", claims(map[string]interface{}{"nbf": time.Now().Add(time.Hour).Unix()}), false, false, nil},
+		{"wrong issuer", rsaKey, "rsa", claims(map[string]interface{}{"iss": "https://evil.example.com"}), false, false, nil},
+		{"wrong audience", rsaKey, "rsa", claims(map[string]interface{}{"aud": "other"}), false, false, nil},
+		{"wrong audience and party", rsaKey, "rsa", claims(map[string]interface{}{"aud": "other", "azp": "other"}), false, false, nil},
+		{"no audience", rsaKey, "rsa", claims(map[string]interface{}{"aud": nil}), false, false, nil},
+		{"authorized party", rsaKey, "rsa", claims(map[string]interface{}{"aud": "account", "azp": "rsbackup"}), true, false, dataScopes},
+		{"wrong key", otherKey, "rsa", claims(nil), false, false, nil},
+		{"unknown kid", otherKey, "other", claims(nil), false, false, nil},
+	}
+
+	for _, tt := range jwtTests {
+		t.Run(tt.name, func(t *testing.T) {
+			token, err := validator.Validate(signJWT(t, tt.key, tt.kid, tt.claims))
+			if (err == nil) != tt.expectedValid {
+				t.Fatalf("Got error '%v', expected valid: %t", err, tt.expectedValid)
+			}
+			if err != nil {
+				return
+			}
+			if token.Name != "oidc:alice" || token.Admin != tt.expectedAdmin || !reflect.DeepEqual(token.Scopes, tt.expectedScopes) {
+				t.Errorf("Got token %+v, expected admin: %t and scopes %v", token, tt.expectedAdmin, tt.expectedScopes)
+			}
+		})
+	}
+
+	// A key added by the provider is picked up without a restart.
+	jwks.keys["new"] = otherKey
+	validator.fetched = time.Now().Add(-2 * jwksMinRefresh)
+	_, err = validator.Validate(signJWT(t, otherKey, "new", claims(nil)))
+	if err != nil {
+		t.Errorf("Token signed with rotated key rejected: %s", err)
+	}
+}
+
+func TestAuthenticatedJWT(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	provider := httptest.NewServer(&testJWKS{keys: map[string]crypto.Signer{"k": key}})
+	defer provider.Close()
+	validator, err := NewJWTValidator(&Config{OIDCIssuer: provider.URL, OIDCJWKSURL: provider.URL + "/jwks", OIDCAudience: "rsbackup", OIDCRoleClaim: "roles", OIDCRoleScopes: map[string][]string{"reader": {ScopeRead}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	api := &RSBackupAPI{Config: &Config{}, Tokens: newTestTokenStore(t), JWTs: validator}
+	handler := api.authenticated(ScopeRead, func(w http.ResponseWriter, r *http.Request) {
+		token, _ := requestToken(r)
+		fmt.Fprintf(w, "hello %s", token.Name)
+	})
+
+	claims := map[string]interface{}{
+		"iss": provider.URL,
+		"aud": "rsbackup",
+		"sub": "bob",
+		"exp": time.Now().Add(time.Hour).Unix(),
+	}
+	// Without a mapped role a JWT grants no access.
+	noRoles := signJWT(t, key, "k", claims)
+	claims["roles"] = []string{"reader"}
+	jwt := signJWT(t, key, "k", claims)
+	for secret, expected := range map[string]string{
+		jwt:            "hello oidc:bob",
+		testUserSecret: "hello user",
+		jwt + "x":      "Unauthorized\n",
+		noRoles:        "Unauthorized\n",
+	} {
+		req := httptest.NewRequest("GET", "/list_data", nil)
+		req.Header.Set("Authorization", "Bearer "+secret)
+		rr := httptest.NewRecorder()
+		handler(rr, req)
+		if rr.Body.String() != expected {
+			t.Errorf("Got rsp body '%s', expected '%s'", rr.Body.String(), expected)
+		}
+	}
+}
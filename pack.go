@@ -0,0 +1,474 @@
+package rsbackup
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/sirmackk/rsutils"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// packDirName is the directory under BackupRoot holding the containers
+// small files are packed into.
+const packDirName = ".packs"
+
+const defaultPackSize = 8 << 20
+
+var errPackedBundle = errors.New("Packed files can't be bundled")
+
+// PackInfo is recorded in the metadata of packed files. Their data file is
+// left empty and has no parity, the stored contents are at Offset in a
+// container under packDirName instead, whose parity covers every file in
+// it.
+type PackInfo struct {
+	Container string
+	Offset    int64
+	// Size is the size of the stored contents, compressed and encrypted
+	// like the data file would have been.
+	Size int64
+	// Hash is the sha256 of the stored contents.
+	Hash string
+}
+
+type packState struct {
+	// Open is the container new files are appended to.
+	Open string
+	// Live counts the files packed into each container.
+	Live map[string]int
+}
+
+// PackStore appends small files to containers and counts the files left in
+// each, a container is removed along with the last file in it. The state
+// is persisted in a json file. Containers are written one append at a
+// time, reads only touch bytes that are never written again.
+type PackStore struct {
+	mu    sync.Mutex
+	path  string
+	state packState
+}
+
+func NewPackStore(fpath string) (*PackStore, error) {
+	s := &PackStore{path: fpath}
+	err := readJSONState(fpath, &s.state)
+	if err != nil {
+		return nil, err
+	}
+	if s.state.Live == nil {
+		s.state.Live = make(map[string]int)
+	}
+	return s, nil
+}
+
+// Files returns the number of files packed into container.
+func (s *PackStore) Files(container string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.state.Live[container]
+}
+
+// add appends data to the open container, starting a new one when the
+// container would grow past limit, and returns where data was stored.
+func (s *PackStore) add(files *RSFileManager, data []byte, limit int64) (*PackInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	storage := files.storage()
+	container := s.state.Open
+	var offset int64
+	if container != "" {
+		stat, err := storage.Stat(files.DataPath(container))
+		if err == nil {
+			offset = stat.Size()
+		} else if !os.IsNotExist(err) {
+			return nil, err
+		}
+		if err != nil || offset+int64(len(data)) > limit {
+			s.seal(files)
+			container = ""
+		}
+	}
+	if container == "" {
+		id, err := generateToken()
+		if err != nil {
+			return nil, err
+		}
+		container, offset = id[:16], 0
+	}
+	err := appendToContainer(files, container, offset, data)
+	if err != nil {
+		return nil, err
+	}
+	s.state.Open = container
+	s.state.Live[container]++
+	err = writeJSONState(s.path, s.state)
+	if err != nil {
+		// The bytes stay in the container unused.
+		s.state.Live[container]--
+		return nil, err
+	}
+	sum := sha256.Sum256(data)
+	return &PackInfo{Container: container, Offset: offset, Size: int64(len(data)), Hash: hex.EncodeToString(sum[:])}, nil
+}
+
+// seal stops appending to the open container, removing it if no file is
+// left in it.
+func (s *PackStore) seal(files *RSFileManager) {
+	container := s.state.Open
+	s.state.Open = ""
+	if s.state.Live[container] > 0 {
+		return
+	}
+	delete(s.state.Live, container)
+	removeStoredObject(files.storage(), files.DataPath(container), false)
+}
+
+// release drops a packed file whose own files were removed. With shred its
+// contents are overwritten with zeroes in the container.
+func (s *PackStore) release(files *RSFileManager, info *PackInfo, shred bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	live := s.state.Live[info.Container]
+	if live == 1 {
+		delete(s.state.Live, info.Container)
+	} else if live > 1 {
+		s.state.Live[info.Container] = live - 1
+	}
+	err := writeJSONState(s.path, s.state)
+	if err != nil {
+		return err
+	}
+	// Containers packed before the counts were may hold other files.
+	if live == 1 && info.Container != s.state.Open {
+		removeStoredObject(files.storage(), files.DataPath(info.Container), shred)
+		return nil
+	}
+	if !shred {
+		return nil
+	}
+	err = zeroContainer(files, info.Container, info.Offset, info.Size)
+	if err != nil {
+		return err
+	}
+	return protectContainer(files, info.Container)
+}
+
+// appendToContainer writes data at offset, the end of container name, and
+// protects the container again. The metadata of the container goes first,
+// so a container whose parity is stale is told apart by its missing
+// metadata.
+func appendToContainer(files *RSFileManager, name string, offset int64, data []byte) error {
+	storage := files.storage()
+	fpath := files.DataPath(name)
+	var f StorageFile
+	var err error
+	if offset == 0 {
+		f, err = storage.CreateExclusive(fpath)
+	} else {
+		err = removeMetadata(storage, fpath)
+		if err == nil {
+			f, err = storage.OpenWritable(fpath)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	_, err = f.Seek(offset, io.SeekStart)
+	if err == nil {
+		_, err = f.Write(data)
+	}
+	if err != nil {
+		f.Truncate(offset)
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		if offset == 0 {
+			storage.Remove(fpath)
+			return err
+		}
+		log.Errorf("Unable to append to container '%s': %s", name, err)
+	}
+	if protectErr := protectContainer(files, name); err == nil {
+		err = protectErr
+	}
+	return err
+}
+
+// zeroContainer overwrites size bytes at offset in container name.
+func zeroContainer(files *RSFileManager, name string, offset, size int64) error {
+	fpath := files.DataPath(name)
+	err := removeMetadata(files.storage(), fpath)
+	if err != nil {
+		return err
+	}
+	f, err := files.storage().OpenWritable(fpath)
+	if err != nil {
+		return err
+	}
+	_, err = f.Seek(offset, io.SeekStart)
+	if err == nil {
+		_, err = f.Write(make([]byte, size))
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// protectContainer replaces the parity and metadata of container name.
+func protectContainer(files *RSFileManager, name string) error {
+	storage := files.storage()
+	fpath := files.DataPath(name)
+	err := removeMetadata(storage, fpath)
+	if err != nil {
+		return err
+	}
+	suffixes := objectSuffixes(storage, fpath)
+	for _, suffix := range suffixes[1 : len(suffixes)-1] {
+		err = storage.Remove(fpath + suffix)
+		if err != nil {
+			return err
+		}
+	}
+	md, _, err := writeParity(storage, fpath, files.Config.DataShards, files.Config.ParityShards, files.Config)
+	if err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	return files.WriteMetadata(name, md, MetadataExtras{StoredAt: &now, Codec: files.Config.codecName(), Hash: files.Config.shardHashName()})
+}
+
+// packFiles returns a file manager for the containers of packed files.
+func (r *RSFileManager) packFiles() *RSFileManager {
+	config := *r.Config
+	config.BackupRoot = path.Join(r.Config.BackupRoot, packDirName)
+	return &RSFileManager{Config: &config, Storage: r.Storage}
+}
+
+// packedInfo returns where the contents of the file at fpath are packed,
+// or nil if it isn't packed or has no metadata.
+func (r *RSFileManager) packedInfo(fpath string) *PackInfo {
+	extras, err := r.ReadExtras(fpath)
+	if err != nil {
+		return nil
+	}
+	return extras.Packed
+}
+
+// packFile moves the contents of the data file at fpath into a container
+// when packing is on and they are no larger than Config.PackThreshold,
+// recording where in extras. It returns the metadata to store for the
+// file, or nil if it wasn't packed and needs parity of its own.
+func (r *RSFileManager) packFile(fpath string, extras *MetadataExtras) (*rsutils.Metadata, error) {
+	// Chunk manifests are read straight from their data file, and files
+	// of another storage class than the default, or asked to be
+	// replicated, need parity of their own.
+	if r.Packs == nil || r.Config.PackThreshold <= 0 || extras.Dedup != nil || extras.StorageClass != "" || extras.Replicas > 0 {
+		return nil, nil
+	}
+	f, err := r.storage().Open(fpath)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(f, int64(r.Config.PackThreshold)+1))
+	f.Close()
+	if err != nil || int64(len(data)) > int64(r.Config.PackThreshold) {
+		return nil, err
+	}
+	files := r.packFiles()
+	info, err := r.Packs.add(files, data, int64(r.Config.packSize()))
+	if err != nil {
+		return nil, err
+	}
+	f, err = r.storage().OpenWritable(fpath)
+	if err == nil {
+		err = f.Truncate(0)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if err != nil {
+		r.Packs.release(files, info, false)
+		return nil, err
+	}
+	extras.Packed = info
+	return &rsutils.Metadata{Size: info.Size, Hashes: []string{}, DataShards: r.Config.DataShards, ParityShards: r.Config.ParityShards}, nil
+}
+
+// openStored opens the stored contents of the file at fpath, from its data
+// file or, for packed files, from their container.
+func (r *RSFileManager) openStored(fpath string) (*io.SectionReader, io.Closer, error) {
+	if packed := r.packedInfo(fpath); packed != nil {
+		files := r.packFiles()
+		f, err := files.storage().Open(files.DataPath(packed.Container))
+		if err != nil {
+			return nil, nil, fmt.Errorf("Container %s: %w", packed.Container, err)
+		}
+		return io.NewSectionReader(f, packed.Offset, packed.Size), f, nil
+	}
+	cached, size, err := r.Cache.open(r.storage(), fpath)
+	if err != nil {
+		return nil, nil, err
+	}
+	if cached != nil {
+		return io.NewSectionReader(cached, 0, size), cached, nil
+	}
+	f, err := r.storage().Open(fpath)
+	if err != nil {
+		return nil, nil, err
+	}
+	stat, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	return io.NewSectionReader(f, 0, stat.Size()), f, nil
+}
+
+// checkPacked is CheckData for the packed file fname: it is healthy when
+// its container is and still holds its contents. With repair the container
+// is repaired first, and a missing data file recreated.
+func (r *RSFileManager) checkPacked(fname string, info *PackInfo, repair bool) (bool, string, error) {
+	if r.Packs != nil {
+		// Appends replace the parity of the open container.
+		r.Packs.mu.Lock()
+		defer r.Packs.mu.Unlock()
+	}
+	fpath := r.DataPath(fname)
+	files := r.packFiles()
+	containerPath := files.DataPath(info.Container)
+	health := true
+	if _, err := files.storage().Stat(containerPath + ".md"); os.IsNotExist(err) {
+		log.Infof("Container %s of '%s' lacks parity", info.Container, fname)
+		health = false
+		if repair {
+			err = protectContainer(files, info.Container)
+			if err != nil {
+				return false, "", err
+			}
+		}
+	}
+	if repair {
+		err := files.RepairData(info.Container)
+		if err != nil {
+			return false, "", fmt.Errorf("Container %s: %s", info.Container, err)
+		}
+		health = true
+	} else if health {
+		healthy, _, _, err := files.CheckData(info.Container)
+		if err != nil {
+			return false, "", fmt.Errorf("Container %s: %s", info.Container, err)
+		}
+		health = healthy
+	}
+	if health {
+		f, err := files.storage().Open(containerPath)
+		if err != nil {
+			return false, "", err
+		}
+		hash := sha256.New()
+		_, err = io.Copy(hash, io.NewSectionReader(f, info.Offset, info.Size))
+		f.Close()
+		if err != nil {
+			return false, "", err
+		}
+		if hex.EncodeToString(hash.Sum(nil)) != info.Hash {
+			if repair {
+				return false, "", fmt.Errorf("Contents of '%s' are lost from container %s", fname, info.Container)
+			}
+			log.Infof("Contents of '%s' don't match container %s", fname, info.Container)
+			health = false
+		}
+	}
+	stat, err := r.storage().Stat(fpath)
+	if os.IsNotExist(err) {
+		log.Infof("Data file of '%s' is missing", fname)
+		if !repair {
+			return false, "", nil
+		}
+		var f StorageFile
+		f, err = r.storage().CreateExclusive(fpath)
+		if err == nil {
+			err = f.Close()
+		}
+		if err != nil {
+			return false, "", err
+		}
+		stat, err = r.storage().Stat(fpath)
+	}
+	if err != nil {
+		return false, "", err
+	}
+	return health, stat.ModTime().Format("2006-01-02 15:04:05"), nil
+}
+
+// releasePacked drops the place in its container of a packed file whose
+// files were removed.
+func (r *RSFileManager) releasePacked(info *PackInfo, shred bool) {
+	if info == nil {
+		return
+	}
+	if r.Packs == nil {
+		log.Warnf("Packed files aren't counted, container %s stays stored", info.Container)
+		return
+	}
+	err := r.Packs.release(r.packFiles(), info, shred)
+	if err != nil {
+		log.Errorf("Unable to release packed file in %s: %s", info.Container, err)
+	}
+}
+
+// sharedContents is what a file holds in storage other files share, read
+// before its own files are removed and released after.
+type sharedContents struct {
+	manifest *chunkManifest
+	packed   *PackInfo
+}
+
+func (r *RSFileManager) readShared(fpath string) (sharedContents, error) {
+	manifest, err := r.readManifest(fpath)
+	if err != nil {
+		return sharedContents{}, err
+	}
+	return sharedContents{manifest: manifest, packed: r.packedInfo(fpath)}, nil
+}
+
+func (r *RSFileManager) releaseShared(shared sharedContents, shred bool) {
+	r.releaseChunks(shared.manifest, shred)
+	r.releasePacked(shared.packed, shred)
+}
+
+// sectionWriter passes on the size bytes written to it after the first
+// skip, discarding the rest.
+type sectionWriter struct {
+	w          io.Writer
+	skip, size int64
+}
+
+func (s *sectionWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	if s.skip >= int64(len(p)) {
+		s.skip -= int64(len(p))
+		return n, nil
+	}
+	p = p[s.skip:]
+	s.skip = 0
+	if int64(len(p)) > s.size {
+		p = p[:s.size]
+	}
+	s.size -= int64(len(p))
+	if len(p) == 0 {
+		return n, nil
+	}
+	_, err := s.w.Write(p)
+	return n, err
+}
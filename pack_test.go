@@ -0,0 +1,156 @@
+package rsbackup
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+)
+
+func newTestPackAPI(t *testing.T) *RSBackupAPI {
+	tmpDir := createTMPDir(t, "rsbackup")
+	config := &Config{BackupRoot: tmpDir, DataShards: 2, ParityShards: 1, PackThreshold: 1 << 10, PackSize: 4 << 10}
+	packs, err := NewPackStore(config.StatePath("packs.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &RSBackupAPI{Config: config, RsFileMan: &RSFileManager{Config: config, Packs: packs}}
+}
+
+func TestPackedStorage(t *testing.T) {
+	api := newTestPackAPI(t)
+	fm := api.RsFileMan
+	contents := make(map[string][]byte)
+	for i := 0; i < 10; i++ {
+		fname := fmt.Sprintf("small%d", i)
+		contents[fname] = bytes.Repeat([]byte{byte('a' + i)}, 1000+i)
+		submitData(t, api, fname, contents[fname])
+	}
+	contents["big"] = bytes.Repeat([]byte("big"), 1000)
+	submitData(t, api, "big", contents["big"])
+
+	// Four files fit a container, the big one has parity of its own.
+	containers, err := fm.packFiles().ListData()
+	if err != nil || len(containers) != 3 {
+		t.Fatalf("Got containers %v (error: %v)", containers, err)
+	}
+	for fname := range contents {
+		_, err := os.Stat(fm.DataPath(fname) + ".parity.1")
+		if packed := fname != "big"; packed != os.IsNotExist(err) {
+			t.Errorf("%s has parity: %t", fname, err == nil)
+		}
+	}
+	if names, err := fm.ListData(); err != nil || len(names) != len(contents) {
+		t.Errorf("Got names %v (error: %v)", names, err)
+	}
+
+	retrieve := func(url, rangeHeader string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", url, nil)
+		if rangeHeader != "" {
+			req.Header.Set("Range", rangeHeader)
+		}
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(api.retrieveDataHandler).ServeHTTP(rr, req)
+		return rr
+	}
+	for fname, data := range contents {
+		if rr := retrieve("/retrieve_data/"+fname, ""); rr.Code != 200 || !bytes.Equal(rr.Body.Bytes(), data) {
+			t.Errorf("Got status code %d and %d bytes retrieving %s", rr.Code, rr.Body.Len(), fname)
+		}
+		health, _, _, err := fm.CheckData(fname)
+		if err != nil || !health {
+			t.Errorf("Got health %t for %s (error: %v)", health, fname, err)
+		}
+	}
+	if rr := retrieve("/retrieve_data/small3", "bytes=10-19"); rr.Code != 206 || !bytes.Equal(rr.Body.Bytes(), contents["small3"][10:20]) {
+		t.Errorf("Got status code %d for a range, %q", rr.Code, rr.Body.Bytes())
+	}
+
+	// Damage to a container shows on the files in it, which are served
+	// reconstructed and repaired along with the container.
+	info := fm.packedInfo(fm.DataPath("small3"))
+	containerPath := fm.packFiles().DataPath(info.Container)
+	stored, err := ioutil.ReadFile(containerPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored[info.Offset+5] ^= 0xff
+	ioutil.WriteFile(containerPath, stored, 0644)
+	if health, _, _, err := fm.CheckData("small2"); err != nil || health {
+		t.Errorf("Got health %t for a file in a damaged container (error: %v)", health, err)
+	}
+	rr := retrieve("/retrieve_data/small3?verify=true", "")
+	if rr.Header().Get("Reconstructed") != "true" || !bytes.Equal(rr.Body.Bytes(), contents["small3"]) {
+		t.Errorf("Got status code %d and %q for a damaged container", rr.Code, rr.Body.Bytes())
+	}
+	if err := fm.RepairData("small2"); err != nil {
+		t.Fatal(err)
+	}
+	if health, _, _, err := fm.CheckData("small3"); err != nil || !health {
+		t.Errorf("Got health %t after repairing the container (error: %v)", health, err)
+	}
+
+	// A container goes with the last file in it.
+	if err := fm.Rename("small2", "renamed"); err != nil {
+		t.Fatal(err)
+	}
+	if rr := retrieve("/retrieve_data/renamed", ""); !bytes.Equal(rr.Body.Bytes(), contents["small2"]) {
+		t.Errorf("Got %q retrieving a renamed packed file", rr.Body.Bytes())
+	}
+	if err := fm.Delete("renamed", false, false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(containerPath); err != nil {
+		t.Errorf("Container was removed with a file left in it: %s", err)
+	}
+	for _, fname := range []string{"small0", "small1", "small3"} {
+		if err := fm.Delete(fname, false, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := os.Stat(containerPath); !os.IsNotExist(err) {
+		t.Errorf("Got %v stating an emptied container", err)
+	}
+	if files := fm.Packs.Files(info.Container); files != 0 {
+		t.Errorf("Got %d files in a removed container", files)
+	}
+}
+
+func TestPackedShred(t *testing.T) {
+	api := newTestPackAPI(t)
+	fm := api.RsFileMan
+	secret := bytes.Repeat([]byte("secret"), 100)
+	submitData(t, api, "secret", secret)
+	submitData(t, api, "public", []byte("public"))
+	info := fm.packedInfo(fm.DataPath("secret"))
+	if err := fm.Delete("secret", true, false); err != nil {
+		t.Fatal(err)
+	}
+	stored, err := ioutil.ReadFile(fm.packFiles().DataPath(info.Container))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(stored, []byte("secret")) {
+		t.Errorf("Shredded contents left in the container")
+	}
+	if health, _, _, err := fm.CheckData("public"); err != nil || !health {
+		t.Errorf("Got health %t after shredding a neighbour (error: %v)", health, err)
+	}
+}
+
+func TestPackedBundle(t *testing.T) {
+	api := newTestPackAPI(t)
+	submitTestData(t, api, "tyger")
+	if _, err := os.Stat(path.Join(api.Config.BackupRoot, packDirName)); err != nil {
+		t.Fatalf("Nothing was packed: %s", err)
+	}
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(api.exportBundleHandler).ServeHTTP(rr, httptest.NewRequest("GET", "/export_bundle/tyger", nil))
+	if rr.Code != http.StatusUnprocessableEntity {
+		t.Errorf("Got status code %d exporting a packed file", rr.Code)
+	}
+}
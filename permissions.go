@@ -0,0 +1,208 @@
+package rsbackup
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/user"
+	"path"
+	"strconv"
+)
+
+const (
+	defaultFileMode = 0644
+	defaultDirMode  = 0755
+)
+
+// Mode is a set of permission bits, written in octal like "0640" in
+// config files.
+type Mode os.FileMode
+
+// ParseMode parses octal permission bits, with or without a leading 0.
+func ParseMode(s string) (Mode, error) {
+	bits, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || bits&^0777 != 0 {
+		return 0, fmt.Errorf("Invalid mode '%s', must be octal permissions like \"0640\"", s)
+	}
+	return Mode(bits), nil
+}
+
+func (m Mode) String() string {
+	return fmt.Sprintf("%04o", uint32(m))
+}
+
+// Set implements flag.Value.
+func (m *Mode) Set(value string) error {
+	parsed, err := ParseMode(value)
+	if err != nil {
+		return err
+	}
+	*m = parsed
+	return nil
+}
+
+// UnmarshalJSON only accepts strings, as json numbers are decimal and 640
+// would silently mean 01200.
+func (m *Mode) UnmarshalJSON(data []byte) error {
+	var str string
+	if err := json.Unmarshal(data, &str); err != nil {
+		return fmt.Errorf("Invalid mode %s, must be a string like \"0640\"", data)
+	}
+	return m.Set(str)
+}
+
+func (m Mode) MarshalJSON() ([]byte, error) {
+	return json.Marshal(m.String())
+}
+
+// FileOwner is who files are handed to, -1 leaving the user or group as
+// it is.
+type FileOwner struct {
+	UID, GID int
+}
+
+// LookupOwner returns the ids of userName and groupName, which may be
+// names or numbers. Without a group the user's primary group is used, and
+// without a user only the group is set.
+func LookupOwner(userName, groupName string) (FileOwner, error) {
+	owner := FileOwner{UID: -1, GID: -1}
+	gid := ""
+	if userName != "" {
+		u, err := user.Lookup(userName)
+		if err != nil {
+			u, err = user.LookupId(userName)
+		}
+		if err != nil {
+			return owner, fmt.Errorf("Unknown user '%s'", userName)
+		}
+		owner.UID, err = strconv.Atoi(u.Uid)
+		if err != nil {
+			return owner, err
+		}
+		gid = u.Gid
+	}
+	if groupName != "" {
+		g, err := user.LookupGroup(groupName)
+		if err != nil {
+			g, err = user.LookupGroupId(groupName)
+		}
+		if err != nil {
+			return owner, fmt.Errorf("Unknown group '%s'", groupName)
+		}
+		gid = g.Gid
+	}
+	if gid != "" {
+		var err error
+		owner.GID, err = strconv.Atoi(gid)
+		if err != nil {
+			return owner, err
+		}
+	}
+	return owner, nil
+}
+
+// NewOSBackend returns the local disk backend with the permissions and
+// ownership of config. Handing files to another owner takes root.
+func NewOSBackend(config *Config) (OSBackend, error) {
+	local := OSBackend{FileMode: os.FileMode(config.FileMode), DirMode: os.FileMode(config.DirMode)}
+	if config.FileOwner == "" && config.FileGroup == "" {
+		return local, nil
+	}
+	if os.Geteuid() != 0 {
+		return local, fmt.Errorf("FileOwner and FileGroup need the server to run as root")
+	}
+	owner, err := LookupOwner(config.FileOwner, config.FileGroup)
+	if err != nil {
+		return local, err
+	}
+	local.Owner = &owner
+	return local, nil
+}
+
+func (o OSBackend) fileMode() os.FileMode {
+	if o.FileMode == 0 {
+		return defaultFileMode
+	}
+	return o.FileMode
+}
+
+func (o OSBackend) dirMode() os.FileMode {
+	if o.DirMode == 0 {
+		return defaultDirMode
+	}
+	return o.DirMode
+}
+
+// local returns the local disk backend files are created with before
+// they're stored, the configured one if files are stored on local disk.
+func (r *RSFileManager) local() OSBackend {
+	if local, ok := baseStorage(r.storage()).(OSBackend); ok {
+		return local
+	}
+	return OSBackend{}
+}
+
+// create creates fpath with the backend's permissions and owner. The
+// umask can only take permissions away, so they are set again once the
+// file exists; it's never more open than configured.
+func (o OSBackend) create(fpath string) (*os.File, error) {
+	err := o.mkdirAll(path.Dir(fpath))
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(fpath, os.O_RDWR|os.O_CREATE|os.O_EXCL, o.fileMode())
+	if err != nil {
+		return nil, err
+	}
+	err = f.Chmod(o.fileMode())
+	if err == nil && o.Owner != nil {
+		err = f.Chown(o.Owner.UID, o.Owner.GID)
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(fpath)
+		return nil, err
+	}
+	return f, nil
+}
+
+// adopt gives fpath, created elsewhere and renamed into storage, the
+// backend's permissions and owner.
+func (o OSBackend) adopt(fpath string) error {
+	err := os.Chmod(fpath, o.fileMode())
+	if err == nil && o.Owner != nil {
+		err = os.Chown(fpath, o.Owner.UID, o.Owner.GID)
+	}
+	return err
+}
+
+// mkdirAll creates dir and its missing parents like os.MkdirAll, with the
+// backend's permissions and owner.
+func (o OSBackend) mkdirAll(dir string) error {
+	stat, err := os.Stat(dir)
+	if err == nil {
+		if !stat.IsDir() {
+			return &os.PathError{Op: "mkdir", Path: dir, Err: fmt.Errorf("not a directory")}
+		}
+		return nil
+	}
+	if parent := path.Dir(dir); parent != dir {
+		err = o.mkdirAll(parent)
+		if err != nil {
+			return err
+		}
+	}
+	err = os.Mkdir(dir, o.dirMode())
+	if os.IsExist(err) {
+		// Created by someone else meanwhile.
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	err = os.Chmod(dir, o.dirMode())
+	if err == nil && o.Owner != nil {
+		err = os.Chown(dir, o.Owner.UID, o.Owner.GID)
+	}
+	return err
+}
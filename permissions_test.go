@@ -0,0 +1,82 @@
+package rsbackup
+
+import (
+	"encoding/json"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestParseMode(t *testing.T) {
+	modeTests := []struct {
+		input       string
+		expected    Mode
+		expectedErr bool
+	}{
+		{"0640", 0640, false},
+		{"755", 0755, false},
+		{"0", 0, false},
+		{"0800", 0, true},
+		{"4755", 0, true},
+		{"rw-r-----", 0, true},
+	}
+	for _, tt := range modeTests {
+		t.Run(tt.input, func(t *testing.T) {
+			mode, err := ParseMode(tt.input)
+			if (err != nil) != tt.expectedErr {
+				t.Fatalf("Got error '%v', expected error: %t", err, tt.expectedErr)
+			}
+			if mode != tt.expected {
+				t.Errorf("Got mode %s, expected %s", mode, tt.expected)
+			}
+		})
+	}
+
+	var mode Mode
+	if err := json.Unmarshal([]byte(`"0640"`), &mode); err != nil || mode != 0640 {
+		t.Errorf("Got mode %s (error: %v)", mode, err)
+	}
+	if err := json.Unmarshal([]byte(`640`), &mode); err == nil {
+		t.Errorf("Decimal mode was accepted")
+	}
+}
+
+func TestOSBackendPermissions(t *testing.T) {
+	tmpDir := createTMPDir(t, "rsbackup")
+	modes := func(storage OSBackend, fname string) (os.FileMode, os.FileMode) {
+		fpath := path.Join(tmpDir, fname, "sub", "file")
+		f, err := storage.CreateExclusive(fpath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+		file, err := os.Stat(fpath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dir, err := os.Stat(path.Dir(fpath))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return file.Mode().Perm(), dir.Mode().Perm()
+	}
+
+	if file, dir := modes(OSBackend{}, "default"); file != 0644 || dir != 0755 {
+		t.Errorf("Got default modes %o and %o", file, dir)
+	}
+	// Group write is taken away by the usual umask of 022.
+	if file, dir := modes(OSBackend{FileMode: 0664, DirMode: 0770}, "shared"); file != 0664 || dir != 0770 {
+		t.Errorf("Got modes %o and %o", file, dir)
+	}
+	storage := OSBackend{FileMode: 0600, DirMode: 0700}
+	if err := storage.Rename(path.Join(tmpDir, "shared", "sub", "file"), path.Join(tmpDir, "private", "file")); err != nil {
+		t.Fatal(err)
+	}
+	dir, err := os.Stat(path.Join(tmpDir, "private"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dir.Mode().Perm() != 0700 {
+		t.Errorf("Rename created a directory with mode %o", dir.Mode().Perm())
+	}
+}
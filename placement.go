@@ -0,0 +1,417 @@
+package rsbackup
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// StorageTarget is somewhere the Placement rules can put files. Exactly
+// one of Dir, ShardRoots, SFTPURL, GCSBucket and B2Bucket is set.
+type StorageTarget struct {
+	// Dir is a local directory, like one on a second disk.
+	Dir string
+	// ShardRoots spreads files over several disks, as Config.ShardRoots.
+	ShardRoots []string
+	// SFTPURL is a remote directory, logged into with SFTPKeyPath.
+	SFTPURL string
+	// GCSBucket and B2Bucket are buckets accessed with the credentials in
+	// the config, object names starting with Prefix.
+	GCSBucket string
+	B2Bucket  string
+	Prefix    string
+}
+
+// PlacementRule decides which StorageTargets hold the files it matches.
+// An empty target name stands for BackupRoot itself.
+type PlacementRule struct {
+	// Files is a pattern, as for path.Match, for the names of the files
+	// the rule is for. Empty matches every name.
+	Files string
+	// Namespace limits the rule to files stored by that credential.
+	Namespace string
+	// Class limits the rule to files submitted with that storage class.
+	Class string
+	Data  string
+	// Parity shard i goes to Parity[(i-1) % len(Parity)].
+	Parity   []string
+	Metadata string
+}
+
+// PlacementBackend stores the data, parity and metadata of each file on
+// the targets picked by the first matching PlacementRule, files no rule
+// matches stay under BackupRoot. Rules for a namespace or a storage class
+// need to know who stored a file and with which class, so that is
+// recorded in json files when it's first stored through the API. Bundle
+// imports aren't, only rules without a Namespace or Class apply to them.
+//
+// Files are looked for on every target when they aren't where the rules
+// place them, so changing the rules doesn't lose anything. Files stay
+// where they are until renamed, repairs rebuild lost shards where the
+// rules place them.
+type PlacementBackend struct {
+	rules   []PlacementRule
+	targets map[string]StorageBackend
+	// names lists the targets in the order they are searched.
+	names []string
+
+	mu         sync.Mutex
+	path       string
+	namespaces map[string]string
+	classPath  string
+	classes    map[string]string
+}
+
+// NewPlacementBackend sets up the StorageTargets of config and loads
+// which namespace stored which file.
+func NewPlacementBackend(config *Config) (*PlacementBackend, error) {
+	local, err := NewOSBackend(config)
+	if err != nil {
+		return nil, err
+	}
+	targets := map[string]StorageBackend{"": local}
+	for name, target := range config.StorageTargets {
+		backend, err := openStorageTarget(config, target)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to set up storage target '%s': %s", name, err)
+		}
+		targets[name] = backend
+	}
+	return newPlacementBackend(config.StatePath("placement.json"), config.StatePath("placement_classes.json"), config.Placement, targets)
+}
+
+func newPlacementBackend(statePath, classPath string, rules []PlacementRule, targets map[string]StorageBackend) (*PlacementBackend, error) {
+	p := &PlacementBackend{
+		rules:      rules,
+		targets:    targets,
+		path:       statePath,
+		namespaces: make(map[string]string),
+		classPath:  classPath,
+		classes:    make(map[string]string),
+	}
+	for name := range targets {
+		p.names = append(p.names, name)
+	}
+	sort.Strings(p.names)
+	err := readJSONState(statePath, &p.namespaces)
+	if err == nil {
+		err = readJSONState(classPath, &p.classes)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func openStorageTarget(config *Config, target StorageTarget) (StorageBackend, error) {
+	c := *config
+	switch {
+	case target.Dir != "":
+		return newLocalTarget(config, []string{target.Dir})
+	case len(target.ShardRoots) > 0:
+		return newLocalTarget(config, target.ShardRoots)
+	case target.SFTPURL != "":
+		c.SFTPStorageURL = target.SFTPURL
+		return NewSFTPBackend(&c)
+	case target.GCSBucket != "":
+		c.GCSBucket, c.GCSPrefix = target.GCSBucket, target.Prefix
+		return NewGCSBackend(&c)
+	case target.B2Bucket != "":
+		c.B2Bucket, c.B2Prefix = target.B2Bucket, target.Prefix
+		return NewB2Backend(&c)
+	}
+	return nil, fmt.Errorf("no storage configured")
+}
+
+func newLocalTarget(config *Config, disks []string) (StorageBackend, error) {
+	local, err := NewOSBackend(config)
+	if err != nil {
+		return nil, err
+	}
+	return NewMultiDiskBackend(config.BackupRoot, disks, local)
+}
+
+// shardOf splits fpath into the path of the data file it belongs to and
+// its shard: 0 for the data file, i for parity shard i and -1 for the
+// metadata.
+func shardOf(fpath string) (string, int) {
+	for _, suffix := range []string{".md", metadataMirrorSuffix} {
+		if strings.HasSuffix(fpath, suffix) {
+			return strings.TrimSuffix(fpath, suffix), -1
+		}
+	}
+	if i := strings.LastIndex(fpath, ".parity."); i >= 0 {
+		if n, err := strconv.Atoi(fpath[i+len(".parity."):]); err == nil && n > 0 {
+			return fpath[:i], n
+		}
+	}
+	return fpath, 0
+}
+
+// Assign records that namespace stores fname, for the rules limited to a
+// namespace.
+func (p *PlacementBackend) Assign(fname, namespace string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.namespaces[fname] == namespace {
+		return nil
+	}
+	old, known := p.namespaces[fname]
+	p.namespaces[fname] = namespace
+	err := writeJSONState(p.path, p.namespaces)
+	if err != nil {
+		if known {
+			p.namespaces[fname] = old
+		} else {
+			delete(p.namespaces, fname)
+		}
+	}
+	return err
+}
+
+// AssignClass records that fname is stored with the storage class class,
+// for the rules limited to a class. The default class isn't recorded.
+func (p *PlacementBackend) AssignClass(fname, class string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	old, known := p.classes[fname]
+	if old == class {
+		return nil
+	}
+	if class == "" {
+		delete(p.classes, fname)
+	} else {
+		p.classes[fname] = class
+	}
+	err := writeJSONState(p.classPath, p.classes)
+	if err != nil {
+		if known {
+			p.classes[fname] = old
+		} else {
+			delete(p.classes, fname)
+		}
+	}
+	return err
+}
+
+// Move makes to placed for the namespace that stored from, and its storage
+// class. It's done before renaming the files, so they move to where to
+// belongs.
+func (p *PlacementBackend) Move(from, to string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if class, ok := p.classes[from]; ok {
+		delete(p.classes, from)
+		p.classes[to] = class
+		if err := writeJSONState(p.classPath, p.classes); err != nil {
+			return err
+		}
+	}
+	namespace, ok := p.namespaces[from]
+	if !ok {
+		return nil
+	}
+	delete(p.namespaces, from)
+	p.namespaces[to] = namespace
+	return writeJSONState(p.path, p.namespaces)
+}
+
+// rule returns the first rule matching fname, if any.
+func (p *PlacementBackend) rule(fname string) (PlacementRule, bool) {
+	p.mu.Lock()
+	namespace, known := p.namespaces[fname]
+	class := p.classes[fname]
+	p.mu.Unlock()
+	for _, rule := range p.rules {
+		if rule.Namespace != "" && (!known || rule.Namespace != namespace) {
+			continue
+		}
+		if rule.Class != "" && rule.Class != class {
+			continue
+		}
+		if ok, _ := path.Match(rule.Files, fname); rule.Files != "" && !ok {
+			continue
+		}
+		return rule, true
+	}
+	return PlacementRule{}, false
+}
+
+// target returns the name of the target fpath is placed on.
+func (p *PlacementBackend) target(fpath string) string {
+	base, shard := shardOf(fpath)
+	rule, ok := p.rule(path.Base(base))
+	switch {
+	case !ok:
+		return ""
+	case shard < 0:
+		return rule.Metadata
+	case shard > 0 && len(rule.Parity) > 0:
+		return rule.Parity[(shard-1)%len(rule.Parity)]
+	}
+	return rule.Data
+}
+
+// locate returns the name of the target holding fpath, the one it's placed
+// on if that has it.
+func (p *PlacementBackend) locate(fpath string) (string, error) {
+	placed := p.target(fpath)
+	_, err := p.targets[placed].Stat(fpath)
+	if err == nil || !os.IsNotExist(err) {
+		return placed, err
+	}
+	for _, name := range p.names {
+		if name == placed {
+			continue
+		}
+		if _, err := p.targets[name].Stat(fpath); err == nil {
+			return name, nil
+		}
+	}
+	return "", &os.PathError{Op: "stat", Path: fpath, Err: os.ErrNotExist}
+}
+
+func (p *PlacementBackend) Open(fpath string) (StorageFile, error) {
+	name, err := p.locate(fpath)
+	if err != nil {
+		return nil, err
+	}
+	return p.targets[name].Open(fpath)
+}
+
+func (p *PlacementBackend) OpenWritable(fpath string) (StorageFile, error) {
+	name, err := p.locate(fpath)
+	if err != nil {
+		return nil, err
+	}
+	return p.targets[name].OpenWritable(fpath)
+}
+
+// CreateExclusive creates fpath on the target it's placed on. It fails if
+// any target has fpath already.
+func (p *PlacementBackend) CreateExclusive(fpath string) (StorageFile, error) {
+	if _, err := p.locate(fpath); err == nil {
+		return nil, &os.PathError{Op: "open", Path: fpath, Err: os.ErrExist}
+	}
+	return p.targets[p.target(fpath)].CreateExclusive(fpath)
+}
+
+// List merges the entries of dir on all targets.
+func (p *PlacementBackend) List(dir string) ([]string, error) {
+	var backends []StorageBackend
+	for _, name := range p.names {
+		backends = append(backends, p.targets[name])
+	}
+	return listAll(dir, backends...)
+}
+
+// listAll merges the entries of dir on backends, dir only has to exist on
+// one of them.
+func listAll(dir string, backends ...StorageBackend) ([]string, error) {
+	seen := make(map[string]bool)
+	var names []string
+	found := false
+	for _, backend := range backends {
+		entries, err := backend.List(dir)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		found = true
+		for _, entry := range entries {
+			if !seen[entry] {
+				seen[entry] = true
+				names = append(names, entry)
+			}
+		}
+	}
+	if !found {
+		return nil, &os.PathError{Op: "open", Path: dir, Err: os.ErrNotExist}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (p *PlacementBackend) Stat(fpath string) (os.FileInfo, error) {
+	name, err := p.locate(fpath)
+	if err != nil {
+		return nil, err
+	}
+	return p.targets[name].Stat(fpath)
+}
+
+func (p *PlacementBackend) Remove(fpath string) error {
+	name, err := p.locate(fpath)
+	if err != nil {
+		return &os.PathError{Op: "remove", Path: fpath, Err: os.ErrNotExist}
+	}
+	return p.targets[name].Remove(fpath)
+}
+
+// Rename moves from to the target to is placed on, copying it over when
+// that's another target.
+func (p *PlacementBackend) Rename(from, to string) error {
+	name, err := p.locate(from)
+	if err != nil {
+		return &os.LinkError{Op: "rename", Old: from, New: to, Err: os.ErrNotExist}
+	}
+	placed := p.target(to)
+	if placed == name {
+		return p.targets[name].Rename(from, to)
+	}
+	src, dst := p.targets[name], p.targets[placed]
+	if err := dst.Remove(to); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	in, err := src.Open(from)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := dst.CreateExclusive(to)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if err == nil {
+		err = out.Sync()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		dst.Remove(to)
+		return err
+	}
+	return src.Remove(from)
+}
+
+// placeFile tells the Placement backend which namespace stores fname, and
+// with which storage class, unless it's stored already and so stays where
+// it is. It reports whether to go on.
+func (rs *RSBackupAPI) placeFile(w http.ResponseWriter, r *http.Request, fname string) bool {
+	if rs.Placement == nil {
+		return true
+	}
+	if _, err := rs.RsFileMan.Stat(fname); err == nil {
+		return true
+	}
+	err := rs.Placement.Assign(fname, requestNamespace(r))
+	if err == nil {
+		err = rs.Placement.AssignClass(fname, r.FormValue("storage_class"))
+	}
+	if err != nil {
+		rs.Errorf(r, "Unable to record placement of %s: %s", fname, err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,125 @@
+package rsbackup
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+)
+
+func newTestPlacementAPI(t *testing.T) (*RSBackupAPI, map[string]string) {
+	tmpDir := createTMPDir(t, "rsbackup")
+	dirs := map[string]string{"": path.Join(tmpDir, "root")}
+	targets := map[string]StorageTarget{}
+	for _, name := range []string{"disk2", "disk3"} {
+		dirs[name] = path.Join(tmpDir, name)
+		targets[name] = StorageTarget{Dir: dirs[name]}
+	}
+	for _, dir := range dirs {
+		if err := os.Mkdir(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	conf := &Config{
+		BackupRoot:     dirs[""],
+		DataShards:     2,
+		ParityShards:   2,
+		StorageTargets: targets,
+		Placement: []PlacementRule{
+			{Namespace: "alice", Data: "disk3", Parity: []string{"disk3"}, Metadata: "disk3"},
+			{Files: "*.tar", Parity: []string{"disk2", ""}},
+		},
+	}
+	placement, err := NewPlacementBackend(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	api := &RSBackupAPI{Config: conf, RsFileMan: &RSFileManager{Config: conf, Storage: placement}, Placement: placement}
+	return api, dirs
+}
+
+func TestPlacementBackend(t *testing.T) {
+	api, dirs := newTestPlacementAPI(t)
+	testData := submitTestData(t, api, "tyger.tar")
+
+	placed := map[string]string{"": "", ".md": "", ".parity.1": "disk2", ".parity.2": ""}
+	for suffix, target := range placed {
+		for name, dir := range dirs {
+			_, err := os.Stat(path.Join(dir, "tyger.tar"+suffix))
+			if found := err == nil; found != (name == target) {
+				t.Errorf("Got tyger.tar%s on %s: %t", suffix, dir, found)
+			}
+		}
+	}
+	health, _, _, err := api.RsFileMan.CheckData("tyger.tar")
+	if err != nil || !health {
+		t.Errorf("Got health %t (error: %v)", health, err)
+	}
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(api.retrieveDataHandler).ServeHTTP(rr, httptest.NewRequest("GET", "/retrieve_data/tyger.tar", nil))
+	if rr.Body.String() != string(testData) {
+		t.Errorf("Got retrieved contents '%s'", rr.Body.String())
+	}
+	names, err := api.RsFileMan.Storage.List(dirs[""])
+	if err != nil || len(names) != 6 {
+		t.Errorf("Got names %v (error: %v)", names, err)
+	}
+
+	// Files of a namespace follow its rule once they're renamed.
+	if err := api.Placement.Assign("lion", "alice"); err != nil {
+		t.Fatal(err)
+	}
+	if err := api.RsFileMan.Rename("tyger.tar", "lion"); err != nil {
+		t.Fatal(err)
+	}
+	for suffix := range placed {
+		if _, err := os.Stat(path.Join(dirs["disk3"], "lion"+suffix)); err != nil {
+			t.Errorf("lion%s wasn't moved: %s", suffix, err)
+		}
+	}
+	health, _, _, err = api.RsFileMan.CheckData("lion")
+	if err != nil || !health {
+		t.Errorf("Got health %t after renaming (error: %v)", health, err)
+	}
+	if _, err := api.RsFileMan.Stat("tyger.tar"); !os.IsNotExist(err) {
+		t.Errorf("Got %v stating a renamed file", err)
+	}
+}
+
+func TestPlacementBackendLostTarget(t *testing.T) {
+	api, dirs := newTestPlacementAPI(t)
+	testData := submitTestData(t, api, "tyger.tar")
+	os.Remove(path.Join(dirs["disk2"], "tyger.tar.parity.1"))
+
+	health, _, _, err := api.RsFileMan.CheckData("tyger.tar")
+	if err != nil || health {
+		t.Errorf("Got health %t after losing parity (error: %v)", health, err)
+	}
+	if err := api.RsFileMan.RepairData("tyger.tar"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path.Join(dirs["disk2"], "tyger.tar.parity.1")); err != nil {
+		t.Errorf("Parity wasn't recreated on its target: %s", err)
+	}
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(api.retrieveDataHandler).ServeHTTP(rr, httptest.NewRequest("GET", "/retrieve_data/tyger.tar", nil))
+	if rr.Body.String() != string(testData) {
+		t.Errorf("Got retrieved contents '%s' after repair", rr.Body.String())
+	}
+}
+
+func TestPlacementAssign(t *testing.T) {
+	api, _ := newTestPlacementAPI(t)
+	submitTestData(t, api, "tyger")
+	if namespace := api.Placement.namespaces["tyger"]; namespace != "anonymous" {
+		t.Errorf("tyger was placed for '%s'", namespace)
+	}
+	reloaded, err := NewPlacementBackend(api.Config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if namespace := reloaded.namespaces["tyger"]; namespace != "anonymous" {
+		t.Errorf("tyger was placed for '%s' after reloading", namespace)
+	}
+}
@@ -0,0 +1,226 @@
+package rsbackup
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// defaultPresignTTL is how long presigned upload URLs stay valid, unless
+// the admin minting one asks otherwise.
+const defaultPresignTTL = time.Hour
+
+var (
+	errPresignNotFound = errors.New("Presigned upload not found")
+	errPresignUsed     = errors.New("Presigned upload used or expired")
+)
+
+// PresignedUpload allows a single upload of a file named Name, of up to
+// MaxSize bytes, before it expires. The upload is charged to Namespace.
+type PresignedUpload struct {
+	Token     string    `json:"token"`
+	Name      string    `json:"name"`
+	MaxSize   Size      `json:"max_size"`
+	Namespace string    `json:"namespace"`
+	Created   time.Time `json:"created"`
+	Expires   time.Time `json:"expires"`
+	Used      bool      `json:"used"`
+}
+
+// PresignStore keeps presigned uploads persisted in a json file, so URLs
+// stay usable, and used ones stay used, across restarts.
+type PresignStore struct {
+	mu      sync.Mutex
+	path    string
+	uploads map[string]*PresignedUpload
+}
+
+func NewPresignStore(fpath string) (*PresignStore, error) {
+	s := &PresignStore{
+		path:    fpath,
+		uploads: make(map[string]*PresignedUpload),
+	}
+	err := readJSONState(fpath, &s.uploads)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *PresignStore) Create(name string, maxSize Size, namespace string, ttl time.Duration) (*PresignedUpload, error) {
+	token, err := generateToken()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	upload := &PresignedUpload{
+		Token:     token,
+		Name:      name,
+		MaxSize:   maxSize,
+		Namespace: namespace,
+		Created:   now,
+		Expires:   now.Add(ttl),
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.uploads[token] = upload
+	err = s.save(now)
+	if err != nil {
+		delete(s.uploads, token)
+		return nil, err
+	}
+	return upload, nil
+}
+
+// Use marks the upload identified by token as used and returns a copy of
+// it. An upload that fails still uses it up.
+func (s *PresignStore) Use(token string) (PresignedUpload, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	upload, ok := s.uploads[token]
+	if !ok {
+		return PresignedUpload{}, errPresignNotFound
+	}
+	now := time.Now()
+	if upload.Used || now.After(upload.Expires) {
+		return PresignedUpload{}, errPresignUsed
+	}
+	upload.Used = true
+	err := s.save(now)
+	if err != nil {
+		upload.Used = false
+		return PresignedUpload{}, err
+	}
+	return *upload, nil
+}
+
+// save must be called with s.mu held. Uploads expired for over a day are
+// dropped, until then they are kept to tell clients they are gone.
+func (s *PresignStore) save(now time.Time) error {
+	for token, upload := range s.uploads {
+		if now.Sub(upload.Expires) > 24*time.Hour {
+			delete(s.uploads, token)
+		}
+	}
+	return writeJSONState(s.path, s.uploads)
+}
+
+type presignRsp struct {
+	Token     string `json:"token"`
+	Name      string `json:"name"`
+	URL       string `json:"url"`
+	MaxSize   Size   `json:"max_size"`
+	Namespace string `json:"namespace"`
+	Expires   string `json:"expires"`
+}
+
+// presignUploadHandler mints a URL that allows a single upload of the file
+// in the filename form field, of up to max_size bytes, within ttl. The file
+// is charged to the quota of namespace, the admin's own by default.
+func (rs *RSBackupAPI) presignUploadHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		rs.Errorf(r, "Bad method %s", r.Method)
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	fname := r.FormValue("filename")
+	auditObject(r, fname)
+	err := validateFileName(fname)
+	if err != nil {
+		rs.Errorf(r, "Can't presign upload: %s", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	maxSize, err := ParseSize(r.FormValue("max_size"))
+	if err != nil || maxSize <= 0 {
+		rs.Errorf(r, "Bad 'max_size' parameter '%s'", r.FormValue("max_size"))
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	ttl := defaultPresignTTL
+	if ttlParam := r.FormValue("ttl"); ttlParam != "" {
+		ttl, err = time.ParseDuration(ttlParam)
+		if err != nil || ttl <= 0 {
+			rs.Errorf(r, "Bad 'ttl' parameter '%s'", ttlParam)
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+	}
+	namespace := r.FormValue("namespace")
+	if namespace == "" {
+		namespace = requestNamespace(r)
+	}
+	if _, err := rs.RsFileMan.Stat(fname); err == nil {
+		rs.Errorf(r, "Can't presign upload of %s: %s", fname, errFileExists)
+		http.Error(w, http.StatusText(http.StatusConflict), http.StatusConflict)
+		return
+	}
+	upload, err := rs.Presigned.Create(fname, maxSize, namespace, ttl)
+	if err != nil {
+		rs.Errorf(r, "Unable to presign upload of %s: %s", fname, err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	log.Infof("Presigned upload of %s (up to %s, for '%s') expiring %s", fname, maxSize, namespace, upload.Expires)
+	rsp := &presignRsp{
+		Token:     upload.Token,
+		Name:      upload.Name,
+		URL:       "/upload/" + upload.Token,
+		MaxSize:   upload.MaxSize,
+		Namespace: upload.Namespace,
+		Expires:   upload.Expires.Format("2006-01-02 15:04:05"),
+	}
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(rsp)
+	if err != nil {
+		rs.Errorf(r, "Unable to marshal json response: %s", err)
+	}
+}
+
+// presignedUploadHandler takes the upload a presigned URL allows, like
+// submit_data but without credentials and a filename field.
+func (rs *RSBackupAPI) presignedUploadHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		rs.Errorf(r, "Bad method %s", r.Method)
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	token, err := getURLParam(r.URL)
+	if err != nil {
+		rs.Errorf(r, "Can't take presigned upload: %s", err)
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	upload, err := rs.Presigned.Use(token)
+	if err != nil {
+		switch err {
+		case errPresignNotFound:
+			rs.Errorf(r, "Unknown presigned upload token")
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		case errPresignUsed:
+			rs.Errorf(r, "Presigned upload used or expired")
+			http.Error(w, http.StatusText(http.StatusGone), http.StatusGone)
+		default:
+			rs.Errorf(r, "Unable to use presigned upload: %s", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		}
+		return
+	}
+	if entry := requestAudit(r); entry != nil {
+		entry.Identity = upload.Namespace
+	}
+	limit := upload.MaxSize
+	if rs.Config.MaxUploadSize > 0 && rs.Config.MaxUploadSize < limit {
+		limit = rs.Config.MaxUploadSize
+	}
+	// The upload acts as a write-only credential of the namespace, so its
+	// quota applies.
+	credential := APIToken{Name: upload.Namespace, Scopes: []string{ScopeWrite}}
+	r = r.WithContext(context.WithValue(r.Context(), tokenContextKey, credential))
+	rs.receiveUpload(w, r, limit, upload.Name)
+}
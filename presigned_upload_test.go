@@ -0,0 +1,106 @@
+package rsbackup
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+)
+
+func presignedUploadReq(t *testing.T, target string, contents []byte) *http.Request {
+	body := new(bytes.Buffer)
+	multipartWriter := multipart.NewWriter(body)
+	form, err := multipartWriter.CreateFormFile("file", "upload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	form.Write(contents)
+	multipartWriter.Close()
+	req := httptest.NewRequest("POST", target, body)
+	req.Header.Add("content-type", multipartWriter.FormDataContentType())
+	return req
+}
+
+func TestPresignedUpload(t *testing.T) {
+	tmpDir := createTMPDir(t, "rsbackup")
+	conf := &Config{BackupRoot: tmpDir, DataShards: 2, ParityShards: 1}
+	presigned, err := NewPresignStore(conf.StatePath("presigned.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	quotas, err := NewQuotaStore(conf.StatePath("quotas.json"), conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	api := &RSBackupAPI{Config: conf, RsFileMan: &RSFileManager{Config: conf}, Presigned: presigned, Quotas: quotas}
+	fillDirWithEmptyFiles(t, tmpDir, "taken")
+
+	presignTests := []struct {
+		name           string
+		form           url.Values
+		expectedStatus int
+	}{
+		{"missing filename", url.Values{"max_size": {"1KiB"}}, 400},
+		{"missing max_size", url.Values{"filename": {"report"}}, 400},
+		{"bad ttl", url.Values{"filename": {"report"}, "max_size": {"1KiB"}, "ttl": {"-1h"}}, 400},
+		{"file exists", url.Values{"filename": {"taken"}, "max_size": {"1KiB"}}, 409},
+		{"presigned", url.Values{"filename": {"report"}, "max_size": {"1KiB"}, "namespace": {"agent"}}, 200},
+	}
+	var rsp presignRsp
+	for _, tt := range presignTests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", "/presign_upload", strings.NewReader(tt.form.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			rr := httptest.NewRecorder()
+			http.HandlerFunc(api.presignUploadHandler).ServeHTTP(rr, req)
+			if rr.Code != tt.expectedStatus {
+				t.Errorf("Got status code %d, expected %d", rr.Code, tt.expectedStatus)
+			}
+			if rr.Code == http.StatusOK {
+				json.NewDecoder(rr.Body).Decode(&rsp)
+			}
+		})
+	}
+	if rsp.URL != "/upload/"+rsp.Token || rsp.Name != "report" {
+		t.Fatalf("Got presign response %+v", rsp)
+	}
+
+	// Used up by a failed upload as well.
+	tooLarge, _ := presigned.Create("large", 100, "agent", defaultPresignTTL)
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(api.presignedUploadHandler).ServeHTTP(rr, presignedUploadReq(t, "/upload/"+tooLarge.Token, make([]byte, 1000)))
+	if rr.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Got status code %d for an oversized upload", rr.Code)
+	}
+
+	uploadTests := []struct {
+		name           string
+		target         string
+		expectedStatus int
+	}{
+		{"unknown token", "/upload/0123", 404},
+		{"upload", rsp.URL, 200},
+		{"used", rsp.URL, 410},
+		{"used by failure", "/upload/" + tooLarge.Token, 410},
+	}
+	for _, tt := range uploadTests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			http.HandlerFunc(api.presignedUploadHandler).ServeHTTP(rr, presignedUploadReq(t, tt.target, []byte("signed, sealed, delivered")))
+			if rr.Code != tt.expectedStatus {
+				t.Errorf("Got status code %d, expected %d", rr.Code, tt.expectedStatus)
+			}
+		})
+	}
+	if _, err := os.Stat(api.RsFileMan.DataPath("report")); err != nil {
+		t.Errorf("Upload not stored under the presigned name: %s", err)
+	}
+	if quotas.Usage("agent") == 0 {
+		t.Errorf("Upload not charged to the presigned namespace")
+	}
+}
@@ -4,6 +4,7 @@ import hashlib
 import logging
 import pathlib
 import typing
+import urllib.parse
 
 import aiohttp
 import click
@@ -31,6 +32,7 @@ class Client():
         'list_data': 'list_data',
         'check_data': 'check_data',
         'submit_data': 'submit_data',
+        'submit_url': 'submit_url',
         'retrieve_data': 'retrieve_data',
         'repair_data': 'repair_data',
     }
@@ -38,11 +40,15 @@ class Client():
     def __init__(self,
                  timeout: int = 5,
                  server_url: str = 'http://localhost:44987',
-                 strict_tls: bool = False) -> None:
+                 strict_tls: bool = False,
+                 token: typing.Optional[str] = None) -> None:
         self.server_url = self._format_server_url(server_url)
         self.timeout = aiohttp.ClientTimeout(total=float(timeout))
         self.strict_tls = strict_tls
         self._aio_ssl = not strict_tls
+        self._headers = {}
+        if token:
+            self._headers['Authorization'] = f'Bearer {token}'
 
     def _format_server_url(self, url: str) -> str:
         if url.startswith('http://') or url.startswith('https://'):
@@ -50,6 +56,10 @@ class Client():
         else:
             return f'http://{url}'
 
+    def _url(self, verb: str, fname: str) -> str:
+        # File names are sent as a single percent-encoded path segment.
+        return f'{self.server_url}/{verb}/{urllib.parse.quote(fname, safe="")}'
+
     def _sha256(self, file_: typing.BinaryIO) -> str:
         file_.seek(0)
         block_size = 65536
@@ -68,7 +78,8 @@ class Client():
         if not filepath.is_file():
             raise ClientError(f"{filepath} is not a file!")
 
-        async with aiohttp.ClientSession(timeout=self.timeout) as session:
+        async with aiohttp.ClientSession(timeout=self.timeout,
+                                         headers=self._headers) as session:
             with open(filepath, 'rb') as f:
                 sha256_digest = self._sha256(f)
                 print('=' * 80)
@@ -89,6 +100,31 @@ class Client():
                     print(f'parity_shards: {data_submit["parity_shards"]}')
                     print(f'hashes: {data_submit["hashes"]}')
 
+    async def submit_url(self, fname: str, url: str,
+                         sha256_digest: typing.Optional[str] = None) -> None:
+        # rsp = {size, data_shards, parity_shards, [hashes]}
+        data = {'url': url, 'filename': fname}
+        if sha256_digest:
+            data['sha256'] = sha256_digest
+        async with aiohttp.ClientSession(timeout=self.timeout,
+                                         headers=self._headers) as session:
+            print('=' * 80)
+            print(f'Server fetching: {url}')
+            async with session.post(
+                f'{self.server_url}/{self.SERVER_URLMAP["submit_url"]}',
+                data=data,
+                ssl=self._aio_ssl
+            ) as rsp:
+                if rsp.status != 200:
+                    raise ServerError(await rsp.text())
+                data_submit = (await rsp.json())
+                print('=' * 80)
+                print('Status: SUCCESS')
+                print(f'size: {data_submit["size"]}')
+                print(f'data_shards: {data_submit["data_shards"]}')
+                print(f'parity_shards: {data_submit["parity_shards"]}')
+                print(f'hashes: {data_submit["hashes"]}')
+
     async def _save_rsp_to_file(self, rsp: aiohttp.ClientResponse,
                                 path: pathlib.Path) -> None:
         chunk_size = 66560
@@ -103,9 +139,10 @@ class Client():
                             target_path: pathlib.Path) -> None:
         if target_path.exists():
             raise ClientError(f'{target_path} already exists!')
-        async with aiohttp.ClientSession(timeout=self.timeout) as session:
+        async with aiohttp.ClientSession(timeout=self.timeout,
+                                         headers=self._headers) as session:
             async with session.get(
-                    f'{self.server_url}/{self.SERVER_URLMAP["retrieve_data"]}/{fname}',
+                    self._url(self.SERVER_URLMAP["retrieve_data"], fname),
                     ssl=self._aio_ssl) as rsp:
                 if rsp.status != 200:
                     raise ServerError(await rsp.text())
@@ -115,9 +152,10 @@ class Client():
 
     async def check_data(self, fname: str) -> None:
         # rsp = {name, lmod, health, [hashes]}
-        async with aiohttp.ClientSession(timeout=self.timeout) as session:
+        async with aiohttp.ClientSession(timeout=self.timeout,
+                                         headers=self._headers) as session:
             async with session.get(
-                f'{self.server_url}/{self.SERVER_URLMAP["check_data"]}/{fname}',
+                self._url(self.SERVER_URLMAP["check_data"], fname),
                 ssl=self._aio_ssl
             ) as rsp:
                 if rsp.status == 404:
@@ -134,7 +172,8 @@ class Client():
 
     async def list_data(self) -> None:
         # rsp = {[file_names]}
-        async with aiohttp.ClientSession(timeout=self.timeout) as session:
+        async with aiohttp.ClientSession(timeout=self.timeout,
+                                         headers=self._headers) as session:
             async with session.get(
                     f'{self.server_url}/{self.SERVER_URLMAP["list_data"]}',
                     ssl=self._aio_ssl
@@ -150,9 +189,10 @@ class Client():
 
     async def repair_data(self, fname: str) -> None:
         # rsp = {name, status}
-        async with aiohttp.ClientSession(timeout=self.timeout) as session:
+        async with aiohttp.ClientSession(timeout=self.timeout,
+                                         headers=self._headers) as session:
             async with session.get(
-                    f'{self.server_url}/{self.SERVER_URLMAP["repair_data"]}/{fname}',
+                    self._url(self.SERVER_URLMAP["repair_data"], fname),
                     ssl=self._aio_ssl) as rsp:
                 if rsp.status != 200:
                     raise ServerError(await rsp.text())
@@ -196,6 +236,10 @@ def common_options(
     @click.option('-strict-tls/--no-strict-tls',
                   default=True,
                   help='Disable strict tls cert verification')
+    @click.option('--token',
+                  type=str,
+                  envvar='RSBACKUP_TOKEN',
+                  help='API token, defaults to $RSBACKUP_TOKEN')
     @functools.wraps(func)
     def wrapper(*args, **kwargs) -> typing.Any:
         return func(*args, **kwargs)
@@ -211,58 +255,76 @@ def cli() -> None:
 @click.argument('filename', type=str)
 @click.argument('source-path', type=str)
 @common_options
-def submit_data(debug: bool, server_url: str, timeout: int, strict_tls: bool,
+def submit_data(debug: bool, server_url: str, timeout: int,
+                strict_tls: bool, token: typing.Optional[str],
                 filename: str, source_path: str) -> None:
     """Submit data to archive"""
     # TODO: refactor common setup
     _setup_logging(debug)
     file_path = pathlib.Path(source_path)
-    client = Client(timeout, server_url, strict_tls)
+    client = Client(timeout, server_url, strict_tls, token)
     _run_client_fn(client.submit_data, filename, file_path)
 
 
+@cli.command()
+@click.argument('filename', type=str)
+@click.argument('url', type=str)
+@click.option('--sha256', type=str, help='Expected sha256 of the data')
+@common_options
+def submit_url(debug: bool, server_url: str, timeout: int,
+               strict_tls: bool, token: typing.Optional[str],
+               filename: str, url: str, sha256: typing.Optional[str]) -> None:
+    """Have the server download data from a url"""
+    _setup_logging(debug)
+    client = Client(timeout, server_url, strict_tls, token)
+    _run_client_fn(client.submit_url, filename, url, sha256)
+
+
 @cli.command()
 @click.argument('filename', type=str)
 @click.argument('destination-path', type=str)
 @common_options
-def retrieve_data(debug: bool, server_url: str, timeout: int, strict_tls: bool,
+def retrieve_data(debug: bool, server_url: str, timeout: int,
+                  strict_tls: bool, token: typing.Optional[str],
                   filename: str, destination_path: str) -> None:
     """Retrieve data by file name"""
     _setup_logging(debug)
     target_path = pathlib.Path(destination_path)
-    client = Client(timeout, server_url, strict_tls)
+    client = Client(timeout, server_url, strict_tls, token)
     _run_client_fn(client.retrieve_data, filename, target_path)
 
 
 @cli.command()
 @click.argument('filename', type=str)
 @common_options
-def check_data(debug: bool, server_url: str, timeout: int, strict_tls: bool,
+def check_data(debug: bool, server_url: str, timeout: int,
+               strict_tls: bool, token: typing.Optional[str],
                filename: str) -> None:
     """Check data integrity"""
     _setup_logging(debug)
-    client = Client(timeout, server_url, strict_tls)
+    client = Client(timeout, server_url, strict_tls, token)
     _run_client_fn(client.check_data, filename)
 
 
 @cli.command()
 @common_options
 def list_data(debug: bool, server_url: str, timeout: int,
-              strict_tls: bool) -> None:
+              strict_tls: bool, token: typing.Optional[str]) -> None:
     """List data"""
     _setup_logging(debug)
-    client = Client(timeout, server_url, strict_tls)
+    client = Client(timeout, server_url, strict_tls, token)
     _run_client_fn(client.list_data)
 
 
 @cli.command()
 @click.argument('filename', type=str)
 @common_options
-def repair_data(debug: bool, server_url: str, timeout: int, strict_tls: bool,
+def repair_data(debug: bool, server_url: str, timeout: int,
+                strict_tls: bool, token: typing.Optional[str],
                 filename: str) -> None:
     """Attempt to repair broken data"""
     _setup_logging(debug)
-    client = Client(timeout, server_url, strict_tls)
+    client = Client(timeout, server_url, strict_tls, token)
     _run_client_fn(client.repair_data, filename)
 
 
@@ -11,6 +11,7 @@ URL_MAP = pyclient.Client.SERVER_URLMAP
 LIST_DATA_URL = f'http://{SERVER_URL}/{URL_MAP["list_data"]}'
 CHECK_DATA_URL = f'http://{SERVER_URL}/{URL_MAP["check_data"]}'
 SUBMIT_DATA_URL = f'http://{SERVER_URL}/{URL_MAP["submit_data"]}'
+SUBMIT_URL_URL = f'http://{SERVER_URL}/{URL_MAP["submit_url"]}'
 RETRIEVE_DATA_URL = f'http://{SERVER_URL}/{URL_MAP["retrieve_data"]}'
 REPAIR_DATA_URL = f'http://{SERVER_URL}/{URL_MAP["repair_data"]}'
 
@@ -155,6 +156,43 @@ async def test_submit_data_fails(capfd, tmp_path) -> None:
         assert e.value.args[0] == expected
 
 
+@pytest.mark.asyncio
+async def test_submit_url(capfd) -> None:
+    expected = (
+        '=' * 80 + '\n' +
+        'Server fetching: https://example.org/dump.sql\n' +
+        '=' * 80 + '\n' +
+        'Status: SUCCESS\n'
+        'size: 40\n' +
+        'data_shards: 2\n' +
+        'parity_shards: 1\n' +
+        "hashes: ['123', '456']\n"
+    )
+    response = {
+        'size': 40,
+        'data_shards': 2,
+        'parity_shards': 1,
+        'hashes': ['123', '456'],
+    }
+    with aioresponses() as m:
+        m.post(SUBMIT_URL_URL, status=200, payload=response)
+        c = pyclient.Client(server_url=SERVER_URL)
+        await c.submit_url('dump', 'https://example.org/dump.sql', 'abcd')
+        captured = capfd.readouterr()
+        assert captured.out == expected
+
+
+@pytest.mark.asyncio
+async def test_submit_url_fails() -> None:
+    expected = 'Bad Gateway'
+    with aioresponses() as m:
+        m.post(SUBMIT_URL_URL, status=502, body=expected)
+        c = pyclient.Client(server_url=SERVER_URL)
+        with pytest.raises(pyclient.ServerError) as e:
+            await c.submit_url('dump', 'https://example.org/dump.sql')
+        assert e.value.args[0] == expected
+
+
 @pytest.mark.asyncio
 async def test_retrieve_data(capfd, tmp_path) -> None:
     data_path = tmp_path / 'target_file'
@@ -229,3 +267,22 @@ async def test_repair_data_failure(status, exc, exc_msg) -> None:
         with pytest.raises(exc) as e:
             await c.repair_data('some/file')
         assert e.value.args[0] == exc_msg
+
+
+def test_client_token_header() -> None:
+    c = pyclient.Client(server_url=SERVER_URL, token='secret')
+    assert c._headers == {'Authorization': 'Bearer secret'}
+    c = pyclient.Client(server_url=SERVER_URL)
+    assert c._headers == {}
+
+
+@pytest.mark.parametrize('fname,expected', [
+    ('tyger', 'tyger'),
+    ('with space', 'with%20space'),
+    ('a+b', 'a%2Bb'),
+    ('100%', '100%25'),
+    ('naïve', 'na%C3%AFve'),
+])
+def test_client_url_escapes_names(fname, expected) -> None:
+    c = pyclient.Client(server_url=SERVER_URL)
+    assert c._url('check_data', fname) == f'{CHECK_DATA_URL}/{expected}'
@@ -0,0 +1,238 @@
+package rsbackup
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+)
+
+var errQuotaExceeded = errors.New("Quota exceeded")
+
+type quotaObject struct {
+	Namespace string `json:"namespace"`
+	Bytes     int64  `json:"bytes"`
+}
+
+// QuotaStore tracks the bytes, data and parity, stored by each namespace
+// and keeps them within the quotas from the config. The namespace of a
+// file is the name of the credential that stored it. Which namespace owns
+// which file is persisted in a json file, files stored while quotas were
+// disabled are not counted.
+type QuotaStore struct {
+	mu           sync.Mutex
+	path         string
+	limits       map[string]Size
+	defaultLimit Size
+	objects      map[string]quotaObject
+	usage        map[string]int64
+}
+
+func NewQuotaStore(fpath string, config *Config) (*QuotaStore, error) {
+	q := &QuotaStore{
+		path:         fpath,
+		limits:       config.Quotas,
+		defaultLimit: config.DefaultQuota,
+		objects:      make(map[string]quotaObject),
+		usage:        make(map[string]int64),
+	}
+	err := readJSONState(fpath, &q.objects)
+	if err != nil {
+		return nil, err
+	}
+	for _, object := range q.objects {
+		q.usage[object.Namespace] += object.Bytes
+	}
+	return q, nil
+}
+
+// Limit returns the quota of namespace in bytes, 0 means no limit.
+func (q *QuotaStore) Limit(namespace string) int64 {
+	if limit, ok := q.limits[namespace]; ok {
+		return int64(limit)
+	}
+	return int64(q.defaultLimit)
+}
+
+func (q *QuotaStore) Usage(namespace string) int64 {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.usage[namespace]
+}
+
+// Charge records that namespace stored bytes as fname, unless that takes
+// namespace over its quota.
+func (q *QuotaStore) Charge(namespace, fname string, bytes int64) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if limit := q.Limit(namespace); limit > 0 && q.usage[namespace]+bytes > limit {
+		return errQuotaExceeded
+	}
+	q.objects[fname] = quotaObject{Namespace: namespace, Bytes: bytes}
+	q.usage[namespace] += bytes
+	err := writeJSONState(q.path, q.objects)
+	if err != nil {
+		delete(q.objects, fname)
+		q.usage[namespace] -= bytes
+	}
+	return err
+}
+
+// Release gives the bytes of fname back to the namespace that stored it.
+func (q *QuotaStore) Release(fname string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	object, ok := q.objects[fname]
+	if !ok {
+		return nil
+	}
+	delete(q.objects, fname)
+	q.usage[object.Namespace] -= object.Bytes
+	err := writeJSONState(q.path, q.objects)
+	if err != nil {
+		q.objects[fname] = object
+		q.usage[object.Namespace] += object.Bytes
+	}
+	return err
+}
+
+// Move keeps charging the bytes of from to its namespace after it was
+// renamed to to.
+func (q *QuotaStore) Move(from, to string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	object, ok := q.objects[from]
+	if !ok {
+		return nil
+	}
+	delete(q.objects, from)
+	q.objects[to] = object
+	return writeJSONState(q.path, q.objects)
+}
+
+// requestNamespace returns the namespace files stored by r are charged to.
+func requestNamespace(r *http.Request) string {
+	if token, ok := requestToken(r); ok {
+		return token.Name
+	}
+	return "anonymous"
+}
+
+type quotaRsp struct {
+	Error     string `json:"error,omitempty"`
+	Namespace string `json:"namespace"`
+	Usage     int64  `json:"usage"`
+	Limit     int64  `json:"limit"`
+	Requested int64  `json:"requested,omitempty"`
+}
+
+func (rs *RSBackupAPI) quotaExceeded(w http.ResponseWriter, r *http.Request, namespace string, requested int64) {
+	rsp := &quotaRsp{
+		Error:     errQuotaExceeded.Error(),
+		Namespace: namespace,
+		Usage:     rs.Quotas.Usage(namespace),
+		Limit:     rs.Quotas.Limit(namespace),
+		Requested: requested,
+	}
+	rs.Errorf(r, "Storing %d bytes takes '%s' over its quota, %d of %d bytes used", requested, namespace, rsp.Usage, rsp.Limit)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusInsufficientStorage)
+	err := json.NewEncoder(w).Encode(rsp)
+	if err != nil {
+		rs.Errorf(r, "Unable to marshal json response: %s", err)
+	}
+}
+
+// checkQuota rejects a request up front when storing the bytes it declares
+// would take its namespace over quota. It reports whether to go on.
+func (rs *RSBackupAPI) checkQuota(w http.ResponseWriter, r *http.Request, bytes int64) bool {
+	if rs.Quotas == nil || bytes <= 0 {
+		return true
+	}
+	namespace := requestNamespace(r)
+	limit := rs.Quotas.Limit(namespace)
+	if limit > 0 && rs.Quotas.Usage(namespace)+bytes > limit {
+		rs.quotaExceeded(w, r, namespace, bytes)
+		return false
+	}
+	return true
+}
+
+// storedSize returns the bytes taken by the data file at fpath with its
+// metadata and parity.
+func storedSize(storage StorageBackend, fpath string) int64 {
+	var bytes int64
+	for _, suffix := range objectSuffixes(storage, fpath) {
+		if fi, err := storage.Stat(fpath + suffix); err == nil {
+			bytes += fi.Size()
+		}
+	}
+	return bytes
+}
+
+// chargeQuota charges the files just stored for fname to the namespace of
+// r. When they don't fit the quota they are removed again and the request
+// is rejected. It reports whether to go on.
+func (rs *RSBackupAPI) chargeQuota(w http.ResponseWriter, r *http.Request, fname string) bool {
+	if rs.Quotas == nil {
+		return true
+	}
+	storage := rs.RsFileMan.storage()
+	fpath := rs.RsFileMan.DataPath(fname)
+	suffixes := objectSuffixes(storage, fpath)
+	bytes := storedSize(storage, fpath)
+	extras, _ := rs.RsFileMan.ReadExtras(fpath)
+	if extras.Dedup != nil {
+		// Chunks other files share are charged to whoever stored them first.
+		bytes += extras.Dedup.Stored
+	}
+	if extras.Packed != nil {
+		// Its share of the container and the container's parity.
+		shards := int64(rs.Config.DataShards + rs.Config.ParityShards)
+		bytes += extras.Packed.Size * shards / int64(rs.Config.DataShards)
+	}
+	if stat, err := storage.Stat(fpath); err == nil && extras.ParityPending {
+		// The parity the job is yet to generate.
+		dataShards, parityShards := rs.Config.protection(&extras, stat.Size())
+		bytes += (stat.Size() + int64(dataShards) - 1) / int64(dataShards) * int64(parityShards)
+	}
+	namespace := requestNamespace(r)
+	err := rs.Quotas.Charge(namespace, fname, bytes)
+	if err == nil {
+		return true
+	}
+	shared, _ := rs.RsFileMan.readShared(fpath)
+	// The data file goes first, so nothing lists a file without parity.
+	for i := len(suffixes) - 1; i >= 0; i-- {
+		storage.Remove(fpath + suffixes[i])
+	}
+	rs.RsFileMan.releaseShared(shared, false)
+	rs.RsFileMan.unindex(fname)
+	if err == errQuotaExceeded {
+		rs.quotaExceeded(w, r, namespace, bytes)
+		return false
+	}
+	rs.Errorf(r, "Unable to charge %s to '%s': %s", fname, namespace, err)
+	http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+	return false
+}
+
+// quotaHandler reports the usage and quota of the caller's namespace.
+func (rs *RSBackupAPI) quotaHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		rs.Errorf(r, "Bad method %s", r.Method)
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	namespace := requestNamespace(r)
+	rsp := &quotaRsp{
+		Namespace: namespace,
+		Usage:     rs.Quotas.Usage(namespace),
+		Limit:     rs.Quotas.Limit(namespace),
+	}
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(rsp)
+	if err != nil {
+		rs.Errorf(r, "Unable to marshal json response: %s", err)
+	}
+}
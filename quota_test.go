@@ -0,0 +1,138 @@
+package rsbackup
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestQuotaStore(t *testing.T) {
+	quotasPath := path.Join(createTMPDir(t, "rsbackup"), "quotas.json")
+	config := &Config{Quotas: map[string]Size{"small": 100}, DefaultQuota: 1000}
+	quotas, err := NewQuotaStore(quotasPath, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if quotas.Limit("small") != 100 || quotas.Limit("other") != 1000 {
+		t.Errorf("Got limits %d and %d, expected 100 and 1000", quotas.Limit("small"), quotas.Limit("other"))
+	}
+	err = quotas.Charge("small", "a", 60)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = quotas.Charge("small", "b", 60)
+	if err != errQuotaExceeded {
+		t.Errorf("Got error '%v', expected '%s'", err, errQuotaExceeded)
+	}
+	err = quotas.Charge("other", "b", 60)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Usage survives restarts.
+	quotas, err = NewQuotaStore(quotasPath, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if quotas.Usage("small") != 60 || quotas.Usage("other") != 60 {
+		t.Errorf("Got usage %d and %d after reload, expected 60 and 60", quotas.Usage("small"), quotas.Usage("other"))
+	}
+	err = quotas.Release("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if quotas.Usage("small") != 0 {
+		t.Errorf("Got usage %d after release, expected 0", quotas.Usage("small"))
+	}
+}
+
+func TestSubmitDataQuota(t *testing.T) {
+	tmpDir := createTMPDir(t, "rsbackup")
+	config := &Config{
+		BackupRoot:   tmpDir,
+		DataShards:   2,
+		ParityShards: 1,
+		Quotas:       map[string]Size{"agent": 2500},
+	}
+	quotas, err := NewQuotaStore(config.StatePath("quotas.json"), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	api := &RSBackupAPI{Config: config, RsFileMan: &RSFileManager{Config: config}, Quotas: quotas}
+	data, err := ioutil.ReadFile("testdata/tyger")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	submit := func(token, fname string, declareLength bool) *httptest.ResponseRecorder {
+		body := new(bytes.Buffer)
+		mw := multipart.NewWriter(body)
+		fw, err := mw.CreateFormFile("file", fname)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fw.Write(data)
+		mw.WriteField("filename", fname)
+		mw.Close()
+		req := httptest.NewRequest("POST", "/submit_data", body)
+		req.Header.Set("Content-Type", mw.FormDataContentType())
+		if !declareLength {
+			req.ContentLength = -1
+		}
+		req = req.WithContext(context.WithValue(req.Context(), tokenContextKey, APIToken{Name: token}))
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(api.submitDataHandler).ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := submit("agent", "first", true)
+	if rr.Code != 200 {
+		t.Fatalf("Got status code %d, expected 200: %s", rr.Code, rr.Body)
+	}
+	used := quotas.Usage("agent")
+	if used < int64(len(data))*3/2 {
+		t.Errorf("Got usage %d, expected at least the %d bytes of data and parity", used, len(data)*3/2)
+	}
+
+	// The declared size is too much already.
+	rr = submit("agent", "second", true)
+	if rr.Code != http.StatusInsufficientStorage {
+		t.Fatalf("Got status code %d, expected 507", rr.Code)
+	}
+	var rsp quotaRsp
+	err = json.NewDecoder(rr.Body).Decode(&rsp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rsp.Namespace != "agent" || rsp.Usage != used || rsp.Limit != 2500 || rsp.Requested == 0 {
+		t.Errorf("Unexpected quota response %+v", rsp)
+	}
+
+	// Without a declared size the files are stored, found to be too much
+	// and removed again.
+	rr = submit("agent", "second", false)
+	if rr.Code != http.StatusInsufficientStorage {
+		t.Fatalf("Got status code %d, expected 507", rr.Code)
+	}
+	for _, suffix := range []string{"", ".md", ".parity.1"} {
+		if _, err := os.Stat(path.Join(tmpDir, "second"+suffix)); err == nil {
+			t.Errorf("second%s left behind after exceeding the quota", suffix)
+		}
+	}
+	if quotas.Usage("agent") != used {
+		t.Errorf("Got usage %d after rejected upload, expected %d", quotas.Usage("agent"), used)
+	}
+
+	// Other namespaces have no quota.
+	rr = submit("other", "second", true)
+	if rr.Code != 200 {
+		t.Errorf("Got status code %d, expected 200", rr.Code)
+	}
+}
@@ -0,0 +1,242 @@
+package rsbackup
+
+import (
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// maxBudgets is how many client budgets are kept. Beyond it the ones that
+// have refilled completely are dropped, and failing that the one used
+// longest ago.
+const maxBudgets = 1024
+
+// clientBudget holds the requests and bytes a client may still use. Bytes
+// can go negative: transfers pause until the debt has refilled.
+type clientBudget struct {
+	requests float64
+	bytes    float64
+	updated  time.Time
+}
+
+// rateLimiter is a token bucket per client for requests and one for bytes
+// transferred in either direction. A zero rate disables that bucket.
+type rateLimiter struct {
+	mu           sync.Mutex
+	requestRate  float64
+	requestBurst float64
+	byteRate     float64
+	budgets      map[string]*clientBudget
+	now          func() time.Time
+	sleep        func(d time.Duration, stop <-chan struct{})
+}
+
+// newRateLimiter returns nil, which limits nothing, unless the config sets
+// a request rate or bandwidth.
+func newRateLimiter(c *Config) *rateLimiter {
+	if c.RateLimitRequests <= 0 && c.RateLimitBandwidth <= 0 {
+		return nil
+	}
+	burst := float64(c.RateLimitBurst)
+	if burst < 1 {
+		burst = math.Max(1, c.RateLimitRequests)
+	}
+	return &rateLimiter{
+		requestRate:  c.RateLimitRequests,
+		requestBurst: burst,
+		byteRate:     float64(c.RateLimitBandwidth),
+		budgets:      make(map[string]*clientBudget),
+		now:          time.Now,
+		sleep: func(d time.Duration, stop <-chan struct{}) {
+			timer := time.NewTimer(d)
+			defer timer.Stop()
+			select {
+			case <-timer.C:
+			case <-stop:
+			}
+		},
+	}
+}
+
+// refill must be called with l.mu held.
+func (l *rateLimiter) refill(client string, now time.Time) *clientBudget {
+	b, ok := l.budgets[client]
+	if !ok {
+		if len(l.budgets) >= maxBudgets {
+			l.dropIdle(now)
+		}
+		b = &clientBudget{requests: l.requestBurst, bytes: l.byteRate, updated: now}
+		l.budgets[client] = b
+		return b
+	}
+	elapsed := now.Sub(b.updated).Seconds()
+	b.requests = math.Min(l.requestBurst, b.requests+elapsed*l.requestRate)
+	b.bytes = math.Min(l.byteRate, b.bytes+elapsed*l.byteRate)
+	b.updated = now
+	return b
+}
+
+// dropIdle must be called with l.mu held.
+func (l *rateLimiter) dropIdle(now time.Time) {
+	oldest := ""
+	for client, b := range l.budgets {
+		elapsed := now.Sub(b.updated).Seconds()
+		if b.requests+elapsed*l.requestRate >= l.requestBurst && b.bytes+elapsed*l.byteRate >= l.byteRate {
+			delete(l.budgets, client)
+		} else if oldest == "" || b.updated.Before(l.budgets[oldest].updated) {
+			oldest = client
+		}
+	}
+	if len(l.budgets) >= maxBudgets {
+		delete(l.budgets, oldest)
+	}
+}
+
+// take spends a request from the budget of client. When the budget is
+// exhausted it returns how long until the client may try again.
+func (l *rateLimiter) take(client string) (time.Duration, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b := l.refill(client, l.now())
+	var wait float64
+	if l.requestRate > 0 && b.requests < 1 {
+		wait = (1 - b.requests) / l.requestRate
+	}
+	if l.byteRate > 0 && b.bytes < 0 {
+		wait = math.Max(wait, -b.bytes/l.byteRate)
+	}
+	if wait > 0 {
+		return time.Duration(wait * float64(time.Second)), false
+	}
+	if l.requestRate > 0 {
+		b.requests--
+	}
+	return 0, true
+}
+
+// pay charges client for n bytes transferred and, once the client is in
+// debt, waits until it's repaid or until stop is closed.
+func (l *rateLimiter) pay(client string, n int, stop <-chan struct{}) {
+	if l.byteRate <= 0 || n == 0 {
+		return
+	}
+	l.mu.Lock()
+	b := l.refill(client, l.now())
+	b.bytes -= float64(n)
+	debt := -b.bytes
+	l.mu.Unlock()
+	if debt > 0 {
+		l.sleep(time.Duration(debt/l.byteRate*float64(time.Second)), stop)
+	}
+}
+
+// piece returns how many of n bytes to transfer before paying for them, at
+// most a second's worth so transfers don't burst beyond that.
+func (l *rateLimiter) piece(n int) int {
+	if l.byteRate > 0 && float64(n) > l.byteRate {
+		return int(math.Max(1, l.byteRate))
+	}
+	return n
+}
+
+type countingReadCloser struct {
+	io.ReadCloser
+	n int64
+}
+
+func (r *countingReadCloser) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
+// pacedReadCloser paces the reads of a request body to the bandwidth of
+// its client.
+type pacedReadCloser struct {
+	io.ReadCloser
+	limiter *rateLimiter
+	client  string
+	stop    <-chan struct{}
+}
+
+func (r *pacedReadCloser) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p[:r.limiter.piece(len(p))])
+	r.limiter.pay(r.client, n, r.stop)
+	return n, err
+}
+
+// pacedResponseWriter paces the writes of a response to the bandwidth of
+// its client.
+type pacedResponseWriter struct {
+	http.ResponseWriter
+	limiter *rateLimiter
+	client  string
+	stop    <-chan struct{}
+}
+
+func (w *pacedResponseWriter) Write(b []byte) (int, error) {
+	written := 0
+	for written < len(b) {
+		n, err := w.ResponseWriter.Write(b[written : written+w.limiter.piece(len(b)-written)])
+		written += n
+		w.limiter.pay(w.client, n, w.stop)
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// ReadFrom keeps sendfile for clients without a bandwidth to keep to.
+func (w *pacedResponseWriter) ReadFrom(src io.Reader) (int64, error) {
+	if w.limiter.byteRate <= 0 {
+		return io.Copy(w.ResponseWriter, src)
+	}
+	return io.Copy(struct{ io.Writer }{w}, src)
+}
+
+func (w *pacedResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *pacedResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// rateLimitKey identifies the client a request is charged to: its
+// credential when it has one, otherwise its address.
+func (rs *RSBackupAPI) rateLimitKey(r *http.Request) string {
+	if token, ok := requestToken(r); ok {
+		return "token:" + token.Name
+	}
+	return "ip:" + rs.clientIP(r)
+}
+
+// rateLimited refuses requests from clients that have run out of requests
+// or bandwidth with 429 Too Many Requests and a Retry-After header, and
+// paces the bodies of the requests it lets through, and their responses,
+// to the bandwidth. A nil limiter lets everything through.
+func (rs *RSBackupAPI) rateLimited(limiter *rateLimiter, next http.HandlerFunc) http.HandlerFunc {
+	if limiter == nil {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		client := rs.rateLimitKey(r)
+		wait, ok := limiter.take(client)
+		if !ok {
+			retryAfter := int(math.Ceil(wait.Seconds()))
+			rs.Errorf(r, "Rate limit of %s exceeded for %s %s, retry in %ds", client, r.Method, r.URL.Path, retryAfter)
+			w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+			http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+			return
+		}
+		stop := r.Context().Done()
+		r.Body = &pacedReadCloser{ReadCloser: r.Body, limiter: limiter, client: client, stop: stop}
+		next(&pacedResponseWriter{ResponseWriter: w, limiter: limiter, client: client, stop: stop}, r)
+	}
+}
@@ -0,0 +1,104 @@
+package rsbackup
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRateLimited(t *testing.T) {
+	now := time.Unix(1000, 0)
+	limiter := newRateLimiter(&Config{RateLimitRequests: 1, RateLimitBurst: 2, RateLimitBandwidth: 100})
+	limiter.now = func() time.Time { return now }
+	var slept time.Duration
+	limiter.sleep = func(d time.Duration, stop <-chan struct{}) {
+		slept += d
+		now = now.Add(d)
+	}
+	api := &RSBackupAPI{Config: &Config{}}
+	handler := api.rateLimited(limiter, func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(ioutil.Discard, r.Body)
+		w.Write([]byte("ok"))
+	})
+	request := func(remoteAddr, token, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/submit_data", strings.NewReader(body))
+		req.RemoteAddr = remoteAddr
+		if token != "" {
+			req = req.WithContext(context.WithValue(req.Context(), tokenContextKey, APIToken{Name: token}))
+		}
+		rr := httptest.NewRecorder()
+		handler(rr, req)
+		return rr
+	}
+
+	for i := 0; i < 2; i++ {
+		if rr := request("10.0.0.1:4242", "", ""); rr.Code != 200 {
+			t.Fatalf("Request %d within burst got status code %d", i, rr.Code)
+		}
+	}
+	rr := request("10.0.0.1:4242", "", "")
+	if rr.Code != http.StatusTooManyRequests || rr.Header().Get("Retry-After") != "1" {
+		t.Errorf("Got status code %d and Retry-After '%s', expected 429 and 1", rr.Code, rr.Header().Get("Retry-After"))
+	}
+	if rr := request("10.0.0.2:4242", "", ""); rr.Code != 200 {
+		t.Errorf("Other address limited, got status code %d", rr.Code)
+	}
+	// A token has one budget whichever address it comes from.
+	if rr := request("10.0.0.1:4242", "agent", ""); rr.Code != 200 {
+		t.Errorf("Token limited by its address, got status code %d", rr.Code)
+	}
+	now = now.Add(time.Second)
+	if rr := request("10.0.0.1:4242", "", ""); rr.Code != 200 {
+		t.Errorf("Budget not refilled, got status code %d", rr.Code)
+	}
+
+	// 300 bytes up and 2 down at 100 bytes/s, with a burst of 100 bytes,
+	// take the transfer 2.02s.
+	if rr := request("10.0.0.3:4242", "", strings.Repeat("x", 300)); rr.Code != 200 {
+		t.Fatalf("Large upload got status code %d", rr.Code)
+	}
+	if slept != 2020*time.Millisecond {
+		t.Errorf("Transfer paused for %s, expected 2.02s", slept)
+	}
+	if rr := request("10.0.0.3:4242", "", ""); rr.Code != 200 {
+		t.Errorf("Bandwidth debt not repaid while transferring, got status code %d", rr.Code)
+	}
+
+	// Debt from transfers running at the same time refuses requests.
+	limiter.sleep = func(time.Duration, <-chan struct{}) {}
+	limiter.pay("ip:10.0.0.4", 300, nil)
+	rr = request("10.0.0.4:4242", "", "")
+	if rr.Code != http.StatusTooManyRequests || rr.Header().Get("Retry-After") != "2" {
+		t.Errorf("Got status code %d and Retry-After '%s', expected 429 and 2", rr.Code, rr.Header().Get("Retry-After"))
+	}
+}
+
+func TestRateLimiterBudgetsBounded(t *testing.T) {
+	limiter := newRateLimiter(&Config{RateLimitRequests: 1, RateLimitBurst: 1})
+	for i := 0; i < maxBudgets+100; i++ {
+		if _, ok := limiter.take(fmt.Sprintf("ip:10.0.%d.%d", i/256, i%256)); !ok {
+			t.Fatalf("Client %d refused", i)
+		}
+	}
+	if len(limiter.budgets) > maxBudgets {
+		t.Errorf("Kept %d budgets, at most %d expected", len(limiter.budgets), maxBudgets)
+	}
+}
+
+func TestNewRateLimiterDisabled(t *testing.T) {
+	if newRateLimiter(&Config{}) != nil {
+		t.Errorf("Got a rate limiter without limits")
+	}
+	called := false
+	handler := (&RSBackupAPI{Config: &Config{}}).rateLimited(nil, func(w http.ResponseWriter, r *http.Request) { called = true })
+	handler(httptest.NewRecorder(), httptest.NewRequest("GET", "/list_data", nil))
+	if !called {
+		t.Errorf("Request not passed through")
+	}
+}
@@ -0,0 +1,342 @@
+package rsbackup
+
+import (
+	"bytes"
+	"container/list"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultCacheMaxObject   = 64 << 20
+	defaultCacheVerifiedFor = 10 * time.Minute
+	// maxVerifiedObjects bounds how many intact files are remembered.
+	maxVerifiedObjects = 100000
+)
+
+var errChangedWhileCached = errors.New("File changed while it was cached")
+
+// cachedObject is a stored file kept by a cacheTier, valid for as long as
+// the file has the size and modification time it had when cached.
+type cachedObject struct {
+	fpath   string
+	size    int64
+	modTime time.Time
+	// data holds the contents in memory, file is where they're kept on
+	// disk otherwise.
+	data []byte
+	file string
+}
+
+func (o *cachedObject) matches(stat os.FileInfo) bool {
+	return o.size == stat.Size() && o.modTime.Equal(stat.ModTime())
+}
+
+// cacheTier keeps up to limit bytes of stored files, the least recently
+// retrieved evicted first, in memory or, with dir set, in files in dir.
+type cacheTier struct {
+	name    string
+	dir     string
+	limit   int64
+	size    int64
+	hits    int64
+	entries map[string]*list.Element
+	order   *list.List
+}
+
+func newCacheTier(name, dir string, limit int64) *cacheTier {
+	return &cacheTier{name: name, dir: dir, limit: limit, entries: make(map[string]*list.Element), order: list.New()}
+}
+
+func (t *cacheTier) remove(elem *list.Element) {
+	obj := elem.Value.(*cachedObject)
+	delete(t.entries, obj.fpath)
+	t.order.Remove(elem)
+	t.size -= obj.size
+	if obj.file != "" {
+		// Readers still holding it open keep reading it.
+		os.Remove(obj.file)
+	}
+}
+
+func (t *cacheTier) insert(obj *cachedObject) {
+	if elem, ok := t.entries[obj.fpath]; ok {
+		t.remove(elem)
+	}
+	t.entries[obj.fpath] = t.order.PushFront(obj)
+	t.size += obj.size
+	for t.size > t.limit {
+		t.remove(t.order.Back())
+	}
+}
+
+// open returns a reader of fpath if the tier has it as stat describes it.
+// What it has of an older version of the file is dropped.
+func (t *cacheTier) open(fpath string, stat os.FileInfo) readerAtCloser {
+	elem, ok := t.entries[fpath]
+	if !ok {
+		return nil
+	}
+	obj := elem.Value.(*cachedObject)
+	if !obj.matches(stat) {
+		t.remove(elem)
+		return nil
+	}
+	if obj.data != nil {
+		t.order.MoveToFront(elem)
+		t.hits++
+		return cachedData{bytes.NewReader(obj.data)}
+	}
+	f, err := os.Open(obj.file)
+	if err != nil {
+		log.Warnf("Dropping '%s' from the read cache: %s", fpath, err)
+		t.remove(elem)
+		return nil
+	}
+	t.order.MoveToFront(elem)
+	t.hits++
+	return f
+}
+
+type readerAtCloser interface {
+	io.ReaderAt
+	io.Closer
+}
+
+// cachedData reads contents cached in memory.
+type cachedData struct {
+	*bytes.Reader
+}
+
+func (cachedData) Close() error {
+	return nil
+}
+
+// verifiedObject is a data file found intact at a time, with the size and
+// modification time it had then.
+type verifiedObject struct {
+	size    int64
+	modTime time.Time
+	at      time.Time
+}
+
+// ReadCache keeps the contents of recently retrieved files in memory, on a
+// local disk, or both, which cuts the latency of repeated retrievals from
+// remote storage. A cached file is served as long as the stored one has
+// the same size and modification time, so files replaced or repaired
+// since are read again. It also remembers the files retrievals with
+// verify=true found intact, so they needn't be checked again right away.
+// A nil ReadCache caches nothing.
+type ReadCache struct {
+	mu          sync.Mutex
+	memory      *cacheTier
+	disk        *cacheTier
+	maxObject   int64
+	misses      int64
+	verifiedFor time.Duration
+	verified    map[string]verifiedObject
+}
+
+// NewReadCache sets up the cache of config, nil if it has none. What a
+// previous run left in CacheDir is removed, it may be stale by now.
+func NewReadCache(config *Config) (*ReadCache, error) {
+	if config.CacheMemory <= 0 && config.CacheDir == "" {
+		return nil, nil
+	}
+	c := &ReadCache{
+		maxObject:   defaultCacheMaxObject,
+		verifiedFor: defaultCacheVerifiedFor,
+		verified:    make(map[string]verifiedObject),
+	}
+	if config.CacheMaxObject > 0 {
+		c.maxObject = int64(config.CacheMaxObject)
+	}
+	if config.CacheVerifiedFor != 0 {
+		c.verifiedFor = config.CacheVerifiedFor
+	}
+	if config.CacheMemory > 0 {
+		c.memory = newCacheTier("memory", "", int64(config.CacheMemory))
+	}
+	if config.CacheDir != "" {
+		dir := path.Join(config.CacheDir, "objects")
+		if err := os.RemoveAll(dir); err != nil {
+			return nil, err
+		}
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return nil, err
+		}
+		c.disk = newCacheTier("disk", dir, int64(config.CacheDirSize))
+	}
+	return c, nil
+}
+
+func (c *ReadCache) tiers() []*cacheTier {
+	var tiers []*cacheTier
+	for _, t := range []*cacheTier{c.memory, c.disk} {
+		if t != nil {
+			tiers = append(tiers, t)
+		}
+	}
+	return tiers
+}
+
+// open returns a reader of the stored file at fpath and its size, from
+// the cache, which takes the file first if it has room for it. It returns
+// a nil reader for files it doesn't cache.
+func (c *ReadCache) open(storage StorageBackend, fpath string) (readerAtCloser, int64, error) {
+	if c == nil {
+		return nil, 0, nil
+	}
+	stat, err := storage.Stat(fpath)
+	if err != nil {
+		return nil, 0, err
+	}
+	size := stat.Size()
+	c.mu.Lock()
+	for _, t := range c.tiers() {
+		if f := t.open(fpath, stat); f != nil {
+			c.mu.Unlock()
+			return f, size, nil
+		}
+	}
+	c.misses++
+	c.mu.Unlock()
+	fitsMemory := c.memory != nil && size <= c.memory.limit
+	fitsDisk := c.disk != nil && size <= c.disk.limit
+	if size == 0 || size > c.maxObject || (!fitsMemory && !fitsDisk) {
+		return nil, 0, nil
+	}
+	f, err := c.fill(storage, fpath, stat, fitsMemory, fitsDisk)
+	if err != nil {
+		// Served from storage, the cache is only a shortcut.
+		log.Warnf("Unable to cache '%s': %s", fpath, err)
+		return nil, 0, nil
+	}
+	return f, size, nil
+}
+
+// fill reads the stored file at fpath into the tiers it fits, and returns
+// a reader of the copy.
+func (c *ReadCache) fill(storage StorageBackend, fpath string, stat os.FileInfo, fitsMemory, fitsDisk bool) (readerAtCloser, error) {
+	in, err := storage.Open(fpath)
+	if err != nil {
+		return nil, err
+	}
+	defer in.Close()
+	obj := &cachedObject{fpath: fpath, size: stat.Size(), modTime: stat.ModTime()}
+	var src io.Reader = in
+	if fitsMemory {
+		obj.data, err = ioutil.ReadAll(io.LimitReader(in, obj.size+1))
+		if err == nil && int64(len(obj.data)) != obj.size {
+			err = errChangedWhileCached
+		}
+		if err != nil {
+			return nil, err
+		}
+		src = bytes.NewReader(obj.data)
+	}
+	var cached *os.File
+	if fitsDisk {
+		cached, err = ioutil.TempFile(c.disk.dir, "object")
+		if err != nil {
+			return nil, err
+		}
+		var n int64
+		n, err = io.Copy(cached, io.LimitReader(src, obj.size+1))
+		if err == nil && n != obj.size {
+			err = errChangedWhileCached
+		}
+		if err != nil {
+			cached.Close()
+			os.Remove(cached.Name())
+			return nil, err
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if cached != nil {
+		c.disk.insert(&cachedObject{fpath: fpath, size: obj.size, modTime: obj.modTime, file: cached.Name()})
+	}
+	if obj.data != nil {
+		c.memory.insert(obj)
+		if cached != nil {
+			cached.Close()
+		}
+		return cachedData{bytes.NewReader(obj.data)}, nil
+	}
+	return cached, nil
+}
+
+// verifiedIntact reports whether the data file at fpath, as stat
+// describes it, was found intact within Config.CacheVerifiedFor.
+func (c *ReadCache) verifiedIntact(fpath string, stat os.FileInfo) bool {
+	if c == nil || c.verifiedFor < 0 {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	v, ok := c.verified[fpath]
+	return ok && v.size == stat.Size() && v.modTime.Equal(stat.ModTime()) && time.Since(v.at) < c.verifiedFor
+}
+
+func (c *ReadCache) markIntact(fpath string, stat os.FileInfo) {
+	if c == nil || c.verifiedFor < 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	if len(c.verified) >= maxVerifiedObjects {
+		for fpath, v := range c.verified {
+			if now.Sub(v.at) >= c.verifiedFor {
+				delete(c.verified, fpath)
+			}
+		}
+		if len(c.verified) >= maxVerifiedObjects {
+			return
+		}
+	}
+	c.verified[fpath] = verifiedObject{size: stat.Size(), modTime: stat.ModTime(), at: now}
+}
+
+// cacheStats are the bytes cached and hits of a tier.
+type cacheStats struct {
+	tier  string
+	bytes int64
+	limit int64
+	hits  int64
+}
+
+func (c *ReadCache) stats() ([]cacheStats, int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var stats []cacheStats
+	for _, t := range c.tiers() {
+		stats = append(stats, cacheStats{tier: t.name, bytes: t.size, limit: t.limit, hits: t.hits})
+	}
+	return stats, c.misses
+}
+
+// checkShards is DamagedShards, skipped for data files found intact
+// within Config.CacheVerifiedFor and unchanged since. It reports whether
+// it checked them.
+func (r *RSFileManager) checkShards(fname string) ([]int, bool, error) {
+	fpath := r.DataPath(fname)
+	stat, err := r.storage().Stat(fpath)
+	if err == nil && r.Cache.verifiedIntact(fpath, stat) {
+		return nil, false, nil
+	}
+	damaged, err := r.DamagedShards(fname)
+	if err == nil && stat != nil && len(damaged) == 0 {
+		r.Cache.markIntact(fpath, stat)
+	}
+	return damaged, true, err
+}
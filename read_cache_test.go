@@ -0,0 +1,127 @@
+package rsbackup
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadCache(t *testing.T) {
+	config := &Config{
+		BackupRoot:     createTMPDir(t, "rsbackup"),
+		DataShards:     2,
+		ParityShards:   1,
+		CacheMemory:    3000,
+		CacheDir:       createTMPDir(t, "rsbackup-cache"),
+		CacheDirSize:   10000,
+		CacheMaxObject: 4000,
+	}
+	cache, err := NewReadCache(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fm := &RSFileManager{Config: config, Cache: cache}
+	store := func(fname, content string) {
+		t.Helper()
+		fpath := fm.DataPath(fname)
+		os.Remove(fpath)
+		if err := ioutil.WriteFile(fpath, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	retrieve := func(fname string) (string, bool) {
+		t.Helper()
+		content, file, _, err := fm.openContents(fname)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer file.Close()
+		b, err := ioutil.ReadAll(content)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, onDisk := file.(*os.File)
+		return string(b), onDisk
+	}
+	hits := func() (int64, int64, int64) {
+		tiers, misses := cache.stats()
+		return tiers[0].hits, tiers[1].hits, misses
+	}
+
+	tyger := strings.Repeat("tyger ", 400)
+	store("tyger", tyger)
+	for i := 0; i < 3; i++ {
+		if content, _ := retrieve("tyger"); content != tyger {
+			t.Fatalf("Got '%s' retrieving a cached file", content)
+		}
+	}
+	if memory, disk, misses := hits(); memory != 2 || disk != 0 || misses != 1 {
+		t.Errorf("Got %d memory hits, %d disk hits and %d misses", memory, disk, misses)
+	}
+
+	// A file replaced since is read again.
+	lamb := strings.Repeat("little lamb ", 200)
+	store("tyger", lamb)
+	if content, _ := retrieve("tyger"); content != lamb {
+		t.Errorf("Got '%s' retrieving a replaced file", content)
+	}
+
+	// Files too large for memory are kept on disk, and served from there
+	// once evicted from memory.
+	rose := strings.Repeat("o rose thou art sick ", 160)
+	store("rose", rose)
+	for i := 0; i < 2; i++ {
+		if content, onDisk := retrieve("rose"); content != rose || !onDisk {
+			t.Errorf("Got '%s' from disk: %t retrieving a file too large for memory", content, onDisk)
+		}
+	}
+	store("fly", strings.Repeat("fly ", 700))
+	retrieve("fly")
+	if content, onDisk := retrieve("tyger"); content != lamb || !onDisk {
+		t.Errorf("Got '%s' from disk: %t retrieving a file evicted from memory", content, onDisk)
+	}
+	before, _ := cache.stats()
+	if before[0].bytes > 3000 || before[1].bytes > 10000 {
+		t.Errorf("Got %+v, more than the cache holds", before)
+	}
+	big := strings.Repeat("x", 4001)
+	store("big", big)
+	content, _ := retrieve("big")
+	after, _ := cache.stats()
+	if content != big || after[0].bytes != before[0].bytes || after[1].bytes != before[1].bytes {
+		t.Errorf("Expected a file larger than CacheMaxObject read from storage and left out")
+	}
+}
+
+func TestVerifiedCache(t *testing.T) {
+	config := &Config{BackupRoot: createTMPDir(t, "rsbackup"), DataShards: 2, ParityShards: 1, CacheMemory: 1 << 20}
+	cache, err := NewReadCache(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fm := &RSFileManager{Config: config, Cache: cache}
+	api := &RSBackupAPI{Config: config, RsFileMan: fm}
+	fpath := fm.DataPath("tyger")
+	if err := ioutil.WriteFile(fpath, []byte("tyger tyger burning bright"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	md, err := api.generateParity(fm.storage(), fpath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fm.WriteMetadata("tyger", md, MetadataExtras{}); err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range []bool{true, false} {
+		if damaged, checked, err := fm.checkShards("tyger"); err != nil || len(damaged) != 0 || checked != want {
+			t.Errorf("Got damaged shards %v, checked %t (error: %v) on check %d", damaged, checked, err, i)
+		}
+	}
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(fpath, later, later)
+	if _, checked, _ := fm.checkShards("tyger"); !checked {
+		t.Errorf("Expected a file changed since checked again")
+	}
+}
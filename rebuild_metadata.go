@@ -0,0 +1,224 @@
+package rsbackup
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/sirmackk/rsutils"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	errMetadataIntact = errors.New("Metadata is intact")
+	// errShardsUnknown is returned when no shard counts produce the
+	// parity left, because the data or every parity shard is damaged.
+	errShardsUnknown = errors.New("Unable to derive the shard counts from the parity left")
+)
+
+// shardCandidates returns the numbers of data shards a file of size bytes
+// may have been split into, with parity shards of shardSize bytes. Those
+// configured come first.
+func (c *Config) shardCandidates(size, shardSize int64, parityShards int) []int {
+	var candidates []int
+	seen := make(map[int]bool)
+	add := func(dataShards int) {
+		if dataShards < 1 || seen[dataShards] || dataShards+parityShards > 256 {
+			return
+		}
+		seen[dataShards] = true
+		if (size+int64(dataShards)-1)/int64(dataShards) == shardSize {
+			candidates = append(candidates, dataShards)
+		}
+	}
+	if dataShards, _ := c.fileShards("", size); c.ShardSize > 0 || len(c.ShardBands) > 0 {
+		add(dataShards)
+	}
+	add(c.DataShards)
+	for _, class := range c.StorageClasses {
+		add(class.DataShards)
+	}
+	for _, band := range c.ShardBands {
+		add(band.DataShards)
+	}
+	for dataShards := 1; dataShards+parityShards <= 256; dataShards++ {
+		add(dataShards)
+	}
+	return candidates
+}
+
+// fileHash returns the hex encoded sha256 of the file at fpath, as
+// rsutils hashes shards.
+func fileHash(storage StorageBackend, fpath string) (string, error) {
+	f, err := storage.Open(fpath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	_, err = io.Copy(h, f)
+	return fmt.Sprintf("%x", h.Sum(nil)), err
+}
+
+// RebuildMetadata derives the metadata of fname, lost along with its
+// mirror, from its data and parity files: the size is that of the data
+// file, the parity shards are those left and the data shards the number
+// that, encoded again, produces the most of them. It reports how many of
+// the parity shards matched; those that didn't are repaired like damaged
+// ones. What else the metadata recorded, such as encryption or
+// compression, is lost, along with the ID unless the index has it.
+func (r *RSFileManager) RebuildMetadata(fname string) (*rsutils.Metadata, int, error) {
+	fpath := r.DataPath(fname)
+	_, err := r.readStoredMetadata(fpath)
+	if err == nil {
+		return nil, 0, errMetadataIntact
+	}
+	if !os.IsNotExist(err) && !errors.Is(err, errMetadataCorrupt) {
+		return nil, 0, err
+	}
+	stat, err := r.storage().Stat(fpath)
+	if err != nil {
+		return nil, 0, err
+	}
+	var parityHashes []string
+	var shardSize int64
+	for _, suffix := range objectSuffixes(r.storage(), fpath) {
+		if !strings.HasPrefix(suffix, ".parity.") {
+			continue
+		}
+		parityStat, err := r.storage().Stat(fpath + suffix)
+		if err != nil {
+			return nil, 0, err
+		}
+		shardSize = parityStat.Size()
+		hash, err := fileHash(r.storage(), fpath+suffix)
+		if err != nil {
+			return nil, 0, err
+		}
+		parityHashes = append(parityHashes, hash)
+	}
+	if len(parityHashes) == 0 {
+		return nil, 0, fmt.Errorf("%w: no parity shards are left", errShardsUnknown)
+	}
+
+	var best *rsutils.Metadata
+	matched := 0
+	for _, dataShards := range r.Config.shardCandidates(stat.Size(), shardSize, len(parityHashes)) {
+		md, err := r.encodeHashes(fpath, stat.Size(), dataShards, len(parityHashes))
+		if err != nil {
+			return nil, 0, err
+		}
+		n := 0
+		for i, hash := range parityHashes {
+			if md.Hashes[dataShards+i] == hash {
+				n++
+			}
+		}
+		if n > matched {
+			best, matched = md, n
+		}
+		if matched == len(parityHashes) {
+			break
+		}
+	}
+	if best == nil {
+		return nil, 0, errShardsUnknown
+	}
+	// Whatever is left of the metadata can't be read anyway. The ID is
+	// kept if the index has it.
+	extras := MetadataExtras{ID: r.objectID(fname)}
+	err = removeMetadata(r.storage(), fpath)
+	if err == nil {
+		err = r.WriteMetadata(fname, best, extras)
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	log.Infof("Rebuilt metadata of %s with %d data and %d parity shards, %d of which matched", fname, best.DataShards, best.ParityShards, matched)
+	return best, matched, nil
+}
+
+// encodeHashes returns the metadata of the data file at fpath split into
+// dataShards, computing parity shards only to hash them.
+func (r *RSFileManager) encodeHashes(fpath string, size int64, dataShards, parityShards int) (*rsutils.Metadata, error) {
+	dataFile, err := r.storage().Open(fpath)
+	if err != nil {
+		return nil, err
+	}
+	defer dataFile.Close()
+	chunks := rsutils.SplitIntoPaddedChunks(dataFile, size, dataShards)
+	sources := make([]io.Reader, len(chunks))
+	for i := range chunks {
+		sources[i] = chunks[i]
+	}
+	discard := make([]io.Writer, parityShards)
+	for i := range discard {
+		discard[i] = ioutil.Discard
+	}
+	return rsutils.NewShardCreator(sources, size, dataShards, parityShards).Encode(discard)
+}
+
+type rebuildMetadataRsp struct {
+	Name         string   `json:"name"`
+	Size         int64    `json:"size"`
+	Hashes       []string `json:"hashes"`
+	DataShards   int      `json:"data_shards"`
+	ParityShards int      `json:"parity_shards"`
+	// ParityMatched is the number of parity shards that match the data,
+	// the others need a repair.
+	ParityMatched int `json:"parity_matched"`
+}
+
+// rebuildMetadataHandler rebuilds the lost metadata of a file, see
+// RSFileManager.RebuildMetadata.
+func (rs *RSBackupAPI) rebuildMetadataHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		rs.Errorf(r, "Bad method %s", r.Method)
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	fname, err := getFileNameParam(r.URL)
+	if err != nil {
+		rs.Errorf(r, "Can't rebuild metadata: %s", err)
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	md, matched, err := rs.RsFileMan.RebuildMetadata(fname)
+	switch {
+	case os.IsNotExist(err):
+		rs.Errorf(r, "File %s not found", fname)
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	case errors.Is(err, errMetadataIntact):
+		rs.Errorf(r, "Metadata of %s is intact, not rebuilding it", fname)
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	case errors.Is(err, errShardsUnknown):
+		rs.Errorf(r, "Can't rebuild metadata of %s: %s", fname, err)
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	case err != nil:
+		rs.Errorf(r, "Unable to rebuild metadata of %s: %s", fname, err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	rs.mirror(fname)
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(rebuildMetadataRsp{
+		Name:          fname,
+		Size:          md.Size,
+		Hashes:        md.Hashes,
+		DataShards:    md.DataShards,
+		ParityShards:  md.ParityShards,
+		ParityMatched: matched,
+	})
+	if err != nil {
+		rs.Errorf(r, "Unable to marshal json response: %s", err)
+	}
+}
@@ -0,0 +1,91 @@
+package rsbackup
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func TestRebuildMetadata(t *testing.T) {
+	tmpDir := createTMPDir(t, "rsbackup")
+	config := &Config{BackupRoot: tmpDir, DataShards: 3, ParityShards: 2}
+	fm := &RSFileManager{Config: config}
+	api := &RSBackupAPI{Config: config, RsFileMan: fm}
+	fpath := fm.DataPath("tyger")
+	if err := ioutil.WriteFile(fpath, bytes.Repeat([]byte("in what distant deeps or skies "), 100), 0644); err != nil {
+		t.Fatal(err)
+	}
+	md, err := api.generateParity(fm.storage(), fpath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fm.WriteMetadata("tyger", md, MetadataExtras{}); err != nil {
+		t.Fatal(err)
+	}
+	rebuild := func(fname string) (int, rebuildMetadataRsp) {
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(api.rebuildMetadataHandler).ServeHTTP(rr, httptest.NewRequest("POST", "/rebuild_metadata/"+fname, nil))
+		var rsp rebuildMetadataRsp
+		json.NewDecoder(rr.Body).Decode(&rsp)
+		return rr.Code, rsp
+	}
+	lose := func() {
+		if err := removeMetadata(fm.storage(), fpath); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if code, _ := rebuild("tyger"); code != http.StatusConflict {
+		t.Errorf("Got status code %d rebuilding intact metadata", code)
+	}
+	// The shard counts are found even when the config changed since.
+	config.DataShards = 2
+	lose()
+	code, rsp := rebuild("tyger")
+	if code != http.StatusOK || rsp.Size != md.Size || rsp.DataShards != 3 || rsp.ParityShards != 2 || rsp.ParityMatched != 2 {
+		t.Fatalf("Got status code %d and %+v", code, rsp)
+	}
+	rebuilt, err := fm.ReadMetadata(fpath)
+	if err != nil || len(rebuilt.Hashes) != len(md.Hashes) {
+		t.Fatalf("Got metadata %+v (error: %v)", rebuilt, err)
+	}
+	for i := range md.Hashes {
+		if rebuilt.Hashes[i] != md.Hashes[i] {
+			t.Errorf("Got hash %d %s, expected %s", i, rebuilt.Hashes[i], md.Hashes[i])
+		}
+	}
+	if _, err := os.Stat(fpath + metadataMirrorSuffix); err != nil {
+		t.Errorf("Expected the rebuilt metadata mirrored: %s", err)
+	}
+
+	// A damaged parity shard is left to repairs.
+	lose()
+	if err := ioutil.WriteFile(fpath+".parity.1", bytes.Repeat([]byte{0}, int(md.Size/3)+1), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if code, rsp := rebuild("tyger"); code != http.StatusOK || rsp.DataShards != 3 || rsp.ParityMatched != 1 {
+		t.Fatalf("Got status code %d and %+v with a damaged parity shard", code, rsp)
+	}
+	if err := fm.RepairData("tyger"); err != nil {
+		t.Fatal(err)
+	}
+	if health, _, _, err := fm.CheckData("tyger"); err != nil || !health {
+		t.Errorf("Got health %t (error: %v) after the repair", health, err)
+	}
+
+	// Damaged data produces none of the parity.
+	lose()
+	if err := ioutil.WriteFile(fpath, bytes.Repeat([]byte("x"), int(md.Size)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if code, _ := rebuild("tyger"); code != http.StatusUnprocessableEntity {
+		t.Errorf("Got status code %d rebuilding from damaged data", code)
+	}
+	if code, _ := rebuild("lamb"); code != http.StatusNotFound {
+		t.Errorf("Got status code %d rebuilding a missing file", code)
+	}
+}
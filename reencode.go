@@ -0,0 +1,321 @@
+package rsbackup
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// reencodeDirName is the directory in the state directory the new parity
+// and metadata of files being re-encoded are built in.
+const reencodeDirName = "reencode"
+
+var (
+	errReencodeDamaged = errors.New("File is damaged, repair it before re-encoding it")
+	errNotReencodable  = errors.New("Packed files and files waiting for their parity can't be re-encoded")
+)
+
+// reencodeTarget is what a file is re-encoded to: DataShards and
+// ParityShards, a storage class or replicas, or with none of them the
+// shard counts the config gives a file of its size.
+type reencodeTarget struct {
+	DataShards   int
+	ParityShards int
+	StorageClass string
+	Replicas     int
+}
+
+// shards returns the shard counts of a file with extras of size bytes,
+// and records the storage class and replicas they come from in extras.
+func (t reencodeTarget) shards(config *Config, extras *MetadataExtras, size int64) (int, int) {
+	extras.StorageClass, extras.Replicas = t.StorageClass, t.Replicas
+	if t.DataShards > 0 {
+		return t.DataShards, t.ParityShards
+	}
+	return config.protection(extras, size)
+}
+
+// reencodeParams returns the target of a re-encode from the data_shards
+// and parity_shards form fields, or storage_class or replicas.
+func (rs *RSBackupAPI) reencodeParams(r *http.Request) (reencodeTarget, error) {
+	var t reencodeTarget
+	var err error
+	t.StorageClass, err = rs.storageClassParam(r)
+	if err == nil {
+		t.Replicas, err = replicasParam(r, t.StorageClass)
+	}
+	if err != nil {
+		return t, err
+	}
+	dataParam, parityParam := r.FormValue("data_shards"), r.FormValue("parity_shards")
+	if dataParam == "" && parityParam == "" {
+		return t, nil
+	}
+	if t.StorageClass != "" || t.Replicas > 0 {
+		return t, fmt.Errorf("Shard counts can't be combined with a storage class or replicas")
+	}
+	t.DataShards, err = strconv.Atoi(dataParam)
+	if err == nil {
+		t.ParityShards, err = strconv.Atoi(parityParam)
+	}
+	if err != nil || t.DataShards < 1 || t.ParityShards < 1 || t.DataShards+t.ParityShards > 256 {
+		return t, fmt.Errorf("Invalid shard counts '%s' and '%s', both must be set, at least 1 and at most 256 together", dataParam, parityParam)
+	}
+	return t, nil
+}
+
+// ReencodeFile computes the parity of fname anew for target, with the
+// codec and shard hash of the config, once it checked the file is intact.
+// The data file stays as it is. The parity and metadata are built in the
+// state directory and then moved into place under a journal entry, so a
+// crash half way is finished by RecoverOperations. It reports whether
+// anything changed; files already encoded like that are left alone.
+func (rs *RSBackupAPI) ReencodeFile(fname string, target reencodeTarget) (*storedMetadata, bool, error) {
+	renameMu.Lock()
+	defer renameMu.Unlock()
+	fm := rs.RsFileMan
+	fpath := fm.DataPath(fname)
+	md, err := fm.readStoredMetadata(fpath)
+	if err != nil {
+		return nil, false, err
+	}
+	if md.Packed != nil || md.ParityPending {
+		return nil, false, errNotReencodable
+	}
+	stat, err := fm.storage().Stat(fpath)
+	if err != nil {
+		return nil, false, err
+	}
+	extras := md.MetadataExtras
+	dataShards, parityShards := target.shards(rs.Config, &extras, stat.Size())
+	codec, hash := md.Codec, md.Hash
+	if codec == "" {
+		codec = CodecReedSolomon
+	}
+	if hash == "" {
+		hash = hashSHA256
+	}
+	if dataShards == md.DataShards && parityShards == md.ParityShards && extras.StorageClass == md.StorageClass && extras.Replicas == md.Replicas &&
+		codec == rs.Config.codecName() && hash == rs.Config.shardHashName() {
+		return md, false, nil
+	}
+	health, _, _, err := fm.CheckData(fname)
+	if err != nil {
+		return nil, false, err
+	}
+	if !health {
+		return nil, false, errReencodeDamaged
+	}
+
+	token, err := generateToken()
+	if err != nil {
+		return nil, false, err
+	}
+	dir := rs.Config.StatePath(path.Join(reencodeDirName, token[:16]))
+	defer os.RemoveAll(dir)
+	encoded, segments, err := writeParityAt(fm.storage(), fpath, fm.local(), path.Join(dir, "data"), dataShards, parityShards, rs.Config)
+	if err != nil {
+		return nil, false, err
+	}
+	extras.Codec, extras.Hash, extras.Segments = rs.Config.codecName(), rs.Config.shardHashName(), segments
+	reencoded := &storedMetadata{Metadata: encoded, MetadataExtras: extras}
+	err = writeJSONState(path.Join(dir, "metadata.json"), reencoded)
+	if err != nil {
+		return nil, false, err
+	}
+	entry, err := fm.Journal.begin(opReencode, fname, token[:16])
+	if err != nil {
+		return nil, false, err
+	}
+	err = fm.finishReencode(fname, dir)
+	if err != nil {
+		// The entry stays, so the next start finishes the re-encode.
+		return nil, false, fmt.Errorf("Re-encode of '%s' cut short: %w", fname, err)
+	}
+	fm.Journal.end(entry)
+	return reencoded, true, nil
+}
+
+// finishReencode moves the parity files waiting in dir into place, then
+// the metadata, and removes the parity files the file has no more. It
+// picks up where it left off when it was cut short.
+func (r *RSFileManager) finishReencode(fname, dir string) error {
+	fpath := r.DataPath(fname)
+	mdPath := path.Join(dir, "metadata.json")
+	if _, err := os.Stat(mdPath); err == nil {
+		var md storedMetadata
+		err := readJSONState(mdPath, &md)
+		if err != nil {
+			return err
+		}
+		for i := 1; i <= md.ParityShards; i++ {
+			suffix := fmt.Sprintf(".parity.%d", i)
+			src := path.Join(dir, "data") + suffix
+			if _, err := os.Stat(src); os.IsNotExist(err) {
+				// Moved before the cut.
+				continue
+			}
+			if err := storeLocal(r.storage(), src, fpath+suffix); err != nil {
+				return err
+			}
+		}
+		if err := r.replaceMetadata(fpath, &md); err != nil {
+			return err
+		}
+		if err := os.Remove(mdPath); err != nil {
+			return err
+		}
+	}
+	md, err := r.readStoredMetadata(fpath)
+	if os.IsNotExist(err) {
+		// Deleted since.
+		return os.RemoveAll(dir)
+	}
+	if err != nil {
+		return err
+	}
+	for i := md.ParityShards + 1; ; i++ {
+		err := r.storage().Remove(fmt.Sprintf("%s.parity.%d", fpath, i))
+		if os.IsNotExist(err) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return os.RemoveAll(dir)
+}
+
+type reencodeDataRsp struct {
+	Name          string   `json:"name"`
+	Reencoded     bool     `json:"reencoded"`
+	Size          int64    `json:"size"`
+	Hashes        []string `json:"hashes"`
+	DataShards    int      `json:"data_shards"`
+	ParityShards  int      `json:"parity_shards"`
+	StorageClass  string   `json:"storage_class,omitempty"`
+	Replicas      int      `json:"replicas,omitempty"`
+	HashAlgorithm string   `json:"hash_algorithm,omitempty"`
+}
+
+// reencodeDataHandler re-encodes one file on POST /reencode_data/{name},
+// to the target in the form fields, see reencodeParams.
+func (rs *RSBackupAPI) reencodeDataHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		rs.Errorf(r, "Bad method %s", r.Method)
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	fname, err := getFileNameParam(r.URL)
+	if err != nil {
+		rs.Errorf(r, "Can't re-encode file: %s", err)
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	target, err := rs.reencodeParams(r)
+	if err != nil {
+		rs.Errorf(r, "%s", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	md, reencoded, err := rs.ReencodeFile(fname, target)
+	switch {
+	case os.IsNotExist(err):
+		rs.Errorf(r, "File %s not found", fname)
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	case err == errReencodeDamaged || err == errNotReencodable:
+		rs.Errorf(r, "Can't re-encode %s: %s", fname, err)
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	case isNoSpace(err):
+		rs.insufficientSpace(w, r, 0)
+		return
+	case err != nil:
+		rs.Errorf(r, "Unable to re-encode %s: %s", fname, err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	if reencoded {
+		log.Infof("Re-encoded %s with %d data and %d parity shards", fname, md.DataShards, md.ParityShards)
+		rs.mirror(fname)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(reencodeDataRsp{
+		Name:          fname,
+		Reencoded:     reencoded,
+		Size:          contentSize(md.Metadata, md.MetadataExtras),
+		Hashes:        md.Hashes,
+		DataShards:    md.DataShards,
+		ParityShards:  md.ParityShards,
+		StorageClass:  md.StorageClass,
+		Replicas:      md.Replicas,
+		HashAlgorithm: responseHash(md.Hash),
+	})
+	if err != nil {
+		rs.Errorf(r, "Unable to marshal json response: %s", err)
+	}
+}
+
+// reencode re-encodes every file to target, paced to the scrub read rate.
+// Packed files and files waiting for their parity are skipped.
+func (rs *RSBackupAPI) reencode(job *jobProgress, stop <-chan struct{}, target reencodeTarget) error {
+	names, err := rs.RsFileMan.ListData()
+	if err != nil {
+		return err
+	}
+	job.setTotal(len(names))
+	work := rs.background()
+	for _, name := range names {
+		select {
+		case <-stop:
+			return nil
+		default:
+		}
+		_, reencoded, err := rs.ReencodeFile(name, target)
+		if os.IsNotExist(err) || err == errNotReencodable {
+			err = nil
+		}
+		if err != nil {
+			log.Warnf("Re-encode couldn't process %s, continuing: %s", name, err)
+		}
+		if reencoded {
+			rs.mirror(name)
+			// Checked, then read again to encode it.
+			work.throttle.pay(2*storedSize(rs.RsFileMan.storage(), rs.RsFileMan.DataPath(name)), stop)
+		}
+		job.done(name, err)
+	}
+	return nil
+}
+
+// reencodeHandler starts a job re-encoding every file on POST /reencode,
+// to the target in the form fields like /reencode_data.
+func (rs *RSBackupAPI) reencodeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		rs.Errorf(r, "Bad method %s", r.Method)
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	target, err := rs.reencodeParams(r)
+	if err != nil {
+		rs.Errorf(r, "%s", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	job, err := rs.background().jobs.start("reencode", func(job *jobProgress, stop <-chan struct{}) error {
+		return rs.reencode(job, stop, target)
+	})
+	if err == errJobRunning {
+		rs.Errorf(r, "Re-encode already running")
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	rs.writeJobStarted(w, r, job)
+}
@@ -0,0 +1,112 @@
+package rsbackup
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestReencode(t *testing.T) {
+	config := &Config{BackupRoot: createTMPDir(t, "rsbackup"), DataShards: 10, ParityShards: 3}
+	journal, err := OpenOperationJournal(path.Join(createTMPDir(t, "rsbackup-state"), "journal"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fm := &RSFileManager{Config: config, Journal: journal}
+	api := &RSBackupAPI{Config: config, RsFileMan: fm}
+	content := strings.Repeat("tyger tyger burning bright ", 100)
+	for _, fname := range []string{"tyger", "lamb", "rose"} {
+		fpath := fm.DataPath(fname)
+		if err := ioutil.WriteFile(fpath, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		md, err := api.generateParity(fm.storage(), fpath, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := fm.WriteMetadata(fname, md, MetadataExtras{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	exists := func(fpath string) bool {
+		_, err := os.Stat(fpath)
+		return err == nil
+	}
+	reencode := func(fname string, form url.Values) (int, reencodeDataRsp) {
+		t.Helper()
+		req := httptest.NewRequest("POST", "/reencode_data/"+fname, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(api.reencodeDataHandler).ServeHTTP(rr, req)
+		var rsp reencodeDataRsp
+		if rr.Code == http.StatusOK {
+			json.NewDecoder(rr.Body).Decode(&rsp)
+		}
+		return rr.Code, rsp
+	}
+
+	form := url.Values{"data_shards": {"4"}, "parity_shards": {"2"}}
+	if code, rsp := reencode("tyger", form); code != http.StatusOK || !rsp.Reencoded || rsp.DataShards != 4 || rsp.ParityShards != 2 || rsp.Size != int64(len(content)) {
+		t.Fatalf("Got status code %d and response %+v", code, rsp)
+	}
+	if exists(fm.DataPath("tyger")+".parity.3") || !exists(fm.DataPath("tyger")+".parity.2") {
+		t.Errorf("Expected 2 parity files once re-encoded")
+	}
+	if health, _, _, err := fm.CheckData("tyger"); err != nil || !health {
+		t.Errorf("Got health %t (error: %v) once re-encoded", health, err)
+	}
+	if code, rsp := reencode("tyger", form); code != http.StatusOK || rsp.Reencoded {
+		t.Errorf("Got status code %d and response %+v re-encoding again", code, rsp)
+	}
+	for _, form := range []url.Values{{"data_shards": {"4"}}, {"data_shards": {"200"}, "parity_shards": {"100"}}, {"data_shards": {"0"}, "parity_shards": {"1"}}} {
+		if code, _ := reencode("tyger", form); code != http.StatusBadRequest {
+			t.Errorf("Got status code %d for %v", code, form)
+		}
+	}
+	if code, _ := reencode("fly", form); code != http.StatusNotFound {
+		t.Errorf("Got status code %d for a missing file", code)
+	}
+
+	// Damaged files are refused.
+	if err := ioutil.WriteFile(fm.DataPath("lamb"), []byte(strings.ToUpper(content)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if code, _ := reencode("lamb", form); code != http.StatusConflict {
+		t.Errorf("Got status code %d for a damaged file", code)
+	}
+	if md, err := fm.readStoredMetadata(fm.DataPath("lamb")); err != nil || md.DataShards != 10 {
+		t.Errorf("Got metadata %+v (error: %v) of a damaged file", md, err)
+	}
+
+	// A re-encode cut short after moving some parity files is finished.
+	dir := config.StatePath(path.Join(reencodeDirName, "cut"))
+	fpath := fm.DataPath("rose")
+	encoded, segments, err := writeParityAt(fm.storage(), fpath, fm.local(), path.Join(dir, "data"), 4, 2, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	extras := MetadataExtras{Codec: config.codecName(), Hash: config.shardHashName(), Segments: segments}
+	if err := writeJSONState(path.Join(dir, "metadata.json"), &storedMetadata{Metadata: encoded, MetadataExtras: extras}); err != nil {
+		t.Fatal(err)
+	}
+	journal.begin(opReencode, "rose", "cut")
+	if err := os.Rename(path.Join(dir, "data.parity.1"), fpath+".parity.1"); err != nil {
+		t.Fatal(err)
+	}
+	recovered, err := fm.RecoverOperations()
+	if err != nil || recovered != 1 {
+		t.Fatalf("Recovered %d operations (error: %v)", recovered, err)
+	}
+	if health, _, _, err := fm.CheckData("rose"); err != nil || !health {
+		t.Errorf("Got health %t (error: %v) after recovery", health, err)
+	}
+	if exists(fpath+".parity.3") || exists(config.StatePath(reencodeDirName)) {
+		t.Errorf("Expected the old parity and the state directory removed after recovery")
+	}
+}
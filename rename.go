@@ -0,0 +1,266 @@
+package rsbackup
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// renameMu serializes renames, so two of them can't claim the same name.
+var renameMu sync.Mutex
+
+// Rename gives the file from the name to, moving its parity and metadata
+// along. The data file moves last, so from is listed until the move is
+// complete.
+func (r *RSFileManager) Rename(from, to string) error {
+	renameMu.Lock()
+	defer renameMu.Unlock()
+	srcPath := r.DataPath(from)
+	dstPath := r.DataPath(to)
+	_, err := r.storage().Stat(srcPath)
+	if err != nil {
+		return err
+	}
+	err = r.checkMutable(srcPath, false)
+	if err != nil {
+		return err
+	}
+	if _, err := r.storage().Stat(dstPath); err == nil {
+		return errFileExists
+	}
+	entry, err := r.Journal.begin(opRename, from, to)
+	if err != nil {
+		return err
+	}
+	defer r.Journal.end(entry)
+	for _, suffix := range objectSuffixes(r.storage(), srcPath) {
+		err = r.storage().Rename(srcPath+suffix, dstPath+suffix)
+		if err != nil {
+			return fmt.Errorf("Cannot rename '%s': %w", from, err)
+		}
+	}
+	if r.Index != nil {
+		if err := r.Index.Move(from, to); err != nil {
+			log.Errorf("Unable to index %s as %s: %s", from, to, err)
+		}
+	}
+	return nil
+}
+
+// RenameRecord tells where a file went.
+type RenameRecord struct {
+	To        string    `json:"to"`
+	RenamedAt time.Time `json:"renamed_at"`
+	By        string    `json:"by,omitempty"`
+}
+
+// RenameHistory remembers the old names of renamed files, persisted in a
+// json file, so requests for an old name can be sent to the new one.
+type RenameHistory struct {
+	mu      sync.Mutex
+	path    string
+	renames map[string]RenameRecord
+}
+
+func NewRenameHistory(fpath string) (*RenameHistory, error) {
+	h := &RenameHistory{
+		path:    fpath,
+		renames: make(map[string]RenameRecord),
+	}
+	err := readJSONState(fpath, &h.renames)
+	if err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// Record notes that from was renamed to to by the credential called by.
+func (h *RenameHistory) Record(from, to, by string) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.renames[from] = RenameRecord{To: to, RenamedAt: time.Now(), By: by}
+	// to names a file again, it must not send anyone elsewhere.
+	delete(h.renames, to)
+	return writeJSONState(h.path, h.renames)
+}
+
+// Forget drops every rename that led to fname, so its old names are no
+// longer known.
+func (h *RenameHistory) Forget(fname string) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	names := []string{fname}
+	for len(names) > 0 {
+		name := names[len(names)-1]
+		names = names[:len(names)-1]
+		for from, record := range h.renames {
+			if record.To == name {
+				delete(h.renames, from)
+				names = append(names, from)
+			}
+		}
+	}
+	return writeJSONState(h.path, h.renames)
+}
+
+// Resolve follows the renames of fname to the current name of the file.
+// The returned record holds that name along with when and by whom fname
+// was renamed. ok is false if fname was never renamed.
+func (h *RenameHistory) Resolve(fname string) (RenameRecord, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	record, ok := h.renames[fname]
+	if !ok {
+		return RenameRecord{}, false
+	}
+	// Bounded, in case the file was renamed in a circle.
+	for i := 0; i < len(h.renames); i++ {
+		next, ok := h.renames[record.To]
+		if !ok {
+			break
+		}
+		record.To = next.To
+	}
+	return record, true
+}
+
+type renamedRsp struct {
+	Error     string `json:"error"`
+	Name      string `json:"name"`
+	RenamedTo string `json:"renamed_to"`
+	RenamedAt string `json:"renamed_at"`
+}
+
+// redirectRenamed sends requests for a file that no longer exists under
+// fname, because it was renamed, to the same endpoint for its current
+// name. It reports whether it handled the request.
+func (rs *RSBackupAPI) redirectRenamed(w http.ResponseWriter, r *http.Request, fname string) bool {
+	if rs.Renames == nil {
+		return false
+	}
+	if _, err := os.Stat(rs.RsFileMan.DataPath(fname)); !os.IsNotExist(err) {
+		return false
+	}
+	record, ok := rs.Renames.Resolve(fname)
+	if !ok {
+		return false
+	}
+	escapedPath := r.URL.EscapedPath()
+	location := escapedPath[:strings.LastIndex(escapedPath, "/")+1] + url.PathEscape(record.To)
+	if r.URL.RawQuery != "" {
+		location += "?" + r.URL.RawQuery
+	}
+	log.Debugf("%s was renamed to %s, redirecting", fname, record.To)
+	rsp := &renamedRsp{
+		Error:     "Renamed",
+		Name:      fname,
+		RenamedTo: record.To,
+		RenamedAt: record.RenamedAt.Format("2006-01-02 15:04:05"),
+	}
+	w.Header().Set("Location", location)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusMovedPermanently)
+	err := json.NewEncoder(w).Encode(rsp)
+	if err != nil {
+		rs.Errorf(r, "Unable to marshal json response: %s", err)
+	}
+	return true
+}
+
+type renameRsp struct {
+	Name        string `json:"name"`
+	RenamedFrom string `json:"renamed_from"`
+}
+
+// renameHandler renames the file in the url to the name in the "to" form
+// field. Health, annotations and quota usage move along with it.
+func (rs *RSBackupAPI) renameHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		rs.Errorf(r, "Bad method %s", r.Method)
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	from, err := getFileNameParam(r.URL)
+	if err != nil {
+		rs.Errorf(r, "Can't rename file: %s", err)
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	to := r.FormValue("to")
+	err = validateFileName(to)
+	if err != nil {
+		rs.Errorf(r, "Can't rename %s: %s", from, err)
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	// Placement follows the new name before the files move, so they end up
+	// where it's placed. A taken name fails the rename below anyway.
+	moved := false
+	if rs.Placement != nil {
+		if _, err := rs.RsFileMan.Stat(to); os.IsNotExist(err) {
+			if err := rs.Placement.Move(from, to); err != nil {
+				rs.Errorf(r, "Unable to move placement of %s to %s: %s", from, to, err)
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+				return
+			}
+			moved = true
+		}
+	}
+	err = rs.RsFileMan.Rename(from, to)
+	if err != nil && moved {
+		rs.Placement.Move(to, from)
+	}
+	if err != nil {
+		rs.Errorf(r, "Unable to rename %s to %s: %s", from, to, err)
+		switch {
+		case os.IsNotExist(err):
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		case err == errFileExists:
+			http.Error(w, http.StatusText(http.StatusConflict), http.StatusConflict)
+		case isLocked(err):
+			http.Error(w, err.Error(), http.StatusConflict)
+		default:
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		}
+		return
+	}
+	by := requestNamespace(r)
+	log.Infof("Renamed %s to %s (by '%s')", from, to, by)
+	err = rs.Renames.Record(from, to, by)
+	if err != nil {
+		log.Errorf("Unable to record rename of %s to %s: %s", from, to, err)
+	}
+	if rs.Health != nil {
+		if err := rs.Health.Move(from, to); err != nil {
+			log.Errorf("Unable to move health of %s to %s: %s", from, to, err)
+		}
+	}
+	if rs.Tiering != nil {
+		if err := rs.Tiering.Move(from, to); err != nil {
+			log.Errorf("Unable to move retrieval time of %s to %s: %s", from, to, err)
+		}
+	}
+	if rs.Annotations != nil {
+		if err := rs.Annotations.Move(from, to); err != nil {
+			log.Errorf("Unable to move annotations of %s to %s: %s", from, to, err)
+		}
+	}
+	if rs.Quotas != nil {
+		if err := rs.Quotas.Move(from, to); err != nil {
+			log.Errorf("Unable to move quota usage of %s to %s: %s", from, to, err)
+		}
+	}
+	rs.mirror(to)
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(&renameRsp{Name: to, RenamedFrom: from})
+	if err != nil {
+		rs.Errorf(r, "Unable to marshal json response: %s", err)
+	}
+}
@@ -0,0 +1,108 @@
+package rsbackup
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestRenameHandler(t *testing.T) {
+	tmpDir := createTMPDir(t, "rsbackup")
+	conf := &Config{BackupRoot: tmpDir, DataShards: 2, ParityShards: 1}
+	cloneShards(t, "tyger", tmpDir, conf)
+	cloneShards(t, "tyger_bad", tmpDir, conf)
+	renamesPath := conf.StatePath("renames.json")
+	renames, err := NewRenameHistory(renamesPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	annotations, err := NewAnnotationStore(conf.StatePath("annotations.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = annotations.Add("tyger", "from the poem", "operator")
+	if err != nil {
+		t.Fatal(err)
+	}
+	api := &RSBackupAPI{Config: conf, RsFileMan: &RSFileManager{Config: conf}, Renames: renames, Annotations: annotations}
+
+	renameTests := []struct {
+		name           string
+		method         string
+		url            string
+		to             string
+		expectedStatus int
+	}{
+		{"bad method", "GET", "/rename/tyger", "tiger", 405},
+		{"missing target", "POST", "/rename/tyger", "", 400},
+		{"illegal target", "POST", "/rename/tyger", "ti/ger", 400},
+		{"file not found", "POST", "/rename/lion", "tiger", 404},
+		{"target exists", "POST", "/rename/tyger", "tyger_bad", 409},
+		{"rename", "POST", "/rename/tyger", "tiger", 200},
+		{"rename again", "POST", "/rename/tiger", "the tyger", 200},
+	}
+	for _, tt := range renameTests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.url, strings.NewReader(url.Values{"to": {tt.to}}.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			rr := httptest.NewRecorder()
+			http.HandlerFunc(api.renameHandler).ServeHTTP(rr, req)
+			if rr.Code != tt.expectedStatus {
+				t.Errorf("Got status code %d, expected %d", rr.Code, tt.expectedStatus)
+			}
+		})
+	}
+
+	for _, suffix := range []string{"", ".md", ".parity.1"} {
+		if _, err := os.Stat(path.Join(tmpDir, "the tyger"+suffix)); err != nil {
+			t.Errorf("the tyger%s missing after rename: %s", suffix, err)
+		}
+	}
+	if len(annotations.Get("the tyger")) != 1 {
+		t.Errorf("Annotations didn't move with the file")
+	}
+
+	// The oldest name leads to the current one, even after a restart.
+	api.Renames, err = NewRenameHistory(renamesPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest("GET", "/retrieve_data/tyger?verify=true", nil)
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(api.retrieveDataHandler).ServeHTTP(rr, req)
+	if rr.Code != http.StatusMovedPermanently {
+		t.Fatalf("Got status code %d, expected 301", rr.Code)
+	}
+	if location := rr.Header().Get("Location"); location != "/retrieve_data/the%20tyger?verify=true" {
+		t.Errorf("Got location '%s'", location)
+	}
+	var rsp renamedRsp
+	err = json.NewDecoder(rr.Body).Decode(&rsp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rsp.Name != "tyger" || rsp.RenamedTo != "the tyger" || rsp.RenamedAt == "" {
+		t.Errorf("Unexpected response %+v", rsp)
+	}
+
+	req = httptest.NewRequest("GET", "/check_data/tiger", nil)
+	rr = httptest.NewRecorder()
+	http.HandlerFunc(api.checkDataHandler).ServeHTTP(rr, req)
+	if rr.Code != http.StatusMovedPermanently || rr.Header().Get("Location") != "/check_data/the%20tyger" {
+		t.Errorf("Got status code %d and location '%s'", rr.Code, rr.Header().Get("Location"))
+	}
+
+	// A file stored under an old name again is served as usual.
+	cloneShards(t, "tyger", tmpDir, conf)
+	req = httptest.NewRequest("GET", "/check_data/tyger", nil)
+	rr = httptest.NewRecorder()
+	http.HandlerFunc(api.checkDataHandler).ServeHTTP(rr, req)
+	if rr.Code != 200 {
+		t.Errorf("Got status code %d for reused name, expected 200", rr.Code)
+	}
+}
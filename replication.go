@@ -0,0 +1,53 @@
+package rsbackup
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+// A replicated file is stored with one data shard and a parity shard per
+// replica. With a single data shard every parity shard is a plain copy of
+// the data, so replicas are hashed, checked and repaired like the shards
+// of any other file, and are placed wherever parity goes.
+
+// replicas returns the number of replicas of files replicated without a
+// count of their own: Config.Replicas, or as many as there are parity
+// shards so they survive as many losses.
+func (c *Config) replicas() int {
+	if c.Replicas > 0 {
+		return c.Replicas
+	}
+	return c.ParityShards
+}
+
+// protection returns the number of data and parity shards the file with
+// extras of size bytes gets. Files of the default class smaller than
+// Config.ReplicationThreshold are replicated, recorded in extras, unless
+// their size isn't known yet.
+func (c *Config) protection(extras *MetadataExtras, size int64) (int, int) {
+	if extras.Replicas == 0 && extras.StorageClass == "" && size >= 0 && size < int64(c.ReplicationThreshold) {
+		extras.Replicas = c.replicas()
+	}
+	if extras.Replicas > 0 {
+		return 1, extras.Replicas
+	}
+	return c.fileShards(extras.StorageClass, size)
+}
+
+// replicasParam returns the replicas form field of a submit, 0 if it
+// isn't set. A file can't have both replicas and a storage class.
+func replicasParam(r *http.Request, class string) (int, error) {
+	param := r.FormValue("replicas")
+	if param == "" {
+		return 0, nil
+	}
+	replicas, err := strconv.Atoi(param)
+	if err != nil || replicas < 1 || replicas > 255 {
+		return 0, fmt.Errorf("Invalid replicas '%s', must be between 1 and 255", param)
+	}
+	if class != "" {
+		return 0, fmt.Errorf("Replicas can't be combined with a storage class")
+	}
+	return replicas, nil
+}
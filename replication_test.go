@@ -0,0 +1,91 @@
+package rsbackup
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestReplication(t *testing.T) {
+	conf := &Config{BackupRoot: createTMPDir(t, "rsbackup"), DataShards: 4, ParityShards: 2, ReplicationThreshold: 1024,
+		StorageClasses: map[string]StorageClass{"redundant": {DataShards: 2, ParityShards: 3}}}
+	fm := &RSFileManager{Config: conf}
+	api := &RSBackupAPI{Config: conf, RsFileMan: fm}
+	submit := func(fname, content string, fields map[string]string) (*httptest.ResponseRecorder, submitDataRsp) {
+		body := new(bytes.Buffer)
+		mw := multipart.NewWriter(body)
+		mw.WriteField("filename", fname)
+		for k, v := range fields {
+			mw.WriteField(k, v)
+		}
+		fw, _ := mw.CreateFormFile("file", fname)
+		fw.Write([]byte(content))
+		mw.Close()
+		req := httptest.NewRequest("POST", "/submit_data", body)
+		req.Header.Set("Content-Type", mw.FormDataContentType())
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(api.submitDataHandler).ServeHTTP(rr, req)
+		var rsp submitDataRsp
+		if rr.Code == http.StatusOK {
+			json.NewDecoder(rr.Body).Decode(&rsp)
+		}
+		return rr, rsp
+	}
+
+	large := strings.Repeat("tyger tyger ", 200)
+	var tests = []struct {
+		fname    string
+		content  string
+		fields   map[string]string
+		data     int
+		replicas int
+	}{
+		{"small", "burning bright", nil, 1, 2},
+		{"large", large, nil, 4, 0},
+		{"asked", large, map[string]string{"replicas": "3"}, 1, 3},
+		{"classy", "in the forests", map[string]string{"storage_class": "redundant"}, 2, 0},
+	}
+	for _, tt := range tests {
+		rr, rsp := submit(tt.fname, tt.content, tt.fields)
+		if rr.Code != http.StatusOK || rsp.DataShards != tt.data || rsp.Replicas != tt.replicas || (tt.replicas > 0 && rsp.ParityShards != tt.replicas) {
+			t.Errorf("%s: got status code %d and response %+v", tt.fname, rr.Code, rsp)
+			continue
+		}
+		if extras, err := fm.ReadExtras(fm.DataPath(tt.fname)); err != nil || extras.Replicas != tt.replicas {
+			t.Errorf("%s: got %d replicas in metadata (error: %v)", tt.fname, extras.Replicas, err)
+		}
+		for i := 1; i <= tt.replicas; i++ {
+			replica, err := ioutil.ReadFile(fmt.Sprintf("%s.parity.%d", fm.DataPath(tt.fname), i))
+			if err != nil || string(replica) != tt.content {
+				t.Errorf("%s: replica %d isn't a copy (error: %v)", tt.fname, i, err)
+			}
+		}
+	}
+
+	// Losing the data and all but one replica is repaired from it.
+	os.Remove(fm.DataPath("asked"))
+	os.Remove(fm.DataPath("asked") + ".parity.1")
+	os.Remove(fm.DataPath("asked") + ".parity.2")
+	if err := fm.RepairData("asked"); err != nil {
+		t.Fatal(err)
+	}
+	if health, _, _, err := fm.CheckData("asked"); err != nil || !health {
+		t.Errorf("Got health %t (error: %v) after repair", health, err)
+	}
+	if data, err := ioutil.ReadFile(fm.DataPath("asked")); err != nil || string(data) != large {
+		t.Errorf("Got %d bytes repaired (error: %v)", len(data), err)
+	}
+
+	for _, fields := range []map[string]string{{"replicas": "0"}, {"replicas": "many"}, {"replicas": "2", "storage_class": "redundant"}} {
+		if rr, _ := submit("refused", "the lamb", fields); rr.Code != http.StatusBadRequest {
+			t.Errorf("Got status code %d submitting with %v", rr.Code, fields)
+		}
+	}
+}
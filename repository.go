@@ -0,0 +1,110 @@
+package rsbackup
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// RepositoryFormatVersion is the on-disk format written by this version of
+// the server. Repositories with a newer format are refused. Since version
+// 2 metadata is sealed with a checksum, and files may be encrypted,
+// compressed, deduplicated, packed, encoded with another codec or hashed by
+// segment, which servers knowing version 1 would serve or check as plain
+// files. Every file stored gets sealed metadata, so repositories are
+// upgraded when opened.
+const RepositoryFormatVersion = 2
+
+const repositoryMarkerName = "repository.json"
+
+// RepositoryMarker identifies a directory as a BackupRoot managed by
+// rsbackup, with files stored in Layout.
+type RepositoryMarker struct {
+	FormatVersion int
+	Created       time.Time
+	ServerID      string
+	Layout        string `json:",omitempty"`
+}
+
+// OpenRepository checks that config.BackupRoot holds an rsbackup
+// repository with files stored in layout and returns its marker, upgraded
+// to RepositoryFormatVersion. When init is set, a missing marker is
+// created. When force is set, a missing marker is ignored and nil is
+// returned.
+func OpenRepository(config *Config, layout Layout, init, force bool) (*RepositoryMarker, error) {
+	markerPath := config.StatePath(repositoryMarkerName)
+	var marker *RepositoryMarker
+	err := readJSONState(markerPath, &marker)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot read repository marker '%s': %s", markerPath, err)
+	}
+	if marker != nil {
+		if marker.FormatVersion > RepositoryFormatVersion {
+			return nil, fmt.Errorf("Repository '%s' has format version %d, this server supports up to %d", config.BackupRoot, marker.FormatVersion, RepositoryFormatVersion)
+		}
+		if marker.Layout != "" && marker.Layout != layout.String() {
+			return nil, fmt.Errorf("Repository '%s' stores files in layout %s, not %s, use -layout %s or -migrate-layout-from %s", config.BackupRoot, marker.Layout, layout, marker.Layout, marker.Layout)
+		}
+		if marker.FormatVersion < RepositoryFormatVersion || marker.Layout == "" {
+			if marker.Layout == "" {
+				// Markers didn't record it before.
+				log.Warnf("Recording layout %s for repository %s", layout, config.BackupRoot)
+			}
+			if marker.FormatVersion < RepositoryFormatVersion {
+				log.Warnf("Upgrading repository %s from format version %d to %d, older servers will refuse it", config.BackupRoot, marker.FormatVersion, RepositoryFormatVersion)
+			}
+			marker.FormatVersion, marker.Layout = RepositoryFormatVersion, layout.String()
+			err = writeJSONState(markerPath, marker)
+			if err != nil {
+				return nil, fmt.Errorf("Cannot write repository marker '%s': %s", markerPath, err)
+			}
+		}
+		log.Infof("Opened repository %s (server id %s, created %s)", config.BackupRoot, marker.ServerID, marker.Created.Format("2006-01-02 15:04:05"))
+		return marker, nil
+	}
+
+	switch {
+	case init:
+		err = os.MkdirAll(config.BackupRoot, 0755)
+		if err != nil {
+			return nil, err
+		}
+		serverID, err := generateToken()
+		if err != nil {
+			return nil, err
+		}
+		marker = &RepositoryMarker{
+			FormatVersion: RepositoryFormatVersion,
+			Created:       time.Now(),
+			ServerID:      serverID[:32],
+			Layout:        layout.String(),
+		}
+		err = writeJSONState(markerPath, marker)
+		if err != nil {
+			return nil, fmt.Errorf("Cannot write repository marker '%s': %s", markerPath, err)
+		}
+		log.Infof("Initialized repository %s (server id %s)", config.BackupRoot, marker.ServerID)
+		return marker, nil
+	case force:
+		log.Warnf("'%s' is not an rsbackup repository, continuing anyway", config.BackupRoot)
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("'%s' is not an rsbackup repository, use -init to create one or -force to use it anyway", config.BackupRoot)
+	}
+}
+
+// RecordRepositoryLayout records in the marker of config.BackupRoot that
+// its files are now stored in layout, once they've been migrated to it.
+func RecordRepositoryLayout(config *Config, layout Layout) error {
+	markerPath := config.StatePath(repositoryMarkerName)
+	var marker *RepositoryMarker
+	err := readJSONState(markerPath, &marker)
+	if err != nil || marker == nil {
+		// Ignored with -force.
+		return err
+	}
+	marker.Layout = layout.String()
+	return writeJSONState(markerPath, marker)
+}
@@ -0,0 +1,86 @@
+package rsbackup
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestOpenRepository(t *testing.T) {
+	repositoryTests := []struct {
+		name           string
+		existingMarker *RepositoryMarker
+		init           bool
+		force          bool
+		expectedErr    bool
+		expectedMarker bool
+	}{
+		{"not a repository", nil, false, false, true, false},
+		{"init", nil, true, false, false, true},
+		{"force", nil, false, true, false, false},
+		{"existing", &RepositoryMarker{FormatVersion: RepositoryFormatVersion, ServerID: "abc", Layout: "hash2"}, false, false, false, true},
+		{"upgraded", &RepositoryMarker{FormatVersion: 1, ServerID: "abc"}, false, false, false, true},
+		{"newer format", &RepositoryMarker{FormatVersion: RepositoryFormatVersion + 1}, true, true, true, false},
+		{"other layout", &RepositoryMarker{FormatVersion: RepositoryFormatVersion, ServerID: "abc", Layout: "flat"}, true, true, true, false},
+	}
+
+	for _, tt := range repositoryTests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := &Config{BackupRoot: createTMPDir(t, "rsbackup")}
+			if tt.existingMarker != nil {
+				err := writeJSONState(config.StatePath(repositoryMarkerName), tt.existingMarker)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			layout := HashPrefixLayout{Levels: 2}
+			marker, err := OpenRepository(config, layout, tt.init, tt.force)
+			if (err != nil) != tt.expectedErr {
+				t.Fatalf("Got error '%v', expected error: %t", err, tt.expectedErr)
+			}
+			if (marker != nil) != tt.expectedMarker {
+				t.Fatalf("Got marker %+v, expected marker: %t", marker, tt.expectedMarker)
+			}
+			_, statErr := os.Stat(config.StatePath(repositoryMarkerName))
+			if markerWritten := statErr == nil; markerWritten != (tt.existingMarker != nil || tt.init) {
+				t.Errorf("Marker file exists: %t", markerWritten)
+			}
+			if marker == nil {
+				return
+			}
+
+			reopened, err := OpenRepository(config, layout, false, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if reopened.FormatVersion != RepositoryFormatVersion || reopened.Layout != "hash2" {
+				t.Errorf("Got format version %d and layout '%s' on reopen", reopened.FormatVersion, reopened.Layout)
+			}
+			if reopened.ServerID != marker.ServerID || reopened.ServerID == "" {
+				t.Errorf("Got server id '%s' on reopen, expected '%s'", reopened.ServerID, marker.ServerID)
+			}
+			if tt.init && time.Since(reopened.Created) > time.Minute {
+				t.Errorf("Got bad creation time %s", reopened.Created)
+			}
+		})
+	}
+}
+
+func TestRecordRepositoryLayout(t *testing.T) {
+	config := &Config{BackupRoot: createTMPDir(t, "rsbackup")}
+	_, err := OpenRepository(config, FlatLayout{}, true, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = RecordRepositoryLayout(config, HashPrefixLayout{Levels: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenRepository(config, FlatLayout{}, false, false); err == nil {
+		t.Errorf("Opened repository with its old layout after migration")
+	}
+	if _, err := OpenRepository(config, HashPrefixLayout{Levels: 1}, false, false); err != nil {
+		t.Errorf("Cannot open repository with its new layout: %s", err)
+	}
+}
@@ -0,0 +1,298 @@
+package rsbackup
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"runtime"
+	"sync"
+
+	"github.com/sirmackk/rsutils"
+)
+
+// restoreStripeSize is how much of a shard is read or decoded at a time
+// when restoring degraded data.
+var restoreStripeSize int64 = 1 << 20
+
+var errTooManyDamaged = errors.New("Too many damaged shards to reconstruct data")
+
+// shardSet gives random access to the padded data and parity shards of a
+// file. Parity shards that can't be opened are left nil.
+type shardSet struct {
+	md        *rsutils.Metadata
+	chunkSize int64
+	data      StorageFile
+	parity    []StorageFile
+	// codec and hash are the ones recorded in the metadata.
+	codec string
+	hash  string
+}
+
+func (r *RSFileManager) openShards(fname string) (*shardSet, error) {
+	fpath := r.DataPath(fname)
+	if packed := r.packedInfo(fpath); packed != nil {
+		// The shards of a packed file are those of its container.
+		return r.packFiles().openShards(packed.Container)
+	}
+	md, err := r.ReadMetadata(fpath)
+	if err != nil {
+		return nil, err
+	}
+	if md.DataShards < 1 || md.ParityShards < 0 || md.Size < 0 || len(md.Hashes) != md.DataShards+md.ParityShards {
+		return nil, fmt.Errorf("Invalid metadata for '%s'", fname)
+	}
+	data, err := r.storage().Open(fpath)
+	if err != nil {
+		return nil, err
+	}
+	s := &shardSet{
+		md:        md,
+		chunkSize: (md.Size + int64(md.DataShards) - 1) / int64(md.DataShards),
+		data:      data,
+		parity:    make([]StorageFile, md.ParityShards),
+	}
+	for i := range s.parity {
+		s.parity[i], _ = r.storage().Open(fmt.Sprintf("%s.parity.%d", fpath, i+1))
+	}
+	if extras, err := r.ReadExtras(fpath); err == nil {
+		s.codec, s.hash = extras.Codec, extras.Hash
+	}
+	return s, nil
+}
+
+func (s *shardSet) Close() {
+	s.data.Close()
+	for _, f := range s.parity {
+		if f != nil {
+			f.Close()
+		}
+	}
+}
+
+// dataLen returns how many bytes of data shard i are stored in the data
+// file, the rest of the shard is zero padding.
+func (s *shardSet) dataLen(i int) int64 {
+	n := s.md.Size - int64(i)*s.chunkSize
+	if n < 0 {
+		return 0
+	}
+	if n > s.chunkSize {
+		return s.chunkSize
+	}
+	return n
+}
+
+// readShardAt fills p with shard i starting at off. The caller must not
+// read past the end of the shard.
+func (s *shardSet) readShardAt(i int, p []byte, off int64) error {
+	if i >= s.md.DataShards {
+		f := s.parity[i-s.md.DataShards]
+		if f == nil {
+			return fmt.Errorf("Parity shard %d is missing", i-s.md.DataShards+1)
+		}
+		n, err := f.ReadAt(p, off)
+		if err == io.EOF && n == len(p) {
+			err = nil
+		}
+		return err
+	}
+	n := 0
+	if stored := s.dataLen(i) - off; stored > 0 {
+		if int64(len(p)) < stored {
+			stored = int64(len(p))
+		}
+		var err error
+		n, err = s.data.ReadAt(p[:stored], int64(i)*s.chunkSize+off)
+		if err != nil && !(err == io.EOF && int64(n) == stored) {
+			return err
+		}
+	}
+	for j := n; j < len(p); j++ {
+		p[j] = 0
+	}
+	return nil
+}
+
+// hashShard reports whether shard i matches its hash in the metadata.
+func (s *shardSet) hashShard(i int) bool {
+	hasher := newShardHash(s.hash)
+	buf := make([]byte, restoreStripeSize)
+	for off := int64(0); off < s.chunkSize; off += int64(len(buf)) {
+		if rest := s.chunkSize - off; rest < int64(len(buf)) {
+			buf = buf[:rest]
+		}
+		if s.readShardAt(i, buf, off) != nil {
+			return false
+		}
+		hasher.Write(buf)
+	}
+	return fmt.Sprintf("%x", hasher.Sum(nil)) == s.md.Hashes[i]
+}
+
+func restoreWorkers(config *Config) int {
+	if config.RestoreWorkers > 0 {
+		return config.RestoreWorkers
+	}
+	return runtime.NumCPU()
+}
+
+// DamagedShards hashes all shards of fname in parallel and returns the
+// indices of the ones that don't match the metadata, parity shards being
+// numbered after the data shards.
+func (r *RSFileManager) DamagedShards(fname string) ([]int, error) {
+	s, err := r.openShards(fname)
+	if err != nil {
+		return nil, err
+	}
+	defer s.Close()
+	return s.damaged(restoreWorkers(r.Config)), nil
+}
+
+func (s *shardSet) damaged(workers int) []int {
+	healthy := make([]bool, s.md.DataShards+s.md.ParityShards)
+	sem := make(chan struct{}, workers)
+	var wg sync.WaitGroup
+	for i := range healthy {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int) {
+			defer wg.Done()
+			healthy[i] = s.hashShard(i)
+			<-sem
+		}(i)
+	}
+	wg.Wait()
+	var damaged []int
+	for i, ok := range healthy {
+		if !ok {
+			damaged = append(damaged, i)
+		}
+	}
+	return damaged
+}
+
+// restorePiece is a stripe of one data shard, the unit of work when
+// restoring degraded data. Pieces are written out in file order.
+type restorePiece struct {
+	shard int
+	off   int64
+	len   int64
+	buf   []byte
+	err   error
+	done  chan struct{}
+}
+
+// WriteReconstructed writes the contents of fname to w, rebuilding the
+// stripes of damaged data shards from the healthy ones. Stripes are read
+// and decoded by a pool of workers while earlier ones are being written,
+// so a degraded restore is not much slower than reading a healthy file.
+func (r *RSFileManager) WriteReconstructed(w io.Writer, fname string, damaged []int) error {
+	if packed := r.packedInfo(r.DataPath(fname)); packed != nil {
+		w = &sectionWriter{w: w, skip: packed.Offset, size: packed.Size}
+		return r.packFiles().WriteReconstructed(w, packed.Container, damaged)
+	}
+	s, err := r.openShards(fname)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	isDamaged := make([]bool, s.md.DataShards+s.md.ParityShards)
+	for _, i := range damaged {
+		isDamaged[i] = true
+	}
+	var sources []int
+	for i, bad := range isDamaged {
+		if !bad && len(sources) < s.md.DataShards {
+			sources = append(sources, i)
+		}
+	}
+	if len(sources) < s.md.DataShards {
+		return fmt.Errorf("%w: %d damaged, %d parity shards", errTooManyDamaged, len(damaged), s.md.ParityShards)
+	}
+	enc, err := r.Config.newCodec(s.codec, s.md.DataShards, s.md.ParityShards)
+	if err != nil {
+		return err
+	}
+
+	restore := func(p *restorePiece) error {
+		stripeLen := s.chunkSize - p.off
+		if stripeLen > restoreStripeSize {
+			stripeLen = restoreStripeSize
+		}
+		if !isDamaged[p.shard] {
+			p.buf = make([]byte, stripeLen)
+			return s.readShardAt(p.shard, p.buf, p.off)
+		}
+		shards := make([][]byte, len(isDamaged))
+		for _, i := range sources {
+			shards[i] = make([]byte, stripeLen)
+			err := s.readShardAt(i, shards[i], p.off)
+			if err != nil {
+				return err
+			}
+		}
+		err := enc.ReconstructData(shards)
+		if err != nil {
+			return err
+		}
+		p.buf = shards[p.shard]
+		return nil
+	}
+
+	workers := restoreWorkers(r.Config)
+	quit := make(chan struct{})
+	jobs := make(chan *restorePiece)
+	// order holds pieces in file order, its capacity bounds how far the
+	// workers can get ahead of the writer.
+	order := make(chan *restorePiece, 2*workers)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for p := range jobs {
+				p.err = restore(p)
+				close(p.done)
+			}
+		}()
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer close(order)
+		defer close(jobs)
+		for shard := 0; shard < s.md.DataShards; shard++ {
+			for off := int64(0); off < s.dataLen(shard); off += restoreStripeSize {
+				p := &restorePiece{shard: shard, off: off, len: s.dataLen(shard) - off, done: make(chan struct{})}
+				if p.len > restoreStripeSize {
+					p.len = restoreStripeSize
+				}
+				select {
+				case order <- p:
+				case <-quit:
+					return
+				}
+				select {
+				case jobs <- p:
+				case <-quit:
+					return
+				}
+			}
+		}
+	}()
+
+	for p := range order {
+		<-p.done
+		err = p.err
+		if err == nil {
+			_, err = w.Write(p.buf[:p.len])
+		}
+		if err != nil {
+			break
+		}
+	}
+	close(quit)
+	wg.Wait()
+	return err
+}
@@ -0,0 +1,122 @@
+package rsbackup
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+)
+
+func TestWriteReconstructed(t *testing.T) {
+	expected, err := ioutil.ReadFile("testdata/tyger")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(size int64) { restoreStripeSize = size }(restoreStripeSize)
+
+	restoreTests := []struct {
+		name            string
+		shardName       string
+		removeParity    bool
+		stripeSize      int64
+		workers         int
+		expectedDamaged []int
+	}{
+		{"healthy", "tyger", false, 1 << 20, 1, nil},
+		{"corrupt data shard", "tyger_bad", false, 1 << 20, 1, []int{0}},
+		{"corrupt data shard, small stripes", "tyger_bad", false, 7, 4, []int{0}},
+		{"missing parity shard", "tyger", true, 7, 4, []int{2}},
+	}
+
+	for _, tt := range restoreTests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpDir := createTMPDir(t, "rsbackup")
+			conf := &Config{BackupRoot: tmpDir, DataShards: 2, ParityShards: 1, RestoreWorkers: tt.workers}
+			cloneShards(t, tt.shardName, tmpDir, conf)
+			if tt.removeParity {
+				os.Remove(path.Join(tmpDir, tt.shardName+".parity.1"))
+			}
+			restoreStripeSize = tt.stripeSize
+			fileMan := &RSFileManager{Config: conf}
+
+			damaged, err := fileMan.DamagedShards(tt.shardName)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(damaged, tt.expectedDamaged) {
+				t.Errorf("Got damaged shards %v, expected %v", damaged, tt.expectedDamaged)
+			}
+			var out bytes.Buffer
+			err = fileMan.WriteReconstructed(&out, tt.shardName, damaged)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(out.Bytes(), expected) {
+				t.Errorf("Reconstructed data doesn't match original")
+			}
+		})
+	}
+}
+
+func TestWriteReconstructedTooManyDamaged(t *testing.T) {
+	tmpDir := createTMPDir(t, "rsbackup")
+	conf := &Config{BackupRoot: tmpDir, DataShards: 2, ParityShards: 1}
+	cloneShards(t, "tyger_broken", tmpDir, conf)
+	fileMan := &RSFileManager{Config: conf}
+
+	damaged, err := fileMan.DamagedShards("tyger_broken")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	err = fileMan.WriteReconstructed(&out, "tyger_broken", damaged)
+	if err == nil {
+		t.Errorf("Expected error reconstructing '%s' with damaged shards %v", "tyger_broken", damaged)
+	}
+}
+
+func TestRetrieveDataVerify(t *testing.T) {
+	expected, err := ioutil.ReadFile("testdata/tyger")
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifyTests := []struct {
+		name                  string
+		shardName             string
+		url                   string
+		expectedStatus        int
+		expectedReconstructed string
+	}{
+		{"healthy", "tyger", "/retrieve_data/tyger?verify=true", 200, ""},
+		{"damaged, no verify", "tyger_bad", "/retrieve_data/tyger_bad", 200, ""},
+		{"damaged", "tyger_bad", "/retrieve_data/tyger_bad?verify=true", 200, "true"},
+		{"broken", "tyger_broken", "/retrieve_data/tyger_broken?verify=true", 422, ""},
+	}
+
+	for _, tt := range verifyTests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpDir := createTMPDir(t, "rsbackup")
+			conf := &Config{BackupRoot: tmpDir, DataShards: 2, ParityShards: 1}
+			cloneShards(t, tt.shardName, tmpDir, conf)
+			api := &RSBackupAPI{Config: conf, RsFileMan: &RSFileManager{Config: conf}}
+
+			req := httptest.NewRequest("GET", tt.url, nil)
+			rr := httptest.NewRecorder()
+			http.HandlerFunc(api.retrieveDataHandler).ServeHTTP(rr, req)
+
+			if rr.Code != tt.expectedStatus {
+				t.Fatalf("Got status code %d, expected %d", rr.Code, tt.expectedStatus)
+			}
+			if got := rr.Header().Get("Reconstructed"); got != tt.expectedReconstructed {
+				t.Errorf("Got Reconstructed header '%s', expected '%s'", got, tt.expectedReconstructed)
+			}
+			if tt.expectedReconstructed == "true" && !bytes.Equal(rr.Body.Bytes(), expected) {
+				t.Errorf("Reconstructed data doesn't match original")
+			}
+		})
+	}
+}
@@ -1,6 +1,8 @@
 package rsbackup
 
 import (
+	"bytes"
+	"crypto/cipher"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -16,126 +18,454 @@ import (
 
 type RSFileManager struct {
 	Config *Config
+	// Layout decides where files are stored, defaults to FlatLayout.
+	Layout Layout
+	// Keys holds the master keys of encrypted files, new files are
+	// encrypted when it has an active key.
+	Keys *KeyRing
+	// Storage holds the files, defaults to OSBackend.
+	Storage StorageBackend
+	// Chunks counts the references to the chunks of deduplicated files,
+	// new files of the default storage class are deduplicated when it's
+	// set and Config.Dedup is on.
+	Chunks *ChunkStore
+	// Packs holds the containers of packed files, new files no larger
+	// than Config.PackThreshold are packed when it's set.
+	Packs *PackStore
+	// Index keeps the metadata of files for listings when set.
+	Index *MetadataIndex
+	// Journal records submits, renames and deletes in progress when set,
+	// see RecoverOperations.
+	Journal *OperationJournal
+	// Cache keeps recently retrieved files when set.
+	Cache *ReadCache
 }
 
 func (r *RSFileManager) ListData() ([]string, error) {
-	dir, err := os.Open(r.Config.BackupRoot)
+	if r.Index != nil {
+		return r.Index.Names()
+	}
+	names, err := r.listDir(r.Config.BackupRoot, r.layout().Depth())
 	if err != nil {
 		return nil, err
 	}
-	defer dir.Close()
-	names, err := dir.Readdirnames(-1)
+	sort.Slice(names, func(i, j int) bool { return names[i] < names[j] })
+	return names, nil
+}
+
+// WalkData calls fn with the name of each stored file as it's found,
+// stopping at the first error fn returns. Names come sorted from the
+// index, otherwise sorted within each directory of the layout.
+func (r *RSFileManager) WalkData(fn func(string) error) error {
+	if r.Index != nil {
+		return r.Index.WalkNames(fn)
+	}
+	return r.walkDir(r.Config.BackupRoot, r.layout().Depth(), fn)
+}
+
+// listDir returns the names of data files found depth directory levels
+// below dir.
+func (r *RSFileManager) listDir(dir string, depth int) ([]string, error) {
+	names := []string{}
+	err := r.walkDir(dir, depth, func(name string) error {
+		names = append(names, name)
+		return nil
+	})
 	if err != nil {
 		return nil, err
 	}
-	n := 0
-	for _, name := range names {
-		matched, err := regexp.MatchString(`(.*parity\.\d+|md$)`, name)
+	return names, nil
+}
+
+// walkDir calls fn with the names of data files found depth directory
+// levels below dir, sorted within each directory. Directories below dir
+// that can't be listed are skipped.
+func (r *RSFileManager) walkDir(dir string, depth int, fn func(string) error) error {
+	var fnErr error
+	var walk func(dir string, depth int) error
+	walk = func(dir string, depth int) error {
+		names, err := r.storage().List(dir)
 		if err != nil {
-			log.Errorf("Error while listing file '%s', skipping (error: %s)", name, err)
-			continue
+			return err
 		}
-		if !matched {
-			names[n] = name
-			n++
+		sort.Strings(names)
+		for _, name := range names {
+			if fnErr != nil {
+				return nil
+			}
+			if isReservedName(name) {
+				continue
+			}
+			if depth > 0 {
+				if err := walk(path.Join(dir, name), depth-1); err != nil {
+					log.Errorf("Error while listing directory '%s', skipping (error: %s)", name, err)
+				}
+				continue
+			}
+			matched, err := regexp.MatchString(`(\.parity\.\d+|\.md|\.md\.mirror)$`, name)
+			if err != nil {
+				log.Errorf("Error while listing file '%s', skipping (error: %s)", name, err)
+				continue
+			}
+			if !matched {
+				fnErr = fn(name)
+			}
 		}
+		return nil
 	}
-	names = names[:n]
+	err := walk(dir, depth)
+	if fnErr != nil {
+		return fnErr
+	}
+	return err
+}
 
-	sort.Slice(names, func(i, j int) bool { return names[i] < names[j] })
-	return names, nil
+func (r *RSFileManager) layout() Layout {
+	if r.Layout == nil {
+		return FlatLayout{}
+	}
+	return r.Layout
+}
+
+func (r *RSFileManager) storage() StorageBackend {
+	if r.Storage == nil {
+		return OSBackend{}
+	}
+	return r.Storage
+}
+
+// Stat returns the file info of the data file of fname.
+func (r *RSFileManager) Stat(fname string) (os.FileInfo, error) {
+	return r.storage().Stat(r.DataPath(fname))
+}
+
+// DataPath returns the path of the data file for fname under the
+// configured layout.
+func (r *RSFileManager) DataPath(fname string) string {
+	return path.Join(r.Config.BackupRoot, r.layout().Path(fname))
 }
 
 // ReadMetadata applies the naming scheme of "file" + ".md" to find
 // and read the metadata of the file at "fpath"
 func (r *RSFileManager) ReadMetadata(fpath string) (*rsutils.Metadata, error) {
 	mdPath := fpath + ".md"
-	mdFile, err := os.Open(mdPath)
+	md, err := r.readStoredMetadata(fpath)
 	if err != nil {
 		if os.IsNotExist(err) {
 			log.Errorf("Metadata file '%s' does not exist!", mdPath)
 			return nil, fmt.Errorf("Metadata not found")
 		}
-		log.Errorf("Cannot open metadata file '%s': %s", mdPath, err)
+		log.Errorf("Unable to read metadata '%s': %s", mdPath, err)
 		return nil, err
 	}
-	var md rsutils.Metadata
-	err = json.NewDecoder(mdFile).Decode(&md)
+	if md.Metadata == nil {
+		return &rsutils.Metadata{}, nil
+	}
+	return md.Metadata, nil
+}
+
+// WriteMetadata writes md, along with extras, next to the data file of
+// fname.
+func (r *RSFileManager) WriteMetadata(fname string, md *rsutils.Metadata, extras MetadataExtras) error {
+	fpath := r.DataPath(fname)
+	stored := &storedMetadata{Metadata: md, MetadataExtras: extras}
+	err := sealMetadata(stored)
+	if err == nil {
+		err = r.createMetadata(fpath+".md", stored)
+	}
 	if err != nil {
-		log.Errorf("Unable to decode metadata '%s': %s", mdPath, err)
-		return nil, err
+		return err
+	}
+	// The metadata is complete without its mirror, which checks write
+	// again. A mirror left behind by a file of the same name goes first.
+	err = r.storage().Remove(fpath + metadataMirrorSuffix)
+	if err == nil || os.IsNotExist(err) {
+		err = r.createMetadata(fpath+metadataMirrorSuffix, stored)
+	}
+	if err != nil {
+		log.Errorf("Unable to mirror metadata of %s: %s", fpath, err)
 	}
-	return &md, nil
+	r.reindex(fname)
+	return nil
 }
 
-func (r *RSFileManager) WriteMetadata(fname string, md *rsutils.Metadata) error {
-	fpath := path.Join(r.Config.BackupRoot, fname)
-	mdPath := fpath + ".md"
-	mdFile, err := os.OpenFile(mdPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0655)
+// createMetadata writes md, sealed, to the new metadata file at mdPath.
+func (r *RSFileManager) createMetadata(mdPath string, md *storedMetadata) error {
+	mdFile, err := createStaged(r.storage(), mdPath, r.Config.Fsync)
 	if err != nil {
 		log.Errorf("Cannot create metadata file %s: %s", mdPath, err)
 		return err
 	}
 	err = json.NewEncoder(mdFile).Encode(md)
+	if err == nil {
+		err = mdFile.commit()
+	} else {
+		mdFile.abort()
+	}
 	if err != nil {
 		log.Errorf("Unable to encode metadata to %s: %s", mdPath, err)
-		return err
 	}
-	return nil
+	return err
 }
 
-func (r *RSFileManager) SaveFile(src io.Reader, fname string) (string, error) {
-	dstPath := path.Join(r.Config.BackupRoot, fname)
-	outputFile, err := os.OpenFile(dstPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0655)
+// SaveFile stores the contents of src as the data file of fname. Unless
+// the client encrypted them already, their holes are left out and they are
+// deduplicated or compressed when the config asks for it, a deduplicated
+// file storing the manifest of its chunks instead. They are encrypted when the key ring has an
+// active key. How is recorded in extras, which must go into the metadata
+// of the file. If extras has an Archive, the members of the archive are
+// indexed into it.
+func (r *RSFileManager) SaveFile(src io.Reader, fname string, extras *MetadataExtras) (string, error) {
+	dstPath, _, err := r.saveFile(src, -1, fname, extras)
+	return dstPath, err
+}
+
+// saveFile is SaveFile for src of size bytes, -1 if unknown. When the
+// contents are stored as they are, and their parity fits in
+// Config.SinglePassBuffer, it's computed while they're saved and the
+// encoder holding it is returned too.
+func (r *RSFileManager) saveFile(src io.Reader, size int64, fname string, extras *MetadataExtras) (string, *parityEncoder, error) {
+	dstPath := r.DataPath(fname)
+	outputFile, err := createStaged(r.storage(), dstPath, r.Config.Fsync)
 	if err != nil {
-		return "", err
+		return "", nil, err
+	}
+	var indexer *tarIndexer
+	if extras.Archive != nil {
+		indexer = newTarIndexer(src)
+		src = indexer
+	}
+	if r.Config.Sparse && extras.ClientCipher == nil {
+		sparsing := newSparsingReader(src)
+		src, extras.Sparse = sparsing, sparsing.info
+	}
+	var manifest *chunkManifest
+	if r.Config.Dedup && r.Chunks != nil && extras.ClientCipher == nil && extras.StorageClass == "" && extras.Replicas == 0 && !r.Keys.Encrypting() {
+		var stored int64
+		manifest, stored, err = r.Chunks.store(r.chunkFiles(), src, r.Config.dedupChunkSize())
+		if err != nil {
+			outputFile.abort()
+			return "", nil, err
+		}
+		// Chunks are compressed on their own.
+		extras.Dedup = &DedupInfo{Size: manifest.size(), Chunks: len(manifest.Chunks), Stored: stored}
+		encoded, _ := json.Marshal(manifest)
+		src = bytes.NewReader(encoded)
+	} else if r.Config.Compression != "" && extras.ClientCipher == nil {
+		compressing := newCompressingReader(src)
+		defer compressing.Close()
+		src, extras.Compression = compressing, compressing.info
+	}
+	var enc *EncryptionInfo
+	var encoder *parityEncoder
+	if r.Keys.Encrypting() {
+		var dataKey []byte
+		dataKey, enc, err = r.Keys.newDataKey()
+		if err == nil {
+			var aead cipher.AEAD
+			aead, err = newGCM(dataKey)
+			if err == nil {
+				enc.Size, err = encryptTo(outputFile, src, aead)
+			}
+		}
+	} else {
+		var dst io.Writer = outputFile
+		// Deferred parity is computed from the stored file later on.
+		if extras.Sparse == nil && manifest == nil && extras.Compression == nil && !r.Config.DeferParity {
+			dataShards, parityShards := r.Config.protection(extras, size)
+			encoder, err = newParityEncoder(r.Config, size, dataShards, parityShards)
+			if encoder != nil {
+				dst = io.MultiWriter(outputFile, encoder)
+			}
+		}
+		if err == nil {
+			_, err = io.CopyBuffer(dst, src, make([]byte, r.Config.writeBufferSize()))
+		}
+	}
+	if indexer != nil {
+		members, indexErr := indexer.close()
+		if err == nil {
+			extras.Archive.Members, err = members, indexErr
+		}
+	}
+	if err == nil {
+		err = outputFile.commit()
+	} else {
+		// Don't leave a partial file behind, it would block resubmission.
+		outputFile.abort()
 	}
-	defer outputFile.Close()
-	_, err = io.Copy(outputFile, src)
 	if err != nil {
-		return "", err
+		r.releaseChunks(manifest, false)
+		return "", nil, err
+	}
+	extras.Encryption = enc
+	if encoder != nil && encoder.metadata() == nil {
+		// The size was wrong, the parity is computed from the file.
+		encoder = nil
 	}
-	return dstPath, nil
+	return dstPath, encoder, nil
 }
 
 func (rs *RSBackupAPI) GenerateParityFiles(dataFilePath string) (*rsutils.Metadata, error) {
-	dataFile, err := os.Open(dataFilePath)
+	return rs.generateParity(rs.RsFileMan.storage(), dataFilePath, nil)
+}
+
+// generateParity writes the parity files of the data file at dataFilePath
+// in storage, with the shard counts a file of its size and extras gets,
+// or replicas, and records its codec, hash and segments in extras. Without extras it's
+// protected like a file of the default storage class.
+func (rs *RSBackupAPI) generateParity(storage StorageBackend, dataFilePath string, extras *MetadataExtras) (*rsutils.Metadata, error) {
+	stat, err := storage.Stat(dataFilePath)
+	if err != nil {
+		return nil, err
+	}
+	if extras == nil {
+		extras = &MetadataExtras{}
+	}
+	dataShards, parityShards := rs.Config.protection(extras, stat.Size())
+	md, segments, err := writeParity(storage, dataFilePath, dataShards, parityShards, rs.Config)
 	if err != nil {
 		return nil, err
 	}
+	extras.Codec, extras.Hash, extras.Segments = rs.Config.codecName(), rs.Config.shardHashName(), segments
+	return md, nil
+}
+
+// writeParity writes the parity shards of the data file at dataFilePath in
+// storage, each staged until all are complete, encoding and syncing them
+// as config says. It returns the segments of files large enough to be
+// hashed by segment.
+func writeParity(storage StorageBackend, dataFilePath string, dataShards, parityShards int, config *Config) (*rsutils.Metadata, *SegmentInfo, error) {
+	return writeParityAt(storage, dataFilePath, storage, dataFilePath, dataShards, parityShards, config)
+}
+
+// writeParityAt is writeParity with the parity files written as those of
+// dstPath in dst instead of next to the data file.
+func writeParityAt(storage StorageBackend, dataFilePath string, dst StorageBackend, dstPath string, dataShards, parityShards int, config *Config) (*rsutils.Metadata, *SegmentInfo, error) {
+	dataFile, err := storage.Open(dataFilePath)
+	if err != nil {
+		return nil, nil, err
+	}
 	defer dataFile.Close()
 	dataFileStat, err := dataFile.Stat()
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	dataFileSize := dataFileStat.Size()
-	dataShards := rs.Config.DataShards
-	parityShards := rs.Config.ParityShards
 
-	dataChunks := rsutils.SplitIntoPaddedChunks(dataFile, dataFileSize, dataShards)
-	dataSources := make([]io.Reader, len(dataChunks))
-	for i := range dataChunks {
-		dataSources[i] = dataChunks[i]
+	var md *rsutils.Metadata
+	var segments *SegmentInfo
+	err = writeParityFiles(dst, dstPath, parityShards, config.Fsync, func(parityWriters []io.Writer) error {
+		if dataFileSize == 0 {
+			// An empty file has no stripes.
+			dataChunks := rsutils.SplitIntoPaddedChunks(dataFile, dataFileSize, dataShards)
+			dataSources := make([]io.Reader, len(dataChunks))
+			for i := range dataChunks {
+				dataSources[i] = dataChunks[i]
+			}
+			md, err = rsutils.NewShardCreator(dataSources, dataFileSize, dataShards, parityShards).Encode(parityWriters)
+			return err
+		}
+		md, segments, err = encodeStripes(dataFile, dataFileSize, dataShards, parityShards, config, parityWriters)
+		return err
+	})
+	if err != nil {
+		return nil, nil, err
 	}
-	parityWriters := make([]io.Writer, rs.Config.ParityShards)
+	return md, segments, nil
+}
+
+// writeParityFiles stages the parityShards parity files of the data file
+// at dataFilePath, has write fill them and commits them once all are
+// complete.
+func writeParityFiles(storage StorageBackend, dataFilePath string, parityShards int, fsync string, write func([]io.Writer) error) error {
+	parityFiles := make([]*stagedFile, 0, parityShards)
+	defer func() {
+		for _, f := range parityFiles {
+			f.abort()
+		}
+	}()
+	parityWriters := make([]io.Writer, parityShards)
 	for i := range parityWriters {
 		parityPath := fmt.Sprintf("%s.parity.%d", dataFilePath, i+1)
-		pwriter, err := os.OpenFile(parityPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0655)
+		pwriter, err := createStaged(storage, parityPath, fsync)
 		if err != nil {
-			return nil, err
+			return err
 		}
-		defer pwriter.Close()
+		parityFiles = append(parityFiles, pwriter)
 		parityWriters[i] = pwriter
 	}
-	shardCreator := rsutils.NewShardCreator(dataSources, dataFileSize, dataShards, parityShards)
-	return shardCreator.Encode(parityWriters)
+	if err := write(parityWriters); err != nil {
+		return err
+	}
+	for len(parityFiles) > 0 {
+		err := parityFiles[0].commit()
+		parityFiles = parityFiles[1:]
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// closeFiles closes files and returns the first error, files written to
+// must be closed this way, as some backends only store them on close.
+func closeFiles(files []StorageFile) error {
+	var firstErr error
+	for _, f := range files {
+		if err := f.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// lostData returns the metadata of the file at fpath if its data file is
+// missing while the metadata is left, e.g. after the disk holding the data
+// failed. The data can then still be rebuilt from the parity.
+func (r *RSFileManager) lostData(fpath string) (*rsutils.Metadata, bool) {
+	if _, err := r.storage().Stat(fpath + ".md"); err != nil {
+		return nil, false
+	}
+	md, err := r.ReadMetadata(fpath)
+	return md, err == nil
 }
 
-func (r *RSFileManager) RepairData(fname string) error {
+// recreateShard replaces the missing shard at fpath with size zeroes, for
+// a repair to rebuild.
+func (r *RSFileManager) recreateShard(fpath string, size int64) (StorageFile, error) {
+	log.Warnf("Recreating missing shard '%s'", fpath)
+	f, err := r.storage().CreateExclusive(fpath)
+	if err != nil {
+		return nil, err
+	}
+	err = f.Truncate(size)
+	if err != nil {
+		f.Close()
+		r.storage().Remove(fpath)
+		return nil, err
+	}
+	return f, nil
+}
+
+func (r *RSFileManager) RepairData(fname string) (err error) {
 	// TODO: can this be deduplicated from CheckData?
 	// Is there a clean, safe way to ensure closing files across functions?
-	fpath := path.Join(r.Config.BackupRoot, fname)
-	dataFile, err := os.OpenFile(fpath, os.O_RDWR, 0664)
+	fpath := r.DataPath(fname)
+	if packed := r.packedInfo(fpath); packed != nil {
+		_, _, err = r.checkPacked(fname, packed, true)
+		return err
+	}
+	var recreated []string
+	dataFile, err := r.storage().OpenWritable(fpath)
+	if os.IsNotExist(err) {
+		if md, ok := r.lostData(fpath); ok {
+			dataFile, err = r.recreateShard(fpath, md.Size)
+			if err == nil {
+				recreated = append(recreated, fpath)
+			}
+		}
+	}
 	if err != nil {
 		if os.IsNotExist(err) {
 			log.Errorf("Requested file '%s' does not exist", fpath)
@@ -144,7 +474,17 @@ func (r *RSFileManager) RepairData(fname string) error {
 		log.Errorf("Cannot open file '%s': %s", fpath, err)
 		return err
 	}
-	defer dataFile.Close()
+	files := []StorageFile{dataFile}
+	defer func() {
+		closeFiles(files)
+		// Shards that couldn't be rebuilt stay missing rather than
+		// zeroed.
+		if err != nil {
+			for _, shardPath := range recreated {
+				r.storage().Remove(shardPath)
+			}
+		}
+	}()
 	md, err := r.ReadMetadata(fpath)
 	if err != nil {
 		return err
@@ -155,29 +495,63 @@ func (r *RSFileManager) RepairData(fname string) error {
 	for i := range fileChunks {
 		shards[i] = fileChunks[i]
 	}
+	chunkSize := (md.Size + int64(md.DataShards) - 1) / int64(md.DataShards)
 	for i := 0; i < md.ParityShards; i++ {
 		parityPath := fmt.Sprintf("%s.parity.%d", fpath, i+1)
-		parityChunk, err := os.OpenFile(parityPath, os.O_RDWR, 0664)
+		parityChunk, err := r.storage().OpenWritable(parityPath)
+		if os.IsNotExist(err) {
+			parityChunk, err = r.recreateShard(parityPath, chunkSize)
+			if err == nil {
+				recreated = append(recreated, parityPath)
+			}
+		}
 		if err != nil {
 			return err
 		}
-		defer parityChunk.Close()
+		files = append(files, parityChunk)
 		shards[md.DataShards+i] = parityChunk
 	}
-	shardMan := rsutils.NewShardManager(shards, md)
+	extras, err := r.ReadExtras(fpath)
 	if err != nil {
-		log.Errorf("Cannot create shardManager for %s: %s", fname, err)
 		return err
 	}
-	return shardMan.Repair()
+	if segments := shardSegments(md, extras); segments != nil {
+		s := &shardSet{md: md, chunkSize: chunkSize, data: dataFile, parity: files[1:], codec: extras.Codec, hash: extras.Hash}
+		err = s.repairSegments(r.Config, segments)
+	} else {
+		err = rsutils.NewShardManager(shards, md).Repair()
+	}
+	if err != nil {
+		return err
+	}
+	err = closeFiles(files)
+	files = nil
+	if err != nil {
+		return err
+	}
+	recreated = nil
+	_, err = r.checkChunks(fpath, true)
+	return err
 }
 
 func (r *RSFileManager) CheckData(fname string) (bool, string, []string, error) {
 	// TODO: returning 4 items is a code smell
-	fpath := path.Join(r.Config.BackupRoot, fname)
-	dataFile, err := os.Open(fpath)
+	fpath := r.DataPath(fname)
+	r.repairMetadata(fpath)
+	if packed := r.packedInfo(fpath); packed != nil {
+		health, lmod, err := r.checkPacked(fname, packed, false)
+		if err != nil {
+			return false, "", []string{}, err
+		}
+		return health, lmod, []string{}, nil
+	}
+	dataFile, err := r.storage().Open(fpath)
 	if err != nil {
 		if os.IsNotExist(err) {
+			if md, ok := r.lostData(fpath); ok {
+				log.Infof("Data of '%s' is missing", fname)
+				return false, "", md.Hashes, nil
+			}
 			log.Errorf("Requested file '%s' does not exist", fpath)
 			return false, "", []string{}, fmt.Errorf("File not found")
 		}
@@ -195,25 +569,52 @@ func (r *RSFileManager) CheckData(fname string) (bool, string, []string, error)
 	for i := range fileChunks {
 		shards[i] = fileChunks[i]
 	}
+	parityFiles := make([]StorageFile, md.ParityShards)
+	var health = true
 	for i := 0; i < md.ParityShards; i++ {
 		parityPath := fmt.Sprintf("%s.parity.%d", fpath, i+1)
-		parityChunk, err := os.Open(parityPath)
+		parityChunk, err := r.storage().Open(parityPath)
+		if os.IsNotExist(err) {
+			log.Infof("Parity shard '%s' is missing", parityPath)
+			health = false
+			continue
+		}
 		if err != nil {
 			return false, "", []string{}, err
 		}
 		defer parityChunk.Close()
 		shards[md.DataShards+i] = parityChunk
+		parityFiles[i] = parityChunk
 	}
-	shardMan := rsutils.NewShardManager(shards, md)
+	extras, err := r.ReadExtras(fpath)
 	if err != nil {
-		log.Errorf("Cannot create shardManager for %s: %s", fname, err)
 		return false, "", []string{}, err
 	}
-	err = shardMan.CheckHealth()
-	var health = true
-	if err != nil {
-		log.Infof("Found corrupted shards for '%s': %s", fname, err)
-		health = false
+	if segments := shardSegments(md, extras); health && segments != nil {
+		// Each segment is read and hashed on its own, not whole shards.
+		s := &shardSet{md: md, chunkSize: (md.Size + int64(md.DataShards) - 1) / int64(md.DataShards), data: dataFile, parity: parityFiles, codec: extras.Codec, hash: extras.Hash}
+		damaged, err := s.damagedBlocks(segments)
+		if err != nil {
+			return false, "", []string{}, err
+		}
+		for _, block := range damaged {
+			log.Infof("Found corrupted block of shard %d of '%s' at %d, %d bytes", block.Shard, fname, block.Offset, block.Length)
+			health = false
+		}
+	} else if health {
+		shardMan := rsutils.NewShardManager(shards, md)
+		err = shardMan.CheckHealth()
+		if err != nil {
+			log.Infof("Found corrupted shards for '%s': %s", fname, err)
+			health = false
+		}
+	}
+	if health {
+		// A deduplicated file is only as healthy as its chunks.
+		health, err = r.checkChunks(fpath, false)
+		if err != nil {
+			return false, "", []string{}, err
+		}
 	}
 
 	stat, err := dataFile.Stat()
@@ -222,5 +623,5 @@ func (r *RSFileManager) CheckData(fname string) (bool, string, []string, error)
 		return false, "", []string{}, err
 	}
 	lmod := stat.ModTime().Format("2006-01-02 15:04:05")
-	return health, lmod, shardMan.Metadata.Hashes, nil
+	return health, lmod, md.Hashes, nil
 }
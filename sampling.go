@@ -0,0 +1,149 @@
+package rsbackup
+
+import (
+	"math/rand"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// SampleStripes checks each stripe of fname with probability rate by
+// recomputing its parity from the data. It returns the number of stripes
+// checked and whether they were all consistent. Unlike DamagedShards this
+// can't tell which shard is damaged, only that one is.
+func (r *RSFileManager) SampleStripes(fname string, rate float64) (int, bool, error) {
+	s, err := r.openShards(fname)
+	if err != nil {
+		return 0, false, err
+	}
+	defer s.Close()
+	sampled, _, consistent, err := s.sampleStripes(r.Config, rate)
+	return sampled, consistent, err
+}
+
+// sampleStripes is SampleStripes on the open shards of a file, it also
+// returns the bytes read.
+func (s *shardSet) sampleStripes(config *Config, rate float64) (int, int64, bool, error) {
+	if s.md.ParityShards == 0 {
+		return 0, 0, true, nil
+	}
+	enc, err := config.newCodec(s.codec, s.md.DataShards, s.md.ParityShards)
+	if err != nil {
+		return 0, 0, false, err
+	}
+	sampled := 0
+	var read int64
+	for off := int64(0); off < s.chunkSize; off += restoreStripeSize {
+		if rand.Float64() >= rate {
+			continue
+		}
+		stripeLen := s.chunkSize - off
+		if stripeLen > restoreStripeSize {
+			stripeLen = restoreStripeSize
+		}
+		shards := make([][]byte, s.md.DataShards+s.md.ParityShards)
+		for i := range shards {
+			shards[i] = make([]byte, stripeLen)
+			err = s.readShardAt(i, shards[i], off)
+			if err != nil {
+				return sampled, read, false, err
+			}
+			read += stripeLen
+		}
+		sampled++
+		ok, err := enc.Verify(shards)
+		if err != nil {
+			return sampled, read, false, err
+		}
+		if !ok {
+			return sampled, read, false, nil
+		}
+	}
+	return sampled, read, true, nil
+}
+
+// sampleBlocks checks each block of each shard with probability rate
+// against its hash. It returns the bytes read and the damaged blocks
+// among those sampled.
+func (s *shardSet) sampleBlocks(segments *SegmentInfo, rate float64) (int64, []DamagedBlock, error) {
+	if err := s.checkSegments(segments); err != nil {
+		return 0, nil, err
+	}
+	var read int64
+	var damaged []DamagedBlock
+	buf := segmentBuffer(segments)
+	for k := range segments.Hashes {
+		n := s.segmentLen(segments, k)
+		for i := 0; i < s.md.DataShards+s.md.ParityShards; i++ {
+			if rand.Float64() >= rate {
+				continue
+			}
+			read += n
+			if !s.readSegment(segments, k, i, buf) {
+				damaged = append(damaged, DamagedBlock{Shard: i, Offset: int64(k) * segments.Stripe, Length: n})
+			}
+		}
+	}
+	return read, damaged, nil
+}
+
+// SampleFile checks a random share rate of the blocks of fname against
+// their hashes, or of its stripes against their parity if its shards
+// aren't hashed in blocks. It returns the bytes read and whether all it
+// checked was intact, which doesn't prove the whole file is.
+func (r *RSFileManager) SampleFile(fname string, rate float64) (int64, bool, error) {
+	extras, err := r.ReadExtras(r.DataPath(fname))
+	if err != nil {
+		return 0, false, err
+	}
+	s, err := r.openShards(fname)
+	if err != nil {
+		return 0, false, err
+	}
+	defer s.Close()
+	if extras.Segments == nil || extras.Packed != nil {
+		_, read, consistent, err := s.sampleStripes(r.Config, rate)
+		return read, consistent, err
+	}
+	read, damaged, err := s.sampleBlocks(extras.Segments, rate)
+	for _, block := range damaged {
+		log.Infof("Found corrupted block of shard %d of '%s' at %d, %d bytes", block.Shard, fname, block.Offset, block.Length)
+	}
+	return read, len(damaged) == 0, err
+}
+
+// queueSample has a sample of fname checked in the background, unless too
+// many samples are waiting already.
+func (rs *RSBackupAPI) queueSample(fname string) {
+	samples := rs.background().sample
+	go func() {
+		err := samples.acquire(nil)
+		if err != nil {
+			log.Debugf("Skipping sample of %s: %s", fname, err)
+			return
+		}
+		defer samples.release()
+		rs.sampleRead(fname)
+	}()
+}
+
+// sampleRead checks a sample of the stripes of fname, which is being read,
+// at the configured rate. Damage or errors found go into the health cache;
+// a clean sample doesn't prove the file healthy, so it isn't recorded.
+func (rs *RSBackupAPI) sampleRead(fname string) {
+	if rs.Config.ReadSampleRate <= 0 {
+		return
+	}
+	sampled, consistent, err := rs.RsFileMan.SampleStripes(fname, rs.Config.ReadSampleRate)
+	if err != nil {
+		log.Warnf("Sampling stripes of %s failed: %s", fname, err)
+		rs.recordCheckError(fname, err)
+		return
+	}
+	if !consistent {
+		log.Warnf("Sampled stripes of %s don't match their parity, it needs a check", fname)
+		rs.recordHealth(fname, false)
+		rs.recordEvent(fname, eventCorruptionFound, "read sample")
+		return
+	}
+	log.Debugf("Sampled %d stripes of %s, no damage found", sampled, fname)
+}
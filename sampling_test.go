@@ -0,0 +1,42 @@
+package rsbackup
+
+import (
+	"testing"
+)
+
+func TestSampleStripes(t *testing.T) {
+	defer func(size int64) { restoreStripeSize = size }(restoreStripeSize)
+	restoreStripeSize = 64
+
+	tmpDir := createTMPDir(t, "rsbackup")
+	conf := &Config{BackupRoot: tmpDir, DataShards: 2, ParityShards: 1, ReadSampleRate: 1}
+	cloneShards(t, "tyger", tmpDir, conf)
+	cloneShards(t, "tyger_bad", tmpDir, conf)
+	health, err := NewHealthCache(conf.StatePath("health.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	api := &RSBackupAPI{Config: conf, RsFileMan: &RSFileManager{Config: conf}, Health: health}
+
+	sampled, consistent, err := api.RsFileMan.SampleStripes("tyger", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 808 bytes in 2 shards of 404 bytes, 7 stripes each.
+	if sampled != 7 || !consistent {
+		t.Errorf("Got %d stripes sampled, consistent: %t, expected 7 and true", sampled, consistent)
+	}
+	sampled, _, err = api.RsFileMan.SampleStripes("tyger", 0)
+	if err != nil || sampled != 0 {
+		t.Errorf("Sampled %d stripes at rate 0 (error: %v)", sampled, err)
+	}
+
+	api.sampleRead("tyger")
+	if _, ok := health.Get("tyger"); ok {
+		t.Errorf("Clean sample recorded as health")
+	}
+	api.sampleRead("tyger_bad")
+	if record, ok := health.Get("tyger_bad"); !ok || record.Health {
+		t.Errorf("Damage found by sampling not recorded, got %+v", record)
+	}
+}
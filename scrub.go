@@ -0,0 +1,188 @@
+package rsbackup
+
+import (
+	"context"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ScrubSummary is the outcome of one scrub cycle.
+type ScrubSummary struct {
+	Checked int
+	Damaged []string
+	// Failed maps the files that couldn't be checked to the reason.
+	Failed   map[string]string
+	Duration time.Duration
+	// Sampled is set for cycles that only checked a sample of each file,
+	// see Config.ScrubSampleRate.
+	Sampled bool
+}
+
+// scrubSampleRate returns the share of each file the scrub cycle pass,
+// counted from 1, checks, 0 for all of it.
+func (c *Config) scrubSampleRate(pass int) float64 {
+	every := c.DeepScrubEvery
+	if every == 0 {
+		every = 10
+	}
+	if pass%every == 0 {
+		return 0
+	}
+	return c.ScrubSampleRate
+}
+
+// Scrub checks every stored file once and records the results in the
+// health cache. A file that can't be read is recorded with its error and
+// skipped, so the cycle always covers the remaining files. Files are
+// checked by the scrub workers, paced to the scrub read rate. Closing stop
+// ends the cycle early.
+func (rs *RSBackupAPI) Scrub(stop <-chan struct{}) (*ScrubSummary, error) {
+	return rs.scrub(stop, 0)
+}
+
+// scrub is Scrub, checking only a random share rate of the blocks or
+// stripes of each file unless rate is 0. Sampling only records damage in
+// the health cache, an intact sample doesn't prove the file healthy.
+func (rs *RSBackupAPI) scrub(stop <-chan struct{}, rate float64) (*ScrubSummary, error) {
+	start := time.Now()
+	names, err := rs.RsFileMan.ListData()
+	if err != nil {
+		return nil, err
+	}
+	work := rs.background()
+	summary := &ScrubSummary{Failed: make(map[string]string), Sampled: rate > 0}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	check := func(name string) {
+		defer wg.Done()
+		defer work.scrub.release()
+		var health bool
+		var read int64
+		var err error
+		if summary.Sampled {
+			read, health, err = rs.RsFileMan.SampleFile(name, rate)
+		} else {
+			health, _, _, err = rs.RsFileMan.CheckData(name)
+			read = storedSize(rs.RsFileMan.storage(), rs.RsFileMan.DataPath(name))
+		}
+		if err != nil {
+			if err.Error() == "File not found" || os.IsNotExist(err) {
+				// Removed since the listing.
+				return
+			}
+			log.Warnf("Scrub couldn't check %s, continuing: %s", name, err)
+			mu.Lock()
+			summary.Failed[name] = err.Error()
+			mu.Unlock()
+			rs.recordCheckError(name, err)
+			return
+		}
+		mu.Lock()
+		summary.Checked++
+		if !health {
+			summary.Damaged = append(summary.Damaged, name)
+		}
+		mu.Unlock()
+		if !summary.Sampled {
+			rs.recordHealth(name, health)
+			rs.recordEvent(name, checkEvent(health), "scrub")
+		} else if !health {
+			rs.recordHealth(name, false)
+			rs.recordEvent(name, eventCorruptionFound, "scrub sample")
+		}
+		work.throttle.pay(read, stop)
+	}
+scrub:
+	for _, name := range names {
+		select {
+		case <-stop:
+			break scrub
+		default:
+		}
+		if work.scrub.acquire(stop) != nil {
+			break
+		}
+		wg.Add(1)
+		go check(name)
+	}
+	wg.Wait()
+	select {
+	case <-stop:
+		log.Infof("%s interrupted after %d of %d files", summary.kind(), summary.Checked, len(names))
+	default:
+	}
+	sort.Strings(summary.Damaged)
+	summary.Duration = time.Since(start)
+	return summary, nil
+}
+
+func (s *ScrubSummary) kind() string {
+	if s.Sampled {
+		return "Sampled scrub"
+	}
+	return "Scrub"
+}
+
+// logScrubSummary reports a finished cycle, listing every file that needs
+// attention.
+func logScrubSummary(summary *ScrubSummary) {
+	if len(summary.Damaged) == 0 && len(summary.Failed) == 0 && summary.Sampled {
+		log.Infof("Sampled scrub checked %d files in %s, no damage found", summary.Checked, summary.Duration)
+		return
+	}
+	if len(summary.Damaged) == 0 && len(summary.Failed) == 0 {
+		log.Infof("Scrub checked %d files in %s, all healthy", summary.Checked, summary.Duration)
+		return
+	}
+	log.Warnf("%s checked %d files in %s, %d damaged, %d failed", summary.kind(), summary.Checked, summary.Duration, len(summary.Damaged), len(summary.Failed))
+	for _, name := range summary.Damaged {
+		log.Warnf("Scrub found damage in %s", name)
+	}
+	failed := make([]string, 0, len(summary.Failed))
+	for name := range summary.Failed {
+		failed = append(failed, name)
+	}
+	sort.Strings(failed)
+	for _, name := range failed {
+		log.Warnf("Scrub failed to check %s: %s", name, summary.Failed[name])
+	}
+}
+
+// StartScrubber scrubs all files every interval in the background until
+// the server is stopped, with samples in between deep scrubs when
+// Config.ScrubSampleRate is set.
+func (rs *RSBackupAPI) StartScrubber(interval time.Duration) {
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for pass := 1; ; pass++ {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+			summary, err := rs.scrub(stop, rs.Config.scrubSampleRate(pass))
+			if err != nil {
+				log.Errorf("Unable to scrub files: %s", err)
+				continue
+			}
+			logScrubSummary(summary)
+		}
+	}()
+	rs.OnShutdown("scrubber", func(ctx context.Context) error {
+		close(stop)
+		select {
+		case <-done:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	})
+}
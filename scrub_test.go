@@ -0,0 +1,109 @@
+package rsbackup
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"reflect"
+	"testing"
+)
+
+func TestScrubContinuesPastErrors(t *testing.T) {
+	tmpDir := createTMPDir(t, "rsbackup")
+	conf := &Config{BackupRoot: tmpDir, DataShards: 2, ParityShards: 1}
+	cloneShards(t, "tyger", tmpDir, conf)
+	cloneShards(t, "tyger_bad", tmpDir, conf)
+	// Sorts between the others and has no metadata, so it can't be checked.
+	err := ioutil.WriteFile(path.Join(tmpDir, "tyger_a"), []byte("orphaned"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	health, err := NewHealthCache(conf.StatePath("health.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	api := &RSBackupAPI{Config: conf, RsFileMan: &RSFileManager{Config: conf}, Health: health}
+
+	summary, err := api.Scrub(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if summary.Checked != 2 {
+		t.Errorf("Checked %d files, expected 2", summary.Checked)
+	}
+	if len(summary.Damaged) != 1 || summary.Damaged[0] != "tyger_bad" {
+		t.Errorf("Got damaged files %v, expected [tyger_bad]", summary.Damaged)
+	}
+	if _, ok := summary.Failed["tyger_a"]; !ok || len(summary.Failed) != 1 {
+		t.Errorf("Got failed files %v, expected tyger_a", summary.Failed)
+	}
+
+	req := httptest.NewRequest("GET", "/list_data?extended=true", nil)
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(api.listDataHandler).ServeHTTP(rr, req)
+	var rsp listDataRsp
+	err = json.NewDecoder(rr.Body).Decode(&rsp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, object := range rsp.Objects {
+		if object.CachedHealth == nil {
+			t.Errorf("%s wasn't scrubbed", object.Name)
+			continue
+		}
+		if (object.CachedError != "") != (object.Name == "tyger_a") {
+			t.Errorf("Got error '%s' for %s", object.CachedError, object.Name)
+		}
+	}
+
+	stop := make(chan struct{})
+	close(stop)
+	summary, err = api.Scrub(stop)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if summary.Checked != 0 {
+		t.Errorf("Stopped scrub checked %d files", summary.Checked)
+	}
+}
+
+func TestSampledScrub(t *testing.T) {
+	conf := &Config{BackupRoot: createTMPDir(t, "rsbackup"), DataShards: 3, ParityShards: 2, BlockSize: 4096, ScrubSampleRate: 0.5, DeepScrubEvery: 3}
+	fm := &RSFileManager{Config: conf}
+	api := &RSBackupAPI{Config: conf, RsFileMan: fm}
+	content := make([]byte, 60000)
+	rand.New(rand.NewSource(1)).Read(content)
+	submitData(t, api, "blocks", content)
+	conf.BlockSize = 0
+	submitData(t, api, "stripes", content)
+	for pass, rate := range []float64{0.5, 0.5, 0, 0.5} {
+		if got := conf.scrubSampleRate(pass + 1); got != rate {
+			t.Errorf("Got rate %f for pass %d, expected %f", got, pass+1, rate)
+		}
+	}
+
+	summary, err := api.scrub(nil, 1)
+	if err != nil || !summary.Sampled || summary.Checked != 2 || len(summary.Damaged) != 0 {
+		t.Fatalf("Got summary %+v (error: %v) of intact files", summary, err)
+	}
+	// Damage in every shard, so any sample finds it.
+	for _, fname := range []string{"blocks", "stripes"} {
+		damaged := append([]byte{}, content...)
+		for off := 0; off < len(damaged); off += 1000 {
+			damaged[off] ^= 1
+		}
+		if err := ioutil.WriteFile(fm.DataPath(fname), damaged, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	summary, err = api.scrub(nil, 1)
+	if err != nil || summary.Checked != 2 || !reflect.DeepEqual(summary.Damaged, []string{"blocks", "stripes"}) {
+		t.Errorf("Got summary %+v (error: %v) of damaged files", summary, err)
+	}
+	if read, _, err := fm.SampleFile("blocks", 0.0001); err != nil || read >= 60000 {
+		t.Errorf("Read %d bytes (error: %v) sampling a few blocks", read, err)
+	}
+}
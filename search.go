@@ -0,0 +1,187 @@
+package rsbackup
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// maxSearchResults bounds a page of search results.
+const maxSearchResults = 1000
+
+// IndexQuery selects entries of the metadata index. Zero fields match
+// every entry.
+type IndexQuery struct {
+	// Name is a substring of the names looked for.
+	Name string
+	// MinSize and MaxSize bound the size of the contents, MaxSize only if
+	// it's positive.
+	MinSize int64
+	MaxSize int64
+	// Since and Until bound when files were stored.
+	Since time.Time
+	Until time.Time
+	// Health is "healthy", "damaged" or "unchecked".
+	Health string
+	Labels map[string]string
+	// After is the name the previous page ended with, Limit the size of a
+	// page.
+	After string
+	Limit int
+}
+
+func (q *IndexQuery) match(entry *IndexEntry) bool {
+	if !strings.Contains(entry.Name, q.Name) || entry.Size < q.MinSize || (q.MaxSize > 0 && entry.Size > q.MaxSize) {
+		return false
+	}
+	// Files stored before StoredAt was recorded go by their modification
+	// time.
+	stored := entry.Modified
+	if entry.StoredAt != nil {
+		stored = *entry.StoredAt
+	}
+	if (!q.Since.IsZero() && stored.Before(q.Since)) || (!q.Until.IsZero() && stored.After(q.Until)) {
+		return false
+	}
+	switch q.Health {
+	case "healthy":
+		if entry.Health == nil || !*entry.Health {
+			return false
+		}
+	case "damaged":
+		if entry.Health == nil || *entry.Health {
+			return false
+		}
+	case "unchecked":
+		if entry.Health != nil {
+			return false
+		}
+	}
+	return matchLabels(entry.Labels, q.Labels)
+}
+
+// Search returns the entries matching q in the order of their names, and
+// the name to continue after if there may be more.
+func (x *MetadataIndex) Search(q IndexQuery) ([]IndexEntry, string, error) {
+	entries := []IndexEntry{}
+	next := ""
+	err := x.db.View(func(tx *bolt.Tx) error {
+		objects := tx.Bucket(indexObjectsBucket)
+		if objects == nil {
+			return nil
+		}
+		c := objects.Cursor()
+		k, v := c.First()
+		if q.After != "" {
+			k, v = c.Seek([]byte(q.After))
+			if bytes.Equal(k, []byte(q.After)) {
+				k, v = c.Next()
+			}
+		}
+		for ; k != nil; k, v = c.Next() {
+			var entry IndexEntry
+			if err := json.Unmarshal(v, &entry); err != nil {
+				return fmt.Errorf("Bad index entry of %s: %w", k, err)
+			}
+			if !q.match(&entry) {
+				continue
+			}
+			if len(entries) == q.Limit {
+				next = entries[len(entries)-1].Name
+				return nil
+			}
+			entries = append(entries, entry)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	return entries, next, nil
+}
+
+type searchRsp struct {
+	Results []IndexEntry `json:"results"`
+	// Next is passed as after to fetch the next page, if there is one.
+	Next string `json:"next,omitempty"`
+}
+
+// searchQuery reads a search from the name, min_size, max_size (like
+// 10MiB), since, until (RFC 3339), health, labels, after and limit fields.
+func searchQuery(r *http.Request) (IndexQuery, error) {
+	q := IndexQuery{
+		Name:   r.FormValue("name"),
+		Health: r.FormValue("health"),
+		After:  r.FormValue("after"),
+		Limit:  100,
+	}
+	switch q.Health {
+	case "", "healthy", "damaged", "unchecked":
+	default:
+		return q, fmt.Errorf("Bad health '%s', must be healthy, damaged or unchecked", q.Health)
+	}
+	for name, field := range map[string]*int64{"min_size": &q.MinSize, "max_size": &q.MaxSize} {
+		if value := r.FormValue(name); value != "" {
+			size, err := ParseSize(value)
+			if err != nil {
+				return q, fmt.Errorf("Bad %s: %w", name, err)
+			}
+			*field = int64(size)
+		}
+	}
+	for name, field := range map[string]*time.Time{"since": &q.Since, "until": &q.Until} {
+		if value := r.FormValue(name); value != "" {
+			t, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				return q, fmt.Errorf("Bad %s: %w", name, err)
+			}
+			*field = t
+		}
+	}
+	if value := r.FormValue("labels"); value != "" {
+		var err error
+		if q.Labels, err = parseLabels(value); err != nil {
+			return q, err
+		}
+	}
+	if value := r.FormValue("limit"); value != "" {
+		var err error
+		q.Limit, err = strconv.Atoi(value)
+		if err != nil || q.Limit < 1 || q.Limit > maxSearchResults {
+			return q, fmt.Errorf("limit must be between 1 and %d", maxSearchResults)
+		}
+	}
+	return q, nil
+}
+
+// searchHandler returns a page of the files in the metadata index that
+// match a query, see searchQuery.
+func (rs *RSBackupAPI) searchHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		rs.Errorf(r, "Bad method %s", r.Method)
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	q, err := searchQuery(r)
+	if err != nil {
+		rs.Errorf(r, "Bad search: %s", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	entries, next, err := rs.RsFileMan.Index.Search(q)
+	if err != nil {
+		rs.Errorf(r, "Unable to search the metadata index: %s", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	err = writeResponse(w, r, searchRsp{Results: entries, Next: next})
+	if err != nil {
+		rs.Errorf(r, "Unable to marshal response: %s", err)
+	}
+}
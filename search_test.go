@@ -0,0 +1,95 @@
+package rsbackup
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSearch(t *testing.T) {
+	index, err := OpenMetadataIndex(path.Join(createTMPDir(t, "rsbackup-state"), "index.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	healthy, damaged := true, false
+	day := func(d int) *time.Time {
+		t := time.Date(2026, 3, d, 0, 0, 0, 0, time.UTC)
+		return &t
+	}
+	for _, entry := range []IndexEntry{
+		{Name: "web01-db-0301", Size: 5 << 20, StoredAt: day(1), Health: &healthy, Labels: map[string]string{"host": "web01", "type": "db"}},
+		{Name: "web01-db-0302", Size: 6 << 20, StoredAt: day(2), Health: &damaged, Labels: map[string]string{"host": "web01", "type": "db"}},
+		{Name: "web01-etc-0302", Size: 10 << 10, StoredAt: day(2), Labels: map[string]string{"host": "web01", "type": "files"}},
+		{Name: "web02-db-0303", Size: 7 << 20, StoredAt: day(3), Health: &healthy, Labels: map[string]string{"host": "web02", "type": "db"}},
+		{Name: "legacy", Size: 100, Modified: *day(1)},
+	} {
+		if err := index.Put(entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	config := &Config{BackupRoot: createTMPDir(t, "rsbackup")}
+	api := &RSBackupAPI{Config: config, RsFileMan: &RSFileManager{Config: config, Index: index}}
+	search := func(query string) (int, searchRsp) {
+		req := httptest.NewRequest("GET", "/search?"+query, nil)
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(api.searchHandler).ServeHTTP(rr, req)
+		var rsp searchRsp
+		json.NewDecoder(rr.Body).Decode(&rsp)
+		return rr.Code, rsp
+	}
+	names := func(rsp searchRsp) []string {
+		names := []string{}
+		for _, entry := range rsp.Results {
+			names = append(names, entry.Name)
+		}
+		return names
+	}
+
+	var tests = []struct {
+		query    string
+		expected []string
+	}{
+		{"", []string{"legacy", "web01-db-0301", "web01-db-0302", "web01-etc-0302", "web02-db-0303"}},
+		{"name=-db-", []string{"web01-db-0301", "web01-db-0302", "web02-db-0303"}},
+		{"min_size=1MiB&max_size=6MiB", []string{"web01-db-0301", "web01-db-0302"}},
+		{"since=2026-03-02T00:00:00Z", []string{"web01-db-0302", "web01-etc-0302", "web02-db-0303"}},
+		{"until=2026-03-01T12:00:00Z", []string{"legacy", "web01-db-0301"}},
+		{"health=healthy", []string{"web01-db-0301", "web02-db-0303"}},
+		{"health=damaged", []string{"web01-db-0302"}},
+		{"health=unchecked", []string{"legacy", "web01-etc-0302"}},
+		{"labels=host=web01,type=db&health=healthy", []string{"web01-db-0301"}},
+		{"name=web03", []string{}},
+	}
+	for _, tt := range tests {
+		code, rsp := search(tt.query)
+		if code != http.StatusOK || !reflect.DeepEqual(names(rsp), tt.expected) || rsp.Next != "" {
+			t.Errorf("Got status code %d, %v and next %q searching %q", code, names(rsp), rsp.Next, tt.query)
+		}
+	}
+
+	// Pages end with the name to continue after.
+	var paged []string
+	query := "labels=type=db&limit=2"
+	for i := 0; i < 3; i++ {
+		_, rsp := search(query)
+		paged = append(paged, names(rsp)...)
+		if rsp.Next == "" {
+			break
+		}
+		query = "labels=type=db&limit=2&after=" + rsp.Next
+	}
+	if !reflect.DeepEqual(paged, []string{"web01-db-0301", "web01-db-0302", "web02-db-0303"}) {
+		t.Errorf("Got %v paging through results", paged)
+	}
+
+	for _, query := range []string{"health=sick", "min_size=lots", "since=yesterday", "limit=0", "labels=web01"} {
+		if code, _ := search(query); code != http.StatusBadRequest {
+			t.Errorf("Got status code %d searching %q", code, query)
+		}
+	}
+}
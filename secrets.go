@@ -0,0 +1,276 @@
+package rsbackup
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// vaultPrefix marks secret references read from Vault, like
+// "vault:secret/data/rsbackup#master_key". Other references are paths of
+// files.
+const vaultPrefix = "vault:"
+
+func isVaultRef(ref string) bool {
+	return strings.HasPrefix(ref, vaultPrefix)
+}
+
+// parseVaultRef splits a Vault reference into the secret path and field.
+func parseVaultRef(ref string) (string, string, error) {
+	i := strings.LastIndex(ref, "#")
+	if !isVaultRef(ref) || i < 0 || i == len(vaultPrefix) || i == len(ref)-1 {
+		return "", "", fmt.Errorf("Vault secrets look like vault:path#field, got '%s'", ref)
+	}
+	return strings.Trim(ref[len(vaultPrefix):i], "/"), ref[i+1:], nil
+}
+
+// SecretReader reads the secrets the config refers to, from files or from
+// Vault. A nil SecretReader only reads files.
+type SecretReader struct {
+	addr   string
+	token  string
+	client *http.Client
+}
+
+// NewSecretReader returns a reader for config.VaultAddr, or nil when Vault
+// isn't configured. The token comes from config.VaultTokenPath or else the
+// VAULT_TOKEN environment variable.
+func NewSecretReader(config *Config) (*SecretReader, error) {
+	if config.VaultAddr == "" {
+		return nil, nil
+	}
+	token := os.Getenv("VAULT_TOKEN")
+	if config.VaultTokenPath != "" {
+		encoded, err := ioutil.ReadFile(config.VaultTokenPath)
+		if err != nil {
+			return nil, err
+		}
+		token = strings.TrimSpace(string(encoded))
+	}
+	if token == "" {
+		return nil, fmt.Errorf("No Vault token, set VaultTokenPath or VAULT_TOKEN")
+	}
+	return &SecretReader{
+		addr:   strings.TrimSuffix(config.VaultAddr, "/"),
+		token:  token,
+		client: &http.Client{Timeout: 30 * time.Second},
+	}, nil
+}
+
+// Read returns the secret ref refers to.
+func (s *SecretReader) Read(ref string) ([]byte, error) {
+	if !isVaultRef(ref) {
+		return ioutil.ReadFile(ref)
+	}
+	if s == nil {
+		return nil, fmt.Errorf("Cannot read '%s', VaultAddr isn't set", ref)
+	}
+	secretPath, field, err := parseVaultRef(ref)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("GET", s.addr+"/v1/"+secretPath, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Vault-Token", s.token)
+	rsp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Vault returned %s for '%s'", rsp.Status, secretPath)
+	}
+	var body struct {
+		Data map[string]json.RawMessage `json:"data"`
+	}
+	err = json.NewDecoder(rsp.Body).Decode(&body)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot parse Vault response for '%s': %s", secretPath, err)
+	}
+	fields := body.Data
+	// Version 2 of the KV engine nests the secret in data.data.
+	if nested, ok := fields["data"]; ok && fields["metadata"] != nil {
+		fields = nil
+		err = json.Unmarshal(nested, &fields)
+		if err != nil {
+			return nil, fmt.Errorf("Cannot parse Vault response for '%s': %s", secretPath, err)
+		}
+	}
+	var value string
+	if raw, ok := fields[field]; !ok || json.Unmarshal(raw, &value) != nil {
+		return nil, fmt.Errorf("Vault secret '%s' has no string field '%s'", secretPath, field)
+	}
+	return []byte(value), nil
+}
+
+// certStore serves the TLS certificate, which can be reloaded while the
+// server runs. Connections already set up keep the certificate they were
+// made with.
+type certStore struct {
+	mu       sync.RWMutex
+	cert     *tls.Certificate
+	secrets  *SecretReader
+	certPath string
+	keyPath  string
+	// stamp identifies the versions of the files last loaded, or tried.
+	stamp string
+}
+
+func newCertStore(secrets *SecretReader, certPath, keyPath string) (*certStore, error) {
+	c := &certStore{secrets: secrets, certPath: certPath, keyPath: keyPath}
+	return c, c.reload()
+}
+
+// fileStamp identifies the current versions of the certificate and key
+// files by size and modification time. Secrets in Vault don't count.
+func (c *certStore) fileStamp() string {
+	var stamp string
+	for _, fpath := range []string{c.certPath, c.keyPath} {
+		if isVaultRef(fpath) {
+			continue
+		}
+		stat, err := os.Stat(fpath)
+		if err != nil {
+			stamp += err.Error() + ";"
+			continue
+		}
+		stamp += fmt.Sprintf("%d@%d;", stat.Size(), stat.ModTime().UnixNano())
+	}
+	return stamp
+}
+
+func (c *certStore) reload() error {
+	stamp := c.fileStamp()
+	c.mu.Lock()
+	c.stamp = stamp
+	c.mu.Unlock()
+	certPEM, err := c.secrets.Read(c.certPath)
+	if err != nil {
+		return err
+	}
+	keyPEM, err := c.secrets.Read(c.keyPath)
+	if err != nil {
+		return err
+	}
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	c.cert = &cert
+	c.mu.Unlock()
+	return nil
+}
+
+// reloadIfChanged reloads the certificate if its files changed since they
+// were last tried. Tools renewing a certificate may write the certificate
+// and key one after the other, so a pair that doesn't match is tried
+// again once either file changes.
+func (c *certStore) reloadIfChanged() (bool, error) {
+	c.mu.RLock()
+	last := c.stamp
+	c.mu.RUnlock()
+	if c.fileStamp() == last {
+		return false, nil
+	}
+	return true, c.reload()
+}
+
+func (c *certStore) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.cert, nil
+}
+
+// ReloadCertificate reads the TLS certificate and key again, eg. on
+// SIGHUP after they were renewed. On failure the current certificate
+// stays in use. Certificates obtained via ACME are left alone.
+func (rs *RSBackupAPI) ReloadCertificate() error {
+	if rs.certs == nil {
+		return nil
+	}
+	err := rs.certs.reload()
+	if err != nil {
+		return err
+	}
+	log.Info("Reloaded TLS certificate")
+	return nil
+}
+
+// watchCertificate checks the certificate files for changes every
+// interval and reloads them when they change, until the server is
+// stopped.
+func (rs *RSBackupAPI) watchCertificate(interval time.Duration) {
+	stop := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+			changed, err := rs.certs.reloadIfChanged()
+			if err != nil {
+				log.Errorf("Unable to reload changed TLS certificate, keeping the current one: %s", err)
+			} else if changed {
+				log.Info("Reloaded changed TLS certificate")
+			}
+		}
+	}()
+	rs.OnShutdown("certificate watcher", func(context.Context) error {
+		close(stop)
+		return nil
+	})
+}
+
+// refreshSecrets fetches the TLS certificate and encryption keys again. A
+// secret that can't be fetched keeps its previous value.
+func (rs *RSBackupAPI) refreshSecrets() {
+	if rs.certs != nil {
+		err := rs.certs.reload()
+		if err != nil {
+			log.Errorf("Unable to refresh TLS certificate, keeping the current one: %s", err)
+		}
+	}
+	if rs.RsFileMan != nil && rs.RsFileMan.Keys != nil {
+		err := rs.RsFileMan.Keys.Reload()
+		if err != nil {
+			log.Errorf("Unable to refresh encryption keys, keeping the current ones: %s", err)
+		}
+	}
+}
+
+// startSecretRefresh refreshes secrets every interval until the server is
+// stopped.
+func (rs *RSBackupAPI) startSecretRefresh(interval time.Duration) {
+	stop := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				rs.refreshSecrets()
+			}
+		}
+	}()
+	rs.OnShutdown("secret refresh", func(context.Context) error {
+		close(stop)
+		return nil
+	})
+}
@@ -0,0 +1,139 @@
+package rsbackup
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeVault serves KV secrets, version 2 under secret/ and version 1
+// under kv/.
+type fakeVault struct {
+	mu      sync.Mutex
+	secrets map[string]map[string]string
+}
+
+func (v *fakeVault) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("X-Vault-Token") != "s.test" {
+		http.Error(w, `{"errors":["permission denied"]}`, http.StatusForbidden)
+		return
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	secretPath := strings.TrimPrefix(r.URL.Path, "/v1/")
+	fields, ok := v.secrets[secretPath]
+	if !ok {
+		http.Error(w, `{"errors":[]}`, http.StatusNotFound)
+		return
+	}
+	var rsp interface{} = map[string]interface{}{"data": fields}
+	if strings.HasPrefix(secretPath, "secret/data/") {
+		rsp = map[string]interface{}{"data": map[string]interface{}{"data": fields, "metadata": map[string]int{"version": 1}}}
+	}
+	json.NewEncoder(w).Encode(rsp)
+}
+
+func (v *fakeVault) set(secretPath, field, value string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.secrets[secretPath] == nil {
+		v.secrets[secretPath] = make(map[string]string)
+	}
+	v.secrets[secretPath][field] = value
+}
+
+func TestSecretReader(t *testing.T) {
+	tmpDir := createTMPDir(t, "rsbackup")
+	vault := &fakeVault{secrets: make(map[string]map[string]string)}
+	vault.set("secret/data/rsbackup", "master_key", strings.Repeat("ab", 32))
+	vault.set("kv/rsbackup", "note", "version one")
+	server := httptest.NewServer(vault)
+	defer server.Close()
+	tokenPath := path.Join(tmpDir, "vault-token")
+	ioutil.WriteFile(tokenPath, []byte("s.test\n"), 0600)
+	config := &Config{VaultAddr: server.URL, VaultTokenPath: tokenPath}
+	secrets, err := NewSecretReader(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	readTests := []struct {
+		ref         string
+		expected    string
+		expectedErr bool
+	}{
+		{"vault:secret/data/rsbackup#master_key", strings.Repeat("ab", 32), false},
+		{"vault:/kv/rsbackup#note", "version one", false},
+		{"vault:secret/data/rsbackup#missing", "", true},
+		{"vault:secret/data/missing#master_key", "", true},
+		{"vault:secret/data/rsbackup", "", true},
+		{tokenPath, "s.test\n", false},
+	}
+	for _, tt := range readTests {
+		t.Run(tt.ref, func(t *testing.T) {
+			value, err := secrets.Read(tt.ref)
+			if (err != nil) != tt.expectedErr || string(value) != tt.expected {
+				t.Errorf("Got '%s', %v", value, err)
+			}
+		})
+	}
+	if _, err := (*SecretReader)(nil).Read("vault:kv/rsbackup#note"); err == nil {
+		t.Errorf("Read a Vault secret without Vault")
+	}
+	os.Setenv("VAULT_TOKEN", "s.wrong")
+	defer os.Unsetenv("VAULT_TOKEN")
+	wrongToken, err := NewSecretReader(&Config{VaultAddr: server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := wrongToken.Read("vault:kv/rsbackup#note"); err == nil {
+		t.Errorf("Read a secret with the wrong token")
+	}
+
+	// Keys and certificates fetched again pick up changes.
+	config.EncryptionKeys = map[string]string{"2026": "vault:secret/data/rsbackup#master_key"}
+	config.EncryptionKeyID = "2026"
+	keys, err := NewKeyRing(config, secrets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := keys.key("2026")
+	vault.set("secret/data/rsbackup", "master_key", strings.Repeat("cd", 32))
+	err = keys.Reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys.key("2026") == before {
+		t.Errorf("Reload kept the old key")
+	}
+	vault.set("secret/data/rsbackup", "master_key", "short")
+	if keys.Reload() == nil || keys.key("2026") == nil {
+		t.Errorf("Bad key replaced the current one")
+	}
+
+	certPath, keyPath, _ := writeSelfSignedCert(t, tmpDir)
+	certPEM, _ := ioutil.ReadFile(certPath)
+	keyPEM, _ := ioutil.ReadFile(keyPath)
+	vault.set("secret/data/tls", "cert", string(certPEM))
+	vault.set("secret/data/tls", "key", string(keyPEM))
+	certs, err := newCertStore(secrets, "vault:secret/data/tls#cert", "vault:secret/data/tls#key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := certs.GetCertificate(nil)
+	if cert == nil {
+		t.Fatal("No certificate loaded")
+	}
+	vault.set("secret/data/tls", "key", "garbage")
+	api := &RSBackupAPI{Config: config, RsFileMan: &RSFileManager{Config: config, Keys: keys}, certs: certs}
+	api.refreshSecrets()
+	if current, _ := certs.GetCertificate(nil); current != cert {
+		t.Errorf("Bad key replaced the certificate")
+	}
+}
@@ -0,0 +1,330 @@
+package rsbackup
+
+import (
+	"fmt"
+	"hash"
+	"io"
+
+	"github.com/sirmackk/rsutils"
+	log "github.com/sirupsen/logrus"
+)
+
+// SegmentInfo records the hashes of a file encoded in segments, see
+// Config.SegmentSize. Segment k is the Stripe bytes at offset k*Stripe of
+// every data and parity shard, the last one possibly shorter. Each byte
+// offset of the shards is a parity set of its own, so a segment can be
+// checked and repaired without reading the rest of the file.
+type SegmentInfo struct {
+	Stripe int64
+	// Hashes are the hex encoded hashes of each segment of each shard, in
+	// the order of the shards in the metadata.
+	Hashes [][]string
+}
+
+// DamagedBlock is a stretch of a shard that doesn't match its hash, see
+// Config.BlockSize. Parity shards are numbered after the data shards.
+type DamagedBlock struct {
+	Shard  int   `json:"shard"`
+	Offset int64 `json:"offset"`
+	Length int64 `json:"length"`
+}
+
+// segmentBufferSize bounds what checks and repairs hold in memory of each
+// shard, segments larger than it are read in pieces. Files hashed whole
+// with another algorithm than sha256 are a single segment as large as
+// their shards.
+const segmentBufferSize = 1 << 20
+
+// segmentStripe returns the Stripe of the segments of a file of size
+// bytes split into dataShards, 0 if it's small enough to be hashed whole.
+// Config.BlockSize caps it, so every block of a shard gets a hash.
+func (c *Config) segmentStripe(size int64, dataShards int) int64 {
+	var stripe int64
+	if c.SegmentSize > 0 && size > int64(c.SegmentSize) {
+		stripe = (int64(c.SegmentSize) + int64(dataShards) - 1) / int64(dataShards)
+	}
+	chunkSize := (size + int64(dataShards) - 1) / int64(dataShards)
+	if c.BlockSize > 0 && chunkSize > int64(c.BlockSize) && (stripe == 0 || stripe > int64(c.BlockSize)) {
+		stripe = int64(c.BlockSize)
+	}
+	return stripe
+}
+
+// segmentHasher hashes shards written in lockstep segment by segment.
+type segmentHasher struct {
+	info    *SegmentInfo
+	hashers []hash.Hash
+	pos     int64
+}
+
+func newSegmentHasher(stripe int64, shards int, hashName string) *segmentHasher {
+	h := &segmentHasher{info: &SegmentInfo{Stripe: stripe}, hashers: make([]hash.Hash, shards)}
+	for i := range h.hashers {
+		h.hashers[i] = newShardHash(hashName)
+	}
+	return h
+}
+
+// write hashes the next bytes of every shard, as many of each.
+func (h *segmentHasher) write(shards [][]byte) {
+	for done := 0; done < len(shards[0]); {
+		n := int(h.info.Stripe - h.pos%h.info.Stripe)
+		if rest := len(shards[0]) - done; rest < n {
+			n = rest
+		}
+		for i, shard := range shards {
+			h.hashers[i].Write(shard[done : done+n])
+		}
+		done += n
+		h.pos += int64(n)
+		if h.pos%h.info.Stripe == 0 {
+			h.flush()
+		}
+	}
+}
+
+func (h *segmentHasher) flush() {
+	hashes := make([]string, len(h.hashers))
+	for i, hasher := range h.hashers {
+		hashes[i] = fmt.Sprintf("%x", hasher.Sum(nil))
+		hasher.Reset()
+	}
+	h.info.Hashes = append(h.info.Hashes, hashes)
+}
+
+// segments returns the hashes of all segments written, the last one
+// included if it's shorter.
+func (h *segmentHasher) segments() *SegmentInfo {
+	if h.pos%h.info.Stripe != 0 {
+		h.flush()
+	}
+	return h.info
+}
+
+// shardSegments returns the segments the shards of the file with md and
+// extras are checked and repaired by, nil to leave them to rsutils. Files
+// of another codec than Reed-Solomon, or hashed with another algorithm
+// than sha256, which rsutils is limited to, are a single segment unless
+// they have segments of their own.
+func shardSegments(md *rsutils.Metadata, extras MetadataExtras) *SegmentInfo {
+	rsutilsFile := (extras.Codec == "" || extras.Codec == CodecReedSolomon) && (extras.Hash == "" || extras.Hash == hashSHA256)
+	if extras.Segments != nil || rsutilsFile {
+		return extras.Segments
+	}
+	chunkSize := (md.Size + int64(md.DataShards) - 1) / int64(md.DataShards)
+	if chunkSize == 0 {
+		return nil
+	}
+	return &SegmentInfo{Stripe: chunkSize, Hashes: [][]string{md.Hashes}}
+}
+
+// segmentLen returns how many bytes of each shard segment k covers.
+func (s *shardSet) segmentLen(segments *SegmentInfo, k int) int64 {
+	n := s.chunkSize - int64(k)*segments.Stripe
+	if n > segments.Stripe {
+		return segments.Stripe
+	}
+	return n
+}
+
+// checkSegments checks that segments cover the shards of s, and that
+// their hashes can be computed.
+func (s *shardSet) checkSegments(segments *SegmentInfo) error {
+	if _, ok := shardHashes[s.hash]; s.hash != "" && !ok {
+		return fmt.Errorf("Unknown shard hash '%s'", s.hash)
+	}
+	shards := s.md.DataShards + s.md.ParityShards
+	if segments.Stripe <= 0 || int64(len(segments.Hashes)) != (s.chunkSize+segments.Stripe-1)/segments.Stripe {
+		return fmt.Errorf("Invalid segments in metadata")
+	}
+	for _, hashes := range segments.Hashes {
+		if len(hashes) != shards {
+			return fmt.Errorf("Invalid segments in metadata")
+		}
+	}
+	return nil
+}
+
+// segmentBuffer returns a buffer for the pieces segments are read in.
+func segmentBuffer(segments *SegmentInfo) []byte {
+	if segments.Stripe < segmentBufferSize {
+		return make([]byte, segments.Stripe)
+	}
+	return make([]byte, segmentBufferSize)
+}
+
+// segmentPieces calls fn with the offset and length of each piece of
+// segment k, at most max bytes long, until fn fails.
+func (s *shardSet) segmentPieces(segments *SegmentInfo, k int, max int, fn func(off int64, n int) error) error {
+	off := int64(k) * segments.Stripe
+	end := off + s.segmentLen(segments, k)
+	for off < end {
+		n := max
+		if end-off < int64(n) {
+			n = int(end - off)
+		}
+		if err := fn(off, n); err != nil {
+			return err
+		}
+		off += int64(n)
+	}
+	return nil
+}
+
+// readSegment reads shard i of segment k piece by piece into buf and
+// reports whether it matches its hash. Missing and unreadable shards
+// don't.
+func (s *shardSet) readSegment(segments *SegmentInfo, k, i int, buf []byte) bool {
+	h := newShardHash(s.hash)
+	err := s.segmentPieces(segments, k, len(buf), func(off int64, n int) error {
+		if err := s.readShardAt(i, buf[:n], off); err != nil {
+			return err
+		}
+		h.Write(buf[:n])
+		return nil
+	})
+	return err == nil && fmt.Sprintf("%x", h.Sum(nil)) == segments.Hashes[k][i]
+}
+
+// damagedBlocks returns the segments of each shard that don't match
+// their hashes.
+func (s *shardSet) damagedBlocks(segments *SegmentInfo) ([]DamagedBlock, error) {
+	if err := s.checkSegments(segments); err != nil {
+		return nil, err
+	}
+	var damaged []DamagedBlock
+	buf := segmentBuffer(segments)
+	for k := range segments.Hashes {
+		for i := 0; i < s.md.DataShards+s.md.ParityShards; i++ {
+			if !s.readSegment(segments, k, i, buf) {
+				damaged = append(damaged, DamagedBlock{Shard: i, Offset: int64(k) * segments.Stripe, Length: s.segmentLen(segments, k)})
+			}
+		}
+	}
+	return damaged, nil
+}
+
+// DamagedBlocks hashes the shards of fname block by block and returns the
+// blocks that don't match the metadata. Files hashed whole have no blocks,
+// DamagedShards tells which of their shards are damaged.
+func (r *RSFileManager) DamagedBlocks(fname string) ([]DamagedBlock, error) {
+	fpath := r.DataPath(fname)
+	extras, err := r.ReadExtras(fpath)
+	if err != nil || extras.Segments == nil || extras.Packed != nil {
+		return nil, err
+	}
+	s, err := r.openShards(fname)
+	if err != nil {
+		return nil, err
+	}
+	defer s.Close()
+	return s.damagedBlocks(extras.Segments)
+}
+
+// repairSegments rebuilds the damaged shards of each damaged segment from
+// the rest of it and writes them back to the data and parity files of s,
+// which must be open for writing. Segments are rebuilt in pieces of at
+// most segmentBufferSize of each shard.
+func (s *shardSet) repairSegments(config *Config, segments *SegmentInfo) error {
+	if err := s.checkSegments(segments); err != nil {
+		return err
+	}
+	enc, err := config.newCodec(s.codec, s.md.DataShards, s.md.ParityShards)
+	if err != nil {
+		return err
+	}
+	bufs := make([][]byte, s.md.DataShards+s.md.ParityShards)
+	for i := range bufs {
+		bufs[i] = segmentBuffer(segments)
+	}
+	for k := range segments.Hashes {
+		var damaged []int
+		for i := range bufs {
+			if !s.readSegment(segments, k, i, bufs[i]) {
+				damaged = append(damaged, i)
+			}
+		}
+		if len(damaged) == 0 {
+			continue
+		}
+		if len(damaged) > s.md.ParityShards {
+			return errTooManyDamaged
+		}
+		log.Warnf("Repairing shards %v of segment %d", damaged, k)
+		// The rebuilt shards are checked against their hashes before
+		// any is written, which takes rebuilding them twice.
+		for _, write := range []bool{false, true} {
+			err = s.rebuildSegment(enc, segments, k, damaged, bufs, write)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// rebuildSegment rebuilds the damaged shards of segment k piece by piece
+// in bufs. With write it writes them back, otherwise it checks that they
+// match their hashes.
+func (s *shardSet) rebuildSegment(enc Codec, segments *SegmentInfo, k int, damaged []int, bufs [][]byte, write bool) error {
+	hashers := make([]hash.Hash, len(damaged))
+	for j := range hashers {
+		hashers[j] = newShardHash(s.hash)
+	}
+	shards := make([][]byte, len(bufs))
+	err := s.segmentPieces(segments, k, len(bufs[0]), func(off int64, n int) error {
+		for i := range shards {
+			shards[i] = bufs[i][:n]
+		}
+		for _, i := range damaged {
+			shards[i] = shards[i][:0]
+		}
+		for i := range shards {
+			if len(shards[i]) == 0 {
+				continue
+			}
+			if err := s.readShardAt(i, shards[i], off); err != nil {
+				return err
+			}
+		}
+		if err := enc.Reconstruct(shards); err != nil {
+			return err
+		}
+		for j, i := range damaged {
+			if !write {
+				hashers[j].Write(shards[i])
+			} else if err := s.writeShardAt(i, shards[i], off); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil || write {
+		return err
+	}
+	for j, i := range damaged {
+		if fmt.Sprintf("%x", hashers[j].Sum(nil)) != segments.Hashes[k][i] {
+			return fmt.Errorf("Shard %d of segment %d doesn't match its hash once rebuilt", i, k)
+		}
+	}
+	return nil
+}
+
+// writeShardAt writes p to shard i at off, leaving out the padding of
+// data shards.
+func (s *shardSet) writeShardAt(i int, p []byte, off int64) error {
+	f, pos := s.data, int64(i)*s.chunkSize+off
+	if i >= s.md.DataShards {
+		f, pos = s.parity[i-s.md.DataShards], off
+	} else if stored := s.dataLen(i) - off; stored < int64(len(p)) {
+		if stored <= 0 {
+			return nil
+		}
+		p = p[:stored]
+	}
+	if _, err := f.Seek(pos, io.SeekStart); err != nil {
+		return err
+	}
+	_, err := f.Write(p)
+	return err
+}
@@ -0,0 +1,181 @@
+package rsbackup
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+)
+
+// damagedSegments returns the segments of stripe 3334 the blocks are in.
+func damagedSegments(blocks []DamagedBlock) []int {
+	var segments []int
+	for _, block := range blocks {
+		k := int(block.Offset / 3334)
+		if len(segments) == 0 || segments[len(segments)-1] != k {
+			segments = append(segments, k)
+		}
+	}
+	return segments
+}
+
+func TestSegments(t *testing.T) {
+	defer func(size int64) { encodeStripeSize = size }(encodeStripeSize)
+	// Stripes and segments don't line up.
+	encodeStripeSize = 1000
+	config := &Config{BackupRoot: createTMPDir(t, "rsbackup"), DataShards: 3, ParityShards: 2, SegmentSize: 10000}
+	fm := &RSFileManager{Config: config}
+	api := &RSBackupAPI{Config: config, RsFileMan: fm}
+	fpath := fm.DataPath("tyger")
+	content := make([]byte, 50000)
+	rand.New(rand.NewSource(1)).Read(content)
+	if err := ioutil.WriteFile(fpath, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	var extras MetadataExtras
+	md, err := api.generateParity(fm.storage(), fpath, &extras)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if extras.Segments == nil || extras.Segments.Stripe != 3334 || len(extras.Segments.Hashes) != 5 {
+		t.Fatalf("Got segments %+v", extras.Segments)
+	}
+	if err := fm.WriteMetadata("tyger", md, extras); err != nil {
+		t.Fatal(err)
+	}
+	// The shards are those of a file hashed whole.
+	wholePath := path.Join(createTMPDir(t, "rsbackup"), "tyger")
+	if err := ioutil.WriteFile(wholePath, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	whole, _, err := writeParity(OSBackend{}, wholePath, 3, 2, &Config{Fsync: fsyncOff})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(md.Hashes, whole.Hashes) {
+		t.Errorf("Got hashes %v, expected %v", md.Hashes, whole.Hashes)
+	}
+
+	flip := func(fpath string, off int64) {
+		f, err := os.OpenFile(fpath, os.O_RDWR, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		b := make([]byte, 1)
+		f.ReadAt(b, off)
+		b[0] ^= 1
+		f.WriteAt(b, off)
+	}
+	// Segment 2 of data shard 1, and segment 4 of the last data shard,
+	// short and padded.
+	flip(fpath, 16667+7000)
+	flip(fpath, 2*16667+16000)
+	os.Remove(fpath + ".parity.1")
+	s, err := fm.openShards("tyger")
+	if err != nil {
+		t.Fatal(err)
+	}
+	damaged, err := s.damagedBlocks(extras.Segments)
+	s.Close()
+	if err != nil || !reflect.DeepEqual(damagedSegments(damaged), []int{0, 1, 2, 3, 4}) {
+		t.Errorf("Got damaged blocks %v (error: %v) with a parity shard missing", damaged, err)
+	}
+	if health, _, _, err := fm.CheckData("tyger"); err != nil || health {
+		t.Errorf("Got health %t (error: %v) of a damaged file", health, err)
+	}
+	if err := fm.RepairData("tyger"); err != nil {
+		t.Fatal(err)
+	}
+	if health, _, _, err := fm.CheckData("tyger"); err != nil || !health {
+		t.Errorf("Got health %t (error: %v) once repaired", health, err)
+	}
+	if repaired, err := ioutil.ReadFile(fpath); err != nil || !bytes.Equal(repaired, content) {
+		t.Errorf("Got a different file once repaired (error: %v)", err)
+	}
+
+	flip(fpath+".parity.2", 10000)
+	s, err = fm.openShards("tyger")
+	if err != nil {
+		t.Fatal(err)
+	}
+	damaged, err = s.damagedBlocks(extras.Segments)
+	s.Close()
+	expected := []DamagedBlock{{Shard: 4, Offset: 2 * 3334, Length: 3334}}
+	if err != nil || !reflect.DeepEqual(damaged, expected) {
+		t.Errorf("Got damaged blocks %v (error: %v), expected %v", damaged, err, expected)
+	}
+}
+
+func TestBlockChecksums(t *testing.T) {
+	config := &Config{BackupRoot: createTMPDir(t, "rsbackup"), DataShards: 3, ParityShards: 2, BlockSize: 4096}
+	fm := &RSFileManager{Config: config}
+	api := &RSBackupAPI{Config: config, RsFileMan: fm}
+	var stripes = []struct {
+		segmentSize Size
+		size        int64
+		stripe      int64
+	}{
+		{0, 3 * 4096, 0},
+		{0, 3*4096 + 1, 4096},
+		{1 << 20, 3 << 20, 4096},
+		{6000, 3 << 20, 2000},
+	}
+	for _, tt := range stripes {
+		config.SegmentSize = tt.segmentSize
+		if stripe := config.segmentStripe(tt.size, 3); stripe != tt.stripe {
+			t.Errorf("Got stripe %d for %d bytes with SegmentSize %d, expected %d", stripe, tt.size, tt.segmentSize, tt.stripe)
+		}
+	}
+	config.SegmentSize = 0
+
+	fpath := fm.DataPath("tyger")
+	content := make([]byte, 60000)
+	rand.New(rand.NewSource(1)).Read(content)
+	if err := ioutil.WriteFile(fpath, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	var extras MetadataExtras
+	md, err := api.generateParity(fm.storage(), fpath, &extras)
+	if err == nil {
+		err = fm.WriteMetadata("tyger", md, extras)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	check := func() checkDataRsp {
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(api.checkDataHandler).ServeHTTP(rr, httptest.NewRequest("GET", "/check_data/tyger", nil))
+		var rsp checkDataRsp
+		if rr.Code != http.StatusOK || json.NewDecoder(rr.Body).Decode(&rsp) != nil {
+			t.Fatalf("Got status code %d checking", rr.Code)
+		}
+		return rsp
+	}
+	if rsp := check(); !rsp.Health || rsp.DamagedBlocks != nil {
+		t.Errorf("Got %+v for an intact file", rsp)
+	}
+
+	// Shards are 20000 bytes, in blocks of 4096 and a last one of 3616.
+	content[20000+9000] ^= 1
+	content[40000+19000] ^= 1
+	if err := ioutil.WriteFile(fpath, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	expected := []DamagedBlock{{Shard: 1, Offset: 8192, Length: 4096}, {Shard: 2, Offset: 16384, Length: 3616}}
+	if rsp := check(); rsp.Health || !reflect.DeepEqual(rsp.DamagedBlocks, expected) {
+		t.Errorf("Got health %t and damaged blocks %v, expected %v", rsp.Health, rsp.DamagedBlocks, expected)
+	}
+	if err := fm.RepairData("tyger"); err != nil {
+		t.Fatal(err)
+	}
+	if rsp := check(); !rsp.Health {
+		t.Errorf("Got %+v once repaired", rsp)
+	}
+}
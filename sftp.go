@@ -0,0 +1,307 @@
+package rsbackup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/sftp"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// sftpRetryDelay is the wait before retrying a failed upload, doubled on
+// every further attempt.
+var sftpRetryDelay = time.Second
+
+type sftpConn struct {
+	*sftp.Client
+	ssh io.Closer
+}
+
+// close shuts the transport first, the client waits for it to go away.
+func (c *sftpConn) close() {
+	if c.ssh != nil {
+		c.ssh.Close()
+	}
+	c.Client.Close()
+}
+
+// sftpPool hands out connections to the remote, dialing new ones when none
+// are idle and keeping at most cap(idle) around for reuse.
+type sftpPool struct {
+	dial func() (*sftpConn, error)
+	idle chan *sftpConn
+}
+
+func (p *sftpPool) get() (*sftpConn, error) {
+	select {
+	case c := <-p.idle:
+		return c, nil
+	default:
+		return p.dial()
+	}
+}
+
+func (p *sftpPool) put(c *sftpConn) {
+	select {
+	case p.idle <- c:
+	default:
+		c.close()
+	}
+}
+
+func (p *sftpPool) close() {
+	for {
+		select {
+		case c := <-p.idle:
+			c.close()
+		default:
+			return
+		}
+	}
+}
+
+// SFTPMirror copies stored files, with their parity and metadata, to a
+// directory on a remote machine over SFTP, eg. an offsite storage box.
+// Copies are made in the background by a worker per pooled connection.
+type SFTPMirror struct {
+	fileMan *RSFileManager
+	root    string
+	retries int
+	pool    *sftpPool
+	queue   chan string
+	wg      sync.WaitGroup
+}
+
+// NewSFTPMirror connects to config.SFTPURL.
+func NewSFTPMirror(config *Config, fileMan *RSFileManager) (*SFTPMirror, error) {
+	dial, root, err := sftpDialer(config, "SFTPURL", config.SFTPURL)
+	if err != nil {
+		return nil, err
+	}
+	return newSFTPMirror(fileMan, root, config.SFTPConnections, config.SFTPRetries, config.SFTPQueue, dial), nil
+}
+
+// sftpDialer returns a function connecting to rawURL, like
+// "sftp://user@host/path", and the remote directory. The path is relative
+// to the login directory unless it starts with "//". The host key is
+// checked against config.SFTPKnownHostsPath and config.SFTPKeyPath is
+// used to log in. name is the setting rawURL comes from.
+func sftpDialer(config *Config, name, rawURL string) (func() (*sftpConn, error), string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, "", err
+	}
+	if u.Scheme != "sftp" || u.Hostname() == "" || u.User == nil {
+		return nil, "", fmt.Errorf("%s must look like sftp://user@host/path", name)
+	}
+	key, err := ioutil.ReadFile(config.SFTPKeyPath)
+	if err != nil {
+		return nil, "", err
+	}
+	signer, err := ssh.ParsePrivateKey(key)
+	if err != nil {
+		return nil, "", fmt.Errorf("Cannot parse SSH key '%s': %s", config.SFTPKeyPath, err)
+	}
+	hostKeys, err := knownhosts.New(config.SFTPKnownHostsPath)
+	if err != nil {
+		return nil, "", err
+	}
+	addr := u.Host
+	if u.Port() == "" {
+		addr = net.JoinHostPort(u.Hostname(), "22")
+	}
+	sshConfig := &ssh.ClientConfig{
+		User:            u.User.Username(),
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		HostKeyCallback: hostKeys,
+		Timeout:         30 * time.Second,
+	}
+	dial := func() (*sftpConn, error) {
+		sshClient, err := ssh.Dial("tcp", addr, sshConfig)
+		if err != nil {
+			return nil, err
+		}
+		client, err := sftp.NewClient(sshClient)
+		if err != nil {
+			sshClient.Close()
+			return nil, err
+		}
+		return &sftpConn{Client: client, ssh: sshClient}, nil
+	}
+	root := strings.TrimPrefix(u.Path, "/")
+	if root == "" {
+		root = "."
+	}
+	return dial, root, nil
+}
+
+func newSFTPMirror(fileMan *RSFileManager, root string, connections, retries, queue int, dial func() (*sftpConn, error)) *SFTPMirror {
+	if connections == 0 {
+		connections = 2
+	}
+	if retries == 0 {
+		retries = 3
+	}
+	if queue == 0 {
+		queue = 1024
+	}
+	m := &SFTPMirror{
+		fileMan: fileMan,
+		root:    root,
+		retries: retries,
+		pool:    &sftpPool{dial: dial, idle: make(chan *sftpConn, connections)},
+		queue:   make(chan string, queue),
+	}
+	for i := 0; i < connections; i++ {
+		m.wg.Add(1)
+		go m.work()
+	}
+	return m
+}
+
+// Enqueue schedules fname to be copied, blocking while the queue is full.
+func (m *SFTPMirror) Enqueue(fname string) {
+	m.queue <- fname
+}
+
+func (m *SFTPMirror) work() {
+	defer m.wg.Done()
+	for fname := range m.queue {
+		start := time.Now()
+		err := m.Upload(fname)
+		if err != nil {
+			log.Errorf("Unable to mirror %s: %s", fname, err)
+			continue
+		}
+		log.Infof("Mirrored %s in %s", fname, time.Since(start))
+	}
+}
+
+// Stop waits for queued copies to finish, giving up when ctx is done.
+func (m *SFTPMirror) Stop(ctx context.Context) error {
+	close(m.queue)
+	done := make(chan struct{})
+	go func() {
+		m.wg.Wait()
+		close(done)
+	}()
+	defer m.pool.close()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("Gave up on %d queued files: %w", len(m.queue), ctx.Err())
+	}
+}
+
+// Upload copies fname to the remote. Like on local disk the data file is
+// written last, so a listing of the remote never shows a file without its
+// parity.
+func (m *SFTPMirror) Upload(fname string) error {
+	localPath := m.fileMan.DataPath(fname)
+	remotePath := path.Join(m.root, m.fileMan.layout().Path(fname))
+	for _, suffix := range objectSuffixes(m.fileMan.storage(), localPath) {
+		err := m.withRetries(func(c *sftp.Client) error {
+			return putFile(c, m.fileMan.storage(), localPath+suffix, remotePath+suffix)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sftpConnUsable reports whether a connection is still good after a
+// request on it returned err, which it is if the server answered.
+func sftpConnUsable(err error) bool {
+	var statusErr *sftp.StatusError
+	return err == nil || errors.As(err, &statusErr) || os.IsNotExist(err) || os.IsExist(err) || os.IsPermission(err)
+}
+
+// withRetries runs fn with a pooled connection, retrying with backoff on a
+// fresh connection when it fails.
+func (m *SFTPMirror) withRetries(fn func(*sftp.Client) error) error {
+	delay := sftpRetryDelay
+	var err error
+	for attempt := 0; attempt <= m.retries; attempt++ {
+		if attempt > 0 {
+			log.Warnf("SFTP attempt %d/%d failed, retrying in %s: %s", attempt, m.retries+1, delay, err)
+			time.Sleep(delay)
+			delay *= 2
+		}
+		var c *sftpConn
+		c, err = m.pool.get()
+		if err != nil {
+			continue
+		}
+		err = fn(c.Client)
+		if sftpConnUsable(err) {
+			m.pool.put(c)
+		} else {
+			c.close()
+		}
+		if err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// mirror queues fname to be copied offsite, if a mirror is configured.
+func (rs *RSBackupAPI) mirror(fname string) {
+	if rs.Mirror != nil {
+		rs.Mirror.Enqueue(fname)
+	}
+}
+
+// putFile copies the file src in storage to dst on the remote. The copy is
+// written to a temporary name and synced before it's renamed over dst, so
+// dst is never seen half written.
+func putFile(c *sftp.Client, storage StorageBackend, src, dst string) error {
+	in, err := storage.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	err = c.MkdirAll(path.Dir(dst))
+	if err != nil {
+		return err
+	}
+	tmpPath := dst + ".upload"
+	out, err := c.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if err == nil {
+		if _, ok := c.HasExtension("fsync@openssh.com"); ok {
+			err = out.Sync()
+		}
+	}
+	closeErr := out.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		c.Remove(tmpPath)
+		return err
+	}
+	if _, ok := c.HasExtension("posix-rename@openssh.com"); ok {
+		return c.PosixRename(tmpPath, dst)
+	}
+	// Plain SFTP renames refuse to replace files.
+	c.Remove(dst)
+	return c.Rename(tmpPath, dst)
+}
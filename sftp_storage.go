@@ -0,0 +1,192 @@
+package rsbackup
+
+import (
+	"os"
+	"path"
+	"sync"
+
+	"github.com/pkg/sftp"
+)
+
+// SFTPBackend stores files in a directory on a remote machine over SFTP,
+// so a storage box can hold the backups while the server runs elsewhere.
+// Requests share one connection, dialed again after it fails.
+type SFTPBackend struct {
+	root   string
+	remote string
+	dial   func() (*sftpConn, error)
+
+	mu   sync.Mutex
+	conn *sftpConn
+}
+
+// NewSFTPBackend connects to config.SFTPStorageURL, with the key and
+// known hosts used by the SFTP mirror.
+func NewSFTPBackend(config *Config) (*SFTPBackend, error) {
+	dial, remote, err := sftpDialer(config, "SFTPStorageURL", config.SFTPStorageURL)
+	if err != nil {
+		return nil, err
+	}
+	b := newSFTPBackend(config.BackupRoot, remote, dial)
+	// Fail on startup rather than on the first request.
+	_, err = b.client()
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+func newSFTPBackend(root, remote string, dial func() (*sftpConn, error)) *SFTPBackend {
+	return &SFTPBackend{root: path.Clean(root), remote: remote, dial: dial}
+}
+
+func (b *SFTPBackend) client() (*sftpConn, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.conn == nil {
+		c, err := b.dial()
+		if err != nil {
+			return nil, err
+		}
+		b.conn = c
+	}
+	return b.conn, nil
+}
+
+// Close closes the connection, if there is one.
+func (b *SFTPBackend) Close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.conn != nil {
+		b.conn.close()
+		b.conn = nil
+	}
+}
+
+// do runs fn on the connection and drops the connection if fn failed
+// without an answer from the server. The error is returned for fpath.
+func (b *SFTPBackend) do(op, fpath string, fn func(c *sftp.Client, remote string) error) error {
+	rel, err := relativePath(b.root, fpath)
+	if err != nil {
+		return err
+	}
+	c, err := b.client()
+	if err != nil {
+		return err
+	}
+	err = fn(c.Client, path.Join(b.remote, rel))
+	if err == nil {
+		return nil
+	}
+	if !sftpConnUsable(err) {
+		b.mu.Lock()
+		if b.conn == c {
+			b.conn = nil
+			c.close()
+		}
+		b.mu.Unlock()
+	}
+	return &os.PathError{Op: op, Path: fpath, Err: err}
+}
+
+func (b *SFTPBackend) open(fpath string, flags int) (StorageFile, error) {
+	var f StorageFile
+	err := b.do("open", fpath, func(c *sftp.Client, remote string) error {
+		file, err := c.OpenFile(remote, flags)
+		if err == nil {
+			f = &sftpFile{File: file, client: c}
+		}
+		return err
+	})
+	return f, err
+}
+
+func (b *SFTPBackend) Open(fpath string) (StorageFile, error) {
+	return b.open(fpath, os.O_RDONLY)
+}
+
+func (b *SFTPBackend) OpenWritable(fpath string) (StorageFile, error) {
+	return b.open(fpath, os.O_RDWR)
+}
+
+func (b *SFTPBackend) CreateExclusive(fpath string) (StorageFile, error) {
+	var f StorageFile
+	err := b.do("open", fpath, func(c *sftp.Client, remote string) error {
+		err := c.MkdirAll(path.Dir(remote))
+		if err != nil {
+			return err
+		}
+		file, err := c.OpenFile(remote, os.O_RDWR|os.O_CREATE|os.O_EXCL)
+		if err != nil {
+			// Version 3 of the protocol has no error code for files that
+			// exist already.
+			if _, statErr := c.Lstat(remote); statErr == nil {
+				return os.ErrExist
+			}
+			return err
+		}
+		f = &sftpFile{File: file, client: c}
+		return nil
+	})
+	return f, err
+}
+
+func (b *SFTPBackend) List(dir string) ([]string, error) {
+	var names []string
+	err := b.do("open", dir, func(c *sftp.Client, remote string) error {
+		infos, err := c.ReadDir(remote)
+		for _, info := range infos {
+			names = append(names, info.Name())
+		}
+		return err
+	})
+	return names, err
+}
+
+func (b *SFTPBackend) Stat(fpath string) (os.FileInfo, error) {
+	var info os.FileInfo
+	err := b.do("stat", fpath, func(c *sftp.Client, remote string) error {
+		var err error
+		info, err = c.Stat(remote)
+		return err
+	})
+	return info, err
+}
+
+func (b *SFTPBackend) Remove(fpath string) error {
+	return b.do("remove", fpath, func(c *sftp.Client, remote string) error {
+		return c.Remove(remote)
+	})
+}
+
+func (b *SFTPBackend) Rename(from, to string) error {
+	rel, err := relativePath(b.root, to)
+	if err != nil {
+		return err
+	}
+	dst := path.Join(b.remote, rel)
+	return b.do("rename", from, func(c *sftp.Client, remote string) error {
+		err := c.MkdirAll(path.Dir(dst))
+		if err != nil {
+			return err
+		}
+		if _, ok := c.HasExtension("posix-rename@openssh.com"); ok {
+			return c.PosixRename(remote, dst)
+		}
+		return c.Rename(remote, dst)
+	})
+}
+
+// sftpFile is a file open on the remote.
+type sftpFile struct {
+	*sftp.File
+	client *sftp.Client
+}
+
+// Sync flushes the file to the remote disk, if the server supports it.
+func (f *sftpFile) Sync() error {
+	if _, ok := f.client.HasExtension("fsync@openssh.com"); !ok {
+		return nil
+	}
+	return f.File.Sync()
+}
@@ -0,0 +1,121 @@
+package rsbackup
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestSFTPBackend(t *testing.T) {
+	tmpDir := createTMPDir(t, "rsbackup")
+	remoteRoot := path.Join(tmpDir, "remote")
+	dials := 0
+	b := newSFTPBackend("/backups", remoteRoot, func() (*sftpConn, error) {
+		dials++
+		return dialTestSFTP()
+	})
+	defer b.Close()
+
+	f, err := b.CreateExclusive("/backups/85/tyger")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("tyger tyger"))
+	f.Close()
+	if contents, err := ioutil.ReadFile(path.Join(remoteRoot, "85/tyger")); err != nil || string(contents) != "tyger tyger" {
+		t.Errorf("Got remote contents '%s' (error: %v)", contents, err)
+	}
+	if _, err := b.CreateExclusive("/backups/85/tyger"); !os.IsExist(err) {
+		t.Errorf("Got %v creating an existing file", err)
+	}
+	if _, err := b.Open("/backups/lion"); !os.IsNotExist(err) {
+		t.Errorf("Got %v opening a missing file", err)
+	}
+	if _, err := b.Stat("/elsewhere"); err == nil {
+		t.Errorf("Stat of a path outside the backup root succeeded")
+	}
+
+	err = b.Rename("/backups/85/tyger", "/backups/e7/tyger")
+	if err != nil {
+		t.Fatal(err)
+	}
+	names, err := b.List("/backups/e7")
+	if err != nil || len(names) != 1 || names[0] != "tyger" {
+		t.Errorf("Got names %v (error: %v)", names, err)
+	}
+	if stat, err := b.Stat("/backups/e7/tyger"); err != nil || stat.Size() != 11 {
+		t.Errorf("Got %v after rename (error: %v)", stat, err)
+	}
+	err = b.Remove("/backups/e7/tyger")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Errors answered by the server keep the connection.
+	if dials != 1 {
+		t.Errorf("Dialed %d times, expected 1", dials)
+	}
+}
+
+func TestSFTPBackendRedials(t *testing.T) {
+	dials := 0
+	b := newSFTPBackend("/backups", createTMPDir(t, "rsbackup"), func() (*sftpConn, error) {
+		dials++
+		if dials == 1 {
+			return nil, fmt.Errorf("connection refused")
+		}
+		return dialTestSFTP()
+	})
+	defer b.Close()
+	if _, err := b.List("/backups"); err == nil {
+		t.Errorf("Listed without a connection")
+	}
+	if _, err := b.List("/backups"); err != nil {
+		t.Errorf("Got %v after dialing again", err)
+	}
+}
+
+func TestHandlersWithSFTPBackend(t *testing.T) {
+	testData, err := ioutil.ReadFile("testdata/tyger")
+	if err != nil {
+		t.Fatal(err)
+	}
+	remoteRoot := createTMPDir(t, "rsbackup")
+	b := newSFTPBackend("/backups", remoteRoot, dialTestSFTP)
+	defer b.Close()
+	conf := &Config{BackupRoot: "/backups", DataShards: 2, ParityShards: 1}
+	api := &RSBackupAPI{Config: conf, RsFileMan: &RSFileManager{Config: conf, Storage: b}}
+
+	body := new(bytes.Buffer)
+	multipartWriter := multipart.NewWriter(body)
+	form, _ := multipartWriter.CreateFormFile("file", "tyger")
+	form.Write(testData)
+	multipartWriter.WriteField("filename", "tyger")
+	multipartWriter.Close()
+	req := httptest.NewRequest("POST", "/submit_data", body)
+	req.Header.Add("content-type", multipartWriter.FormDataContentType())
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(api.submitDataHandler).ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Got status code %d submitting", rr.Code)
+	}
+	for _, suffix := range []string{"", ".md", ".parity.1"} {
+		if _, err := os.Stat(path.Join(remoteRoot, "tyger"+suffix)); err != nil {
+			t.Errorf("Missing remote tyger%s: %s", suffix, err)
+		}
+	}
+	health, _, _, err := api.RsFileMan.CheckData("tyger")
+	if err != nil || !health {
+		t.Errorf("Got health %t (error: %v)", health, err)
+	}
+	rr = httptest.NewRecorder()
+	http.HandlerFunc(api.retrieveDataHandler).ServeHTTP(rr, httptest.NewRequest("GET", "/retrieve_data/tyger", nil))
+	if rr.Body.String() != string(testData) {
+		t.Errorf("Got retrieved contents '%s'", rr.Body.String())
+	}
+}
@@ -0,0 +1,123 @@
+package rsbackup
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/pkg/sftp"
+)
+
+// dialTestSFTP connects a client to an in-process SFTP server serving the
+// local filesystem.
+func dialTestSFTP() (*sftpConn, error) {
+	serverReader, clientWriter := io.Pipe()
+	clientReader, serverWriter := io.Pipe()
+	server, err := sftp.NewServer(struct {
+		io.Reader
+		io.WriteCloser
+	}{serverReader, serverWriter})
+	if err != nil {
+		return nil, err
+	}
+	go server.Serve()
+	client, err := sftp.NewClientPipe(clientReader, clientWriter)
+	if err != nil {
+		return nil, err
+	}
+	return &sftpConn{Client: client, ssh: server}, nil
+}
+
+func TestSFTPMirror(t *testing.T) {
+	defer func(delay time.Duration) { sftpRetryDelay = delay }(sftpRetryDelay)
+	sftpRetryDelay = time.Millisecond
+
+	tmpDir := createTMPDir(t, "rsbackup")
+	conf := &Config{BackupRoot: path.Join(tmpDir, "local"), DataShards: 2, ParityShards: 1}
+	layout := HashPrefixLayout{Levels: 1}
+	fileMan := &RSFileManager{Config: conf, Layout: layout}
+	localPath := fileMan.DataPath("tyger")
+	err := os.MkdirAll(path.Dir(localPath), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cloneShards(t, "tyger", path.Dir(localPath), conf)
+	remoteRoot := path.Join(tmpDir, "remote")
+	remotePath := path.Join(remoteRoot, layout.Path("tyger"))
+	// A stale copy on the remote gets replaced.
+	err = os.MkdirAll(path.Dir(remotePath), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(remotePath, []byte("stale"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The first connection attempts fail, so uploads have to be retried.
+	dials := 0
+	dial := func() (*sftpConn, error) {
+		dials++
+		if dials <= 2 {
+			return nil, fmt.Errorf("connection refused")
+		}
+		return dialTestSFTP()
+	}
+	mirror := newSFTPMirror(fileMan, remoteRoot, 1, 3, 0, dial)
+	api := &RSBackupAPI{Config: conf, RsFileMan: fileMan, Mirror: mirror}
+	api.mirror("tyger")
+	err = mirror.Stop(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, suffix := range []string{"", ".md", ".parity.1"} {
+		expected, err := ioutil.ReadFile(localPath + suffix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		actual, err := ioutil.ReadFile(remotePath + suffix)
+		if err != nil {
+			t.Fatalf("Missing remote copy: %s", err)
+		}
+		if !bytes.Equal(actual, expected) {
+			t.Errorf("Remote copy of tyger%s differs from the local file", suffix)
+		}
+		if _, err := os.Stat(remotePath + suffix + ".upload"); err == nil {
+			t.Errorf("Temporary upload of tyger%s left behind", suffix)
+		}
+	}
+	// Every file was copied over the one pooled connection.
+	if dials != 3 {
+		t.Errorf("Dialed %d times, expected 3", dials)
+	}
+}
+
+func TestSFTPMirrorGivesUp(t *testing.T) {
+	defer func(delay time.Duration) { sftpRetryDelay = delay }(sftpRetryDelay)
+	sftpRetryDelay = time.Millisecond
+
+	tmpDir := createTMPDir(t, "rsbackup")
+	conf := &Config{BackupRoot: tmpDir, DataShards: 2, ParityShards: 1}
+	fileMan := &RSFileManager{Config: conf}
+	cloneShards(t, "tyger", tmpDir, conf)
+	dials := 0
+	mirror := newSFTPMirror(fileMan, tmpDir, 1, 2, 0, func() (*sftpConn, error) {
+		dials++
+		return nil, fmt.Errorf("connection refused")
+	})
+	defer mirror.Stop(context.Background())
+	err := mirror.Upload("tyger")
+	if err == nil {
+		t.Fatal("Expected upload to fail")
+	}
+	if dials != 3 {
+		t.Errorf("Dialed %d times, expected 3", dials)
+	}
+}
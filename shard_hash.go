@@ -0,0 +1,58 @@
+package rsbackup
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"fmt"
+	"hash"
+
+	"github.com/zeebo/blake3"
+)
+
+// Values of Config.ShardHash.
+const (
+	hashSHA256 = "sha256"
+	hashSHA512 = "sha512"
+	hashBLAKE3 = "blake3"
+)
+
+// shardHashes are the algorithms shards can be hashed with. rsutils only
+// knows sha256, the hash of files that don't record one.
+var shardHashes = map[string]func() hash.Hash{
+	hashSHA256: sha256.New,
+	hashSHA512: sha512.New,
+	hashBLAKE3: func() hash.Hash { return blake3.New() },
+}
+
+// shardHashName returns the algorithm new files are hashed with.
+func (c *Config) shardHashName() string {
+	if c.ShardHash == "" {
+		return hashSHA256
+	}
+	return c.ShardHash
+}
+
+// newShardHash returns a hash of the algorithm name, as recorded in the
+// metadata of a file, sha256 for none.
+func newShardHash(name string) hash.Hash {
+	if newHash, ok := shardHashes[name]; ok {
+		return newHash()
+	}
+	return sha256.New()
+}
+
+// responseHash returns the algorithm named in responses for shards hashed
+// with name, none for sha256 so clients that only know it see no change.
+func responseHash(name string) string {
+	if name == hashSHA256 {
+		return ""
+	}
+	return name
+}
+
+// shardSum returns the hex encoded hash of p with the algorithm name.
+func shardSum(name string, p []byte) string {
+	h := newShardHash(name)
+	h.Write(p)
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
@@ -0,0 +1,112 @@
+package rsbackup
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+func TestShardHash(t *testing.T) {
+	config := &Config{BackupRoot: createTMPDir(t, "rsbackup"), DataShards: 3, ParityShards: 2}
+	fm := &RSFileManager{Config: config}
+	api := &RSBackupAPI{Config: config, RsFileMan: fm}
+	content := bytes.Repeat([]byte("what immortal hand or eye "), 500)
+	var tests = []struct {
+		hash      string
+		hexLength int
+	}{
+		{"", 64},
+		{hashSHA512, 128},
+		{hashBLAKE3, 64},
+	}
+	for _, tt := range tests {
+		config.ShardHash = tt.hash
+		fname := "tyger-" + config.shardHashName()
+		fpath := fm.DataPath(fname)
+		if err := ioutil.WriteFile(fpath, content, 0644); err != nil {
+			t.Fatal(err)
+		}
+		var extras MetadataExtras
+		md, err := api.generateParity(fm.storage(), fpath, &extras)
+		if err == nil {
+			err = fm.WriteMetadata(fname, md, extras)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if extras.Hash != config.shardHashName() || len(md.Hashes[0]) != tt.hexLength {
+			t.Errorf("%s: got hash '%s' and hashes %v", fname, extras.Hash, md.Hashes)
+		}
+		if health, _, _, err := fm.CheckData(fname); err != nil || !health {
+			t.Errorf("%s: got health %t (error: %v)", fname, health, err)
+		}
+
+		damaged := append([]byte{}, content...)
+		damaged[len(content)/2] ^= 1
+		if err := ioutil.WriteFile(fpath, damaged, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if shards, err := fm.DamagedShards(fname); err != nil || !reflect.DeepEqual(shards, []int{1}) {
+			t.Errorf("%s: got damaged shards %v (error: %v)", fname, shards, err)
+		}
+		if health, _, _, err := fm.CheckData(fname); err != nil || health {
+			t.Errorf("%s: got health %t (error: %v) of a damaged file", fname, health, err)
+		}
+		if err := fm.RepairData(fname); err != nil {
+			t.Fatal(err)
+		}
+		if data, err := ioutil.ReadFile(fpath); err != nil || !bytes.Equal(data, content) {
+			t.Errorf("%s: got a different file once repaired (error: %v)", fname, err)
+		}
+	}
+
+	config.ShardHash = "md5"
+	if err := config.Validate(); err == nil {
+		t.Errorf("An unknown shard hash passed validation")
+	}
+}
+
+// Shards larger than segmentBufferSize are checked and repaired in pieces.
+func TestShardHashLargeFile(t *testing.T) {
+	config := &Config{BackupRoot: createTMPDir(t, "rsbackup"), DataShards: 2, ParityShards: 1, ShardHash: hashBLAKE3}
+	fm := &RSFileManager{Config: config}
+	api := &RSBackupAPI{Config: config, RsFileMan: fm}
+	content := make([]byte, 3*segmentBufferSize+100)
+	rand.Read(content)
+	fpath := fm.DataPath("tyger")
+	if err := ioutil.WriteFile(fpath, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	var extras MetadataExtras
+	md, err := api.generateParity(fm.storage(), fpath, &extras)
+	if err == nil {
+		err = fm.WriteMetadata("tyger", md, extras)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if extras.Segments != nil {
+		t.Fatalf("Got segments %+v without SegmentSize or BlockSize", extras.Segments)
+	}
+
+	// The second piece of the second data shard.
+	damaged := append([]byte{}, content...)
+	damaged[len(content)/2+segmentBufferSize+10] ^= 1
+	if err := ioutil.WriteFile(fpath, damaged, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if health, _, _, err := fm.CheckData("tyger"); err != nil || health {
+		t.Errorf("Got health %t (error: %v) of a damaged file", health, err)
+	}
+	if err := fm.RepairData("tyger"); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := ioutil.ReadFile(fpath); err != nil || !bytes.Equal(data, content) {
+		t.Errorf("Got a different file once repaired (error: %v)", err)
+	}
+	if health, _, _, err := fm.CheckData("tyger"); err != nil || !health {
+		t.Errorf("Got health %t (error: %v) once repaired", health, err)
+	}
+}
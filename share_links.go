@@ -0,0 +1,277 @@
+package rsbackup
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	errShareNotFound = errors.New("Share link not found")
+	errShareExpired  = errors.New("Share link expired")
+)
+
+// ShareLink grants anonymous download access to a single file until it
+// expires or runs out of downloads. A MaxDownloads of 0 means unlimited.
+// The file is the one with the object ID, wherever it was renamed to, and
+// links to files without one go by Name. Like API tokens, only the sha256
+// of the Token is stored, so Token is only set on new links.
+type ShareLink struct {
+	Token        string    `json:"token,omitempty"`
+	Name         string    `json:"name"`
+	ID           string    `json:"id,omitempty"`
+	Created      time.Time `json:"created"`
+	Expires      time.Time `json:"expires"`
+	MaxDownloads int       `json:"max_downloads"`
+	Downloads    int       `json:"downloads"`
+}
+
+func (l *ShareLink) usable(now time.Time) bool {
+	if now.After(l.Expires) {
+		return false
+	}
+	return l.MaxDownloads == 0 || l.Downloads < l.MaxDownloads
+}
+
+// ShareStore keeps share links persisted in a json file so they survive
+// server restarts. Links are keyed by the hex sha256 of their token.
+type ShareStore struct {
+	mu    sync.Mutex
+	path  string
+	links map[string]*ShareLink
+}
+
+func NewShareStore(fpath string) (*ShareStore, error) {
+	s := &ShareStore{
+		path:  fpath,
+		links: make(map[string]*ShareLink),
+	}
+	err := readJSONState(fpath, &s.links)
+	if err != nil {
+		return nil, err
+	}
+	// Links used to be stored with their token.
+	rehashed := false
+	for key, link := range s.links {
+		if link.Token != "" {
+			delete(s.links, key)
+			s.links[hashShareToken(link.Token)] = link
+			link.Token = ""
+			rehashed = true
+		}
+	}
+	if rehashed {
+		err = s.save(time.Now())
+		if err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+func hashShareToken(token string) string {
+	return hex.EncodeToString(hashSecret(token))
+}
+
+func generateToken() (string, error) {
+	buf := make([]byte, 32)
+	_, err := rand.Read(buf)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+func (s *ShareStore) Create(name, id string, ttl time.Duration, maxDownloads int) (*ShareLink, error) {
+	token, err := generateToken()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	link := &ShareLink{
+		Name:         name,
+		ID:           id,
+		Created:      now,
+		Expires:      now.Add(ttl),
+		MaxDownloads: maxDownloads,
+	}
+	key := hashShareToken(token)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.links[key] = link
+	err = s.save(now)
+	if err != nil {
+		delete(s.links, key)
+		return nil, err
+	}
+	created := *link
+	created.Token = token
+	return &created, nil
+}
+
+// Use counts a download against the link identified by token and returns a
+// copy of it.
+func (s *ShareStore) Use(token string) (ShareLink, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	link, ok := s.links[hashShareToken(token)]
+	if !ok {
+		return ShareLink{}, errShareNotFound
+	}
+	now := time.Now()
+	if !link.usable(now) {
+		return ShareLink{}, errShareExpired
+	}
+	link.Downloads++
+	err := s.save(now)
+	if err != nil {
+		link.Downloads--
+		return ShareLink{}, err
+	}
+	return *link, nil
+}
+
+// save must be called with s.mu held. Links expired for over a day are
+// dropped, until then they are kept to tell clients they are gone.
+func (s *ShareStore) save(now time.Time) error {
+	for token, link := range s.links {
+		if now.Sub(link.Expires) > 24*time.Hour {
+			delete(s.links, token)
+		}
+	}
+	return writeJSONState(s.path, s.links)
+}
+
+type shareRsp struct {
+	Token        string `json:"token"`
+	Name         string `json:"name"`
+	URL          string `json:"url"`
+	Expires      string `json:"expires"`
+	MaxDownloads int    `json:"max_downloads"`
+}
+
+func (rs *RSBackupAPI) shareHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		rs.Errorf(r, "Bad method %s", r.Method)
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	fname, err := getFileNameParam(r.URL)
+	if err != nil {
+		rs.Errorf(r, "Can't share file: %s", err)
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	ttl := rs.Config.ShareDefaultTTL
+	if ttlParam := r.FormValue("ttl"); ttlParam != "" {
+		ttl, err = time.ParseDuration(ttlParam)
+		if err != nil || ttl <= 0 {
+			rs.Errorf(r, "Bad 'ttl' parameter '%s'", ttlParam)
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+	}
+	maxDownloads := 0
+	if maxParam := r.FormValue("max_downloads"); maxParam != "" {
+		maxDownloads, err = strconv.Atoi(maxParam)
+		if err != nil || maxDownloads < 0 {
+			rs.Errorf(r, "Bad 'max_downloads' parameter '%s'", maxParam)
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+	}
+	_, err = rs.RsFileMan.Stat(fname)
+	if err != nil || isReservedName(fname) {
+		rs.Errorf(r, "Can't share %s: file not found", fname)
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+	link, err := rs.Shares.Create(fname, rs.RsFileMan.objectID(fname), ttl, maxDownloads)
+	if err != nil {
+		rs.Errorf(r, "Unable to create share link for %s: %s", fname, err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	log.Infof("Created share link for %s expiring %s", fname, link.Expires)
+	rsp := &shareRsp{
+		Token:        link.Token,
+		Name:         link.Name,
+		URL:          "/shared/" + link.Token,
+		Expires:      link.Expires.Format("2006-01-02 15:04:05"),
+		MaxDownloads: link.MaxDownloads,
+	}
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(rsp)
+	if err != nil {
+		rs.Errorf(r, "Unable to marshal json response: %s", err)
+	}
+}
+
+// sharedHandler serves the file of a share link. Every request counts as a
+// download before it's served, range requests too, so a link can't serve
+// more than its downloads however the requests are split. Requests for
+// multiple ranges are refused.
+func (rs *RSBackupAPI) sharedHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		rs.Errorf(r, "Bad method %s", r.Method)
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	token, err := getURLParam(r.URL)
+	if err != nil {
+		rs.Errorf(r, "Can't retrieve shared file: %s", err)
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	if strings.Contains(r.Header.Get("Range"), ",") {
+		rs.Errorf(r, "Multiple ranges requested through share link")
+		http.Error(w, "Multiple ranges aren't supported on share links", http.StatusRequestedRangeNotSatisfiable)
+		return
+	}
+	link, err := rs.Shares.Use(token)
+	var fname string
+	if err == nil {
+		fname, err = rs.sharedName(link)
+	}
+	if err != nil {
+		switch {
+		case err == errShareNotFound:
+			rs.Errorf(r, "Unknown share token")
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		case err == errShareExpired:
+			rs.Errorf(r, "Share token expired or exhausted")
+			http.Error(w, http.StatusText(http.StatusGone), http.StatusGone)
+		case os.IsNotExist(err):
+			rs.Errorf(r, "Shared file %s no longer stored", link.Name)
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		default:
+			rs.Errorf(r, "Unable to use share link: %s", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		}
+		return
+	}
+	auditObject(r, fname)
+	log.Debugf("Serving %s via share link (%d/%d downloads)", fname, link.Downloads, link.MaxDownloads)
+	rs.serveData(w, r, fname)
+}
+
+// sharedName returns the name the file of link is stored under now.
+func (rs *RSBackupAPI) sharedName(link ShareLink) (string, error) {
+	if link.ID == "" {
+		return link.Name, nil
+	}
+	if rs.RsFileMan.objectID(link.Name) == link.ID {
+		return link.Name, nil
+	}
+	// Renamed since, or replaced by another file of the same name.
+	return rs.RsFileMan.NameOfID(link.ID)
+}
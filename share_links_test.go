@@ -0,0 +1,242 @@
+package rsbackup
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestShareHandler(t *testing.T) {
+	shareTests := []struct {
+		name           string
+		method         string
+		url            string
+		form           url.Values
+		expectedStatus int
+	}{
+		{"bad method", "GET", "/share/tyger", url.Values{}, 405},
+		{"bad url param", "POST", "/share/", url.Values{}, 400},
+		{"file not found", "POST", "/share/lion", url.Values{}, 404},
+		{"bad ttl", "POST", "/share/tyger", url.Values{"ttl": {"forever"}}, 400},
+		{"bad max downloads", "POST", "/share/tyger", url.Values{"max_downloads": {"-1"}}, 400},
+		{"success", "POST", "/share/tyger", url.Values{"ttl": {"1h"}, "max_downloads": {"2"}}, 200},
+	}
+
+	for _, tt := range shareTests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := &Config{
+				BackupRoot:      "testdata/",
+				ShareDefaultTTL: time.Hour,
+			}
+			shares, err := NewShareStore(path.Join(createTMPDir(t, "rsbackup"), "shares.json"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			api := &RSBackupAPI{
+				Config:    config,
+				RsFileMan: &RSFileManager{Config: config},
+				Shares:    shares,
+			}
+
+			req := httptest.NewRequest(tt.method, tt.url, strings.NewReader(tt.form.Encode()))
+			req.Header.Set("content-type", "application/x-www-form-urlencoded")
+			rr := httptest.NewRecorder()
+			http.HandlerFunc(api.shareHandler).ServeHTTP(rr, req)
+
+			if rr.Code != tt.expectedStatus {
+				t.Errorf("Got status code %d, expected %d", rr.Code, tt.expectedStatus)
+			}
+		})
+	}
+}
+
+func TestSharedHandler(t *testing.T) {
+	testData, err := ioutil.ReadFile("testdata/tyger")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &Config{BackupRoot: "testdata/", ShareDefaultTTL: time.Hour}
+	sharesPath := path.Join(createTMPDir(t, "rsbackup"), "shares.json")
+	shares, err := NewShareStore(sharesPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	api := &RSBackupAPI{
+		Config:    config,
+		RsFileMan: &RSFileManager{Config: config},
+		Shares:    shares,
+	}
+
+	req := httptest.NewRequest("POST", "/share/tyger?max_downloads=1", nil)
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(api.shareHandler).ServeHTTP(rr, req)
+	var created shareRsp
+	err = json.NewDecoder(rr.Body).Decode(&created)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Links must survive a restart.
+	api.Shares, err = NewShareStore(sharesPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Every range counts as a download, and multiple ranges are refused.
+	sharedTests := []struct {
+		name           string
+		url            string
+		rangeHeader    string
+		expectedStatus int
+		expectedRsp    string
+	}{
+		{"unknown token", "/shared/abc", "", 404, "Not Found\n"},
+		{"multiple ranges", created.URL, "bytes=0-9,20-29", 416, "Multiple ranges aren't supported on share links\n"},
+		{"range", created.URL, "bytes=0-99", 206, string(testData[:100])},
+		{"ranges exhausted", created.URL, "bytes=100-", 410, "Gone\n"},
+		{"downloads exhausted", created.URL, "", 410, "Gone\n"},
+	}
+	for _, tt := range sharedTests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", tt.url, nil)
+			if tt.rangeHeader != "" {
+				req.Header.Set("Range", tt.rangeHeader)
+			}
+			rr := httptest.NewRecorder()
+			http.HandlerFunc(api.sharedHandler).ServeHTTP(rr, req)
+
+			if rr.Code != tt.expectedStatus {
+				t.Errorf("Got status code %d, expected %d", rr.Code, tt.expectedStatus)
+			}
+			if rr.Body.String() != tt.expectedRsp {
+				t.Errorf("Got rsp body '%s', expected '%s'", rr.Body.String(), tt.expectedRsp)
+			}
+		})
+	}
+}
+
+func TestShareStoreConcurrentUse(t *testing.T) {
+	shares, err := NewShareStore(path.Join(createTMPDir(t, "rsbackup"), "shares.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	link, err := shares.Create("tyger", "", time.Hour, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	var used int32
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := shares.Use(link.Token); err == nil {
+				atomic.AddInt32(&used, 1)
+			}
+		}()
+	}
+	wg.Wait()
+	if used != 3 {
+		t.Errorf("Link with 3 downloads was used %d times", used)
+	}
+}
+
+func TestShareStoreHashesTokens(t *testing.T) {
+	sharesPath := path.Join(createTMPDir(t, "rsbackup"), "shares.json")
+	shares, err := NewShareStore(sharesPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	link, err := shares.Create("tyger", "", time.Hour, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Links stored with their token before are rehashed on load.
+	old := &ShareLink{Token: strings.Repeat("ab", 32), Name: "lamb", Expires: time.Now().Add(time.Hour)}
+	shares.links[old.Token] = old
+	if err := shares.save(time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	shares, err = NewShareStore(sharesPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored, err := ioutil.ReadFile(sharesPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, token := range []string{link.Token, strings.Repeat("ab", 32)} {
+		if strings.Contains(string(stored), token) {
+			t.Errorf("Token %s stored in plain text", token)
+		}
+		if _, err := shares.Use(token); err != nil {
+			t.Errorf("Cannot use token %s: %s", token, err)
+		}
+	}
+}
+
+func TestShareLinkFollowsObject(t *testing.T) {
+	tmpDir := createTMPDir(t, "rsbackup")
+	config := &Config{BackupRoot: tmpDir, DataShards: 2, ParityShards: 1, ShareDefaultTTL: time.Hour}
+	shares, err := NewShareStore(path.Join(createTMPDir(t, "rsbackup-state"), "shares.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fm := &RSFileManager{Config: config}
+	api := &RSBackupAPI{Config: config, RsFileMan: fm, Shares: shares}
+	store := func(fname, content string) {
+		t.Helper()
+		if err := ioutil.WriteFile(fm.DataPath(fname), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		md, err := api.generateParity(fm.storage(), fm.DataPath(fname), nil)
+		if err == nil {
+			var id string
+			id, err = newObjectID()
+			if err == nil {
+				err = fm.WriteMetadata(fname, md, MetadataExtras{ID: id})
+			}
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	store("tyger", "tyger tyger burning bright")
+
+	req := httptest.NewRequest("POST", "/share/tyger", nil)
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(api.shareHandler).ServeHTTP(rr, req)
+	var created shareRsp
+	if err := json.NewDecoder(rr.Body).Decode(&created); err != nil {
+		t.Fatal(err)
+	}
+	// The link serves the shared file under its new name, not the one
+	// stored under its old name since.
+	if err := fm.Rename("tyger", "lamb"); err != nil {
+		t.Fatal(err)
+	}
+	store("tyger", "little lamb who made thee")
+	shared := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", created.URL, nil)
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(api.sharedHandler).ServeHTTP(rr, req)
+		return rr
+	}
+	if rr := shared(); rr.Code != http.StatusOK || rr.Body.String() != "tyger tyger burning bright" {
+		t.Errorf("Got status code %d and body '%s'", rr.Code, rr.Body)
+	}
+	if err := fm.Delete("lamb", false, false); err != nil {
+		t.Fatal(err)
+	}
+	if rr := shared(); rr.Code != http.StatusNotFound {
+		t.Errorf("Got status code %d once the shared file was deleted", rr.Code)
+	}
+}
@@ -0,0 +1,103 @@
+package rsbackup
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// abortedRequestsWait bounds the wait for handlers to return once their
+// connections were closed by a shutdown that timed out.
+const abortedRequestsWait = 10 * time.Second
+
+type shutdownHook struct {
+	name string
+	fn   func(context.Context) error
+}
+
+// OnShutdown registers fn to be called by Stop once the HTTP server no
+// longer serves requests. Hooks run in reverse order of registration, so a
+// subsystem registered after the ones it depends on is stopped before them.
+func (r *RSBackupAPI) OnShutdown(name string, fn func(context.Context) error) {
+	r.shutdownHooks = append(r.shutdownHooks, shutdownHook{name: name, fn: fn})
+}
+
+// trackInFlight counts requests being served, so shutdown can report what
+// it is waiting for.
+func (r *RSBackupAPI) trackInFlight(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt64(&r.inFlight, 1)
+		defer atomic.AddInt64(&r.inFlight, -1)
+		next.ServeHTTP(w, req)
+	})
+}
+
+// waitInFlight waits up to timeout for the requests being served to finish,
+// and reports whether they did.
+func (r *RSBackupAPI) waitInFlight(timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for atomic.LoadInt64(&r.inFlight) > 0 {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return true
+}
+
+// Stop shuts the server down in stages: first new connections are refused
+// and in-flight requests get up to Config.ShutdownTimeout to finish, then
+// those left are aborted and waited for, and the registered shutdown hooks
+// stop background subsystems.
+func (r *RSBackupAPI) Stop() error {
+	log.Infof("Shutting down server...")
+	var errs []error
+
+	log.Infof("Shutdown stage 1/2: stop serving requests (%d in flight)", atomic.LoadInt64(&r.inFlight))
+	if r.server != nil {
+		ctx := context.Background()
+		if r.Config.ShutdownTimeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, r.Config.ShutdownTimeout)
+			defer cancel()
+		}
+		err := r.server.Shutdown(ctx)
+		if err == context.DeadlineExceeded {
+			// Aborted uploads clean up their partial files, see SaveFile.
+			log.Warnf("Timed out waiting for %d requests, aborting them", atomic.LoadInt64(&r.inFlight))
+			err = r.server.Close()
+			// Closing the connections doesn't stop their handlers, which
+			// may still write to the subsystems the hooks stop.
+			if !r.waitInFlight(abortedRequestsWait) {
+				log.Errorf("Stopping subsystems with %d requests still running", atomic.LoadInt64(&r.inFlight))
+			}
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("Error while shutting down server: %s", err))
+		}
+		r.server = nil
+	}
+
+	log.Infof("Shutdown stage 2/2: stop %d subsystems", len(r.shutdownHooks))
+	for i := len(r.shutdownHooks) - 1; i >= 0; i-- {
+		hook := r.shutdownHooks[i]
+		log.Infof("Stopping %s", hook.name)
+		err := hook.fn(context.Background())
+		if err != nil {
+			errs = append(errs, fmt.Errorf("Error while stopping %s: %s", hook.name, err))
+		}
+	}
+
+	if len(errs) > 0 {
+		for _, err := range errs[1:] {
+			log.Error(err)
+		}
+		return errs[0]
+	}
+	log.Info("Server shutdown successfully")
+	return nil
+}
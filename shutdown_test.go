@@ -0,0 +1,85 @@
+package rsbackup
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestStop(t *testing.T) {
+	stopTests := []struct {
+		name            string
+		requestDuration time.Duration
+		timeout         time.Duration
+		expectedBody    string
+	}{
+		{"in-flight request finishes", 50 * time.Millisecond, time.Second, "done"},
+		{"in-flight request aborted", time.Second, 50 * time.Millisecond, ""},
+	}
+
+	for _, tt := range stopTests {
+		t.Run(tt.name, func(t *testing.T) {
+			api := &RSBackupAPI{Config: &Config{ShutdownTimeout: tt.timeout}}
+			var stopped []string
+			for _, name := range []string{"first", "second"} {
+				name := name
+				api.OnShutdown(name, func(context.Context) error {
+					if n := atomic.LoadInt64(&api.inFlight); n != 0 {
+						t.Errorf("Stopping %s with %d requests in flight", name, n)
+					}
+					stopped = append(stopped, name)
+					return nil
+				})
+			}
+			requestDone := make(chan struct{})
+			handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("content-length", "4")
+				w.WriteHeader(200)
+				w.(http.Flusher).Flush()
+				select {
+				case <-time.After(tt.requestDuration):
+					w.Write([]byte("done"))
+				case <-requestDone:
+				}
+			})
+			defer close(requestDone)
+			api.server = &http.Server{Handler: api.trackInFlight(handler)}
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			go api.server.Serve(ln)
+
+			body := make(chan string)
+			go func() {
+				rsp, err := http.Get("http://" + ln.Addr().String())
+				if err != nil {
+					body <- ""
+					return
+				}
+				defer rsp.Body.Close()
+				content, _ := ioutil.ReadAll(rsp.Body)
+				body <- string(content)
+			}()
+			for atomic.LoadInt64(&api.inFlight) == 0 {
+				time.Sleep(time.Millisecond)
+			}
+
+			err = api.Stop()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := <-body; got != tt.expectedBody {
+				t.Errorf("Got body '%s', expected '%s'", got, tt.expectedBody)
+			}
+			if expected := []string{"second", "first"}; !reflect.DeepEqual(stopped, expected) {
+				t.Errorf("Subsystems stopped in order %v, expected %v", stopped, expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,138 @@
+package rsbackup
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Size is an amount of bytes that can be parsed from human readable
+// strings like "512", "200MB" or "50GiB".
+type Size int64
+
+var sizeUnits = []struct {
+	suffix string
+	bytes  int64
+}{
+	{"PiB", 1 << 50},
+	{"TiB", 1 << 40},
+	{"GiB", 1 << 30},
+	{"MiB", 1 << 20},
+	{"KiB", 1 << 10},
+	{"PB", 1e15},
+	{"TB", 1e12},
+	{"GB", 1e9},
+	{"MB", 1e6},
+	{"KB", 1e3},
+	{"B", 1},
+}
+
+// ParseSize parses a decimal number followed by an optional unit. Units are
+// case insensitive, KB/MB/GB are powers of 1000 and KiB/MiB/GiB powers
+// of 1024.
+func ParseSize(s string) (Size, error) {
+	trimmed := strings.TrimSpace(s)
+	multiplier := int64(1)
+	for _, unit := range sizeUnits {
+		if len(trimmed) > len(unit.suffix) && strings.EqualFold(trimmed[len(trimmed)-len(unit.suffix):], unit.suffix) {
+			trimmed = strings.TrimSpace(trimmed[:len(trimmed)-len(unit.suffix)])
+			multiplier = unit.bytes
+			break
+		}
+	}
+	value, err := strconv.ParseFloat(trimmed, 64)
+	if err != nil || value < 0 || math.IsInf(value, 0) || math.IsNaN(value) {
+		return 0, fmt.Errorf("Invalid size '%s'", s)
+	}
+	bytes := value * float64(multiplier)
+	// float64(math.MaxInt64) rounds up to 1<<63, which doesn't fit.
+	if bytes >= math.MaxInt64 {
+		return 0, fmt.Errorf("Size '%s' is too large", s)
+	}
+	return Size(bytes), nil
+}
+
+// String formats the size using the largest binary unit that represents it
+// exactly, so that it can be parsed back by ParseSize.
+func (s Size) String() string {
+	for _, unit := range sizeUnits[:5] {
+		if s != 0 && int64(s)%unit.bytes == 0 {
+			return fmt.Sprintf("%d%s", int64(s)/unit.bytes, unit.suffix)
+		}
+	}
+	return strconv.FormatInt(int64(s), 10)
+}
+
+// Set implements flag.Value.
+func (s *Size) Set(value string) error {
+	parsed, err := ParseSize(value)
+	if err != nil {
+		return err
+	}
+	*s = parsed
+	return nil
+}
+
+// UnmarshalJSON accepts both a plain number of bytes and a human readable
+// string.
+func (s *Size) UnmarshalJSON(data []byte) error {
+	var str string
+	if err := json.Unmarshal(data, &str); err == nil {
+		return s.Set(str)
+	}
+	var n int64
+	if err := json.Unmarshal(data, &n); err != nil || n < 0 {
+		return fmt.Errorf("Invalid size %s", data)
+	}
+	*s = Size(n)
+	return nil
+}
+
+func (s Size) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.String())
+}
+
+// Rate is a throughput in bytes per second, parsed from strings like
+// "200MB/s". The "/s" suffix is optional.
+type Rate Size
+
+func ParseRate(s string) (Rate, error) {
+	size, err := ParseSize(strings.TrimSuffix(strings.TrimSpace(s), "/s"))
+	if err != nil {
+		return 0, fmt.Errorf("Invalid rate '%s'", s)
+	}
+	return Rate(size), nil
+}
+
+func (r Rate) String() string {
+	return Size(r).String() + "/s"
+}
+
+// Set implements flag.Value.
+func (r *Rate) Set(value string) error {
+	parsed, err := ParseRate(value)
+	if err != nil {
+		return err
+	}
+	*r = parsed
+	return nil
+}
+
+func (r *Rate) UnmarshalJSON(data []byte) error {
+	var str string
+	if err := json.Unmarshal(data, &str); err == nil {
+		return r.Set(str)
+	}
+	var n int64
+	if err := json.Unmarshal(data, &n); err != nil || n < 0 {
+		return fmt.Errorf("Invalid rate %s", data)
+	}
+	*r = Rate(n)
+	return nil
+}
+
+func (r Rate) MarshalJSON() ([]byte, error) {
+	return json.Marshal(r.String())
+}
@@ -0,0 +1,76 @@
+package rsbackup
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestParseSize(t *testing.T) {
+	sizeTests := []struct {
+		input       string
+		expected    Size
+		expectedStr string
+		expectedErr bool
+	}{
+		{"512", 512, "512", false},
+		{"200MB", 200e6, "200000000", false},
+		{"50GiB", 50 << 30, "50GiB", false},
+		{"1.5 kib", 1536, "1536", false},
+		{"2048KiB", 2 << 20, "2MiB", false},
+		{"0", 0, "0", false},
+		{"10 B", 10, "10", false},
+		{"-1GB", 0, "", true},
+		{"GB", 0, "", true},
+		{"lots", 0, "", true},
+		{"10000PiB", 0, "", true},
+		{"8192PiB", 0, "", true},
+		{"9223372036854775808", 0, "", true},
+		{"8191PiB", 8191 << 50, "8191PiB", false},
+	}
+
+	for _, tt := range sizeTests {
+		t.Run(tt.input, func(t *testing.T) {
+			size, err := ParseSize(tt.input)
+			if (err != nil) != tt.expectedErr {
+				t.Fatalf("Got error '%v', expected error: %t", err, tt.expectedErr)
+			}
+			if size != tt.expected {
+				t.Errorf("Got size %d, expected %d", size, tt.expected)
+			}
+			if err == nil && size.String() != tt.expectedStr {
+				t.Errorf("Got string '%s', expected '%s'", size.String(), tt.expectedStr)
+			}
+		})
+	}
+}
+
+func TestParseRate(t *testing.T) {
+	rate, err := ParseRate("200MiB/s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rate != 200<<20 {
+		t.Errorf("Got rate %d, expected %d", rate, 200<<20)
+	}
+	if rate.String() != "200MiB/s" {
+		t.Errorf("Got string '%s', expected '200MiB/s'", rate.String())
+	}
+	if _, err := ParseRate("fast/s"); err == nil {
+		t.Errorf("Expected error for bad rate")
+	}
+}
+
+func TestSizeJSON(t *testing.T) {
+	var limits struct {
+		A Size
+		B Size
+		C Rate
+	}
+	err := json.Unmarshal([]byte(`{"A":"1KiB","B":2048,"C":"1MB/s"}`), &limits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if limits.A != 1024 || limits.B != 2048 || limits.C != 1e6 {
+		t.Errorf("Got %+v, expected {A:1024 B:2048 C:1000000}", limits)
+	}
+}
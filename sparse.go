@@ -0,0 +1,207 @@
+package rsbackup
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// sparseBlockSize is the granularity holes are found at: blocks of that
+// many zero bytes, at multiples of it, are left out.
+const sparseBlockSize = 64 << 10
+
+var zeroBlock = make([]byte, sparseBlockSize)
+
+// SparseInfo is recorded in the metadata of files stored sparse. The data
+// file only holds the extents of the contents, one after the other, and
+// the holes between them are zeros.
+type SparseInfo struct {
+	// Size is the size of the contents as submitted.
+	Size    int64          `json:"size"`
+	Extents []SparseExtent `json:"extents"`
+}
+
+// SparseExtent is a range of the contents of a sparse file that holds data.
+type SparseExtent struct {
+	Offset int64 `json:"offset"`
+	Length int64 `json:"length"`
+}
+
+// sparsingReader reads the contents of src without their holes. Its
+// SparseInfo is complete once src is read to the end.
+type sparsingReader struct {
+	src     io.Reader
+	info    *SparseInfo
+	buf     []byte
+	pending []byte
+	err     error
+}
+
+func newSparsingReader(src io.Reader) *sparsingReader {
+	return &sparsingReader{src: src, info: &SparseInfo{Extents: []SparseExtent{}}, buf: make([]byte, sparseBlockSize)}
+}
+
+func (s *sparsingReader) Read(p []byte) (int, error) {
+	for len(s.pending) == 0 {
+		if s.err != nil {
+			return 0, s.err
+		}
+		n, err := io.ReadFull(s.src, s.buf)
+		if err == io.ErrUnexpectedEOF {
+			err = io.EOF
+		}
+		block := s.buf[:n]
+		if n > 0 && !bytes.Equal(block, zeroBlock[:n]) {
+			last := len(s.info.Extents) - 1
+			if last >= 0 && s.info.Extents[last].Offset+s.info.Extents[last].Length == s.info.Size {
+				s.info.Extents[last].Length += int64(n)
+			} else {
+				s.info.Extents = append(s.info.Extents, SparseExtent{Offset: s.info.Size, Length: int64(n)})
+			}
+			s.pending = block
+		}
+		s.info.Size += int64(n)
+		s.err = err
+		if err != nil && len(s.info.Extents) == 0 && s.info.Size > 0 {
+			// Parity needs data, so files that are a hole only keep
+			// their last byte.
+			s.info.Extents = append(s.info.Extents, SparseExtent{Offset: s.info.Size - 1, Length: 1})
+			s.pending = zeroBlock[:1]
+		}
+	}
+	n := copy(p, s.pending)
+	s.pending = s.pending[n:]
+	return n, nil
+}
+
+// sparseReader gives random access to the contents of a sparse file, src
+// reading what its data file holds.
+type sparseReader struct {
+	src  io.ReadSeeker
+	info *SparseInfo
+	// stored holds where each extent starts in src.
+	stored []int64
+	pos    int64
+}
+
+func newSparseReader(src io.ReadSeeker, info *SparseInfo) *sparseReader {
+	s := &sparseReader{src: src, info: info, stored: make([]int64, len(info.Extents))}
+	var offset int64
+	for i, e := range info.Extents {
+		s.stored[i] = offset
+		offset += e.Length
+	}
+	return s
+}
+
+func (s *sparseReader) Read(p []byte) (int, error) {
+	if s.pos >= s.info.Size {
+		return 0, io.EOF
+	}
+	extents := s.info.Extents
+	// The first extent not ending before pos.
+	i := sort.Search(len(extents), func(i int) bool {
+		return extents[i].Offset+extents[i].Length > s.pos
+	})
+	if i == len(extents) || extents[i].Offset > s.pos {
+		end := s.info.Size
+		if i < len(extents) {
+			end = extents[i].Offset
+		}
+		if int64(len(p)) > end-s.pos {
+			p = p[:end-s.pos]
+		}
+		for j := range p {
+			p[j] = 0
+		}
+		s.pos += int64(len(p))
+		return len(p), nil
+	}
+	within := s.pos - extents[i].Offset
+	if remaining := extents[i].Length - within; int64(len(p)) > remaining {
+		p = p[:remaining]
+	}
+	_, err := s.src.Seek(s.stored[i]+within, io.SeekStart)
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.ReadFull(s.src, p)
+	s.pos += int64(n)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = fmt.Errorf("Sparse file is missing data at %d", s.pos)
+	}
+	return n, err
+}
+
+func (s *sparseReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += s.pos
+	case io.SeekEnd:
+		offset += s.info.Size
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("Negative position %d", offset)
+	}
+	s.pos = offset
+	return offset, nil
+}
+
+// sparseWriter writes the contents of a sparse file to w, the extents its
+// data file holds being written to it. The hole at the end is written
+// along with the last extent.
+type sparseWriter struct {
+	w    io.Writer
+	info *SparseInfo
+	// extent is the index of the extent being written and pos the
+	// position in the contents.
+	extent int
+	pos    int64
+	err    error
+}
+
+func (s *sparseWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 && s.err == nil {
+		if s.extent >= len(s.info.Extents) {
+			return written, fmt.Errorf("Sparse contents longer than expected")
+		}
+		e := s.info.Extents[s.extent]
+		if s.err = s.zeros(e.Offset); s.err != nil {
+			break
+		}
+		chunk := p
+		if remaining := e.Offset + e.Length - s.pos; int64(len(chunk)) > remaining {
+			chunk = chunk[:remaining]
+		}
+		var n int
+		n, s.err = s.w.Write(chunk)
+		s.pos += int64(n)
+		written += n
+		p = p[n:]
+		if s.err == nil && s.pos == e.Offset+e.Length {
+			s.extent++
+			if s.extent == len(s.info.Extents) {
+				s.err = s.zeros(s.info.Size)
+			}
+		}
+	}
+	return written, s.err
+}
+
+// zeros fills the hole up to end.
+func (s *sparseWriter) zeros(end int64) error {
+	for s.pos < end {
+		n := int64(len(zeroBlock))
+		if n > end-s.pos {
+			n = end - s.pos
+		}
+		written, err := s.w.Write(zeroBlock[:n])
+		s.pos += int64(written)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
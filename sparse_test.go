@@ -0,0 +1,104 @@
+package rsbackup
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+func TestSparseStorage(t *testing.T) {
+	// A block of data, a hole of three blocks, data spanning a block and
+	// a half and a hole of one and a half blocks at the end.
+	data := make([]byte, 7*sparseBlockSize)
+	copy(data, bytes.Repeat([]byte("x"), sparseBlockSize))
+	copy(data[4*sparseBlockSize:], bytes.Repeat([]byte("y"), sparseBlockSize+sparseBlockSize/2))
+	data = data[:len(data)-sparseBlockSize/2]
+	extents := []SparseExtent{{0, sparseBlockSize}, {4 * sparseBlockSize, 2 * sparseBlockSize}}
+
+	for _, tc := range []struct {
+		name        string
+		data        []byte
+		extents     []SparseExtent
+		compression string
+	}{
+		{"sparse", data, extents, ""},
+		{"compressed", data, extents, "zstd"},
+		{"hole", make([]byte, 2*sparseBlockSize+1), []SparseExtent{{2 * sparseBlockSize, 1}}, ""},
+	} {
+		tmpDir := createTMPDir(t, "rsbackup")
+		config := &Config{BackupRoot: tmpDir, DataShards: 2, ParityShards: 1, Sparse: true, Compression: tc.compression}
+		fm := &RSFileManager{Config: config}
+		api := &RSBackupAPI{Config: config, RsFileMan: fm}
+
+		body := new(bytes.Buffer)
+		mw := multipart.NewWriter(body)
+		fw, _ := mw.CreateFormFile("file", "disk.img")
+		fw.Write(tc.data)
+		mw.WriteField("filename", "disk.img")
+		mw.Close()
+		req := httptest.NewRequest("POST", "/submit_data", body)
+		req.Header.Set("Content-Type", mw.FormDataContentType())
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(api.submitDataHandler).ServeHTTP(rr, req)
+		var rsp submitDataRsp
+		if rr.Code != 200 || json.NewDecoder(rr.Body).Decode(&rsp) != nil || rsp.Size != int64(len(tc.data)) {
+			t.Fatalf("%s: Got status code %d and size %d", tc.name, rr.Code, rsp.Size)
+		}
+		if rsp.Sparse == nil || rsp.Sparse.Size != int64(len(tc.data)) || !reflect.DeepEqual(rsp.Sparse.Extents, tc.extents) {
+			t.Fatalf("%s: Got sparse info %+v", tc.name, rsp.Sparse)
+		}
+
+		fpath := fm.DataPath("disk.img")
+		stored, err := ioutil.ReadFile(fpath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var dataSize int
+		for _, e := range tc.extents {
+			dataSize += int(e.Length)
+		}
+		if tc.compression == "" && len(stored) != dataSize {
+			t.Errorf("%s: Stored %d bytes, expected %d without the holes", tc.name, len(stored), dataSize)
+		}
+
+		retrieve := func(url, rangeHeader string) *httptest.ResponseRecorder {
+			req := httptest.NewRequest("GET", url, nil)
+			if rangeHeader != "" {
+				req.Header.Set("Range", rangeHeader)
+			}
+			rr := httptest.NewRecorder()
+			http.HandlerFunc(api.retrieveDataHandler).ServeHTTP(rr, req)
+			return rr
+		}
+		if rr := retrieve("/retrieve_data/disk.img", ""); rr.Code != 200 || !bytes.Equal(rr.Body.Bytes(), tc.data) {
+			t.Errorf("%s: Got status code %d and %d bytes, expected the %d bytes submitted", tc.name, rr.Code, rr.Body.Len(), len(tc.data))
+		}
+		// Ranges within holes, and across holes and extents.
+		for _, r := range [][2]int{{10, 19}, {sparseBlockSize - 5, sparseBlockSize + 5}, {3*sparseBlockSize - 1, 5 * sparseBlockSize}, {len(tc.data) - 10, len(tc.data) - 1}} {
+			if r[1] >= len(tc.data) {
+				continue
+			}
+			rr := retrieve("/retrieve_data/disk.img", "bytes="+strconv.Itoa(r[0])+"-"+strconv.Itoa(r[1]))
+			if rr.Code != 206 || !bytes.Equal(rr.Body.Bytes(), tc.data[r[0]:r[1]+1]) {
+				t.Errorf("%s: Got status code %d and %d bytes for range %v", tc.name, rr.Code, rr.Body.Len(), r)
+			}
+		}
+
+		// Parity covers the stored extents, reconstruction fills in holes.
+		stored[0] ^= 0xff
+		err = ioutil.WriteFile(fpath, stored, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr = retrieve("/retrieve_data/disk.img?verify=true", "")
+		if rr.Header().Get("Reconstructed") != "true" || rr.Header().Get("Content-Length") != strconv.Itoa(len(tc.data)) || !bytes.Equal(rr.Body.Bytes(), tc.data) {
+			t.Errorf("%s: Got status code %d and %d bytes for a damaged file", tc.name, rr.Code, rr.Body.Len())
+		}
+	}
+}
@@ -0,0 +1,225 @@
+package rsbackup
+
+import (
+	"os"
+	"path"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// Files are staged in a directory named stagingPrefix and a token,
+	// next to where they are committed to.
+	stagingPrefix = ".staging-"
+
+	fsyncOff  = "off"
+	fsyncFile = "file"
+	fsyncFull = "full"
+)
+
+// commitMu makes checking that nothing is stored at a path and renaming a
+// staged file there one step.
+var commitMu sync.Mutex
+
+// atomicCreator is a StorageBackend whose new files only appear, whole,
+// once closed, and only if nothing took their place, like object stores
+// uploading them on close. Their files aren't staged.
+type atomicCreator interface {
+	createsAtomically()
+}
+
+func (b *objectBackend) createsAtomically() {}
+
+// dirSyncer is a StorageBackend that can flush a directory to disk, so the
+// renames in it survive a crash.
+type dirSyncer interface {
+	SyncDir(dir string) error
+}
+
+func (OSBackend) SyncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	if closeErr := d.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// SyncDir flushes dir on every disk holding it.
+func (m *MultiDiskBackend) SyncDir(dir string) error {
+	for disk := range m.disks {
+		diskPath, err := m.onDisk(disk, dir)
+		if err != nil {
+			return err
+		}
+		err = OSBackend{}.SyncDir(diskPath)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+func isStagingName(name string) bool {
+	return strings.HasPrefix(name, stagingPrefix)
+}
+
+// stagedFile is a new file written under a staging name, which only takes
+// the place of the file once complete. A crash never leaves part of it in
+// place.
+type stagedFile struct {
+	StorageFile
+	storage StorageBackend
+	fpath   string
+	// staging is where the file is written, "" if written in place.
+	staging string
+	fsync   string
+	closed  bool
+}
+
+// createStaged creates a file in storage that becomes fpath once it's
+// committed. It fails if fpath exists already, as does the commit. fsync
+// is a Config.Fsync setting.
+func createStaged(storage StorageBackend, fpath, fsync string) (*stagedFile, error) {
+	f := &stagedFile{storage: storage, fpath: fpath, fsync: fsync}
+	if _, ok := storage.(atomicCreator); ok {
+		file, err := storage.CreateExclusive(fpath)
+		if err != nil {
+			return nil, err
+		}
+		f.StorageFile = file
+		return f, nil
+	}
+	// Refused right away, so nothing is written in vain.
+	if _, err := storage.Stat(fpath); err == nil {
+		return nil, &os.PathError{Op: "open", Path: fpath, Err: os.ErrExist}
+	}
+	token, err := generateToken()
+	if err != nil {
+		return nil, err
+	}
+	// Keeping the name puts the file on the same disk or storage target
+	// as where it's committed to.
+	f.staging = path.Join(path.Dir(fpath), stagingPrefix+token[:16], path.Base(fpath))
+	f.StorageFile, err = storage.CreateExclusive(f.staging)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// commit syncs and closes the file, then renames it to its path unless
+// something was stored there in the meantime. With Config.Fsync "full"
+// the directory holding it is synced too. The file is removed if it
+// can't be committed.
+func (f *stagedFile) commit() error {
+	var err error
+	if f.fsync != fsyncOff {
+		err = f.Sync()
+	}
+	// Backends that upload files on close report failures here.
+	f.closed = true
+	if closeErr := f.StorageFile.Close(); err == nil {
+		err = closeErr
+	}
+	if f.staging == "" {
+		return err
+	}
+	if err == nil {
+		commitMu.Lock()
+		if _, err = f.storage.Stat(f.fpath); err == nil {
+			err = &os.LinkError{Op: "rename", Old: f.staging, New: f.fpath, Err: os.ErrExist}
+		} else if os.IsNotExist(err) {
+			err = f.storage.Rename(f.staging, f.fpath)
+		}
+		commitMu.Unlock()
+	}
+	if err != nil {
+		f.storage.Remove(f.staging)
+	}
+	f.storage.Remove(path.Dir(f.staging))
+	if err == nil && f.fsync == fsyncFull {
+		if syncer, ok := f.storage.(dirSyncer); ok {
+			err = syncer.SyncDir(path.Dir(f.fpath))
+		}
+	}
+	return err
+}
+
+// abort closes and removes the file, unless it was committed.
+func (f *stagedFile) abort() {
+	if f.closed {
+		return
+	}
+	f.closed = true
+	f.StorageFile.Close()
+	if f.staging == "" {
+		f.storage.Remove(f.fpath)
+		return
+	}
+	f.storage.Remove(f.staging)
+	f.storage.Remove(path.Dir(f.staging))
+}
+
+// RemoveStaged removes the files a crash left staged, those of deduplicated
+// chunks and packed containers included. It's meant to run on startup,
+// before anything is stored.
+func (r *RSFileManager) RemoveStaged() error {
+	for _, files := range []*RSFileManager{r, r.chunkFiles(), r.packFiles()} {
+		err := files.removeStaged(files.Config.BackupRoot, files.layout().Depth())
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeStaged removes the staging directories found up to depth
+// directory levels below dir.
+func (r *RSFileManager) removeStaged(dir string, depth int) error {
+	names, err := r.storage().List(dir)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		fpath := path.Join(dir, name)
+		switch {
+		case isStagingName(name):
+			log.Warnf("Removing '%s', left staged by a crash", fpath)
+			err = removeTree(r.storage(), fpath)
+		case depth > 0 && !isReservedName(name):
+			err = r.removeStaged(fpath, depth-1)
+		}
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeTree removes fpath from storage, with everything below it if it's
+// a directory.
+func removeTree(storage StorageBackend, fpath string) error {
+	stat, err := storage.Stat(fpath)
+	if err != nil {
+		return err
+	}
+	if stat.IsDir() {
+		names, err := storage.List(fpath)
+		if err != nil {
+			return err
+		}
+		for _, name := range names {
+			err = removeTree(storage, path.Join(fpath, name))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return storage.Remove(fpath)
+}
@@ -0,0 +1,94 @@
+package rsbackup
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestStagedFile(t *testing.T) {
+	tmpDir := createTMPDir(t, "rsbackup")
+	fm := &RSFileManager{Config: &Config{BackupRoot: tmpDir, DataShards: 2, ParityShards: 1, Fsync: fsyncFull}}
+	storage := fm.storage()
+	stagingDirs := func() []string {
+		var dirs []string
+		names, err := ioutil.ReadDir(tmpDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, info := range names {
+			if strings.HasPrefix(info.Name(), stagingPrefix) {
+				dirs = append(dirs, info.Name())
+			}
+		}
+		return dirs
+	}
+
+	fpath := path.Join(tmpDir, "committed")
+	f, err := createStaged(storage, fpath, fsyncFull)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("data"))
+	if _, err := os.Stat(fpath); !os.IsNotExist(err) {
+		t.Errorf("Got %v stating a file before it's committed", err)
+	}
+	if err := f.commit(); err != nil {
+		t.Fatal(err)
+	}
+	f.abort()
+	if data, err := ioutil.ReadFile(fpath); err != nil || string(data) != "data" {
+		t.Errorf("Got %q committing (error: %v)", data, err)
+	}
+	if dirs := stagingDirs(); len(dirs) != 0 {
+		t.Errorf("Staging directories left behind: %v", dirs)
+	}
+
+	if _, err := createStaged(storage, fpath, fsyncFile); !os.IsExist(err) {
+		t.Errorf("Got %v staging over a stored file", err)
+	}
+	f, err = createStaged(storage, path.Join(tmpDir, "raced"), fsyncOff)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path.Join(tmpDir, "raced"), []byte("first"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.commit(); !os.IsExist(err) {
+		t.Errorf("Got %v committing over a file stored meanwhile", err)
+	}
+	if data, _ := ioutil.ReadFile(path.Join(tmpDir, "raced")); string(data) != "first" {
+		t.Errorf("Commit replaced the file stored meanwhile with %q", data)
+	}
+
+	f, err = createStaged(storage, path.Join(tmpDir, "aborted"), fsyncFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("data"))
+	f.abort()
+	if _, err := os.Stat(path.Join(tmpDir, "aborted")); !os.IsNotExist(err) {
+		t.Errorf("Got %v stating an aborted file", err)
+	}
+	if dirs := stagingDirs(); len(dirs) != 0 {
+		t.Errorf("Staging directories left behind: %v", dirs)
+	}
+
+	// A crash leaves the staged file behind, which listings skip.
+	f, err = createStaged(storage, path.Join(tmpDir, "crashed"), fsyncFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	if names, err := fm.ListData(); err != nil || len(names) != 2 {
+		t.Errorf("Got names %v (error: %v)", names, err)
+	}
+	if err := fm.RemoveStaged(); err != nil {
+		t.Fatal(err)
+	}
+	if dirs := stagingDirs(); len(dirs) != 0 {
+		t.Errorf("RemoveStaged left %v", dirs)
+	}
+}
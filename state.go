@@ -0,0 +1,52 @@
+package rsbackup
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+)
+
+// readJSONState decodes the state file at fpath into v. A missing file is
+// not an error and leaves v untouched.
+func readJSONState(fpath string, v interface{}) error {
+	f, err := os.Open(fpath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+	return json.NewDecoder(f).Decode(v)
+}
+
+// writeJSONState atomically replaces the state file at fpath with the json
+// encoding of v, creating its directory if needed.
+func writeJSONState(fpath string, v interface{}) error {
+	dir := path.Dir(fpath)
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+	tmpFile, err := ioutil.TempFile(dir, path.Base(fpath)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+	err = json.NewEncoder(tmpFile).Encode(v)
+	if err != nil {
+		tmpFile.Close()
+		return err
+	}
+	err = tmpFile.Sync()
+	if err != nil {
+		tmpFile.Close()
+		return err
+	}
+	err = tmpFile.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpFile.Name(), fpath)
+}
@@ -0,0 +1,416 @@
+package rsbackup
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// StorageFile is a file opened through a StorageBackend. *os.File is one.
+type StorageFile interface {
+	io.ReadWriteSeeker
+	io.ReaderAt
+	io.Closer
+	Stat() (os.FileInfo, error)
+	Sync() error
+	Truncate(size int64) error
+}
+
+// StorageBackend is where RSFileManager keeps data, parity and metadata
+// files, and the trash. Paths are those built from DataPath. Errors for
+// missing or existing files must satisfy os.IsNotExist and os.IsExist.
+// The rest of the server state stays on local disk.
+type StorageBackend interface {
+	// Open opens fpath for reading.
+	Open(fpath string) (StorageFile, error)
+	// OpenWritable opens the existing fpath for reading and writing.
+	OpenWritable(fpath string) (StorageFile, error)
+	// CreateExclusive creates fpath, and its parent directories, failing
+	// if it already exists.
+	CreateExclusive(fpath string) (StorageFile, error)
+	// List returns the names of the entries of the directory dir.
+	List(dir string) ([]string, error)
+	Stat(fpath string) (os.FileInfo, error)
+	Remove(fpath string) error
+	// Rename moves from to to, creating the parent directories of to.
+	Rename(from, to string) error
+}
+
+// OSBackend stores files on local disk, it is the default.
+type OSBackend struct {
+	// FileMode and DirMode are the permissions of the files and
+	// directories it creates, whatever the umask. Zero means 0644 and 0755.
+	FileMode os.FileMode
+	DirMode  os.FileMode
+	// Owner, if set, is who created files and directories are handed to.
+	Owner *FileOwner
+}
+
+func (OSBackend) Open(fpath string) (StorageFile, error) {
+	return os.Open(fpath)
+}
+
+func (OSBackend) OpenWritable(fpath string) (StorageFile, error) {
+	return os.OpenFile(fpath, os.O_RDWR, 0)
+}
+
+func (o OSBackend) CreateExclusive(fpath string) (StorageFile, error) {
+	f, err := o.create(fpath)
+	if err != nil {
+		// A nil *os.File isn't a nil StorageFile.
+		return nil, err
+	}
+	return f, nil
+}
+
+func (OSBackend) List(dir string) ([]string, error) {
+	d, err := os.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	defer d.Close()
+	return d.Readdirnames(-1)
+}
+
+func (OSBackend) Stat(fpath string) (os.FileInfo, error) {
+	return os.Stat(fpath)
+}
+
+func (OSBackend) Remove(fpath string) error {
+	return os.Remove(fpath)
+}
+
+func (o OSBackend) Rename(from, to string) error {
+	err := o.mkdirAll(path.Dir(to))
+	if err != nil {
+		return err
+	}
+	return os.Rename(from, to)
+}
+
+// relativePath returns the path of fpath below root, for backends that
+// don't store files under BackupRoot. It's "" for root itself.
+func relativePath(root, fpath string) (string, error) {
+	rel, err := filepath.Rel(root, path.Clean(fpath))
+	if err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+		return "", fmt.Errorf("'%s' is outside the backup root", fpath)
+	}
+	if rel == "." {
+		return "", nil
+	}
+	return filepath.ToSlash(rel), nil
+}
+
+// storeLocal moves the file src, assembled on local disk, to dst in
+// storage, replacing dst. Backends other than OSBackend can't rename over
+// dst, so it is removed first and briefly missing. So is dst when src is
+// on another filesystem.
+func storeLocal(storage StorageBackend, src, dst string) error {
+	if tracked, ok := storage.(*usageBackend); ok {
+		return tracked.storeLocal(src, dst)
+	}
+	if local, ok := storage.(OSBackend); ok {
+		err := local.Rename(src, dst)
+		if err == nil {
+			return local.adopt(dst)
+		}
+		if !errors.Is(err, syscall.EXDEV) {
+			return err
+		}
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	err = storage.Remove(dst)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	out, err := storage.CreateExclusive(dst)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		storage.Remove(dst)
+		return err
+	}
+	return os.Remove(src)
+}
+
+// MemoryBackend keeps files in memory, for tests that shouldn't need a
+// temporary directory, including those of projects embedding the API. Its
+// zero value is empty and ready to use. Directories exist as long as they
+// hold a file.
+type MemoryBackend struct {
+	mu    sync.Mutex
+	files map[string]*memoryObject
+}
+
+type memoryObject struct {
+	data    []byte
+	modTime time.Time
+}
+
+func (m *MemoryBackend) open(op, fpath string, writable bool) (StorageFile, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	obj, ok := m.files[path.Clean(fpath)]
+	if !ok {
+		return nil, &os.PathError{Op: op, Path: fpath, Err: os.ErrNotExist}
+	}
+	return &memoryFile{backend: m, name: path.Base(fpath), obj: obj, writable: writable}, nil
+}
+
+func (m *MemoryBackend) Open(fpath string) (StorageFile, error) {
+	return m.open("open", fpath, false)
+}
+
+func (m *MemoryBackend) OpenWritable(fpath string) (StorageFile, error) {
+	return m.open("open", fpath, true)
+}
+
+func (m *MemoryBackend) CreateExclusive(fpath string) (StorageFile, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	fpath = path.Clean(fpath)
+	if _, ok := m.files[fpath]; ok {
+		return nil, &os.PathError{Op: "open", Path: fpath, Err: os.ErrExist}
+	}
+	if m.files == nil {
+		m.files = make(map[string]*memoryObject)
+	}
+	obj := &memoryObject{modTime: time.Now()}
+	m.files[fpath] = obj
+	return &memoryFile{backend: m, name: path.Base(fpath), obj: obj, writable: true}, nil
+}
+
+func (m *MemoryBackend) List(dir string) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	prefix := path.Clean(dir) + "/"
+	seen := make(map[string]bool)
+	var names []string
+	for fpath := range m.files {
+		if !strings.HasPrefix(fpath, prefix) {
+			continue
+		}
+		name := strings.SplitN(strings.TrimPrefix(fpath, prefix), "/", 2)[0]
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return nil, &os.PathError{Op: "open", Path: dir, Err: os.ErrNotExist}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (m *MemoryBackend) Stat(fpath string) (os.FileInfo, error) {
+	m.mu.Lock()
+	obj, ok := m.files[path.Clean(fpath)]
+	m.mu.Unlock()
+	if ok {
+		return m.info(path.Base(fpath), obj), nil
+	}
+	if _, err := m.List(fpath); err == nil {
+		return storedFileInfo{name: path.Base(fpath), dir: true}, nil
+	}
+	return nil, &os.PathError{Op: "stat", Path: fpath, Err: os.ErrNotExist}
+}
+
+func (m *MemoryBackend) info(name string, obj *memoryObject) os.FileInfo {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return storedFileInfo{name: name, size: int64(len(obj.data)), modTime: obj.modTime}
+}
+
+func (m *MemoryBackend) Remove(fpath string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	fpath = path.Clean(fpath)
+	if _, ok := m.files[fpath]; !ok {
+		return &os.PathError{Op: "remove", Path: fpath, Err: os.ErrNotExist}
+	}
+	delete(m.files, fpath)
+	return nil
+}
+
+func (m *MemoryBackend) Rename(from, to string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	from, to = path.Clean(from), path.Clean(to)
+	obj, ok := m.files[from]
+	if !ok {
+		return &os.LinkError{Op: "rename", Old: from, New: to, Err: os.ErrNotExist}
+	}
+	delete(m.files, from)
+	m.files[to] = obj
+	return nil
+}
+
+// WriteFile stores a copy of data as fpath, replacing the file if there is
+// one.
+func (m *MemoryBackend) WriteFile(fpath string, data []byte) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.files == nil {
+		m.files = make(map[string]*memoryObject)
+	}
+	m.files[path.Clean(fpath)] = &memoryObject{data: append([]byte(nil), data...), modTime: time.Now()}
+}
+
+// ReadFile returns a copy of the contents of fpath.
+func (m *MemoryBackend) ReadFile(fpath string) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	obj, ok := m.files[path.Clean(fpath)]
+	if !ok {
+		return nil, &os.PathError{Op: "open", Path: fpath, Err: os.ErrNotExist}
+	}
+	return append([]byte(nil), obj.data...), nil
+}
+
+// Load copies the files below the local directory dir to the same paths
+// below root, to start from fixtures kept on disk.
+func (m *MemoryBackend) Load(dir, root string) error {
+	return filepath.Walk(dir, func(fpath string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, fpath)
+		if err != nil {
+			return err
+		}
+		data, err := ioutil.ReadFile(fpath)
+		if err != nil {
+			return err
+		}
+		m.WriteFile(path.Join(root, filepath.ToSlash(rel)), data)
+		return nil
+	})
+}
+
+type storedFileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+	dir     bool
+}
+
+func (i storedFileInfo) Name() string       { return i.name }
+func (i storedFileInfo) Size() int64        { return i.size }
+func (i storedFileInfo) ModTime() time.Time { return i.modTime }
+func (i storedFileInfo) IsDir() bool        { return i.dir }
+func (i storedFileInfo) Sys() interface{}   { return nil }
+
+func (i storedFileInfo) Mode() os.FileMode {
+	if i.dir {
+		return os.ModeDir | 0755
+	}
+	return defaultFileMode
+}
+
+// memoryFile is an open MemoryBackend file, its contents are shared with
+// every other handle of the same file.
+type memoryFile struct {
+	backend  *MemoryBackend
+	name     string
+	obj      *memoryObject
+	offset   int64
+	writable bool
+}
+
+func (f *memoryFile) ReadAt(p []byte, off int64) (int, error) {
+	f.backend.mu.Lock()
+	defer f.backend.mu.Unlock()
+	if off >= int64(len(f.obj.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, f.obj.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *memoryFile) Read(p []byte) (int, error) {
+	n, err := f.ReadAt(p, f.offset)
+	f.offset += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (f *memoryFile) Write(p []byte) (int, error) {
+	if !f.writable {
+		return 0, &os.PathError{Op: "write", Path: f.name, Err: os.ErrPermission}
+	}
+	f.backend.mu.Lock()
+	defer f.backend.mu.Unlock()
+	if end := f.offset + int64(len(p)); end > int64(len(f.obj.data)) {
+		f.obj.data = append(f.obj.data, make([]byte, end-int64(len(f.obj.data)))...)
+	}
+	copy(f.obj.data[f.offset:], p)
+	f.offset += int64(len(p))
+	f.obj.modTime = time.Now()
+	return len(p), nil
+}
+
+func (f *memoryFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		stat, _ := f.Stat()
+		offset += stat.Size()
+	}
+	if offset < 0 {
+		return 0, &os.PathError{Op: "seek", Path: f.name, Err: os.ErrInvalid}
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+func (f *memoryFile) Stat() (os.FileInfo, error) {
+	return f.backend.info(f.name, f.obj), nil
+}
+
+func (f *memoryFile) Truncate(size int64) error {
+	if !f.writable {
+		return &os.PathError{Op: "truncate", Path: f.name, Err: os.ErrPermission}
+	}
+	f.backend.mu.Lock()
+	defer f.backend.mu.Unlock()
+	if size < int64(len(f.obj.data)) {
+		f.obj.data = f.obj.data[:size]
+	} else {
+		f.obj.data = append(f.obj.data, make([]byte, size-int64(len(f.obj.data)))...)
+	}
+	f.obj.modTime = time.Now()
+	return nil
+}
+
+func (f *memoryFile) Sync() error {
+	return nil
+}
+
+func (f *memoryFile) Close() error {
+	return nil
+}
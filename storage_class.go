@@ -0,0 +1,86 @@
+package rsbackup
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// StorageClass is a level of protection clients can pick for each file
+// they submit, by its name in Config.StorageClasses. Placement rules with
+// its name as Class decide where its files go.
+type StorageClass struct {
+	DataShards   int
+	ParityShards int
+}
+
+// ShardBand gives the files of the default storage class of up to UpTo
+// bytes their shard counts, see Config.ShardBands. UpTo 0 is unbounded.
+type ShardBand struct {
+	UpTo         Size
+	DataShards   int
+	ParityShards int
+}
+
+// DefaultShardBands are the bands -auto-shards picks: small files are
+// copied rather than split into shards padded to the same size, medium
+// ones get the usual 10+3, and large ones more shards of bounded size.
+var DefaultShardBands = []ShardBand{
+	{UpTo: 1 << 20, DataShards: 1, ParityShards: 2},
+	{UpTo: 1 << 30, DataShards: 10, ParityShards: 3},
+	{DataShards: 20, ParityShards: 4},
+}
+
+// shards returns the number of data and parity shards files of the
+// storage class class get, the configured ones for the default class "".
+func (c *Config) shards(class string) (int, int) {
+	if sc, ok := c.StorageClasses[class]; ok && class != "" {
+		return sc.DataShards, sc.ParityShards
+	}
+	return c.DataShards, c.ParityShards
+}
+
+// fileShards returns the number of data and parity shards a file of size
+// bytes of the storage class class gets. With Config.ShardSize, files of
+// the default class get as many data shards of at most that size as they
+// need, up to the 256 shards a file can have, and parity shards in the
+// configured proportion, but never fewer than configured. With
+// Config.ShardBands, they get the counts of the first band their size
+// fits in.
+func (c *Config) fileShards(class string, size int64) (int, int) {
+	if _, ok := c.StorageClasses[class]; (ok && class != "") || size <= 0 {
+		return c.shards(class)
+	}
+	for _, band := range c.ShardBands {
+		if band.UpTo == 0 || size <= int64(band.UpTo) {
+			return band.DataShards, band.ParityShards
+		}
+	}
+	if c.ShardSize <= 0 {
+		return c.shards(class)
+	}
+	parity := func(dataShards int) int {
+		parityShards := (dataShards*c.ParityShards + c.DataShards - 1) / c.DataShards
+		if parityShards < c.ParityShards {
+			return c.ParityShards
+		}
+		return parityShards
+	}
+	dataShards := (size + int64(c.ShardSize) - 1) / int64(c.ShardSize)
+	if dataShards > 256 {
+		dataShards = 256
+	}
+	for dataShards > 1 && int(dataShards)+parity(int(dataShards)) > 256 {
+		dataShards--
+	}
+	return int(dataShards), parity(int(dataShards))
+}
+
+// storageClassParam returns the storage_class form field of a submit,
+// checking that it's configured.
+func (rs *RSBackupAPI) storageClassParam(r *http.Request) (string, error) {
+	class := r.FormValue("storage_class")
+	if _, ok := rs.Config.StorageClasses[class]; class != "" && !ok {
+		return "", fmt.Errorf("Unknown storage class '%s'", class)
+	}
+	return class, nil
+}
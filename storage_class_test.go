@@ -0,0 +1,184 @@
+package rsbackup
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestStorageClass(t *testing.T) {
+	tmpDir := createTMPDir(t, "rsbackup")
+	archive := path.Join(tmpDir, "archive")
+	conf := &Config{
+		BackupRoot:     path.Join(tmpDir, "root"),
+		DataShards:     2,
+		ParityShards:   1,
+		StorageClasses: map[string]StorageClass{"redundant": {DataShards: 2, ParityShards: 3}},
+		StorageTargets: map[string]StorageTarget{"archive": {Dir: archive}},
+		Placement:      []PlacementRule{{Class: "redundant", Parity: []string{"archive"}}},
+	}
+	for _, dir := range []string{conf.BackupRoot, archive} {
+		if err := os.Mkdir(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	placement, err := NewPlacementBackend(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	api := &RSBackupAPI{Config: conf, RsFileMan: &RSFileManager{Config: conf, Storage: placement}, Placement: placement}
+	submit := func(fname, class string) *httptest.ResponseRecorder {
+		body := new(bytes.Buffer)
+		mw := multipart.NewWriter(body)
+		fw, err := mw.CreateFormFile("file", fname)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fw.Write(bytes.Repeat([]byte(fname), 100))
+		mw.WriteField("filename", fname)
+		mw.WriteField("storage_class", class)
+		mw.Close()
+		req := httptest.NewRequest("POST", "/submit_data", body)
+		req.Header.Set("Content-Type", mw.FormDataContentType())
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(api.submitDataHandler).ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := submit("important", "redundant")
+	var rsp submitDataRsp
+	if rr.Code != http.StatusOK || json.NewDecoder(rr.Body).Decode(&rsp) != nil {
+		t.Fatalf("Got status code %d submitting with a storage class", rr.Code)
+	}
+	if rsp.ParityShards != 3 || rsp.StorageClass != "redundant" {
+		t.Errorf("Got response %+v", rsp)
+	}
+	for i := 1; i <= 3; i++ {
+		if _, err := os.Stat(path.Join(archive, fmt.Sprintf("important.parity.%d", i))); err != nil {
+			t.Errorf("Parity shard %d wasn't placed for the class: %s", i, err)
+		}
+	}
+	if extras, err := api.RsFileMan.ReadExtras(api.RsFileMan.DataPath("important")); err != nil || extras.StorageClass != "redundant" {
+		t.Errorf("Got storage class '%s' in metadata (error: %v)", extras.StorageClass, err)
+	}
+	if err := api.RsFileMan.RepairData("important"); err != nil {
+		t.Fatal(err)
+	}
+
+	if rr := submit("plain", ""); rr.Code != http.StatusOK {
+		t.Fatalf("Got status code %d submitting without a storage class", rr.Code)
+	}
+	if _, err := os.Stat(path.Join(conf.BackupRoot, "plain.parity.2")); !os.IsNotExist(err) {
+		t.Errorf("Got %v stating a parity shard the default class doesn't have", err)
+	}
+	if _, err := os.Stat(path.Join(archive, "plain.parity.1")); !os.IsNotExist(err) {
+		t.Errorf("Got %v stating parity placed for another class", err)
+	}
+
+	if rr := submit("unknown", "gold"); rr.Code != http.StatusBadRequest {
+		t.Errorf("Got status code %d for an unknown storage class", rr.Code)
+	}
+}
+
+func TestFileShards(t *testing.T) {
+	conf := &Config{
+		DataShards:     2,
+		ParityShards:   1,
+		ShardSize:      4096,
+		StorageClasses: map[string]StorageClass{"redundant": {DataShards: 2, ParityShards: 3}},
+	}
+	var tests = []struct {
+		class  string
+		size   int64
+		data   int
+		parity int
+	}{
+		{"", 100, 1, 1},
+		{"", 4096, 1, 1},
+		{"", 10000, 3, 2},
+		{"", 1 << 40, 170, 85},
+		{"", 0, 2, 1},
+		{"redundant", 10000, 2, 3},
+	}
+	for _, tt := range tests {
+		if data, parity := conf.fileShards(tt.class, tt.size); data != tt.data || parity != tt.parity {
+			t.Errorf("Got %d+%d shards for %d bytes of class '%s', expected %d+%d", data, parity, tt.size, tt.class, tt.data, tt.parity)
+		}
+	}
+
+	conf.BackupRoot = createTMPDir(t, "rsbackup")
+	fm := &RSFileManager{Config: conf}
+	api := &RSBackupAPI{Config: conf, RsFileMan: fm}
+	// Encoded while received, and again once saved.
+	for _, buffer := range []Size{0, 1} {
+		conf.SinglePassBuffer = buffer
+		body := new(bytes.Buffer)
+		mw := multipart.NewWriter(body)
+		fw, _ := mw.CreateFormFile("file", "tyger")
+		fw.Write(bytes.Repeat([]byte("burning bright "), 700))
+		mw.WriteField("filename", "tyger")
+		mw.Close()
+		req := httptest.NewRequest("POST", "/submit_data", body)
+		req.Header.Set("Content-Type", mw.FormDataContentType())
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(api.submitDataHandler).ServeHTTP(rr, req)
+		var rsp submitDataRsp
+		if rr.Code != http.StatusOK || json.NewDecoder(rr.Body).Decode(&rsp) != nil || rsp.DataShards != 3 || rsp.ParityShards != 2 {
+			t.Fatalf("Got status code %d and response %+v", rr.Code, rsp)
+		}
+		if health, _, _, err := fm.CheckData("tyger"); err != nil || !health {
+			t.Errorf("Got health %t (error: %v)", health, err)
+		}
+		if err := fm.Delete("tyger", false, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestShardBands(t *testing.T) {
+	conf := &Config{DataShards: 2, ParityShards: 1, StorageClasses: map[string]StorageClass{"redundant": {DataShards: 2, ParityShards: 3}}}
+	if err := json.Unmarshal([]byte(`[{"UpTo": "1MiB", "DataShards": 1, "ParityShards": 2}, {"UpTo": 1073741824, "DataShards": 10, "ParityShards": 3}]`), &conf.ShardBands); err != nil {
+		t.Fatal(err)
+	}
+	var tests = []struct {
+		class  string
+		size   int64
+		data   int
+		parity int
+	}{
+		{"", 100, 1, 2},
+		{"", 1 << 20, 1, 2},
+		{"", 1<<20 + 1, 10, 3},
+		{"", 2 << 30, 2, 1},
+		{"", 0, 2, 1},
+		{"redundant", 100, 2, 3},
+	}
+	for _, tt := range tests {
+		if data, parity := conf.fileShards(tt.class, tt.size); data != tt.data || parity != tt.parity {
+			t.Errorf("Got %d+%d shards for %d bytes of class '%s', expected %d+%d", data, parity, tt.size, tt.class, tt.data, tt.parity)
+		}
+	}
+
+	conf.BackupRoot = "/tmp"
+	for _, bands := range [][]ShardBand{
+		{{UpTo: 1 << 30, DataShards: 10, ParityShards: 3}, {UpTo: 1 << 20, DataShards: 1, ParityShards: 2}},
+		{{DataShards: 10, ParityShards: 3}, {UpTo: 1 << 20, DataShards: 1, ParityShards: 2}},
+		{{UpTo: 1 << 20, DataShards: 0, ParityShards: 2}},
+		{{UpTo: 1 << 20, DataShards: 250, ParityShards: 10}},
+	} {
+		conf.ShardBands = bands
+		if err := conf.Validate(); err == nil {
+			t.Errorf("Bands %+v passed validation", bands)
+		}
+	}
+	conf.ShardBands = DefaultShardBands
+	if err := conf.Validate(); err != nil {
+		t.Errorf("Got %s validating the default bands", err)
+	}
+}
@@ -0,0 +1,137 @@
+package rsbackup
+
+import (
+	"bytes"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMemoryBackend(t *testing.T) {
+	m := &MemoryBackend{}
+	f, err := m.CreateExclusive("/root/85/tyger")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("tyger tyger"))
+	f.Close()
+	if _, err := m.CreateExclusive("/root/85/tyger"); !os.IsExist(err) {
+		t.Errorf("Got %v creating an existing file", err)
+	}
+
+	f, err = m.OpenWritable("/root/85/tyger")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("Tyger"))
+	f.Close()
+	f, _ = m.Open("/root/85/tyger")
+	contents, _ := ioutil.ReadAll(f)
+	if string(contents) != "Tyger tyger" {
+		t.Errorf("Got contents '%s'", contents)
+	}
+	if _, err := f.Write([]byte("x")); err == nil {
+		t.Errorf("Wrote to a file opened for reading")
+	}
+
+	m.CreateExclusive("/root/lion")
+	names, err := m.List("/root")
+	if err != nil || !reflect.DeepEqual(names, []string{"85", "lion"}) {
+		t.Errorf("Got names %v (error: %v)", names, err)
+	}
+	if stat, err := m.Stat("/root/85"); err != nil || !stat.IsDir() {
+		t.Errorf("Got %v stating a directory (error: %v)", stat, err)
+	}
+
+	err = m.Rename("/root/85/tyger", "/root/tyger")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Stat("/root/85"); !os.IsNotExist(err) {
+		t.Errorf("Emptied directory still exists")
+	}
+	if stat, err := m.Stat("/root/tyger"); err != nil || stat.Size() != 11 {
+		t.Errorf("Got %v after rename (error: %v)", stat, err)
+	}
+	m.Remove("/root/tyger")
+	if _, err := m.Open("/root/tyger"); !os.IsNotExist(err) {
+		t.Errorf("Got %v opening a removed file", err)
+	}
+}
+
+func TestHandlersWithMemoryBackend(t *testing.T) {
+	testData, err := ioutil.ReadFile("testdata/tyger")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := &Config{BackupRoot: "/backups", DataShards: 2, ParityShards: 1}
+	storage := &MemoryBackend{}
+	api := &RSBackupAPI{Config: conf, RsFileMan: &RSFileManager{Config: conf, Layout: HashPrefixLayout{Levels: 1}, Storage: storage}}
+
+	body := new(bytes.Buffer)
+	multipartWriter := multipart.NewWriter(body)
+	form, _ := multipartWriter.CreateFormFile("file", "tyger")
+	form.Write(testData)
+	multipartWriter.WriteField("filename", "tyger")
+	multipartWriter.Close()
+	req := httptest.NewRequest("POST", "/submit_data", body)
+	req.Header.Add("content-type", multipartWriter.FormDataContentType())
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(api.submitDataHandler).ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Got status code %d submitting", rr.Code)
+	}
+	names, _ := storage.List("/backups/85")
+	if !reflect.DeepEqual(names, []string{"tyger", "tyger.md", "tyger.md.mirror", "tyger.parity.1"}) {
+		t.Errorf("Got stored files %v", names)
+	}
+
+	rr = httptest.NewRecorder()
+	http.HandlerFunc(api.listDataHandler).ServeHTTP(rr, httptest.NewRequest("GET", "/list_data", nil))
+	if !strings.Contains(rr.Body.String(), `"tyger"`) {
+		t.Errorf("Got listing '%s'", rr.Body.String())
+	}
+	rr = httptest.NewRecorder()
+	http.HandlerFunc(api.checkDataHandler).ServeHTTP(rr, httptest.NewRequest("GET", "/check_data/tyger", nil))
+	if !strings.Contains(rr.Body.String(), `"health":true`) {
+		t.Errorf("Got check '%s'", rr.Body.String())
+	}
+	rr = httptest.NewRecorder()
+	http.HandlerFunc(api.retrieveDataHandler).ServeHTTP(rr, httptest.NewRequest("GET", "/retrieve_data/tyger", nil))
+	if rr.Body.String() != string(testData) {
+		t.Errorf("Got retrieved contents '%s'", rr.Body.String())
+	}
+
+	rr = httptest.NewRecorder()
+	http.HandlerFunc(api.deleteHandler).ServeHTTP(rr, httptest.NewRequest("POST", "/delete/tyger", nil))
+	if rr.Code != http.StatusNoContent {
+		t.Errorf("Got status code %d deleting", rr.Code)
+	}
+	if _, err := storage.List("/backups"); !os.IsNotExist(err) {
+		t.Errorf("Files left behind after delete")
+	}
+}
+
+func TestMemoryBackendLoad(t *testing.T) {
+	m := &MemoryBackend{}
+	err := m.Load("testdata", "/backups")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected, _ := ioutil.ReadFile("testdata/tyger.md")
+	if contents, err := m.ReadFile("/backups/tyger.md"); err != nil || !bytes.Equal(contents, expected) {
+		t.Errorf("Got contents '%s' (error: %v)", contents, err)
+	}
+	m.WriteFile("/backups/tyger.md", []byte("tyger"))
+	if stat, err := m.Stat("/backups/tyger.md"); err != nil || stat.Size() != 5 {
+		t.Errorf("Got %v after writing (error: %v)", stat, err)
+	}
+	if _, err := m.ReadFile("/backups/lion"); !os.IsNotExist(err) {
+		t.Errorf("Got %v reading a missing file", err)
+	}
+}
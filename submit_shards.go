@@ -0,0 +1,177 @@
+package rsbackup
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// stagedShardsName is the name parts of a submit_shards request are stored
+// under until the request names the file.
+const stagedShardsName = "object"
+
+var parityPartName = regexp.MustCompile(`^parity\.[1-9]\d{0,2}$`)
+
+// isTrustedAgent reports whether the client may submit precomputed shards.
+func (rs *RSBackupAPI) isTrustedAgent(r *http.Request) bool {
+	token, ok := requestToken(r)
+	if !ok {
+		return rs.Tokens == nil && rs.JWTs == nil && len(rs.PasswordAuth) == 0
+	}
+	return containsString(rs.Config.TrustedAgents, token.Name)
+}
+
+// stageShardParts writes the parts of a submit_shards request into dir and
+// returns the value of the filename field.
+func stageShardParts(mr *multipart.Reader, dir string) (string, error) {
+	var fname string
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			return fname, nil
+		}
+		if err != nil {
+			return "", err
+		}
+		name := part.FormName()
+		var dst string
+		switch {
+		case name == "filename":
+			value, err := ioutil.ReadAll(io.LimitReader(part, 4096))
+			if err != nil {
+				return "", err
+			}
+			fname = string(value)
+			continue
+		case name == "data":
+			dst = stagedShardsName
+		case name == "metadata":
+			dst = stagedShardsName + ".md"
+		case parityPartName.MatchString(name):
+			dst = stagedShardsName + "." + name
+		default:
+			return "", fmt.Errorf("%w: unexpected part '%s'", errShardsInvalid, name)
+		}
+		f, err := os.OpenFile(path.Join(dir, dst), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err != nil {
+			return "", fmt.Errorf("%w: %s", errShardsInvalid, err)
+		}
+		_, err = io.Copy(f, part)
+		f.Close()
+		if err != nil {
+			return "", err
+		}
+	}
+}
+
+// submitShardsHandler accepts a file along with metadata and parity shards
+// computed by the client, following the layout described in the README.
+// Nothing is stored unless every shard matches its hash.
+func (rs *RSBackupAPI) submitShardsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		rs.Errorf(r, "Bad method %s", r.Method)
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	if !rs.isTrustedAgent(r) {
+		rs.Errorf(r, "Client is not allowed to submit precomputed shards")
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+	if maxSize := int64(rs.Config.MaxUploadSize); maxSize > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, maxSize)
+	}
+	if !rs.checkQuota(w, r, r.ContentLength) || !rs.checkDiskSpace(w, r, r.ContentLength) {
+		return
+	}
+	mr, err := r.MultipartReader()
+	if err != nil {
+		rs.Errorf(r, "Error while reading multipart form: %s", err)
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	stagingDir, err := rs.RsFileMan.stagingDir("shards")
+	if err != nil {
+		rs.Errorf(r, "Unable to stage shards: %s", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	defer os.RemoveAll(stagingDir)
+
+	fname, err := stageShardParts(mr, stagingDir)
+	auditObject(r, fname)
+	if isNoSpace(err) {
+		rs.insufficientSpace(w, r, r.ContentLength)
+		return
+	}
+	if err == nil {
+		err = validateFileName(fname)
+	}
+	if err != nil {
+		rs.Errorf(r, "Bad submit_shards request: %s", err)
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	if !rs.placeFile(w, r, fname) {
+		return
+	}
+	staged := &RSFileManager{Config: &Config{BackupRoot: stagingDir}}
+	md, err := staged.ReadMetadata(staged.DataPath(stagedShardsName))
+	if err != nil {
+		rs.Errorf(r, "Bad metadata for %s: %s", fname, err)
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	if md.ParityShards < rs.Config.ParityShards {
+		rs.Errorf(r, "Refusing %s with %d parity shards, need at least %d", fname, md.ParityShards, rs.Config.ParityShards)
+		http.Error(w, http.StatusText(http.StatusUnprocessableEntity), http.StatusUnprocessableEntity)
+		return
+	}
+
+	md, err = rs.RsFileMan.commitStaged(stagingDir, stagedShardsName, fname, requestNamespace(r))
+	if err != nil {
+		rs.Errorf(r, "Unable to store shards of %s: %s", fname, err)
+		switch {
+		case errors.Is(err, errShardsInvalid):
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		case errors.Is(err, errShardsCorrupt):
+			http.Error(w, http.StatusText(http.StatusUnprocessableEntity), http.StatusUnprocessableEntity)
+		case errors.Is(err, errFileExists):
+			http.Error(w, http.StatusText(http.StatusConflict), http.StatusConflict)
+		case isNoSpace(err):
+			rs.insufficientSpace(w, r, r.ContentLength)
+		default:
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		}
+		return
+	}
+	if !rs.chargeQuota(w, r, fname) {
+		return
+	}
+	log.Infof("Stored precomputed shards of %s", fname)
+	rs.recordHealth(fname, true)
+	rs.recordEvent(fname, eventStored, "shards")
+	rs.mirror(fname)
+
+	rsp := &submitDataRsp{
+		ID:           rs.RsFileMan.objectID(fname),
+		Size:         md.Size,
+		Hashes:       md.Hashes,
+		DataShards:   md.DataShards,
+		ParityShards: md.ParityShards,
+	}
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(rsp)
+	if err != nil {
+		rs.Errorf(r, "Unable to marshal json response: %s", err)
+	}
+}
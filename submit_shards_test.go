@@ -0,0 +1,99 @@
+package rsbackup
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// shardsRequest builds a submit_shards request from the testdata files of
+// shardName, with parts named in skip left out.
+func shardsRequest(t *testing.T, fname, shardName string, skip ...string) *http.Request {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	mw.WriteField("filename", fname)
+	parts := map[string]string{
+		"data":     "testdata/" + shardName,
+		"metadata": "testdata/" + shardName + ".md",
+		"parity.1": "testdata/" + shardName + ".parity.1",
+	}
+	for _, part := range []string{"metadata", "data", "parity.1"} {
+		skipped := false
+		for _, s := range skip {
+			skipped = skipped || s == part
+		}
+		if skipped {
+			continue
+		}
+		content, err := ioutil.ReadFile(parts[part])
+		if err != nil {
+			t.Fatal(err)
+		}
+		fw, err := mw.CreateFormFile(part, part)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fw.Write(content)
+	}
+	mw.Close()
+	req := httptest.NewRequest("POST", "/submit_shards", &body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	return req
+}
+
+func TestSubmitShardsHandler(t *testing.T) {
+	submitShardsTests := []struct {
+		name           string
+		req            func(t *testing.T) *http.Request
+		untrusted      bool
+		parityShards   int
+		expectedStatus int
+	}{
+		{"success", func(t *testing.T) *http.Request { return shardsRequest(t, "new_tyger", "tyger") }, false, 1, 200},
+		{"untrusted", func(t *testing.T) *http.Request { return shardsRequest(t, "new_tyger", "tyger") }, true, 1, 403},
+		{"missing parity", func(t *testing.T) *http.Request { return shardsRequest(t, "new_tyger", "tyger", "parity.1") }, false, 1, 400},
+		{"missing filename", func(t *testing.T) *http.Request { return shardsRequest(t, "", "tyger") }, false, 1, 400},
+		{"corrupt shard", func(t *testing.T) *http.Request { return shardsRequest(t, "new_tyger", "tyger_bad") }, false, 1, 422},
+		{"too little parity", func(t *testing.T) *http.Request { return shardsRequest(t, "new_tyger", "tyger") }, false, 2, 422},
+		{"file exists", func(t *testing.T) *http.Request { return shardsRequest(t, "tyger", "tyger") }, false, 1, 409},
+	}
+
+	for _, tt := range submitShardsTests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpDir := createTMPDir(t, "rsbackup")
+			conf := &Config{BackupRoot: tmpDir, DataShards: 2, ParityShards: 1}
+			cloneShards(t, "tyger", tmpDir, conf)
+			conf.ParityShards = tt.parityShards
+			conf.TrustedAgents = []string{"agent"}
+			api := &RSBackupAPI{Config: conf, RsFileMan: &RSFileManager{Config: conf}}
+
+			req := tt.req(t)
+			tokenName := "agent"
+			if tt.untrusted {
+				tokenName = "laptop"
+			}
+			api.Tokens = &TokenStore{}
+			req = req.WithContext(context.WithValue(req.Context(), tokenContextKey, APIToken{Name: tokenName}))
+			rr := httptest.NewRecorder()
+			http.HandlerFunc(api.submitShardsHandler).ServeHTTP(rr, req)
+
+			if rr.Code != tt.expectedStatus {
+				t.Fatalf("Got status code %d, expected %d", rr.Code, tt.expectedStatus)
+			}
+			if tt.expectedStatus != 200 {
+				return
+			}
+			health, _, _, err := api.RsFileMan.CheckData("new_tyger")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !health {
+				t.Errorf("Submitted shards are not healthy")
+			}
+		})
+	}
+}
@@ -0,0 +1,213 @@
+package rsbackup
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// errFetchForbidden refuses downloads from addresses clients may not have
+// the server reach.
+var errFetchForbidden = errors.New("Fetching from this address is not allowed")
+
+// fetchableIP reports whether submit_url may connect to ip: public
+// addresses, and internal ones in allowed.
+func fetchableIP(ip net.IP, allowed []*net.IPNet) bool {
+	if containsIP(allowed, ip) {
+		return true
+	}
+	return !(ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified())
+}
+
+// fetchClient returns the client submit_url downloads with. Its dialer
+// checks the address of every connection it makes, so names resolving to
+// internal addresses and redirects to them are refused alike.
+func (rs *RSBackupAPI) fetchClient() *http.Client {
+	allowed := mustParseNetworks(rs.Config.FetchAllowedNetworks)
+	dialer := &net.Dialer{
+		Timeout: 30 * time.Second,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || !fetchableIP(ip, allowed) {
+				return fmt.Errorf("%w: %s", errFetchForbidden, host)
+			}
+			return nil
+		},
+	}
+	return &http.Client{
+		Timeout: rs.Config.FetchTimeout,
+		// A proxy would make the connections checked those to the proxy.
+		Transport: &http.Transport{DialContext: dialer.DialContext, TLSHandshakeTimeout: 10 * time.Second},
+	}
+}
+
+// fetchURL opens the body of a remote resource for reading, and returns
+// its size, -1 if the server didn't tell. Only plain http(s) GETs answered
+// with 200 are accepted, from addresses fetchClient may connect to.
+func (rs *RSBackupAPI) fetchURL(rawURL string) (io.ReadCloser, int64, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, 0, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, 0, fmt.Errorf("Unsupported url scheme '%s'", u.Scheme)
+	}
+	client := rs.fetchClient()
+	rsp, err := client.Get(u.String())
+	if err != nil {
+		return nil, 0, err
+	}
+	if rsp.StatusCode != http.StatusOK {
+		rsp.Body.Close()
+		return nil, 0, fmt.Errorf("Remote server replied '%s'", rsp.Status)
+	}
+	if maxSize := int64(rs.Config.FetchMaxSize); maxSize > 0 && rsp.ContentLength > maxSize {
+		rsp.Body.Close()
+		return nil, 0, fmt.Errorf("Remote file is %d bytes, limit is %s", rsp.ContentLength, rs.Config.FetchMaxSize)
+	}
+	return rsp.Body, rsp.ContentLength, nil
+}
+
+// limitedReader fails reads once more than limit bytes were read, unlike
+// io.LimitReader which silently truncates.
+type limitedReader struct {
+	r     io.Reader
+	limit int64
+	read  int64
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	n, err := l.r.Read(p)
+	l.read += int64(n)
+	if l.limit > 0 && l.read > l.limit {
+		return n, fmt.Errorf("Data exceeds limit of %d bytes", l.limit)
+	}
+	return n, err
+}
+
+// submitURLHandler stores data the server downloads itself from a client
+// supplied url, optionally verifying it against a sha256 checksum.
+func (rs *RSBackupAPI) submitURLHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		rs.Errorf(r, "Bad method %s", r.Method)
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	sourceURL := r.FormValue("url")
+	if sourceURL == "" {
+		rs.Errorf(r, "Missing 'url' parameter")
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	desiredFileName := r.FormValue("filename")
+	auditObject(r, desiredFileName)
+	err := validateFileName(desiredFileName)
+	if err != nil {
+		rs.Errorf(r, "%s", err)
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	class, err := rs.storageClassParam(r)
+	if err != nil {
+		rs.Errorf(r, "%s", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	replicas, err := replicasParam(r, class)
+	if err != nil {
+		rs.Errorf(r, "%s", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !rs.placeFile(w, r, desiredFileName) {
+		return
+	}
+	// The size of the download isn't known yet.
+	if !rs.checkQuota(w, r, 0) || !rs.checkDiskSpace(w, r, 0) {
+		return
+	}
+	expectedChecksum := strings.ToLower(r.FormValue("sha256"))
+	extras := MetadataExtras{Immutable: r.FormValue("immutable") == "true", StorageClass: class, Replicas: replicas}
+	extras.ClientCipher, err = clientCipherParams(r)
+	if err == nil {
+		extras.Attributes, err = fileAttributesParams(r)
+	}
+	if err == nil {
+		extras.RetainUntil, err = retainUntilParam(r)
+	}
+	if err == nil {
+		extras.Archive, err = archiveParam(r)
+	}
+	if err == nil {
+		extras.Labels, err = labelsParam(r)
+	}
+	if err == nil {
+		extras.UserMetadata, err = userMetadataParams(r)
+	}
+	if err != nil {
+		rs.Errorf(r, "%s", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	log.Debugf("Fetching %s from %s", desiredFileName, sourceURL)
+	body, size, err := rs.fetchURL(sourceURL)
+	if err != nil {
+		rs.Errorf(r, "Unable to fetch %s: %s", sourceURL, err)
+		http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+		return
+	}
+	defer body.Close()
+	var stored int64
+	if size > 0 {
+		stored = rs.storedEstimate(size)
+		if !rs.checkQuota(w, r, stored) || !rs.checkDiskSpace(w, r, stored) {
+			return
+		}
+	}
+	hasher := sha256.New()
+	src := io.TeeReader(&limitedReader{r: body, limit: int64(rs.Config.FetchMaxSize)}, hasher)
+	entry, err := rs.RsFileMan.Journal.begin(opStore, desiredFileName, "")
+	if err != nil {
+		rs.Errorf(r, "Unable to journal submit of %s: %s", desiredFileName, err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	defer rs.RsFileMan.Journal.end(entry)
+	dataFilePath, err := rs.RsFileMan.SaveFile(src, desiredFileName, &extras)
+	if isNoSpace(err) {
+		rs.insufficientSpace(w, r, stored)
+		return
+	}
+	if errors.Is(err, errBadArchive) {
+		rs.Errorf(r, "Unable to index %s from %s: %s", desiredFileName, sourceURL, err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		rs.Errorf(r, "Unable to save file %s from %s: %s", desiredFileName, sourceURL, err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	if checksum := hex.EncodeToString(hasher.Sum(nil)); expectedChecksum != "" && checksum != expectedChecksum {
+		rs.RsFileMan.discardSaved(dataFilePath, extras)
+		rs.Errorf(r, "Checksum mismatch for %s: got %s, expected %s", sourceURL, checksum, expectedChecksum)
+		http.Error(w, http.StatusText(http.StatusUnprocessableEntity), http.StatusUnprocessableEntity)
+		return
+	}
+	rs.protectData(w, r, desiredFileName, dataFilePath, extras, nil)
+}
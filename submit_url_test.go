@@ -0,0 +1,122 @@
+package rsbackup
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSubmitURLHandler(t *testing.T) {
+	remote := httptest.NewServer(http.FileServer(http.Dir("testdata")))
+	defer remote.Close()
+	testData, err := ioutil.ReadFile("testdata/tyger")
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest := sha256.Sum256(testData)
+	checksum := hex.EncodeToString(digest[:])
+
+	submitURLTests := []struct {
+		name           string
+		method         string
+		form           url.Values
+		maxSize        Size
+		expectedStatus int
+		expectedRsp    string
+	}{
+		{"bad method", "GET", url.Values{}, 0, 405, "Method Not Allowed"},
+		{"missing url", "POST", url.Values{"filename": {"tyger"}}, 0, 400, "Bad Request"},
+		{"bad filename", "POST", url.Values{"url": {remote.URL + "/tyger"}, "filename": {"ty/ger"}}, 0, 400, "Bad Request"},
+		{"bad scheme", "POST", url.Values{"url": {"file:///etc/passwd"}, "filename": {"tyger"}}, 0, 502, "Bad Gateway"},
+		{"remote not found", "POST", url.Values{"url": {remote.URL + "/lion"}, "filename": {"tyger"}}, 0, 502, "Bad Gateway"},
+		{"too large", "POST", url.Values{"url": {remote.URL + "/tyger"}, "filename": {"tyger"}}, 100, 502, "Bad Gateway"},
+		{"unknown storage class", "POST", url.Values{"url": {remote.URL + "/tyger"}, "filename": {"tyger"}, "storage_class": {"gold"}}, 0, 400, "Unknown storage class 'gold'"},
+		{"checksum mismatch", "POST", url.Values{"url": {remote.URL + "/tyger"}, "filename": {"tyger"}, "sha256": {"abcd"}}, 0, 422, "Unprocessable Entity"},
+		{"success", "POST", url.Values{"url": {remote.URL + "/tyger"}, "filename": {"tyger"}, "sha256": {checksum}}, 0, 200, `{"id":"<id>","size":808,"hashes":["aa8b8979f1486fe03d54d1bdd4a32018386285a2ad0dc9a2820f0da3d6293e72","64163fa75b3eadb78f376dd7ab84e48595e9748dadbfb50e2126bef20481baa1","e32a8903342ab6dc68d46462df727f6812f6fbb728c4a1240b625331b811c147"],"data_shards":2,"parity_shards":1}`},
+	}
+
+	for _, tt := range submitURLTests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpDir := createTMPDir(t, "rsbackup")
+			config := &Config{
+				BackupRoot:   tmpDir,
+				DataShards:   2,
+				ParityShards: 1,
+				FetchTimeout: time.Minute,
+				FetchMaxSize: tt.maxSize,
+				// The test server listens on loopback.
+				FetchAllowedNetworks: []string{"127.0.0.1"},
+			}
+			api := &RSBackupAPI{
+				Config:    config,
+				RsFileMan: &RSFileManager{Config: config},
+			}
+
+			req := httptest.NewRequest(tt.method, "/submit_url", strings.NewReader(tt.form.Encode()))
+			req.Header.Set("content-type", "application/x-www-form-urlencoded")
+			rr := httptest.NewRecorder()
+			http.HandlerFunc(api.submitURLHandler).ServeHTTP(rr, req)
+
+			if rr.Code != tt.expectedStatus {
+				t.Errorf("Got status code %d, expected %d", rr.Code, tt.expectedStatus)
+			}
+			// IDs are random.
+			rspBody := objectIDField.ReplaceAllString(strings.TrimSuffix(rr.Body.String(), "\n"), `"id":"<id>"`)
+			if rspBody != tt.expectedRsp {
+				t.Errorf("Got rsp body '%s', expected '%s'", rspBody, tt.expectedRsp)
+			}
+			_, err := os.Stat(path.Join(tmpDir, "tyger"))
+			if stored := err == nil; stored != (tt.expectedStatus == 200) {
+				t.Errorf("Data file stored: %t, expected %t", stored, tt.expectedStatus == 200)
+			}
+		})
+	}
+}
+
+func TestFetchURLRefusesInternalAddresses(t *testing.T) {
+	remote := httptest.NewServer(http.FileServer(http.Dir("testdata")))
+	defer remote.Close()
+	redirector := httptest.NewServer(http.RedirectHandler("http://10.0.0.1/", http.StatusFound))
+	defer redirector.Close()
+	_, port, _ := net.SplitHostPort(strings.TrimPrefix(remote.URL, "http://"))
+
+	tests := []struct {
+		name    string
+		url     string
+		allowed []string
+		ok      bool
+	}{
+		{"loopback", remote.URL + "/tyger", nil, false},
+		{"loopback name", "http://localhost:" + port + "/tyger", nil, false},
+		{"metadata service", "http://169.254.169.254/latest/meta-data/", nil, false},
+		{"private", "http://10.0.0.1/", nil, false},
+		{"allowed", remote.URL + "/tyger", []string{"127.0.0.0/8"}, true},
+		{"redirect to private", redirector.URL, []string{"127.0.0.0/8"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := &Config{FetchTimeout: 5 * time.Second, FetchAllowedNetworks: tt.allowed}
+			api := &RSBackupAPI{Config: config}
+			body, _, err := api.fetchURL(tt.url)
+			if body != nil {
+				body.Close()
+			}
+			if tt.ok && err != nil {
+				t.Errorf("Got error %v", err)
+			}
+			if !tt.ok && !errors.Is(err, errFetchForbidden) {
+				t.Errorf("Got error %v, expected %v", err, errFetchForbidden)
+			}
+		})
+	}
+}
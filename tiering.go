@@ -0,0 +1,403 @@
+package rsbackup
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	tierCold = "cold"
+	// tieringInterval is the time between looks for files to move to the
+	// cold tier.
+	tieringInterval = time.Hour
+	// Access times are only recorded once an hour per file, so retrievals
+	// don't all write the state file.
+	accessResolution = time.Hour
+)
+
+// TieredBackend keeps files on a hot backend until they are moved to a
+// cold one, StorageTarget Config.ColdTarget, once untouched for
+// Config.ColdAfter. Files are looked for on the hot backend first, then
+// on the cold one, and new files always go to the hot one. When each
+// file was last retrieved is recorded in a json file.
+type TieredBackend struct {
+	hot  StorageBackend
+	cold StorageBackend
+
+	mu       sync.Mutex
+	path     string
+	accessed map[string]time.Time
+}
+
+// NewTieredBackend sets up the cold storage target of config in front of
+// hot, which is the local disk if nil.
+func NewTieredBackend(config *Config, hot StorageBackend) (*TieredBackend, error) {
+	if hot == nil {
+		local, err := NewOSBackend(config)
+		if err != nil {
+			return nil, err
+		}
+		hot = local
+	}
+	cold, err := openStorageTarget(config, config.StorageTargets[config.ColdTarget])
+	if err != nil {
+		return nil, fmt.Errorf("Unable to set up cold storage target '%s': %s", config.ColdTarget, err)
+	}
+	return newTieredBackend(config.StatePath("tiering.json"), hot, cold)
+}
+
+func newTieredBackend(statePath string, hot, cold StorageBackend) (*TieredBackend, error) {
+	t := &TieredBackend{
+		hot:      hot,
+		cold:     cold,
+		path:     statePath,
+		accessed: make(map[string]time.Time),
+	}
+	err := readJSONState(statePath, &t.accessed)
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// locate returns the backend holding fpath.
+func (t *TieredBackend) locate(fpath string) (StorageBackend, error) {
+	_, err := t.hot.Stat(fpath)
+	if err == nil || !os.IsNotExist(err) {
+		return t.hot, err
+	}
+	if _, err := t.cold.Stat(fpath); err == nil {
+		return t.cold, nil
+	}
+	return nil, &os.PathError{Op: "stat", Path: fpath, Err: os.ErrNotExist}
+}
+
+func (t *TieredBackend) Open(fpath string) (StorageFile, error) {
+	backend, err := t.locate(fpath)
+	if err != nil {
+		return nil, err
+	}
+	return backend.Open(fpath)
+}
+
+func (t *TieredBackend) OpenWritable(fpath string) (StorageFile, error) {
+	backend, err := t.locate(fpath)
+	if err != nil {
+		return nil, err
+	}
+	return backend.OpenWritable(fpath)
+}
+
+// CreateExclusive creates fpath on the hot backend. It fails if either
+// backend has fpath already.
+func (t *TieredBackend) CreateExclusive(fpath string) (StorageFile, error) {
+	if _, err := t.locate(fpath); err == nil {
+		return nil, &os.PathError{Op: "open", Path: fpath, Err: os.ErrExist}
+	}
+	return t.hot.CreateExclusive(fpath)
+}
+
+// List merges the entries of dir on both backends.
+func (t *TieredBackend) List(dir string) ([]string, error) {
+	return listAll(dir, t.hot, t.cold)
+}
+
+func (t *TieredBackend) Stat(fpath string) (os.FileInfo, error) {
+	backend, err := t.locate(fpath)
+	if err != nil {
+		return nil, err
+	}
+	return backend.Stat(fpath)
+}
+
+// Remove removes fpath from both backends, a move between them cut short
+// leaves it on both.
+func (t *TieredBackend) Remove(fpath string) error {
+	found := false
+	for _, backend := range []StorageBackend{t.hot, t.cold} {
+		err := backend.Remove(fpath)
+		if err == nil {
+			found = true
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if !found {
+		return &os.PathError{Op: "remove", Path: fpath, Err: os.ErrNotExist}
+	}
+	return nil
+}
+
+// Rename renames from on the backends holding it, without moving it
+// between them. A to on the other backend is removed, so it doesn't
+// show through.
+func (t *TieredBackend) Rename(from, to string) error {
+	backends := []StorageBackend{t.hot, t.cold}
+	holding := make([]bool, len(backends))
+	found := false
+	for i, backend := range backends {
+		if _, err := backend.Stat(from); err == nil {
+			holding[i], found = true, true
+		}
+	}
+	if !found {
+		return &os.LinkError{Op: "rename", Old: from, New: to, Err: os.ErrNotExist}
+	}
+	for i, backend := range backends {
+		var err error
+		if holding[i] {
+			err = backend.Rename(from, to)
+		} else if err = backend.Remove(to); os.IsNotExist(err) {
+			err = nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Touch records that fname was just retrieved.
+func (t *TieredBackend) Touch(fname string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now()
+	if now.Sub(t.accessed[fname]) < accessResolution {
+		return nil
+	}
+	t.accessed[fname] = now
+	return writeJSONState(t.path, t.accessed)
+}
+
+// Move carries when from was last retrieved over to to, after a rename.
+func (t *TieredBackend) Move(from, to string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	accessed, ok := t.accessed[from]
+	delete(t.accessed, from)
+	delete(t.accessed, to)
+	if ok {
+		t.accessed[to] = accessed
+	}
+	return writeJSONState(t.path, t.accessed)
+}
+
+// Forget drops when fname was last retrieved, after it was deleted.
+func (t *TieredBackend) Forget(fname string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.accessed[fname]; !ok {
+		return nil
+	}
+	delete(t.accessed, fname)
+	return writeJSONState(t.path, t.accessed)
+}
+
+func (t *TieredBackend) lastAccess(fname string) time.Time {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.accessed[fname]
+}
+
+// copyObject copies fpath from src to dst, replacing what dst has there.
+func copyObject(src, dst StorageBackend, fpath string) (int64, error) {
+	if err := dst.Remove(fpath); err != nil && !os.IsNotExist(err) {
+		return 0, err
+	}
+	in, err := src.Open(fpath)
+	if err != nil {
+		return 0, err
+	}
+	defer in.Close()
+	out, err := dst.CreateExclusive(fpath)
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(out, in)
+	if err == nil {
+		err = out.Sync()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		dst.Remove(fpath)
+	}
+	return n, err
+}
+
+// moveObjects moves the data and parity files of the data file at fpath
+// from src to dst, recording tier in its metadata once copied. The
+// metadata stays where it is, as do shards src doesn't have, like those
+// repaired in the meantime. It returns the number of bytes copied.
+func (r *RSFileManager) moveObjects(src, dst StorageBackend, fpath string, md *storedMetadata, tier string) (int64, error) {
+	var suffixes []string
+	for _, suffix := range objectSuffixes(r.storage(), fpath) {
+		if suffix != ".md" && suffix != metadataMirrorSuffix {
+			suffixes = append(suffixes, suffix)
+		}
+	}
+	var copied int64
+	for _, suffix := range suffixes {
+		if _, err := src.Stat(fpath + suffix); os.IsNotExist(err) {
+			continue
+		}
+		n, err := copyObject(src, dst, fpath+suffix)
+		if err != nil {
+			return copied, err
+		}
+		copied += n
+	}
+	md.Tier = tier
+	err := r.replaceMetadata(fpath, md)
+	if err != nil {
+		return copied, err
+	}
+	for _, suffix := range suffixes {
+		if err := src.Remove(fpath + suffix); err != nil && !os.IsNotExist(err) {
+			return copied, err
+		}
+	}
+	return copied, nil
+}
+
+// freezeFile moves fname to the cold tier if it wasn't retrieved or
+// stored for after before now. Packed and deduplicated files share their
+// contents with other files, they stay hot. It returns the number of
+// bytes moved.
+func (rs *RSBackupAPI) freezeFile(fname string, now time.Time, after time.Duration) (int64, error) {
+	fm := rs.RsFileMan
+	t := rs.Tiering
+	fpath := fm.DataPath(fname)
+	renameMu.Lock()
+	defer renameMu.Unlock()
+	md, err := fm.readStoredMetadata(fpath)
+	if os.IsNotExist(err) {
+		// Removed since the listing.
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	if md.Tier == tierCold || md.Packed != nil || md.Dedup != nil {
+		return 0, nil
+	}
+	touched, err := rs.lastTouched(fname, md.MetadataExtras)
+	if err != nil {
+		return 0, err
+	}
+	if now.Sub(touched) < after {
+		return 0, nil
+	}
+	log.Infof("Moving %s to the cold tier, untouched since %s", fname, touched.Format(time.RFC3339))
+	return fm.moveObjects(t.hot, t.cold, fpath, md, tierCold)
+}
+
+// lastTouched returns when fname, with extras in its metadata, was last
+// stored or retrieved.
+func (rs *RSBackupAPI) lastTouched(fname string, extras MetadataExtras) (time.Time, error) {
+	touched := rs.Tiering.lastAccess(fname)
+	storedAt, err := rs.RsFileMan.storedAt(rs.RsFileMan.DataPath(fname), extras)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if storedAt.After(touched) {
+		touched = storedAt
+	}
+	return touched, nil
+}
+
+// tierFiles moves the files untouched for Config.ColdAfter before now to
+// the cold tier, paced to the scrub read rate. Closing stop ends it
+// early.
+func (rs *RSBackupAPI) tierFiles(job *jobProgress, stop <-chan struct{}, now time.Time) error {
+	names, err := rs.RsFileMan.ListData()
+	if err != nil {
+		return err
+	}
+	job.setTotal(len(names))
+	for _, fname := range names {
+		select {
+		case <-stop:
+			return nil
+		default:
+		}
+		moved, err := rs.freezeFile(fname, now, rs.Config.ColdAfter)
+		if err != nil {
+			log.Warnf("Tiering couldn't move %s, continuing: %s", fname, err)
+		}
+		job.done(fname, err)
+		rs.background().throttle.pay(moved, stop)
+	}
+	return nil
+}
+
+// recall moves fname back to the hot tier if it's cold, and records that
+// it was retrieved. Failing to move it only costs a slower retrieval, so
+// that is just logged.
+func (rs *RSBackupAPI) recall(fname string) {
+	if rs.Tiering == nil {
+		return
+	}
+	t := rs.Tiering
+	if err := t.Touch(fname); err != nil {
+		log.Errorf("Unable to record retrieval of %s: %s", fname, err)
+	}
+	fm := rs.RsFileMan
+	fpath := fm.DataPath(fname)
+	if extras, err := fm.ReadExtras(fpath); err != nil || extras.Tier != tierCold {
+		return
+	}
+	renameMu.Lock()
+	defer renameMu.Unlock()
+	md, err := fm.readStoredMetadata(fpath)
+	if err != nil || md.Tier != tierCold {
+		return
+	}
+	log.Infof("Recalling %s from the cold tier", fname)
+	_, err = fm.moveObjects(t.cold, t.hot, fpath, md, "")
+	if err != nil {
+		log.Warnf("Unable to recall %s from the cold tier, serving it from there: %s", fname, err)
+	}
+}
+
+// StartTiering moves the files untouched for Config.ColdAfter to the cold
+// tier every hour until the server is stopped.
+func (rs *RSBackupAPI) StartTiering() {
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	tier := func(job *jobProgress, stop <-chan struct{}) error {
+		return rs.tierFiles(job, stop, time.Now())
+	}
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(tieringInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+			_, err := rs.background().jobs.start("tier", tier)
+			if err != nil {
+				log.Warnf("Skipping tiering: %s", err)
+			}
+		}
+	}()
+	rs.OnShutdown("tiering", func(ctx context.Context) error {
+		close(stop)
+		select {
+		case <-done:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	})
+}
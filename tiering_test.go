@@ -0,0 +1,113 @@
+package rsbackup
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestTiering(t *testing.T) {
+	tmpDir := createTMPDir(t, "rsbackup")
+	coldDir := createTMPDir(t, "rsbackup-cold")
+	config := &Config{BackupRoot: tmpDir, DataShards: 2, ParityShards: 1, ColdAfter: 24 * time.Hour}
+	cold, err := NewMultiDiskBackend(tmpDir, []string{coldDir}, OSBackend{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tiering, err := newTieredBackend(config.StatePath("tiering.json"), OSBackend{}, cold)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fm := &RSFileManager{Config: config, Storage: tiering}
+	api := &RSBackupAPI{Config: config, RsFileMan: fm, Tiering: tiering}
+	contents := map[string][]byte{
+		"old": bytes.Repeat([]byte("old"), 100),
+		"new": bytes.Repeat([]byte("new"), 100),
+	}
+	for fname, data := range contents {
+		submitData(t, api, fname, data)
+	}
+	tiering.accessed["new"] = time.Now().Add(2 * time.Hour)
+
+	tier := func(after time.Duration) {
+		job, err := api.background().jobs.start("tier", func(job *jobProgress, stop <-chan struct{}) error {
+			return api.tierFiles(job, stop, time.Now().Add(after))
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if job = waitForJob(t, api, job.ID); job.State != jobDone || len(job.Failed) != 0 {
+			t.Fatalf("Got job %+v", job)
+		}
+	}
+	isCold := func(fname string) bool {
+		cold := true
+		for _, suffix := range []string{"", ".parity.1"} {
+			_, hotErr := os.Stat(fm.DataPath(fname) + suffix)
+			_, coldErr := os.Stat(path.Join(coldDir, fname+suffix))
+			if os.IsNotExist(hotErr) == os.IsNotExist(coldErr) {
+				t.Errorf("%s%s is on both tiers or neither (%v, %v)", fname, suffix, hotErr, coldErr)
+			}
+			cold = cold && coldErr == nil
+		}
+		extras, err := fm.ReadExtras(fm.DataPath(fname))
+		if err != nil || (extras.Tier == tierCold) != cold {
+			t.Errorf("Got tier '%s' for %s (error: %v)", extras.Tier, fname, err)
+		}
+		return cold
+	}
+	retrieve := func(fname string) {
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(api.retrieveDataHandler).ServeHTTP(rr, httptest.NewRequest("GET", "/retrieve_data/"+fname, nil))
+		if !bytes.Equal(rr.Body.Bytes(), contents[fname]) {
+			t.Errorf("Got status code %d and %q retrieving %s", rr.Code, rr.Body.Bytes(), fname)
+		}
+	}
+
+	tier(25 * time.Hour)
+	if !isCold("old") || isCold("new") {
+		t.Fatalf("Only the untouched file should be cold")
+	}
+	if _, err := os.Stat(fm.DataPath("old") + ".md"); err != nil {
+		t.Errorf("Metadata left the hot tier: %s", err)
+	}
+	if names, err := fm.ListData(); err != nil || len(names) != 2 {
+		t.Errorf("Got names %v (error: %v)", names, err)
+	}
+	if health, _, _, err := fm.CheckData("old"); err != nil || !health {
+		t.Errorf("Got health %t for a cold file (error: %v)", health, err)
+	}
+
+	// Cold files are renamed where they are and recalled when retrieved.
+	if err := fm.Rename("old", "older"); err != nil {
+		t.Fatal(err)
+	}
+	contents["older"] = contents["old"]
+	if !isCold("older") {
+		t.Errorf("Renaming moved a cold file")
+	}
+	retrieve("older")
+	if isCold("older") {
+		t.Errorf("Retrieving didn't recall the file")
+	}
+	tier(23 * time.Hour)
+	if isCold("older") {
+		t.Errorf("A file retrieved just now went cold")
+	}
+
+	// Deleting removes cold files from the cold tier.
+	tier(25 * time.Hour)
+	if !isCold("older") {
+		t.Fatalf("File didn't go cold again")
+	}
+	if err := fm.Delete("older", false, false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path.Join(coldDir, "older")); !os.IsNotExist(err) {
+		t.Errorf("Got %v stating a deleted cold file", err)
+	}
+}
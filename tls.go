@@ -0,0 +1,81 @@
+package rsbackup
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// certWatchInterval is how often certificate files are checked for
+// changes.
+const certWatchInterval = 10 * time.Second
+
+var tlsVersions = map[string]uint16{
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+var tlsCurves = map[string]tls.CurveID{
+	"X25519": tls.X25519,
+	"P256":   tls.CurveP256,
+	"P384":   tls.CurveP384,
+	"P521":   tls.CurveP521,
+}
+
+// tlsConfig returns the TLS settings of the server, without certificates.
+func (c *Config) tlsConfig() (*tls.Config, error) {
+	conf := &tls.Config{MinVersion: tls.VersionTLS12}
+	if c.TLSMinVersion != "" {
+		version, ok := tlsVersions[c.TLSMinVersion]
+		if !ok {
+			return nil, fmt.Errorf("TLSMinVersion must be 1.2 or 1.3, got '%s'", c.TLSMinVersion)
+		}
+		conf.MinVersion = version
+	}
+	if len(c.TLSCipherSuites) > 0 {
+		// Only suites without known weaknesses may be picked.
+		known := make(map[string]uint16)
+		for _, suite := range tls.CipherSuites() {
+			known[suite.Name] = suite.ID
+		}
+		for _, name := range c.TLSCipherSuites {
+			id, ok := known[name]
+			if !ok {
+				return nil, fmt.Errorf("Unknown or insecure cipher suite '%s'", name)
+			}
+			conf.CipherSuites = append(conf.CipherSuites, id)
+		}
+	}
+	for _, name := range c.TLSCurves {
+		id, ok := tlsCurves[name]
+		if !ok {
+			return nil, fmt.Errorf("Unknown curve '%s', use X25519, P256, P384 or P521", name)
+		}
+		conf.CurvePreferences = append(conf.CurvePreferences, id)
+	}
+	return conf, nil
+}
+
+// securityHeaders sets headers telling clients to stick to HTTPS and not
+// to render or embed responses, which are data, never pages.
+func (rs *RSBackupAPI) securityHeaders(next http.Handler) http.Handler {
+	var hsts string
+	if rs.Config.HSTSMaxAge > 0 {
+		hsts = fmt.Sprintf("max-age=%d", int64(rs.Config.HSTSMaxAge.Seconds()))
+		if rs.Config.HSTSIncludeSubdomains {
+			hsts += "; includeSubDomains"
+		}
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h := w.Header()
+		if hsts != "" {
+			h.Set("Strict-Transport-Security", hsts)
+		}
+		h.Set("X-Content-Type-Options", "nosniff")
+		h.Set("X-Frame-Options", "DENY")
+		h.Set("Content-Security-Policy", "default-src 'none'; frame-ancestors 'none'")
+		h.Set("Referrer-Policy", "no-referrer")
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,173 @@
+package rsbackup
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+// writeSelfSignedCert writes a certificate for 127.0.0.1 and its key into
+// dir and returns their paths along with a pool trusting the certificate.
+func writeSelfSignedCert(t *testing.T, dir string) (string, string, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "rsbackup integration test"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPath := path.Join(dir, "cert.pem")
+	keyPath := path.Join(dir, "key.pem")
+	err = ioutil.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return certPath, keyPath, pool
+}
+
+func TestTLSConfig(t *testing.T) {
+	configTests := []struct {
+		name        string
+		config      Config
+		expectedErr bool
+	}{
+		{"defaults", Config{}, false},
+		{"tls 1.3", Config{TLSMinVersion: "1.3"}, false},
+		{"tls 1.1", Config{TLSMinVersion: "1.1"}, true},
+		{"suites", Config{TLSCipherSuites: []string{"TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384"}}, false},
+		{"insecure suite", Config{TLSCipherSuites: []string{"TLS_RSA_WITH_RC4_128_SHA"}}, true},
+		{"curves", Config{TLSCurves: []string{"X25519", "P256"}}, false},
+		{"unknown curve", Config{TLSCurves: []string{"P192"}}, true},
+	}
+	for _, tt := range configTests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf, err := tt.config.tlsConfig()
+			if (err != nil) != tt.expectedErr {
+				t.Fatalf("Got error %v", err)
+			}
+			if err == nil && conf.MinVersion < tls.VersionTLS12 {
+				t.Errorf("Got min version %#x", conf.MinVersion)
+			}
+		})
+	}
+	conf, _ := (&Config{TLSMinVersion: "1.3", TLSCurves: []string{"P384", "X25519"}}).tlsConfig()
+	if conf.MinVersion != tls.VersionTLS13 || len(conf.CurvePreferences) != 2 || conf.CurvePreferences[0] != tls.CurveP384 {
+		t.Errorf("Got min version %#x and curves %v", conf.MinVersion, conf.CurvePreferences)
+	}
+}
+
+func TestSecurityHeaders(t *testing.T) {
+	api := &RSBackupAPI{Config: &Config{HSTSMaxAge: 365 * 24 * time.Hour, HSTSIncludeSubdomains: true}}
+	handler := api.securityHeaders(http.NotFoundHandler())
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("GET", "/retrieve_data/missing", nil))
+	expected := map[string]string{
+		"Strict-Transport-Security": "max-age=31536000; includeSubDomains",
+		"X-Content-Type-Options":    "nosniff",
+		"X-Frame-Options":           "DENY",
+	}
+	for name, value := range expected {
+		if got := rr.Header().Get(name); got != value {
+			t.Errorf("Got %s '%s', expected '%s'", name, got, value)
+		}
+	}
+
+	api.Config.HSTSMaxAge = 0
+	rr = httptest.NewRecorder()
+	api.securityHeaders(http.NotFoundHandler()).ServeHTTP(rr, httptest.NewRequest("GET", "/", nil))
+	if rr.Header().Get("Strict-Transport-Security") != "" || rr.Header().Get("X-Content-Type-Options") == "" {
+		t.Errorf("Got headers %v without HSTS", rr.Header())
+	}
+}
+
+func TestCertificateReload(t *testing.T) {
+	tmpDir := createTMPDir(t, "rsbackup")
+	certPath, keyPath, _ := writeSelfSignedCert(t, tmpDir)
+	certs, err := newCertStore(nil, certPath, keyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, _ := certs.GetCertificate(nil)
+	if changed, err := certs.reloadIfChanged(); changed || err != nil {
+		t.Errorf("Reloaded unchanged files: %v", err)
+	}
+
+	// Renewal tooling may replace the files within the timestamp
+	// resolution, so move their times along explicitly.
+	touch := func(fpath string, age time.Duration) {
+		stamp := time.Now().Add(age)
+		os.Chtimes(fpath, stamp, stamp)
+	}
+	keyPEM, _ := ioutil.ReadFile(keyPath)
+	ioutil.WriteFile(keyPath, []byte("half written"), 0600)
+	touch(keyPath, time.Minute)
+	if changed, err := certs.reloadIfChanged(); !changed || err == nil {
+		t.Errorf("Got %t, %v for a broken key", changed, err)
+	}
+	if current, _ := certs.GetCertificate(nil); current != first {
+		t.Errorf("Broken key replaced the certificate")
+	}
+	if changed, _ := certs.reloadIfChanged(); changed {
+		t.Errorf("Retried the broken key before it changed")
+	}
+	ioutil.WriteFile(keyPath, keyPEM, 0600)
+	touch(keyPath, 2*time.Minute)
+
+	writeSelfSignedCert(t, tmpDir)
+	touch(certPath, 3*time.Minute)
+	touch(keyPath, 3*time.Minute)
+	if changed, err := certs.reloadIfChanged(); !changed || err != nil {
+		t.Fatalf("Got %t, %v for a renewed certificate", changed, err)
+	}
+	if current, _ := certs.GetCertificate(nil); current == first {
+		t.Errorf("Renewed certificate wasn't loaded")
+	}
+
+	api := &RSBackupAPI{certs: certs}
+	renewed, _ := certs.GetCertificate(nil)
+	if err := api.ReloadCertificate(); err != nil {
+		t.Fatal(err)
+	}
+	if current, _ := certs.GetCertificate(nil); current == renewed {
+		t.Errorf("Explicit reload kept the old certificate")
+	}
+}
@@ -0,0 +1,353 @@
+package rsbackup
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// trashPurgeInterval is how often files past the grace period are purged
+// from the trash.
+const trashPurgeInterval = time.Hour
+
+var errNotInTrash = errors.New("Not in the trash")
+
+// MoveOut moves the data, parity and metadata files of fname to dst, the
+// data file first, so fname isn't listed while it's half gone. Like
+// Delete, it refuses to move locked files unless override is set.
+func (r *RSFileManager) MoveOut(fname, dst string, override bool) error {
+	renameMu.Lock()
+	defer renameMu.Unlock()
+	fpath := r.DataPath(fname)
+	_, err := r.storage().Stat(fpath)
+	if err != nil {
+		return err
+	}
+	err = r.checkMutable(fpath, override)
+	if err != nil {
+		return err
+	}
+	suffixes := objectSuffixes(r.storage(), fpath)
+	for i := len(suffixes) - 1; i >= 0; i-- {
+		err = r.storage().Rename(fpath+suffixes[i], dst+suffixes[i])
+		if err != nil {
+			return fmt.Errorf("Cannot move '%s' out: %w", fname, err)
+		}
+	}
+	r.unindex(fname)
+	return nil
+}
+
+// MoveIn stores the data file at src, along with its parity and metadata,
+// as fname. The data file goes last, so fname is only listed once it's
+// complete.
+func (r *RSFileManager) MoveIn(src, fname string) error {
+	renameMu.Lock()
+	defer renameMu.Unlock()
+	dstPath := r.DataPath(fname)
+	if _, err := r.storage().Stat(dstPath); err == nil {
+		return errFileExists
+	}
+	for _, suffix := range objectSuffixes(r.storage(), src) {
+		err := r.storage().Rename(src+suffix, dstPath+suffix)
+		if err != nil {
+			return fmt.Errorf("Cannot move in '%s': %w", fname, err)
+		}
+	}
+	r.reindex(fname)
+	return nil
+}
+
+// TrashEntry is a deleted file waiting in the trash.
+type TrashEntry struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	DeletedAt time.Time `json:"deleted_at"`
+	By        string    `json:"by,omitempty"`
+	Size      int64     `json:"size"`
+}
+
+// Trash keeps deleted files for Config.TrashRetention, so they can still
+// be restored. Each file is moved to a directory of its own in the state
+// directory, in the storage of the file manager it came from, and the
+// entries are persisted in a json file.
+type Trash struct {
+	mu      sync.Mutex
+	path    string
+	dir     string
+	config  *Config
+	entries map[string]TrashEntry
+}
+
+func NewTrash(fpath string, config *Config) (*Trash, error) {
+	t := &Trash{
+		path:    fpath,
+		dir:     config.StatePath("trash"),
+		config:  config,
+		entries: make(map[string]TrashEntry),
+	}
+	err := readJSONState(fpath, &t.entries)
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func (t *Trash) dataPath(id string) string {
+	return path.Join(t.dir, id, "data")
+}
+
+// remove deletes the files of id from fm, along with its directory.
+func (t *Trash) remove(fm *RSFileManager, id string) error {
+	storage := fm.storage()
+	fpath := t.dataPath(id)
+	shared, err := fm.readShared(fpath)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	suffixes := objectSuffixes(storage, fpath)
+	for i := len(suffixes) - 1; i >= 0; i-- {
+		err := storage.Remove(fpath + suffixes[i])
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	fm.releaseShared(shared, false)
+	// Only OSBackend leaves the emptied directory behind.
+	return os.RemoveAll(path.Join(t.dir, id))
+}
+
+// Put moves fname from fm to the trash.
+func (t *Trash) Put(fm *RSFileManager, fname, by string, override bool) (TrashEntry, error) {
+	id, err := generateToken()
+	if err != nil {
+		return TrashEntry{}, err
+	}
+	id = id[:16]
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	err = fm.MoveOut(fname, t.dataPath(id), override)
+	if err != nil {
+		t.remove(fm, id)
+		return TrashEntry{}, err
+	}
+	entry := TrashEntry{ID: id, Name: fname, DeletedAt: time.Now().UTC(), By: by, Size: storedSize(fm.storage(), t.dataPath(id))}
+	t.entries[id] = entry
+	err = writeJSONState(t.path, t.entries)
+	if err != nil {
+		delete(t.entries, id)
+		// Untracked files would never be purged, so put the file back.
+		if err := fm.MoveIn(t.dataPath(id), fname); err != nil {
+			log.Errorf("Unable to move %s back from the trash, it's left in %s: %s", fname, t.dataPath(id), err)
+		}
+		return TrashEntry{}, err
+	}
+	return entry, nil
+}
+
+// Get returns the entry of id.
+func (t *Trash) Get(id string) (TrashEntry, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	entry, ok := t.entries[id]
+	return entry, ok
+}
+
+// List returns the files in the trash, the most recently deleted first.
+func (t *Trash) List() []TrashEntry {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	entries := make([]TrashEntry, 0, len(t.entries))
+	for _, entry := range t.entries {
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].DeletedAt.After(entries[j].DeletedAt) })
+	return entries
+}
+
+// Restore moves the file of id from the trash back into fm as fname.
+func (t *Trash) Restore(fm *RSFileManager, id, fname string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.entries[id]; !ok {
+		return errNotInTrash
+	}
+	err := fm.MoveIn(t.dataPath(id), fname)
+	if err != nil {
+		return err
+	}
+	entry := t.entries[id]
+	delete(t.entries, id)
+	err = writeJSONState(t.path, t.entries)
+	if err != nil {
+		t.entries[id] = entry
+		return err
+	}
+	return t.remove(fm, id)
+}
+
+// Purge removes the files deleted more than Config.TrashRetention before
+// now from fm for good. It returns the number of files removed.
+func (t *Trash) Purge(fm *RSFileManager, now time.Time) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	purged := 0
+	for id, entry := range t.entries {
+		if now.Sub(entry.DeletedAt) < t.config.TrashRetention {
+			continue
+		}
+		err := t.remove(fm, id)
+		if err != nil {
+			log.Errorf("Unable to purge %s (%s) from the trash: %s", entry.Name, id, err)
+			continue
+		}
+		delete(t.entries, id)
+		purged++
+	}
+	if purged == 0 {
+		return 0, nil
+	}
+	return purged, writeJSONState(t.path, t.entries)
+}
+
+// StartTrashPurger purges the trash every trashPurgeInterval in the
+// background until the server is stopped.
+func (rs *RSBackupAPI) StartTrashPurger() {
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(trashPurgeInterval)
+		defer ticker.Stop()
+		for {
+			purged, err := rs.Trash.Purge(rs.RsFileMan, time.Now())
+			if err != nil {
+				log.Errorf("Unable to purge the trash: %s", err)
+			} else if purged > 0 {
+				log.Infof("Purged %d files from the trash", purged)
+			}
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	rs.OnShutdown("trash purger", func(ctx context.Context) error {
+		close(stop)
+		select {
+		case <-done:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	})
+}
+
+type trashRsp struct {
+	Entries []TrashEntry `json:"entries"`
+}
+
+// trashHandler lists the files in the trash.
+func (rs *RSBackupAPI) trashHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		rs.Errorf(r, "Bad method %s", r.Method)
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(trashRsp{Entries: rs.Trash.List()})
+	if err != nil {
+		rs.Errorf(r, "Unable to marshal json response: %s", err)
+	}
+}
+
+// restoreHandler moves a file out of the trash, under its old name or the
+// one in the to form field. The restored file is charged to the quota of
+// the client restoring it.
+func (rs *RSBackupAPI) restoreHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		rs.Errorf(r, "Bad method %s", r.Method)
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	id, err := getURLParam(r.URL)
+	if err != nil {
+		rs.Errorf(r, "Can't restore file: %s", err)
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	entry, ok := rs.Trash.Get(id)
+	if !ok {
+		rs.Errorf(r, "Can't restore %s: %s", id, errNotInTrash)
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+	to := entry.Name
+	if value := r.FormValue("to"); value != "" {
+		to = value
+		err = validateFileName(to)
+		if err != nil {
+			rs.Errorf(r, "Can't restore %s: %s", id, err)
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+	}
+	auditObject(r, to)
+	if _, err := rs.RsFileMan.Stat(to); err == nil {
+		rs.Errorf(r, "Can't restore %s as %s: %s", id, to, errFileExists)
+		http.Error(w, http.StatusText(http.StatusConflict), http.StatusConflict)
+		return
+	}
+	namespace := requestNamespace(r)
+	if rs.Quotas != nil {
+		err = rs.Quotas.Charge(namespace, to, entry.Size)
+		if err == errQuotaExceeded {
+			rs.quotaExceeded(w, r, namespace, entry.Size)
+			return
+		}
+		if err != nil {
+			rs.Errorf(r, "Unable to charge %s to '%s': %s", to, namespace, err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+	}
+	err = rs.Trash.Restore(rs.RsFileMan, id, to)
+	if err != nil {
+		rs.Errorf(r, "Unable to restore %s as %s: %s", id, to, err)
+		if rs.Quotas != nil {
+			rs.Quotas.Release(to)
+		}
+		switch {
+		case err == errNotInTrash:
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		case err == errFileExists:
+			http.Error(w, http.StatusText(http.StatusConflict), http.StatusConflict)
+		default:
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		}
+		return
+	}
+	log.Infof("Restored %s from the trash as %s (by '%s')", entry.Name, to, namespace)
+	if to != entry.Name && rs.Annotations != nil {
+		if err := rs.Annotations.Move(entry.Name, to); err != nil {
+			log.Errorf("Unable to move annotations of %s to %s: %s", entry.Name, to, err)
+		}
+	}
+	rs.mirror(to)
+	entry.Name = to
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(entry)
+	if err != nil {
+		rs.Errorf(r, "Unable to marshal json response: %s", err)
+	}
+}
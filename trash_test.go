@@ -0,0 +1,120 @@
+package rsbackup
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTrash(t *testing.T) {
+	tmpDir := createTMPDir(t, "rsbackup")
+	conf := &Config{BackupRoot: tmpDir, DataShards: 2, ParityShards: 1, TrashRetention: time.Hour}
+	fm := &RSFileManager{Config: conf}
+	cloneShards(t, "tyger", tmpDir, conf)
+	cloneShards(t, "tyger_bad", tmpDir, conf)
+	trashPath := conf.StatePath("trash.json")
+	trash, err := NewTrash(trashPath, conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	api := &RSBackupAPI{Config: conf, RsFileMan: fm, Trash: trash}
+
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(api.deleteHandler).ServeHTTP(rr, httptest.NewRequest("POST", "/delete/tyger", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Got status code %d, expected 200", rr.Code)
+	}
+	var entry TrashEntry
+	err = json.NewDecoder(rr.Body).Decode(&entry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry.Name != "tyger" || entry.Size == 0 {
+		t.Errorf("Got trash entry %+v", entry)
+	}
+	if names, _ := fm.ListData(); len(names) != 1 || names[0] != "tyger_bad" {
+		t.Errorf("Got listing %v after delete", names)
+	}
+	// Shredded files skip the trash.
+	rr = httptest.NewRecorder()
+	http.HandlerFunc(api.deleteHandler).ServeHTTP(rr, httptest.NewRequest("POST", "/delete/tyger_bad?shred=true", nil))
+	if rr.Code != http.StatusNoContent || len(trash.List()) != 1 {
+		t.Errorf("Got status code %d and %d trash entries after shredding", rr.Code, len(trash.List()))
+	}
+
+	// The trash survives restarts.
+	api.Trash, err = NewTrash(trashPath, conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr = httptest.NewRecorder()
+	http.HandlerFunc(api.trashHandler).ServeHTTP(rr, httptest.NewRequest("GET", "/trash", nil))
+	var rsp trashRsp
+	json.NewDecoder(rr.Body).Decode(&rsp)
+	if len(rsp.Entries) != 1 || rsp.Entries[0] != entry {
+		t.Fatalf("Got trash %+v, expected %+v", rsp.Entries, entry)
+	}
+
+	cloneShards(t, "tyger_bad", tmpDir, conf)
+	restoreTests := []struct {
+		name           string
+		id             string
+		to             string
+		expectedStatus int
+	}{
+		{"unknown id", "0123456789abcdef", "", 404},
+		{"name taken", entry.ID, "tyger_bad", 409},
+		{"illegal name", entry.ID, "ti/ger", 400},
+		{"restore", entry.ID, "tiger", 200},
+		{"restored already", entry.ID, "", 404},
+	}
+	for _, tt := range restoreTests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", "/restore/"+tt.id, strings.NewReader(url.Values{"to": {tt.to}}.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			rr := httptest.NewRecorder()
+			http.HandlerFunc(api.restoreHandler).ServeHTTP(rr, req)
+			if rr.Code != tt.expectedStatus {
+				t.Errorf("Got status code %d, expected %d", rr.Code, tt.expectedStatus)
+			}
+		})
+	}
+	if healthy, _, _, err := fm.CheckData("tiger"); err != nil || !healthy {
+		t.Errorf("Restored file isn't healthy: %v", err)
+	}
+	if _, err := os.Stat(conf.StatePath("trash/" + entry.ID)); !os.IsNotExist(err) {
+		t.Errorf("Trash directory left behind: %v", err)
+	}
+}
+
+func TestTrashPurge(t *testing.T) {
+	tmpDir := createTMPDir(t, "rsbackup")
+	conf := &Config{BackupRoot: tmpDir, DataShards: 2, ParityShards: 1, TrashRetention: time.Hour}
+	fm := &RSFileManager{Config: conf}
+	cloneShards(t, "tyger", tmpDir, conf)
+	trash, err := NewTrash(conf.StatePath("trash.json"), conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry, err := trash.Put(fm, "tyger", "operator", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if purged, err := trash.Purge(fm, time.Now()); purged != 0 || err != nil {
+		t.Errorf("Purged %d files within the grace period: %v", purged, err)
+	}
+	if purged, err := trash.Purge(fm, time.Now().Add(2*time.Hour)); purged != 1 || err != nil {
+		t.Errorf("Purged %d files after the grace period: %v", purged, err)
+	}
+	if _, err := os.Stat(conf.StatePath("trash/" + entry.ID)); !os.IsNotExist(err) {
+		t.Errorf("Purged file left behind: %v", err)
+	}
+	if len(trash.List()) != 0 {
+		t.Errorf("Purged file still listed")
+	}
+}
@@ -0,0 +1,257 @@
+package rsbackup
+
+import (
+	"context"
+	"os"
+	"path"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// StorageUsage keeps count of the bytes stored under the backup root, for
+// Config.MaxStorageSize. The files are only walked when the count can't
+// be trusted: when the server starts for the first time, or wasn't shut
+// down cleanly. From then on the backend returned by Track keeps it up to
+// date as files are written and removed.
+type StorageUsage struct {
+	mu    sync.Mutex
+	path  string
+	bytes int64
+	limit int64
+}
+
+// usageState is what's persisted, Clean being false while the server
+// runs.
+type usageState struct {
+	Bytes int64
+	Clean bool
+}
+
+func NewStorageUsage(fpath string, storage StorageBackend, config *Config) (*StorageUsage, error) {
+	u := &StorageUsage{path: fpath, limit: int64(config.MaxStorageSize)}
+	var state usageState
+	err := readJSONState(fpath, &state)
+	if err != nil {
+		return nil, err
+	}
+	u.bytes = state.Bytes
+	if !state.Clean {
+		log.Infof("Counting the bytes stored under %s", config.BackupRoot)
+		u.bytes, err = countBytes(storage, config.BackupRoot)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	err = writeJSONState(fpath, usageState{Bytes: u.bytes})
+	if err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// countBytes returns the size of the files below dir.
+func countBytes(storage StorageBackend, dir string) (int64, error) {
+	names, err := storage.List(dir)
+	if err != nil {
+		return 0, err
+	}
+	var bytes int64
+	for _, name := range names {
+		fpath := path.Join(dir, name)
+		stat, err := storage.Stat(fpath)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		if !stat.IsDir() {
+			bytes += stat.Size()
+			continue
+		}
+		n, err := countBytes(storage, fpath)
+		if err != nil && !os.IsNotExist(err) {
+			return 0, err
+		}
+		bytes += n
+	}
+	return bytes, nil
+}
+
+// Bytes returns the bytes stored.
+func (u *StorageUsage) Bytes() int64 {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.bytes
+}
+
+// Limit returns Config.MaxStorageSize, 0 meaning no limit.
+func (u *StorageUsage) Limit() int64 {
+	return u.limit
+}
+
+func (u *StorageUsage) add(bytes int64) {
+	if bytes == 0 {
+		return
+	}
+	u.mu.Lock()
+	u.bytes += bytes
+	u.mu.Unlock()
+}
+
+// Close persists the count, to be trusted on the next start.
+func (u *StorageUsage) Close(context.Context) error {
+	return writeJSONState(u.path, usageState{Bytes: u.Bytes(), Clean: true})
+}
+
+// Track returns storage counting what is written to and removed from it.
+// It reports the room left under the limit as its free space, so uploads
+// past it are refused like those that don't fit on disk.
+func (u *StorageUsage) Track(storage StorageBackend) StorageBackend {
+	return &usageBackend{StorageBackend: storage, usage: u}
+}
+
+type usageBackend struct {
+	StorageBackend
+	usage *StorageUsage
+}
+
+// baseStorage returns the backend storage counts the usage of, or storage
+// itself.
+func baseStorage(storage StorageBackend) StorageBackend {
+	if tracked, ok := storage.(*usageBackend); ok {
+		return tracked.StorageBackend
+	}
+	return storage
+}
+
+func (b *usageBackend) FreeSpace(dir string) (int64, error) {
+	free := int64(-1)
+	if reporter, ok := b.StorageBackend.(spaceReporter); ok {
+		if disk, err := reporter.FreeSpace(dir); err == nil {
+			free = disk
+		}
+	}
+	if b.usage.limit <= 0 {
+		if free < 0 {
+			return 0, errFreeSpaceUnknown
+		}
+		return free, nil
+	}
+	left := b.usage.limit - b.usage.Bytes()
+	if left < 0 {
+		left = 0
+	}
+	if free < 0 || left < free {
+		free = left
+	}
+	return free, nil
+}
+
+func (b *usageBackend) OpenWritable(fpath string) (StorageFile, error) {
+	f, err := b.StorageBackend.OpenWritable(fpath)
+	if err != nil {
+		return nil, err
+	}
+	stat, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &usageFile{StorageFile: f, usage: b.usage, size: stat.Size()}, nil
+}
+
+func (b *usageBackend) CreateExclusive(fpath string) (StorageFile, error) {
+	f, err := b.StorageBackend.CreateExclusive(fpath)
+	if err != nil {
+		return nil, err
+	}
+	return &usageFile{StorageFile: f, usage: b.usage}, nil
+}
+
+// fileSize returns the size of fpath if it's a file, 0 otherwise.
+func (b *usageBackend) fileSize(fpath string) int64 {
+	stat, err := b.StorageBackend.Stat(fpath)
+	if err != nil || stat.IsDir() {
+		return 0
+	}
+	return stat.Size()
+}
+
+func (b *usageBackend) Remove(fpath string) error {
+	size := b.fileSize(fpath)
+	err := b.StorageBackend.Remove(fpath)
+	if err == nil {
+		b.usage.add(-size)
+	}
+	return err
+}
+
+// Rename counts the file it replaces at to as removed.
+func (b *usageBackend) Rename(from, to string) error {
+	replaced := b.fileSize(to)
+	err := b.StorageBackend.Rename(from, to)
+	if err == nil {
+		b.usage.add(-replaced)
+	}
+	return err
+}
+
+// storeLocal is storeLocal for the local file src, which isn't counted
+// yet.
+func (b *usageBackend) storeLocal(src, dst string) error {
+	stat, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	replaced := b.fileSize(dst)
+	err = storeLocal(b.StorageBackend, src, dst)
+	if err == nil {
+		b.usage.add(stat.Size() - replaced)
+	}
+	return err
+}
+
+// usageFile counts the bytes files grow and shrink by.
+type usageFile struct {
+	StorageFile
+	usage *StorageUsage
+	// size is the size of the file and pos the offset of the next read
+	// or write.
+	size int64
+	pos  int64
+}
+
+func (f *usageFile) Read(p []byte) (int, error) {
+	n, err := f.StorageFile.Read(p)
+	f.pos += int64(n)
+	return n, err
+}
+
+func (f *usageFile) Write(p []byte) (int, error) {
+	n, err := f.StorageFile.Write(p)
+	f.pos += int64(n)
+	if f.pos > f.size {
+		f.usage.add(f.pos - f.size)
+		f.size = f.pos
+	}
+	return n, err
+}
+
+func (f *usageFile) Seek(offset int64, whence int) (int64, error) {
+	pos, err := f.StorageFile.Seek(offset, whence)
+	if err == nil {
+		f.pos = pos
+	}
+	return pos, err
+}
+
+func (f *usageFile) Truncate(size int64) error {
+	err := f.StorageFile.Truncate(size)
+	if err == nil {
+		f.usage.add(size - f.size)
+		f.size = size
+	}
+	return err
+}
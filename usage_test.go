@@ -0,0 +1,89 @@
+package rsbackup
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"testing"
+)
+
+func TestStorageUsage(t *testing.T) {
+	tmpDir := createTMPDir(t, "rsbackup")
+	stateDir := createTMPDir(t, "rsbackup-state")
+	statePath := path.Join(stateDir, "usage.json")
+	conf := &Config{BackupRoot: tmpDir, DataShards: 2, ParityShards: 1, MaxStorageSize: 3000}
+	open := func() (*StorageUsage, *RSBackupAPI) {
+		usage, err := NewStorageUsage(statePath, OSBackend{}, conf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fm := &RSFileManager{Config: conf, Storage: usage.Track(OSBackend{})}
+		return usage, &RSBackupAPI{Config: conf, RsFileMan: fm, Usage: usage}
+	}
+	submit := func(api *RSBackupAPI, fname string, size int) *httptest.ResponseRecorder {
+		body := new(bytes.Buffer)
+		mw := multipart.NewWriter(body)
+		fw, _ := mw.CreateFormFile("file", fname)
+		fw.Write(bytes.Repeat([]byte("a"), size))
+		mw.WriteField("filename", fname)
+		mw.Close()
+		req := httptest.NewRequest("POST", "/submit_data", body)
+		req.Header.Set("Content-Type", mw.FormDataContentType())
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(api.submitDataHandler).ServeHTTP(rr, req)
+		return rr
+	}
+	assertUsage := func(usage *StorageUsage) {
+		t.Helper()
+		counted, err := countBytes(OSBackend{}, tmpDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if usage.Bytes() != counted {
+			t.Errorf("Got usage %d, %d bytes stored", usage.Bytes(), counted)
+		}
+	}
+
+	usage, api := open()
+	if rr := submit(api, "first", 300); rr.Code != http.StatusOK {
+		t.Fatalf("Got status code %d", rr.Code)
+	}
+	if rr := submit(api, "second", 300); rr.Code != http.StatusOK {
+		t.Fatalf("Got status code %d", rr.Code)
+	}
+	assertUsage(usage)
+	if err := api.RsFileMan.Delete("first", false, false); err != nil {
+		t.Fatal(err)
+	}
+	assertUsage(usage)
+
+	// Another 1000 bytes with their parity don't fit under the cap.
+	rr := submit(api, "big", 1000)
+	var rsp diskSpaceRsp
+	if rr.Code != http.StatusInsufficientStorage || json.NewDecoder(rr.Body).Decode(&rsp) != nil {
+		t.Fatalf("Got status code %d past the cap", rr.Code)
+	}
+	if rsp.Available == nil || *rsp.Available != 3000-usage.Bytes() {
+		t.Errorf("Got response %+v with %d bytes stored", rsp, usage.Bytes())
+	}
+	assertUsage(usage)
+
+	// The count is trusted after a clean shutdown only.
+	stored := usage.Bytes()
+	if err := usage.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeJSONState(statePath, usageState{Bytes: 1, Clean: true}); err != nil {
+		t.Fatal(err)
+	}
+	if usage, _ = open(); usage.Bytes() != 1 {
+		t.Errorf("Got usage %d after a clean shutdown, expected the persisted count", usage.Bytes())
+	}
+	if usage, _ = open(); usage.Bytes() != stored {
+		t.Errorf("Got usage %d after an unclean shutdown, expected the %d bytes stored", usage.Bytes(), stored)
+	}
+}
@@ -0,0 +1,67 @@
+package rsbackup
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// User metadata is submitted in form fields named userMetadataField and
+// the key, and retrieved in headers named userMetadataHeader and the key.
+const (
+	userMetadataField  = "meta_"
+	userMetadataHeader = "Meta-"
+	// maxUserMetadataBytes bounds the keys and values of a file together,
+	// like S3 does.
+	maxUserMetadataBytes = 2 << 10
+)
+
+// userMetadataKey is what keys look like. Header names are case
+// insensitive, so keys are lower case.
+var userMetadataKey = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,63}$`)
+
+// userMetadataParams reads the user metadata of a submission, opaque
+// key/value pairs such as meta_source-host=web01, or returns nil if there
+// is none.
+func userMetadataParams(r *http.Request) (map[string]string, error) {
+	var meta map[string]string
+	total := 0
+	for field, values := range r.Form {
+		if !strings.HasPrefix(field, userMetadataField) {
+			continue
+		}
+		key := strings.ToLower(strings.TrimPrefix(field, userMetadataField))
+		if !userMetadataKey.MatchString(key) {
+			return nil, fmt.Errorf("Bad user metadata key '%s'", key)
+		}
+		if len(values) != 1 {
+			return nil, fmt.Errorf("User metadata %s is given %d times", key, len(values))
+		}
+		if err := checkHeaderValue(field, values[0]); err != nil {
+			return nil, err
+		}
+		total += len(key) + len(values[0])
+		if total > maxUserMetadataBytes {
+			return nil, fmt.Errorf("User metadata takes more than %d bytes", maxUserMetadataBytes)
+		}
+		if meta == nil {
+			meta = make(map[string]string)
+		}
+		meta[key] = values[0]
+	}
+	return meta, nil
+}
+
+// setUserMetadataHeaders sends meta back with a retrieval.
+func setUserMetadataHeaders(h http.Header, meta map[string]string) {
+	keys := make([]string, 0, len(meta))
+	for key := range meta {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		h.Set(userMetadataHeader+key, meta[key])
+	}
+}
@@ -0,0 +1,65 @@
+package rsbackup
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestUserMetadata(t *testing.T) {
+	tmpDir := createTMPDir(t, "rsbackup")
+	config := &Config{BackupRoot: tmpDir, DataShards: 2, ParityShards: 1}
+	api := &RSBackupAPI{Config: config, RsFileMan: &RSFileManager{Config: config}}
+	submit := func(fname string, fields map[string]string) *httptest.ResponseRecorder {
+		body := new(bytes.Buffer)
+		mw := multipart.NewWriter(body)
+		fw, _ := mw.CreateFormFile("file", fname)
+		fw.Write([]byte("in the forests of the night"))
+		mw.WriteField("filename", fname)
+		for name, value := range fields {
+			mw.WriteField(name, value)
+		}
+		mw.Close()
+		req := httptest.NewRequest("POST", "/submit_data", body)
+		req.Header.Set("Content-Type", mw.FormDataContentType())
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(api.submitDataHandler).ServeHTTP(rr, req)
+		return rr
+	}
+	expected := map[string]string{"source-host": "web01.example.com", "tool-version": "restic 0.16.2"}
+
+	rr := submit("tyger", map[string]string{"meta_source-host": "web01.example.com", "meta_Tool-Version": "restic 0.16.2"})
+	var submitRsp submitDataRsp
+	if rr.Code != http.StatusOK || json.NewDecoder(rr.Body).Decode(&submitRsp) != nil || !reflect.DeepEqual(submitRsp.UserMetadata, expected) {
+		t.Fatalf("Got status code %d and user metadata %v", rr.Code, submitRsp.UserMetadata)
+	}
+	for name, fields := range map[string]map[string]string{
+		"bad key":     {"meta_source_host": "web01"},
+		"bad value":   {"meta_source-host": "web01\n"},
+		"too large":   {"meta_a": strings.Repeat("a", 1024), "meta_b": strings.Repeat("b", 1024)},
+		"unprintable": {"meta_note": "café"},
+	} {
+		if rr := submit("lamb", fields); rr.Code != http.StatusBadRequest {
+			t.Errorf("Got status code %d submitting %s", rr.Code, name)
+		}
+	}
+
+	req := httptest.NewRequest("GET", "/check_data/tyger", nil)
+	rr = httptest.NewRecorder()
+	http.HandlerFunc(api.checkDataHandler).ServeHTTP(rr, req)
+	var checkRsp checkDataRsp
+	if rr.Code != http.StatusOK || json.NewDecoder(rr.Body).Decode(&checkRsp) != nil || !reflect.DeepEqual(checkRsp.UserMetadata, expected) {
+		t.Errorf("Got status code %d and user metadata %v checking", rr.Code, checkRsp.UserMetadata)
+	}
+	req = httptest.NewRequest("GET", "/retrieve_data/tyger", nil)
+	rr = httptest.NewRecorder()
+	http.HandlerFunc(api.retrieveDataHandler).ServeHTTP(rr, req)
+	if rr.Header().Get("Meta-Source-Host") != "web01.example.com" || rr.Header().Get("Meta-Tool-Version") != "restic 0.16.2" {
+		t.Errorf("Got headers %v retrieving", rr.Header())
+	}
+}
@@ -0,0 +1,40 @@
+package rsbackup
+
+import (
+	"bufio"
+	"io"
+)
+
+// defaultIOBufferSize is the buffer io.Copy uses when none is configured.
+const defaultIOBufferSize = 32 << 10
+
+// storedAsIs reports whether a file with extras is stored as its contents,
+// so it can be served straight from its data file.
+func (e MetadataExtras) storedAsIs() bool {
+	return e.Packed == nil && e.Encryption == nil && e.Compression == nil && e.Dedup == nil && e.Sparse == nil
+}
+
+// bufferedReadSeeker reads src in reads of the size of its buffer, however
+// small the reads made of it, which suits decrypting and decompressing
+// readers, and forgets what it buffered when it seeks.
+type bufferedReadSeeker struct {
+	src io.ReadSeeker
+	buf *bufio.Reader
+}
+
+func newBufferedReadSeeker(src io.ReadSeeker, size int) *bufferedReadSeeker {
+	return &bufferedReadSeeker{src: src, buf: bufio.NewReaderSize(src, size)}
+}
+
+func (b *bufferedReadSeeker) Read(p []byte) (int, error) {
+	return b.buf.Read(p)
+}
+
+func (b *bufferedReadSeeker) Seek(offset int64, whence int) (int64, error) {
+	if whence == io.SeekCurrent {
+		offset -= int64(b.buf.Buffered())
+	}
+	pos, err := b.src.Seek(offset, whence)
+	b.buf.Reset(b.src)
+	return pos, err
+}
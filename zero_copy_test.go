@@ -0,0 +1,73 @@
+package rsbackup
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestBufferedReadSeeker(t *testing.T) {
+	content := strings.Repeat("tyger tyger burning bright ", 10)
+	b := newBufferedReadSeeker(strings.NewReader(content), 16)
+	p := make([]byte, 6)
+	if _, err := io.ReadFull(b, p); err != nil || string(p) != "tyger " {
+		t.Fatalf("Read '%s' (error: %v)", p, err)
+	}
+	if pos, err := b.Seek(0, io.SeekCurrent); err != nil || pos != 6 {
+		t.Fatalf("Got position %d (error: %v)", pos, err)
+	}
+	if _, err := b.Seek(-7, io.SeekEnd); err != nil {
+		t.Fatal(err)
+	}
+	rest, err := ioutil.ReadAll(b)
+	if err != nil || string(rest) != "bright " {
+		t.Errorf("Read '%s' (error: %v) after seeking", rest, err)
+	}
+}
+
+func TestRetrieveBuffered(t *testing.T) {
+	config := &Config{BackupRoot: createTMPDir(t, "rsbackup"), DataShards: 2, ParityShards: 1, ReadBufferSize: 4 << 10}
+	fm := &RSFileManager{Config: config}
+	api := &RSBackupAPI{Config: config, RsFileMan: fm}
+	content := strings.Repeat("tyger tyger burning bright ", 1000)
+	for _, compression := range []string{"", compressionZstd} {
+		config.Compression = compression
+		var extras MetadataExtras
+		if _, err := fm.SaveFile(strings.NewReader(content), "tyger", &extras); err != nil {
+			t.Fatal(err)
+		}
+		md, err := api.generateParity(fm.storage(), fm.DataPath("tyger"), &extras)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := fm.WriteMetadata("tyger", md, extras); err != nil {
+			t.Fatal(err)
+		}
+		// Over a connection, so stored files go through sendfile.
+		srv := httptest.NewServer(http.HandlerFunc(api.retrieveDataHandler))
+		for _, byteRange := range []string{"", "bytes=6-11", "bytes=-7"} {
+			req, _ := http.NewRequest("GET", srv.URL+"/retrieve_data/tyger", nil)
+			want := content
+			if byteRange != "" {
+				req.Header.Set("Range", byteRange)
+				want = map[string]string{"bytes=6-11": "tyger ", "bytes=-7": "bright "}[byteRange]
+			}
+			rsp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, err := ioutil.ReadAll(rsp.Body)
+			rsp.Body.Close()
+			if err != nil || string(body) != want {
+				t.Errorf("Got %d bytes (error: %v) for range '%s' with compression '%s'", len(body), err, byteRange, compression)
+			}
+		}
+		srv.Close()
+		if err := fm.Delete("tyger", false, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+}